@@ -63,17 +63,23 @@ if [ "$DEBUG" = true ]; then
     BINARY_NAME="${BINARY_NAME}-debug"
 fi
 
+# Version info embedded in the binary, shown by "version" and /version
+VERSION_PKG="alt-text-generator/internal/version"
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+COMMIT=$(git rev-parse HEAD 2>/dev/null || echo "")
+BUILD_DATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+LDFLAGS="-X $VERSION_PKG.Version=$VERSION -X $VERSION_PKG.Commit=$COMMIT -X $VERSION_PKG.Date=$BUILD_DATE"
+
 # Build flags
-BUILD_FLAGS=""
 if [ "$DEBUG" = false ]; then
-    BUILD_FLAGS="-ldflags=-w -ldflags=-s"
+    LDFLAGS="-w -s $LDFLAGS"
 fi
 
 echo -e "${BLUE}Running go mod tidy...${NC}"
 go mod tidy
 
 echo -e "${BLUE}Building binary...${NC}"
-if go build $BUILD_FLAGS -o "$OUTPUT_DIR/$BINARY_NAME" cmd/server/main.go; then
+if go build -ldflags "$LDFLAGS" -o "$OUTPUT_DIR/$BINARY_NAME" ./cmd/server; then
     echo -e "${GREEN}Build successful!${NC}"
     echo -e "Binary location: $OUTPUT_DIR/$BINARY_NAME"
     
@@ -81,7 +87,7 @@ if go build $BUILD_FLAGS -o "$OUTPUT_DIR/$BINARY_NAME" cmd/server/main.go; then
     if [ ! -z "$MODE" ]; then
         RUN_SCRIPT="$OUTPUT_DIR/run.sh"
         echo "#!/bin/bash" > "$RUN_SCRIPT"
-        echo "./$BINARY_NAME -$MODE" >> "$RUN_SCRIPT"
+        echo "./$BINARY_NAME serve -$MODE" >> "$RUN_SCRIPT"
         chmod +x "$RUN_SCRIPT"
         echo -e "${GREEN}Created run script: $RUN_SCRIPT${NC}"
     fi
@@ -95,6 +101,6 @@ echo -e "\n${BLUE}Usage instructions:${NC}"
 if [ ! -z "$MODE" ]; then
     echo -e "Run the application with: ${GREEN}./bin/run.sh${NC}"
 else
-    echo -e "Run the application with: ${GREEN}./bin/$BINARY_NAME -openai${NC}"
-    echo -e "                     or: ${GREEN}./bin/$BINARY_NAME -anthropic${NC}"
+    echo -e "Run the application with: ${GREEN}./bin/$BINARY_NAME serve -openai${NC}"
+    echo -e "                     or: ${GREEN}./bin/$BINARY_NAME serve -anthropic${NC}"
 fi
\ No newline at end of file
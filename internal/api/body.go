@@ -0,0 +1,93 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// imagePlaceholder stands in for an image's base64 encoding in a request
+// body until it's sent. It's random so no prompt text can contain it.
+var imagePlaceholder = func() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "image-" + hex.EncodeToString(b)
+}()
+
+// imageBody is a JSON request body holding an image. The image is encoded
+// to base64 as the body is sent rather than beforehand, so a request holds
+// one copy of it, the raw bytes, instead of those plus the encoded string
+// plus the marshalled JSON.
+type imageBody struct {
+	prefix, suffix []byte
+	image          []byte
+}
+
+// newImageBody marshals v, which holds imagePlaceholder where the image's
+// encoding belongs
+func newImageBody(v interface{}, image []byte) (*imageBody, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	prefix, suffix, ok := bytes.Cut(data, []byte(imagePlaceholder))
+	if !ok {
+		return nil, errors.New("request body has no place for the image")
+	}
+	return &imageBody{prefix: prefix, suffix: suffix, image: image}, nil
+}
+
+// size is the length of the body once the image is encoded
+func (b *imageBody) size() int64 {
+	return int64(len(b.prefix) + base64.StdEncoding.EncodedLen(len(b.image)) + len(b.suffix))
+}
+
+// reader returns a new reader over the body. The JSON and the image are
+// written through a base64 encoder into a pipe as the transport reads it.
+// Closing the reader, as the transport always does, stops the writing.
+func (b *imageBody) reader() io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(b.writeTo(w))
+	}()
+	return r
+}
+
+// writeTo writes the body to w, encoding the image on the way
+func (b *imageBody) writeTo(w io.Writer) error {
+	if _, err := w.Write(b.prefix); err != nil {
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := enc.Write(b.image); err != nil {
+		return err
+	}
+	// Close flushes the final partial block and its padding
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	_, err := w.Write(b.suffix)
+	return err
+}
+
+// newImageRequest returns a POST request to url with body, which is encoded
+// as it's sent and can be sent again if the transport retries
+func newImageRequest(ctx context.Context, url string, body *imageBody) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = body.reader()
+	req.ContentLength = body.size()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return body.reader(), nil
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+
+	"alt-text-generator/internal/config"
+)
+
+// defaultExtraCalls is how many extra provider calls a generation may make
+// unless configured otherwise
+const defaultExtraCalls = 2
+
+type (
+	extraCallsKey struct{}
+	extraCallKey  struct{}
+)
+
+// MaxExtraCalls returns how many provider calls one generation may make
+// beyond its first and its candidates: asking again for shorter, simpler,
+// objective, or filtered text, and grading it
+func MaxExtraCalls() int {
+	return max(config.GetInt("ALT_TEXT_MAX_EXTRA_CALLS", defaultExtraCalls), 0)
+}
+
+// withExtraCallLimit gives each generation MaxExtraCalls to share between
+// the wrappers that call the provider again. It goes outside every other
+// wrapper, so they all draw on the same count.
+func (p Provider) withExtraCallLimit() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		return generate(withExtraCalls(ctx), image)
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			return stream(withExtraCalls(ctx), image, onDelta)
+		}
+	}
+	return p
+}
+
+// withExtraCalls returns a copy of ctx allowing MaxExtraCalls, unless ctx
+// already has a count, as for a generation inside another
+func withExtraCalls(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(extraCallsKey{}).(*atomic.Int32); ok {
+		return ctx
+	}
+	left := new(atomic.Int32)
+	left.Store(int32(MaxExtraCalls()))
+	return context.WithValue(ctx, extraCallsKey{}, left)
+}
+
+// extraCall takes one of the generation's extra calls, for the reason given,
+// and returns the context to make it with. An extra call runs the provider
+// once: it doesn't sample other candidates or make extra calls of its own.
+// ok is false once the generation has none left, or inside an extra call.
+func extraCall(ctx context.Context, reason string) (_ context.Context, ok bool) {
+	if isExtraCall(ctx) {
+		return ctx, false
+	}
+	if left, counted := ctx.Value(extraCallsKey{}).(*atomic.Int32); counted && left.Add(-1) < 0 {
+		slog.InfoContext(ctx, "Skipping extra provider call; the generation has made as many as allowed", "reason", reason, "max_extra_calls", MaxExtraCalls())
+		return ctx, false
+	}
+	return context.WithValue(ctx, extraCallKey{}, true), true
+}
+
+// isExtraCall reports whether ctx is for an extra call
+func isExtraCall(ctx context.Context) bool {
+	extra, _ := ctx.Value(extraCallKey{}).(bool)
+	return extra
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingProvider answers with text too long for a 20 character limit, or
+// a rating when asked to grade, counting its calls
+func countingProvider(calls *atomic.Int32) Provider {
+	return Provider{
+		Name: "counting",
+		Generate: func(ctx context.Context, image []byte) (Result, error) {
+			n := calls.Add(1)
+			if _, grading := gradingPrompt(ctx); grading {
+				return Result{Text: "80", InputTokens: 1}, nil
+			}
+			return Result{Text: "1. A very long description of take " + strings.Repeat("x", int(n)), InputTokens: 1}, nil
+		},
+	}.withOptions()
+}
+
+func TestExtraCallLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates string
+		extra      string
+		// calls is how many times the provider should be called
+		calls int32
+	}{
+		{"shorten and grade", "1", "", 3},
+		{"no extra calls", "1", "0", 1},
+		{"one extra call", "1", "1", 2},
+		{"extra calls don't resample candidates", "3", "", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ALT_TEXT_MAX_LENGTH", "20")
+			t.Setenv("ALT_TEXT_GRADER", "true")
+			t.Setenv("ALT_TEXT_FILTERS", "")
+			t.Setenv("ALT_TEXT_CANDIDATES", tt.candidates)
+			t.Setenv("ALT_TEXT_MAX_EXTRA_CALLS", tt.extra)
+
+			var calls atomic.Int32
+			result, err := countingProvider(&calls).Generate(context.Background(), []byte("image"))
+			if err != nil {
+				t.Fatalf("Generate: %v", err)
+			}
+			if got := calls.Load(); got != tt.calls {
+				t.Errorf("provider called %d times, want %d", got, tt.calls)
+			}
+			if result.InputTokens != int(tt.calls) {
+				t.Errorf("tokens from %d calls, want %d", result.InputTokens, tt.calls)
+			}
+			if longest := longestOption(result.Text); longest > 20 {
+				t.Errorf("option of %d characters left over the limit", longest)
+			}
+		})
+	}
+}
+
+func TestExtraCall(t *testing.T) {
+	t.Setenv("ALT_TEXT_MAX_EXTRA_CALLS", "1")
+	ctx := withExtraCalls(context.Background())
+	if withExtraCalls(ctx) != ctx {
+		t.Error("a generation inside another got its own count")
+	}
+	extra, ok := extraCall(ctx, "first")
+	if !ok || !isExtraCall(extra) {
+		t.Fatal("first extra call refused")
+	}
+	if _, ok := extraCall(extra, "nested"); ok {
+		t.Error("extra call made from inside another")
+	}
+	if _, ok := extraCall(ctx, "second"); ok {
+		t.Error("second extra call allowed with a limit of 1")
+	}
+	if Candidates(WithCandidates(extra, 3)) != 1 {
+		t.Error("extra call samples more than one candidate")
+	}
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"alt-text-generator/internal/config"
+)
+
+// MaxCandidates caps how many generations one request may ask for
+const MaxCandidates = 5
+
+type candidatesKey struct{}
+
+// WithCandidates returns a copy of ctx whose generations sample the model n
+// times, whatever the configured default
+func WithCandidates(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, candidatesKey{}, n)
+}
+
+// Candidates returns how many times generations for ctx sample the model,
+// from 1 to MaxCandidates. A translation, or an extra call such as asking
+// again for shorter text, is asked for once.
+func Candidates(ctx context.Context) int {
+	if Translating(ctx) || isExtraCall(ctx) {
+		return 1
+	}
+	n, ok := ctx.Value(candidatesKey{}).(int)
+	if !ok {
+		n = config.GetInt("ALT_TEXT_CANDIDATES", 1)
+	}
+	return min(max(n, 1), MaxCandidates)
+}
+
+// CheckCandidates returns an error if n is outside 1 to MaxCandidates
+func CheckCandidates(n int) error {
+	if n < 1 || n > MaxCandidates {
+		return fmt.Errorf("candidates must be from 1 to %d", MaxCandidates)
+	}
+	return nil
+}
+
+// withCandidates samples the model as many times as Candidates asks, at
+// once, and offers every distinct option among the takes. The description,
+// keywords, and structured fields come from the first take. A stream shows
+// the first take as it arrives; the others are added when it ends.
+func (p Provider) withCandidates() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		n := Candidates(ctx)
+		if n == 1 {
+			return generate(ctx, image)
+		}
+		extra := sampleExtra(ctx, generate, image, n-1)
+		result, err := generate(ctx, image)
+		if err != nil {
+			return result, err
+		}
+		return mergeCandidates(ctx, result, <-extra), nil
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			n := Candidates(ctx)
+			if n == 1 {
+				return stream(ctx, image, onDelta)
+			}
+			extra := sampleExtra(ctx, generate, image, n-1)
+			result, err := stream(ctx, image, onDelta)
+			if err != nil {
+				return result, err
+			}
+			return mergeCandidates(ctx, result, <-extra), nil
+		}
+	}
+	return p
+}
+
+// sampleExtra calls generate n times concurrently, delivering the successful
+// results once all have finished. With a fixed seed, each take gets the next
+// one, since the same seed would give the same text.
+func sampleExtra(ctx context.Context, generate func(context.Context, []byte) (Result, error), image []byte, n int) <-chan []Result {
+	done := make(chan []Result, 1)
+	sampling := SamplingFrom(ctx)
+	go func() {
+		results := make([]Result, n)
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				takeCtx := ctx
+				if sampling.Seed != nil {
+					s, seed := sampling, *sampling.Seed+int64(i)+1
+					s.Seed = &seed
+					takeCtx = WithSampling(ctx, s)
+				}
+				results[i], errs[i] = generate(takeCtx, image)
+			}()
+		}
+		wg.Wait()
+		var ok []Result
+		for i, err := range errs {
+			if err != nil {
+				slog.WarnContext(ctx, "Error generating an extra candidate; leaving it out", "err", err)
+				continue
+			}
+			ok = append(ok, results[i])
+		}
+		done <- ok
+	}()
+	return done
+}
+
+// mergeCandidates adds the options of extra takes to result's, renumbered
+// and without repeats, and counts their tokens
+func mergeCandidates(ctx context.Context, result Result, extra []Result) Result {
+	var options []string
+	for i, take := range append([]Result{result}, extra...) {
+		if i > 0 {
+			result.InputTokens += take.InputTokens
+			result.OutputTokens += take.OutputTokens
+		}
+		for _, line := range strings.Split(take.Text, "\n") {
+			option := optionNumber.ReplaceAllString(strings.TrimSpace(line), "")
+			if option != "" && !slices.ContainsFunc(options, func(o string) bool { return strings.EqualFold(o, option) }) {
+				options = append(options, option)
+			}
+		}
+	}
+	var numbered strings.Builder
+	for i, option := range options {
+		fmt.Fprintf(&numbered, "%d. %s\n", i+1, option)
+	}
+	result.Text = strings.TrimSpace(numbered.String())
+	slog.DebugContext(ctx, "Merged candidates", "takes", len(extra)+1, "options", len(options))
+	return result
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"alt-text-generator/internal/config"
+)
+
+// dataTableLabel introduces a chart's data table in a response
+const dataTableLabel = "data table:"
+
+var (
+	// tableElement matches the first HTML table in a response
+	tableElement = regexp.MustCompile(`(?is)<table\b.*</table>`)
+	// htmlTag matches an HTML tag, capturing its name
+	htmlTag = regexp.MustCompile(`</?([a-zA-Z][a-zA-Z0-9]*)\b[^>]*>`)
+	// scopeAttr matches the one attribute kept on table cells
+	scopeAttr = regexp.MustCompile(`(?i)\bscope\s*=\s*"(row|col|rowgroup|colgroup)"`)
+)
+
+// tableTags are the elements kept in a data table; anything else is removed,
+// so the table is safe to insert into a page
+var tableTags = map[string]bool{
+	"table": true, "caption": true, "thead": true, "tbody": true, "tfoot": true,
+	"tr": true, "th": true, "td": true,
+}
+
+type chartsKey struct{}
+
+// WithCharts returns a copy of ctx whose generations do or don't use chart
+// mode, whatever the configured default
+func WithCharts(ctx context.Context, on bool) context.Context {
+	return context.WithValue(ctx, chartsKey{}, on)
+}
+
+// ChartsWanted reports whether generations for ctx use chart mode: charts
+// and graphs get alt text summarising their trend, and an HTML table of
+// their data in the long description
+func ChartsWanted(ctx context.Context) bool {
+	if on, ok := ctx.Value(chartsKey{}).(bool); ok {
+		return on
+	}
+	return config.GetBool("ALT_TEXT_CHARTS", false)
+}
+
+// withCharts moves any data table in the provider's responses out of the
+// alt text and onto the end of Result.Description
+func (p Provider) withCharts() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		return takeDataTable(result), err
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			result, err := stream(ctx, image, onDelta)
+			return takeDataTable(result), err
+		}
+	}
+	return p
+}
+
+// takeDataTable moves a "Data table:" section out of result's text and adds
+// its table to the long description
+func takeDataTable(result Result) Result {
+	i := strings.Index(strings.ToLower(result.Text), dataTableLabel)
+	if i < 0 {
+		return result
+	}
+	// Drop any emphasis or heading marks the model put before the label
+	options := strings.TrimRight(result.Text[:i], "*_# \n")
+	table := sanitizeTable(result.Text[i+len(dataTableLabel):])
+	result.Text = strings.TrimSpace(options)
+	result.Description = addDataTable(result.Description, table)
+	return result
+}
+
+// addDataTable appends table to a long description
+func addDataTable(description, table string) string {
+	if table == "" {
+		return description
+	}
+	if description == "" {
+		return table
+	}
+	return description + "\n\n" + table
+}
+
+// sanitizeTable returns the first HTML table in text with every element but
+// the table's own, and every attribute but scope, removed, or "" if there
+// is no table
+func sanitizeTable(text string) string {
+	table := tableElement.FindString(text)
+	if table == "" {
+		return ""
+	}
+	return htmlTag.ReplaceAllStringFunc(table, func(tag string) string {
+		name := strings.ToLower(htmlTag.FindStringSubmatch(tag)[1])
+		if !tableTags[name] {
+			return ""
+		}
+		if strings.HasPrefix(tag, "</") {
+			return "</" + name + ">"
+		}
+		if scope := scopeAttr.FindStringSubmatch(tag); scope != nil && (name == "th" || name == "td") {
+			return "<" + name + ` scope="` + strings.ToLower(scope[1]) + `">`
+		}
+		return "<" + name + ">"
+	})
+}
@@ -1,133 +1,248 @@
 package api
 
 import (
-	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
+
+	"alt-text-generator/internal/config"
 )
 
-const claudeAPIURL = "https://api.anthropic.com/v1/messages"
+const (
+	claudeAPIURL = "https://api.anthropic.com/v1/messages"
+	claudeModel  = "claude-3-opus-20240229"
+	// claudeMaxTemperature is the highest temperature Anthropic accepts
+	claudeMaxTemperature = 1
+)
 
-func GenerateAltTextClaude(encodedImage string) (string, error) {
-	log.Println("Reading Anthropic API key from environment variables")
-	anthropicAPIKey := os.Getenv("ANTHROPIC_API_KEY")
-	if anthropicAPIKey == "" {
-		log.Println("Anthropic API key is not set in environment variables")
-		return "", fmt.Errorf("Anthropic API key is not set in environment variables")
+func GenerateAltTextClaude(ctx context.Context, image []byte) (Result, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	req, err := newClaudeRequest(ctx, image, false)
+	if err != nil {
+		return Result{}, err
+	}
+
+	slog.InfoContext(ctx, "Sending request to Anthropic API")
+	resp, err := send(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error making request to Anthropic API", "err", err)
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+
+	slog.InfoContext(ctx, "Successfully received response from Anthropic API")
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading response body", "err", err)
+		return Result{}, err
+	}
+
+	slog.DebugContext(ctx, "Provider response", "body", string(body))
+
+	// If we received an error response, parse and return it
+	if strings.Contains(string(body), "error") {
+		if err := parseClaudeError(body); err != nil {
+			return Result{}, err
+		}
+	}
+
+	var claudeResp struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		Usage claudeUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &claudeResp); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling response JSON", "err", err)
+		return Result{}, err
+	}
+
+	if len(claudeResp.Content) > 0 {
+		slog.InfoContext(ctx, "Successfully extracted response from Claude")
+		return Result{
+			Text:         claudeResp.Content[0].Text,
+			InputTokens:  claudeResp.Usage.InputTokens,
+			OutputTokens: claudeResp.Usage.OutputTokens,
+		}, nil
+	}
+	slog.InfoContext(ctx, "No response from Claude")
+	return Result{}, fmt.Errorf("No response from Claude")
+}
+
+// StreamAltTextClaude requests a streamed response, calling onDelta with each
+// text fragment as it arrives, and returns the full text once complete
+func StreamAltTextClaude(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	req, err := newClaudeRequest(ctx, image, true)
+	if err != nil {
+		return Result{}, err
+	}
+
+	slog.InfoContext(ctx, "Sending streaming request to Anthropic API")
+	resp, err := send(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error making request to Anthropic API", "err", err)
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		slog.DebugContext(ctx, "Provider response", "body", string(body))
+		if err := parseClaudeError(body); err != nil {
+			return Result{}, err
+		}
+		return Result{}, fmt.Errorf("API error: unexpected status %s", resp.Status)
 	}
-	log.Println("Successfully read Anthropic API key")
 
-	// Decode base64 image to get media type
-	imageData, err := base64.StdEncoding.DecodeString(encodedImage)
+	var text strings.Builder
+	var usage claudeUsage
+	err = readSSE(resp.Body, func(event, data string) error {
+		switch event {
+		case "message_start":
+			var start struct {
+				Message struct {
+					Usage claudeUsage `json:"usage"`
+				} `json:"message"`
+			}
+			if err := json.Unmarshal([]byte(data), &start); err != nil {
+				return err
+			}
+			usage.InputTokens = start.Message.Usage.InputTokens
+		case "message_delta":
+			var delta struct {
+				Usage claudeUsage `json:"usage"`
+			}
+			if err := json.Unmarshal([]byte(data), &delta); err != nil {
+				return err
+			}
+			usage.OutputTokens = delta.Usage.OutputTokens
+		case "content_block_delta":
+			var delta struct {
+				Delta struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				} `json:"delta"`
+			}
+			if err := json.Unmarshal([]byte(data), &delta); err != nil {
+				return err
+			}
+			if delta.Delta.Type == "text_delta" && delta.Delta.Text != "" {
+				text.WriteString(delta.Delta.Text)
+				onDelta(delta.Delta.Text)
+			}
+		case "error":
+			if err := parseClaudeError([]byte(data)); err != nil {
+				return err
+			}
+			return fmt.Errorf("API error: %s", data)
+		}
+		return nil
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to decode base64 image: %v", err)
+		slog.ErrorContext(ctx, "Error reading Anthropic stream", "err", err)
+		// The tokens used before the stream broke off are still paid for
+		return Result{InputTokens: usage.InputTokens, OutputTokens: usage.OutputTokens}, err
+	}
+
+	if text.Len() == 0 {
+		slog.InfoContext(ctx, "No response from Claude")
+		return Result{}, fmt.Errorf("No response from Claude")
 	}
+	slog.InfoContext(ctx, "Successfully streamed response from Claude")
+	return Result{Text: text.String(), InputTokens: usage.InputTokens, OutputTokens: usage.OutputTokens}, nil
+}
 
-	prompt := `Generate 3 different alt text descriptions for this image. Vary the level of detail and focus in each description.
-Each alt text should:
-1. Be clear and concise
-2. Avoid starting with "An image of" or "A photo of"
-3. Focus on the most important elements
-4. Use natural language
+func newClaudeRequest(ctx context.Context, image []byte, stream bool) (*http.Request, error) {
+	slog.DebugContext(ctx, "Reading Anthropic API key from environment variables")
+	anthropicAPIKey := os.Getenv("ANTHROPIC_API_KEY")
+	if anthropicAPIKey == "" {
+		slog.WarnContext(ctx, "Anthropic API key is not set in environment variables")
+		return nil, fmt.Errorf("Anthropic API key is not set in environment variables")
+	}
+	slog.DebugContext(ctx, "Successfully read Anthropic API key")
 
-Return the descriptions in this format:
-1. [first description]
-2. [second description]
-3. [third description]`
+	promptText, err := prompt(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create the request body with the correct structure for images
 	data := map[string]interface{}{
-		"model": "claude-3-opus-20240229",
+		"model": config.GetString("ANTHROPIC_MODEL", claudeModel),
 		"messages": []map[string]interface{}{
 			{
 				"role": "user",
 				"content": []map[string]interface{}{
 					{
 						"type": "text",
-						"text": prompt,
+						"text": promptText,
 					},
 					{
 						"type": "image",
 						"source": map[string]interface{}{
 							"type":       "base64",
-							"media_type": http.DetectContentType(imageData),
-							"data":       encodedImage,
+							"media_type": http.DetectContentType(image),
+							"data":       imagePlaceholder,
 						},
 					},
 				},
 			},
 		},
-		"max_tokens": 300,
+		"max_tokens": maxTokens(ctx),
 	}
-
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		log.Printf("Error marshaling JSON data: %v", err)
-		return "", err
+	addSampling(ctx, data, "anthropic")
+	if StructuredWanted(ctx) {
+		// Starting the reply with "{" keeps the model to JSON
+		messages := data["messages"].([]map[string]interface{})
+		data["messages"] = append(messages, map[string]interface{}{"role": "assistant", "content": "{"})
 	}
-	log.Println("Successfully marshaled request data to JSON")
-
-	req, err := http.NewRequest("POST", claudeAPIURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Printf("Error creating HTTP request: %v", err)
-		return "", err
+	if stream {
+		data["stream"] = true
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", anthropicAPIKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
-
-	log.Println("Sending request to Anthropic API")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	body, err := newImageBody(data, image)
 	if err != nil {
-		log.Printf("Error making request to Anthropic API: %v", err)
-		return "", err
+		slog.ErrorContext(ctx, "Error marshaling JSON data", "err", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	slog.DebugContext(ctx, "Successfully marshaled request data to JSON")
 
-	log.Println("Successfully received response from Anthropic API")
-	body, err := ioutil.ReadAll(resp.Body)
+	req, err := newImageRequest(ctx, claudeAPIURL, body)
 	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return "", err
+		slog.ErrorContext(ctx, "Error creating HTTP request", "err", err)
+		return nil, err
 	}
 
-	log.Printf("Response body: %s", body)
+	req.Header.Set("x-api-key", anthropicAPIKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+	return req, nil
+}
 
-	// If we received an error response, parse and return it
-	if strings.Contains(string(body), "error") {
-		var errorResp struct {
-			Error struct {
-				Message string `json:"message"`
-			} `json:"error"`
-		}
-		if err := json.Unmarshal(body, &errorResp); err == nil && errorResp.Error.Message != "" {
-			return "", fmt.Errorf("API error: %s", errorResp.Error.Message)
-		}
-	}
+type claudeUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
 
-	var claudeResp struct {
-		Content []struct {
-			Type string `json:"type"`
-			Text string `json:"text"`
-		} `json:"content"`
+// parseClaudeError returns the API error contained in body, or nil if body is
+// not an error response
+func parseClaudeError(body []byte) error {
+	var errorResp struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
 	}
-	if err := json.Unmarshal(body, &claudeResp); err != nil {
-		log.Printf("Error unmarshaling response JSON: %v", err)
-		return "", err
-	}
-
-	if len(claudeResp.Content) > 0 {
-		log.Println("Successfully extracted response from Claude")
-		return claudeResp.Content[0].Text, nil
+	if err := json.Unmarshal(body, &errorResp); err == nil && errorResp.Error.Message != "" {
+		return &Error{Message: errorResp.Error.Message, Type: errorResp.Error.Type}
 	}
-	log.Println("No response from Claude")
-	return "", fmt.Errorf("No response from Claude")
+	return nil
 }
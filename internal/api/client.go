@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"alt-text-generator/internal/config"
+	"alt-text-generator/internal/metrics"
+)
+
+// defaultTimeout is how long a provider call may take when PROVIDER_TIMEOUT
+// is unset
+const defaultTimeout = 2 * time.Minute
+
+// idleConnTimeout is how long a connection to a provider is kept open unused
+const idleConnTimeout = 90 * time.Second
+
+// client returns the client that sends every request to the providers. It
+// keeps connections and TLS sessions between calls, so a batch pays for the
+// handshake once rather than per image. It has no overall timeout, since a
+// stream may rightly run for a while; each call is bounded by its context
+// and the provider timeout instead. It's built on first use, once the
+// config file has been read.
+var client = sync.OnceValue(func() *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig: &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			ClientSessionCache: tls.NewLRUClientSessionCache(64),
+		},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: config.GetDuration("PROVIDER_RESPONSE_HEADER_TIMEOUT", 90*time.Second),
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   max(config.GetInt("PROVIDER_MAX_IDLE_CONNS", 32), 1),
+		IdleConnTimeout:       idleConnTimeout,
+		ForceAttemptHTTP2:     config.GetBool("PROVIDER_HTTP2", true),
+	}
+	if !transport.ForceAttemptHTTP2 {
+		// A non-nil, empty map is what turns HTTP/2 off
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{Transport: transport}
+})
+
+// send sends a request to a provider, counting whether it reused a
+// connection
+func send(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			metrics.ProviderConnections.Inc(req.URL.Host, strconv.FormatBool(info.Reused))
+		},
+	}
+	return client().Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// withTimeout bounds a provider call by PROVIDER_TIMEOUT, on top of whatever
+// deadline or cancellation ctx already has, such as the caller hanging up
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := config.GetDuration("PROVIDER_TIMEOUT", defaultTimeout)
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// KeepWarm connects to every provider with an API key straight away, then
+// pings each every interval, so there's always an open connection with a
+// finished TLS handshake for the next request, even after a quiet spell.
+// It runs for the life of the process.
+func KeepWarm(interval time.Duration) {
+	if interval >= idleConnTimeout {
+		slog.Warn("Provider keep-alive interval is longer than connections stay idle, so they will close between pings", "interval", interval.String(), "idle_timeout", idleConnTimeout.String())
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			warm()
+			<-ticker.C
+		}
+	}()
+}
+
+// warm pings every enabled provider with an API key
+func warm() {
+	for _, p := range providers {
+		if !p.Configured() || !p.Enabled() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		start := time.Now()
+		err := p.Ping(ctx)
+		cancel()
+		if err != nil {
+			slog.Warn("Provider keep-alive ping failed", "provider", p.Name, "err", err)
+			continue
+		}
+		slog.Debug("Provider keep-alive ping", "provider", p.Name, "duration_ms", float64(time.Since(start).Microseconds())/1000)
+	}
+}
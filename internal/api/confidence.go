@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"alt-text-generator/internal/quality"
+)
+
+// confidenceReminder asks the model to rate itself, and is added to the
+// prompt unless a structured result, which has a field for it, is wanted
+const confidenceReminder = "\n\nFinally, on a line of its own, rate from 0 to 100 how confident you are that the descriptions are accurate, lower if the image is blurry, ambiguous, or hard to make out, in this format:\nConfidence: [number]"
+
+var (
+	// confidenceLine matches a "Confidence:" line in a response, capturing
+	// the rating
+	confidenceLine = regexp.MustCompile(`(?im)^[*_# ]*confidence[*_ ]*:[*_ ]*(\d{1,3})\b.*$`)
+	// confidenceField matches the rating in a structured result's JSON
+	confidenceField = regexp.MustCompile(`"confidence"\s*:\s*"?(\d{1,3})\b`)
+)
+
+// noRating is the Confidence withSelfRating leaves when the model didn't
+// rate itself, for withConfidence to notice
+const noRating = -1
+
+// withSelfRating moves the model's rating of its own confidence out of the
+// provider's responses and into Result.Confidence, for withConfidence to
+// finish
+func (p Provider) withSelfRating() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		return takeSelfRating(ctx, result), err
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			result, err := stream(ctx, image, onDelta)
+			return takeSelfRating(ctx, result), err
+		}
+	}
+	return p
+}
+
+// takeSelfRating sets result.Confidence to the rating in its text, removing
+// it unless the text is a structured result's JSON, or to noRating
+func takeSelfRating(ctx context.Context, result Result) Result {
+	result.Confidence = noRating
+	pattern := confidenceLine
+	if StructuredWanted(ctx) {
+		pattern = confidenceField
+	}
+	loc := pattern.FindStringSubmatchIndex(result.Text)
+	if loc == nil {
+		return result
+	}
+	if rating, err := strconv.Atoi(result.Text[loc[2]:loc[3]]); err == nil && rating <= 100 {
+		result.Confidence = rating
+	}
+	if pattern == confidenceLine {
+		result.Text = strings.TrimSpace(result.Text[:loc[0]] + strings.TrimPrefix(result.Text[loc[1]:], "\n"))
+	}
+	return result
+}
+
+// withConfidence estimates from 0 to 100 how likely each result's first
+// option is to be accurate: quality.Confidence's reading of its hedging,
+// averaged with the model's own rating when it gave one
+func (p Provider) withConfidence() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		if err != nil {
+			return result, err
+		}
+		return confidence(ctx, result), nil
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			result, err := stream(ctx, image, onDelta)
+			if err != nil {
+				return result, err
+			}
+			return confidence(ctx, result), nil
+		}
+	}
+	return p
+}
+
+// confidence combines result's self-rating with the heuristic estimate
+func confidence(ctx context.Context, result Result) Result {
+	estimate := quality.Confidence(FirstOption(result.Text))
+	if result.Confidence == noRating {
+		result.Confidence = estimate
+		return result
+	}
+	slog.DebugContext(ctx, "Estimated confidence", "heuristic", estimate, "model", result.Confidence)
+	result.Confidence = (estimate + result.Confidence + 1) / 2
+	return result
+}
+
+// selfRatingReminder is added to the prompt to ask for the model's rating
+func selfRatingReminder(ctx context.Context) string {
+	if StructuredWanted(ctx) {
+		return ""
+	}
+	return confidenceReminder
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"strings"
+
+	"alt-text-generator/internal/config"
+)
+
+// descriptionLabel introduces the long description in a response
+const descriptionLabel = "long description"
+
+type describeKey struct{}
+
+// WithDescription returns a copy of ctx whose generations do or don't ask
+// for a long description, whatever the configured default
+func WithDescription(ctx context.Context, on bool) context.Context {
+	return context.WithValue(ctx, describeKey{}, on)
+}
+
+// DescriptionWanted reports whether generations for ctx ask for a long
+// description alongside the alt text
+func DescriptionWanted(ctx context.Context) bool {
+	if on, ok := ctx.Value(describeKey{}).(bool); ok {
+		return on
+	}
+	return config.GetBool("ALT_TEXT_LONG_DESCRIPTION", false)
+}
+
+// maxTokens is the most a response may use; a long description, keywords,
+// a data table, or a structured result need room beyond the short options
+func maxTokens(ctx context.Context) int {
+	tokens := 300
+	if DescriptionWanted(ctx) {
+		tokens = 1024
+	}
+	if KeywordsWanted(ctx) {
+		tokens += 100
+	}
+	if ChartsWanted(ctx) {
+		tokens += 800
+	}
+	if StructuredWanted(ctx) {
+		tokens += 500
+	}
+	return tokens
+}
+
+// withDescription moves any long description in the provider's responses
+// out of the alt text and into Result.Description
+func (p Provider) withDescription() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		result = takeDescription(result)
+		return result, err
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			result, err := stream(ctx, image, onDelta)
+			result = takeDescription(result)
+			return result, err
+		}
+	}
+	return p
+}
+
+// takeDescription moves a long description out of result's text. A structured
+// result's description is already apart, and is kept.
+func takeDescription(result Result) Result {
+	if options, description := splitDescription(result.Text); description != "" {
+		result.Text, result.Description = options, description
+	}
+	return result
+}
+
+// splitDescription separates the options in a response from the long
+// description following a "Long description:" line
+func splitDescription(text string) (options, description string) {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		// Models sometimes embolden the label or make it a heading
+		label := strings.ToLower(strings.TrimLeft(strings.TrimSpace(line), "*_# "))
+		if !strings.HasPrefix(label, descriptionLabel) {
+			continue
+		}
+		first := strings.TrimSpace(line[strings.IndexByte(line+":", ':')+1:])
+		rest := append([]string{strings.Trim(first, "*_ ")}, lines[i+1:]...)
+		return strings.TrimSpace(strings.Join(lines[:i], "\n")), strings.TrimSpace(strings.Join(rest, "\n"))
+	}
+	return text, ""
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+
+	"alt-text-generator/internal/config"
+)
+
+// Domains are prompt presets for kinds of image that need particular details
+// described. general, the default, leaves the prompt as it is.
+var Domains = []Preset{
+	{Name: "general"},
+	{Name: "ecommerce", Instruction: "These are product photos for an online shop. Name the product type and the visible attributes that tell it apart from similar items, such as colour, material, pattern, shape, and any visible brand or model. Mention the angle or setting only when it shows something about the product."},
+	{Name: "artwork", Instruction: "This is an artwork. Give the medium and style where evident, such as oil painting or charcoal sketch, then the subject, composition, palette, and mood. Name the title or artist only if they appear in the image."},
+	{Name: "scientific", Instruction: "This is a medical or scientific figure. Identify the figure type, such as micrograph, X-ray, plot, or diagram, and what it shows: axes, labels, units, scale bars, annotations, and the key trend or finding. Use the field's terms precisely and don't offer a diagnosis."},
+	{Name: "news", Instruction: "This is a news photo. Say who is shown when visible captions or signs identify them, what they are doing, where, and the key action or emotion, factually and without editorializing."},
+	{Name: "screenshot", Instruction: "This is a screenshot of software. Name the app or kind of page, then the key elements and their state, such as an open dialog, the selected tab, or an error message, quoting important visible text exactly."},
+}
+
+// LookupDomain returns the domain with the given name
+func LookupDomain(name string) (Preset, bool) {
+	return lookupPreset(Domains, name)
+}
+
+// DomainNames lists the domain presets
+func DomainNames() []string {
+	return presetNames(Domains)
+}
+
+// CheckDomain returns an error naming the choices if name isn't a domain
+func CheckDomain(name string) error {
+	return checkPreset(Domains, "domain", name)
+}
+
+type domainKey struct{}
+
+// WithDomain returns a copy of ctx whose generations use the named domain
+// instead of the configured one
+func WithDomain(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, domainKey{}, name)
+}
+
+// DomainFrom returns the domain set on ctx with WithDomain, or else the
+// configured domain
+func DomainFrom(ctx context.Context) string {
+	if name, _ := ctx.Value(domainKey{}).(string); name != "" {
+		return name
+	}
+	return config.GetString("ALT_TEXT_DOMAIN", "general")
+}
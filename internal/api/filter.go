@@ -0,0 +1,289 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"alt-text-generator/internal/config"
+)
+
+// Filter removes one kind of unwanted text from generated output
+type Filter struct {
+	Name string
+	// Label is what the filter removes, as told to the model when asking
+	// again
+	Label string
+	// Replacement stands in for what was removed
+	Replacement string
+	find        func(text string) [][]int
+}
+
+// Filters lists the output filters. pii names email, phone, and
+// license_plate together.
+var Filters = []Filter{
+	{Name: "profanity", Label: "profanity", Replacement: "[expletive]", find: findProfanity},
+	{Name: "email", Label: "email addresses", Replacement: "[email address]", find: findEmailAddresses},
+	{Name: "phone", Label: "phone numbers", Replacement: "[phone number]", find: findPhoneNumbers},
+	{Name: "license_plate", Label: "license plate numbers", Replacement: "[license plate]", find: findLicensePlates},
+}
+
+// piiFilters are the filters "pii" stands for
+var piiFilters = []string{"email", "phone", "license_plate"}
+
+// filterActions are what can be done about filtered text: redact replaces
+// it, and reprompt asks the model once more before redacting what remains
+var filterActions = []string{"redact", "reprompt"}
+
+// profanity is the built-in word list, matched as whole words
+var profanity = []string{
+	"arse", "arsehole", "ass", "asshole", "bastard", "bitch", "bitches", "bollocks", "bullshit",
+	"cock", "crap", "cunt", "damn", "dick", "dickhead", "fag", "faggot", "fuck", "fucked",
+	"fucker", "fucking", "motherfucker", "nigger", "piss", "pissed", "prick", "pussy", "shit",
+	"shitty", "slut", "twat", "wanker", "whore",
+}
+
+var (
+	emailAddress = regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`)
+	phoneNumber  = regexp.MustCompile(`\+?\(?\d[\d\s().-]{7,}\d`)
+	plateNumber  = regexp.MustCompile(`\b[A-Z0-9]{1,4}[ -]?[A-Z0-9]{2,5}\b`)
+	plateWord    = regexp.MustCompile(`(?i)\b(licen[cs]e|number|registration|plate|plates|tag)\b`)
+)
+
+// FilterNames lists the filters, including pii
+func FilterNames() []string {
+	names := []string{}
+	for _, f := range Filters {
+		names = append(names, f.Name)
+	}
+	return append(names, "pii")
+}
+
+// EnabledFilters returns the filters turned on in the config
+func EnabledFilters() []Filter {
+	names := config.GetList("ALT_TEXT_FILTERS")
+	if slices.Contains(names, "pii") {
+		names = append(names, piiFilters...)
+	}
+	var enabled []Filter
+	for _, f := range Filters {
+		if slices.Contains(names, f.Name) {
+			enabled = append(enabled, f)
+		}
+	}
+	return enabled
+}
+
+// CheckFilters reports whether the filter settings name real filters and
+// an action, so a typo is caught at startup rather than silently ignored
+func CheckFilters() error {
+	for _, name := range config.GetList("ALT_TEXT_FILTERS") {
+		if !slices.Contains(FilterNames(), name) {
+			return fmt.Errorf("unknown filter %q (expected %s)", name, strings.Join(FilterNames(), ", "))
+		}
+	}
+	if action := filterAction(); !slices.Contains(filterActions, action) {
+		return fmt.Errorf("unknown filter action %q (expected %s)", action, strings.Join(filterActions, ", "))
+	}
+	return nil
+}
+
+func filterAction() string {
+	return config.GetString("ALT_TEXT_FILTER_ACTION", "redact")
+}
+
+type refilterKey struct{}
+
+// withFilters removes what the enabled filters find from the provider's alt
+// text, long descriptions, and structured results. With the reprompt action, text that trips a
+// filter is requested again once, with a reminder of what to leave out, and
+// anything still found is redacted. While filters are on, streamed text is
+// held back until it has been filtered, then passed on in one piece.
+func (p Provider) withFilters() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		if err != nil {
+			return result, err
+		}
+		return applyFilters(ctx, generate, image, result), nil
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			if len(EnabledFilters()) == 0 {
+				return stream(ctx, image, onDelta)
+			}
+			result, err := stream(ctx, image, func(string) {})
+			if err != nil {
+				return result, err
+			}
+			result = applyFilters(ctx, generate, image, result)
+			onDelta(result.Text)
+			return result, nil
+		}
+	}
+	return p
+}
+
+// applyFilters returns result with nothing the enabled filters find,
+// asking generate once for new text first if the action is reprompt and the
+// generation has an extra call left
+func applyFilters(ctx context.Context, generate func(context.Context, []byte) (Result, error), image []byte, result Result) Result {
+	filters := EnabledFilters()
+	found := filtersTripped(filters, filteredText(&result))
+	if len(found) == 0 {
+		return result
+	}
+	slog.InfoContext(ctx, "Generated text tripped output filters", "filters", filterNames(found), "action", filterAction())
+	if filterAction() == "reprompt" {
+		if retryCtx, ok := extraCall(ctx, "refilter"); ok {
+			retry, err := generate(context.WithValue(retryCtx, refilterKey{}, found), image)
+			if err != nil {
+				slog.WarnContext(ctx, "Error asking for filtered text again; redacting instead", "err", err)
+			} else {
+				retry.InputTokens += result.InputTokens
+				retry.OutputTokens += result.OutputTokens
+				result = retry
+			}
+		}
+	}
+	for _, text := range filteredText(&result) {
+		*text = redact(filters, *text)
+	}
+	return result
+}
+
+// filteredText points to every piece of text in result that filters apply to
+func filteredText(result *Result) []*string {
+	texts := []*string{&result.Text, &result.Description, &result.Caption, &result.DetectedText}
+	for i := range result.Tags {
+		texts = append(texts, &result.Tags[i])
+	}
+	for i := range result.Objects {
+		texts = append(texts, &result.Objects[i])
+	}
+	for i := range result.Keywords {
+		texts = append(texts, &result.Keywords[i])
+	}
+	return texts
+}
+
+// filterReminder is added to the prompt when text tripped filters
+func filterReminder(ctx context.Context) string {
+	found, _ := ctx.Value(refilterKey{}).([]Filter)
+	if len(found) == 0 {
+		return ""
+	}
+	labels := make([]string, len(found))
+	for i, f := range found {
+		labels[i] = f.Label
+	}
+	return fmt.Sprintf("\n\nYour previous descriptions included %s. Leave these out, even if they appear in the image.", strings.Join(labels, " and "))
+}
+
+// filtersTripped returns the filters that find something in any of texts
+func filtersTripped(filters []Filter, texts []*string) []Filter {
+	var found []Filter
+	for _, f := range filters {
+		for _, text := range texts {
+			if len(f.find(*text)) > 0 {
+				found = append(found, f)
+				break
+			}
+		}
+	}
+	return found
+}
+
+func filterNames(filters []Filter) []string {
+	names := make([]string, len(filters))
+	for i, f := range filters {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// redact replaces everything the filters find in text
+func redact(filters []Filter, text string) string {
+	for _, f := range filters {
+		matches := f.find(text)
+		for i := len(matches) - 1; i >= 0; i-- {
+			text = text[:matches[i][0]] + f.Replacement + text[matches[i][1]:]
+		}
+	}
+	return text
+}
+
+// extraFilterWords are the words added to the profanity list with
+// ALT_TEXT_FILTER_WORDS
+func extraFilterWords() []string {
+	return config.GetList("ALT_TEXT_FILTER_WORDS")
+}
+
+// findProfanity finds the words on the built-in list and any added with
+// ALT_TEXT_FILTER_WORDS
+func findProfanity(text string) [][]int {
+	words := slices.Clone(profanity)
+	for _, word := range extraFilterWords() {
+		words = append(words, strings.ToLower(word))
+	}
+	var matches [][]int
+	start := -1
+	for i, r := range text + " " {
+		// Apostrophes count within a word, as in "don't", but not before one
+		inWord := unicode.IsLetter(r) || r == '\'' && start >= 0
+		switch {
+		case inWord && start < 0:
+			start = i
+		case !inWord && start >= 0:
+			word := strings.TrimRight(text[start:i], "'")
+			if slices.Contains(words, strings.ToLower(word)) {
+				matches = append(matches, []int{start, start + len(word)})
+			}
+			start = -1
+		}
+	}
+	return matches
+}
+
+func findEmailAddresses(text string) [][]int {
+	return emailAddress.FindAllStringIndex(text, -1)
+}
+
+// findPhoneNumbers finds runs of digits and separators long enough to be a
+// phone number, leaving shorter numbers such as years and dates alone
+func findPhoneNumbers(text string) [][]int {
+	var matches [][]int
+	for _, m := range phoneNumber.FindAllStringIndex(text, -1) {
+		digits := 0
+		for _, r := range text[m[0]:m[1]] {
+			if unicode.IsDigit(r) {
+				digits++
+			}
+		}
+		if digits >= 9 && digits <= 15 {
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// findLicensePlates finds registration-like codes of letters and digits
+// mentioned shortly after a word such as "plate" or "registration"
+func findLicensePlates(text string) [][]int {
+	var matches [][]int
+	for _, m := range plateNumber.FindAllStringIndex(text, -1) {
+		code := strings.NewReplacer(" ", "", "-", "").Replace(text[m[0]:m[1]])
+		if len(code) < 4 || len(code) > 8 || !strings.ContainsAny(code, "0123456789") || strings.IndexFunc(code, unicode.IsLetter) < 0 {
+			continue
+		}
+		if plateWord.MatchString(text[max(m[0]-40, 0):m[0]]) {
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
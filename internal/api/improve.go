@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"alt-text-generator/internal/config"
+)
+
+// improveInstruction is added to the prompt in improve mode, with the
+// existing alt text
+const improveInstruction = `This image already has alt text:
+%q
+
+Check it against the image before writing: whether it is accurate, whether it describes what matters, and whether it is a file name, a placeholder such as "image", redundant, too vague, or too long. Make each description an improved rewrite of it that keeps whatever it gets right.
+
+After your answer, list the problems you found with the existing alt text in this format:
+Issues:
+- [issue]
+If there are none, write "Issues: none".`
+
+// errNoExistingAlt is returned when improvement is asked for without the alt
+// text to improve
+var errNoExistingAlt = errors.New("improve mode needs the existing alt text: set existing_alt in the image context")
+
+type improveKey struct{}
+
+// WithImprove returns a copy of ctx whose generations do or don't critique
+// and rewrite the image's existing alt text, whatever the configured default
+func WithImprove(ctx context.Context, on bool) context.Context {
+	return context.WithValue(ctx, improveKey{}, on)
+}
+
+// ImproveWanted reports whether generations for ctx are in improve mode:
+// the existing_alt context is checked against the image, the problems found
+// are returned as issues, and the options rewrite it. Translation takes
+// precedence.
+func ImproveWanted(ctx context.Context) bool {
+	if on, ok := ctx.Value(improveKey{}).(bool); ok {
+		return on && !Translating(ctx)
+	}
+	return config.GetBool("ALT_TEXT_IMPROVE", false) && !Translating(ctx)
+}
+
+// improveReminder is added to the prompt in improve mode
+func improveReminder(ctx context.Context) (string, error) {
+	if !ImproveWanted(ctx) {
+		return "", nil
+	}
+	existing := strings.TrimSpace(ImageContextFrom(ctx).ExistingAlt)
+	if existing == "" {
+		return "", errNoExistingAlt
+	}
+	return "\n\n" + fmt.Sprintf(improveInstruction, existing), nil
+}
+
+// withImprove moves the issues listed in improve mode out of the provider's
+// responses and into Result.Issues, leaving the rewritten options
+func (p Provider) withImprove() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		if err == nil && ImproveWanted(ctx) {
+			result = takeIssues(result)
+		}
+		return result, err
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			result, err := stream(ctx, image, onDelta)
+			if err == nil && ImproveWanted(ctx) {
+				result = takeIssues(result)
+			}
+			return result, err
+		}
+	}
+	return p
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// judgePrompt asks the model which of several descriptions of the image is
+// best
+const judgePrompt = `Here are %d alt text descriptions written for the attached image:
+%s
+%s
+Which one would a screen reader user find the most accurate, specific, and concise description of what matters in the image? Reply with the number of the best one only.`
+
+type judgeKey struct{}
+
+// Judge asks provider's model which of candidates best describes the image,
+// given a reference description written by a person, if there is one. It
+// returns the index of the one it picked, or -1 if the reply names none,
+// and the tokens the call used. The reply skips the handling generations
+// get, such as normalizing and scoring.
+func Judge(ctx context.Context, provider Provider, image []byte, reference string, candidates []string) (int, Result, error) {
+	generate := provider.Generate
+	for _, p := range providers {
+		if p.Name == provider.Name {
+			generate = p.withModel().Generate
+		}
+	}
+	var list strings.Builder
+	for i, candidate := range candidates {
+		fmt.Fprintf(&list, "%d. %s\n", i+1, candidate)
+	}
+	if reference != "" {
+		reference = fmt.Sprintf("\nFor reference, a person described the image as: %q\n", reference)
+	}
+	ctx = context.WithValue(ctx, judgeKey{}, fmt.Sprintf(judgePrompt, len(candidates), list.String(), reference))
+	result, err := generate(ctx, image)
+	if err != nil {
+		return -1, result, err
+	}
+	pick, err := strconv.Atoi(gradeNumber.FindString(result.Text))
+	if err != nil || pick < 1 || pick > len(candidates) {
+		return -1, result, nil
+	}
+	return pick - 1, result, nil
+}
+
+// judgingPrompt is the prompt for a Judge request, if ctx is one
+func judgingPrompt(ctx context.Context) (string, bool) {
+	text, ok := ctx.Value(judgeKey{}).(string)
+	return text, ok
+}
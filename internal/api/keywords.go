@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"alt-text-generator/internal/config"
+)
+
+// keywordsLabel introduces the keywords in a response
+const keywordsLabel = "keywords"
+
+// maxKeywords caps the keywords kept from a response
+const maxKeywords = 10
+
+type keywordsKey struct{}
+
+// WithKeywords returns a copy of ctx whose generations do or don't ask for
+// keywords, whatever the configured default
+func WithKeywords(ctx context.Context, on bool) context.Context {
+	return context.WithValue(ctx, keywordsKey{}, on)
+}
+
+// KeywordsWanted reports whether generations for ctx ask for searchable
+// keywords alongside the alt text
+func KeywordsWanted(ctx context.Context) bool {
+	if on, ok := ctx.Value(keywordsKey{}).(bool); ok {
+		return on
+	}
+	return config.GetBool("ALT_TEXT_KEYWORDS", false)
+}
+
+// withKeywords moves any keywords line in the provider's responses out of
+// the alt text and into Result.Keywords
+func (p Provider) withKeywords() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		return takeKeywords(result), err
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			result, err := stream(ctx, image, onDelta)
+			return takeKeywords(result), err
+		}
+	}
+	return p
+}
+
+// takeKeywords moves a "Keywords:" line out of result's text. A structured
+// result's keywords are already apart, and are kept.
+func takeKeywords(result Result) Result {
+	lines := strings.Split(result.Text, "\n")
+	for i, line := range lines {
+		// Models sometimes embolden the label or make it a heading
+		label := strings.TrimLeft(strings.TrimSpace(line), "*_# ")
+		if !strings.HasPrefix(strings.ToLower(label), keywordsLabel) {
+			continue
+		}
+		list, ok := strings.CutPrefix(strings.TrimLeft(label[len(keywordsLabel):], "*_ "), ":")
+		if !ok {
+			continue
+		}
+		result.Keywords = cleanKeywords(strings.Split(list, ","))
+		result.Text = strings.TrimSpace(strings.Join(slices.Delete(lines, i, i+1), "\n"))
+		break
+	}
+	return result
+}
+
+// cleanKeywords trims and lowercases keywords, dropping blanks and
+// duplicates, and keeps at most maxKeywords
+func cleanKeywords(keywords []string) []string {
+	var clean []string
+	for _, keyword := range keywords {
+		keyword = strings.ToLower(strings.Trim(keyword, " .\"'*_[]"))
+		if keyword != "" && !slices.Contains(clean, keyword) {
+			clean = append(clean, keyword)
+		}
+	}
+	if len(clean) > maxKeywords {
+		clean = clean[:maxKeywords]
+	}
+	return clean
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"alt-text-generator/internal/config"
+)
+
+// defaultMaxChars is the alt text length limit unless configured otherwise;
+// screen readers and many CMSes cut alt text off around this length
+const defaultMaxChars = 125
+
+// cmsDefaultLimit names the default limit as a -limit preset
+const cmsDefaultLimit = "cms-default"
+
+type maxCharsKey struct{}
+
+// WithMaxChars returns a copy of ctx whose generations are held to limit
+// characters, or not at all for 0, whatever the platform or configured limit
+func WithMaxChars(ctx context.Context, limit int) context.Context {
+	return context.WithValue(ctx, maxCharsKey{}, limit)
+}
+
+// MaxChars returns the longest alt text allowed for generations for ctx, in
+// characters, or 0 for no limit: the limit set with WithMaxChars, or else
+// the platform's, or else the configured one
+func MaxChars(ctx context.Context) int {
+	if limit, ok := ctx.Value(maxCharsKey{}).(int); ok {
+		return limit
+	}
+	if platform, ok := PlatformFrom(ctx); ok {
+		return platform.MaxChars
+	}
+	return max(config.GetInt("ALT_TEXT_MAX_LENGTH", defaultMaxChars), 0)
+}
+
+// LimitPresets lists the named length limits: the CMS default and each
+// platform's
+func LimitPresets() []string {
+	return append([]string{cmsDefaultLimit}, PlatformNames()...)
+}
+
+// ParseLimit returns the length limit s names: one of LimitPresets, or
+// custom:N for N characters, with 0 for no limit
+func ParseLimit(s string) (int, error) {
+	if s == cmsDefaultLimit {
+		return defaultMaxChars, nil
+	}
+	if platform, ok := LookupPlatform(s); ok {
+		return platform.MaxChars, nil
+	}
+	if n, ok := strings.CutPrefix(s, "custom:"); ok {
+		limit, err := strconv.Atoi(n)
+		if err != nil || limit < 0 {
+			return 0, fmt.Errorf("custom limit %q must be a number of characters", n)
+		}
+		return limit, nil
+	}
+	return 0, fmt.Errorf("unknown limit %q (expected %s, or custom:N)", s, strings.Join(LimitPresets(), ", "))
+}
+
+// optionNumber matches the "1. " prefix on each option
+var optionNumber = regexp.MustCompile(`^\s*\d+[.)]\s*`)
+
+type shortenKey struct{}
+
+// withMaxChars makes the provider hold its alt text to MaxChars. Results
+// with a longer option are requested again with a reminder of the limit,
+// as an extra call, and any option still too long is cut at the last sentence or word that
+// fits. Streamed text is checked once the stream ends.
+func (p Provider) withMaxChars() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		if err != nil {
+			return result, err
+		}
+		return fitMaxChars(ctx, generate, image, result), nil
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			result, err := stream(ctx, image, onDelta)
+			if err != nil {
+				return result, err
+			}
+			return fitMaxChars(ctx, generate, image, result), nil
+		}
+	}
+	return p
+}
+
+// fitMaxChars returns result with every option within MaxChars, asking
+// generate once for shorter text if any is over and the generation has an
+// extra call left, and records the limit
+func fitMaxChars(ctx context.Context, generate func(context.Context, []byte) (Result, error), image []byte, result Result) Result {
+	limit := MaxChars(ctx)
+	result.MaxChars = limit
+	if limit == 0 || longestOption(result.Text) <= limit {
+		return result
+	}
+	if retryCtx, ok := extraCall(ctx, "shorten"); ok {
+		slog.InfoContext(ctx, "Alt text over the length limit; asking for shorter text", "max_chars", limit, "length", longestOption(result.Text))
+		retry, err := generate(context.WithValue(retryCtx, shortenKey{}, true), image)
+		if err != nil {
+			slog.WarnContext(ctx, "Error asking for shorter alt text; truncating instead", "err", err)
+		} else {
+			retry.InputTokens += result.InputTokens
+			retry.OutputTokens += result.OutputTokens
+			result = retry
+			result.MaxChars = limit
+		}
+	}
+	result.Text = truncateOptions(result.Text, limit)
+	return result
+}
+
+// shortenReminder is added to the prompt when text came back too long
+func shortenReminder(ctx context.Context) string {
+	if shorten, _ := ctx.Value(shortenKey{}).(bool); !shorten {
+		return ""
+	}
+	return fmt.Sprintf("\n\nYour previous descriptions were too long. Each description must be %d characters or fewer.", MaxChars(ctx))
+}
+
+// longestOption returns the length of the longest option in text, without
+// its numbering
+func longestOption(text string) int {
+	longest := 0
+	for _, line := range strings.Split(text, "\n") {
+		line = optionNumber.ReplaceAllString(strings.TrimSpace(line), "")
+		longest = max(longest, len([]rune(line)))
+	}
+	return longest
+}
+
+// truncateOptions cuts every option in text down to limit characters,
+// keeping its numbering
+func truncateOptions(text string, limit int) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		number := optionNumber.FindString(line)
+		lines[i] = number + truncateAlt(line[len(number):], limit)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// truncateAlt shortens alt to at most limit characters, ending after the last
+// whole sentence that fits, or else the last whole word
+func truncateAlt(alt string, limit int) string {
+	runes := []rune(alt)
+	if len(runes) <= limit {
+		return alt
+	}
+	// Keep one character past the limit, so a sentence ending exactly at
+	// the limit is seen to be followed by a space
+	head := string(runes[:limit+1])
+	fits := len(string(runes[:limit]))
+	for i := fits - 1; i > 0; i-- {
+		if strings.IndexByte(".!?", head[i]) >= 0 && head[i+1] == ' ' {
+			return head[:i+1]
+		}
+	}
+	if i := strings.LastIndexByte(head, ' '); i > 0 {
+		return strings.TrimRight(head[:i], " ,;:-")
+	}
+	return string(runes[:limit])
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"context"
+
+	"alt-text-generator/internal/config"
+	"alt-text-generator/internal/quality"
+)
+
+// nearbyVars are the context values holding text shown beside the image,
+// which alt text shouldn't repeat
+var nearbyVars = []string{"caption", "surrounding_text"}
+
+// LintDisabled lists the lint rules turned off in the config
+func LintDisabled() []string {
+	return config.GetList("ALT_TEXT_LINT_DISABLE")
+}
+
+// CheckLint reports whether every lint rule turned off in the config exists,
+// so a typo is caught at startup rather than silently ignored
+func CheckLint() error {
+	return quality.CheckRules(LintDisabled())
+}
+
+// lint sets result.Lint to the enabled rules its first option breaks
+func lint(ctx context.Context, result Result) Result {
+	in := quality.LintInput{MaxLength: MaxChars(ctx)}
+	vars := ImageContextFrom(ctx).Vars
+	for _, name := range nearbyVars {
+		if text := vars[name]; text != "" {
+			in.Nearby = append(in.Nearby, text)
+		}
+	}
+	result.Lint = quality.Lint(FirstOption(result.Text), in, LintDisabled())
+	return result
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+)
+
+// mockText is the alt text the mock provider returns for every image
+const mockText = "A placeholder description of the image from the mock provider."
+
+// mockImageTokens is roughly what a provider counts for a mid-sized image
+const mockImageTokens = 765
+
+// Mock returns a provider that makes no network calls: it renders the prompt
+// and encodes a request body as a real provider would, waits for latency,
+// and returns canned alt text. It isn't offered by LookupProvider; it's for
+// measuring the rest of the generation path, as the bench command does.
+func Mock(latency time.Duration) Provider {
+	p := Provider{
+		Name:  "mock",
+		Label: "Mock",
+		Model: "mock",
+	}
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		return mockGenerate(ctx, image, latency, nil)
+	}
+	p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+		return mockGenerate(ctx, image, latency, onDelta)
+	}
+	return p.withOptions()
+}
+
+// mockGenerate does the local work of a provider call, then waits for
+// latency, spread across the words of the text when streaming
+func mockGenerate(ctx context.Context, image []byte, latency time.Duration, onDelta func(string)) (Result, error) {
+	promptText, err := prompt(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	body, err := newImageBody(map[string]string{"prompt": promptText, "image": imagePlaceholder}, image)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := body.writeTo(io.Discard); err != nil {
+		return Result{}, err
+	}
+
+	words := strings.SplitAfter(mockText, " ")
+	if onDelta == nil {
+		words = []string{mockText}
+	}
+	step := latency / time.Duration(len(words))
+	timer := time.NewTimer(step)
+	defer timer.Stop()
+	for _, word := range words {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return Result{}, ctx.Err()
+		}
+		timer.Reset(step)
+		if onDelta != nil {
+			onDelta(word)
+		}
+	}
+	return Result{
+		Text:         mockText,
+		InputTokens:  len(promptText)/4 + mockImageTokens,
+		OutputTokens: len(mockText) / 4,
+	}, nil
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"alt-text-generator/internal/config"
+	"alt-text-generator/internal/quality"
+)
+
+// symbolActions are what the normalizer can do with emoji and hashtags:
+// strip removes emoji and the # of hashtags, and verbalize puts them into
+// words
+var symbolActions = []string{"strip", "verbalize"}
+
+// NormalizeDisabled lists the normalizer fixes turned off in the config
+func NormalizeDisabled() []string {
+	return config.GetList("ALT_TEXT_NORMALIZE_DISABLE")
+}
+
+// CheckNormalize reports whether every normalizer fix turned off in the
+// config exists, and the symbols setting names an action, so a typo is
+// caught at startup rather than silently ignored
+func CheckNormalize() error {
+	if action := symbolAction(); !slices.Contains(symbolActions, action) {
+		return fmt.Errorf("unknown symbols action %q (expected %s)", action, strings.Join(symbolActions, ", "))
+	}
+	return quality.CheckFixes(NormalizeDisabled())
+}
+
+func symbolAction() string {
+	return config.GetString("ALT_TEXT_SYMBOLS", "strip")
+}
+
+// withNormalize makes the enabled normalizer fixes to each option in the
+// provider's responses, and to the structured caption, rather than trusting
+// the model to follow the prompt. Streamed text is passed on as it arrives;
+// the result holds the normalized text.
+func (p Provider) withNormalize() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		if err != nil {
+			return result, err
+		}
+		return normalize(ctx, result), nil
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			result, err := stream(ctx, image, onDelta)
+			if err != nil {
+				return result, err
+			}
+			return normalize(ctx, result), nil
+		}
+	}
+	return p
+}
+
+// normalize fixes each option line of result's text, keeping its numbering
+// and, in a translation, its language label
+func normalize(ctx context.Context, result Result) Result {
+	opts := quality.NormalizeOptions{Disabled: NormalizeDisabled(), Verbalize: symbolAction() == "verbalize"}
+	lines := strings.Split(result.Text, "\n")
+	for i, line := range lines {
+		number := optionNumber.FindString(line)
+		option := line[len(number):]
+		label := ""
+		if Translating(ctx) {
+			if language, text, ok := strings.Cut(option, ": "); ok {
+				label, option = language+": ", text
+			}
+		}
+		if strings.TrimSpace(option) != "" {
+			lines[i] = number + label + quality.Normalize(option, opts)
+		}
+	}
+	result.Text = strings.Join(lines, "\n")
+	result.Caption = quality.Normalize(result.Caption, opts)
+	return result
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"alt-text-generator/internal/config"
+)
+
+// objectiveInstruction is added to the prompt in objective mode
+const objectiveInstruction = `Describe only what can be seen, objectively and neutrally. Don't use subjective, evaluative, or promotional words such as "beautiful", "stunning", "amazing", or "delicious", and don't describe the mood the image is meant to create.`
+
+// subjectiveWords is the built-in list of words objective mode leaves out,
+// matched as whole words
+var subjectiveWords = []string{
+	"adorable", "amazing", "amazingly", "awesome", "beautiful", "beautifully", "best",
+	"breathtaking", "captivating", "charming", "cozy", "cute", "dazzling", "delicious",
+	"delightful", "elegant", "elegantly", "exceptional", "exquisite", "fabulous", "fantastic",
+	"glorious", "gorgeous", "idyllic", "impressive", "incredible", "incredibly", "iconic",
+	"lovely", "luxurious", "magnificent", "majestic", "marvelous", "mesmerizing", "must-have",
+	"perfect", "perfectly", "picturesque", "serene", "spectacular", "splendid", "stunning",
+	"stunningly", "stylish", "superb", "tasty", "terrible", "ugly", "wonderful",
+}
+
+// punctSpace matches spacing left before punctuation by a removed word
+var punctSpace = regexp.MustCompile(`\s+([,.;:!?])`)
+
+type objectiveKey struct{}
+
+type reobjectiveKey struct{}
+
+// WithObjective returns a copy of ctx whose generations do or don't use
+// objective mode, whatever the configured default
+func WithObjective(ctx context.Context, on bool) context.Context {
+	return context.WithValue(ctx, objectiveKey{}, on)
+}
+
+// ObjectiveWanted reports whether generations for ctx use objective mode:
+// alt text for government, education, and other sites that must describe
+// images neutrally, without subjective or promotional words. It overrides
+// the style preset.
+func ObjectiveWanted(ctx context.Context) bool {
+	if on, ok := ctx.Value(objectiveKey{}).(bool); ok {
+		return on
+	}
+	return config.GetBool("ALT_TEXT_OBJECTIVE", false)
+}
+
+// objectiveReminder is added to the prompt in objective mode, naming the
+// words to leave out when text came back with some
+func objectiveReminder(ctx context.Context) string {
+	if !ObjectiveWanted(ctx) {
+		return ""
+	}
+	reminder := "\n\n" + objectiveInstruction
+	if found, _ := ctx.Value(reobjectiveKey{}).([]string); len(found) > 0 {
+		quoted := make([]string, len(found))
+		for i, word := range found {
+			quoted[i] = strconv.Quote(word)
+		}
+		reminder += fmt.Sprintf(" Your previous descriptions used %s; leave these out.", strings.Join(quoted, ", "))
+	}
+	return reminder
+}
+
+// withObjective keeps subjective words out of the provider's alt text, long
+// descriptions, and structured results in objective mode. Text that has any
+// is requested again once, naming them, and any still there are removed.
+// Streamed text is checked once the stream ends.
+func (p Provider) withObjective() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		if err != nil {
+			return result, err
+		}
+		return applyObjective(ctx, generate, image, result), nil
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			result, err := stream(ctx, image, onDelta)
+			if err != nil {
+				return result, err
+			}
+			return applyObjective(ctx, generate, image, result), nil
+		}
+	}
+	return p
+}
+
+// applyObjective returns result without subjective words, asking generate
+// once for new text first if it has any and the generation has an extra call
+// left. Translations keep the original's
+// wording, so they are left alone.
+func applyObjective(ctx context.Context, generate func(context.Context, []byte) (Result, error), image []byte, result Result) Result {
+	if !ObjectiveWanted(ctx) || Translating(ctx) {
+		return result
+	}
+	words := subjectiveWordList()
+	found := findSubjective(words, objectiveText(&result))
+	if len(found) == 0 {
+		return result
+	}
+	if retryCtx, ok := extraCall(ctx, "objective"); ok {
+		slog.InfoContext(ctx, "Objective mode alt text has subjective words; asking again", "words", found)
+		retry, err := generate(context.WithValue(retryCtx, reobjectiveKey{}, found), image)
+		if err != nil {
+			slog.WarnContext(ctx, "Error asking for objective text again; removing the words instead", "err", err)
+		} else {
+			retry.InputTokens += result.InputTokens
+			retry.OutputTokens += result.OutputTokens
+			result = retry
+		}
+	}
+	pattern := subjectivePattern(words)
+	for _, text := range objectiveText(&result) {
+		lines := strings.Split(*text, "\n")
+		for i, line := range lines {
+			line = replaceWithArticle(line, pattern, false, func(string) string { return "" })
+			lines[i] = punctSpace.ReplaceAllString(line, "$1")
+		}
+		*text = strings.Join(lines, "\n")
+	}
+	return result
+}
+
+// objectiveText points to every piece of text in result that objective mode
+// applies to: all but the text found in the image, which is quoted as it is
+func objectiveText(result *Result) []*string {
+	return slices.DeleteFunc(filteredText(result), func(text *string) bool { return text == &result.DetectedText })
+}
+
+// subjectiveWordList returns the built-in subjective words and any added
+// with ALT_TEXT_OBJECTIVE_WORDS
+func subjectiveWordList() []string {
+	words := slices.Clone(subjectiveWords)
+	for _, word := range config.GetList("ALT_TEXT_OBJECTIVE_WORDS") {
+		words = append(words, strings.ToLower(word))
+	}
+	return words
+}
+
+// subjectivePattern matches any of words, with a comma or "and" joining it
+// to the next word, and the spacing after it
+func subjectivePattern(words []string) *regexp.Regexp {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	return regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b(,?\s+and\b|,)?\s*`)
+}
+
+// findSubjective returns the words in texts, lower-cased and without repeats
+func findSubjective(words []string, texts []*string) []string {
+	pattern := subjectivePattern(words)
+	var found []string
+	for _, text := range texts {
+		for _, m := range pattern.FindAllStringSubmatch(*text, -1) {
+			if word := strings.ToLower(m[1]); !slices.Contains(found, word) {
+				found = append(found, word)
+			}
+		}
+	}
+	return found
+}
@@ -1,94 +1,230 @@
 package api
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strings"
+
+	"alt-text-generator/internal/config"
 )
 
-const chatgptAPIURL = "https://api.openai.com/v1/completions"
+// Describing an image needs a model that can see it, sent as a chat message
+// with an image part. The legacy /v1/completions endpoint takes only a text
+// prompt, and gpt-3.5-turbo has no vision, so Chat Completions and gpt-4o are
+// used instead; Chat Completions is also what streams answers as deltas.
+const (
+	chatgptAPIURL = "https://api.openai.com/v1/chat/completions"
+	chatgptModel  = "gpt-4o"
+)
 
-func GenerateAltTextOpenAI(encodedImage string) (string, error) {
-	log.Println("Reading OpenAI API key from environment variables")
-	openaiAPIKey := os.Getenv("OPEN_AI_API_KEY")
-	if openaiAPIKey == "" {
-		log.Println("OpenAI API key is not set in environment variables")
-		return "", fmt.Errorf("OpenAI API key is not set in environment variables")
+func GenerateAltTextOpenAI(ctx context.Context, image []byte) (Result, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	req, err := newOpenAIRequest(ctx, image, false)
+	if err != nil {
+		return Result{}, err
 	}
-	log.Println("Successfully read OpenAI API key")
 
-	prompt := `Generate 3 different alt text descriptions for this image. Vary the level of detail and focus in each description.
-Each alt text should:
-1. Be clear and concise
-2. Avoid starting with "An image of" or "A photo of"
-3. Focus on the most important elements
-4. Use natural language
+	slog.InfoContext(ctx, "Sending request to OpenAI API")
+	resp, err := send(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error making request to OpenAI API", "err", err)
+		return Result{}, err
+	}
+	defer resp.Body.Close()
 
-Return the descriptions in this format:
-1. [first description]
-2. [second description]
-3. [third description]
+	slog.InfoContext(ctx, "Successfully received response from OpenAI API")
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading response body", "err", err)
+		return Result{}, err
+	}
 
-Here's the base64 encoded image: %s`
+	slog.DebugContext(ctx, "Provider response", "body", string(body))
 
-	data := map[string]interface{}{
-		"model": "gpt-3.5-turbo",
-		"messages": []map[string]string{
-			{"role": "user", "content": fmt.Sprintf(prompt, encodedImage)},
-		},
-		"max_tokens": 300,
+	if err := parseOpenAIError(body); err != nil {
+		return Result{}, err
 	}
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		log.Printf("Error marshaling JSON data: %v", err)
-		return "", err
+
+	var chatResp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage openAIUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &chatResp); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling response JSON", "err", err)
+		return Result{}, err
+	}
+
+	if len(chatResp.Choices) > 0 {
+		slog.InfoContext(ctx, "Successfully extracted response choice from ChatGPT")
+		return Result{
+			Text:         chatResp.Choices[0].Message.Content,
+			InputTokens:  chatResp.Usage.PromptTokens,
+			OutputTokens: chatResp.Usage.CompletionTokens,
+		}, nil
 	}
-	log.Println("Successfully marshaled request data to JSON")
+	slog.InfoContext(ctx, "No response choices from ChatGPT")
+	return Result{}, fmt.Errorf("No response from ChatGPT")
+}
 
-	req, err := http.NewRequest("POST", chatgptAPIURL, bytes.NewBuffer(jsonData))
+// StreamAltTextOpenAI requests a streamed response, calling onDelta with each
+// text fragment as it arrives, and returns the full text once complete
+func StreamAltTextOpenAI(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	req, err := newOpenAIRequest(ctx, image, true)
 	if err != nil {
-		log.Printf("Error creating HTTP request: %v", err)
-		return "", err
+		return Result{}, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+openaiAPIKey)
 
-	log.Println("Sending request to OpenAI API")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	slog.InfoContext(ctx, "Sending streaming request to OpenAI API")
+	resp, err := send(req)
 	if err != nil {
-		log.Printf("Error making request to OpenAI API: %v", err)
-		return "", err
+		slog.ErrorContext(ctx, "Error making request to OpenAI API", "err", err)
+		return Result{}, err
 	}
 	defer resp.Body.Close()
 
-	log.Println("Successfully received response from OpenAI API")
-	body, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		slog.DebugContext(ctx, "Provider response", "body", string(body))
+		if err := parseOpenAIError(body); err != nil {
+			return Result{}, err
+		}
+		return Result{}, fmt.Errorf("API error: unexpected status %s", resp.Status)
+	}
+
+	var text strings.Builder
+	var usage openAIUsage
+	err = readSSE(resp.Body, func(event, data string) error {
+		if data == "[DONE]" {
+			return nil
+		}
+		if err := parseOpenAIError([]byte(data)); err != nil {
+			return err
+		}
+
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Usage *openAIUsage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return err
+		}
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				text.WriteString(choice.Delta.Content)
+				onDelta(choice.Delta.Content)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return "", err
+		slog.ErrorContext(ctx, "Error reading OpenAI stream", "err", err)
+		// The tokens used before the stream broke off are still paid for
+		return Result{InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens}, err
 	}
 
-	log.Printf("Response body: %s", body)
+	if text.Len() == 0 {
+		slog.InfoContext(ctx, "No response choices from ChatGPT")
+		return Result{}, fmt.Errorf("No response from ChatGPT")
+	}
+	slog.InfoContext(ctx, "Successfully streamed response from ChatGPT")
+	return Result{Text: text.String(), InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens}, nil
+}
 
-	var chatResp struct {
-		Choices []struct {
-			Text string `json:"text"`
-		} `json:"choices"`
+func newOpenAIRequest(ctx context.Context, image []byte, stream bool) (*http.Request, error) {
+	slog.DebugContext(ctx, "Reading OpenAI API key from environment variables")
+	openaiAPIKey := os.Getenv("OPEN_AI_API_KEY")
+	if openaiAPIKey == "" {
+		slog.WarnContext(ctx, "OpenAI API key is not set in environment variables")
+		return nil, fmt.Errorf("OpenAI API key is not set in environment variables")
 	}
-	if err := json.Unmarshal(body, &chatResp); err != nil {
-		log.Printf("Error unmarshaling response JSON: %v", err)
-		return "", err
+	slog.DebugContext(ctx, "Successfully read OpenAI API key")
+
+	dataURL := fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(image), imagePlaceholder)
+
+	promptText, err := prompt(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(chatResp.Choices) > 0 {
-		log.Println("Successfully extracted response choice from ChatGPT")
-		return chatResp.Choices[0].Text, nil
+	data := map[string]interface{}{
+		"model": config.GetString("OPENAI_MODEL", chatgptModel),
+		"messages": []map[string]interface{}{
+			{
+				"role": "user",
+				"content": []map[string]interface{}{
+					{
+						"type": "text",
+						"text": promptText,
+					},
+					{
+						"type":      "image_url",
+						"image_url": map[string]string{"url": dataURL},
+					},
+				},
+			},
+		},
+		"max_tokens": maxTokens(ctx),
+	}
+	addSampling(ctx, data, "openai")
+	if StructuredWanted(ctx) {
+		data["response_format"] = map[string]string{"type": "json_object"}
+	}
+	if stream {
+		data["stream"] = true
+		data["stream_options"] = map[string]bool{"include_usage": true}
+	}
+
+	body, err := newImageBody(data, image)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling JSON data", "err", err)
+		return nil, err
+	}
+	slog.DebugContext(ctx, "Successfully marshaled request data to JSON")
+
+	req, err := newImageRequest(ctx, chatgptAPIURL, body)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error creating HTTP request", "err", err)
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+openaiAPIKey)
+	return req, nil
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// parseOpenAIError returns the API error contained in body, or nil if body is
+// not an error response
+func parseOpenAIError(body []byte) error {
+	var errorResp struct {
+		Error *struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errorResp); err == nil && errorResp.Error != nil {
+		return &Error{Message: errorResp.Error.Message, Type: errorResp.Error.Type}
 	}
-	log.Println("No response choices from ChatGPT")
-	return "", fmt.Errorf("No response from ChatGPT")
+	return nil
 }
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"alt-text-generator/internal/config"
+)
+
+// PeoplePolicies are the ways generated text may describe people. allow,
+// the default, leaves it to the model; neutral describes people by what is
+// visible without guessing at identity, naming them only when the image or
+// its context does; omit leaves out identity and names altogether.
+var PeoplePolicies = []string{"allow", "neutral", "omit"}
+
+// peopleInstructions are added to the prompt for each policy but allow
+var peopleInstructions = map[string]string{
+	"neutral": "When describing people, describe what is visible, such as clothing, pose, expression, and action, using neutral terms such as \"person\", \"people\", or \"child\". Don't guess at anyone's age, gender, race, or ethnicity. Don't name or identify anyone unless visible text in the image, such as a caption or name badge, or the context given names them.",
+	"omit":    "When describing people, refer to them only as \"a person\" or \"people\" and describe what they are doing. Don't mention anyone's perceived age, gender, race, ethnicity, or physical features, and don't name or identify anyone, even if the image or the context names them.",
+}
+
+var (
+	// personNoun matches a word for a person, with any perceived age,
+	// gender, or ethnicity directly before it; group 1 is those attributes
+	// and group 2 the noun
+	personNoun = regexp.MustCompile(`(?i)\b((?:(?:\w+-year-old|young|old|older|elderly|middle-aged|teenage|male|female|asian|black|white|caucasian|hispanic|latino|latina|african|african-american|arab|indian)[ ,]+)*)(man|woman|men|women|boy|girl|boys|girls|gentleman|gentlemen|lady|ladies|guy|guys|teenager|teenagers|person|people|child|children|kid|kids|adult|adults|individual|individuals)\b`)
+	// titledName matches a name after a title, such as Dr. Jane Doe
+	titledName = regexp.MustCompile(`\b(?:Mr|Mrs|Ms|Miss|Mx|Dr|Prof|Sir|Dame|President|Senator|Governor|Mayor|King|Queen|Prince|Princess|Pope)\.?(?:\s+[A-Z][\p{L}'’-]+)+`)
+	// articleBefore matches "a" or "an" ending the text before a match
+	articleBefore = regexp.MustCompile(`\b([Aa])n?\s$`)
+)
+
+// neutralNouns are the words for a person that don't give a gender or age
+var neutralNouns = map[string]string{
+	"man": "person", "woman": "person", "men": "people", "women": "people",
+	"boy": "child", "girl": "child", "boys": "children", "girls": "children",
+	"gentleman": "person", "gentlemen": "people", "lady": "person", "ladies": "people",
+	"guy": "person", "guys": "people", "teenager": "person", "teenagers": "people",
+}
+
+type peopleKey struct{}
+
+// WithPeoplePolicy returns a copy of ctx whose generations describe people
+// as the named policy says, whatever the configured default
+func WithPeoplePolicy(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, peopleKey{}, name)
+}
+
+// PeoplePolicy returns the policy set on ctx with WithPeoplePolicy, or else
+// the configured one
+func PeoplePolicy(ctx context.Context) string {
+	if name, _ := ctx.Value(peopleKey{}).(string); name != "" {
+		return name
+	}
+	return config.GetString("ALT_TEXT_PEOPLE", "allow")
+}
+
+// CheckPeoplePolicy returns an error naming the choices if name isn't a
+// people policy
+func CheckPeoplePolicy(name string) error {
+	if !slices.Contains(PeoplePolicies, name) {
+		return fmt.Errorf("unknown people policy %q (expected %s)", name, strings.Join(PeoplePolicies, ", "))
+	}
+	return nil
+}
+
+// CheckPeople reports whether the people setting names a policy
+func CheckPeople() error {
+	return CheckPeoplePolicy(PeoplePolicy(context.Background()))
+}
+
+// peopleReminder is added to the prompt under the neutral and omit policies
+func peopleReminder(ctx context.Context) string {
+	if instruction := peopleInstructions[PeoplePolicy(ctx)]; instruction != "" {
+		return "\n\n" + instruction
+	}
+	return ""
+}
+
+// withPeople enforces the people policy on the provider's alt text, long
+// descriptions, and structured results, in case the model didn't follow the
+// prompt: perceived age, gender, and ethnicity before a word for a person
+// are dropped and the word made neutral, and under omit, titled names such
+// as "Dr. Jane Doe" become "a person". Like the output filters, streamed
+// text is held back until it has been checked.
+func (p Provider) withPeople() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		if err != nil {
+			return result, err
+		}
+		return applyPeoplePolicy(ctx, result), nil
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			if PeoplePolicy(ctx) == "allow" {
+				return stream(ctx, image, onDelta)
+			}
+			result, err := stream(ctx, image, func(string) {})
+			if err != nil {
+				return result, err
+			}
+			result = applyPeoplePolicy(ctx, result)
+			onDelta(result.Text)
+			return result, nil
+		}
+	}
+	return p
+}
+
+// applyPeoplePolicy rewrites result's text to follow the people policy.
+// Text found in the image is quoted as it is, so it is left alone.
+func applyPeoplePolicy(ctx context.Context, result Result) Result {
+	policy := PeoplePolicy(ctx)
+	if policy == "allow" {
+		return result
+	}
+	texts := filteredText(&result)
+	changed := 0
+	for _, text := range texts {
+		if text == &result.DetectedText {
+			continue
+		}
+		rewritten := neutralizePeople(*text, policy == "omit")
+		if rewritten != *text {
+			*text = rewritten
+			changed++
+		}
+	}
+	if changed > 0 {
+		slog.InfoContext(ctx, "Rewrote descriptions of people to follow the people policy", "policy", policy, "texts", changed)
+	}
+	return result
+}
+
+// neutralizePeople drops perceived attributes before words for people in
+// text and makes the words neutral, and with names, replaces titled names
+func neutralizePeople(text string, names bool) string {
+	if names {
+		text = replaceWithArticle(text, titledName, true, func(string) string { return "person" })
+	}
+	return replaceWithArticle(text, personNoun, false, func(match string) string {
+		noun := personNoun.FindStringSubmatch(match)[2]
+		if neutral, ok := neutralNouns[strings.ToLower(noun)]; ok {
+			return neutral
+		}
+		return noun
+	})
+}
+
+// replaceWithArticle replaces each match of re in text with what replace
+// returns for it, which may be nothing, fixing a preceding "a" or "an" to
+// suit the word that now follows, or adding "a" when add is set and there is
+// none. Text that now starts a sentence is capitalised.
+func replaceWithArticle(text string, re *regexp.Regexp, add bool, replace func(string) string) string {
+	matches := re.FindAllStringIndex(text, -1)
+	for i := len(matches) - 1; i >= 0; i-- {
+		start, end := matches[i][0], matches[i][1]
+		// Part of a longer word, such as the "old boy" in "year-old boy"
+		if start > 0 && text[start-1] == '-' {
+			continue
+		}
+		word := replace(text[start:end])
+		if word == text[start:end] {
+			continue
+		}
+		before, rest := text[:start], word+text[end:]
+		if article := articleBefore.FindStringSubmatchIndex(before); article != nil {
+			a := before[article[2]:article[3]]
+			if rest != "" && strings.ContainsRune("aeiouAEIOU", rune(rest[0])) {
+				a += "n"
+			}
+			before, rest = before[:article[0]], a+" "+rest
+		} else if add {
+			rest = "a " + rest
+		}
+		if sentenceStart(before) {
+			r, size := utf8.DecodeRuneInString(rest)
+			rest = string(unicode.ToUpper(r)) + rest[size:]
+		}
+		text = before + rest
+	}
+	return text
+}
+
+// sentenceStart reports whether text that follows before starts a sentence
+func sentenceStart(before string) bool {
+	before = strings.TrimRightFunc(before, unicode.IsSpace)
+	return before == "" || strings.ContainsAny(before[len(before)-1:], ".!?:\n")
+}
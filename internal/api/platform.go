@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"alt-text-generator/internal/config"
+)
+
+// Platform is a social network's conventions for alt text: how long it may
+// be, and an instruction added to the prompt on how to write it
+type Platform struct {
+	Preset
+	// MaxChars is the network's alt text limit, which replaces the
+	// configured length limit
+	MaxChars int
+}
+
+// Platforms are the social networks alt text can be written for
+var Platforms = []Platform{
+	{Preset: Preset{Name: "mastodon", Instruction: "This is for a Mastodon post, where alt text may be up to 1500 characters and readers expect thorough descriptions. Describe the image fully, including the setting, what people are doing, and a transcription of any text in it. Don't use hashtags, @mentions, or emoji."}, MaxChars: 1500},
+	{Preset: Preset{Name: "x", Instruction: "This is for a post on X (Twitter), where alt text may be up to 1000 characters. Put the most important thing in the image in the first sentence, as readers may only hear the start, then add detail, transcribing any text that matters. Don't use hashtags, @mentions, or emoji."}, MaxChars: 1000},
+	{Preset: Preset{Name: "instagram", Instruction: "This is for Instagram, where alt text is kept short: name the main subject and what is happening in one plain phrase. Don't use hashtags, @mentions, or emoji; those belong in the caption."}, MaxChars: 100},
+}
+
+// LookupPlatform returns the platform with the given name
+func LookupPlatform(name string) (Platform, bool) {
+	for _, p := range Platforms {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Platform{}, false
+}
+
+// PlatformNames lists the platforms
+func PlatformNames() []string {
+	names := make([]string, len(Platforms))
+	for i, p := range Platforms {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// CheckPlatform returns an error naming the choices if name isn't a
+// platform
+func CheckPlatform(name string) error {
+	if _, ok := LookupPlatform(name); !ok {
+		return fmt.Errorf("unknown platform %q (expected %s)", name, strings.Join(PlatformNames(), ", "))
+	}
+	return nil
+}
+
+// CheckPlatformSetting reports whether the platform setting, if any, names a
+// platform
+func CheckPlatformSetting() error {
+	if name := config.GetString("ALT_TEXT_PLATFORM", ""); name != "" {
+		return CheckPlatform(name)
+	}
+	return nil
+}
+
+type platformKey struct{}
+
+// WithPlatform returns a copy of ctx whose generations are written for the
+// named platform instead of the configured one
+func WithPlatform(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, platformKey{}, name)
+}
+
+// PlatformFrom returns the platform generations for ctx are written for: the
+// one set with WithPlatform, or else the configured one. ok is false when
+// there is none.
+func PlatformFrom(ctx context.Context) (Platform, bool) {
+	name, _ := ctx.Value(platformKey{}).(string)
+	if name == "" {
+		name = config.GetString("ALT_TEXT_PLATFORM", "")
+	}
+	return LookupPlatform(name)
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Preset is a named instruction added to the prompt, such as a style or a
+// domain
+type Preset struct {
+	Name        string
+	Instruction string
+}
+
+// lookupPreset returns the preset with the given name
+func lookupPreset(presets []Preset, name string) (Preset, bool) {
+	for _, p := range presets {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Preset{}, false
+}
+
+// presetNames lists the presets' names
+func presetNames(presets []Preset) []string {
+	names := make([]string, len(presets))
+	for i, p := range presets {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// checkPreset returns an error naming the choices if name isn't one of
+// presets; kind names what they are, such as "style"
+func checkPreset(presets []Preset, kind, name string) error {
+	if _, ok := lookupPreset(presets, name); !ok {
+		return fmt.Errorf("unknown %s %q (expected %s)", kind, name, strings.Join(presetNames(presets), ", "))
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"alt-text-generator/internal/config"
+)
+
+// altTextPrompt is the built-in prompt template
+const altTextPrompt = `Generate 3 different alt text descriptions for this image. Vary the level of detail and focus in each description.
+Each alt text should:
+1. Be clear and concise
+2. Avoid starting with "An image of" or "A photo of"
+3. Focus on the most important elements
+4. Use natural language
+{{- if .MaxLength}}
+5. Be no longer than {{.MaxLength}} characters
+{{- end}}
+{{- with .DomainGuide}}
+
+{{.}}
+{{- end}}
+{{- with .StyleGuide}}
+
+{{.}}
+{{- end}}
+{{- with .PlatformGuide}}
+
+{{.}}
+{{- end}}
+
+Return the descriptions in this format:
+1. [first description]
+2. [second description]
+3. [third description]
+{{- if .Keywords}}
+
+Then give 5 to 10 searchable keywords for the image, such as its subject, setting, colours, and style, as a comma-separated line in this format:
+Keywords: [keyword], [keyword], [keyword]
+{{- end}}
+{{- if .Charts}}
+
+If the image is a chart or graph, make each description a summary of what it shows and its main trend, such as "Bar chart of monthly sales rising from $2M in January to $5M in June", rather than a description of how it looks. Then give an HTML table approximating its data, with a header row, in this format:
+Data table:
+<table>...</table>
+Leave the data table out for any other kind of image.
+{{- end}}
+{{- if .Describe}}
+
+Then give a long description for readers who can't see the image, covering everything the short descriptions leave out, such as the data in a chart or the steps in a diagram, in this format:
+Long description: [long description]
+{{- end}}
+{{- with .Context}}
+
+Context about where this image is used, to help identify what it shows. Describe only what is visible; don't repeat the context unless the image shows it:
+{{.}}
+{{- end}}`
+
+// ImageContext is what is known about where an image is used, such as the
+// product it shows, passed to the model alongside the image
+type ImageContext struct {
+	PageTitle   string
+	ProductName string
+	ExistingAlt string
+	Notes       string
+	// Vars holds any other values the caller knows, such as the paragraph
+	// around the image, keyed by name
+	Vars map[string]string
+}
+
+const (
+	// maxContextVars caps how many values an image's context may hold
+	maxContextVars = 32
+	// maxContextValue caps the length of each value, in characters
+	maxContextValue = 4000
+)
+
+// NewImageContext builds an image context from named values. Names are
+// normalized to lower case with underscores, so "Page Title" is page_title;
+// page_title, product_name, existing_alt, and notes fill the matching
+// fields and any others go in Vars. Empty values are ignored.
+func NewImageContext(values map[string]string) (ImageContext, error) {
+	var c ImageContext
+	seen := map[string]bool{}
+	for name, value := range values {
+		key := ContextKey(name)
+		value = strings.TrimSpace(value)
+		switch {
+		case value == "":
+			continue
+		case key == "":
+			return ImageContext{}, fmt.Errorf("context value %q has no name", value)
+		case seen[key]:
+			return ImageContext{}, fmt.Errorf("context value %s is given twice", key)
+		case len([]rune(value)) > maxContextValue:
+			return ImageContext{}, fmt.Errorf("context value %s is longer than %d characters", key, maxContextValue)
+		}
+		seen[key] = true
+		switch key {
+		case "page_title":
+			c.PageTitle = value
+		case "product_name":
+			c.ProductName = value
+		case "existing_alt":
+			c.ExistingAlt = value
+		case "notes":
+			c.Notes = value
+		default:
+			if len(c.Vars) == maxContextVars {
+				return ImageContext{}, fmt.Errorf("context may hold at most %d extra values", maxContextVars)
+			}
+			if c.Vars == nil {
+				c.Vars = map[string]string{}
+			}
+			c.Vars[key] = value
+		}
+	}
+	return c, nil
+}
+
+// ContextKey normalizes the name of a context value
+func ContextKey(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+}
+
+// IsZero reports whether c holds nothing
+func (c ImageContext) IsZero() bool {
+	return c.PageTitle == "" && c.ProductName == "" && c.ExistingAlt == "" && c.Notes == "" && len(c.Vars) == 0
+}
+
+// Key identifies c's contents, for telling apart captions of one image in
+// different contexts
+func (c ImageContext) Key() string {
+	if c.IsZero() {
+		return ""
+	}
+	// fmt prints maps sorted by key, so equal contexts give equal keys
+	return fmt.Sprintf("%q", c)
+}
+
+type imageContextKey struct{}
+
+// WithImageContext returns a copy of ctx whose generations include c in the
+// prompt
+func WithImageContext(ctx context.Context, c ImageContext) context.Context {
+	return context.WithValue(ctx, imageContextKey{}, c)
+}
+
+// ImageContextFrom returns the image context stored in ctx, if any
+func ImageContextFrom(ctx context.Context) ImageContext {
+	c, _ := ctx.Value(imageContextKey{}).(ImageContext)
+	return c
+}
+
+type filenameKey struct{}
+
+// WithFilename returns a copy of ctx naming the image file being captioned,
+// for prompt templates that use it
+func WithFilename(ctx context.Context, filename string) context.Context {
+	return context.WithValue(ctx, filenameKey{}, filename)
+}
+
+type storedPromptKey struct{}
+
+// WithStoredPrompt returns a copy of ctx whose generations are sent prompt,
+// as recorded for an earlier generation, instead of the rendered template,
+// so the image can be captioned again as it was first asked for
+func WithStoredPrompt(ctx context.Context, prompt string) context.Context {
+	return context.WithValue(ctx, storedPromptKey{}, prompt)
+}
+
+// PromptData is what a prompt template can refer to: {{.Filename}},
+// {{.Context}}, {{.MaxLength}}, {{.Style}}, {{.Domain}}, {{.Platform}},
+// {{.Describe}}, {{.Keywords}}, {{.Charts}}, and each ImageContext field, such as {{.ProductName}} or
+// {{.Vars.surrounding_text}}. A var the caller didn't pass is empty.
+type PromptData struct {
+	ImageContext
+	// Filename is the image's file name, if known
+	Filename string
+	// Context lists the image context as "- Label: value" lines, and is
+	// empty when there is none
+	Context string
+	// MaxLength is the longest alt text wanted, or 0 for no limit
+	MaxLength int
+	// Style names the style preset, and StyleGuide is its instruction,
+	// empty for neutral
+	Style      string
+	StyleGuide string
+	// Domain names the domain preset, and DomainGuide is its instruction,
+	// empty for general
+	Domain      string
+	DomainGuide string
+	// Platform names the social network the alt text is for, and
+	// PlatformGuide is its instruction; both are empty when there is none
+	Platform      string
+	PlatformGuide string
+	// Describe is set when a long description is wanted, which should
+	// follow the options on a line starting "Long description:"
+	Describe bool
+	// Keywords is set when keywords are wanted, which should follow the
+	// options, before any long description, on a line starting "Keywords:"
+	Keywords bool
+	// Charts is set in chart mode, when charts and graphs should be
+	// summarised by their trend, followed by an HTML table of their data on
+	// the lines after "Data table:", before any long description
+	Charts bool
+}
+
+// promptSource identifies where a prompt template came from: the file at path
+// as last modified, or else text itself
+type promptSource struct {
+	path    string
+	modTime time.Time
+	size    int64
+	text    string
+}
+
+// parsedPrompt holds the last template parsed and its source, so the file is
+// only read and parsed again once it changes
+var parsedPrompt struct {
+	sync.Mutex
+	source promptSource
+	tmpl   *template.Template
+}
+
+// promptTemplate returns the prompt template in effect: the file named by
+// ALT_TEXT_PROMPT_FILE, else ALT_TEXT_PROMPT, else the built-in prompt
+func promptTemplate() (*template.Template, error) {
+	source := promptSource{text: config.GetString("ALT_TEXT_PROMPT", altTextPrompt)}
+	if path := os.Getenv("ALT_TEXT_PROMPT_FILE"); path != "" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading prompt file: %v", err)
+		}
+		source = promptSource{path: path, modTime: info.ModTime(), size: info.Size()}
+	}
+
+	parsedPrompt.Lock()
+	defer parsedPrompt.Unlock()
+	if parsedPrompt.tmpl != nil && parsedPrompt.source == source {
+		return parsedPrompt.tmpl, nil
+	}
+	text, name := source.text, "prompt"
+	if source.path != "" {
+		data, err := os.ReadFile(source.path)
+		if err != nil {
+			return nil, fmt.Errorf("reading prompt file: %v", err)
+		}
+		text, name = string(data), source.path
+	}
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prompt template: %v", err)
+	}
+	parsedPrompt.source, parsedPrompt.tmpl = source, tmpl
+	return tmpl, nil
+}
+
+// CheckPrompt reports whether the prompt template in effect can be read and
+// rendered, so a bad one is caught at startup rather than on the first
+// request. The template it parses is kept for the requests that follow.
+func CheckPrompt() error {
+	_, err := prompt(WithImageContext(context.Background(), ImageContext{ProductName: "example", ExistingAlt: "example"}))
+	return err
+}
+
+// Prompt returns the prompt an image is first sent with for ctx, before any
+// reminder added when asking again
+func Prompt(ctx context.Context) (string, error) {
+	return prompt(ctx)
+}
+
+// prompt renders the prompt template with what ctx holds about the image
+func prompt(ctx context.Context) (string, error) {
+	if grading, ok := gradingPrompt(ctx); ok {
+		return grading, nil
+	}
+	if judging, ok := judgingPrompt(ctx); ok {
+		return judging, nil
+	}
+	if stored, _ := ctx.Value(storedPromptKey{}).(string); stored != "" {
+		return stored, nil
+	}
+	if translation, ok, err := translationPrompt(ctx); ok {
+		return translation, err
+	}
+	tmpl, err := promptTemplate()
+	if err != nil {
+		return "", err
+	}
+	data := PromptData{
+		ImageContext: ImageContextFrom(ctx),
+		MaxLength:    MaxChars(ctx),
+		// A structured result carries these in its JSON instead
+		Describe: DescriptionWanted(ctx) && !StructuredWanted(ctx),
+		Keywords: KeywordsWanted(ctx) && !StructuredWanted(ctx),
+		Charts:   ChartsWanted(ctx) && !StructuredWanted(ctx),
+	}
+	data.Filename, _ = ctx.Value(filenameKey{}).(string)
+	name := StyleFrom(ctx)
+	if err := CheckStyle(name); err != nil {
+		return "", err
+	}
+	if ObjectiveWanted(ctx) {
+		// Objective mode has its own instruction, which a tone such as
+		// marketing would contradict
+		name = "neutral"
+	}
+	style, _ := LookupStyle(name)
+	data.Style, data.StyleGuide = style.Name, style.Instruction
+	name = DomainFrom(ctx)
+	if err := CheckDomain(name); err != nil {
+		return "", err
+	}
+	domain, _ := LookupDomain(name)
+	data.Domain, data.DomainGuide = domain.Name, domain.Instruction
+	if platform, ok := PlatformFrom(ctx); ok {
+		data.Platform, data.PlatformGuide = platform.Name, platform.Instruction
+	}
+
+	var lines []string
+	for _, field := range []struct{ label, value string }{
+		{"Page title", data.PageTitle},
+		{"Product name", data.ProductName},
+		{"Existing alt text (may be inaccurate or incomplete)", data.ExistingAlt},
+		{"Notes", data.Notes},
+	} {
+		if value := strings.TrimSpace(field.value); value != "" {
+			lines = append(lines, fmt.Sprintf("- %s: %s", field.label, value))
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(data.Vars)) {
+		if value := strings.TrimSpace(data.Vars[key]); value != "" {
+			lines = append(lines, fmt.Sprintf("- %s: %s", contextLabel(key), value))
+		}
+	}
+	data.Context = strings.Join(lines, "\n")
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("invalid prompt template: %v", err)
+	}
+	improve, err := improveReminder(ctx)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()) + structuredReminder(ctx) + improve + selfRatingReminder(ctx) + objectiveReminder(ctx) + readingLevelReminder(ctx) + peopleReminder(ctx) + shortenReminder(ctx) + filterReminder(ctx), nil
+}
+
+// contextLabel turns a var name such as surrounding_text into a label such as
+// "Surrounding text"
+func contextLabel(key string) string {
+	label := strings.ReplaceAll(key, "_", " ")
+	r, size := utf8.DecodeRuneInString(label)
+	return string(unicode.ToUpper(r)) + label[size:]
+}
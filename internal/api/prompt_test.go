@@ -0,0 +1,66 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromptTemplateCached(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompt.tmpl")
+	if err := os.WriteFile(path, []byte("Describe {{.Filename}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ALT_TEXT_PROMPT_FILE", path)
+
+	first, err := promptTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := promptTemplate(); err != nil || again != first {
+		t.Errorf("unchanged file parsed again: %p, %v, want %p", again, err, first)
+	}
+
+	// Editing the file is picked up, and a broken edit is reported
+	if err := os.WriteFile(path, []byte("Describe {{.Filename"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := promptTemplate(); err == nil || !strings.Contains(err.Error(), "invalid prompt template") {
+		t.Errorf("broken file err = %v", err)
+	}
+	if err := os.WriteFile(path, []byte("Caption {{.Filename}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, later.Add(time.Minute), later.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	edited, err := promptTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := edited.Execute(&b, PromptData{Filename: "cat.png"}); err != nil || b.String() != "Caption cat.png" {
+		t.Errorf("edited template = %q, %v", b.String(), err)
+	}
+
+	// Without the file the inline prompt is used, cached by its text
+	t.Setenv("ALT_TEXT_PROMPT_FILE", "")
+	t.Setenv("ALT_TEXT_PROMPT", "Inline {{.Filename}}")
+	inline, err := promptTemplate()
+	if err != nil || inline == edited {
+		t.Fatalf("inline template = %p, %v", inline, err)
+	}
+	if again, _ := promptTemplate(); again != inline {
+		t.Error("unchanged inline prompt parsed again")
+	}
+	t.Setenv("ALT_TEXT_PROMPT", "Other {{.Filename}}")
+	if other, _ := promptTemplate(); other == inline {
+		t.Error("changed inline prompt not parsed again")
+	}
+}
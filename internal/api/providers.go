@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+
+	"alt-text-generator/internal/config"
+)
+
+// ErrProviderDisabled is returned when generation is attempted with a
+// provider that has been switched off at runtime
+var ErrProviderDisabled = errors.New("provider is disabled")
+
+// ErrInvalidRequest matches an Error for a request the provider rejected as
+// invalid, such as an image it can't read, which resending won't fix
+var ErrInvalidRequest = errors.New("invalid_request_error")
+
+// Error is an error response from a provider's API
+type Error struct {
+	Message string
+	// Type is the provider's error type, such as "overloaded_error"
+	Type string
+}
+
+func (e *Error) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("API error: %s", e.Message)
+	}
+	return fmt.Sprintf("API error: %s (%s)", e.Message, e.Type)
+}
+
+// Is reports whether target is ErrInvalidRequest and the provider rejected
+// the request as invalid
+func (e *Error) Is(target error) bool {
+	return target == ErrInvalidRequest && e.Type == ErrInvalidRequest.Error()
+}
+
+// Result is the text a provider generated and the tokens it used
+type Result struct {
+	Text         string
+	InputTokens  int
+	OutputTokens int
+	// Description is the long description, when one was asked for
+	Description string
+	// Score rates the first option from 0 to 100
+	Score int
+	// Confidence estimates from 0 to 100 how likely the first option is to
+	// be accurate
+	Confidence int
+	// Lint lists the lint rules the first option breaks, as "rule: problem"
+	Lint []string
+	// Caption, Tags, Objects, and DetectedText are filled in when a
+	// structured result was asked for
+	Caption      string
+	Tags         []string
+	Objects      []string
+	DetectedText string
+	// Keywords are searchable keywords for the image, when asked for
+	Keywords []string
+	// Issues lists what checking a translation, or in improve mode the
+	// existing alt text, against the image found, such as the original alt
+	// text getting a detail wrong
+	Issues []string
+	// MaxChars is the length limit the options were held to, or 0 for none
+	MaxChars int
+	// Provider names the racer that produced the result, when several
+	// providers raced for it
+	Provider string
+	// Losers are the calls to the other racers, which are paid for too
+	Losers []Usage
+}
+
+// Usage is what a provider call that didn't produce the result used, as far
+// as the provider reported it before the call ended
+type Usage struct {
+	Provider     string
+	InputTokens  int
+	OutputTokens int
+	Err          error
+}
+
+// Tokens is every token paid for to get r, including the calls to racers
+// that lost
+func (r Result) Tokens() int {
+	n := r.InputTokens + r.OutputTokens
+	for _, l := range r.Losers {
+		n += l.InputTokens + l.OutputTokens
+	}
+	return n
+}
+
+// Provider describes an alt text backend and how to call it
+type Provider struct {
+	Name    string
+	Label   string
+	Model   string
+	BaseURL string
+	EnvKey  string
+	// ModelEnv names the environment variable that overrides Model
+	ModelEnv string
+	// InputPrice and OutputPrice are the model's list prices in USD per
+	// million tokens, used for cost estimates
+	InputPrice  float64
+	OutputPrice float64
+	// Generate and Stream take the image's raw bytes, which are encoded to
+	// base64 as the request is sent
+	Generate func(ctx context.Context, image []byte) (Result, error)
+	Stream   func(ctx context.Context, image []byte, onDelta func(string)) (Result, error)
+	// racers are the providers a race sends each request to
+	racers []Provider
+}
+
+// Configured reports whether the provider's API key is present in the
+// environment. A race is configured when any of its racers is.
+func (p Provider) Configured() bool {
+	if len(p.racers) > 0 {
+		return slices.ContainsFunc(p.racers, Provider.Configured)
+	}
+	return os.Getenv(p.EnvKey) != ""
+}
+
+// Cost estimates what a result cost in USD at the model's list prices, or
+// for a race, at the winning racer's
+func (p Provider) Cost(r Result) float64 {
+	p = p.Responder(r)
+	return (float64(r.InputTokens)*p.InputPrice + float64(r.OutputTokens)*p.OutputPrice) / 1e6
+}
+
+// Enabled reports whether the provider is accepting requests. Providers are
+// enabled unless switched off with SetEnabled; a race is enabled while any
+// of its racers is.
+func (p Provider) Enabled() bool {
+	if len(p.racers) > 0 {
+		return slices.ContainsFunc(p.racers, Provider.Enabled)
+	}
+	disabledMu.RLock()
+	defer disabledMu.RUnlock()
+	return !disabled[p.Name]
+}
+
+// SetAPIKey replaces the provider's API key. Requests read the key on every
+// call, so the new key takes effect immediately.
+func (p Provider) SetAPIKey(key string) error {
+	return os.Setenv(p.EnvKey, key)
+}
+
+var (
+	disabledMu sync.RWMutex
+	disabled   = map[string]bool{}
+)
+
+// SetEnabled switches a provider on or off at runtime
+func SetEnabled(name string, enabled bool) {
+	disabledMu.Lock()
+	defer disabledMu.Unlock()
+	if enabled {
+		delete(disabled, name)
+	} else {
+		disabled[name] = true
+	}
+}
+
+// Ping checks that the provider's API host is reachable. Any HTTP response,
+// including an error status, counts as reachable.
+func (p Provider) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, p.BaseURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := send(req)
+	if err != nil {
+		return fmt.Errorf("%s API unreachable: %v", p.Label, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+var providers = []Provider{
+	{
+		Name:        "openai",
+		Label:       "OpenAI",
+		Model:       chatgptModel,
+		BaseURL:     "https://api.openai.com",
+		EnvKey:      "OPEN_AI_API_KEY",
+		ModelEnv:    "OPENAI_MODEL",
+		InputPrice:  2.50,
+		OutputPrice: 10,
+		Generate:    GenerateAltTextOpenAI,
+		Stream:      StreamAltTextOpenAI,
+	},
+	{
+		Name:        "anthropic",
+		Label:       "Anthropic",
+		Model:       claudeModel,
+		BaseURL:     "https://api.anthropic.com",
+		EnvKey:      "ANTHROPIC_API_KEY",
+		ModelEnv:    "ANTHROPIC_MODEL",
+		InputPrice:  15,
+		OutputPrice: 75,
+		Generate:    GenerateAltTextClaude,
+		Stream:      StreamAltTextClaude,
+	},
+}
+
+// Providers returns every supported provider
+func Providers() []Provider {
+	all := make([]Provider, len(providers))
+	for i, p := range providers {
+		all[i] = p.withOptions()
+	}
+	return all
+}
+
+// LookupProvider finds a provider by name
+func LookupProvider(name string) (Provider, bool) {
+	for _, p := range providers {
+		if p.Name == name {
+			return p.withOptions(), true
+		}
+	}
+	return Provider{}, false
+}
+
+// withOptions applies the model override and the handling every response
+// gets, from unpacking structured results to scoring the alt text
+func (p Provider) withOptions() Provider {
+	return p.withModel().withSectionsHeldBack().withTranslation().withImprove().withSelfRating().withStructured().withDescription().withKeywords().withCharts().withNormalize().withCandidates().withPeople().withFilters().withObjective().withReadingLevel().withMaxChars().withConfidence().withQuality().withExtraCallLimit()
+}
+
+// withModel applies any model override from the environment
+func (p Provider) withModel() Provider {
+	p.Model = config.GetString(p.ModelEnv, p.Model)
+	return p
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		parse   func([]byte) error
+		body    string
+		message string
+		invalid bool
+	}{
+		{
+			name:    "claude invalid request",
+			parse:   parseClaudeError,
+			body:    `{"type":"error","error":{"type":"invalid_request_error","message":"Could not process image"}}`,
+			message: "API error: Could not process image (invalid_request_error)",
+			invalid: true,
+		},
+		{
+			name:    "claude overloaded",
+			parse:   parseClaudeError,
+			body:    `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			message: "API error: Overloaded (overloaded_error)",
+		},
+		{
+			name:    "claude without a type",
+			parse:   parseClaudeError,
+			body:    `{"error":{"message":"Overloaded"}}`,
+			message: "API error: Overloaded",
+		},
+		{
+			name:    "openai invalid request",
+			parse:   parseOpenAIError,
+			body:    `{"error":{"message":"Invalid image.","type":"invalid_request_error"}}`,
+			message: "API error: Invalid image. (invalid_request_error)",
+			invalid: true,
+		},
+		{
+			name:  "not an error",
+			parse: parseOpenAIError,
+			body:  `{"choices":[]}`,
+		},
+	}
+	for _, tt := range tests {
+		err := tt.parse([]byte(tt.body))
+		if tt.message == "" {
+			if err != nil {
+				t.Errorf("%s: err = %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || err.Error() != tt.message {
+			t.Errorf("%s: err = %v, want *Error %q", tt.name, err, tt.message)
+		}
+		if got := errors.Is(err, ErrInvalidRequest); got != tt.invalid {
+			t.Errorf("%s: errors.Is(err, ErrInvalidRequest) = %v, want %v", tt.name, got, tt.invalid)
+		}
+	}
+}
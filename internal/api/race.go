@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"alt-text-generator/internal/metrics"
+)
+
+// Race returns a provider that sends each request to every one of racers
+// at once and returns the first successful result, cancelling the others.
+// A streamed request goes to whichever racer starts answering first. It
+// trades paying for several calls for the fastest answer, for interactive
+// use. Racers that are disabled or have no API key sit the race out. When
+// every racer fails, the first one's error is returned.
+func Race(racers ...Provider) Provider {
+	var names, labels, models []string
+	for _, r := range racers {
+		names = append(names, r.Name)
+		labels = append(labels, r.Label)
+		models = append(models, r.Model)
+	}
+	p := Provider{
+		Name:   strings.Join(names, "+"),
+		Label:  strings.Join(labels, " or "),
+		Model:  strings.Join(models, "+"),
+		racers: racers,
+	}
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		return race(ctx, racers, func(ctx context.Context, r Provider, _ func()) (Result, error) {
+			return r.Generate(ctx, image)
+		})
+	}
+	p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+		var mu sync.Mutex
+		leader := ""
+		return race(ctx, racers, func(ctx context.Context, r Provider, win func()) (Result, error) {
+			return r.Stream(ctx, image, func(delta string) {
+				mu.Lock()
+				defer mu.Unlock()
+				if leader == "" {
+					leader = r.Name
+					win()
+				}
+				if leader == r.Name {
+					onDelta(delta)
+				}
+			})
+		})
+	}
+	return p
+}
+
+// raceOutcome is how one racer's call ended
+type raceOutcome struct {
+	index  int
+	result Result
+	err    error
+}
+
+// race calls call for each eligible racer at once. A racer wins by
+// returning first without an error, or, if call invokes win, by doing so
+// first; the others' calls are cancelled either way. The winner's result is
+// returned once its call finishes, labelled with its name, and once the
+// cancelled calls have returned, with what they used as its Losers. When
+// there's no winner, the Result returned with the error lists every call.
+func race(ctx context.Context, racers []Provider, call func(ctx context.Context, r Provider, win func()) (Result, error)) (Result, error) {
+	var eligible []int
+	for i, r := range racers {
+		if r.Enabled() && r.Configured() {
+			eligible = append(eligible, i)
+		}
+	}
+	if len(eligible) == 0 {
+		return Result{}, ErrProviderDisabled
+	}
+
+	cancels := make([]context.CancelFunc, len(racers))
+	contexts := make([]context.Context, len(racers))
+	for _, i := range eligible {
+		contexts[i], cancels[i] = context.WithCancel(ctx)
+	}
+	defer func() {
+		for _, cancel := range cancels {
+			if cancel != nil {
+				cancel()
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	winner := -1
+	// claim makes racer i the winner unless another racer already is,
+	// cancelling the rest, and reports whether i is the winner
+	claim := func(i int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if winner < 0 {
+			winner = i
+			for j, cancel := range cancels {
+				if j != i && cancel != nil {
+					cancel()
+				}
+			}
+		}
+		return winner == i
+	}
+	won := func(i int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return winner == i
+	}
+
+	outcomes := make(chan raceOutcome, len(eligible))
+	for _, i := range eligible {
+		go func() {
+			result, err := call(contexts[i], racers[i], func() { claim(i) })
+			outcomes <- raceOutcome{index: i, result: result, err: err}
+		}()
+	}
+
+	var final *raceOutcome
+	var losers []Usage
+	errs := make([]error, len(racers))
+	for range eligible {
+		outcome := <-outcomes
+		if outcome.err == nil && final == nil && claim(outcome.index) {
+			final = &outcome
+			continue
+		}
+		if outcome.err != nil && won(outcome.index) {
+			// The racer that started streaming first failed part way
+			final = &outcome
+		}
+		errs[outcome.index] = outcome.err
+		losers = append(losers, Usage{
+			Provider:     racers[outcome.index].Name,
+			InputTokens:  outcome.result.InputTokens,
+			OutputTokens: outcome.result.OutputTokens,
+			Err:          outcome.err,
+		})
+	}
+
+	if final != nil && final.err == nil {
+		name := racers[final.index].Name
+		metrics.RaceWins.Inc(name)
+		slog.InfoContext(ctx, "Provider won the race", "provider", name)
+		final.result.Provider = name
+		final.result.Losers = losers
+		return final.result, nil
+	}
+	err := ErrProviderDisabled
+	if final != nil {
+		err = final.err
+	} else {
+		for _, i := range eligible {
+			if errs[i] != nil {
+				err = errs[i]
+				break
+			}
+		}
+	}
+	return Result{Losers: losers}, err
+}
+
+// Racers returns the providers p races, or p itself when it isn't a race
+func (p Provider) Racers() []Provider {
+	if len(p.racers) == 0 {
+		return []Provider{p}
+	}
+	return p.racers
+}
+
+// Responder returns the provider that produced r: the racer that won when p
+// is a race, or p itself
+func (p Provider) Responder(r Result) Provider {
+	for _, racer := range p.racers {
+		if racer.Name == r.Provider {
+			return racer
+		}
+	}
+	return p
+}
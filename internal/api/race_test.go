@@ -0,0 +1,257 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRacer is a configured provider whose calls, streamed or not, run call
+func fakeRacer(t *testing.T, name string, call func(ctx context.Context, onDelta func(string)) (Result, error)) Provider {
+	t.Helper()
+	env := "RACE_TEST_KEY_" + strings.ToUpper(name)
+	t.Setenv(env, "key")
+	return Provider{
+		Name:   name,
+		EnvKey: env,
+		Generate: func(ctx context.Context, image []byte) (Result, error) {
+			return call(ctx, func(string) {})
+		},
+		Stream: func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			return call(ctx, onDelta)
+		},
+	}
+}
+
+// answers returns text at once
+func answers(text string, input, output int) func(context.Context, func(string)) (Result, error) {
+	return func(ctx context.Context, onDelta func(string)) (Result, error) {
+		onDelta(text)
+		return Result{Text: text, InputTokens: input, OutputTokens: output}, nil
+	}
+}
+
+// waitsForCancel blocks until its call is cancelled, having used input
+// tokens by then
+func waitsForCancel(input int) func(context.Context, func(string)) (Result, error) {
+	return func(ctx context.Context, onDelta func(string)) (Result, error) {
+		<-ctx.Done()
+		return Result{InputTokens: input}, ctx.Err()
+	}
+}
+
+// fails returns err, having used input tokens, once release is closed
+func fails(err error, input int, release <-chan struct{}) func(context.Context, func(string)) (Result, error) {
+	return func(ctx context.Context, onDelta func(string)) (Result, error) {
+		<-release
+		return Result{InputTokens: input}, err
+	}
+}
+
+func TestRaceGenerate(t *testing.T) {
+	errOverloaded := &Error{Message: "Overloaded", Type: "overloaded_error"}
+	errBadImage := &Error{Message: "Invalid image", Type: "invalid_request_error"}
+	closed := make(chan struct{})
+	close(closed)
+
+	tests := []struct {
+		name     string
+		racers   func(t *testing.T) []Provider
+		text     string
+		provider string
+		err      error
+		losers   []Usage
+	}{
+		{
+			name: "fastest wins and the other is cancelled",
+			racers: func(t *testing.T) []Provider {
+				return []Provider{
+					fakeRacer(t, "slow", waitsForCancel(120)),
+					fakeRacer(t, "fast", answers("A dog", 100, 10)),
+				}
+			},
+			text:     "A dog",
+			provider: "fast",
+			losers:   []Usage{{Provider: "slow", InputTokens: 120, Err: context.Canceled}},
+		},
+		{
+			name: "a failure doesn't hold up the other racer",
+			racers: func(t *testing.T) []Provider {
+				return []Provider{
+					fakeRacer(t, "broken", fails(errOverloaded, 5, closed)),
+					fakeRacer(t, "working", answers("A cat", 90, 8)),
+				}
+			},
+			text:     "A cat",
+			provider: "working",
+			losers:   []Usage{{Provider: "broken", InputTokens: 5, Err: errOverloaded}},
+		},
+		{
+			name: "every racer fails",
+			racers: func(t *testing.T) []Provider {
+				return []Provider{
+					fakeRacer(t, "first", fails(errBadImage, 7, closed)),
+					fakeRacer(t, "second", fails(errOverloaded, 3, closed)),
+				}
+			},
+			err: errBadImage,
+			losers: []Usage{
+				{Provider: "first", InputTokens: 7, Err: errBadImage},
+				{Provider: "second", InputTokens: 3, Err: errOverloaded},
+			},
+		},
+		{
+			name: "unconfigured racers sit out",
+			racers: func(t *testing.T) []Provider {
+				keyless := fakeRacer(t, "keyless", answers("never", 1, 1))
+				t.Setenv(keyless.EnvKey, "")
+				return []Provider{keyless, fakeRacer(t, "keyed", answers("A bird", 50, 5))}
+			},
+			text:     "A bird",
+			provider: "keyed",
+		},
+		{
+			name: "no racer can run",
+			racers: func(t *testing.T) []Provider {
+				keyless := fakeRacer(t, "unset", answers("never", 1, 1))
+				t.Setenv(keyless.EnvKey, "")
+				return []Provider{keyless}
+			},
+			err: ErrProviderDisabled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Race(tt.racers(t)...).Generate(context.Background(), []byte("image"))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if result.Text != tt.text || result.Provider != tt.provider {
+				t.Errorf("result = %q from %q, want %q from %q", result.Text, result.Provider, tt.text, tt.provider)
+			}
+			// Losers are listed in the order their calls ended
+			slices.SortFunc(result.Losers, func(a, b Usage) int { return strings.Compare(a.Provider, b.Provider) })
+			if !reflect.DeepEqual(result.Losers, tt.losers) {
+				t.Errorf("losers = %+v, want %+v", result.Losers, tt.losers)
+			}
+		})
+	}
+}
+
+func TestRaceDisabledRacer(t *testing.T) {
+	SetEnabled("switched-off", false)
+	defer SetEnabled("switched-off", true)
+	result, err := Race(
+		fakeRacer(t, "switched-off", answers("never", 1, 1)),
+		fakeRacer(t, "switched-on", answers("A fox", 40, 4)),
+	).Generate(context.Background(), []byte("image"))
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if result.Provider != "switched-on" || len(result.Losers) != 0 {
+		t.Errorf("result from %q with losers %+v", result.Provider, result.Losers)
+	}
+}
+
+func TestRaceTokens(t *testing.T) {
+	result := Result{InputTokens: 100, OutputTokens: 10, Losers: []Usage{
+		{Provider: "a", InputTokens: 120},
+		{Provider: "b", InputTokens: 80, OutputTokens: 3},
+	}}
+	if got := result.Tokens(); got != 313 {
+		t.Errorf("Tokens() = %d, want 313", got)
+	}
+}
+
+func TestRaceStream(t *testing.T) {
+	errDropped := errors.New("stream dropped")
+
+	t.Run("first to start streaming leads", func(t *testing.T) {
+		leading := make(chan struct{})
+		finish := make(chan struct{})
+		leader := fakeRacer(t, "leader", func(ctx context.Context, onDelta func(string)) (Result, error) {
+			onDelta("A ")
+			close(leading)
+			<-finish
+			onDelta("dog")
+			return Result{Text: "A dog", InputTokens: 100, OutputTokens: 2}, nil
+		})
+		// Starts answering only after the leader has, and would finish first
+		// if it weren't cancelled
+		follower := fakeRacer(t, "follower", func(ctx context.Context, onDelta func(string)) (Result, error) {
+			<-leading
+			select {
+			case <-ctx.Done():
+				close(finish)
+				return Result{InputTokens: 110}, ctx.Err()
+			default:
+			}
+			onDelta("A cat")
+			close(finish)
+			return Result{Text: "A cat"}, nil
+		})
+
+		var mu sync.Mutex
+		var deltas []string
+		result, err := Race(follower, leader).Stream(context.Background(), []byte("image"), func(delta string) {
+			mu.Lock()
+			defer mu.Unlock()
+			deltas = append(deltas, delta)
+		})
+		if err != nil {
+			t.Fatalf("Stream: %v", err)
+		}
+		if result.Provider != "leader" || result.Text != "A dog" {
+			t.Errorf("result = %q from %q", result.Text, result.Provider)
+		}
+		if !reflect.DeepEqual(deltas, []string{"A ", "dog"}) {
+			t.Errorf("deltas = %q, want only the leader's", deltas)
+		}
+		want := []Usage{{Provider: "follower", InputTokens: 110, Err: context.Canceled}}
+		if !reflect.DeepEqual(result.Losers, want) {
+			t.Errorf("losers = %+v, want %+v", result.Losers, want)
+		}
+	})
+
+	t.Run("leader failing part way fails the stream", func(t *testing.T) {
+		leader := fakeRacer(t, "dropper", func(ctx context.Context, onDelta func(string)) (Result, error) {
+			onDelta("A ")
+			return Result{InputTokens: 100, OutputTokens: 1}, errDropped
+		})
+		other := fakeRacer(t, "other", waitsForCancel(60))
+		result, err := Race(leader, other).Stream(context.Background(), []byte("image"), func(string) {})
+		if !errors.Is(err, errDropped) {
+			t.Fatalf("err = %v, want %v", err, errDropped)
+		}
+		if got := result.Tokens(); got != 161 {
+			t.Errorf("tokens = %d, want 161 from both calls", got)
+		}
+	})
+
+	t.Run("caller hanging up cancels every racer", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		started := make(chan struct{}, 2)
+		wait := func(input int) func(context.Context, func(string)) (Result, error) {
+			return func(ctx context.Context, onDelta func(string)) (Result, error) {
+				started <- struct{}{}
+				return waitsForCancel(input)(ctx, onDelta)
+			}
+		}
+		go func() {
+			<-started
+			<-started
+			cancel()
+		}()
+		result, err := Race(fakeRacer(t, "one", wait(10)), fakeRacer(t, "two", wait(20))).Stream(ctx, []byte("image"), func(string) {})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("err = %v, want context.Canceled", err)
+		}
+		if got := result.Tokens(); got != 30 || len(result.Losers) != 2 {
+			t.Errorf("tokens = %d from %d calls, want 30 from 2", got, len(result.Losers))
+		}
+	})
+}
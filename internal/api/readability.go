@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"alt-text-generator/internal/config"
+	"alt-text-generator/internal/quality"
+)
+
+// MaxReadingLevel is the highest grade a reading level can target
+const MaxReadingLevel = 16
+
+// readingLevelLeeway is how many grades over the target alt text may measure
+// before it is requested again, since readability formulas are rough on
+// text as short as alt text
+const readingLevelLeeway = 1
+
+type readingLevelKey struct{}
+
+type simplifyKey struct{}
+
+// WithReadingLevel returns a copy of ctx whose generations target the given
+// US school grade, whatever the configured default. 0 turns the target off.
+func WithReadingLevel(ctx context.Context, grade int) context.Context {
+	return context.WithValue(ctx, readingLevelKey{}, grade)
+}
+
+// ReadingLevel returns the US school grade generations for ctx are written
+// for, or 0 for no target
+func ReadingLevel(ctx context.Context) int {
+	if grade, ok := ctx.Value(readingLevelKey{}).(int); ok {
+		return grade
+	}
+	return config.GetInt("ALT_TEXT_READING_LEVEL", 0)
+}
+
+// CheckReadingLevel returns an error if grade is outside 0 to
+// MaxReadingLevel
+func CheckReadingLevel(grade int) error {
+	if grade < 0 || grade > MaxReadingLevel {
+		return fmt.Errorf("reading level must be a grade from 1 to %d, or 0 for none", MaxReadingLevel)
+	}
+	return nil
+}
+
+// CheckReadability reports whether the reading level setting is a grade
+// CheckReadingLevel accepts
+func CheckReadability() error {
+	return CheckReadingLevel(ReadingLevel(context.Background()))
+}
+
+// readingLevelReminder is added to the prompt when a reading level is
+// targeted, and says how far off the text was when it came back too complex
+func readingLevelReminder(ctx context.Context) string {
+	grade := ReadingLevel(ctx)
+	if grade == 0 {
+		return ""
+	}
+	reminder := fmt.Sprintf("\n\nWrite in plain language that a reader at US school grade %d can follow: common, everyday words and short sentences.", grade)
+	if measured, ok := ctx.Value(simplifyKey{}).(float64); ok {
+		reminder += fmt.Sprintf(" Your previous descriptions read at about grade %.0f; use simpler words and shorter sentences.", measured)
+	}
+	return reminder
+}
+
+// withReadingLevel holds the provider's alt text to ReadingLevel, measured
+// over all the options with quality.GradeLevel. Text that reads above it is
+// requested again once with a reminder, as an extra call, and the simpler of
+// the two kept.
+// Streamed text is checked once the stream ends.
+func (p Provider) withReadingLevel() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		if err != nil {
+			return result, err
+		}
+		return fitReadingLevel(ctx, generate, image, result), nil
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			result, err := stream(ctx, image, onDelta)
+			if err != nil {
+				return result, err
+			}
+			return fitReadingLevel(ctx, generate, image, result), nil
+		}
+	}
+	return p
+}
+
+// fitReadingLevel returns result, or simpler text from asking generate once
+// more if result reads above the target grade and the generation has an
+// extra call left. The formula is for English, so translations are left
+// alone.
+func fitReadingLevel(ctx context.Context, generate func(context.Context, []byte) (Result, error), image []byte, result Result) Result {
+	grade := ReadingLevel(ctx)
+	if grade == 0 || Translating(ctx) {
+		return result
+	}
+	measured := optionsGradeLevel(result.Text)
+	if measured <= float64(grade+readingLevelLeeway) {
+		return result
+	}
+	retryCtx, ok := extraCall(ctx, "simplify")
+	if !ok {
+		return result
+	}
+	slog.InfoContext(ctx, "Alt text above the reading level; asking for simpler text", "reading_level", grade, "measured", measured)
+	retry, err := generate(context.WithValue(retryCtx, simplifyKey{}, measured), image)
+	if err != nil {
+		slog.WarnContext(ctx, "Error asking for simpler alt text; keeping the first", "err", err)
+		return result
+	}
+	retry.InputTokens += result.InputTokens
+	retry.OutputTokens += result.OutputTokens
+	if optionsGradeLevel(retry.Text) > measured {
+		// Keep the simpler text, but count both requests
+		result.InputTokens, result.OutputTokens = retry.InputTokens, retry.OutputTokens
+		return result
+	}
+	return retry
+}
+
+// optionsGradeLevel measures the grade level of the options in text,
+// without their numbering
+func optionsGradeLevel(text string) float64 {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = optionNumber.ReplaceAllString(line, "")
+	}
+	return quality.GradeLevel(strings.Join(lines, "\n"))
+}
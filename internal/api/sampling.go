@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+
+	"alt-text-generator/internal/config"
+)
+
+// Sampling holds the sampling parameters sent to the provider. Nil fields
+// are left to the provider's defaults.
+type Sampling struct {
+	Temperature *float64
+	TopP        *float64
+	Seed        *int64
+}
+
+// maxTemperature is the highest temperature providers accept; Anthropic's
+// is lower, at claudeMaxTemperature
+const maxTemperature = 2
+
+type samplingKey struct{}
+
+// WithSampling returns a copy of ctx whose generations use the parameters
+// set in s, and the configured ones for the rest
+func WithSampling(ctx context.Context, s Sampling) context.Context {
+	return context.WithValue(ctx, samplingKey{}, s)
+}
+
+// SamplingFrom returns the sampling parameters for generations made with
+// ctx: those it was given with WithSampling, falling back to the temperature,
+// top_p, and seed settings
+func SamplingFrom(ctx context.Context) Sampling {
+	s, _ := ctx.Value(samplingKey{}).(Sampling)
+	if s.Temperature == nil && os.Getenv("ALT_TEXT_TEMPERATURE") != "" {
+		t := config.GetFloat("ALT_TEXT_TEMPERATURE", 0)
+		s.Temperature = &t
+	}
+	if s.TopP == nil && os.Getenv("ALT_TEXT_TOP_P") != "" {
+		p := config.GetFloat("ALT_TEXT_TOP_P", 0)
+		s.TopP = &p
+	}
+	if s.Seed == nil && os.Getenv("ALT_TEXT_SEED") != "" {
+		seed := int64(config.GetInt("ALT_TEXT_SEED", 0))
+		s.Seed = &seed
+	}
+	return s
+}
+
+// Check returns an error if a parameter is out of range
+func (s Sampling) Check() error {
+	if s.Temperature != nil && (*s.Temperature < 0 || *s.Temperature > maxTemperature) {
+		return errors.New("temperature must be from 0 to 2")
+	}
+	if s.TopP != nil && (*s.TopP < 0 || *s.TopP > 1) {
+		return errors.New("top_p must be from 0 to 1")
+	}
+	return nil
+}
+
+// CheckSampling reports whether the sampling settings are in range, so a
+// mistake is caught at startup rather than by the provider
+func CheckSampling() error {
+	return SamplingFrom(context.Background()).Check()
+}
+
+// addSampling adds the sampling parameters for ctx to a request body.
+// Anthropic takes no seed, and its temperature is capped at
+// claudeMaxTemperature.
+func addSampling(ctx context.Context, data map[string]interface{}, provider string) {
+	s := SamplingFrom(ctx)
+	if s.Temperature != nil {
+		t := *s.Temperature
+		if provider == "anthropic" && t > claudeMaxTemperature {
+			slog.DebugContext(ctx, "Capping temperature at Anthropic's maximum", "temperature", t)
+			t = claudeMaxTemperature
+		}
+		data["temperature"] = t
+	}
+	if s.TopP != nil {
+		data["top_p"] = *s.TopP
+	}
+	if s.Seed != nil {
+		if provider == "anthropic" {
+			slog.DebugContext(ctx, "Anthropic takes no seed; ignoring it")
+		} else {
+			data["seed"] = *s.Seed
+		}
+	}
+}
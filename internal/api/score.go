@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"alt-text-generator/internal/config"
+	"alt-text-generator/internal/quality"
+)
+
+// gradePrompt asks the model to rate alt text already written for the image
+const gradePrompt = `Rate this alt text for the attached image from 0 to 100, where 100 is alt text that a screen reader user would find accurate, specific, and concise, and 0 is alt text that is wrong, empty, or useless.
+
+Alt text: %q
+
+Consider whether it describes what matters in the image, whether it is specific rather than vague, and whether it avoids redundant phrases like "image of". Reply with the number only.`
+
+// gradeNumber finds the rating in a grader's reply
+var gradeNumber = regexp.MustCompile(`\b\d{1,3}\b`)
+
+type gradeKey struct{}
+
+// GraderEnabled reports whether alt text is also rated by the model, on top
+// of the heuristic quality score
+func GraderEnabled() bool {
+	return config.GetBool("ALT_TEXT_GRADER", false)
+}
+
+// withQuality judges the first option of each result: it is linted, and
+// rated from 0 to 100 with quality.Score, which, when the grader is enabled,
+// is averaged with the model's own rating
+func (p Provider) withQuality() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		if err != nil {
+			return result, err
+		}
+		return lint(ctx, score(ctx, generate, image, result)), nil
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			result, err := stream(ctx, image, onDelta)
+			if err != nil {
+				return result, err
+			}
+			return lint(ctx, score(ctx, generate, image, result)), nil
+		}
+	}
+	return p
+}
+
+// score sets result.Score, asking generate for a rating if the grader is
+// enabled and the generation has an extra call left. A grader that fails or
+// gives no rating leaves the heuristic score.
+func score(ctx context.Context, generate func(context.Context, []byte) (Result, error), image []byte, result Result) Result {
+	alt := FirstOption(result.Text)
+	result.Score = quality.Score(alt)
+	if !GraderEnabled() || alt == "" || Translating(ctx) {
+		return result
+	}
+	ctx, ok := extraCall(ctx, "grade")
+	if !ok {
+		return result
+	}
+	ctx = WithStructured(WithDescription(context.WithValue(ctx, gradeKey{}, alt), false), false)
+	graded, err := generate(ctx, image)
+	if err != nil {
+		slog.WarnContext(ctx, "Error grading alt text; keeping the heuristic score", "err", err)
+		return result
+	}
+	result.InputTokens += graded.InputTokens
+	result.OutputTokens += graded.OutputTokens
+	rating, err := strconv.Atoi(gradeNumber.FindString(graded.Text))
+	if err != nil || rating > 100 {
+		slog.WarnContext(ctx, "Grader gave no rating; keeping the heuristic score", "reply", graded.Text)
+		return result
+	}
+	slog.DebugContext(ctx, "Graded alt text", "heuristic", result.Score, "grader", rating)
+	result.Score = (result.Score + rating + 1) / 2
+	return result
+}
+
+// gradingPrompt is the prompt for a grading request, if ctx is one
+func gradingPrompt(ctx context.Context) (string, bool) {
+	alt, ok := ctx.Value(gradeKey{}).(string)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf(gradePrompt, alt), true
+}
+
+// FirstOption returns the first option in text, without its numbering
+func FirstOption(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return strings.TrimSpace(strings.Trim(optionNumber.ReplaceAllString(line, ""), `[]"`))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// OutputSettings describes the settings for ctx that change what a
+// generation returns without appearing in its prompt: the candidates and
+// sampling asked for, the grader, the normalizer, and the filters. Along
+// with the prompt, they decide whether an earlier result can stand in for a
+// new one. The same settings always describe the same way.
+func OutputSettings(ctx context.Context) string {
+	s := SamplingFrom(ctx)
+	parts := []string{
+		"candidates=" + strconv.Itoa(Candidates(ctx)),
+		"temperature=" + optional(s.Temperature, func(t float64) string { return strconv.FormatFloat(t, 'g', -1, 64) }),
+		"top_p=" + optional(s.TopP, func(p float64) string { return strconv.FormatFloat(p, 'g', -1, 64) }),
+		"seed=" + optional(s.Seed, func(seed int64) string { return strconv.FormatInt(seed, 10) }),
+		"grader=" + strconv.FormatBool(GraderEnabled()),
+		"normalize_disable=" + sortedList(NormalizeDisabled()),
+		"symbols=" + symbolAction(),
+		"filters=" + sortedList(filterNames(EnabledFilters())),
+		"filter_action=" + filterAction(),
+		"filter_words=" + sortedList(extraFilterWords()),
+	}
+	return strings.Join(parts, ";")
+}
+
+// optional formats a setting that may be unset
+func optional[T any](v *T, format func(T) string) string {
+	if v == nil {
+		return ""
+	}
+	return format(*v)
+}
+
+// sortedList joins values in order, so the order they were listed in
+// doesn't matter
+func sortedList(values []string) string {
+	values = slices.Clone(values)
+	for i, v := range values {
+		values[i] = strings.ToLower(strings.TrimSpace(v))
+	}
+	slices.Sort(values)
+	return fmt.Sprintf("%q", values)
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+)
+
+// readSSE parses a server-sent events stream, calling fn for every event with
+// its event name (empty when unnamed) and data payload
+func readSSE(r io.Reader, fn func(event, data string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var event string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(data) > 0 {
+				if err := fn(event, strings.Join(data, "\n")); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		return fn(event, strings.Join(data, "\n"))
+	}
+	return nil
+}
+
+// sectionLabels start the sections a response may end with after its
+// options, which are moved out of the text once it is complete
+var sectionLabels = []string{keywordsLabel, descriptionLabel, "confidence"}
+
+// withSectionsHeldBack keeps the keywords, long description, and confidence
+// rating that follow the options out of streamed text, so clients see only
+// the alt text as it arrives. The complete result still carries them.
+func (p Provider) withSectionsHeldBack() Provider {
+	stream := p.Stream
+	if stream == nil {
+		return p
+	}
+	p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+		if StructuredWanted(ctx) {
+			return stream(ctx, image, onDelta)
+		}
+		f := &sectionFilter{onDelta: onDelta}
+		result, err := stream(ctx, image, f.write)
+		f.flush()
+		return result, err
+	}
+	return p
+}
+
+// sectionFilter passes streamed text on a line at a time, holding back the
+// start of each line until it is clear the line doesn't begin a section, and
+// dropping everything from the first section on
+type sectionFilter struct {
+	onDelta func(string)
+	// held is the start of the current line, not yet passed on
+	held string
+	// blank is blank lines held back, which are dropped if a section follows
+	blank string
+	// passing is set once the current line is known not to start a section
+	passing bool
+	done    bool
+}
+
+func (f *sectionFilter) write(delta string) {
+	for delta != "" && !f.done {
+		chunk := delta
+		if i := strings.IndexByte(delta, '\n'); i >= 0 {
+			chunk = delta[:i+1]
+		}
+		delta = delta[len(chunk):]
+		ended := strings.HasSuffix(chunk, "\n")
+
+		if f.passing {
+			f.onDelta(chunk)
+			f.passing = !ended
+			continue
+		}
+		f.held += chunk
+		switch sectionStart(f.held) {
+		case isSection:
+			f.done = true
+		case mayBeSection:
+			if !ended {
+				continue
+			}
+			if strings.TrimSpace(f.held) == "" {
+				f.blank += f.held
+			} else {
+				f.onDelta(f.blank + f.held)
+				f.blank = ""
+			}
+			f.held = ""
+		default:
+			f.onDelta(f.blank + f.held)
+			f.blank, f.held = "", ""
+			f.passing = !ended
+		}
+	}
+}
+
+// flush passes on a last line left undecided when the stream ended
+func (f *sectionFilter) flush() {
+	if !f.done && strings.TrimSpace(f.held) != "" {
+		f.onDelta(f.blank + f.held)
+	}
+	f.blank, f.held = "", ""
+}
+
+const (
+	notSection = iota
+	mayBeSection
+	isSection
+)
+
+// sectionStart reports whether a line, or the start of one, begins a
+// section: a label such as "Keywords:", which models sometimes embolden or
+// make a heading. As in splitDescription, a long description's label needs
+// no colon.
+func sectionStart(line string) int {
+	label := strings.ToLower(strings.TrimLeft(strings.TrimSpace(line), "*_# "))
+	for _, section := range sectionLabels {
+		if strings.HasPrefix(section, label) && label != section {
+			return mayBeSection
+		}
+		if rest, ok := strings.CutPrefix(label, section); ok {
+			if section == descriptionLabel {
+				return isSection
+			}
+			rest = strings.TrimLeft(rest, "*_ ")
+			if rest == "" {
+				return mayBeSection
+			}
+			if strings.HasPrefix(rest, ":") {
+				return isSection
+			}
+		}
+	}
+	return notSection
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSectionsHeldBack(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "options only",
+			text: "1. A dog on a beach\n2. A dog running\n3. A brown dog",
+			want: "1. A dog on a beach\n2. A dog running\n3. A brown dog",
+		},
+		{
+			name: "every section",
+			text: "1. A dog\n2. A puppy\n\nKeywords: dog, beach\n\nLong description: A brown dog runs.\nWaves behind.\n\nConfidence: 85",
+			want: "1. A dog\n2. A puppy\n",
+		},
+		{
+			name: "emboldened label",
+			text: "1. A cat\n**Confidence:** 70",
+			want: "1. A cat\n",
+		},
+		{
+			name: "heading",
+			text: "1. A cat\n\n## Long description\nA cat asleep.",
+			want: "1. A cat\n",
+		},
+		{
+			name: "heading with a colon",
+			text: "1. A cat\n\n## Long Description:\nA cat asleep.",
+			want: "1. A cat\n",
+		},
+		{
+			name: "word that only starts like a label",
+			text: "1. A cat\nKeyword-rich captions help search",
+			want: "1. A cat\nKeyword-rich captions help search",
+		},
+		{
+			name: "blank lines between options",
+			text: "1. A cat\n\n2. A kitten\n",
+			want: "1. A cat\n\n2. A kitten\n",
+		},
+		{
+			name: "undecided last line",
+			text: "1. A cat\nConfidence",
+			want: "1. A cat\nConfidence",
+		},
+	}
+	for _, tt := range tests {
+		// Whole, then a character at a time, as a stream may split it anywhere
+		for _, size := range []int{len(tt.text), 1} {
+			var chunks []string
+			for text := tt.text; text != ""; {
+				n := min(size, len(text))
+				chunks = append(chunks, text[:n])
+				text = text[n:]
+			}
+			p := Provider{Stream: func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+				for _, chunk := range chunks {
+					onDelta(chunk)
+				}
+				return Result{Text: tt.text}, nil
+			}}.withSectionsHeldBack()
+
+			var got strings.Builder
+			result, err := p.Stream(context.Background(), nil, func(delta string) { got.WriteString(delta) })
+			if err != nil {
+				t.Fatalf("%s: Stream: %v", tt.name, err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("%s, %d-byte deltas: streamed %q, want %q", tt.name, size, got.String(), tt.want)
+			}
+			if result.Text != tt.text {
+				t.Errorf("%s: result text = %q, want it untouched", tt.name, result.Text)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"alt-text-generator/internal/config"
+)
+
+// structuredFormat replaces the prompt's output format when a structured
+// result is wanted
+const structuredFormat = `Instead of a numbered list, respond with only a JSON object, without Markdown fences, in this shape:
+{"alt": ["each alt text description, as asked for above"], "caption": "a fuller caption of one or two sentences", "tags": ["a few topical tags"], "objects": ["each distinct object visible"], "text": "any text visible in the image, or an empty string", "confidence": a number from 0 to 100 for how confident you are that the descriptions are accurate%s}`
+
+type structuredKey struct{}
+
+// WithStructured returns a copy of ctx whose generations do or don't ask for
+// a structured result, whatever the configured default
+func WithStructured(ctx context.Context, on bool) context.Context {
+	return context.WithValue(ctx, structuredKey{}, on)
+}
+
+// StructuredWanted reports whether generations for ctx ask the model for a
+// JSON object holding a caption, tags, objects, and detected text alongside
+// the alt text. Translations are always plain text.
+func StructuredWanted(ctx context.Context) bool {
+	if Translating(ctx) {
+		return false
+	}
+	if on, ok := ctx.Value(structuredKey{}).(bool); ok {
+		return on
+	}
+	return config.GetBool("ALT_TEXT_STRUCTURED", false)
+}
+
+// structuredReminder is added to the prompt when a structured result is
+// wanted
+func structuredReminder(ctx context.Context) string {
+	if !StructuredWanted(ctx) {
+		return ""
+	}
+	var extra string
+	if KeywordsWanted(ctx) {
+		extra += `, "keywords": ["5 to 10 searchable keywords"]`
+	}
+	if DescriptionWanted(ctx) {
+		extra += `, "description": "the long description"`
+	}
+	if ChartsWanted(ctx) {
+		extra += `, "data_table": "for a chart or graph, an HTML table approximating its data, or else an empty string"`
+	}
+	return "\n\n" + fmt.Sprintf(structuredFormat, extra)
+}
+
+// structuredResponse is the JSON object a structured result is asked for
+type structuredResponse struct {
+	// Alt is a list of options, though a model may give a single string
+	Alt         any      `json:"alt"`
+	Caption     string   `json:"caption"`
+	Tags        []string `json:"tags"`
+	Objects     []string `json:"objects"`
+	Text        string   `json:"text"`
+	Keywords    []string `json:"keywords"`
+	Description string   `json:"description"`
+	DataTable   string   `json:"data_table"`
+}
+
+// withStructured unpacks structured results, putting the alt text options in
+// Result.Text as a numbered list and the rest in their own fields. A response
+// that isn't the JSON asked for is left as it is.
+func (p Provider) withStructured() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		if err == nil && StructuredWanted(ctx) {
+			result = unpackStructured(ctx, result)
+		}
+		return result, err
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			result, err := stream(ctx, image, onDelta)
+			if err == nil && StructuredWanted(ctx) {
+				result = unpackStructured(ctx, result)
+			}
+			return result, err
+		}
+	}
+	return p
+}
+
+// unpackStructured fills in result's fields from the JSON in its text
+func unpackStructured(ctx context.Context, result Result) Result {
+	text := strings.TrimSpace(result.Text)
+	text = strings.TrimPrefix(text, "```json")
+	text = strings.TrimSpace(strings.Trim(text, "`"))
+	if !strings.HasPrefix(text, "{") {
+		// Anthropic's reply continues from the "{" the request started
+		text = "{" + text
+	}
+	var response structuredResponse
+	if err := json.Unmarshal([]byte(text), &response); err != nil {
+		slog.WarnContext(ctx, "Structured result is not valid JSON; returning the text as it is", "err", err)
+		return result
+	}
+	var options []string
+	switch alt := response.Alt.(type) {
+	case string:
+		options = append(options, alt)
+	case []any:
+		for _, option := range alt {
+			if s, ok := option.(string); ok {
+				options = append(options, s)
+			}
+		}
+	}
+	var numbered strings.Builder
+	for i, option := range options {
+		fmt.Fprintf(&numbered, "%d. %s\n", i+1, strings.Join(strings.Fields(option), " "))
+	}
+	result.Text = strings.TrimSpace(numbered.String())
+	result.Caption = strings.TrimSpace(response.Caption)
+	result.Tags = response.Tags
+	result.Objects = response.Objects
+	result.DetectedText = strings.TrimSpace(response.Text)
+	result.Keywords = cleanKeywords(response.Keywords)
+	result.Description = addDataTable(strings.TrimSpace(response.Description), sanitizeTable(response.DataTable))
+	return result
+}
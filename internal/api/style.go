@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+
+	"alt-text-generator/internal/config"
+)
+
+// Styles are the voices a caller can choose from. neutral, the default,
+// leaves the prompt as it is.
+var Styles = []Preset{
+	{Name: "neutral"},
+	{Name: "marketing", Instruction: "Write for an online shop: name the product and the appealing qualities the image shows, such as colour, material, and fit, in warm, confident language. Don't add claims the image can't support."},
+	{Name: "journalistic", Instruction: "Write for a news publication: say who or what is shown, where, and what is happening, factually and impartially, without interpretation or loaded adjectives."},
+	{Name: "technical", Instruction: "Write for technical documentation: be precise and literal, naming interface elements, components, labels, and values exactly as they appear."},
+	{Name: "playful", Instruction: "Write in a light, friendly, playful voice suited to a casual brand, while still describing accurately what is shown."},
+}
+
+// LookupStyle returns the style with the given name
+func LookupStyle(name string) (Preset, bool) {
+	return lookupPreset(Styles, name)
+}
+
+// StyleNames lists the style presets
+func StyleNames() []string {
+	return presetNames(Styles)
+}
+
+// CheckStyle returns an error naming the choices if name isn't a style
+func CheckStyle(name string) error {
+	return checkPreset(Styles, "style", name)
+}
+
+type styleKey struct{}
+
+// WithStyle returns a copy of ctx whose generations use the named style
+// instead of the configured one
+func WithStyle(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, styleKey{}, name)
+}
+
+// StyleFrom returns the style set on ctx with WithStyle, or else the
+// configured style
+func StyleFrom(ctx context.Context) string {
+	if name, _ := ctx.Value(styleKey{}).(string); name != "" {
+		return name
+	}
+	return config.GetString("ALT_TEXT_STYLE", "neutral")
+}
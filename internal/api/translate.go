@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"alt-text-generator/internal/config"
+)
+
+// translatePrompt asks the model to translate existing alt text, checking it
+// against the image
+const translatePrompt = `Here is alt text written for the attached image:
+%q
+
+Translate it into each of these languages: %s.
+
+Check every translation against the image, not just the words. Where the original could be translated more than one way, such as a word for an object, colour, or gesture, or a grammatical gender, choose the one that matches what the image shows. Keep each translation as concise as the original.
+
+Return one line per language, labelled with the language as given, in this format:
+%s
+
+Then list anything a reader should know: where the original alt text is wrong about the image, and where a literal translation would have described it wrongly, in this format:
+Issues:
+- [issue]
+If there are none, write "Issues: none".`
+
+// maxLanguages caps the languages one request may translate into
+const maxLanguages = 10
+
+// issuesLabel introduces the problems found in a translation response
+const issuesLabel = "issues:"
+
+// languageTag matches a language as it may be given: a code such as fr or
+// pt-BR, or a name such as French
+var languageTag = regexp.MustCompile(`^[A-Za-z]{2,}([ -][A-Za-z0-9]+)*$`)
+
+// errNoSourceAlt is returned when a translation is asked for without the
+// alt text to translate
+var errNoSourceAlt = errors.New("translation needs the existing alt text: set existing_alt in the image context")
+
+type translateKey struct{}
+
+// WithTranslation returns a copy of ctx whose generations translate the
+// image's existing alt text into languages instead of writing new alt text,
+// whatever the configured default. No languages turns translation off.
+func WithTranslation(ctx context.Context, languages []string) context.Context {
+	return context.WithValue(ctx, translateKey{}, languages)
+}
+
+// TranslationLanguages returns the languages generations for ctx translate
+// the existing alt text into, or none when they write alt text as usual
+func TranslationLanguages(ctx context.Context) []string {
+	if languages, ok := ctx.Value(translateKey{}).([]string); ok {
+		return languages
+	}
+	return config.GetList("ALT_TEXT_TRANSLATE")
+}
+
+// Translating reports whether generations for ctx are translations
+func Translating(ctx context.Context) bool {
+	return len(TranslationLanguages(ctx)) > 0
+}
+
+// CheckLanguages returns an error if languages are too many or one doesn't
+// look like a language code or name
+func CheckLanguages(languages []string) error {
+	if len(languages) > maxLanguages {
+		return fmt.Errorf("at most %d languages can be translated into at once", maxLanguages)
+	}
+	for _, language := range languages {
+		if !languageTag.MatchString(language) {
+			return fmt.Errorf("invalid language %q (expected a code such as fr or pt-BR, or a name)", language)
+		}
+	}
+	return nil
+}
+
+// CheckTranslation reports whether the translate setting names languages
+func CheckTranslation() error {
+	return CheckLanguages(config.GetList("ALT_TEXT_TRANSLATE"))
+}
+
+// translationPrompt is the prompt for a translation, if ctx asks for one
+func translationPrompt(ctx context.Context) (string, bool, error) {
+	languages := TranslationLanguages(ctx)
+	if len(languages) == 0 {
+		return "", false, nil
+	}
+	if err := CheckLanguages(languages); err != nil {
+		return "", true, err
+	}
+	source := strings.TrimSpace(ImageContextFrom(ctx).ExistingAlt)
+	if source == "" {
+		return "", true, errNoSourceAlt
+	}
+	format := make([]string, len(languages))
+	for i, language := range languages {
+		format[i] = language + ": [translation]"
+	}
+	text := fmt.Sprintf(translatePrompt, source, strings.Join(languages, ", "), strings.Join(format, "\n"))
+	return text + peopleReminder(ctx) + shortenReminder(ctx) + filterReminder(ctx), true, nil
+}
+
+// withTranslation moves the issues listed in a translation out of the
+// provider's responses and into Result.Issues, leaving a line per language
+func (p Provider) withTranslation() Provider {
+	generate, stream := p.Generate, p.Stream
+	p.Generate = func(ctx context.Context, image []byte) (Result, error) {
+		result, err := generate(ctx, image)
+		if err == nil && Translating(ctx) {
+			result = takeIssues(result)
+		}
+		return result, err
+	}
+	if stream != nil {
+		p.Stream = func(ctx context.Context, image []byte, onDelta func(string)) (Result, error) {
+			result, err := stream(ctx, image, onDelta)
+			if err == nil && Translating(ctx) {
+				result = takeIssues(result)
+			}
+			return result, err
+		}
+	}
+	return p
+}
+
+// takeIssues moves an "Issues:" section out of result's text: the label's
+// line and the list items after it. Lines after the list, such as a
+// confidence rating, are kept.
+func takeIssues(result Result) Result {
+	lines := strings.Split(result.Text, "\n")
+	for i, line := range lines {
+		label := strings.TrimLeft(strings.TrimSpace(line), "*_# ")
+		if !strings.HasPrefix(strings.ToLower(label), issuesLabel) {
+			continue
+		}
+		items := []string{label[len(issuesLabel):]}
+		end := i + 1
+		for ; end < len(lines); end++ {
+			item := strings.TrimSpace(lines[end])
+			if item != "" && !strings.ContainsAny(item[:1], "-*•") && !optionNumber.MatchString(item) {
+				break
+			}
+			items = append(items, optionNumber.ReplaceAllString(item, ""))
+		}
+		result.Issues = nil
+		for _, item := range items {
+			item = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(item), "-*•"))
+			if item != "" && !strings.EqualFold(strings.TrimRight(item, "."), "none") {
+				result.Issues = append(result.Issues, item)
+			}
+		}
+		result.Text = strings.TrimSpace(strings.Join(append(lines[:i:i], lines[end:]...), "\n"))
+		break
+	}
+	return result
+}
+
+// ParseLanguages splits a comma-separated list of languages, dropping blanks
+// and repeats, and checks them with CheckLanguages
+func ParseLanguages(s string) ([]string, error) {
+	var languages []string
+	for _, language := range strings.Split(s, ",") {
+		if language = strings.TrimSpace(language); language != "" && !slices.Contains(languages, language) {
+			languages = append(languages, language)
+		}
+	}
+	return languages, CheckLanguages(languages)
+}
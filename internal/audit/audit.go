@@ -0,0 +1,189 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"alt-text-generator/internal/auth"
+	"alt-text-generator/internal/logging"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionGenerate            = "generation.created"
+	ActionGenerateCached      = "generation.cached"
+	ActionFeedback            = "generation.feedback"
+	ActionCachesFlushed       = "admin.caches_flushed"
+	ActionKeyRotated          = "admin.provider_key_rotated"
+	ActionProviderEnabled     = "admin.provider_enabled"
+	ActionProviderDisabled    = "admin.provider_disabled"
+	ActionJobsDrained         = "admin.jobs_drained"
+	ActionJobsResumed         = "admin.jobs_resumed"
+	ActionRegenerationStarted = "admin.regeneration_started"
+)
+
+// Event is one entry in the audit log
+type Event struct {
+	ID     int       `json:"id"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// User and Subject are who acted: their account and the API key label
+	// or token subject they used. Both are empty for anonymous callers.
+	User         string `json:"user,omitempty"`
+	Subject      string `json:"subject,omitempty"`
+	RequestID    string `json:"request_id,omitempty"`
+	ImageHash    string `json:"image_hash,omitempty"`
+	Provider     string `json:"provider,omitempty"`
+	Model        string `json:"model,omitempty"`
+	GenerationID string `json:"generation_id,omitempty"`
+	// Detail says more about an admin action, such as which caches were
+	// flushed
+	Detail string `json:"detail,omitempty"`
+}
+
+// Filter selects events from the log. Zero fields match everything.
+type Filter struct {
+	Action string
+	User   string
+	Since  time.Time
+	Until  time.Time
+	// Before only matches events with lower IDs, for paging
+	Before int
+	Limit  int
+}
+
+func (f Filter) matches(e Event) bool {
+	switch {
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	case f.User != "" && e.User != f.User:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	case f.Before > 0 && e.ID >= f.Before:
+		return false
+	}
+	return true
+}
+
+// Log is an append-only audit trail. Events are kept in memory and, when
+// the log is opened with a file, appended to it as JSON lines so the trail
+// survives restarts.
+type Log struct {
+	mu     sync.RWMutex
+	events []Event
+	file   *os.File
+}
+
+// New returns a log kept in memory until the process exits
+func New() *Log {
+	return &Log{}
+}
+
+// Open returns a log appended to the file at path, created if needed, with
+// the events already in it
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{file: f}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reading audit log %s, line %d: %v", path, line, err)
+		}
+		l.events = append(l.events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading audit log %s: %v", path, err)
+	}
+	return l, nil
+}
+
+// Close closes the log's file, if it has one
+func (l *Log) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Add appends e to the log, numbering and timestamping it. An event that
+// can't be written to the file is logged; it is still kept in memory.
+func (l *Log) Add(e Event) Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.ID = 1
+	if n := len(l.events); n > 0 {
+		e.ID = l.events[n-1].ID + 1
+	}
+	e.Time = time.Now().UTC()
+	l.events = append(l.events, e)
+	if l.file != nil {
+		data, _ := json.Marshal(e)
+		if _, err := l.file.Write(append(data, '\n')); err != nil {
+			slog.Error("Error writing audit log", "event_id", e.ID, "action", e.Action, "err", err)
+		}
+	}
+	return e
+}
+
+// List returns the events matching f, newest first
+func (l *Log) List(f Filter) []Event {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var matched []Event
+	for i := len(l.events) - 1; i >= 0; i-- {
+		if f.Limit > 0 && len(matched) == f.Limit {
+			break
+		}
+		if f.matches(l.events[i]) {
+			matched = append(matched, l.events[i])
+		}
+	}
+	return matched
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx through which Record reaches l
+func NewContext(ctx context.Context, l *Log) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// Middleware makes the log available to handlers further down the chain
+func (l *Log) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), l)))
+	})
+}
+
+// Record adds e to the log in ctx, if there is one, as done by the caller
+// in ctx during its request
+func Record(ctx context.Context, e Event) {
+	l, _ := ctx.Value(contextKey{}).(*Log)
+	if l == nil {
+		return
+	}
+	if id, ok := auth.IdentityFromContext(ctx); ok {
+		e.User, e.Subject = id.User, id.Subject
+	}
+	e.RequestID = logging.RequestID(ctx)
+	l.Add(e)
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Identity describes who made a request
+type Identity struct {
+	// Subject is the API key label or token subject
+	Subject string `json:"subject"`
+	// User is the account the credential belongs to, which history, quotas,
+	// and usage are kept under: the name given it in Users, else Subject
+	User string `json:"user"`
+	// Method is how the caller authenticated: "api_key" or "oidc"
+	Method string `json:"method"`
+	// Email is taken from the token's email claim when present
+	Email string `json:"email,omitempty"`
+	// Claims holds every claim of an OIDC token
+	Claims map[string]interface{} `json:"-"`
+}
+
+type contextKey struct{}
+
+// WithIdentity returns a copy of ctx carrying the identity
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// IdentityFromContext returns the identity stored by the auth middleware
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(Identity)
+	return id, ok
+}
+
+// KeySet maps the SHA-256 of each accepted API key to its label. Hashing the
+// keys keeps lookups from leaking key prefixes through timing.
+type KeySet map[[sha256.Size]byte]string
+
+// ParseKeys parses a comma-separated list of keys, each optionally prefixed
+// with a label ("team-a:sk-123,sk-456"). Unlabelled keys are named key-N.
+func ParseKeys(s string) KeySet {
+	keys := KeySet{}
+	for i, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		label, key, ok := strings.Cut(entry, ":")
+		if !ok {
+			label, key = "", entry
+		}
+		if label == "" {
+			label = "key-" + strconv.Itoa(i+1)
+		}
+		keys[sha256.Sum256([]byte(key))] = label
+	}
+	return keys
+}
+
+// Lookup returns the label for key, if it is accepted
+func (k KeySet) Lookup(key string) (string, bool) {
+	label, ok := k[sha256.Sum256([]byte(key))]
+	return label, ok
+}
+
+// Users maps API key labels and token subjects to the accounts they belong
+// to, so someone with several keys, or a key and a login, has one history
+// and quota
+type Users map[string]string
+
+// ParseUsers parses a comma-separated list of accounts, each naming the API
+// key labels and token subjects that belong to it, separated by spaces
+// ("alice=team-a auth0|123,bob=ci-key")
+func ParseUsers(s string) (Users, error) {
+	users := Users{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, subjects, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.TrimSpace(subjects) == "" {
+			return nil, fmt.Errorf("user %q must look like name=subject [subject...]", entry)
+		}
+		for _, subject := range strings.Fields(subjects) {
+			if other, taken := users[subject]; taken && other != name {
+				return nil, fmt.Errorf("%q belongs to both %s and %s", subject, other, name)
+			}
+			users[subject] = name
+		}
+	}
+	return users, nil
+}
+
+// Lookup returns the account subject belongs to. A subject that isn't
+// listed is an account of its own.
+func (u Users) Lookup(subject string) string {
+	if name, ok := u[subject]; ok {
+		return name
+	}
+	return subject
+}
+
+// Authenticator accepts API keys, OIDC-issued JWTs, or both. With neither
+// configured every request is allowed through. Users groups the callers
+// into accounts.
+type Authenticator struct {
+	Keys     KeySet
+	Verifier *OIDCVerifier
+	Users    Users
+}
+
+// Enabled reports whether any authentication method is configured
+func (a *Authenticator) Enabled() bool {
+	return len(a.Keys) > 0 || a.Verifier != nil
+}
+
+// Require rejects requests without valid credentials in either an
+// "Authorization: Bearer" or "X-API-Key" header. Bearer values shaped like a
+// JWT are verified against the OIDC issuer; anything else is treated as an
+// API key. WebSocket upgrades may pass the credential as an api_key query
+// parameter since browsers cannot set headers on them.
+func (a *Authenticator) Require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		credential := requestAPIKey(r)
+		if credential == "" {
+			Unauthorized(w, "Authentication required")
+			return
+		}
+
+		var id Identity
+		if a.Verifier != nil && strings.Count(credential, ".") == 2 {
+			var err error
+			if id, err = a.Verifier.Verify(r.Context(), credential); err != nil {
+				slog.WarnContext(r.Context(), "Rejected token", "err", err)
+				Unauthorized(w, "Invalid token")
+				return
+			}
+		} else {
+			label, ok := a.Keys.Lookup(credential)
+			if !ok {
+				Unauthorized(w, "Invalid API key")
+				return
+			}
+			id = Identity{Subject: label, Method: "api_key"}
+		}
+		id.User = a.Users.Lookup(id.Subject)
+
+		next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+	})
+}
+
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return r.URL.Query().Get("api_key")
+	}
+	return ""
+}
+
+// Unauthorized writes a 401 JSON error with a bearer challenge
+func Unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="alt-text-generator"`)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,401 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockSkew is the leeway applied to exp and nbf checks
+const clockSkew = time.Minute
+
+const (
+	// keyMaxAge is how long a fetched key set is used before it's refreshed
+	keyMaxAge = time.Hour
+	// minRefreshInterval is how soon after a refresh an unknown key ID can
+	// trigger another
+	minRefreshInterval = time.Minute
+	// refreshBackoff is the wait after a failed refresh, doubling with each
+	// further failure up to maxRefreshBackoff
+	refreshBackoff    = 5 * time.Second
+	maxRefreshBackoff = 5 * time.Minute
+)
+
+// OIDCVerifier validates JWTs issued by an OpenID Connect provider using the
+// signing keys published at the issuer's JWKS endpoint
+type OIDCVerifier struct {
+	issuer    string
+	audience  string
+	userClaim string
+	jwksURL   string
+	client    *http.Client
+
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	// nextRefresh is when the keys may next be refetched, and failures how
+	// many refreshes in a row have failed
+	nextRefresh time.Time
+	failures    int
+	// refreshing is closed when the refresh in progress, if any, ends
+	refreshing chan struct{}
+}
+
+// NewOIDCVerifier discovers the issuer's JWKS endpoint and loads its keys.
+// Tokens must be issued for audience, so that one meant for another client
+// of the same issuer isn't accepted. userClaim names the claim used as the
+// identity subject ("sub" when empty).
+func NewOIDCVerifier(ctx context.Context, issuer, audience, userClaim string) (*OIDCVerifier, error) {
+	if audience == "" {
+		return nil, errors.New("an OIDC audience is required")
+	}
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+	v := &OIDCVerifier{
+		issuer:    strings.TrimSuffix(issuer, "/"),
+		audience:  audience,
+		userClaim: userClaim,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(ctx, v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %v", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != v.issuer {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q, expected %q", discovery.Issuer, v.issuer)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery document has no jwks_uri")
+	}
+	v.jwksURL = discovery.JWKSURI
+
+	if err := v.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+	v.nextRefresh = time.Now().Add(minRefreshInterval)
+	return v, nil
+}
+
+// Verify checks the token's signature and registered claims and returns the
+// identity it describes
+func (v *OIDCVerifier) Verify(ctx context.Context, token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Identity{}, errors.New("malformed token header")
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return Identity{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, errors.New("malformed token signature")
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return Identity{}, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Identity{}, errors.New("malformed token claims")
+	}
+	if err := v.validateClaims(claims); err != nil {
+		return Identity{}, err
+	}
+
+	subject, _ := claims[v.userClaim].(string)
+	if subject == "" {
+		return Identity{}, fmt.Errorf("token has no %q claim", v.userClaim)
+	}
+	email, _ := claims["email"].(string)
+	return Identity{Subject: subject, Method: "oidc", Email: email, Claims: claims}, nil
+}
+
+func (v *OIDCVerifier) validateClaims(claims map[string]interface{}) error {
+	now := time.Now()
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.issuer {
+		return errors.New("token issuer mismatch")
+	}
+
+	if !audienceMatches(claims["aud"], v.audience) {
+		return errors.New("token audience mismatch")
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+func audienceMatches(aud interface{}, want string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == want
+	case []interface{}:
+		for _, item := range a {
+			if s, _ := item.(string); s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the signing key with the given ID, refetching the JWKS when the
+// ID is unknown (key rotation) or the cached set is more than an hour old.
+// A stale key is still used while the JWKS can't be fetched.
+func (v *OIDCVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.RLock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetchedAt) > keyMaxAge
+	v.mu.RUnlock()
+
+	if ok && !stale {
+		return key, nil
+	}
+	v.refresh(ctx)
+	v.mu.RLock()
+	key, ok = v.keys[kid]
+	v.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// refresh refetches the keys unless that was done or tried too recently.
+// Concurrent callers share one fetch, and each failure doubles the wait
+// before the next, so a failing JWKS endpoint isn't hit on every request.
+func (v *OIDCVerifier) refresh(ctx context.Context) {
+	v.mu.Lock()
+	if time.Now().Before(v.nextRefresh) {
+		v.mu.Unlock()
+		return
+	}
+	if done := v.refreshing; done != nil {
+		v.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		return
+	}
+	done := make(chan struct{})
+	v.refreshing = done
+	v.mu.Unlock()
+
+	// The fetch is shared, so it isn't cut short by the request that started it
+	err := v.refreshKeys(context.WithoutCancel(ctx))
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.refreshing = nil
+	close(done)
+	if err == nil {
+		v.failures = 0
+		v.nextRefresh = time.Now().Add(minRefreshInterval)
+		return
+	}
+	v.failures++
+	backoff := maxRefreshBackoff
+	if v.failures < 8 {
+		backoff = min(refreshBackoff<<(v.failures-1), maxRefreshBackoff)
+	}
+	v.nextRefresh = time.Now().Add(backoff)
+	slog.WarnContext(ctx, "Error refreshing OIDC signing keys", "err", err, "failures", v.failures, "retry_in", backoff.String())
+}
+
+func (v *OIDCVerifier) refreshKeys(ctx context.Context) error {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(ctx, v.jwksURL, &jwks); err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			slog.WarnContext(ctx, "Skipping JWKS key", "kid", jwk.Kid, "err", err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS contains no usable signing keys")
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	v.mu.Unlock()
+	slog.InfoContext(ctx, "Loaded OIDC signing keys", "keys", len(keys))
+	return nil
+}
+
+func (v *OIDCVerifier) getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("signing key does not match algorithm")
+		}
+		var err error
+		if alg[:2] == "RS" {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+		} else {
+			err = rsa.VerifyPSS(pub, hash, digest, signature, nil)
+		}
+		if err != nil {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("signing key does not match algorithm")
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported signing algorithm %q", alg)
+}
+
+func decodeSegment(segment string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,303 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIssuer is an OIDC provider serving discovery and a JWKS
+type testIssuer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	keys []jsonWebKey
+	// failing makes the JWKS endpoint answer 503
+	failing bool
+	fetches atomic.Int32
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	iss := &testIssuer{}
+	iss.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": iss.URL, "jwks_uri": iss.URL + "/jwks"})
+		case "/jwks":
+			iss.fetches.Add(1)
+			iss.mu.Lock()
+			defer iss.mu.Unlock()
+			if iss.failing {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": iss.keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+func (iss *testIssuer) setKeys(keys ...jsonWebKey) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.keys = keys
+}
+
+func (iss *testIssuer) setFailing(failing bool) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.failing = failing
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) jsonWebKey {
+	return jsonWebKey{
+		Kty: "RSA", Kid: kid, Use: "sig",
+		N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) jsonWebKey {
+	return jsonWebKey{
+		Kty: "EC", Kid: kid, Crv: "P-256",
+		X: base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y: base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// sign makes a JWT with the claims, signed by key under alg
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if alg == "PS256" {
+			signature, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, digest[:], nil)
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := newTestIssuer(t)
+	iss.setKeys(rsaJWK("rsa", rsaKey), ecJWK("ec", ecKey))
+
+	v, err := NewOIDCVerifier(context.Background(), iss.URL+"/", "alt-text", "")
+	if err != nil {
+		t.Fatalf("NewOIDCVerifier: %v", err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": iss.URL, "aud": "alt-text", "sub": "ada", "exp": now + 600, "email": "ada@example.com"}
+		for k, val := range extra {
+			if val == nil {
+				delete(c, k)
+			} else {
+				c[k] = val
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{name: "RS256", token: sign(t, "RS256", "rsa", rsaKey, claims(nil))},
+		{name: "PS256", token: sign(t, "PS256", "rsa", rsaKey, claims(nil))},
+		{name: "ES256", token: sign(t, "ES256", "ec", ecKey, claims(nil))},
+		{name: "audience list", token: sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": []string{"other", "alt-text"}}))},
+		{name: "within clock skew", token: sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": now - 30}))},
+		{name: "wrong audience", token: sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": "other"})), err: "audience mismatch"},
+		{name: "no audience", token: sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": nil})), err: "audience mismatch"},
+		{name: "wrong issuer", token: sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example"})), err: "issuer mismatch"},
+		{name: "expired", token: sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": now - 600})), err: "expired"},
+		{name: "no expiry", token: sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": nil})), err: "no expiry"},
+		{name: "not yet valid", token: sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"nbf": now + 600})), err: "not valid yet"},
+		{name: "no subject", token: sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"sub": nil})), err: `no "sub" claim`},
+		{name: "signed by another key", token: sign(t, "RS256", "rsa", otherKey, claims(nil)), err: "invalid token signature"},
+		{name: "algorithm for another key type", token: sign(t, "RS256", "ec", rsaKey, claims(nil)), err: "does not match algorithm"},
+		{name: "unsupported algorithm", token: sign(t, "HS256", "rsa", rsaKey, claims(nil)), err: "unsupported signing algorithm"},
+		{name: "malformed", token: "not-a-jwt", err: "malformed token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := v.Verify(context.Background(), tt.token)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if id.Subject != "ada" || id.Method != "oidc" || id.Email != "ada@example.com" {
+				t.Errorf("identity = %+v", id)
+			}
+		})
+	}
+}
+
+func TestOIDCRequiresAudience(t *testing.T) {
+	iss := newTestIssuer(t)
+	if _, err := NewOIDCVerifier(context.Background(), iss.URL, "", ""); err == nil {
+		t.Fatal("verifier created without an audience")
+	}
+	if n := iss.fetches.Load(); n != 0 {
+		t.Errorf("JWKS fetched %d times", n)
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	iss := newTestIssuer(t)
+	iss.setKeys(rsaJWK("old", oldKey))
+	v, err := NewOIDCVerifier(context.Background(), iss.URL, "alt-text", "preferred_username")
+	if err != nil {
+		t.Fatalf("NewOIDCVerifier: %v", err)
+	}
+	claims := map[string]interface{}{"iss": iss.URL, "aud": "alt-text", "preferred_username": "ada", "exp": time.Now().Unix() + 600}
+	token := sign(t, "RS256", "new", newKey, claims)
+
+	// Just after loading, an unknown key ID doesn't refetch
+	iss.setKeys(rsaJWK("old", oldKey), rsaJWK("new", newKey))
+	if _, err := v.Verify(context.Background(), token); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Fatalf("err = %v, want unknown signing key", err)
+	}
+	if n := iss.fetches.Load(); n != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", n)
+	}
+
+	v.mu.Lock()
+	v.nextRefresh = time.Time{}
+	v.mu.Unlock()
+	id, err := v.Verify(context.Background(), token)
+	if err != nil {
+		t.Fatalf("Verify after rotation: %v", err)
+	}
+	if id.Subject != "ada" {
+		t.Errorf("subject = %q, want ada", id.Subject)
+	}
+}
+
+func TestOIDCRefreshBackoff(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	iss := newTestIssuer(t)
+	iss.setKeys(rsaJWK("k1", key))
+	v, err := NewOIDCVerifier(context.Background(), iss.URL, "alt-text", "")
+	if err != nil {
+		t.Fatalf("NewOIDCVerifier: %v", err)
+	}
+	token := sign(t, "RS256", "k1", key, map[string]interface{}{"iss": iss.URL, "aud": "alt-text", "sub": "ada", "exp": time.Now().Unix() + 600})
+
+	// The keys have gone stale and the issuer is down
+	iss.setFailing(true)
+	v.mu.Lock()
+	v.fetchedAt = time.Now().Add(-2 * keyMaxAge)
+	v.nextRefresh = time.Time{}
+	v.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The stale key is still used
+			if _, err := v.Verify(context.Background(), token); err != nil {
+				t.Errorf("Verify with stale key: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := iss.fetches.Load(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2 (one at startup, one shared refresh)", n)
+	}
+
+	v.mu.RLock()
+	failures, wait := v.failures, time.Until(v.nextRefresh)
+	v.mu.RUnlock()
+	if failures != 1 || wait <= 0 || wait > refreshBackoff {
+		t.Errorf("after one failure: failures = %d, next refresh in %s", failures, wait)
+	}
+
+	// Within the backoff, requests don't refetch
+	v.Verify(context.Background(), token)
+	if n := iss.fetches.Load(); n != 2 {
+		t.Errorf("JWKS fetched %d times during backoff, want 2", n)
+	}
+
+	// Each further failure doubles the wait
+	v.mu.Lock()
+	v.nextRefresh = time.Time{}
+	v.mu.Unlock()
+	v.Verify(context.Background(), token)
+	v.mu.RLock()
+	failures, wait = v.failures, time.Until(v.nextRefresh)
+	v.mu.RUnlock()
+	if failures != 2 || wait <= refreshBackoff || wait > 2*refreshBackoff {
+		t.Errorf("after two failures: failures = %d, next refresh in %s", failures, wait)
+	}
+
+	// A successful refresh resets the backoff
+	iss.setFailing(false)
+	v.mu.Lock()
+	v.nextRefresh = time.Time{}
+	v.mu.Unlock()
+	if _, err := v.Verify(context.Background(), token); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	v.mu.RLock()
+	failures, stale := v.failures, time.Since(v.fetchedAt) > keyMaxAge
+	v.mu.RUnlock()
+	if failures != 0 || stale {
+		t.Errorf("after recovering: failures = %d, stale = %v", failures, stale)
+	}
+}
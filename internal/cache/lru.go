@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"alt-text-generator/internal/metrics"
+)
+
+// LRU keeps values in memory, up to a number of entries, dropping the least
+// recently used first and any older than its TTL
+type LRU struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLRU returns a cache holding up to size values, each for ttl, or until
+// evicted if ttl isn't positive
+func NewLRU(size int, ttl time.Duration) *LRU {
+	return &LRU{size: size, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// Get returns the value stored at key
+func (c *LRU) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if ok && c.ttl > 0 && time.Now().After(el.Value.(*lruEntry).expires) {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		metrics.CacheTierMisses.Inc("memory")
+		return nil, false
+	}
+	metrics.CacheTierHits.Inc("memory")
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+// Set stores value at key, evicting the least recently used values if the
+// cache is full
+func (c *LRU) Set(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &lruEntry{key: key, value: value, expires: time.Now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Len returns the number of values cached
+func (c *LRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Flush removes every cached value and returns how many were removed
+func (c *LRU) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.order.Len()
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+	return n
+}
+
+func (c *LRU) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*lruEntry).key)
+}
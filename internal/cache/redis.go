@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"alt-text-generator/internal/metrics"
+	"alt-text-generator/internal/redis"
+)
+
+// lookupTimeout bounds a cache read, so a slow Redis delays a generation
+// only briefly before it goes to history instead
+const lookupTimeout = time.Second
+
+// Redis keeps values in Redis, so every server instance using the same
+// Redis shares them. Errors are logged and treated as misses.
+type Redis struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// NewRedis returns a cache keeping values under keys starting with prefix,
+// each for ttl
+func NewRedis(client *redis.Client, prefix string, ttl time.Duration) *Redis {
+	return &Redis{client: client, prefix: prefix, ttl: ttl}
+}
+
+// Get returns the value stored at key
+func (c *Redis) Get(key string) ([]byte, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	value, ok, err := c.client.Get(ctx, c.prefix+key)
+	if err != nil {
+		slog.Warn("Error reading from the Redis cache", "err", err)
+	}
+	if !ok {
+		metrics.CacheTierMisses.Inc("redis")
+		return nil, false
+	}
+	metrics.CacheTierHits.Inc("redis")
+	return []byte(value), true
+}
+
+// Set stores value at key
+func (c *Redis) Set(key string, value []byte) {
+	if err := c.client.Set(context.Background(), c.prefix+key, string(value), c.ttl); err != nil {
+		slog.Warn("Error writing to the Redis cache", "err", err)
+	}
+}
+
+// Len returns the number of values cached
+func (c *Redis) Len() int {
+	keys, err := c.client.Scan(context.Background(), c.prefix+"*")
+	if err != nil {
+		slog.Warn("Error counting the Redis cache", "err", err)
+	}
+	return len(keys)
+}
+
+// Flush removes every cached value, for every instance sharing it, and
+// returns how many were removed
+func (c *Redis) Flush() int {
+	ctx := context.Background()
+	keys, err := c.client.Scan(ctx, c.prefix+"*")
+	n := 0
+	for start := 0; start < len(keys) && err == nil; start += 500 {
+		batch := keys[start:min(start+500, len(keys))]
+		var deleted any
+		if deleted, err = c.client.Do(ctx, append([]string{"DEL"}, batch...)...); err == nil {
+			d, _ := deleted.(int64)
+			n += int(d)
+		}
+	}
+	if err != nil {
+		slog.Warn("Error flushing the Redis cache", "err", err)
+	}
+	return n
+}
@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// annotateFormats are the CI systems -annotate can write for
+var annotateFormats = []string{"github"}
+
+// summaryRows caps the rows in a step summary table; GitHub rejects
+// summaries over 1MiB
+const summaryRows = 500
+
+// githubAnnotation writes a GitHub Actions workflow command, which the runner
+// turns into an annotation on the file in the run and on pull requests
+func githubAnnotation(w io.Writer, level, title string, f finding) {
+	props := []string{"file=" + githubProperty(f.Path)}
+	if f.Line > 0 {
+		props = append(props, fmt.Sprintf("line=%d", f.Line))
+	}
+	if f.Column > 0 {
+		props = append(props, fmt.Sprintf("col=%d", f.Column))
+	}
+	props = append(props, "title="+githubProperty(title))
+	fmt.Fprintf(w, "::%s %s::%s\n", level, strings.Join(props, ","), githubData(f.Message))
+}
+
+// githubData escapes a workflow command message
+func githubData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// githubProperty escapes a workflow command property value
+func githubProperty(s string) string {
+	return strings.NewReplacer(":", "%3A", ",", "%2C").Replace(githubData(s))
+}
+
+// writeStepSummary appends Markdown to the job summary GitHub shows on the
+// run's page. Outside Actions, where $GITHUB_STEP_SUMMARY is unset, it does
+// nothing.
+func writeStepSummary(markdown string) error {
+	path := os.Getenv("GITHUB_STEP_SUMMARY")
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, markdown); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// markdownCell makes text safe to place in a Markdown table cell
+func markdownCell(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	return strings.ReplaceAll(text, "|", `\|`)
+}
+
+// checkSummary renders check's findings as a Markdown table
+func checkSummary(findings []finding, files int) string {
+	var b strings.Builder
+	fmt.Fprintln(&b, "### Alt text check")
+	fmt.Fprintln(&b)
+	if len(findings) == 0 {
+		fmt.Fprintf(&b, "Checked %d files: every image has alt text.\n\n", files)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Checked %d files: **%d images need alt text.**\n\n", files, len(findings))
+	fmt.Fprintln(&b, "| File | Line | Problem |")
+	fmt.Fprintln(&b, "|------|------|---------|")
+	for i, f := range findings {
+		if i == summaryRows {
+			fmt.Fprintf(&b, "\n…and %d more.\n", len(findings)-i)
+			break
+		}
+		fmt.Fprintf(&b, "| `%s` | %d | %s |\n", markdownCell(f.Path), f.Line, markdownCell(f.Message))
+	}
+	fmt.Fprintln(&b)
+	return b.String()
+}
+
+// batchSummary renders a batch run's alt text and failures as a Markdown
+// table
+func batchSummary(results []batchResult, totals summary) string {
+	var b strings.Builder
+	fmt.Fprintln(&b, "### Alt text batch")
+	fmt.Fprintln(&b)
+	fmt.Fprintf(&b, "%d succeeded, %d failed, %d duplicates", totals.Succeeded, totals.Failed, totals.Duplicates)
+	if totals.Resumed > 0 {
+		fmt.Fprintf(&b, ", %d resumed", totals.Resumed)
+	}
+	if totals.BelowThreshold > 0 {
+		fmt.Fprintf(&b, ", %d below quality thresholds", totals.BelowThreshold)
+	}
+	if totals.NeedsReview > 0 {
+		fmt.Fprintf(&b, ", %d held for review", totals.NeedsReview)
+	}
+	fmt.Fprintf(&b, ". Estimated cost $%.4f.\n\n", totals.Cost)
+	if len(results) == 0 {
+		return b.String()
+	}
+	fmt.Fprintln(&b, "| Image | Alt text |")
+	fmt.Fprintln(&b, "|-------|----------|")
+	for i, result := range results {
+		if i == summaryRows {
+			fmt.Fprintf(&b, "\n…and %d more.\n", len(results)-i)
+			break
+		}
+		alt := bestAltText(result.Result.Text)
+		if result.Err != nil {
+			alt = "**Error:** " + result.Err.Error()
+		} else if len(result.Violations) > 0 {
+			alt += " **Below threshold:** " + strings.Join(result.Violations, "; ")
+		} else if result.NeedsReview {
+			alt += fmt.Sprintf(" **Needs review:** confidence %d", result.Result.Confidence)
+		}
+		fmt.Fprintf(&b, "| `%s` | %s |\n", markdownCell(result.Path), markdownCell(alt))
+	}
+	fmt.Fprintln(&b)
+	return b.String()
+}
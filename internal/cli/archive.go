@@ -0,0 +1,182 @@
+package cli
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"alt-text-generator/internal/api"
+)
+
+// archiveFormat describes how to add alt text to a zip-based document
+// format such as EPUB or DOCX
+type archiveFormat struct {
+	// find returns an edit for every image the named entry needs alt text
+	// for, and why any others were skipped. dir is where the archive has been
+	// unpacked; entries that aren't markup return nothing.
+	find func(dir, name string, data []byte) ([]altEdit, []skippedImage)
+	// finish, if set, makes any further changes once every image has alt text
+	finish func(zr *zip.ReadCloser, changed map[string][]byte) error
+}
+
+// remediateArchive captions the images in file that lack alt text and writes
+// the result to out, or shows it as a diff. The archive is unpacked to a
+// temporary directory so its images can be captioned like any other file.
+// It reports whether every image could be given alt text.
+func remediateArchive(ctx context.Context, provider api.Provider, format archiveFormat, file, out string, concurrency int, diff bool, stdout, stderr io.Writer) (bool, error) {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return false, err
+	}
+	defer zr.Close()
+
+	dir, err := os.MkdirTemp("", "alt-text-archive-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(dir)
+
+	type document struct {
+		name  string
+		data  []byte
+		edits []altEdit
+	}
+	var entries []document
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		name := path.Clean(f.Name)
+		if path.IsAbs(name) || strings.HasPrefix(name, "../") {
+			return false, fmt.Errorf("unsafe entry name %q", f.Name)
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return false, err
+		}
+		local := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(local), 0o755); err != nil {
+			return false, err
+		}
+		if err := os.WriteFile(local, data, 0o644); err != nil {
+			return false, err
+		}
+		entries = append(entries, document{name: name, data: data})
+	}
+
+	// Entries are scanned once everything is unpacked, so images stored
+	// after the markup that uses them are found
+	var docs []document
+	var images []string
+	complete := true
+	for _, doc := range entries {
+		edits, skipped := format.find(dir, doc.name, doc.data)
+		for _, skip := range skipped {
+			fmt.Fprintf(stderr, "%s:%s: skipping %s\n", file, doc.name, strings.ReplaceAll(skip.Reason, dir+string(filepath.Separator), ""))
+			complete = false
+		}
+		if len(edits) > 0 {
+			doc.edits = edits
+			docs = append(docs, doc)
+			for _, edit := range edits {
+				images = append(images, edit.Image)
+			}
+		}
+	}
+	if len(docs) == 0 {
+		fmt.Fprintf(stderr, "%s: no images need alt text\n", file)
+		return complete, nil
+	}
+
+	alts, results := captionImages(ctx, provider, images, concurrency)
+	for _, result := range results {
+		if result.Err != nil {
+			complete = false
+			rel, _ := filepath.Rel(dir, result.Path)
+			fmt.Fprintf(stderr, "%s:%s: %v\n", file, filepath.ToSlash(rel), result.Err)
+		}
+	}
+
+	changed := map[string][]byte{}
+	updated := 0
+	for _, doc := range docs {
+		data, applied := applyEdits(doc.data, doc.edits, alts)
+		if applied > 0 {
+			changed[doc.name] = data
+			updated += applied
+		}
+	}
+	if complete && format.finish != nil {
+		if err := format.finish(zr, changed); err != nil {
+			return false, err
+		}
+	}
+
+	if diff {
+		for _, f := range zr.File {
+			if data, ok := changed[path.Clean(f.Name)]; ok {
+				before, _ := readZipFile(f)
+				writeDiff(stdout, file+":"+f.Name, before, data)
+			}
+		}
+		fmt.Fprintf(stderr, "%s: would add alt text for %d images\n", file, updated)
+		return complete, nil
+	}
+
+	if err := writeArchive(zr, out, changed); err != nil {
+		return false, err
+	}
+	fmt.Fprintf(stderr, "%s: added alt text for %d images, wrote %s\n", file, updated, out)
+	return complete, nil
+}
+
+// writeArchive repacks an archive with changed entries replaced. Entries are
+// written in their original order, and unchanged ones are copied without
+// recompressing, which keeps an uncompressed EPUB mimetype entry first as
+// that format requires.
+func writeArchive(zr *zip.ReadCloser, out string, changed map[string][]byte) error {
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	for _, entry := range zr.File {
+		data, ok := changed[path.Clean(entry.Name)]
+		if !ok {
+			if err := zw.Copy(entry); err != nil {
+				f.Close()
+				return err
+			}
+			continue
+		}
+		header := entry.FileHeader
+		w, err := zw.CreateHeader(&header)
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readZipFile returns the uncompressed contents of an archive entry
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
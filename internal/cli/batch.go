@@ -0,0 +1,417 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/history"
+)
+
+// defaultExtensions are the file extensions batch captions unless -include says otherwise
+const defaultExtensions = "jpg,jpeg,png,gif,webp"
+
+// batchResult is the outcome for one image of a batch run
+type batchResult struct {
+	Path     string
+	Hash     string
+	Provider string
+	Model    string
+	Result   api.Result
+	Err      error
+	// Duplicate is set when the image matched one already captioned in this
+	// run, whose result was reused without another provider call
+	Duplicate bool
+	// Resumed is set when the image was captioned by an earlier run recorded
+	// in the -state file
+	Resumed bool
+	// Violations lists the quality thresholds the alt text failed
+	Violations []string
+	// NeedsReview is set when the alt text's confidence was below the
+	// -review-below threshold, so it is held for a person to check
+	NeedsReview bool
+}
+
+// Batch implements "alt-text-generator batch <dir|file|pattern>...": it
+// captions every matching image and writes a report of the results
+func Batch(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("batch", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	providerName := flags.String("provider", "", "provider to use: anthropic or openai (defaults to the only one configured)")
+	promptFlags(flags)
+	contextValues := contextFlag(flags)
+	recursive := flags.Bool("recursive", false, "descend into subdirectories")
+	include := flags.String("include", defaultExtensions, "comma-separated file extensions to caption")
+	exclude := flags.String("exclude", "", "comma-separated file extensions to skip")
+	reportPath := flags.String("report", "", "write the report to this file instead of stdout")
+	concurrency := flags.Int("concurrency", 4, "number of images to caption in parallel")
+	dryRunFlag := flags.Bool("dry-run", false, "list the files that would be processed or skipped, without calling the provider")
+	sidecars := flags.Bool("sidecar", false, "write each image's alt text to <image>.alt.txt and skip images that already have one")
+	watchFlag := flags.Bool("watch", false, "keep running and caption images as they are added to the given folders")
+	manifestPath := flags.String("manifest", "", "caption the images listed in this CSV or YAML file, using context such as page_title and product_name given for each")
+	statePath := flags.String("state", "", "record finished images in this file, and skip those already in it, so an interrupted run can be resumed")
+	noCache := flags.Bool("no-cache", false, "caption images again even if they have a sidecar or are in the -state file, replacing what was stored")
+	showProgress := flags.Bool("progress", isTerminal(os.Stderr), "show a progress bar on stderr")
+	rateLimit := flags.Int("rate-limit", 0, "maximum provider requests per minute across all workers (0 for no limit)")
+	outputFormat := flags.String("output-format", "text", "report format: "+strings.Join(batchFormats, ", "))
+	thresholds := thresholdFlags(flags)
+	reviewBelow := flags.Int("review-below", 0, "hold alt text whose confidence (0-100) is below this for review instead of writing it out")
+	reviewPath := flags.String("review", "", "also write results held for review to this file, as JSON lines")
+	annotate := flags.String("annotate", "", "also write failures as CI annotations and the results as a job summary: "+strings.Join(annotateFormats, ", "))
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator batch [flags] <dir|file|pattern>...")
+		fmt.Fprintln(stderr, "       alt-text-generator batch [flags] -manifest images.csv")
+		flags.PrintDefaults()
+	}
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(args) == 0 && *manifestPath == "" {
+		flags.Usage()
+		return exitUsage
+	}
+	if *manifestPath != "" && (len(args) > 0 || *watchFlag) {
+		fmt.Fprintln(stderr, "Error: -manifest lists the images to caption; don't also name files or use -watch")
+		return exitUsage
+	}
+	if *watchFlag && *dryRunFlag {
+		fmt.Fprintln(stderr, "Error: -dry-run lists what a single run would caption; it can't be combined with -watch")
+		return exitUsage
+	}
+	if !slices.Contains(batchFormats, *outputFormat) {
+		fmt.Fprintf(stderr, "Error: -output-format must be one of %s\n", strings.Join(batchFormats, ", "))
+		return exitUsage
+	}
+	if *annotate != "" && !slices.Contains(annotateFormats, *annotate) {
+		fmt.Fprintf(stderr, "Error: -annotate must be one of %s\n", strings.Join(annotateFormats, ", "))
+		return exitUsage
+	}
+	if *concurrency < 1 {
+		fmt.Fprintln(stderr, "Error: -concurrency must be at least 1")
+		return exitUsage
+	}
+	if *reviewBelow < 0 || *reviewBelow > 100 {
+		fmt.Fprintln(stderr, "Error: -review-below must be from 0 to 100")
+		return exitUsage
+	}
+	if *reviewPath != "" && *reviewBelow == 0 {
+		fmt.Fprintln(stderr, "Error: -review needs -review-below to pick the results to review")
+		return exitUsage
+	}
+	roots, err := expandGlobs(args)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	includeExts, excludeExts := parseExtensions(*include), parseExtensions(*exclude)
+	if *watchFlag && *outputFormat == "json" {
+		fmt.Fprintln(stderr, "Error: -watch writes results as they arrive; use -output-format jsonl instead of json")
+		return exitUsage
+	}
+
+	imageContext, err := api.NewImageContext(contextValues)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitUsage
+	}
+
+	var paths []string
+	var contexts []api.ImageContext
+	existing := 0
+	if *manifestPath != "" {
+		entries, err := readManifest(*manifestPath, contextValues)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		for _, entry := range entries {
+			paths = append(paths, entry.Path)
+			contexts = append(contexts, entry.Context)
+		}
+	}
+	if !*watchFlag {
+		if *manifestPath == "" {
+			if paths, err = findFiles(roots, *recursive, includeExts, excludeExts); err != nil {
+				fmt.Fprintln(stderr, "Error:", err)
+				return exitError
+			}
+		}
+		if len(paths) == 0 {
+			fmt.Fprintln(stderr, "Error: no matching images found")
+			return exitError
+		}
+		if *dryRunFlag {
+			var state *checkpoint
+			if *statePath != "" {
+				if state, err = readCheckpoint(*statePath); err != nil {
+					fmt.Fprintln(stderr, "Error reading state file:", err)
+					return exitError
+				}
+				state.refresh = *noCache
+			}
+			dryRun(stdout, paths, contexts, *sidecars && !*noCache, state)
+			return exitOK
+		}
+		if *sidecars && !*noCache {
+			var keptPaths []string
+			var keptContexts []api.ImageContext
+			for i, path := range paths {
+				if hasSidecar(path) {
+					existing++
+					continue
+				}
+				keptPaths = append(keptPaths, path)
+				if contexts != nil {
+					keptContexts = append(keptContexts, contexts[i])
+				}
+			}
+			paths, contexts = keptPaths, keptContexts
+		}
+	}
+
+	if err := setup(); err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	if _, set := os.LookupEnv("ALT_TEXT_STRUCTURED"); !set && *outputFormat == "figure" {
+		// A figure's caption comes from the structured result
+		os.Setenv("ALT_TEXT_STRUCTURED", "true")
+	}
+	provider, err := selectProvider(*providerName)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitUsage
+	}
+	if *rateLimit > 0 {
+		provider = paceProvider(provider, *rateLimit, *concurrency)
+	}
+
+	report := stdout
+	if *reportPath != "" {
+		f, err := os.Create(*reportPath)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		defer f.Close()
+		report = f
+	}
+	writer, err := newReportWriter(report, *outputFormat)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error writing report:", err)
+		return exitError
+	}
+
+	var reviewQueue *json.Encoder
+	if *reviewPath != "" {
+		f, err := os.Create(*reviewPath)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		defer f.Close()
+		reviewQueue = json.NewEncoder(f)
+	}
+
+	var state *checkpoint
+	if *statePath != "" {
+		if state, err = openCheckpoint(*statePath); err != nil {
+			fmt.Fprintln(stderr, "Error opening state file:", err)
+			return exitError
+		}
+		defer state.Close()
+		state.refresh = *noCache
+		if n := state.Len(); n > 0 && !*noCache {
+			fmt.Fprintf(stderr, "Resuming: %d images already captioned in %s\n", n, *statePath)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	// Values given with -context apply to every image; a manifest's
+	// contexts already include them
+	ctx = api.WithImageContext(ctx, imageContext)
+
+	totals := summary{Existing: existing}
+	var annotated, belowThreshold, toReview []batchResult
+	handle := func(result batchResult) error {
+		checkThresholds(thresholds, &result)
+		checkConfidence(*reviewBelow, &result)
+		// Alt text below the thresholds or held for review is reported but
+		// not written out
+		if *sidecars && result.Err == nil && len(result.Violations) == 0 && !result.NeedsReview {
+			if err := writeSidecar(result); err != nil {
+				result.Err = fmt.Errorf("writing sidecar: %v", err)
+			}
+		}
+		totals.Add(provider, result)
+		if len(result.Violations) > 0 {
+			belowThreshold = append(belowThreshold, result)
+		}
+		if result.NeedsReview {
+			toReview = append(toReview, result)
+			if reviewQueue != nil {
+				if err := reviewQueue.Encode(newReportRecord(result)); err != nil {
+					return fmt.Errorf("writing review queue: %v", err)
+				}
+			}
+		}
+		if *annotate == "github" {
+			// Annotations go to stderr so they don't mix with a report on stdout;
+			// the runner reads workflow commands from both
+			if result.Err != nil {
+				githubAnnotation(stderr, "error", "Alt text generation failed", finding{Path: result.Path, Message: result.Err.Error()})
+			} else if len(result.Violations) > 0 {
+				githubAnnotation(stderr, "error", "Alt text below quality threshold", finding{Path: result.Path, Message: strings.Join(result.Violations, "; ")})
+			} else if result.NeedsReview {
+				githubAnnotation(stderr, "warning", "Alt text needs review", finding{Path: result.Path, Message: fmt.Sprintf("confidence %d, under %d", result.Result.Confidence, *reviewBelow)})
+			}
+			annotated = append(annotated, result)
+		}
+		return writer.Write(result)
+	}
+
+	started := time.Now()
+	if *watchFlag {
+		match := func(path string) bool {
+			ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+			return includeExts[ext] && !excludeExts[ext] && !(*sidecars && !*noCache && hasSidecar(path))
+		}
+		fmt.Fprintln(stderr, "Watching for new images; press Ctrl-C to stop")
+		err = watch(ctx, provider, roots, *recursive, match, *concurrency, state, handle)
+	} else {
+		var bar *progress
+		if *showProgress {
+			bar = newProgress(stderr, len(paths))
+		}
+		err = captionAll(ctx, provider, paths, contexts, *concurrency, bar, state, handle)
+		bar.Finish()
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+
+	totals.Write(stderr, time.Since(started))
+	if len(belowThreshold) > 0 {
+		fmt.Fprintln(stderr, "Alt text below quality thresholds:")
+		for _, result := range belowThreshold {
+			fmt.Fprintf(stderr, "  %s: %s\n", result.Path, strings.Join(result.Violations, "; "))
+		}
+	}
+	if len(toReview) > 0 {
+		fmt.Fprintf(stderr, "Alt text held for review (confidence under %d):\n", *reviewBelow)
+		for _, result := range toReview {
+			fmt.Fprintf(stderr, "  %s: confidence %d\n", result.Path, result.Result.Confidence)
+		}
+	}
+	if *annotate == "github" {
+		if err := writeStepSummary(batchSummary(annotated, totals)); err != nil {
+			fmt.Fprintln(stderr, "Error writing job summary:", err)
+		}
+	}
+	if totals.Failed > 0 || totals.BelowThreshold > 0 || (ctx.Err() != nil && !*watchFlag) {
+		return exitError
+	}
+	return exitOK
+}
+
+// captionFile reads (or downloads) and captions one image. When seen is non-nil, images
+// with the same content (and image context) as an earlier one reuse its
+// result. Images recorded in state are not captioned again, and new results
+// are recorded there.
+func captionFile(ctx context.Context, provider api.Provider, path string, seen *dedupe, state *checkpoint) batchResult {
+	res := batchResult{Path: path, Provider: provider.Name, Model: provider.Model}
+	if path != stdinPath {
+		ctx = api.WithFilename(ctx, filepath.Base(path))
+	}
+	data, err := loadImage(ctx, path)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	res.Hash = history.HashImage(data)
+	if state.resume(&res) {
+		return res
+	}
+	if seen == nil {
+		res.Result, res.Err = generate(ctx, provider, data)
+	} else {
+		key := dedupeKey(res.Hash, api.ImageContextFrom(ctx))
+		res.Result, res.Err, res.Duplicate = seen.do(key, func() (api.Result, error) {
+			return generate(ctx, provider, data)
+		})
+	}
+	if err := state.save(res); err != nil {
+		res.Err = fmt.Errorf("saving state: %v", err)
+	}
+	return res
+}
+
+// findFiles expands roots into file paths in walk order. Files named
+// directly are always included; directories contribute files whose extension
+// is in include and not in exclude, descending only when recursive is set.
+func findFiles(roots []string, recursive bool, include, exclude map[string]bool) ([]string, error) {
+	var paths []string
+	for _, root := range roots {
+		if root == stdinPath {
+			paths = append(paths, root)
+			continue
+		}
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, root)
+			continue
+		}
+
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != root && !recursive {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+			if include[ext] && !exclude[ext] {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// parseExtensions turns "jpg, .PNG" into a set of lowercase extensions without dots
+func parseExtensions(s string) map[string]bool {
+	exts := map[string]bool{}
+	for _, ext := range strings.Split(s, ",") {
+		if ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")); ext != "" {
+			exts[ext] = true
+		}
+	}
+	return exts
+}
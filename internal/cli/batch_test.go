@@ -0,0 +1,35 @@
+package cli
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBatchConflictingFlags(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{"watch and dry run", []string{"-watch", "-dry-run", dir}, "can't be combined with -watch"},
+		{"manifest and watch", []string{"-manifest", "images.csv", "-watch"}, "don't also name files or use -watch"},
+		{"watch and json", []string{"-watch", "-output-format", "json", dir}, "use -output-format jsonl"},
+		{"review without threshold", []string{"-review", "review.jsonl", dir}, "-review needs -review-below"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := Batch(tt.args, &stdout, &stderr); code != exitUsage {
+				t.Errorf("exit code = %d, want %d", code, exitUsage)
+			}
+			if !strings.Contains(stderr.String(), tt.err) {
+				t.Errorf("stderr = %q, want %q", stderr.String(), tt.err)
+			}
+			if stdout.Len() > 0 {
+				t.Errorf("stdout = %q, want nothing", stdout.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,560 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/diagnostics"
+)
+
+// benchFormats are the formats bench can write its report in
+var benchFormats = []string{"text", "json"}
+
+// benchImage is an image bench sends
+type benchImage struct {
+	Filename string
+	Data     []byte
+	// Encoded is Data in base64 for the server's JSON API, encoded once up
+	// front so the encoding isn't part of what's measured
+	Encoded string
+}
+
+// benchLatency summarises how long the successful requests took
+type benchLatency struct {
+	Min  time.Duration `json:"min_ns"`
+	Mean time.Duration `json:"mean_ns"`
+	P50  time.Duration `json:"p50_ns"`
+	P90  time.Duration `json:"p90_ns"`
+	P95  time.Duration `json:"p95_ns"`
+	P99  time.Duration `json:"p99_ns"`
+	Max  time.Duration `json:"max_ns"`
+}
+
+// benchMemory is the memory the process generating alt text used over the
+// run, in bytes: this one for the provider layer, or the server's as its
+// debug listener reports it
+type benchMemory struct {
+	// AllocPerRequest is everything allocated during the run, freed or not,
+	// divided by the requests sent
+	AllocPerRequest uint64 `json:"alloc_per_request"`
+	HeapInuseBefore uint64 `json:"heap_inuse_before"`
+	HeapInuseAfter  uint64 `json:"heap_inuse_after"`
+	// HeapInusePeak is sampled during the run, so only in-process runs have it
+	HeapInusePeak uint64 `json:"heap_inuse_peak,omitempty"`
+	GCCycles      uint32 `json:"gc_cycles"`
+}
+
+// benchReport is what bench writes
+type benchReport struct {
+	// Target is the server's URL or the provider's name
+	Target      string  `json:"target"`
+	Requests    int     `json:"requests"`
+	Concurrency int     `json:"concurrency"`
+	Succeeded   int     `json:"succeeded"`
+	Failed      int     `json:"failed"`
+	Duration    float64 `json:"duration_seconds"`
+	Throughput  float64 `json:"requests_per_second"`
+	// Errors counts the failed requests by status or error message
+	Errors  map[string]int `json:"errors,omitempty"`
+	Latency benchLatency   `json:"latency"`
+	Memory  *benchMemory   `json:"memory,omitempty"`
+}
+
+// benchSender sends one request, returning an error naming the status or
+// problem when it fails
+type benchSender func(ctx context.Context, image benchImage) error
+
+// Bench implements "alt-text-generator bench": it sends a fixed number of
+// requests to a running server, or straight to a provider, at a given
+// concurrency and reports latency percentiles, throughput, and memory, so a
+// change that slows generation or makes it allocate more can be caught
+func Bench(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	promptFlags(flags)
+	contextValues := contextFlag(flags)
+	serverURL := flags.String("url", "", "send requests to the JSON API of the server at this base URL instead of calling a provider in this process")
+	key := flags.String("key", "", "API key for the server, when it requires one")
+	refresh := flags.Bool("refresh", false, "ask the server to skip its result cache, so every request reaches the provider")
+	debugURL := flags.String("debug-url", "", "base URL of the server's debug listener, to report its memory use over the run")
+	adminKey := flags.String("admin-key", "", "admin API key for the debug listener")
+	providerName := flags.String("provider", "", "provider to call in this process: anthropic or openai")
+	mock := flags.Bool("mock", false, "call a mock provider in this process, which makes no network calls, instead of a real one")
+	latency := flags.Duration("latency", 500*time.Millisecond, "how long each mock provider call takes")
+	stream := flags.Bool("stream", false, "stream each response from the provider in this process instead of waiting for it whole")
+	requests := flags.Int("requests", 100, "number of requests to send")
+	concurrency := flags.Int("concurrency", 8, "number of requests to keep in flight at once")
+	timeout := flags.Duration("timeout", 2*time.Minute, "longest a request may take before it counts as failed")
+	maxP95 := flags.Duration("max-p95", 0, "exit with an error when the 95th percentile latency exceeds this (0 for no limit)")
+	maxErrorRate := flags.Float64("max-error-rate", 100, "exit with an error when more than this percentage of requests fail")
+	outputFormat := flags.String("output-format", "text", "report format: "+strings.Join(benchFormats, ", "))
+	reportPath := flags.String("report", "", "write the report to this file instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator bench [flags] -url http://localhost:8080 <dir|file|pattern>...")
+		fmt.Fprintln(stderr, "       alt-text-generator bench [flags] -mock <dir|file|pattern>...")
+		flags.PrintDefaults()
+	}
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	if *serverURL != "" && (*mock || *providerName != "" || *stream) {
+		fmt.Fprintln(stderr, "Error: -mock, -provider, and -stream are for calling a provider in this process; don't combine them with -url")
+		return exitUsage
+	}
+	if *serverURL == "" && (*refresh || *debugURL != "") {
+		fmt.Fprintln(stderr, "Error: -refresh and -debug-url need -url")
+		return exitUsage
+	}
+	if *mock && *providerName != "" {
+		fmt.Fprintln(stderr, "Error: give -mock or -provider, not both")
+		return exitUsage
+	}
+	if !slices.Contains(benchFormats, *outputFormat) {
+		fmt.Fprintf(stderr, "Error: -output-format must be one of %s\n", strings.Join(benchFormats, ", "))
+		return exitUsage
+	}
+	if *requests < 1 || *concurrency < 1 {
+		fmt.Fprintln(stderr, "Error: -requests and -concurrency must be at least 1")
+		return exitUsage
+	}
+	imageContext, err := api.NewImageContext(contextValues)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitUsage
+	}
+
+	roots, err := expandGlobs(args)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	paths, err := findFiles(roots, false, parseExtensions(defaultExtensions), nil)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(stderr, "Error: no matching images found")
+		return exitError
+	}
+	var images []benchImage
+	for _, path := range paths {
+		data, err := readImage(path)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		image := benchImage{Filename: filepath.Base(path), Data: data}
+		if *serverURL != "" {
+			image.Encoded = base64.StdEncoding.EncodeToString(data)
+		}
+		images = append(images, image)
+	}
+
+	var target string
+	var send benchSender
+	if *serverURL != "" {
+		target = strings.TrimSuffix(*serverURL, "/")
+		send = serverSender(target, *key, *refresh, contextValues, *concurrency)
+	} else {
+		if err := setup(); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		var provider api.Provider
+		if *mock {
+			provider = api.Mock(*latency)
+		} else if provider, err = selectProvider(*providerName); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitUsage
+		}
+		target = provider.Name
+		send = providerSender(provider, imageContext, *stream)
+	}
+
+	out := stdout
+	if *reportPath != "" {
+		f, err := os.Create(*reportPath)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		defer f.Close()
+		out = f
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Fprintf(stderr, "Sending %d requests to %s, %d at a time\n", *requests, target, *concurrency)
+	var memory *benchMemory
+	var report benchReport
+	if *serverURL != "" {
+		var before diagnostics.Stats
+		if *debugURL != "" {
+			if before, err = readServerStats(ctx, *debugURL, *adminKey); err != nil {
+				fmt.Fprintln(stderr, "Error:", err)
+				return exitError
+			}
+		}
+		report = runBench(ctx, send, images, *requests, *concurrency, *timeout)
+		if *debugURL != "" {
+			after, err := readServerStats(ctx, *debugURL, *adminKey)
+			if err != nil {
+				fmt.Fprintln(stderr, "Error:", err)
+				return exitError
+			}
+			memory = memoryUsed(before.Memory.TotalAlloc, after.Memory.TotalAlloc, *requests)
+			memory.HeapInuseBefore = before.Memory.HeapInuse
+			memory.HeapInuseAfter = after.Memory.HeapInuse
+			memory.GCCycles = after.GC.Cycles - before.GC.Cycles
+		}
+	} else {
+		runtime.GC()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		peak := sampleHeap()
+		report = runBench(ctx, send, images, *requests, *concurrency, *timeout)
+		runtime.ReadMemStats(&after)
+		memory = memoryUsed(before.TotalAlloc, after.TotalAlloc, *requests)
+		memory.HeapInuseBefore = before.HeapInuse
+		memory.HeapInuseAfter = after.HeapInuse
+		memory.HeapInusePeak = max(peak(), after.HeapInuse)
+		memory.GCCycles = after.NumGC - before.NumGC
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintln(stderr, "Error: interrupted")
+		return exitError
+	}
+	report.Target = target
+	report.Memory = memory
+
+	if *outputFormat == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = writeBenchText(out, report)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "Error writing report:", err)
+		return exitError
+	}
+
+	status := exitOK
+	if *maxP95 > 0 && report.Latency.P95 > *maxP95 {
+		fmt.Fprintf(stderr, "Error: p95 latency %s exceeds -max-p95 %s\n", roundLatency(report.Latency.P95), *maxP95)
+		status = exitError
+	}
+	if rate := 100 * float64(report.Failed) / float64(report.Requests); rate > *maxErrorRate {
+		fmt.Fprintf(stderr, "Error: %.1f%% of requests failed, more than -max-error-rate %g%%\n", rate, *maxErrorRate)
+		status = exitError
+	}
+	return status
+}
+
+// runBench sends requests with send, concurrency at a time, cycling through
+// images, and summarises how they went
+func runBench(ctx context.Context, send benchSender, images []benchImage, requests, concurrency int, timeout time.Duration) benchReport {
+	latencies := make([]time.Duration, requests)
+	failures := make([]error, requests)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range min(concurrency, requests) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				reqCtx, cancel := context.WithTimeout(ctx, timeout)
+				began := time.Now()
+				failures[i] = send(reqCtx, images[i%len(images)])
+				latencies[i] = time.Since(began)
+				cancel()
+			}
+		}()
+	}
+	for i := 0; i < requests && ctx.Err() == nil; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	report := benchReport{
+		Requests:    requests,
+		Concurrency: concurrency,
+		Duration:    elapsed.Seconds(),
+		Throughput:  float64(requests) / elapsed.Seconds(),
+	}
+	var succeeded []time.Duration
+	for i, err := range failures {
+		if err == nil {
+			succeeded = append(succeeded, latencies[i])
+			continue
+		}
+		if report.Errors == nil {
+			report.Errors = map[string]int{}
+		}
+		report.Errors[err.Error()]++
+	}
+	report.Succeeded = len(succeeded)
+	report.Failed = requests - len(succeeded)
+	report.Latency = summariseLatency(succeeded)
+	return report
+}
+
+// summariseLatency works out the spread of latencies, by nearest rank
+func summariseLatency(latencies []time.Duration) benchLatency {
+	if len(latencies) == 0 {
+		return benchLatency{}
+	}
+	slices.Sort(latencies)
+	var total time.Duration
+	for _, d := range latencies {
+		total += d
+	}
+	percentile := func(p float64) time.Duration {
+		rank := int(math.Ceil(p / 100 * float64(len(latencies))))
+		return latencies[max(rank-1, 0)]
+	}
+	return benchLatency{
+		Min:  latencies[0],
+		Mean: total / time.Duration(len(latencies)),
+		P50:  percentile(50),
+		P90:  percentile(90),
+		P95:  percentile(95),
+		P99:  percentile(99),
+		Max:  latencies[len(latencies)-1],
+	}
+}
+
+// providerSender calls provider in this process, as the server would
+func providerSender(provider api.Provider, imageContext api.ImageContext, stream bool) benchSender {
+	return func(ctx context.Context, image benchImage) error {
+		ctx = api.WithFilename(api.WithImageContext(ctx, imageContext), image.Filename)
+		var err error
+		if stream {
+			_, err = provider.Stream(ctx, image.Data, func(string) {})
+		} else {
+			_, err = provider.Generate(ctx, image.Data)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return errors.New("timed out")
+		}
+		return err
+	}
+}
+
+// serverSender posts each image to the server's JSON generate endpoint
+func serverSender(baseURL, key string, refresh bool, contextValues map[string]string, concurrency int) benchSender {
+	endpoint := baseURL + "/api/v1/generate"
+	if refresh {
+		endpoint += "?refresh=true"
+	}
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: concurrency,
+	}}
+	return func(ctx context.Context, image benchImage) error {
+		body, err := json.Marshal(map[string]interface{}{
+			"image_base64": image.Encoded,
+			"filename":     image.Filename,
+			"context":      contextValues,
+		})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		resp, err := client.Do(req)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return errors.New("timed out")
+		}
+		if err != nil {
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			return err
+		}
+		defer resp.Body.Close()
+		// Read the whole body so the connection can be reused
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return errors.New(resp.Status)
+		}
+		return nil
+	}
+}
+
+// readServerStats fetches the server's runtime stats from its debug listener
+func readServerStats(ctx context.Context, debugURL, adminKey string) (diagnostics.Stats, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(debugURL, "/")+"/debug/runtime", nil)
+	if err != nil {
+		return diagnostics.Stats{}, err
+	}
+	if adminKey != "" {
+		req.Header.Set("X-API-Key", adminKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return diagnostics.Stats{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return diagnostics.Stats{}, fmt.Errorf("reading the server's runtime stats: %s", resp.Status)
+	}
+	var stats diagnostics.Stats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return diagnostics.Stats{}, fmt.Errorf("reading the server's runtime stats: %v", err)
+	}
+	return stats, nil
+}
+
+// memoryUsed starts a memory summary from the bytes allocated before and
+// after a run of requests
+func memoryUsed(allocBefore, allocAfter uint64, requests int) *benchMemory {
+	return &benchMemory{AllocPerRequest: (allocAfter - allocBefore) / uint64(requests)}
+}
+
+// sampleHeap watches the heap in use until the returned function is called,
+// which gives the most it saw
+func sampleHeap() func() uint64 {
+	var peak uint64
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		var m runtime.MemStats
+		for {
+			select {
+			case <-ticker.C:
+				runtime.ReadMemStats(&m)
+				peak = max(peak, m.HeapInuse)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		<-stopped
+		return peak
+	}
+}
+
+// writeBenchText writes report as a list of totals followed by the latency
+// spread and memory use
+func writeBenchText(w io.Writer, report benchReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Target:\t%s\n", report.Target)
+	fmt.Fprintf(tw, "Requests:\t%d (%d succeeded, %d failed)\n", report.Requests, report.Succeeded, report.Failed)
+	fmt.Fprintf(tw, "Concurrency:\t%d\n", report.Concurrency)
+	fmt.Fprintf(tw, "Duration:\t%.2fs\n", report.Duration)
+	fmt.Fprintf(tw, "Throughput:\t%.2f requests/s\n", report.Throughput)
+	if m := report.Memory; m != nil {
+		fmt.Fprintf(tw, "Allocated:\t%s per request\n", formatBytes(m.AllocPerRequest))
+		fmt.Fprintf(tw, "Heap in use:\t%s before, %s after", formatBytes(m.HeapInuseBefore), formatBytes(m.HeapInuseAfter))
+		if m.HeapInusePeak > 0 {
+			fmt.Fprintf(tw, ", %s at peak", formatBytes(m.HeapInusePeak))
+		}
+		fmt.Fprintln(tw)
+		fmt.Fprintf(tw, "GC cycles:\t%d\n", m.GCCycles)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if report.Succeeded > 0 {
+		l := report.Latency
+		fmt.Fprintln(w)
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "Latency\tmin\tmean\tp50\tp90\tp95\tp99\tmax")
+		for _, d := range []time.Duration{l.Min, l.Mean, l.P50, l.P90, l.P95, l.P99, l.Max} {
+			fmt.Fprintf(tw, "\t%s", roundLatency(d))
+		}
+		fmt.Fprintln(tw)
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(report.Errors) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Errors:")
+		messages := make([]string, 0, len(report.Errors))
+		for message := range report.Errors {
+			messages = append(messages, message)
+		}
+		slices.SortFunc(messages, func(a, b string) int {
+			if n := report.Errors[b] - report.Errors[a]; n != 0 {
+				return n
+			}
+			return strings.Compare(a, b)
+		})
+		for _, message := range messages {
+			fmt.Fprintf(w, "  %5d  %s\n", report.Errors[message], message)
+		}
+	}
+	return nil
+}
+
+// roundLatency rounds d to a precision that suits its size
+func roundLatency(d time.Duration) time.Duration {
+	if d < 10*time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
+
+// formatBytes writes n in the largest binary unit that keeps it at least 1
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, suffix := float64(n)/unit, "KiB"
+	for _, next := range []string{"MiB", "GiB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, next
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
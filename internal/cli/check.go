@@ -0,0 +1,235 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// checkExtensions are the files check scans
+const checkExtensions = "html,htm,md,mdx,markdown"
+
+// finding is an image that needs alt text, located for an editor or CI log
+type finding struct {
+	Path         string
+	Line, Column int
+	Message      string
+}
+
+// Check implements "alt-text-generator check [file|dir|pattern...]": it
+// scans HTML and Markdown files, by default those changed in the git working
+// tree, and exits non-zero if any image lacks alt text. With -patch it also
+// captions those images and writes the fixes as a patch.
+func Check(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	providerName := flags.String("provider", "", "provider to use for -patch: anthropic or openai (defaults to the only one configured)")
+	promptFlags(flags)
+	recursive := flags.Bool("recursive", false, "descend into subdirectories")
+	root := flags.String("root", ".", "site or docs root that absolute image paths such as /img/a.png resolve against")
+	base := flags.String("base", "", "check files changed since this git ref, such as origin/main in a pull request")
+	staged := flags.Bool("staged", false, "check files staged for commit, for use as a pre-commit hook")
+	flagEmpty := flags.Bool("flag-empty", false, `also report HTML images with alt="", which otherwise marks them decorative`)
+	patchPath := flags.String("patch", "", `caption the images and write the fixes as a patch to this file ("-" for stdout)`)
+	concurrency := flags.Int("concurrency", 4, "number of images to caption in parallel with -patch")
+	thresholds := thresholdFlags(flags)
+	annotate := flags.String("annotate", "", "write findings as CI annotations and a job summary: "+strings.Join(annotateFormats, ", "))
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator check [flags] [file|dir|pattern...]")
+		fmt.Fprintln(stderr, "With no files, checks those changed in the git working tree.")
+		flags.PrintDefaults()
+	}
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if *annotate != "" && !slices.Contains(annotateFormats, *annotate) {
+		fmt.Fprintf(stderr, "Error: -annotate must be one of %s\n", strings.Join(annotateFormats, ", "))
+		return exitUsage
+	}
+	if len(args) > 0 && (*base != "" || *staged) {
+		fmt.Fprintln(stderr, "Error: -base and -staged choose files from git; don't also name files")
+		return exitUsage
+	}
+
+	var paths []string
+	if len(args) > 0 {
+		roots, err := expandGlobs(args)
+		if err == nil {
+			paths, err = findFiles(roots, *recursive, parseExtensions(checkExtensions), nil)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+	} else {
+		if paths, err = changedFiles(*base, *staged); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+	}
+
+	type document struct {
+		path  string
+		data  []byte
+		edits []altEdit
+	}
+	var findings []finding
+	var docs []document
+	var images []string
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		edits, skipped := findDocumentImages(path, data, *root, *flagEmpty)
+		for _, edit := range edits {
+			rel, err := filepath.Rel(filepath.Dir(path), edit.Image)
+			if err != nil {
+				rel = edit.Image
+			}
+			findings = append(findings, newFinding(path, data, edit.Start, "image "+filepath.ToSlash(rel)+" has no alt text"))
+			images = append(images, edit.Image)
+		}
+		for _, skip := range skipped {
+			findings = append(findings, newFinding(path, data, skip.Offset, "image has no alt text ("+skip.Reason+")"))
+		}
+		if len(edits) > 0 {
+			docs = append(docs, document{path, data, edits})
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+	for _, f := range findings {
+		if *annotate == "github" {
+			githubAnnotation(stdout, "error", "Missing alt text", f)
+		} else {
+			fmt.Fprintf(stdout, "%s:%d:%d: %s\n", f.Path, f.Line, f.Column, f.Message)
+		}
+	}
+	if *annotate == "github" {
+		if err := writeStepSummary(checkSummary(findings, len(paths))); err != nil {
+			fmt.Fprintln(stderr, "Error writing job summary:", err)
+		}
+	}
+	if len(findings) == 0 {
+		fmt.Fprintf(stderr, "Checked %d files: every image has alt text\n", len(paths))
+		return exitOK
+	}
+	fmt.Fprintf(stderr, "Checked %d files: %d images need alt text\n", len(paths), len(findings))
+
+	if *patchPath != "" && len(images) > 0 {
+		if err := setup(); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		provider, err := selectProvider(*providerName)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitUsage
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		alts, results := captionImages(ctx, provider, images, *concurrency)
+		for _, result := range results {
+			checkThresholds(thresholds, &result)
+			switch {
+			case result.Err != nil:
+				fmt.Fprintf(stderr, "%s: %v\n", result.Path, result.Err)
+			case len(result.Violations) > 0:
+				// Alt text below the thresholds is left out of the patch
+				delete(alts, result.Path)
+				fmt.Fprintf(stderr, "%s: alt text below quality thresholds, left out of the patch: %s\n", result.Path, strings.Join(result.Violations, "; "))
+			}
+		}
+
+		var patch bytes.Buffer
+		for _, doc := range docs {
+			if data, applied := applyEdits(doc.data, doc.edits, alts); applied > 0 {
+				writeDiff(&patch, filepath.ToSlash(doc.path), doc.data, data)
+			}
+		}
+		if *patchPath == stdinPath {
+			stdout.Write(patch.Bytes())
+		} else if err := os.WriteFile(*patchPath, patch.Bytes(), 0o644); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		} else {
+			fmt.Fprintf(stderr, "Wrote suggested fixes to %s; apply them with git apply -p0 %s\n", *patchPath, *patchPath)
+		}
+	}
+	return exitError
+}
+
+// findDocumentImages finds the images needing alt text in an HTML or
+// Markdown file, chosen by extension
+func findDocumentImages(path string, data []byte, root string, flagEmpty bool) ([]altEdit, []skippedImage) {
+	dir := filepath.Dir(path)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		return findHTMLImages(data, dir, root, flagEmpty)
+	}
+	return findMarkdownImages(data, dir, root)
+}
+
+// newFinding locates offset in data as a 1-based line and column
+func newFinding(path string, data []byte, offset int, message string) finding {
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := offset - bytes.LastIndexByte(before, '\n')
+	return finding{Path: path, Line: line, Column: column, Message: message}
+}
+
+// changedFiles lists the HTML and Markdown files git reports as changed:
+// since base if set, in the index with staged, and otherwise in the working
+// tree, including untracked files. Paths are relative to the current
+// directory, and deleted files are left out.
+func changedFiles(base string, staged bool) ([]string, error) {
+	diff := []string{"diff", "--name-only", "-z", "--relative", "--diff-filter=ACMR"}
+	var lists [][]string
+	switch {
+	case base != "":
+		lists = append(lists, append(diff, base+"...HEAD"))
+	case staged:
+		lists = append(lists, append(diff, "--cached"))
+	default:
+		lists = append(lists, append(diff, "HEAD"), []string{"ls-files", "-z", "--others", "--exclude-standard"})
+	}
+
+	exts := parseExtensions(checkExtensions)
+	seen := map[string]bool{}
+	var paths []string
+	for _, args := range lists {
+		var stderr bytes.Buffer
+		cmd := exec.Command("git", args...)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("git %s: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+		}
+		for _, path := range strings.Split(string(out), "\x00") {
+			ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+			if path != "" && exts[ext] && !seen[path] {
+				seen[path] = true
+				paths = append(paths, filepath.FromSlash(path))
+			}
+		}
+	}
+	return paths, nil
+}
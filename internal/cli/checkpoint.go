@@ -0,0 +1,160 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"alt-text-generator/internal/api"
+)
+
+// checkpoint records each image a batch run finishes in a JSON Lines state
+// file, so a run interrupted partway can be resumed without captioning (and
+// paying for) those images again. Images are matched by content hash, so a
+// resumed run finds them even if they were moved. A nil checkpoint records
+// nothing.
+type checkpoint struct {
+	mu sync.Mutex
+	// done holds what earlier runs finished; images finished by this run are
+	// only marked saved, so repeats within the run still count as duplicates
+	done  map[string]reportRecord
+	saved map[string]bool
+	f     *os.File
+	// refresh captions every image again, recording new results after the
+	// old ones; the last recorded for an image wins when the file is loaded
+	refresh bool
+}
+
+// openCheckpoint loads the images already finished in the state file at
+// path, creating it if needed, and opens it to record more
+func openCheckpoint(path string) (*checkpoint, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	c := &checkpoint{done: map[string]reportRecord{}, saved: map[string]bool{}, f: f}
+	if err := c.load(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Start recording on a fresh line after any partial one
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			f.Write([]byte("\n"))
+		}
+	}
+	return c, nil
+}
+
+// readCheckpoint loads the images already finished in the state file at
+// path without opening it to record more, for a dry run, which mustn't
+// change it. A missing file has none.
+func readCheckpoint(path string) (*checkpoint, error) {
+	c := &checkpoint{done: map[string]reportRecord{}, saved: map[string]bool{}}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return c, c.load(f)
+}
+
+// load reads the records in a state file
+func (c *checkpoint) load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		// A run killed mid-write can leave a partial last line; skip it
+		var record reportRecord
+		if json.Unmarshal(scanner.Bytes(), &record) == nil && record.Hash != "" {
+			c.done[record.Hash] = record
+		}
+	}
+	return scanner.Err()
+}
+
+// Len returns how many images earlier runs recorded
+func (c *checkpoint) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.done)
+}
+
+// lookup returns the result recorded for an image with hash
+func (c *checkpoint) lookup(hash string) (reportRecord, bool) {
+	if c == nil {
+		return reportRecord{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	record, ok := c.done[hash]
+	return record, ok
+}
+
+// save records a successful result. Each record is written as one line as
+// soon as the image finishes, so little is lost if the run is killed.
+func (c *checkpoint) save(result batchResult) error {
+	if c == nil || result.Err != nil || result.Hash == "" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.done[result.Hash]; ok && !c.refresh || c.saved[result.Hash] {
+		return nil
+	}
+	line, err := json.Marshal(newReportRecord(result))
+	if err != nil {
+		return err
+	}
+	if _, err := c.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	c.saved[result.Hash] = true
+	return nil
+}
+
+// resume fills in res from the state file if its image was finished by an
+// earlier run. No tokens are counted, since none are spent this time.
+func (c *checkpoint) resume(res *batchResult) bool {
+	if c != nil && c.refresh {
+		return false
+	}
+	record, ok := c.lookup(res.Hash)
+	if !ok {
+		return false
+	}
+	res.Provider, res.Model = record.Provider, record.Model
+	res.Result = api.Result{
+		Text:         record.AltText,
+		Description:  record.Description,
+		Score:        record.Score,
+		Confidence:   record.Confidence,
+		Lint:         record.Lint,
+		Caption:      record.Caption,
+		Tags:         record.Tags,
+		Objects:      record.Objects,
+		DetectedText: record.DetectedText,
+		Keywords:     record.Keywords,
+		Issues:       record.Issues,
+		MaxChars:     record.MaxChars,
+	}
+	res.Resumed = true
+	return true
+}
+
+// Close closes the state file
+func (c *checkpoint) Close() error {
+	if c == nil || c.f == nil {
+		return nil
+	}
+	return c.f.Close()
+}
@@ -0,0 +1,455 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/config"
+	"alt-text-generator/internal/fetch"
+	"alt-text-generator/internal/logging"
+	"alt-text-generator/internal/server"
+)
+
+// Exit codes shared by every command
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// Command is a subcommand of the binary
+type Command struct {
+	Name    string
+	Summary string
+	// Run carries out the command and returns the process exit status
+	Run func(args []string, stdout, stderr io.Writer) int
+}
+
+// Commands lists every subcommand in the order help shows them
+var Commands = []Command{
+	{"serve", "run the web server and JSON API", server.Serve},
+	{"generate", "caption image files, URLs, or stdin", Generate},
+	{"batch", "caption every image in folders or a manifest and write a report", Batch},
+	{"html", "add alt text to images in HTML files", HTML},
+	{"markdown", "add alt text to images in Markdown and MDX files", Markdown},
+	{"epub", "add alt text to images in EPUB books", EPUB},
+	{"office", "add alt text to pictures in Word and PowerPoint files", Office},
+	{"crawl", "audit a website's alt text", Crawl},
+	{"check", "report images without alt text, for CI and pre-commit hooks", Check},
+	{"eval", "compare prompt and provider configurations on a set of images", Eval},
+	{"bench", "measure latency and memory under load, against a server or a provider", Bench},
+	{"export", "export the generation history as CSV or JSON", Export},
+	{"regenerate", "caption stored generations again with a newer model, up to a budget", Regenerate},
+	{"config", "create, validate, or show the config file", Config},
+	{"completion", "print a shell completion script", Completion},
+	{"version", "print the version, commit, and build date", Version},
+}
+
+// LookupCommand finds a subcommand by name
+func LookupCommand(name string) (Command, bool) {
+	for _, c := range Commands {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Command{}, false
+}
+
+// Main runs the subcommand named by args[0]. With no subcommand, or when
+// args start with a flag as in "-openai", it serves, as the binary did
+// before it had subcommands.
+func Main(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		if len(args) > 0 && slices.Contains([]string{"-h", "-help", "--help"}, args[0]) {
+			usage(stdout)
+			return exitOK
+		}
+		if len(args) > 0 && slices.Contains([]string{"-version", "--version"}, args[0]) {
+			return Version(args[1:], stdout, stderr)
+		}
+		args = append([]string{"serve"}, args...)
+	}
+	name, args := args[0], args[1:]
+	if name == completeCommand {
+		return complete(args, stdout)
+	}
+	if name == "help" {
+		if len(args) > 0 {
+			if command, ok := LookupCommand(args[0]); ok {
+				command.Run([]string{"-h"}, stdout, stderr)
+				return exitOK
+			}
+		}
+		usage(stdout)
+		return exitOK
+	}
+	command, ok := LookupCommand(name)
+	if !ok {
+		fmt.Fprintf(stderr, "Error: unknown command %q\n\n", name)
+		usage(stderr)
+		return exitUsage
+	}
+	return command.Run(args, stdout, stderr)
+}
+
+// usage lists the subcommands
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: alt-text-generator <command> [flags] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range Commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.Name, c.Summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "alt-text-generator help <command>" for a command's flags.`)
+}
+
+// maxImageSize matches the server's upload limit
+const maxImageSize = 5 * 1024 * 1024
+
+// supportedMediaTypes lists the image formats both providers accept
+var supportedMediaTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// setup loads .env and the config file, checks the prompt template, lint
+// rules, normalizer fixes, filters, and other generation settings, and sends
+// logs to stderr, quieter than the server's by default so stdout stays clean
+// for scripts
+func setup() error {
+	if err := config.LoadEnvFile(".env"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("loading .env file: %v", err)
+	}
+	if err := config.LoadFile(config.FilePath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("loading config file: %v", err)
+	}
+	logging.Setup(os.Stderr, config.GetString("LOG_FORMAT", "text"), config.GetString("LOG_LEVEL", "warn"))
+	return checkSettings()
+}
+
+// checkSettings checks the prompt template, lint rules, normalizer fixes,
+// filters, and other generation settings in the environment
+func checkSettings() error {
+	if err := api.CheckLint(); err != nil {
+		return err
+	}
+	if err := api.CheckNormalize(); err != nil {
+		return err
+	}
+	if err := api.CheckFilters(); err != nil {
+		return err
+	}
+	if err := api.CheckPeople(); err != nil {
+		return err
+	}
+	if err := api.CheckSampling(); err != nil {
+		return err
+	}
+	if err := api.CheckTranslation(); err != nil {
+		return err
+	}
+	if err := api.CheckReadability(); err != nil {
+		return err
+	}
+	if err := api.CheckPlatformSetting(); err != nil {
+		return err
+	}
+	return api.CheckPrompt()
+}
+
+// parseArgs parses flags that may appear before, after, or between
+// positional arguments, returning the positional arguments in order
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// promptFlags adds -prompt-file, -style, -domain, -platform, -max-chars,
+// -limit, -describe, -keywords, -charts, -objective, -reading-level,
+// -structured, -candidates, -people, -filter, -temperature, -top-p, -seed,
+// -translate, and -improve, which set the prompt template, presets, social
+// network, length limit, whether to ask for a long description, keywords,
+// chart summaries, objective text, or a structured result, the reading
+// level, how many times to ask, how people may be described, the output
+// filters, the sampling parameters, the languages to translate existing alt
+// text into, and whether to improve it instead, for the run ahead of the
+// environment and config file
+func promptFlags(flags *flag.FlagSet) {
+	flags.Func("prompt-file", "file holding a Go text/template prompt to use instead of the built-in one", func(path string) error {
+		return os.Setenv("ALT_TEXT_PROMPT_FILE", path)
+	})
+	flags.Func("style", "tone of the alt text: "+strings.Join(api.StyleNames(), ", ")+" (default neutral)", func(name string) error {
+		if err := api.CheckStyle(name); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_STYLE", name)
+	})
+	flags.Func("domain", "kind of image, for details that matter in its field: "+strings.Join(api.DomainNames(), ", ")+" (default general)", func(name string) error {
+		if err := api.CheckDomain(name); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_DOMAIN", name)
+	})
+	flags.Func("platform", "social network to write for, with its length limit and conventions in place of -max-chars: "+strings.Join(api.PlatformNames(), ", "), func(name string) error {
+		if err := api.CheckPlatform(name); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_PLATFORM", name)
+	})
+	flags.Func("max-chars", "longest alt text allowed; longer text is requested again, then truncated (0 for no limit, default 125)", func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return errors.New("must be a number of characters")
+		}
+		return os.Setenv("ALT_TEXT_MAX_LENGTH", s)
+	})
+	flags.Func("limit", "length limit by name in place of -max-chars: "+strings.Join(api.LimitPresets(), ", ")+", or custom:N", func(s string) error {
+		n, err := api.ParseLimit(s)
+		if err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_MAX_LENGTH", strconv.Itoa(n))
+	})
+	flags.BoolFunc("describe", "also ask for a long description of each image, for charts, diagrams, and other complex images", func(s string) error {
+		if _, err := strconv.ParseBool(s); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_LONG_DESCRIPTION", s)
+	})
+	flags.BoolFunc("keywords", "also ask for 5 to 10 searchable keywords for each image, for media libraries and SEO", func(s string) error {
+		if _, err := strconv.ParseBool(s); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_KEYWORDS", s)
+	})
+	flags.BoolFunc("charts", "summarise charts and graphs by their trend, with an HTML table of their data in the long description", func(s string) error {
+		if _, err := strconv.ParseBool(s); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_CHARTS", s)
+	})
+	flags.BoolFunc("objective", "describe images objectively, without subjective or promotional words such as beautiful or stunning, for government and education sites", func(s string) error {
+		if _, err := strconv.ParseBool(s); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_OBJECTIVE", s)
+	})
+	flags.Func("reading-level", fmt.Sprintf("US school grade to write plain-language alt text for, such as 6; text that reads above it is requested again (1 to %d)", api.MaxReadingLevel), func(s string) error {
+		grade, err := strconv.Atoi(s)
+		if err != nil {
+			return errors.New("must be a grade number")
+		}
+		if err := api.CheckReadingLevel(grade); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_READING_LEVEL", s)
+	})
+	flags.BoolFunc("structured", "also ask for a caption, tags, objects, and any text in each image", func(s string) error {
+		if _, err := strconv.ParseBool(s); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_STRUCTURED", s)
+	})
+	flags.Func("candidates", fmt.Sprintf("ask the model this many times for each image, offering every distinct option (1 to %d, default 1)", api.MaxCandidates), func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		if err := api.CheckCandidates(n); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_CANDIDATES", s)
+	})
+	flags.Func("people", "how people may be described: allow, neutral to leave out perceived age, gender, ethnicity, and names not shown, or omit to leave out identity and names (default allow)", func(name string) error {
+		if err := api.CheckPeoplePolicy(name); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_PEOPLE", name)
+	})
+	var filters []string
+	flags.Func("filter", "remove this from generated text (comma-separated or repeated): "+strings.Join(api.FilterNames(), ", "), func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if !slices.Contains(api.FilterNames(), name) {
+					return fmt.Errorf("unknown filter %q (expected %s)", name, strings.Join(api.FilterNames(), ", "))
+				}
+				filters = append(filters, name)
+			}
+		}
+		return os.Setenv("ALT_TEXT_FILTERS", strings.Join(filters, ","))
+	})
+	flags.Func("temperature", "sampling temperature, from 0 for the most repeatable output to 2 for the most varied (Anthropic allows up to 1)", func(s string) error {
+		t, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		if err := (api.Sampling{Temperature: &t}).Check(); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_TEMPERATURE", s)
+	})
+	flags.Func("top-p", "nucleus sampling cutoff from 0 to 1", func(s string) error {
+		p, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		if err := (api.Sampling{TopP: &p}).Check(); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_TOP_P", s)
+	})
+	flags.Func("seed", "sampling seed, for repeatable output where the provider supports it (OpenAI)", func(s string) error {
+		if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+			return errors.New("must be a whole number")
+		}
+		return os.Setenv("ALT_TEXT_SEED", s)
+	})
+	flags.Func("translate", "translate each image's existing_alt context into these comma-separated languages, such as fr,de, checking it against the image", func(s string) error {
+		languages, err := api.ParseLanguages(s)
+		if err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_TRANSLATE", strings.Join(languages, ","))
+	})
+	flags.BoolFunc("improve", "critique each image's existing_alt context against the image and rewrite it, returning the problems found as issues", func(s string) error {
+		if _, err := strconv.ParseBool(s); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_IMPROVE", s)
+	})
+}
+
+// contextFlag adds -context, which may be repeated to pass values such as
+// page_title=Checkout or surrounding_text="..." into the prompt
+func contextFlag(flags *flag.FlagSet) map[string]string {
+	values := map[string]string{}
+	flags.Func("context", "add `key=value` to the prompt context, such as page_title=Pricing (repeatable)", func(s string) error {
+		key, value, ok := strings.Cut(s, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return errors.New("expected key=value")
+		}
+		values[api.ContextKey(key)] = value
+		return nil
+	})
+	return values
+}
+
+// selectProvider looks up the named provider, falling back to the provider
+// setting and then to the only configured one when name is empty
+func selectProvider(name string) (api.Provider, error) {
+	if name == "" {
+		name = os.Getenv("PROVIDER")
+	}
+	if name != "" {
+		provider, ok := api.LookupProvider(name)
+		if !ok {
+			return api.Provider{}, fmt.Errorf("unknown provider %q", name)
+		}
+		if !provider.Configured() {
+			return api.Provider{}, fmt.Errorf("%s is not set", provider.EnvKey)
+		}
+		return provider, nil
+	}
+
+	var configured []api.Provider
+	var names []string
+	for _, p := range api.Providers() {
+		names = append(names, p.Name)
+		if p.Configured() {
+			configured = append(configured, p)
+		}
+	}
+	if len(configured) != 1 {
+		return api.Provider{}, fmt.Errorf("choose a provider with -provider (%s)", strings.Join(names, " or "))
+	}
+	return configured[0], nil
+}
+
+// stdinPath names standard input in place of a file
+const stdinPath = "-"
+
+// readImage reads and validates an image file, or standard input when path
+// is "-", applying the same size and format rules as the web upload
+func readImage(path string) ([]byte, error) {
+	var data []byte
+	var err error
+	if path == stdinPath {
+		data, err = io.ReadAll(io.LimitReader(os.Stdin, maxImageSize+1))
+		if err == nil && len(data) == 0 {
+			err = errors.New("no image data on stdin")
+		}
+		path = "stdin"
+	} else {
+		var info os.FileInfo
+		if info, err = os.Stat(path); err == nil && info.Size() > maxImageSize {
+			return nil, fmt.Errorf("%s: image exceeds 5MB limit", path)
+		}
+		if err == nil {
+			data, err = os.ReadFile(path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImageSize {
+		return nil, fmt.Errorf("%s: image exceeds 5MB limit", path)
+	}
+	if mediaType := http.DetectContentType(data); !supportedMediaTypes[mediaType] {
+		return nil, fmt.Errorf("%s: unsupported image format %q (supported: JPG, PNG, GIF, WebP)", path, mediaType)
+	}
+	return data, nil
+}
+
+// isURL reports whether path is an http(s) URL or an s3:// or gs:// bucket
+// reference rather than a local file
+func isURL(path string) bool {
+	for _, scheme := range []string{"http://", "https://", "s3://", "gs://"} {
+		if strings.HasPrefix(path, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadImage is readImage for local paths that also downloads URLs, such as
+// the images crawl finds or those listed in a manifest
+func loadImage(ctx context.Context, path string) ([]byte, error) {
+	if !isURL(path) {
+		return readImage(path)
+	}
+	image, err := fetch.FetchImage(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if !supportedMediaTypes[image.ContentType] {
+		return nil, fmt.Errorf("%s: unsupported image format %q (supported: JPG, PNG, GIF, WebP)", path, image.ContentType)
+	}
+	return image.Data, nil
+}
+
+// generate captions one image with provider
+func generate(ctx context.Context, provider api.Provider, data []byte) (api.Result, error) {
+	return provider.Generate(ctx, data)
+}
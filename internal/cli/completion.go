@@ -0,0 +1,244 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/quality"
+)
+
+// completeCommand is the hidden command completion scripts call with the
+// words typed so far; it prints the candidates for the last one
+const completeCommand = "__complete"
+
+// completionShells are the shells completion can write a script for
+var completionShells = []string{"bash", "zsh", "fish", "powershell"}
+
+// configActions are config's subcommands
+var configActions = []string{"init", "validate", "show"}
+
+// Completion implements "alt-text-generator completion <shell>": it prints a
+// script that tab-completes commands, flags, and flag values such as
+// provider names. The script asks the binary for candidates, so it stays
+// current as commands and configured providers change.
+func Completion(args []string, stdout, stderr io.Writer) int {
+	usage := func() {
+		fmt.Fprintf(stderr, "Usage: alt-text-generator completion <%s>\n", strings.Join(completionShells, "|"))
+		fmt.Fprintln(stderr, "Load it with, for example:")
+		fmt.Fprintln(stderr, "  source <(alt-text-generator completion bash)")
+	}
+	if len(args) != 1 {
+		usage()
+		return exitUsage
+	}
+	switch args[0] {
+	case "bash":
+		fmt.Fprint(stdout, bashCompletion)
+	case "zsh":
+		fmt.Fprint(stdout, zshCompletion)
+	case "fish":
+		fmt.Fprint(stdout, fishCompletion)
+	case "powershell":
+		fmt.Fprint(stdout, powershellCompletion)
+	default:
+		usage()
+		return exitUsage
+	}
+	return exitOK
+}
+
+// complete prints the candidates for the last of words, the arguments typed
+// after the program name. Printing nothing lets the shell complete file names.
+func complete(words []string, stdout io.Writer) int {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	current, prefix := words[len(words)-1], ""
+	var candidates []string
+	switch {
+	case len(words) == 1:
+		candidates = append(commandNames(), "help")
+	case words[0] == "help" && len(words) == 2:
+		candidates = commandNames()
+	case words[0] == "completion" && len(words) == 2:
+		candidates = completionShells
+	case words[0] == "config" && len(words) == 2:
+		candidates = configActions
+	default:
+		candidates = completeFlag(words)
+		if i := strings.IndexByte(current, '='); i >= 0 {
+			// Complete "-provider=op" as a whole word, except for bash's
+			// lone "=", which is replaced by the value
+			if i > 0 {
+				prefix = current[:i+1]
+			}
+			current = current[i+1:]
+		}
+	}
+	for _, c := range candidates {
+		if strings.HasPrefix(c, current) {
+			fmt.Fprintln(stdout, prefix+c)
+		}
+	}
+	return exitOK
+}
+
+// completeFlag offers a command's flags when the word being completed starts
+// with a dash, and the values of the flag before it when they are known
+func completeFlag(words []string) []string {
+	command, ok := LookupCommand(words[0])
+	if !ok {
+		return nil
+	}
+	current := words[len(words)-1]
+	flagArgs := []string{"-h"}
+	if command.Name == "config" {
+		flagArgs = []string{words[1], "-h"}
+	}
+	flags := commandFlags(command, flagArgs)
+
+	// The flag whose value is being completed: "-provider op",
+	// "-provider=op", or, since bash splits at =, "-provider = op"
+	name := ""
+	switch {
+	case strings.HasPrefix(current, "-") && strings.Contains(current, "="):
+		name = current[:strings.IndexByte(current, '=')]
+	case len(words) >= 3 && words[len(words)-2] == "=":
+		name = words[len(words)-3]
+	case len(words) >= 2:
+		name = words[len(words)-2]
+		if strings.Contains(name, "=") {
+			name = ""
+		}
+	}
+	name = strings.TrimLeft(name, "-")
+	if takesValue, ok := flags[name]; ok && takesValue {
+		return flagValues(name)
+	}
+	if strings.HasPrefix(current, "-") && !strings.Contains(current, "=") {
+		var names []string
+		for flag := range flags {
+			names = append(names, "-"+flag)
+		}
+		sort.Strings(names)
+		return names
+	}
+	return nil
+}
+
+// flagValues lists the values a flag accepts, where they are known
+func flagValues(name string) []string {
+	switch name {
+	case "provider", "judge":
+		return providerNames()
+	case "output-format":
+		return batchFormats
+	case "format":
+		return generateFormats
+	case "annotate":
+		return annotateFormats
+	case "style":
+		return api.StyleNames()
+	case "domain":
+		return api.DomainNames()
+	case "platform":
+		return api.PlatformNames()
+	case "limit":
+		return api.LimitPresets()
+	case "people":
+		return api.PeoplePolicies
+	case "filter":
+		return api.FilterNames()
+	case "disable-rule":
+		return quality.RuleNames()
+	}
+	return nil
+}
+
+// providerNames lists the providers whose API keys are set, in the
+// environment, .env, or the config file, or every provider if none are
+func providerNames() []string {
+	setup()
+	var configured, all []string
+	for _, p := range api.Providers() {
+		all = append(all, p.Name)
+		if p.Configured() {
+			configured = append(configured, p.Name)
+		}
+	}
+	if len(configured) > 0 {
+		return configured
+	}
+	return all
+}
+
+// commandNames lists the visible subcommands
+func commandNames() []string {
+	var names []string
+	for _, c := range Commands {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// flagLine matches a flag in flag.PrintDefaults output: its name and, for
+// flags that take a value, the value's type
+var flagLine = regexp.MustCompile(`(?m)^  -(\S+)( \S+)?$`)
+
+// commandFlags returns a command's flags, and whether each takes a value, by
+// reading the help it prints when run with args ending in -h
+func commandFlags(command Command, args []string) map[string]bool {
+	var help bytes.Buffer
+	command.Run(args, io.Discard, &help)
+	flags := map[string]bool{}
+	for _, m := range flagLine.FindAllStringSubmatch(help.String(), -1) {
+		flags[m[1]] = m[2] != ""
+	}
+	return flags
+}
+
+const bashCompletion = `# bash completion for alt-text-generator
+_alt_text_generator() {
+    local IFS=$'\n'
+    COMPREPLY=($("${COMP_WORDS[0]}" __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _alt_text_generator alt-text-generator
+`
+
+const zshCompletion = `#compdef alt-text-generator
+# zsh completion for alt-text-generator
+_alt_text_generator() {
+    local -a candidates
+    candidates=("${(@f)$("${words[1]}" __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    if (( ${#candidates} )) && [[ -n ${candidates[1]} ]]; then
+        compadd -a candidates
+    else
+        _files
+    fi
+}
+compdef _alt_text_generator alt-text-generator
+`
+
+const fishCompletion = `# fish completion for alt-text-generator
+function __alt_text_generator_complete
+    set -l words (commandline -opc) (commandline -ct)
+    $words[1] __complete $words[2..-1] 2>/dev/null
+end
+complete -c alt-text-generator -a '(__alt_text_generator_complete)'
+`
+
+const powershellCompletion = `# PowerShell completion for alt-text-generator
+Register-ArgumentCompleter -Native -CommandName alt-text-generator -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $words = @($commandAst.CommandElements | Select-Object -Skip 1 | ForEach-Object { $_.ToString() })
+    if ($wordToComplete -eq '') { $words += '""' }
+    & $commandAst.CommandElements[0].ToString() __complete @words 2>$null | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+    }
+}
+`
@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"alt-text-generator/internal/config"
+)
+
+// Config implements "alt-text-generator config init|validate|show": it
+// writes a starter config file, checks one, or shows the settings in effect
+func Config(args []string, stdout, stderr io.Writer) int {
+	usage := func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator config <init|validate|show> [flags]")
+		fmt.Fprintln(stderr, "  init      write a commented config file listing every setting")
+		fmt.Fprintln(stderr, "  validate  check a config file for unknown keys and invalid values")
+		fmt.Fprintln(stderr, "  show      print the settings in effect and where each comes from")
+	}
+	if len(args) == 0 {
+		usage()
+		return exitUsage
+	}
+	action := args[0]
+	flags := flag.NewFlagSet("config "+action, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	path := flags.String("file", config.FilePath(), "config file")
+	force := false
+	if action == "init" {
+		flags.BoolVar(&force, "force", false, "overwrite an existing file")
+	}
+	if _, err := parseArgs(flags, args[1:]); err != nil {
+		return exitUsage
+	}
+
+	switch action {
+	case "init":
+		if _, err := os.Stat(*path); err == nil && !force {
+			fmt.Fprintf(stderr, "Error: %s already exists; use -force to overwrite it\n", *path)
+			return exitError
+		}
+		if err := os.WriteFile(*path, []byte(configTemplate()), 0o600); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		fmt.Fprintf(stderr, "Wrote %s; uncomment the settings you want to change\n", *path)
+		return exitOK
+
+	case "validate":
+		if _, err := config.ReadFile(*path); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintf(stderr, "%s is valid\n", *path)
+		return exitOK
+
+	case "show":
+		if err := config.LoadEnvFile(".env"); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintln(stderr, "Error loading .env file:", err)
+			return exitError
+		}
+		fromFile, err := config.ReadFile(*path)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		writeSettings(stdout, func(s config.Setting) (string, string, bool) {
+			if value := os.Getenv(s.Env); value != "" {
+				return formatSetting(s, value), "from " + s.Env, false
+			}
+			if value, ok := fromFile[s.Env]; ok {
+				return formatSetting(s, value), "from " + *path, false
+			}
+			if s.Default != "" {
+				return formatSetting(s, s.Default), "default", false
+			}
+			return "", "not set", true
+		})
+		return exitOK
+	}
+	usage()
+	return exitUsage
+}
+
+// configTemplate is what config init writes: every setting commented out,
+// with its default where it has one
+func configTemplate() string {
+	var b strings.Builder
+	fmt.Fprintln(&b, "# alt-text-generator configuration")
+	fmt.Fprintln(&b, "# Environment variables and .env take precedence over this file.")
+	writeSettings(&b, func(s config.Setting) (string, string, bool) {
+		example := s.Default
+		if example == "" && (s.Type == "int" || s.Type == "float") {
+			example = "0"
+		}
+		return formatSetting(s, example), s.Help, true
+	})
+	return b.String()
+}
+
+// writeSettings writes every setting as TOML under its table header. line
+// returns the value to write, a comment, and whether to comment the key out.
+func writeSettings(w io.Writer, line func(config.Setting) (value, comment string, commented bool)) {
+	table := ""
+	for _, s := range config.Settings {
+		name := s.Key
+		if i := strings.LastIndexByte(s.Key, '.'); i >= 0 {
+			if s.Key[:i] != table {
+				table = s.Key[:i]
+				fmt.Fprintf(w, "\n[%s]\n", table)
+			}
+			name = s.Key[i+1:]
+		}
+		value, comment, commented := line(s)
+		switch {
+		case commented && value == "":
+			fmt.Fprintf(w, "# %s  (%s)\n", name, comment)
+		case commented:
+			fmt.Fprintf(w, "# %s\n# %s = %s\n", comment, name, value)
+		default:
+			fmt.Fprintf(w, "%s = %s  # %s\n", name, value, comment)
+		}
+	}
+}
+
+// formatSetting renders an environment value as a TOML value, hiding secrets
+func formatSetting(s config.Setting, value string) string {
+	if s.Secret && value != "" {
+		value = "********"
+	}
+	switch s.Type {
+	case "int", "float", "bool":
+		return value
+	case "list":
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, strconv.Quote(item))
+			}
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return strconv.Quote(value)
+}
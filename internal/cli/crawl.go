@@ -0,0 +1,213 @@
+package cli
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"time"
+
+	"alt-text-generator/internal/crawl"
+)
+
+// auditRecord is one image with missing or suspicious alt text on one page
+type auditRecord struct {
+	Page  string `json:"page"`
+	Image string `json:"image"`
+	// Alt is the image's current alt text, or null when it has none
+	Alt         *string `json:"alt"`
+	Issue       string  `json:"issue"`
+	ProposedAlt string  `json:"proposed_alt,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// Crawl implements "alt-text-generator crawl <url|sitemap.xml>...": it
+// crawls a site, captions the images whose alt text is missing or
+// suspicious, and writes an audit report of page, image, and proposed alt
+func Crawl(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("crawl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	providerName := flags.String("provider", "", "provider to use: anthropic or openai (defaults to the only one configured)")
+	promptFlags(flags)
+	depth := flags.Int("depth", 2, "how many links to follow from the start pages")
+	maxPages := flags.Int("max-pages", 100, "stop after crawling this many pages (0 for no limit)")
+	delay := flags.Duration("delay", 500*time.Millisecond, "minimum time between page requests; robots.txt Crawl-delay can raise it")
+	userAgent := flags.String("user-agent", "alt-text-generator", "User-Agent to crawl as and match against robots.txt")
+	reportPath := flags.String("report", "", "write the report to this file instead of stdout")
+	concurrency := flags.Int("concurrency", 4, "number of images to caption in parallel")
+	showProgress := flags.Bool("progress", isTerminal(os.Stderr), "show a progress bar on stderr while captioning")
+	outputFormat := flags.String("output-format", "text", "report format: "+strings.Join(outputFormats, ", "))
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator crawl [flags] <url|sitemap.xml>...")
+		flags.PrintDefaults()
+	}
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	if !slices.Contains(outputFormats, *outputFormat) {
+		fmt.Fprintf(stderr, "Error: -output-format must be one of %s\n", strings.Join(outputFormats, ", "))
+		return exitUsage
+	}
+
+	if err := setup(); err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	provider, err := selectProvider(*providerName)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitUsage
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	started := time.Now()
+	crawler := &crawl.Crawler{
+		Client:    &http.Client{Timeout: 30 * time.Second},
+		UserAgent: *userAgent,
+		MaxDepth:  *depth,
+		MaxPages:  *maxPages,
+		Delay:     *delay,
+	}
+	var records []auditRecord
+	var images []string
+	seen := map[string]bool{}
+	pages := 0
+	err = crawler.Run(ctx, args, func(page crawl.Page) error {
+		pages++
+		if page.Err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", page.URL, page.Err)
+			return nil
+		}
+		for _, image := range page.Images {
+			if image.Issue == "" {
+				continue
+			}
+			record := auditRecord{Page: page.URL, Image: image.Src, Issue: image.Issue}
+			if image.HasAlt {
+				record.Alt = &image.Alt
+			}
+			if image.Disallowed {
+				record.Error = "image disallowed by robots.txt"
+			} else if !seen[image.Src] {
+				seen[image.Src] = true
+				images = append(images, image.Src)
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	fmt.Fprintf(stderr, "Crawled %d pages; %d images need alt text\n", pages, len(images))
+
+	var bar *progress
+	if *showProgress && len(images) > 0 {
+		bar = newProgress(stderr, len(images))
+	}
+	totals := summary{}
+	results := map[string]batchResult{}
+	captionAll(ctx, provider, images, nil, *concurrency, bar, nil, func(result batchResult) error {
+		totals.Add(provider, result)
+		results[result.Path] = result
+		return nil
+	})
+	bar.Finish()
+	for i, record := range records {
+		result, ok := results[record.Image]
+		switch {
+		case record.Error != "":
+		case !ok:
+			records[i].Error = "not captioned"
+		case result.Err != nil:
+			records[i].Error = result.Err.Error()
+		default:
+			records[i].ProposedAlt = bestAltText(result.Result.Text)
+		}
+	}
+
+	report := stdout
+	if *reportPath != "" {
+		f, err := os.Create(*reportPath)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		defer f.Close()
+		report = f
+	}
+	if err := writeAudit(report, *outputFormat, records); err != nil {
+		fmt.Fprintln(stderr, "Error writing report:", err)
+		return exitError
+	}
+
+	totals.Write(stderr, time.Since(started))
+	if totals.Failed > 0 || ctx.Err() != nil {
+		return exitError
+	}
+	return exitOK
+}
+
+// writeAudit writes an audit report in one of outputFormats
+func writeAudit(w io.Writer, format string, records []auditRecord) error {
+	switch format {
+	case "json":
+		if records == nil {
+			records = []auditRecord{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		for _, record := range records {
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"page", "image", "alt", "issue", "proposed_alt", "error"})
+		for _, record := range records {
+			alt := ""
+			if record.Alt != nil {
+				alt = *record.Alt
+			}
+			cw.Write([]string{record.Page, record.Image, alt, record.Issue, record.ProposedAlt, record.Error})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	// Text groups images under the page they appear on
+	page := ""
+	for _, record := range records {
+		if record.Page != page {
+			page = record.Page
+			fmt.Fprintln(w, page)
+		}
+		fmt.Fprintf(w, "  %s (%s)\n", record.Image, record.Issue)
+		if record.Error != "" {
+			fmt.Fprintf(w, "    error: %s\n", record.Error)
+		} else {
+			fmt.Fprintf(w, "    proposed: %s\n", record.ProposedAlt)
+		}
+	}
+	return nil
+}
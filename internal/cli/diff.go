@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// writeDiff writes a unified diff between two versions of a file. Alt text
+// edits never add or remove lines, so lines are compared one to one; other
+// edits, such as inserted metadata, are shown as a single hunk.
+func writeDiff(w io.Writer, path string, before, after []byte) {
+	old, new := splitLines(before), splitLines(after)
+	if len(old) != len(new) {
+		writeInsertion(w, path, old, new)
+		return
+	}
+
+	var changed []int
+	for i := range old {
+		if !bytes.Equal(old[i], new[i]) {
+			changed = append(changed, i)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", path, path)
+	for i := 0; i < len(changed); {
+		// Group changes whose context would overlap into one hunk
+		j := i
+		for j+1 < len(changed) && changed[j+1]-changed[j] <= 2*diffContext {
+			j++
+		}
+		start := max(changed[i]-diffContext, 0)
+		end := min(changed[j]+diffContext+1, len(old))
+		fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", start+1, end-start, start+1, end-start)
+		for line := start; line < end; line++ {
+			if bytes.Equal(old[line], new[line]) {
+				writeLines(w, " ", old[line:line+1])
+			} else {
+				writeLines(w, "-", old[line:line+1])
+				writeLines(w, "+", new[line:line+1])
+			}
+		}
+		i = j + 1
+	}
+}
+
+// writeInsertion writes the lines between the common prefix and suffix of
+// old and new as one hunk
+func writeInsertion(w io.Writer, path string, old, new [][]byte) {
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && bytes.Equal(old[prefix], new[prefix]) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix && bytes.Equal(old[len(old)-1-suffix], new[len(new)-1-suffix]) {
+		suffix++
+	}
+	start := max(prefix-diffContext, 0)
+	after := min(suffix, diffContext)
+	oldEnd, newEnd := len(old)-suffix+after, len(new)-suffix+after
+	fmt.Fprintf(w, "--- %s\n+++ %s\n@@ -%d,%d +%d,%d @@\n", path, path, start+1, oldEnd-start, start+1, newEnd-start)
+	writeLines(w, " ", old[start:prefix])
+	writeLines(w, "-", old[prefix:len(old)-suffix])
+	writeLines(w, "+", new[prefix:len(new)-suffix])
+	writeLines(w, " ", old[len(old)-suffix:oldEnd])
+}
+
+// splitLines splits data into lines that keep their newlines
+func splitLines(data []byte) [][]byte {
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func writeLines(w io.Writer, prefix string, lines [][]byte) {
+	for _, line := range lines {
+		fmt.Fprint(w, prefix)
+		w.Write(line)
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			fmt.Fprint(w, "\n\\ No newline at end of file\n")
+		}
+	}
+}
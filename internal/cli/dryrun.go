@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/history"
+)
+
+// dryRun lists what a batch would do with each path without calling a
+// provider: files that would be captioned, and files that would be skipped
+// because they can't be used, were finished by an earlier run recorded in
+// state, repeat an earlier image, or (with sidecars) already have alt text.
+// URLs are listed without being downloaded, so they aren't checked against
+// state. state may be nil.
+func dryRun(w io.Writer, paths []string, contexts []api.ImageContext, sidecars bool, state *checkpoint) {
+	seen := map[string]string{}
+	process, skip := 0, 0
+	for i, path := range paths {
+		if sidecars && hasSidecar(path) {
+			skip++
+			fmt.Fprintf(w, "skip     %s (sidecar exists)\n", path)
+			continue
+		}
+		if isURL(path) {
+			process++
+			fmt.Fprintf(w, "process  %s (not downloaded)\n", path)
+			continue
+		}
+		data, err := readImage(path)
+		if err != nil {
+			skip++
+			// Read errors already name the file
+			fmt.Fprintf(w, "skip     %v\n", err)
+			continue
+		}
+		var imageContext api.ImageContext
+		if contexts != nil {
+			imageContext = contexts[i]
+		}
+		res := batchResult{Hash: history.HashImage(data)}
+		if state.resume(&res) {
+			skip++
+			fmt.Fprintf(w, "skip     %s (captioned by an earlier run)\n", path)
+			continue
+		}
+		hash := dedupeKey(res.Hash, imageContext)
+		if first, ok := seen[hash]; ok {
+			skip++
+			fmt.Fprintf(w, "skip     %s (duplicate of %s)\n", path, first)
+			continue
+		}
+		seen[hash] = path
+		process++
+		fmt.Fprintf(w, "process  %s\n", path)
+	}
+	fmt.Fprintf(w, "%d would be processed, %d skipped\n", process, skip)
+}
@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"alt-text-generator/internal/history"
+)
+
+// writePNG writes a file that sniffs as a PNG, made distinct by tag
+func writePNG(t *testing.T, dir, name, tag string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("\x89PNG\r\n\x1a\n"+tag), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDryRunSkipsCheckpointedImages(t *testing.T) {
+	dir := t.TempDir()
+	done := writePNG(t, dir, "done.png", "done")
+	todo := writePNG(t, dir, "todo.png", "todo")
+	copied := writePNG(t, dir, "copy.png", "todo")
+
+	statePath := filepath.Join(dir, "state.jsonl")
+	data, _ := os.ReadFile(done)
+	line, _ := json.Marshal(reportRecord{Path: "moved/done.png", Hash: history.HashImage(data), AltText: "Done"})
+	// A partial last line, as a killed run leaves, is ignored
+	if err := os.WriteFile(statePath, append(line, []byte("\n{\"path\":")...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(statePath)
+
+	paths := []string{done, todo, copied, "https://example.com/a.png"}
+	tests := []struct {
+		name    string
+		refresh bool
+		want    string
+	}{
+		{"resumed", false, "skip     " + done + " (captioned by an earlier run)\n" +
+			"process  " + todo + "\n" +
+			"skip     " + copied + " (duplicate of " + todo + ")\n" +
+			"process  https://example.com/a.png (not downloaded)\n" +
+			"2 would be processed, 2 skipped\n"},
+		{"no cache", true, "process  " + done + "\n" +
+			"process  " + todo + "\n" +
+			"skip     " + copied + " (duplicate of " + todo + ")\n" +
+			"process  https://example.com/a.png (not downloaded)\n" +
+			"3 would be processed, 1 skipped\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := readCheckpoint(statePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state.refresh = tt.refresh
+			var out bytes.Buffer
+			dryRun(&out, paths, nil, false, state)
+			if out.String() != tt.want {
+				t.Errorf("dry run =\n%s\nwant\n%s", out.String(), tt.want)
+			}
+		})
+	}
+
+	if after, _ := os.ReadFile(statePath); !bytes.Equal(after, before) {
+		t.Error("dry run changed the state file")
+	}
+	if state, err := readCheckpoint(filepath.Join(dir, "missing.jsonl")); err != nil || state.Len() != 0 {
+		t.Errorf("missing state file = %d records, %v", state.Len(), err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.jsonl")); !os.IsNotExist(err) {
+		t.Error("dry run created the state file")
+	}
+}
+
+func TestBatchDryRunReadsState(t *testing.T) {
+	dir := t.TempDir()
+	done := writePNG(t, dir, "done.png", "done")
+	data, _ := os.ReadFile(done)
+	line, _ := json.Marshal(reportRecord{Path: done, Hash: history.HashImage(data)})
+	statePath := filepath.Join(t.TempDir(), "state.jsonl")
+	if err := os.WriteFile(statePath, append(line, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := Batch([]string{"-dry-run", "-state", statePath, dir}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("exit code = %d: %s", code, stderr.String())
+	}
+	want := "skip     " + done + " (captioned by an earlier run)\n0 would be processed, 1 skipped\n"
+	if stdout.String() != want {
+		t.Errorf("stdout = %q, want %q", stdout.String(), want)
+	}
+}
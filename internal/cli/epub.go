@@ -0,0 +1,163 @@
+package cli
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// metadataEnd matches the closing tag of an OPF package's metadata element
+var metadataEnd = regexp.MustCompile(`</(?:[A-Za-z][\w.-]*:)?metadata>`)
+
+// accessibilityMeta declares that images carry text alternatives, per EPUB
+// Accessibility 1.1
+const accessibilityMeta = `<meta property="schema:accessibilityFeature">alternativeText</meta>`
+
+// EPUB implements "alt-text-generator epub <book.epub>...": it finds images
+// without alt text in each book's XHTML content documents, captions them,
+// and writes a repacked copy of the book
+func EPUB(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("epub", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	providerName := flags.String("provider", "", "provider to use: anthropic or openai (defaults to the only one configured)")
+	promptFlags(flags)
+	output := flags.String("output", "", "where to write the repacked book (defaults to <name>.accessible.epub; only with a single book)")
+	diff := flags.Bool("diff", false, "print the changes as a unified diff instead of writing a new book")
+	concurrency := flags.Int("concurrency", 4, "number of images to caption in parallel")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator epub [flags] <book.epub|pattern>...")
+		flags.PrintDefaults()
+	}
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	books, err := expandGlobs(args)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	if *output != "" && len(books) > 1 {
+		fmt.Fprintln(stderr, "Error: -output can only be used with a single book")
+		return exitUsage
+	}
+
+	if err := setup(); err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	provider, err := selectProvider(*providerName)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitUsage
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	status := exitOK
+	for _, book := range books {
+		out := *output
+		if out == "" {
+			out = strings.TrimSuffix(book, filepath.Ext(book)) + ".accessible.epub"
+		}
+		ok, err := remediateArchive(ctx, provider, epubFormat, book, out, *concurrency, *diff, stdout, stderr)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", book, err)
+		}
+		if err != nil || !ok {
+			status = exitError
+		}
+	}
+	return status
+}
+
+// epubFormat finds images without alt text in an EPUB's XHTML content
+// documents
+var epubFormat = archiveFormat{
+	find: func(dir, name string, data []byte) ([]altEdit, []skippedImage) {
+		switch strings.ToLower(path.Ext(name)) {
+		case ".xhtml", ".html", ".htm":
+			local := filepath.Join(dir, filepath.FromSlash(name))
+			return findHTMLImages(data, filepath.Dir(local), dir, true)
+		}
+		return nil, nil
+	},
+	finish: declareAlternativeText,
+}
+
+// declareAlternativeText adds the schema:accessibilityFeature alternativeText
+// declaration to an EPUB 3 package document once every image has alt text
+func declareAlternativeText(zr *zip.ReadCloser, changed map[string][]byte) error {
+	opfName, err := packageDocument(zr)
+	if err != nil || opfName == "" {
+		return err
+	}
+	data, ok := changed[opfName]
+	if !ok {
+		for _, f := range zr.File {
+			if path.Clean(f.Name) == opfName {
+				if data, err = readZipFile(f); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	var pkg struct {
+		Version string `xml:"version,attr"`
+	}
+	if err := xml.Unmarshal(data, &pkg); err != nil || !strings.HasPrefix(pkg.Version, "3") {
+		// EPUB 2 has no accessibility metadata vocabulary
+		return nil
+	}
+	if bytes.Contains(data, []byte("alternativeText")) {
+		return nil
+	}
+	loc := metadataEnd.FindIndex(data)
+	if loc == nil {
+		return nil
+	}
+	updated := append([]byte{}, data[:loc[0]]...)
+	updated = append(updated, "  "+accessibilityMeta+"\n  "...)
+	updated = append(updated, data[loc[0]:]...)
+	changed[opfName] = updated
+	return nil
+}
+
+// packageDocument finds the OPF file named by META-INF/container.xml
+func packageDocument(zr *zip.ReadCloser) (string, error) {
+	for _, f := range zr.File {
+		if f.Name != "META-INF/container.xml" {
+			continue
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return "", err
+		}
+		var container struct {
+			Rootfiles []struct {
+				FullPath string `xml:"full-path,attr"`
+			} `xml:"rootfiles>rootfile"`
+		}
+		if err := xml.Unmarshal(data, &container); err != nil || len(container.Rootfiles) == 0 {
+			return "", nil
+		}
+		return path.Clean(container.Rootfiles[0].FullPath), nil
+	}
+	return "", nil
+}
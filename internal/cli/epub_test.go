@@ -0,0 +1,194 @@
+package cli
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"alt-text-generator/internal/api"
+)
+
+// testProvider captions the images writePNG makes with their testAlts entry,
+// found from the tag written after the PNG signature
+var testProvider = api.Provider{
+	Name: "test",
+	Generate: func(ctx context.Context, image []byte) (api.Result, error) {
+		tag := string(bytes.TrimPrefix(image, []byte("\x89PNG\r\n\x1a\n")))
+		alt, ok := testAlts[tag+".png"]
+		if !ok {
+			return api.Result{}, errors.New("no alt text for " + tag)
+		}
+		return api.Result{Text: alt}, nil
+	},
+}
+
+// packArchive zips the files under dir, and then images, into a new archive
+// in a temporary directory. An EPUB's mimetype entry goes first, stored
+// uncompressed.
+func packArchive(t *testing.T, dir string, images []string, name string) string {
+	t.Helper()
+	out := filepath.Join(t.TempDir(), name)
+	f, err := os.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	add := func(name string, data []byte, method uint16) {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "mimetype")); err == nil {
+		add("mimetype", data, zip.Store)
+	}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path == filepath.Join(dir, "mimetype") {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		add(filepath.ToSlash(rel), data, zip.Deflate)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, image := range images {
+		tag := strings.TrimSuffix(filepath.Base(image), ".png")
+		add(image, []byte("\x89PNG\r\n\x1a\n"+tag), zip.Deflate)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// unpackArchive opens a written archive as a reader would, checking every
+// entry's checksum, and returns its entries in order
+func unpackArchive(t *testing.T, path string) ([]*zip.File, map[string][]byte) {
+	t.Helper()
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { zr.Close() })
+	entries := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Reading to the end verifies the CRC-32
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		entries[f.Name] = data
+	}
+	return zr.File, entries
+}
+
+// checkXML fails unless data is well-formed XML
+func checkXML(t *testing.T, name string, data []byte) {
+	t.Helper()
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = true
+	for {
+		if _, err := d.Token(); err == io.EOF {
+			return
+		} else if err != nil {
+			t.Errorf("%s is not well-formed: %v", name, err)
+			return
+		}
+	}
+}
+
+func TestRemediateEPUB(t *testing.T) {
+	images := []string{"OEBPS/images/kept.png", "OEBPS/images/cat.png", "OEBPS/images/dog.png", "OEBPS/images/divider.png"}
+	book := packArchive(t, "testdata/epub/book", images, "book.epub")
+	out := filepath.Join(t.TempDir(), "book.accessible.epub")
+
+	var stdout, stderr bytes.Buffer
+	ok, err := remediateArchive(context.Background(), testProvider, epubFormat, book, out, 2, false, &stdout, &stderr)
+	if err != nil || !ok {
+		t.Fatalf("remediateArchive = %v, %v: %s", ok, err, stderr.String())
+	}
+	if want := "added alt text for 2 images"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("stderr = %q, want %q", stderr.String(), want)
+	}
+
+	files, entries := unpackArchive(t, out)
+	if files[0].Name != "mimetype" || files[0].Method != zip.Store || string(entries["mimetype"]) != "application/epub+zip" {
+		t.Errorf("first entry = %s (method %d), want mimetype stored uncompressed", files[0].Name, files[0].Method)
+	}
+	original, _ := unpackArchive(t, book)
+	if len(files) != len(original) {
+		t.Errorf("%d entries, want %d", len(files), len(original))
+	}
+	for i, f := range files {
+		if f.Name != original[i].Name {
+			t.Errorf("entry %d = %s, want %s", i, f.Name, original[i].Name)
+		}
+	}
+	for _, image := range images {
+		if !bytes.Equal(entries[image], []byte("\x89PNG\r\n\x1a\n"+strings.TrimSuffix(filepath.Base(image), ".png"))) {
+			t.Errorf("%s changed", image)
+		}
+	}
+
+	chapter, opf := entries["OEBPS/text/chapter.xhtml"], entries["OEBPS/content.opf"]
+	checkGolden(t, "testdata/epub/chapter.golden.xhtml", chapter)
+	checkGolden(t, "testdata/epub/content.golden.opf", opf)
+	checkXML(t, "chapter.xhtml", chapter)
+	checkXML(t, "content.opf", opf)
+
+	// Remediating the result again finds nothing to do
+	stderr.Reset()
+	again := filepath.Join(t.TempDir(), "again.epub")
+	if ok, err := remediateArchive(context.Background(), testProvider, epubFormat, out, again, 2, false, &stdout, &stderr); err != nil || !ok {
+		t.Fatalf("second remediateArchive = %v, %v", ok, err)
+	}
+	if !strings.Contains(stderr.String(), "no images need alt text") {
+		t.Errorf("second run stderr = %q", stderr.String())
+	}
+}
+
+func TestRemediateEPUBIncomplete(t *testing.T) {
+	// Without the cat image, the book can't claim every image has alt text
+	images := []string{"OEBPS/images/dog.png"}
+	book := packArchive(t, "testdata/epub/book", images, "book.epub")
+	out := filepath.Join(t.TempDir(), "book.accessible.epub")
+
+	var stdout, stderr bytes.Buffer
+	ok, err := remediateArchive(context.Background(), testProvider, epubFormat, book, out, 1, false, &stdout, &stderr)
+	if err != nil || ok {
+		t.Fatalf("remediateArchive = %v, %v, want incomplete", ok, err)
+	}
+	if want := "OEBPS/text/chapter.xhtml: skipping missing image OEBPS/images/cat.png"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("stderr = %q, want %q", stderr.String(), want)
+	}
+	_, entries := unpackArchive(t, out)
+	if bytes.Contains(entries["OEBPS/content.opf"], []byte("alternativeText")) {
+		t.Error("alternativeText declared with an image still missing alt text")
+	}
+	if !bytes.Contains(entries["OEBPS/text/chapter.xhtml"], []byte(`alt="A dog's bone"`)) {
+		t.Error("the image that could be captioned wasn't")
+	}
+}
@@ -0,0 +1,399 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/config"
+)
+
+// evalFormats are the formats eval can write its comparison in
+var evalFormats = []string{"text", "json"}
+
+// referenceColumn is the manifest column eval reads each image's reference
+// alt text from; it is kept out of the prompt context
+const referenceColumn = "reference"
+
+// evalVariant is one configuration an eval run compares: the settings in a
+// config file, layered over the environment and base config
+type evalVariant struct {
+	Name string
+	env  map[string]string
+}
+
+// evalResult is one variant's alt text for one image
+type evalResult struct {
+	Variant string `json:"variant"`
+	// AltText is the first option, which is the one scored
+	AltText    string  `json:"alt_text,omitempty"`
+	Length     int     `json:"length"`
+	Score      int     `json:"score"`
+	Confidence int     `json:"confidence"`
+	Cost       float64 `json:"cost"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// evalImage is an image in the set and what each variant made of it
+type evalImage struct {
+	Path      string       `json:"path"`
+	Reference string       `json:"reference,omitempty"`
+	Results   []evalResult `json:"results"`
+	// Preferred names the variant the judge picked, when there is a judge
+	// and it picked one
+	Preferred string `json:"preferred,omitempty"`
+}
+
+// evalSummary is a variant's totals across the image set
+type evalSummary struct {
+	Variant        string  `json:"variant"`
+	Provider       string  `json:"provider"`
+	Model          string  `json:"model"`
+	Images         int     `json:"images"`
+	Failed         int     `json:"failed"`
+	MeanLength     float64 `json:"mean_length"`
+	MeanScore      float64 `json:"mean_score"`
+	MeanConfidence float64 `json:"mean_confidence"`
+	Cost           float64 `json:"cost"`
+	// Preferred counts the images the judge picked this variant for
+	Preferred int `json:"preferred"`
+}
+
+// evalReport is the comparison eval writes
+type evalReport struct {
+	Variants []evalSummary `json:"variants"`
+	// Judged counts the images the judge picked a variant for, and
+	// JudgeCost is what asking it cost
+	Judged    int         `json:"judged,omitempty"`
+	JudgeCost float64     `json:"judge_cost,omitempty"`
+	Images    []evalImage `json:"images"`
+}
+
+// Eval implements "alt-text-generator eval": it captions a set of images
+// with two or more configurations and compares the results, so a prompt or
+// provider change can be checked before it is rolled out
+func Eval(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("eval", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var variants []evalVariant
+	flags.Func("variant", "compare the configuration in this config file, as `name=path` or a path (repeatable, at least twice)", func(s string) error {
+		name, path, ok := strings.Cut(s, "=")
+		if !ok {
+			path = s
+			name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		for _, v := range variants {
+			if v.Name == name {
+				return fmt.Errorf("variant %s is given twice", name)
+			}
+		}
+		env, err := config.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		variants = append(variants, evalVariant{Name: name, env: env})
+		return nil
+	})
+	promptFlags(flags)
+	contextValues := contextFlag(flags)
+	manifestPath := flags.String("manifest", "", "caption the images listed in this CSV or YAML file, with an optional "+referenceColumn+" column of alt text written by a person")
+	judgeName := flags.String("judge", "", "also ask this provider's model which variant's alt text is best for each image: anthropic or openai")
+	concurrency := flags.Int("concurrency", 4, "number of images to caption in parallel")
+	outputFormat := flags.String("output-format", "text", "comparison format: "+strings.Join(evalFormats, ", "))
+	reportPath := flags.String("report", "", "write the comparison to this file instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator eval [flags] -variant a.toml -variant b.toml <dir|file|pattern>...")
+		fmt.Fprintln(stderr, "       alt-text-generator eval [flags] -variant a.toml -variant b.toml -manifest images.csv")
+		flags.PrintDefaults()
+	}
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(args) == 0 && *manifestPath == "" {
+		flags.Usage()
+		return exitUsage
+	}
+	if *manifestPath != "" && len(args) > 0 {
+		fmt.Fprintln(stderr, "Error: -manifest lists the images to caption; don't also name files")
+		return exitUsage
+	}
+	if len(variants) < 2 {
+		fmt.Fprintln(stderr, "Error: give at least two -variant config files to compare")
+		return exitUsage
+	}
+	if !slices.Contains(evalFormats, *outputFormat) {
+		fmt.Fprintf(stderr, "Error: -output-format must be one of %s\n", strings.Join(evalFormats, ", "))
+		return exitUsage
+	}
+	if *concurrency < 1 {
+		fmt.Fprintln(stderr, "Error: -concurrency must be at least 1")
+		return exitUsage
+	}
+	imageContext, err := api.NewImageContext(contextValues)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitUsage
+	}
+
+	var paths []string
+	var contexts []api.ImageContext
+	var images []evalImage
+	if *manifestPath != "" {
+		entries, err := readManifest(*manifestPath, contextValues)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		for _, entry := range entries {
+			reference := entry.Context.Vars[referenceColumn]
+			delete(entry.Context.Vars, referenceColumn)
+			if len(entry.Context.Vars) == 0 {
+				entry.Context.Vars = nil
+			}
+			paths = append(paths, entry.Path)
+			contexts = append(contexts, entry.Context)
+			images = append(images, evalImage{Path: entry.Path, Reference: reference})
+		}
+	} else {
+		roots, err := expandGlobs(args)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		if paths, err = findFiles(roots, false, parseExtensions(defaultExtensions), nil); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		for _, path := range paths {
+			images = append(images, evalImage{Path: path})
+		}
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(stderr, "Error: no matching images found")
+		return exitError
+	}
+
+	if err := setup(); err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	var judge api.Provider
+	if *judgeName != "" {
+		if judge, err = selectProvider(*judgeName); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitUsage
+		}
+	}
+
+	out := stdout
+	if *reportPath != "" {
+		f, err := os.Create(*reportPath)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		defer f.Close()
+		out = f
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	// Values given with -context apply to every image; a manifest's
+	// contexts already include them
+	ctx = api.WithImageContext(ctx, imageContext)
+
+	var summaries []evalSummary
+	for _, variant := range variants {
+		fmt.Fprintf(stderr, "Captioning %d images with %s\n", len(paths), variant.Name)
+		summary, err := runVariant(ctx, variant, paths, contexts, *concurrency, images)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: variant %s: %v\n", variant.Name, err)
+			return exitError
+		}
+		summaries = append(summaries, summary)
+	}
+	result := evalReport{Variants: summaries, Images: images}
+	if *judgeName != "" {
+		fmt.Fprintf(stderr, "Judging with %s\n", judge.Name)
+		judgeVariants(ctx, judge, &result)
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintln(stderr, "Error: interrupted")
+		return exitError
+	}
+
+	if *outputFormat == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(result)
+	} else {
+		err = writeEvalText(out, result)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "Error writing report:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// runVariant captions paths with variant's settings in the environment,
+// adding its result for each image to images, and returns its totals. The
+// environment is put back afterwards.
+func runVariant(ctx context.Context, variant evalVariant, paths []string, contexts []api.ImageContext, concurrency int, images []evalImage) (evalSummary, error) {
+	defer applyEnv(variant.env)()
+	if err := checkSettings(); err != nil {
+		return evalSummary{}, err
+	}
+	provider, err := selectProvider("")
+	if err != nil {
+		return evalSummary{}, err
+	}
+
+	summary := evalSummary{Variant: variant.Name, Provider: provider.Name, Model: provider.Model}
+	var lengths, scores, confidences int
+	i := 0
+	err = captionAll(ctx, provider, paths, contexts, concurrency, nil, nil, func(res batchResult) error {
+		result := evalResult{Variant: variant.Name, Cost: provider.Cost(res.Result)}
+		summary.Images++
+		summary.Cost += result.Cost
+		if res.Err != nil {
+			result.Error = res.Err.Error()
+			summary.Failed++
+		} else {
+			result.AltText = api.FirstOption(res.Result.Text)
+			result.Length = len([]rune(result.AltText))
+			result.Score = res.Result.Score
+			result.Confidence = res.Result.Confidence
+			lengths += result.Length
+			scores += result.Score
+			confidences += result.Confidence
+		}
+		images[i].Results = append(images[i].Results, result)
+		i++
+		return nil
+	})
+	if err != nil {
+		return summary, err
+	}
+	if n := float64(summary.Images - summary.Failed); n > 0 {
+		summary.MeanLength = float64(lengths) / n
+		summary.MeanScore = float64(scores) / n
+		summary.MeanConfidence = float64(confidences) / n
+	}
+	return summary, nil
+}
+
+// applyEnv sets each variable in env and returns a function that puts back
+// what they were before
+func applyEnv(env map[string]string) func() {
+	type saved struct {
+		value string
+		set   bool
+	}
+	before := map[string]saved{}
+	for key, value := range env {
+		old, set := os.LookupEnv(key)
+		before[key] = saved{old, set}
+		os.Setenv(key, value)
+	}
+	return func() {
+		for key, s := range before {
+			if s.set {
+				os.Setenv(key, s.value)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+	}
+}
+
+// judgeVariants asks judge to pick the best variant's alt text for each
+// image that more than one variant captioned. The variants are offered in
+// a different order for each image, so a judge that favours a position
+// doesn't favour one variant.
+func judgeVariants(ctx context.Context, judge api.Provider, report *evalReport) {
+	for i := range report.Images {
+		image := &report.Images[i]
+		var candidates []string
+		var variants []int
+		for j, result := range image.Results {
+			if result.Error == "" && result.AltText != "" {
+				candidates = append(candidates, result.AltText)
+				variants = append(variants, j)
+			}
+		}
+		if len(candidates) < 2 || ctx.Err() != nil {
+			continue
+		}
+		shift := i % len(candidates)
+		candidates = append(candidates[shift:], candidates[:shift]...)
+		variants = append(variants[shift:], variants[:shift]...)
+
+		data, err := loadImage(ctx, image.Path)
+		if err != nil {
+			continue
+		}
+		pick, result, err := api.Judge(ctx, judge, data, image.Reference, candidates)
+		report.JudgeCost += judge.Cost(result)
+		if err != nil || pick < 0 {
+			continue
+		}
+		image.Preferred = image.Results[variants[pick]].Variant
+		report.Variants[variants[pick]].Preferred++
+		report.Judged++
+	}
+}
+
+// writeEvalText writes report as a table of each variant's totals followed
+// by each image's alt text
+func writeEvalText(w io.Writer, report evalReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "Variant\tProvider\tModel\tImages\tFailed\tMean length\tMean score\tMean confidence\tCost")
+	if report.Judged > 0 {
+		fmt.Fprint(tw, "\tPreferred")
+	}
+	fmt.Fprintln(tw)
+	for _, s := range report.Variants {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%.1f\t%.1f\t%.1f\t$%.4f", s.Variant, s.Provider, s.Model, s.Images, s.Failed, s.MeanLength, s.MeanScore, s.MeanConfidence, s.Cost)
+		if report.Judged > 0 {
+			fmt.Fprintf(tw, "\t%d/%d", s.Preferred, report.Judged)
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if report.Judged > 0 {
+		fmt.Fprintf(w, "Judge cost: $%.4f\n", report.JudgeCost)
+	}
+
+	for _, image := range report.Images {
+		fmt.Fprintf(w, "\n%s\n", image.Path)
+		if image.Reference != "" {
+			fmt.Fprintf(w, "  reference: %s\n", image.Reference)
+		}
+		for _, result := range image.Results {
+			marker := " "
+			if result.Variant == image.Preferred {
+				marker = "*"
+			}
+			if result.Error != "" {
+				fmt.Fprintf(w, " %s%s: error: %s\n", marker, result.Variant, result.Error)
+				continue
+			}
+			fmt.Fprintf(w, " %s%s: %s (%d chars, score %d)\n", marker, result.Variant, result.AltText, result.Length, result.Score)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"alt-text-generator/internal/config"
+	"alt-text-generator/internal/history"
+)
+
+// Export implements "alt-text-generator export": it writes the generations
+// in the history database as CSV or JSON, for compliance records or
+// importing into a CMS
+func Export(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	outputFormat := flags.String("output-format", "csv", "export format: "+strings.Join(history.ExportFormats, ", "))
+	output := flags.String("output", "", "write the export to this file instead of stdout")
+	providerName := flags.String("provider", "", "only generations from this provider")
+	user := flags.String("user", "", "only generations by this API key label or token subject")
+	filename := flags.String("filename", "", "only generations whose filename contains this text")
+	search := flags.String("search", "", "only generations whose alt text contains every one of these words")
+	rating := flags.String("rating", "", "only generations rated up or down as feedback")
+	since := flags.String("since", "", "only generations made at or after this RFC 3339 timestamp or date")
+	until := flags.String("until", "", "only generations made before this RFC 3339 timestamp or date")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator export [flags]")
+		fmt.Fprintln(stderr, "Exports the history database named by history.database or HISTORY_DB.")
+		flags.PrintDefaults()
+	}
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(args) > 0 {
+		fmt.Fprintln(stderr, "Error: export takes no arguments")
+		return exitUsage
+	}
+	if !slices.Contains(history.ExportFormats, *outputFormat) {
+		fmt.Fprintf(stderr, "Error: -output-format must be one of %s\n", strings.Join(history.ExportFormats, ", "))
+		return exitUsage
+	}
+	filter := history.Filter{Provider: *providerName, User: *user, Filename: *filename, Search: *search, Rating: *rating}
+	for _, t := range []struct {
+		flag  string
+		value string
+		dest  *time.Time
+	}{{"since", *since, &filter.Since}, {"until", *until, &filter.Until}} {
+		if t.value == "" {
+			continue
+		}
+		if *t.dest, err = parseTime(t.value); err != nil {
+			fmt.Fprintf(stderr, "Error: -%s must be an RFC 3339 timestamp or a date such as 2024-05-01\n", t.flag)
+			return exitUsage
+		}
+	}
+
+	if err := setup(); err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	dsn := config.GetString("HISTORY_DB", "")
+	if dsn == "" {
+		fmt.Fprintln(stderr, "Error: no history database is configured; set history.database or HISTORY_DB, or export a running server's in-memory history from /api/v1/history/export")
+		return exitError
+	}
+	store, err := history.Open(dsn)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	defer store.Close()
+
+	w := stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := store.Export(w, filter, *outputFormat)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	if *output != "" {
+		fmt.Fprintf(stderr, "Exported %d generations to %s\n", n, *output)
+	}
+	return exitOK
+}
+
+// parseTime reads an RFC 3339 timestamp or a bare date
+func parseTime(v string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", v)
+}
@@ -0,0 +1,130 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/history"
+)
+
+// generateFormats lists the output formats generate can print
+var generateFormats = []string{"text", "markdown"}
+
+// Generate implements "alt-text-generator generate <image>...": it captions
+// each file and prints the alt text options to stdout, one per line. Patterns
+// such as images/**/*.png are expanded, and "-" reads an image from stdin;
+// with several files each one's options are listed beneath its path. With
+// -format markdown it prints a Markdown image per file instead.
+func Generate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	providerName := fs.String("provider", "", "provider to use: anthropic or openai (defaults to the only one configured)")
+	format := fs.String("format", "text", "output format: text, or markdown for ![alt](path) ready to paste into docs")
+	promptFlags(fs)
+	contextValues := contextFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator generate [-provider name] [-format text|markdown] [-context key=value]... <image|pattern|->...")
+		fs.PrintDefaults()
+	}
+
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	if !slices.Contains(generateFormats, *format) {
+		fmt.Fprintf(stderr, "Error: -format must be one of %s\n", strings.Join(generateFormats, ", "))
+		return exitUsage
+	}
+	imageContext, err := api.NewImageContext(contextValues)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitUsage
+	}
+	paths, err := expandGlobs(args)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	if err := setup(); err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+
+	provider, err := selectProvider(*providerName)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx = api.WithImageContext(ctx, imageContext)
+
+	if *format == "markdown" {
+		status := exitOK
+		for _, path := range paths {
+			if ctx.Err() != nil {
+				return exitError
+			}
+			result := captionFile(ctx, provider, path, nil, nil)
+			if result.Err != nil {
+				fmt.Fprintf(stderr, "Error: %s: %v\n", path, result.Err)
+				status = exitError
+				continue
+			}
+			src := path
+			if src == "-" {
+				// An image from stdin has no path; leave one to fill in
+				src = ""
+			}
+			fmt.Fprintln(stdout, markdownImage(bestAltText(result.Result.Text), src))
+		}
+		return status
+	}
+
+	if len(paths) == 1 {
+		result := captionFile(ctx, provider, paths[0], nil, nil)
+		if result.Err != nil {
+			fmt.Fprintln(stderr, "Error:", result.Err)
+			return exitError
+		}
+		for _, option := range (history.Record{AltText: result.Result.Text}).Options() {
+			fmt.Fprintln(stdout, option)
+		}
+		for i, detail := range resultDetails(result.Result) {
+			if i == 0 {
+				fmt.Fprintln(stdout)
+			}
+			fmt.Fprintf(stdout, "%s: %s\n", detail[0], detail[1])
+		}
+		if api.GraderEnabled() {
+			fmt.Fprintf(stdout, "\nQuality score: %d/100\n", result.Result.Score)
+		}
+		return exitOK
+	}
+
+	report := &textReport{w: stdout}
+	status := exitOK
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return exitError
+		}
+		result := captionFile(ctx, provider, path, nil, nil)
+		if result.Err != nil {
+			status = exitError
+		}
+		report.Write(result)
+	}
+	return status
+}
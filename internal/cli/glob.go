@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// expandGlobs replaces shell-style patterns among args with the files they
+// match, so globs work even where the shell doesn't expand them (or doesn't
+// support **). Arguments without pattern characters pass through unchanged;
+// a pattern matching nothing is an error. Duplicates are dropped.
+func expandGlobs(args []string) ([]string, error) {
+	var paths []string
+	seen := map[string]bool{}
+	add := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+
+	for _, arg := range args {
+		if !hasMeta(arg) {
+			add(arg)
+			continue
+		}
+		matches, err := glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", arg)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			add(m)
+		}
+	}
+	return paths, nil
+}
+
+func hasMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// glob is filepath.Glob extended with ** matching any number of directories
+func glob(pattern string) ([]string, error) {
+	if !strings.Contains(pattern, "**") {
+		return filepath.Glob(pattern)
+	}
+
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	for _, segment := range segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	// Walk from the longest leading directory without pattern characters
+	i := 0
+	for i < len(segments)-1 && !hasMeta(segments[i]) {
+		i++
+	}
+	base := strings.Join(segments[:i], "/")
+	if base == "" {
+		base = "."
+		if i > 0 {
+			base = "/"
+		}
+	}
+	rest := segments[i:]
+
+	var matches []string
+	err := filepath.WalkDir(filepath.FromSlash(base), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.FromSlash(base), p)
+		if err != nil {
+			return err
+		}
+		if matchSegments(rest, strings.Split(filepath.ToSlash(rel), "/")) {
+			matches = append(matches, p)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// matchSegments matches path segments against pattern segments, where a **
+// segment matches zero or more path segments
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], name[0])
+	return ok && matchSegments(pattern[1:], name[1:])
+}
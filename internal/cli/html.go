@@ -0,0 +1,313 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// HTML implements "alt-text-generator html <file|dir|pattern>...": it finds
+// <img> tags with missing or empty alt attributes in local HTML files,
+// captions the images they reference, and writes the alt text into the files
+func HTML(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("html", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	providerName := flags.String("provider", "", "provider to use: anthropic or openai (defaults to the only one configured)")
+	promptFlags(flags)
+	recursive := flags.Bool("recursive", false, "descend into subdirectories")
+	root := flags.String("root", ".", "site root that absolute image paths such as /img/a.png resolve against")
+	diff := flags.Bool("diff", false, "print the changes as a unified diff instead of rewriting the files")
+	keepEmpty := flags.Bool("keep-empty", false, `leave alt="" alone, treating those images as decorative`)
+	concurrency := flags.Int("concurrency", 4, "number of images to caption in parallel")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator html [flags] <file|dir|pattern>...")
+		flags.PrintDefaults()
+	}
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	roots, err := expandGlobs(args)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	paths, err := findFiles(roots, *recursive, parseExtensions("html,htm"), nil)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+
+	return rewriteDocuments(paths, *providerName, *concurrency, *diff, stdout, stderr, func(path string, data []byte) []altEdit {
+		edits, skipped := findHTMLImages(data, filepath.Dir(path), *root, !*keepEmpty)
+		for _, skip := range skipped {
+			fmt.Fprintf(stderr, "%s: skipping %s\n", path, skip.Reason)
+		}
+		return edits
+	})
+}
+
+// rewriteDocuments is the shared driver for commands that add alt text to
+// files in place: find returns the edits each file needs, the images are
+// captioned, and the files are rewritten or, with diff, shown as a diff
+func rewriteDocuments(paths []string, providerName string, concurrency int, diff bool, stdout, stderr io.Writer, find func(path string, data []byte) []altEdit) int {
+	type document struct {
+		path  string
+		data  []byte
+		edits []altEdit
+	}
+	var docs []document
+	var images []string
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		edits := find(path, data)
+		if len(edits) == 0 {
+			continue
+		}
+		docs = append(docs, document{path, data, edits})
+		for _, edit := range edits {
+			images = append(images, edit.Image)
+		}
+	}
+	if len(images) == 0 {
+		fmt.Fprintln(stderr, "No images need alt text")
+		return exitOK
+	}
+
+	if err := setup(); err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	provider, err := selectProvider(providerName)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	alts, results := captionImages(ctx, provider, images, concurrency)
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Fprintf(stderr, "%s: %v\n", result.Path, result.Err)
+		}
+	}
+
+	updated, files := 0, 0
+	for _, doc := range docs {
+		data, applied := applyEdits(doc.data, doc.edits, alts)
+		if applied == 0 {
+			continue
+		}
+		updated += applied
+		files++
+		if diff {
+			writeDiff(stdout, doc.path, doc.data, data)
+			continue
+		}
+		info, err := os.Stat(doc.path)
+		if err == nil {
+			err = os.WriteFile(doc.path, data, info.Mode().Perm())
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+	}
+
+	verb := "Added"
+	if diff {
+		verb = "Would add"
+	}
+	fmt.Fprintf(stderr, "%s alt text for %d images in %d files; %d images failed\n", verb, updated, files, failed)
+	if failed > 0 {
+		return exitError
+	}
+	return exitOK
+}
+
+// findHTMLImages returns an edit for every <img> whose alt is missing (or
+// empty, with fixEmpty) and whose src is a local file. Images marked
+// decorative with role="presentation" or aria-hidden="true" are left alone.
+// It also returns why any other such images were skipped.
+func findHTMLImages(data []byte, dir, root string, fixEmpty bool) ([]altEdit, []skippedImage) {
+	var edits []altEdit
+	var skipped []skippedImage
+	z := xhtml.NewTokenizer(bytes.NewReader(data))
+	offset := 0
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			break
+		}
+		start := offset
+		offset += len(z.Raw())
+		if tt != xhtml.StartTagToken && tt != xhtml.SelfClosingTagToken {
+			continue
+		}
+		if name, _ := z.TagName(); string(name) != "img" {
+			continue
+		}
+
+		// The tokenizer lowercases names in its copy, so work from the original
+		tag := string(data[start:offset])
+		attrs := parseTagAttrs(tag)
+		alt, hasAlt := attrs.get("alt")
+		if hasAlt && (!fixEmpty || strings.TrimSpace(alt.value) != "") {
+			continue
+		}
+		if role, _ := attrs.get("role"); role.value == "presentation" || role.value == "none" {
+			continue
+		}
+		if hidden, _ := attrs.get("aria-hidden"); hidden.value == "true" {
+			continue
+		}
+
+		src, _ := attrs.get("src")
+		image, err := resolveImagePath(html.UnescapeString(src.value), dir, root)
+		if err != nil {
+			skipped = append(skipped, skippedImage{start, err.Error()})
+			continue
+		}
+
+		edit := altEdit{Start: start, End: offset, Image: image}
+		if hasAlt {
+			edit.Replace = func(text string) string {
+				return tag[:alt.start] + `alt="` + escapeAttr(text) + `"` + tag[alt.end:]
+			}
+		} else {
+			// Insert right after the tag name, leaving the rest untouched
+			edit.Replace = func(text string) string {
+				return tag[:len("<img")] + ` alt="` + escapeAttr(text) + `"` + tag[len("<img"):]
+			}
+		}
+		edits = append(edits, edit)
+	}
+	return edits, skipped
+}
+
+// escapeAttr escapes text for a double-quoted attribute value
+var escapeAttr = strings.NewReplacer("&", "&amp;", `"`, "&quot;", "<", "&lt;", ">", "&gt;").Replace
+
+// resolveImagePath turns an image reference into a local file path. Paths
+// starting with / resolve against root, others against dir. Remote and
+// data URLs are not supported.
+func resolveImagePath(src, dir, root string) (string, error) {
+	switch {
+	case src == "":
+		return "", fmt.Errorf("image without src")
+	case strings.HasPrefix(src, "data:"):
+		return "", fmt.Errorf("inline data URL image")
+	case strings.HasPrefix(src, "//") || strings.Contains(src, "://"):
+		return "", fmt.Errorf("remote image %s", src)
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("invalid image path %q", src)
+	}
+	path := filepath.FromSlash(u.Path)
+	if strings.HasPrefix(u.Path, "/") {
+		path = filepath.Join(root, path)
+	} else {
+		path = filepath.Join(dir, path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("missing image %s", path)
+	}
+	return path, nil
+}
+
+// tagAttr is an attribute's value and byte range within a raw tag
+type tagAttr struct {
+	name       string
+	value      string
+	start, end int
+}
+
+type tagAttrs []tagAttr
+
+func (a tagAttrs) get(name string) (tagAttr, bool) {
+	for _, attr := range a {
+		if attr.name == name {
+			return attr, true
+		}
+	}
+	return tagAttr{}, false
+}
+
+// parseTagAttrs scans the attributes of a raw start tag such as
+// `<img src="a.png" alt>`, recording where each one sits so it can be
+// replaced without disturbing the rest of the tag. Names are lowercased;
+// values are returned as written, without their quotes.
+func parseTagAttrs(tag string) tagAttrs {
+	var attrs tagAttrs
+	i := strings.IndexAny(tag, " \t\n\r\f/>")
+	if i < 0 {
+		return nil
+	}
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+	for i < len(tag) {
+		for i < len(tag) && (isSpace(tag[i]) || tag[i] == '/') {
+			i++
+		}
+		if i >= len(tag) || tag[i] == '>' {
+			break
+		}
+		start := i
+		for i < len(tag) && !isSpace(tag[i]) && tag[i] != '=' && tag[i] != '>' && tag[i] != '/' {
+			i++
+		}
+		attr := tagAttr{name: strings.ToLower(tag[start:i]), start: start}
+
+		j := i
+		for j < len(tag) && isSpace(tag[j]) {
+			j++
+		}
+		if j < len(tag) && tag[j] == '=' {
+			j++
+			for j < len(tag) && isSpace(tag[j]) {
+				j++
+			}
+			if j < len(tag) && (tag[j] == '"' || tag[j] == '\'') {
+				quote := tag[j]
+				end := strings.IndexByte(tag[j+1:], quote)
+				if end < 0 {
+					end = len(tag) - j - 1
+				}
+				attr.value = tag[j+1 : j+1+end]
+				i = min(j+1+end+1, len(tag))
+			} else {
+				k := j
+				for k < len(tag) && !isSpace(tag[k]) && tag[k] != '>' {
+					k++
+				}
+				attr.value = tag[j:k]
+				i = k
+			}
+		}
+		attr.end = i
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
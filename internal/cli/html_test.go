@@ -0,0 +1,159 @@
+package cli
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	xhtml "golang.org/x/net/html"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got with the golden file at path, or with -update
+// rewrites the file
+func checkGolden(t *testing.T, path string, got []byte) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s:\n%s", path, got)
+	}
+}
+
+// testAlts is alt text for the images in testdata documents, keyed by file
+// name, chosen to need escaping
+var testAlts = map[string]string{
+	"cat.png":  `A cat & a "mouse" <3`,
+	"dog.png":  "A dog's bone",
+	"logo.png": "Acme > Co",
+}
+
+// captioned returns the alt text for each edit's image, as captionImages
+// would, checking that only images in testAlts are edited
+func captioned(t *testing.T, edits []altEdit) map[string]string {
+	t.Helper()
+	alts := map[string]string{}
+	for _, edit := range edits {
+		alt, ok := testAlts[filepath.Base(edit.Image)]
+		if !ok {
+			t.Errorf("unexpected edit for %s", edit.Image)
+		}
+		alts[edit.Image] = alt
+	}
+	return alts
+}
+
+func TestRewriteHTML(t *testing.T) {
+	input, err := os.ReadFile("testdata/html/page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "images"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"kept", "cat", "dog", "divider", "spacer", "rule"} {
+		writePNG(t, filepath.Join(dir, "images"), name+".png", name)
+	}
+	writePNG(t, dir, "logo.png", "logo")
+
+	tests := []struct {
+		golden   string
+		fixEmpty bool
+		edits    int
+	}{
+		{"testdata/html/page.golden.html", true, 4},
+		{"testdata/html/page.keep-empty.golden.html", false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.golden), func(t *testing.T) {
+			edits, skipped := findHTMLImages(input, dir, dir, tt.fixEmpty)
+			if len(edits) != tt.edits {
+				t.Errorf("%d edits, want %d", len(edits), tt.edits)
+			}
+			var reasons []string
+			for _, skip := range skipped {
+				reasons = append(reasons, strings.ReplaceAll(skip.Reason, dir+string(filepath.Separator), ""))
+			}
+			want := []string{"remote image https://example.com/remote.png", "inline data URL image", "missing image images/missing.png"}
+			if tt.fixEmpty {
+				want = append(want, "image without src")
+			}
+			if strings.Join(reasons, "\n") != strings.Join(want, "\n") {
+				t.Errorf("skipped %q, want %q", reasons, want)
+			}
+
+			out, applied := applyEdits(input, edits, captioned(t, edits))
+			if applied != tt.edits {
+				t.Errorf("applied %d edits, want %d", applied, tt.edits)
+			}
+			checkGolden(t, tt.golden, out)
+
+			// The alt text survives a round trip through an HTML parser
+			doc, err := xhtml.Parse(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			alts := map[string]string{}
+			for n := range doc.Descendants() {
+				if n.Type != xhtml.ElementNode || n.Data != "img" {
+					continue
+				}
+				var src, alt string
+				for _, attr := range n.Attr {
+					switch attr.Key {
+					case "src":
+						src = attr.Val
+					case "alt":
+						alt = attr.Val
+					}
+				}
+				if alt != "" {
+					alts[filepath.Base(strings.Split(src, "?")[0])] = alt
+				}
+			}
+			for name, alt := range testAlts {
+				if name == "dog.png" && !tt.fixEmpty {
+					alt = ""
+				}
+				if alts[name] != alt {
+					t.Errorf("%s alt = %q, want %q", name, alts[name], alt)
+				}
+			}
+			if alts["kept.png"] != "A lighthouse at dusk" {
+				t.Errorf("existing alt = %q", alts["kept.png"])
+			}
+		})
+	}
+}
+
+func TestParseTagAttrs(t *testing.T) {
+	tag := `<img SRC="a.png" alt = 'it"s' data-x=bare hidden/>`
+	want := []tagAttr{
+		{"src", "a.png", 5, 16},
+		{"alt", `it"s`, 17, 29},
+		{"data-x", "bare", 30, 41},
+		{"hidden", "", 42, 48},
+	}
+	attrs := parseTagAttrs(tag)
+	if len(attrs) != len(want) {
+		t.Fatalf("parseTagAttrs = %+v, want %+v", attrs, want)
+	}
+	for i, attr := range attrs {
+		if attr != want[i] {
+			t.Errorf("attr %d = %+v (%q), want %+v", i, attr, tag[attr.start:attr.end], want[i])
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/history"
+)
+
+// altEdit is a place in a document that needs alt text for an image
+type altEdit struct {
+	// Start and End are the byte range of the markup to replace
+	Start, End int
+	// Image is the resolved path of the image file
+	Image string
+	// Replace returns the markup to put in place of Start:End
+	Replace func(alt string) string
+}
+
+// skippedImage is an image that needs alt text but can't be captioned, such
+// as a remote image or one whose file is missing
+type skippedImage struct {
+	// Offset is where the image's markup starts in the document
+	Offset int
+	Reason string
+}
+
+// optionNumber matches the "1. " prefix providers put on each option
+var optionNumber = regexp.MustCompile(`^\s*\d+[.)]\s*`)
+
+// bestAltText picks the first alt text option, without its numbering or
+// surrounding brackets or quotes
+func bestAltText(text string) string {
+	options := (history.Record{AltText: text}).Options()
+	if len(options) == 0 {
+		return ""
+	}
+	alt := optionNumber.ReplaceAllString(options[0], "")
+	alt = strings.TrimSpace(strings.Trim(alt, `[]"`))
+	return alt
+}
+
+// captionImages captions each distinct image once and returns the alt text
+// to use for each successful one, keyed by path, along with every result
+func captionImages(ctx context.Context, provider api.Provider, images []string, concurrency int) (map[string]string, []batchResult) {
+	var unique []string
+	seen := map[string]bool{}
+	for _, image := range images {
+		if !seen[image] {
+			seen[image] = true
+			unique = append(unique, image)
+		}
+	}
+
+	alts := map[string]string{}
+	var results []batchResult
+	captionAll(ctx, provider, unique, nil, concurrency, nil, nil, func(result batchResult) error {
+		if result.Err == nil {
+			if alt := bestAltText(result.Result.Text); alt != "" {
+				alts[result.Path] = alt
+			}
+		}
+		results = append(results, result)
+		return nil
+	})
+	return alts, results
+}
+
+// applyEdits rewrites data with the alt text for each edit whose image was
+// captioned. Edits must be in document order and not overlap. It returns the
+// new content and how many edits were applied.
+func applyEdits(data []byte, edits []altEdit, alts map[string]string) ([]byte, int) {
+	var out []byte
+	last, applied := 0, 0
+	for _, edit := range edits {
+		alt, ok := alts[edit.Image]
+		if !ok {
+			continue
+		}
+		out = append(out, data[last:edit.Start]...)
+		out = append(out, edit.Replace(alt)...)
+		last = edit.End
+		applied++
+	}
+	return append(out, data[last:]...), applied
+}
@@ -0,0 +1,224 @@
+package cli
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"alt-text-generator/internal/api"
+)
+
+// manifestEntry is an image listed in a manifest and what is known about it
+type manifestEntry struct {
+	Path    string
+	Context api.ImageContext
+}
+
+// imageColumns are the columns (or YAML keys) that may give a manifest
+// entry's image; every other column is context for the prompt
+var imageColumns = []string{"path", "url", "image"}
+
+// readManifest reads a CSV or YAML manifest, chosen by extension, listing
+// images and optional context for each, which adds to or overrides defaults.
+// Relative paths resolve against the manifest's directory; URLs are kept as
+// they are.
+func readManifest(path string, defaults map[string]string) ([]manifestEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rows []manifestRow
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		rows, err = parseManifestCSV(strings.NewReader(string(data)))
+	case ".yaml", ".yml":
+		rows, err = parseManifestYAML(string(data))
+	default:
+		return nil, fmt.Errorf("%s: manifest must be a .csv, .yaml, or .yml file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	var entries []manifestEntry
+	for _, row := range rows {
+		image := ""
+		values := map[string]string{}
+		maps.Copy(values, defaults)
+		for key, value := range row.values {
+			if !slices.Contains(imageColumns, key) {
+				values[key] = value
+			} else if image == "" || key == "path" {
+				image = value
+			}
+		}
+		if image == "" {
+			return nil, fmt.Errorf("%s: line %d: no image path or URL", path, row.line)
+		}
+		if !isURL(image) && image != stdinPath && !filepath.IsAbs(image) {
+			image = filepath.Join(dir, filepath.FromSlash(image))
+		}
+		imageContext, err := api.NewImageContext(values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, row.line, err)
+		}
+		entries = append(entries, manifestEntry{Path: image, Context: imageContext})
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no images listed", path)
+	}
+	return entries, nil
+}
+
+// manifestRow is one image's values and the line it starts on
+type manifestRow struct {
+	values map[string]string
+	line   int
+}
+
+// parseManifestCSV reads a CSV manifest whose first row names the columns
+func parseManifestCSV(r io.Reader) ([]manifestRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = api.ContextKey(strings.TrimPrefix(header[i], "\ufeff"))
+	}
+
+	var rows []manifestRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) > len(header) {
+			return nil, fmt.Errorf("line %d: %d fields but only %d columns", line, len(record), len(header))
+		}
+		row := manifestRow{values: map[string]string{}, line: line}
+		for i, field := range record {
+			if field = strings.TrimSpace(field); field != "" {
+				row.values[header[i]] = field
+			}
+		}
+		if len(row.values) > 0 {
+			rows = append(rows, row)
+		}
+	}
+}
+
+// parseManifestYAML reads the YAML a manifest needs: a list with one mapping
+// per image, holding plain or quoted scalar values
+func parseManifestYAML(data string) ([]manifestRow, error) {
+	var rows []manifestRow
+	itemIndent := -1
+	for i, raw := range strings.Split(data, "\n") {
+		lineNo := i + 1
+		line := strings.TrimRight(stripYAMLComment(raw), " \t\r")
+		content := strings.TrimLeft(line, " ")
+		if content == "" || content == "---" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, not tabs", lineNo)
+		}
+		indent := len(line) - len(content)
+
+		if content == "-" || strings.HasPrefix(content, "- ") {
+			if itemIndent >= 0 && indent != itemIndent {
+				return nil, fmt.Errorf("line %d: list items must line up", lineNo)
+			}
+			itemIndent = indent
+			rows = append(rows, manifestRow{values: map[string]string{}, line: lineNo})
+			content = strings.TrimSpace(strings.TrimPrefix(content, "-"))
+			if content == "" {
+				continue
+			}
+		} else if len(rows) == 0 || indent <= itemIndent {
+			return nil, fmt.Errorf("line %d: expected a list of images, each starting with -", lineNo)
+		}
+
+		key, value, ok := strings.Cut(content, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", lineNo)
+		}
+		value, err := parseYAMLScalar(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		row := rows[len(rows)-1]
+		key = api.ContextKey(key)
+		if _, dup := row.values[key]; dup {
+			return nil, fmt.Errorf("line %d: %s is set twice", lineNo, key)
+		}
+		if value != "" {
+			row.values[key] = value
+		}
+	}
+	return rows, nil
+}
+
+// stripYAMLComment removes a # comment that starts a line or follows a space
+// outside quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' || c == '\'' && quote == '\'' && i+1 < len(line) && line[i+1] == '\'' {
+				// Skip the escaped character, or the second of a doubled ''
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t:-", line[i-1]) >= 0):
+			// Quotes only open a string at the start of a value, so the
+			// apostrophe in a plain value such as Men's doesn't
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseYAMLScalar unquotes a YAML scalar; ~ and null are empty
+func parseYAMLScalar(s string) (string, error) {
+	switch {
+	case s == "" || s == "~" || s == "null":
+		return "", nil
+	case s[0] == '"':
+		value, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid double-quoted string %s", s)
+		}
+		return value, nil
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s[0] == '|' || s[0] == '>':
+		return "", fmt.Errorf("block scalars are not supported; quote the value on one line")
+	case s[0] == '[' || s[0] == '{':
+		return "", fmt.Errorf("nested values are not supported")
+	}
+	return s, nil
+}
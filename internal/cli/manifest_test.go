@@ -0,0 +1,223 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseManifestYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []manifestRow
+		err  string
+	}{
+		{
+			name: "valid",
+			data: "---\n# images for the shop\n- path: shoes.jpg\n  Product Name: Trail shoe\n\n- url: https://example.com/a.png\n  notes: ~\n",
+			want: []manifestRow{
+				{values: map[string]string{"path": "shoes.jpg", "product_name": "Trail shoe"}, line: 3},
+				{values: map[string]string{"url": "https://example.com/a.png"}, line: 6},
+			},
+		},
+		{
+			name: "item on its own line",
+			data: "-\n  path: a.png\n  page-title: Home\n",
+			want: []manifestRow{{values: map[string]string{"path": "a.png", "page_title": "Home"}, line: 1}},
+		},
+		{
+			name: "comments and quotes",
+			data: "- path: a.png # the hero image\n  notes: \"red # blue\" # colours\n  page_title: 'Men''s #1'\n  product_name: Men's shoes#2\n",
+			want: []manifestRow{{values: map[string]string{
+				"path": "a.png", "notes": "red # blue", "page_title": "Men's #1", "product_name": "Men's shoes#2",
+			}, line: 1}},
+		},
+		{
+			name: "escaped quotes",
+			data: "- path: a.png\n  notes: \"a \\\"quoted\\\" word # kept\\\\\" # dropped\n",
+			want: []manifestRow{{values: map[string]string{"path": "a.png", "notes": `a "quoted" word # kept\`}, line: 1}},
+		},
+		{
+			name: "unknown keys are kept as context",
+			data: "- path: a.png\n  Brand Colour: teal\n",
+			want: []manifestRow{{values: map[string]string{"path": "a.png", "brand_colour": "teal"}, line: 1}},
+		},
+		{name: "empty", data: "# nothing yet\n"},
+		{name: "tab indent", data: "- path: a.png\n\tnotes: x\n", err: "line 2: indent with spaces, not tabs"},
+		{name: "items out of line", data: "- path: a.png\n   - path: b.png\n", err: "line 2: list items must line up"},
+		{name: "not a list", data: "path: a.png\n", err: "line 1: expected a list of images"},
+		{name: "key outside item", data: "  - path: a.png\n  notes: x\n", err: "line 2: expected a list of images"},
+		{name: "no colon", data: "- path a.png\n", err: "line 1: expected key: value"},
+		{name: "duplicate key", data: "- path: a.png\n  Notes: x\n  notes: y\n", err: "line 3: notes is set twice"},
+		{name: "bad scalar", data: "- path: a.png\n  notes: [a, b]\n", err: "line 2: nested values are not supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := parseManifestYAML(tt.data)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("parseManifestYAML err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Errorf("parseManifestYAML = %v, want %v", rows, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripYAMLComment(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"# whole line", ""},
+		{"- path: a.png # trailing", "- path: a.png "},
+		{"  notes: x\t# after a tab", "  notes: x\t"},
+		{"notes: issue#4", "notes: issue#4"},
+		{`notes: "a # b"`, `notes: "a # b"`},
+		{`notes: "a # b" # c`, `notes: "a # b" `},
+		{`notes: 'a # b' # c`, `notes: 'a # b' `},
+		{`notes: "say \"#1\" # now" # c`, `notes: "say \"#1\" # now" `},
+		{`notes: 'it''s # one' # c`, `notes: 'it''s # one' `},
+		{"notes: Men's # shoes", "notes: Men's "},
+	}
+	for _, tt := range tests {
+		if got := stripYAMLComment(tt.line); got != tt.want {
+			t.Errorf("stripYAMLComment(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseYAMLScalar(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  string
+	}{
+		{"", "", ""},
+		{"~", "", ""},
+		{"null", "", ""},
+		{"plain text", "plain text", ""},
+		{`"tab\there"`, "tab\there", ""},
+		{`"a \"b\""`, `a "b"`, ""},
+		{`'it''s'`, "it's", ""},
+		{`''`, "", ""},
+		{`"open`, "", "invalid double-quoted string"},
+		{`'open`, "", "unterminated string"},
+		{`'`, "", "unterminated string"},
+		{"|", "", "block scalars are not supported"},
+		{">-", "", "block scalars are not supported"},
+		{"{a: b}", "", "nested values are not supported"},
+	}
+	for _, tt := range tests {
+		got, err := parseYAMLScalar(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseYAMLScalar(%q) err = %v, want %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseYAMLScalar(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseManifestCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []manifestRow
+		err  string
+	}{
+		{
+			name: "valid",
+			data: "\ufeffPath,Product Name,notes\nshoes.jpg, Trail shoe ,\n,,\nhat.jpg\n",
+			want: []manifestRow{
+				{values: map[string]string{"path": "shoes.jpg", "product_name": "Trail shoe"}, line: 2},
+				{values: map[string]string{"path": "hat.jpg"}, line: 4},
+			},
+		},
+		{
+			name: "quoted fields",
+			data: "path,notes\n\"a, b.png\",\"say \"\"hi\"\"\"\n",
+			want: []manifestRow{{values: map[string]string{"path": "a, b.png", "notes": `say "hi"`}, line: 2}},
+		},
+		{name: "empty", data: ""},
+		{name: "header only", data: "path,notes\n"},
+		{name: "too many fields", data: "path,notes\na.png,x\nb.png,y,z\n", err: "line 3: 3 fields but only 2 columns"},
+		{name: "bad quoting in header", data: "path,\"notes\n", err: "extraneous or missing \" in quoted-field"},
+		{name: "bad quoting in row", data: "path\na\"b.png\n", err: "bare \" in non-quoted-field"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := parseManifestCSV(strings.NewReader(tt.data))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("parseManifestCSV err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Errorf("parseManifestCSV = %v, want %v", rows, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	path := write("images.yaml", "- image: https://example.com/a.png\n  path: shoes.jpg\n  page_title: Shoes\n- url: https://example.com/b.png\n")
+	entries, err := readManifest(path, map[string]string{"page_title": "Shop", "notes": "Summer range"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("readManifest = %d entries, want 2", len(entries))
+	}
+	if want := filepath.Join(dir, "shoes.jpg"); entries[0].Path != want {
+		t.Errorf("path = %q, want %q", entries[0].Path, want)
+	}
+	if c := entries[0].Context; c.PageTitle != "Shoes" || c.Notes != "Summer range" {
+		t.Errorf("context = %+v, want the entry's title over the default", c)
+	}
+	if entries[1].Path != "https://example.com/b.png" || entries[1].Context.PageTitle != "Shop" {
+		t.Errorf("entry = %+v", entries[1])
+	}
+
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"images.txt", "a.png\n", "manifest must be a .csv, .yaml, or .yml file"},
+		{"bad.csv", "path,notes\na.png,x,y\n", "bad.csv: line 2: 3 fields but only 2 columns"},
+		{"noimage.yml", "- notes: x\n", "noimage.yml: line 1: no image path or URL"},
+		{"unnamed.csv", "path,\na.png,x\n", "unnamed.csv: line 2: context value \"x\" has no name"},
+		{"none.csv", "path\n", "none.csv: no images listed"},
+	}
+	for _, tt := range tests {
+		if _, err := readManifest(write(tt.name, tt.data), nil); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("readManifest(%s) err = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
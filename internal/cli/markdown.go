@@ -0,0 +1,226 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// inlineImage matches ![alt](src "title"); group 1 is the alt text and group 2 the source
+	inlineImage = regexp.MustCompile(`!\[([^\]]*)\]\(\s*(<[^>]*>|[^\s)]+)(?:\s+(?:"[^"]*"|'[^']*'|\([^)]*\)))?\s*\)`)
+	// referenceImage matches ![alt][label]
+	referenceImage = regexp.MustCompile(`!\[([^\]]*)\]\[([^\]]+)\]`)
+	// linkDefinition matches a [label]: src line
+	linkDefinition = regexp.MustCompile(`(?m)^ {0,3}\[([^\]]+)\]:\s*(<[^>]*>|\S+)`)
+	// codeFence matches the opening or closing line of a fenced code block
+	codeFence = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+)
+
+// Markdown implements "alt-text-generator markdown <file|dir|pattern>...": it
+// finds images without alt text in Markdown and MDX files, captions them,
+// and writes the alt text in, leaving the rest of each file untouched
+func Markdown(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("markdown", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	providerName := flags.String("provider", "", "provider to use: anthropic or openai (defaults to the only one configured)")
+	promptFlags(flags)
+	recursive := flags.Bool("recursive", false, "descend into subdirectories")
+	root := flags.String("root", ".", "docs root that absolute image paths such as /img/a.png resolve against")
+	diff := flags.Bool("diff", false, "print the changes as a unified diff instead of rewriting the files")
+	concurrency := flags.Int("concurrency", 4, "number of images to caption in parallel")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator markdown [flags] <file|dir|pattern>...")
+		flags.PrintDefaults()
+	}
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	roots, err := expandGlobs(args)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	paths, err := findFiles(roots, *recursive, parseExtensions("md,mdx,markdown"), nil)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+
+	return rewriteDocuments(paths, *providerName, *concurrency, *diff, stdout, stderr, func(path string, data []byte) []altEdit {
+		edits, skipped := findMarkdownImages(data, filepath.Dir(path), *root)
+		for _, skip := range skipped {
+			fmt.Fprintf(stderr, "%s: skipping %s\n", path, skip.Reason)
+		}
+		return edits
+	})
+}
+
+// findMarkdownImages returns an edit for every inline or reference-style
+// image with empty alt text, plus any raw <img> tags missing alt, outside
+// code blocks and code spans. It also returns why any were skipped.
+func findMarkdownImages(data []byte, dir, root string) ([]altEdit, []skippedImage) {
+	text := string(data)
+	code := codeRanges(text)
+	var edits []altEdit
+	var skipped []skippedImage
+
+	add := func(start, end int, src string) {
+		if inRanges(code, start) {
+			return
+		}
+		src = strings.TrimSuffix(strings.TrimPrefix(src, "<"), ">")
+		image, err := resolveImagePath(src, dir, root)
+		if err != nil {
+			skipped = append(skipped, skippedImage{start, err.Error()})
+			return
+		}
+		edits = append(edits, altEdit{Start: start, End: end, Image: image, Replace: escapeMarkdownAlt})
+	}
+
+	// Raw HTML is scanned with code and Markdown images blanked out, so
+	// neither is mistaken for a tag while offsets stay the same
+	masked := []byte(text)
+	blank := func(start, end int) {
+		for i := start; i < end; i++ {
+			if masked[i] != '\n' {
+				masked[i] = ' '
+			}
+		}
+	}
+	for _, r := range code {
+		blank(r[0], r[1])
+	}
+
+	for _, m := range inlineImage.FindAllStringSubmatchIndex(text, -1) {
+		blank(m[0], m[1])
+		if strings.TrimSpace(text[m[2]:m[3]]) == "" {
+			add(m[2], m[3], text[m[4]:m[5]])
+		}
+	}
+
+	definitions := map[string]string{}
+	for _, m := range linkDefinition.FindAllStringSubmatch(text, -1) {
+		label := strings.ToLower(strings.TrimSpace(m[1]))
+		if _, ok := definitions[label]; !ok {
+			definitions[label] = m[2]
+		}
+	}
+	for _, m := range referenceImage.FindAllStringSubmatchIndex(text, -1) {
+		blank(m[0], m[1])
+		if strings.TrimSpace(text[m[2]:m[3]]) != "" {
+			continue
+		}
+		label := strings.ToLower(strings.TrimSpace(text[m[4]:m[5]]))
+		if src, ok := definitions[label]; ok {
+			add(m[2], m[3], src)
+		} else if !inRanges(code, m[0]) {
+			skipped = append(skipped, skippedImage{m[0], fmt.Sprintf("image with undefined reference [%s]", label)})
+		}
+	}
+
+	// MDX and Markdown both allow raw HTML images
+	htmlEdits, htmlSkipped := findHTMLImages(masked, dir, root, true)
+	edits = append(edits, htmlEdits...)
+	skipped = append(skipped, htmlSkipped...)
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].Start < edits[j].Start })
+	return edits, skipped
+}
+
+// escapeMarkdownAlt escapes characters that would end or break the alt text,
+// or start raw HTML or a character reference in it
+var escapeMarkdownAlt = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, "<", `\<`, "&", `\&`).Replace
+
+// markdownImage returns ![alt](src), with src as a forward-slashed path in
+// angle brackets when it has spaces or parentheses
+func markdownImage(alt, src string) string {
+	src = filepath.ToSlash(src)
+	if strings.ContainsAny(src, " ()<>") {
+		src = "<" + strings.NewReplacer("<", "%3C", ">", "%3E").Replace(src) + ">"
+	}
+	alt = strings.Join(strings.Fields(alt), " ")
+	return "![" + escapeMarkdownAlt(alt) + "](" + src + ")"
+}
+
+// codeRanges returns the byte ranges of fenced code blocks and inline code
+// spans, where image syntax is literal text
+func codeRanges(text string) [][2]int {
+	var ranges [][2]int
+	offset := 0
+	fence := ""
+	fenceStart := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		m := codeFence.FindStringSubmatch(line)
+		switch {
+		case fence == "" && m != nil:
+			fence, fenceStart = m[1], offset
+		case fence != "" && m != nil && m[1][0] == fence[0] && len(m[1]) >= len(fence):
+			ranges = append(ranges, [2]int{fenceStart, offset + len(line)})
+			fence = ""
+		case fence == "":
+			ranges = append(ranges, codeSpans(line, offset)...)
+		}
+		offset += len(line)
+	}
+	if fence != "" {
+		ranges = append(ranges, [2]int{fenceStart, len(text)})
+	}
+	return ranges
+}
+
+// codeSpans finds `code` spans in a line, where a span closes at the next
+// run of the same number of backticks
+func codeSpans(line string, offset int) [][2]int {
+	var spans [][2]int
+	for i := 0; i < len(line); {
+		if line[i] != '`' {
+			i++
+			continue
+		}
+		start := i
+		for i < len(line) && line[i] == '`' {
+			i++
+		}
+		run := line[start:i]
+		for j := i; j < len(line); {
+			k := strings.Index(line[j:], run)
+			if k < 0 {
+				break
+			}
+			k += j
+			end := k + len(run)
+			if end < len(line) && line[end] == '`' || k > 0 && line[k-1] == '`' {
+				// Part of a longer run; keep looking
+				for end < len(line) && line[end] == '`' {
+					end++
+				}
+				j = end
+				continue
+			}
+			spans = append(spans, [2]int{offset + start, offset + end})
+			i = end
+			break
+		}
+	}
+	return spans
+}
+
+func inRanges(ranges [][2]int, pos int) bool {
+	for _, r := range ranges {
+		if pos >= r[0] && pos < r[1] {
+			return true
+		}
+	}
+	return false
+}
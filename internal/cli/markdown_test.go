@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// markdownEscape matches a backslash escape of ASCII punctuation
+var markdownEscape = regexp.MustCompile("\\\\([!-/:-@\\[-`{-~])")
+
+func TestRewriteMarkdown(t *testing.T) {
+	input, err := os.ReadFile("testdata/markdown/doc.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "images"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"kept", "cat", "dog", "divider"} {
+		writePNG(t, filepath.Join(dir, "images"), name+".png", name)
+	}
+	writePNG(t, dir, "logo.png", "logo")
+
+	edits, skipped := findMarkdownImages(input, dir, dir)
+	var reasons []string
+	for _, skip := range skipped {
+		reasons = append(reasons, skip.Reason)
+	}
+	want := []string{"remote image https://example.com/remote.png", "image with undefined reference [nowhere]"}
+	if strings.Join(reasons, "\n") != strings.Join(want, "\n") {
+		t.Errorf("skipped %q, want %q", reasons, want)
+	}
+
+	out, applied := applyEdits(input, edits, captioned(t, edits))
+	if applied != 4 {
+		t.Errorf("applied %d edits, want 4", applied)
+	}
+	checkGolden(t, "testdata/markdown/doc.golden.md", out)
+
+	// Nothing is left to fill in, and the alt text reads back unescaped
+	if edits, _ := findMarkdownImages(out, dir, dir); len(edits) != 0 {
+		t.Errorf("rewritten file still has %d images to caption", len(edits))
+	}
+	alts := map[string]string{}
+	for _, m := range inlineImage.FindAllStringSubmatch(string(out), -1) {
+		if m[1] == "" {
+			// Examples in code
+			continue
+		}
+		alts[filepath.Base(strings.Trim(m[2], "<>"))] = markdownEscape.ReplaceAllString(m[1], "$1")
+	}
+	for _, m := range referenceImage.FindAllStringSubmatch(string(out), -1) {
+		alts[strings.ToLower(m[2])+".png"] = markdownEscape.ReplaceAllString(m[1], "$1")
+	}
+	for name, alt := range testAlts {
+		if alts[name] != alt {
+			t.Errorf("%s alt = %q, want %q", name, alts[name], alt)
+		}
+	}
+	if alts["kept.png"] != "A lighthouse at dusk" {
+		t.Errorf("existing alt = %q", alts["kept.png"])
+	}
+}
+
+func TestMarkdownImage(t *testing.T) {
+	tests := []struct {
+		alt  string
+		src  string
+		want string
+	}{
+		{"A cat", "images/cat.png", "![A cat](images/cat.png)"},
+		{"A [boxed]\n  cat\\dog", "a.png", `![A \[boxed\] cat\\dog](a.png)`},
+		{`Tom & "Jerry" <chase>`, "a.png", `![Tom \& "Jerry" \<chase>](a.png)`},
+		{"Photo", "my photos/a (1).png", "![Photo](<my photos/a (1).png>)"},
+		{"Photo", "odd <name>.png", "![Photo](<odd %3Cname%3E.png>)"},
+	}
+	for _, tt := range tests {
+		if got := markdownImage(tt.alt, tt.src); got != tt.want {
+			t.Errorf("markdownImage(%q, %q) = %q, want %q", tt.alt, tt.src, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package cli
+
+import (
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// officePicture matches a picture in a Word part (a drawing anchored in
+	// the text) or a PowerPoint slide (a picture shape)
+	officePicture = regexp.MustCompile(`(?s)<w:drawing\b.*?</w:drawing>|<p:pic\b.*?</p:pic>`)
+	// officeDescriptor matches the element carrying a picture's name and
+	// alt text in its descr attribute
+	officeDescriptor = regexp.MustCompile(`<(?:wp:docPr|p:cNvPr)\b[^>]*>`)
+	officeBlip       = regexp.MustCompile(`<a:blip\b[^>]*>`)
+	// officeDecorative matches Office's "Mark as decorative" extension
+	officeDecorative = regexp.MustCompile(`<adec:decorative\b[^>]*\bval="(?:1|true)"`)
+	// placeholderAlt matches alt text that describes nothing: a file name, or
+	// the caption Office generates itself
+	placeholderAlt = regexp.MustCompile(`(?i)^[\w\s.-]+\.(?:png|jpe?g|gif|bmp|tiff?|webp|emf|wmf|svg)$|description automatically generated`)
+)
+
+// Office implements "alt-text-generator office <file.docx|file.pptx>...": it
+// finds pictures without descriptive alt text in Word and PowerPoint files,
+// captions them, and writes a copy with the alt text in each picture's
+// description
+func Office(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("office", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	providerName := flags.String("provider", "", "provider to use: anthropic or openai (defaults to the only one configured)")
+	promptFlags(flags)
+	output := flags.String("output", "", "where to write the updated document (defaults to <name>.accessible.docx or .pptx; only with a single document)")
+	diff := flags.Bool("diff", false, "print the changes as a unified diff instead of writing a new document")
+	concurrency := flags.Int("concurrency", 4, "number of images to caption in parallel")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator office [flags] <file.docx|file.pptx|pattern>...")
+		flags.PrintDefaults()
+	}
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	documents, err := expandGlobs(args)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	for _, document := range documents {
+		if ext := strings.ToLower(filepath.Ext(document)); ext != ".docx" && ext != ".pptx" {
+			fmt.Fprintf(stderr, "Error: %s is not a .docx or .pptx file\n", document)
+			return exitUsage
+		}
+	}
+	if *output != "" && len(documents) > 1 {
+		fmt.Fprintln(stderr, "Error: -output can only be used with a single document")
+		return exitUsage
+	}
+
+	if err := setup(); err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	provider, err := selectProvider(*providerName)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitUsage
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	status := exitOK
+	for _, document := range documents {
+		out := *output
+		if out == "" {
+			ext := filepath.Ext(document)
+			out = strings.TrimSuffix(document, ext) + ".accessible" + ext
+		}
+		ok, err := remediateArchive(ctx, provider, officeFormat, document, out, *concurrency, *diff, stdout, stderr)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", document, err)
+		}
+		if err != nil || !ok {
+			status = exitError
+		}
+	}
+	return status
+}
+
+// officeFormat finds pictures without descriptive alt text in the XML parts
+// of an Office Open XML package
+var officeFormat = archiveFormat{find: findOfficeImages}
+
+// findOfficeImages returns an edit setting the descr attribute of every
+// picture in an XML part whose alt text is missing or a placeholder.
+// Pictures marked decorative are left alone. Each picture's image is found
+// through the part's relationships file.
+func findOfficeImages(dir, name string, data []byte) ([]altEdit, []skippedImage) {
+	if path.Ext(name) != ".xml" || strings.Contains(name, "_rels/") {
+		return nil, nil
+	}
+	var rels map[string]officeRelationship
+	var edits []altEdit
+	var skipped []skippedImage
+	for _, picture := range officePicture.FindAllIndex(data, -1) {
+		markup := data[picture[0]:picture[1]]
+		loc := officeDescriptor.FindIndex(markup)
+		if loc == nil || officeDecorative.Match(markup) {
+			continue
+		}
+		tag := string(markup[loc[0]:loc[1]])
+		attrs := parseTagAttrs(tag)
+		descr, hasDescr := attrs.get("descr")
+		if alt := strings.TrimSpace(html.UnescapeString(descr.value)); alt != "" && !placeholderAlt.MatchString(alt) {
+			continue
+		}
+
+		label := "picture"
+		if pictureName, ok := attrs.get("name"); ok {
+			label = fmt.Sprintf("picture %q", html.UnescapeString(pictureName.value))
+		}
+		blip := officeBlip.Find(markup)
+		if blip == nil {
+			skipped = append(skipped, skippedImage{picture[0], label + " without an image"})
+			continue
+		}
+		embed, ok := parseTagAttrs(string(blip)).get("r:embed")
+		if !ok {
+			skipped = append(skipped, skippedImage{picture[0], label + " with a linked image"})
+			continue
+		}
+		if rels == nil {
+			rels = readRelationships(dir, name)
+		}
+		rel, ok := rels[embed.value]
+		if !ok || rel.TargetMode == "External" {
+			skipped = append(skipped, skippedImage{picture[0], label + " with a linked image"})
+			continue
+		}
+		target := path.Join(path.Dir(name), rel.Target)
+		if strings.HasPrefix(rel.Target, "/") {
+			target = path.Clean(strings.TrimPrefix(rel.Target, "/"))
+		}
+		image := filepath.Join(dir, filepath.FromSlash(target))
+		if _, err := os.Stat(image); err != nil {
+			skipped = append(skipped, skippedImage{picture[0], fmt.Sprintf("%s with missing image %s", label, target)})
+			continue
+		}
+
+		edit := altEdit{Start: picture[0] + loc[0], End: picture[0] + loc[1], Image: image}
+		if hasDescr {
+			edit.Replace = func(text string) string {
+				return tag[:descr.start] + `descr="` + escapeAttr(text) + `"` + tag[descr.end:]
+			}
+		} else {
+			// Insert right after the element name, leaving the rest untouched
+			nameEnd := strings.IndexAny(tag, " \t\r\n/>")
+			edit.Replace = func(text string) string {
+				return tag[:nameEnd] + ` descr="` + escapeAttr(text) + `"` + tag[nameEnd:]
+			}
+		}
+		edits = append(edits, edit)
+	}
+	return edits, skipped
+}
+
+// officeRelationship is an entry in a part's relationships file
+type officeRelationship struct {
+	ID         string `xml:"Id,attr"`
+	Target     string `xml:"Target,attr"`
+	TargetMode string `xml:"TargetMode,attr"`
+}
+
+// readRelationships loads the relationships of the named part, such as
+// word/_rels/document.xml.rels for word/document.xml, keyed by ID
+func readRelationships(dir, name string) map[string]officeRelationship {
+	rels := map[string]officeRelationship{}
+	relsName := path.Join(path.Dir(name), "_rels", path.Base(name)+".rels")
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(relsName)))
+	if err != nil {
+		return rels
+	}
+	var parsed struct {
+		Relationships []officeRelationship `xml:"Relationship"`
+	}
+	if xml.Unmarshal(data, &parsed) == nil {
+		for _, rel := range parsed.Relationships {
+			rels[rel.ID] = rel
+		}
+	}
+	return rels
+}
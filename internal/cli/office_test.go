@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRemediateOffice(t *testing.T) {
+	tests := []struct {
+		name     string
+		images   []string
+		part     string
+		golden   string
+		complete bool
+		stderr   []string
+		// remaining is how many pictures can't be given alt text
+		remaining int
+	}{
+		{
+			name:     "report.docx",
+			images:   []string{"word/media/kept.png", "word/media/cat.png", "word/media/dog.png", "word/media/divider.png"},
+			part:     "word/document.xml",
+			golden:   "testdata/office/document.golden.xml",
+			complete: true,
+			stderr:   []string{"added alt text for 2 images"},
+		},
+		{
+			name:      "deck.pptx",
+			images:    []string{"ppt/media/logo.png"},
+			part:      "ppt/slides/slide1.xml",
+			golden:    "testdata/office/slide1.golden.xml",
+			stderr:    []string{`ppt/slides/slide1.xml: skipping picture "Remote" with a linked image`, "added alt text for 1 images"},
+			remaining: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := filepath.Join("testdata/office", strings.TrimPrefix(filepath.Ext(tt.name), "."))
+			document := packArchive(t, src, tt.images, tt.name)
+			out := filepath.Join(t.TempDir(), "accessible"+filepath.Ext(tt.name))
+
+			var stdout, stderr bytes.Buffer
+			ok, err := remediateArchive(context.Background(), testProvider, officeFormat, document, out, 2, false, &stdout, &stderr)
+			if err != nil || ok != tt.complete {
+				t.Fatalf("remediateArchive = %v, %v, want %v: %s", ok, err, tt.complete, stderr.String())
+			}
+			for _, want := range tt.stderr {
+				if !strings.Contains(stderr.String(), want) {
+					t.Errorf("stderr = %q, want %q", stderr.String(), want)
+				}
+			}
+
+			files, entries := unpackArchive(t, out)
+			original, originalEntries := unpackArchive(t, document)
+			if len(files) != len(original) {
+				t.Errorf("%d entries, want %d", len(files), len(original))
+			}
+			for i, f := range files {
+				if f.Name != original[i].Name {
+					t.Errorf("entry %d = %s, want %s", i, f.Name, original[i].Name)
+				}
+				if f.Name != tt.part && !bytes.Equal(entries[f.Name], originalEntries[f.Name]) {
+					t.Errorf("%s changed", f.Name)
+				}
+			}
+			checkGolden(t, tt.golden, entries[tt.part])
+			checkXML(t, tt.part, entries[tt.part])
+
+			// The rewritten part has nothing left to caption
+			edits, skipped := findOfficeImages(filepath.Dir(out), tt.part, entries[tt.part])
+			if len(edits)+len(skipped) != tt.remaining {
+				t.Errorf("rewritten %s still has %d pictures without alt text, want %d", tt.part, len(edits)+len(skipped), tt.remaining)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package cli
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/ratelimit"
+)
+
+// captionAll captions paths with up to concurrency workers and passes each
+// result to emit in input order, so reports read the same however the calls
+// interleave. contexts, if not nil, holds the image context for each path.
+// Images repeated within the run, or already recorded in state, are
+// captioned once. It stops early if ctx is cancelled or emit fails.
+func captionAll(ctx context.Context, provider api.Provider, paths []string, contexts []api.ImageContext, concurrency int, bar *progress, state *checkpoint, emit func(batchResult) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type indexed struct {
+		index  int
+		result batchResult
+	}
+	seen := &dedupe{calls: map[string]*dedupeCall{}}
+	indexes := make(chan int)
+	results := make(chan indexed)
+
+	var wg sync.WaitGroup
+	for i := 0; i < max(concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				bar.Start(paths[index])
+				imageCtx := ctx
+				if contexts != nil {
+					imageCtx = api.WithImageContext(ctx, contexts[index])
+				}
+				result := captionFile(imageCtx, provider, paths[index], seen, state)
+				bar.Done()
+				results <- indexed{index, result}
+			}
+		}()
+	}
+	go func() {
+		defer close(indexes)
+		for i := range paths {
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Hold results that finish early until everything before them is emitted
+	pending := map[int]batchResult{}
+	next := 0
+	var emitErr error
+	for r := range results {
+		if emitErr != nil {
+			continue
+		}
+		pending[r.index] = r.result
+		for {
+			result, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if emitErr = emit(result); emitErr != nil {
+				cancel()
+				break
+			}
+		}
+	}
+	return emitErr
+}
+
+// paceProvider returns provider with its calls limited to perMinute across
+// every worker, so a large batch stays under the provider's rate limit
+func paceProvider(provider api.Provider, perMinute, burst int) api.Provider {
+	limiter := ratelimit.New(perMinute, burst, false)
+	wait := func(ctx context.Context) error {
+		for {
+			allowed, _, delay := limiter.Allow(provider.Name)
+			if allowed {
+				return nil
+			}
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	generate := provider.Generate
+	provider.Generate = func(ctx context.Context, image []byte) (api.Result, error) {
+		if err := wait(ctx); err != nil {
+			return api.Result{}, err
+		}
+		return generate(ctx, image)
+	}
+	return provider
+}
+
+// dedupe shares one provider call among images with identical content
+type dedupe struct {
+	mu    sync.Mutex
+	calls map[string]*dedupeCall
+}
+
+// dedupeKey identifies an image by its content hash and any context it is
+// captioned with, since the same picture of two products needs two captions
+func dedupeKey(hash string, c api.ImageContext) string {
+	if c.IsZero() {
+		return hash
+	}
+	return hash + " " + c.Key()
+}
+
+type dedupeCall struct {
+	done   chan struct{}
+	result api.Result
+	err    error
+}
+
+// do runs fn for the first image with hash and hands its outcome to later
+// ones, reporting them as duplicates with no tokens spent
+func (d *dedupe) do(hash string, fn func() (api.Result, error)) (api.Result, error, bool) {
+	d.mu.Lock()
+	if call, ok := d.calls[hash]; ok {
+		d.mu.Unlock()
+		<-call.done
+		result := call.result
+		result.InputTokens, result.OutputTokens = 0, 0
+		return result, call.err, true
+	}
+	call := &dedupeCall{done: make(chan struct{})}
+	d.calls[hash] = call
+	d.mu.Unlock()
+
+	call.result, call.err = fn()
+	close(call.done)
+	return call.result, call.err, false
+}
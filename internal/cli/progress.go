@@ -0,0 +1,154 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"alt-text-generator/internal/api"
+)
+
+// progressWidth is the number of cells in the progress bar
+const progressWidth = 30
+
+// progress draws a single-line progress bar on a terminal and keeps the
+// tallies for the end-of-run summary. A nil *progress draws nothing.
+type progress struct {
+	w       io.Writer
+	total   int
+	started time.Time
+
+	mu       sync.Mutex
+	done     int
+	current  string
+	lastDraw time.Time
+}
+
+func newProgress(w io.Writer, total int) *progress {
+	return &progress{w: w, total: total, started: time.Now()}
+}
+
+// isTerminal reports whether f is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Start notes the file a worker has begun on
+func (p *progress) Start(path string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = path
+	p.draw(false)
+}
+
+// Done counts a finished image
+func (p *progress) Done() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.draw(p.done == p.total)
+}
+
+// Finish clears the bar so the summary starts on a clean line
+func (p *progress) Finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprint(p.w, "\r\033[K")
+}
+
+// draw redraws the bar, at most ten times a second unless forced; p.mu must be held
+func (p *progress) draw(force bool) {
+	now := time.Now()
+	if !force && now.Sub(p.lastDraw) < 100*time.Millisecond {
+		return
+	}
+	p.lastDraw = now
+
+	filled := progressWidth * p.done / max(p.total, 1)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressWidth-filled)
+	eta := "--"
+	if p.done > 0 {
+		remaining := time.Duration(float64(now.Sub(p.started)) / float64(p.done) * float64(p.total-p.done))
+		eta = remaining.Round(time.Second).String()
+	}
+	current := p.current
+	if len(current) > 40 {
+		current = "..." + current[len(current)-37:]
+	}
+	fmt.Fprintf(p.w, "\r\033[K[%s] %d/%d ETA %s %s", bar, p.done, p.total, eta, current)
+}
+
+// summary tallies a batch run for the report printed when it ends
+type summary struct {
+	Succeeded  int
+	Failed     int
+	Duplicates int
+	Resumed    int // captioned by an earlier run recorded in the state file
+	Existing   int // skipped because a sidecar already exists
+	// BelowThreshold counts alt text failing the quality thresholds, whatever
+	// its other category
+	BelowThreshold int
+	// NeedsReview counts alt text held for review for its low confidence
+	NeedsReview  int
+	InputTokens  int
+	OutputTokens int
+	Cost         float64
+}
+
+// Add counts one result
+func (s *summary) Add(provider api.Provider, result batchResult) {
+	switch {
+	case result.Resumed:
+		s.Resumed++
+	case result.Duplicate:
+		s.Duplicates++
+	case result.Err != nil:
+		s.Failed++
+	default:
+		s.Succeeded++
+	}
+	if len(result.Violations) > 0 {
+		s.BelowThreshold++
+	}
+	if result.NeedsReview {
+		s.NeedsReview++
+	}
+	s.InputTokens += result.Result.InputTokens
+	s.OutputTokens += result.Result.OutputTokens
+	s.Cost += provider.Cost(result.Result)
+}
+
+// Write prints the summary
+func (s *summary) Write(w io.Writer, elapsed time.Duration) {
+	fmt.Fprintf(w, "Processed %d images in %s\n", s.Succeeded+s.Failed+s.Duplicates+s.Resumed, elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "  Succeeded:          %d\n", s.Succeeded)
+	fmt.Fprintf(w, "  Failed:             %d\n", s.Failed)
+	fmt.Fprintf(w, "  Skipped duplicates: %d\n", s.Duplicates)
+	if s.Resumed > 0 {
+		fmt.Fprintf(w, "  Resumed from state: %d\n", s.Resumed)
+	}
+	if s.BelowThreshold > 0 {
+		fmt.Fprintf(w, "  Below threshold:    %d\n", s.BelowThreshold)
+	}
+	if s.NeedsReview > 0 {
+		fmt.Fprintf(w, "  Needs review:       %d\n", s.NeedsReview)
+	}
+	if s.Existing > 0 {
+		fmt.Fprintf(w, "  Already captioned:  %d\n", s.Existing)
+	}
+	fmt.Fprintf(w, "  Tokens:             %d input, %d output\n", s.InputTokens, s.OutputTokens)
+	fmt.Fprintf(w, "  Estimated cost:     $%.4f\n", s.Cost)
+}
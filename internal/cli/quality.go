@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+
+	"alt-text-generator/internal/quality"
+)
+
+// thresholdFlags adds the quality threshold flags shared by batch and check,
+// -grade, which has the model rate its own alt text for the quality score,
+// and -disable-rule, which turns lint rules off
+func thresholdFlags(flags *flag.FlagSet) *quality.Thresholds {
+	var t quality.Thresholds
+	flags.IntVar(&t.MinLength, "min-length", 0, "fail alt text shorter than this many characters")
+	flags.IntVar(&t.MaxLength, "max-length", 0, "fail alt text longer than this many characters")
+	flags.Func("ban", "fail alt text containing this phrase (comma-separated or repeated)", func(s string) error {
+		for _, phrase := range strings.Split(s, ",") {
+			if phrase = strings.TrimSpace(phrase); phrase != "" {
+				t.Banned = append(t.Banned, phrase)
+			}
+		}
+		return nil
+	})
+	flags.IntVar(&t.MinScore, "min-score", 0, "fail alt text whose quality score (0-100) is below this")
+	flags.BoolVar(&t.Lint, "lint", false, "fail alt text that breaks an enabled lint rule")
+	var disabled []string
+	flags.Func("disable-rule", "turn off a lint rule (comma-separated or repeated): "+strings.Join(quality.RuleNames(), ", "), func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if err := quality.CheckRules([]string{name}); err != nil {
+					return err
+				}
+				disabled = append(disabled, name)
+			}
+		}
+		return os.Setenv("ALT_TEXT_LINT_DISABLE", strings.Join(disabled, ","))
+	})
+	flags.BoolFunc("grade", "also have the model rate the alt text, averaging its rating into the quality score (one extra request per image)", func(s string) error {
+		if _, err := strconv.ParseBool(s); err != nil {
+			return err
+		}
+		return os.Setenv("ALT_TEXT_GRADER", s)
+	})
+	return &t
+}
+
+// checkConfidence marks result for review if its confidence is below below,
+// which is off when 0
+func checkConfidence(below int, result *batchResult) {
+	result.NeedsReview = below > 0 && result.Err == nil && result.Result.Confidence < below
+}
+
+// checkThresholds records in result how its alt text falls short of t. The
+// first option is judged, since it is the one written into documents.
+func checkThresholds(t *quality.Thresholds, result *batchResult) {
+	if t.Enabled() && result.Err == nil {
+		result.Violations = t.Check(bestAltText(result.Result.Text), result.Result.Score, result.Result.Lint)
+	}
+}
@@ -0,0 +1,129 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/config"
+	"alt-text-generator/internal/fetch"
+	"alt-text-generator/internal/history"
+	"alt-text-generator/internal/regenerate"
+)
+
+// Regenerate implements "alt-text-generator regenerate": it captions the
+// stored generations made by older models, scored low, or rated down again
+// with the current model, up to a budget, and marks the old ones superseded
+func Regenerate(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("regenerate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	providerName := flags.String("provider", "", "provider to use: anthropic or openai (defaults to the only one configured)")
+	var opts regenerate.Options
+	flags.BoolVar(&opts.OldModels, "old-models", false, "regenerate generations made by another provider or model")
+	flags.IntVar(&opts.Below, "below", 0, "regenerate generations whose quality score (0-100) is below this")
+	flags.BoolVar(&opts.RatedDown, "rated-down", false, "regenerate generations given a thumbs-down as feedback")
+	flags.Float64Var(&opts.Budget, "budget", 0, "stop once this much, in USD at the model's list prices, has been spent (required)")
+	flags.IntVar(&opts.Limit, "limit", 0, "call the provider at most this many times (0 for no limit)")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "list the generations that would be regenerated, without calling the provider")
+	since := flags.String("since", "", "only generations made at or after this RFC 3339 timestamp or date")
+	until := flags.String("until", "", "only generations made before this RFC 3339 timestamp or date")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator regenerate [-old-models] [-below N] [-rated-down] -budget USD [flags]")
+		fmt.Fprintln(stderr, "Regenerates from the history database named by history.database or HISTORY_DB, with the images in object storage.")
+		flags.PrintDefaults()
+	}
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(args) > 0 {
+		fmt.Fprintln(stderr, "Error: regenerate takes no arguments")
+		return exitUsage
+	}
+	for _, t := range []struct {
+		flag  string
+		value string
+		dest  *time.Time
+	}{{"since", *since, &opts.Since}, {"until", *until, &opts.Until}} {
+		if t.value == "" {
+			continue
+		}
+		if *t.dest, err = parseTime(t.value); err != nil {
+			fmt.Fprintf(stderr, "Error: -%s must be an RFC 3339 timestamp or a date such as 2024-05-01\n", t.flag)
+			return exitUsage
+		}
+	}
+	if err := opts.Check(); err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitUsage
+	}
+
+	if err := setup(); err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	provider, err := selectProvider(*providerName)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitUsage
+	}
+	dsn := config.GetString("HISTORY_DB", "")
+	if dsn == "" {
+		fmt.Fprintln(stderr, "Error: no history database is configured; set history.database or HISTORY_DB, or use POST /admin/regenerate on a running server")
+		return exitError
+	}
+	storageURL := config.GetString("OBJECT_STORAGE_URL", "")
+	if storageURL == "" {
+		fmt.Fprintln(stderr, "Error: regenerating needs the original images; set storage.url or OBJECT_STORAGE_URL to the bucket they are kept in")
+		return exitError
+	}
+	bucket, err := fetch.OpenBucket(storageURL, config.GetString("OBJECT_STORAGE_SSE", ""), config.GetString("OBJECT_STORAGE_KMS_KEY", ""))
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	store, err := history.Open(dsn)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	defer store.Close()
+	store.UseObjects(bucket)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	summary, err := regenerate.Run(ctx, store, provider, opts, func(old, new history.Record, err error) {
+		switch {
+		case err != nil:
+			fmt.Fprintf(stdout, "failed       %s %s: %v\n", old.ID, old.Filename, err)
+		case new.ID == "":
+			fmt.Fprintf(stdout, "would redo   %s %s (%s, score %d)\n", old.ID, old.Filename, old.Model, old.Score)
+		default:
+			fmt.Fprintf(stdout, "regenerated  %s -> %s %s: %s\n", old.ID, new.ID, old.Filename, api.FirstOption(new.AltText))
+		}
+	})
+
+	if opts.DryRun {
+		fmt.Fprintf(stderr, "%d generations would be regenerated with %s\n", summary.Candidates, provider.Model)
+	} else {
+		fmt.Fprintf(stderr, "Regenerated %d generations with %s (%d reused, %d without images, %d failed), spending $%.4f\n",
+			summary.Regenerated, provider.Model, summary.Reused, summary.Missing, summary.Failed, summary.Cost)
+		if summary.Stopped != "" {
+			fmt.Fprintf(stderr, "Stopped at the -%s; run again to carry on\n", summary.Stopped)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	if summary.Failed > 0 {
+		return exitError
+	}
+	return exitOK
+}
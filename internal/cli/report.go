@@ -0,0 +1,304 @@
+package cli
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/handlers"
+	"alt-text-generator/internal/history"
+)
+
+// outputFormats lists the report formats batch and crawl can write
+var outputFormats = []string{"text", "jsonl", "json", "csv"}
+
+// batchFormats adds the formats only batch can write to outputFormats
+var batchFormats = append(slices.Clone(outputFormats), "figure", "markdown")
+
+// reportRecord is the machine-readable form of a batchResult
+type reportRecord struct {
+	Path         string `json:"path"`
+	Hash         string `json:"hash,omitempty"`
+	AltText      string `json:"alt_text"`
+	Provider     string `json:"provider"`
+	Model        string `json:"model"`
+	InputTokens  int    `json:"input_tokens"`
+	OutputTokens int    `json:"output_tokens"`
+	Error        string `json:"error,omitempty"`
+	// Description is the long description, when one was asked for
+	Description string `json:"description,omitempty"`
+	// Score rates the first option from 0 to 100
+	Score int `json:"score"`
+	// Confidence estimates from 0 to 100 how likely the first option is to
+	// be accurate
+	Confidence int `json:"confidence"`
+	// Lint lists the lint rules the first option breaks
+	Lint []string `json:"lint,omitempty"`
+	// Caption, Tags, Objects, and DetectedText come from a structured
+	// result, when one was asked for
+	Caption      string   `json:"caption,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Objects      []string `json:"objects,omitempty"`
+	DetectedText string   `json:"detected_text,omitempty"`
+	// Keywords are searchable keywords for the image, when asked for
+	Keywords []string `json:"keywords,omitempty"`
+	// Issues lists what checking a translation, or the alt text improved,
+	// against the image found
+	Issues []string `json:"issues,omitempty"`
+	// MaxChars is the length limit the options were held to, or 0 for none
+	MaxChars int `json:"max_chars,omitempty"`
+	// Violations lists the quality thresholds the alt text failed
+	Violations []string `json:"violations,omitempty"`
+	// NeedsReview is set when the confidence was below the -review-below
+	// threshold
+	NeedsReview bool `json:"needs_review,omitempty"`
+}
+
+var csvHeader = []string{"path", "hash", "alt_text", "provider", "model", "input_tokens", "output_tokens", "error", "violations", "description", "score", "lint", "caption", "tags", "objects", "detected_text", "keywords", "confidence", "needs_review", "issues", "max_chars"}
+
+func newReportRecord(result batchResult) reportRecord {
+	record := reportRecord{
+		Path:         result.Path,
+		Hash:         result.Hash,
+		AltText:      result.Result.Text,
+		Provider:     result.Provider,
+		Model:        result.Model,
+		InputTokens:  result.Result.InputTokens,
+		OutputTokens: result.Result.OutputTokens,
+		Description:  result.Result.Description,
+		Score:        result.Result.Score,
+		Confidence:   result.Result.Confidence,
+		Lint:         result.Result.Lint,
+		Caption:      result.Result.Caption,
+		Tags:         result.Result.Tags,
+		Objects:      result.Result.Objects,
+		DetectedText: result.Result.DetectedText,
+		Keywords:     result.Result.Keywords,
+		Issues:       result.Result.Issues,
+		MaxChars:     result.Result.MaxChars,
+		Violations:   result.Violations,
+		NeedsReview:  result.NeedsReview,
+	}
+	if result.Err != nil {
+		record.Error = result.Err.Error()
+	}
+	return record
+}
+
+// reportWriter writes batch results as they complete. Close finishes the
+// report; it does not close the underlying writer.
+type reportWriter interface {
+	Write(result batchResult) error
+	Close() error
+}
+
+// newReportWriter returns a writer for one of batchFormats
+func newReportWriter(w io.Writer, format string) (reportWriter, error) {
+	switch format {
+	case "text":
+		return &textReport{w: w}, nil
+	case "jsonl":
+		return &jsonlReport{enc: json.NewEncoder(w)}, nil
+	case "json":
+		return &jsonReport{w: w, records: []reportRecord{}}, nil
+	case "csv":
+		cw := csv.NewWriter(w)
+		return &csvReport{w: cw}, cw.Write(csvHeader)
+	case "figure":
+		return &figureReport{w: w}, nil
+	case "markdown":
+		return &markdownReport{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// textReport lists each path with its alt text options, or the error,
+// indented beneath it
+type textReport struct {
+	w io.Writer
+}
+
+func (r *textReport) Write(result batchResult) error {
+	fmt.Fprintln(r.w, result.Path)
+	if result.Err != nil {
+		_, err := fmt.Fprintf(r.w, "  error: %v\n", result.Err)
+		return err
+	}
+	if len(result.Violations) > 0 {
+		fmt.Fprintf(r.w, "  below threshold: %s\n", strings.Join(result.Violations, "; "))
+	}
+	if result.NeedsReview {
+		fmt.Fprintf(r.w, "  needs review: confidence %d\n", result.Result.Confidence)
+	}
+	for _, option := range (history.Record{AltText: result.Result.Text}).Options() {
+		if _, err := fmt.Fprintln(r.w, "  "+option); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(r.w, "  quality score: %d\n", result.Result.Score)
+	fmt.Fprintf(r.w, "  confidence: %d\n", result.Result.Confidence)
+	if len(result.Result.Lint) > 0 {
+		fmt.Fprintf(r.w, "  lint: %s\n", strings.Join(result.Result.Lint, "; "))
+	}
+	for _, detail := range resultDetails(result.Result) {
+		if _, err := fmt.Fprintf(r.w, "  %s: %s\n", strings.ToLower(detail[0]), strings.Join(strings.Fields(detail[1]), " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resultDetails lists the keywords, long description, structured result
+// fields, and translation issues that result has, as label and value pairs
+func resultDetails(result api.Result) [][2]string {
+	var details [][2]string
+	for _, detail := range [][2]string{
+		{"Keywords", strings.Join(result.Keywords, ", ")},
+		{"Long description", result.Description},
+		{"Caption", result.Caption},
+		{"Tags", strings.Join(result.Tags, ", ")},
+		{"Objects", strings.Join(result.Objects, ", ")},
+		{"Text in image", result.DetectedText},
+		{"Issues", strings.Join(result.Issues, "; ")},
+	} {
+		if detail[1] != "" {
+			details = append(details, detail)
+		}
+	}
+	return details
+}
+
+func (r *textReport) Close() error { return nil }
+
+// jsonlReport writes one JSON object per line
+type jsonlReport struct {
+	enc *json.Encoder
+}
+
+func (r *jsonlReport) Write(result batchResult) error {
+	return r.enc.Encode(newReportRecord(result))
+}
+
+func (r *jsonlReport) Close() error { return nil }
+
+// jsonReport collects every record and writes a single array on Close
+type jsonReport struct {
+	w       io.Writer
+	records []reportRecord
+}
+
+func (r *jsonReport) Write(result batchResult) error {
+	r.records = append(r.records, newReportRecord(result))
+	return nil
+}
+
+func (r *jsonReport) Close() error {
+	enc := json.NewEncoder(r.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.records)
+}
+
+// csvReport writes a header row followed by one row per image
+type csvReport struct {
+	w *csv.Writer
+}
+
+func (r *csvReport) Write(result batchResult) error {
+	record := newReportRecord(result)
+	// Flush each row so watch mode's report is readable while it runs
+	defer r.w.Flush()
+	return r.w.Write([]string{
+		record.Path,
+		record.Hash,
+		record.AltText,
+		record.Provider,
+		record.Model,
+		strconv.Itoa(record.InputTokens),
+		strconv.Itoa(record.OutputTokens),
+		record.Error,
+		strings.Join(record.Violations, "; "),
+		record.Description,
+		strconv.Itoa(record.Score),
+		strings.Join(record.Lint, "; "),
+		record.Caption,
+		strings.Join(record.Tags, ", "),
+		strings.Join(record.Objects, ", "),
+		record.DetectedText,
+		strings.Join(record.Keywords, ", "),
+		strconv.Itoa(record.Confidence),
+		strconv.FormatBool(record.NeedsReview),
+		strings.Join(record.Issues, "; "),
+		strconv.Itoa(record.MaxChars),
+	})
+}
+
+func (r *csvReport) Close() error {
+	r.w.Flush()
+	return r.w.Error()
+}
+
+// figureReport writes a <figure> snippet for each image captioned, ready to
+// paste into a page; images that failed are left out
+type figureReport struct {
+	w io.Writer
+}
+
+func (r *figureReport) Write(result batchResult) error {
+	alt := bestAltText(result.Result.Text)
+	if result.Err != nil || alt == "" {
+		return nil
+	}
+	return handlers.WriteFigure(r.w, handlers.Figure{Src: result.Path, Alt: alt, Caption: result.Result.Caption})
+}
+
+func (r *figureReport) Close() error { return nil }
+
+// markdownReport writes a Markdown gallery: a section per image with the
+// image itself, using the first option as its alt text, then the other
+// options and the result's details, or the error
+type markdownReport struct {
+	w io.Writer
+}
+
+func (r *markdownReport) Write(result batchResult) error {
+	fmt.Fprintf(r.w, "## %s\n\n", escapeMarkdownAlt(filepath.ToSlash(result.Path)))
+	if result.Err != nil {
+		_, err := fmt.Fprintf(r.w, "> **Error:** %s\n\n", strings.Join(strings.Fields(result.Err.Error()), " "))
+		return err
+	}
+	options := (history.Record{AltText: result.Result.Text}).Options()
+	fmt.Fprintf(r.w, "%s\n\n", markdownImage(bestAltText(result.Result.Text), result.Path))
+	if len(options) > 1 {
+		fmt.Fprintln(r.w, "Other options:")
+		fmt.Fprintln(r.w)
+		for _, option := range options[1:] {
+			// A different bullet keeps this list apart from the details
+			fmt.Fprintf(r.w, "* %s\n", optionNumber.ReplaceAllString(option, ""))
+		}
+		fmt.Fprintln(r.w)
+	}
+	fmt.Fprintf(r.w, "- Quality score: %d/100\n", result.Result.Score)
+	fmt.Fprintf(r.w, "- Confidence: %d/100\n", result.Result.Confidence)
+	if len(result.Violations) > 0 {
+		fmt.Fprintf(r.w, "- Below threshold: %s\n", strings.Join(result.Violations, "; "))
+	}
+	if result.NeedsReview {
+		fmt.Fprintln(r.w, "- Needs review")
+	}
+	if len(result.Result.Lint) > 0 {
+		fmt.Fprintf(r.w, "- Lint: %s\n", strings.Join(result.Result.Lint, "; "))
+	}
+	for _, detail := range resultDetails(result.Result) {
+		fmt.Fprintf(r.w, "- %s: %s\n", detail[0], strings.Join(strings.Fields(detail[1]), " "))
+	}
+	_, err := fmt.Fprintln(r.w)
+	return err
+}
+
+func (r *markdownReport) Close() error { return nil }
@@ -0,0 +1,27 @@
+package cli
+
+import (
+	"os"
+	"strings"
+
+	"alt-text-generator/internal/history"
+)
+
+// sidecarSuffix is appended to an image's path to name its alt text file
+const sidecarSuffix = ".alt.txt"
+
+func sidecarPath(imagePath string) string {
+	return imagePath + sidecarSuffix
+}
+
+// hasSidecar reports whether an alt text file already exists for the image
+func hasSidecar(imagePath string) bool {
+	_, err := os.Stat(sidecarPath(imagePath))
+	return err == nil
+}
+
+// writeSidecar saves a result's alt text options next to the image, one per line
+func writeSidecar(result batchResult) error {
+	options := (history.Record{AltText: result.Result.Text}).Options()
+	return os.WriteFile(sidecarPath(result.Path), []byte(strings.Join(options, "\n")+"\n"), 0o644)
+}
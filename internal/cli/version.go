@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+
+	"alt-text-generator/internal/version"
+)
+
+// Version implements "alt-text-generator version": it prints the version,
+// commit, and build date of the binary
+func Version(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("version", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	asJSON := flags.Bool("json", false, "print the build info as JSON")
+	if _, err := parseArgs(flags, args); err != nil {
+		return exitUsage
+	}
+
+	info := version.Get()
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		return exitOK
+	}
+	fmt.Fprintln(stdout, info)
+	return exitOK
+}
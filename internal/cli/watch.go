@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"alt-text-generator/internal/api"
+)
+
+// settleDelay is how long a new file must go unmodified before it is read,
+// so images still being copied in aren't captioned half-written
+const settleDelay = 500 * time.Millisecond
+
+// watch captions images as they appear in dirs until ctx is cancelled,
+// passing each result to emit. match decides which files are captioned.
+func watch(ctx context.Context, provider api.Provider, dirs []string, recursive bool, match func(path string) bool, concurrency int, state *checkpoint, emit func(batchResult) error) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	add := func(dir string) error {
+		if !recursive {
+			return watcher.Add(dir)
+		}
+		return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return err
+			}
+			return watcher.Add(path)
+		})
+	}
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory; -watch needs folders to watch", dir)
+		}
+		if err := add(dir); err != nil {
+			return err
+		}
+	}
+
+	seen := &dedupe{calls: map[string]*dedupeCall{}}
+	slots := make(chan struct{}, max(concurrency, 1))
+	ready := make(chan string)
+	failed := make(chan error, 1)
+	pending := map[string]*time.Timer{}
+	var emitMu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for _, t := range pending {
+				t.Stop()
+			}
+			return nil
+
+		case err := <-failed:
+			return err
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("File watcher error", "err", err)
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+				if recursive && event.Has(fsnotify.Create) {
+					if err := add(event.Name); err != nil {
+						slog.Warn("Failed to watch new directory", "dir", event.Name, "err", err)
+					}
+				}
+				continue
+			}
+			if !match(event.Name) {
+				continue
+			}
+			// Restart the clock on every write until the file settles
+			if t, ok := pending[event.Name]; ok {
+				t.Reset(settleDelay)
+				continue
+			}
+			path := event.Name
+			pending[path] = time.AfterFunc(settleDelay, func() {
+				select {
+				case ready <- path:
+				case <-ctx.Done():
+				}
+			})
+
+		case path := <-ready:
+			delete(pending, path)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				slots <- struct{}{}
+				defer func() { <-slots }()
+
+				result := captionFile(ctx, provider, path, seen, state)
+				emitMu.Lock()
+				defer emitMu.Unlock()
+				if err := emit(result); err != nil {
+					select {
+					case failed <- err:
+					default:
+					}
+				}
+			}()
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Package coalesce collapses concurrent calls for the same key into one, so
+// a burst of identical requests, such as a CMS importing the same image for
+// many pages at once, makes a single provider call
+package coalesce
+
+import (
+	"context"
+	"sync"
+)
+
+type call struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// Group tracks the calls under way. The zero value is ready to use.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// Do runs fn for key, unless a call for key is already running, in which
+// case it waits for that call and returns its result with shared set. A
+// waiting caller gives up with ctx's error when ctx ends first. Nothing is
+// remembered once a call returns.
+func (g *Group) Do(ctx context.Context, key string, fn func() (interface{}, error)) (value interface{}, shared bool, err error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.value, true, c.err
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		}
+	}
+	if g.calls == nil {
+		g.calls = map[string]*call{}
+	}
+	c := &call{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.value, c.err = fn()
+	return c.value, false, c.err
+}
@@ -0,0 +1,245 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFile is the config file read when ALT_TEXT_CONFIG names no other
+const DefaultFile = "alt-text-generator.toml"
+
+// FilePath returns the config file to read: $ALT_TEXT_CONFIG or DefaultFile
+func FilePath() string {
+	return GetString("ALT_TEXT_CONFIG", DefaultFile)
+}
+
+// Setting is a config file key and the environment variable it stands in
+// for. Everything reads settings from the environment, so a file only has
+// to fill in variables that aren't already set.
+type Setting struct {
+	Key     string // dotted path in the file, such as "server.log_level"
+	Env     string
+	Type    string // string, int, float, bool, duration, or list
+	Default string
+	Choices []string
+	Secret  bool
+	Help    string
+}
+
+// Settings lists every config file key, in the order config init writes them
+var Settings = []Setting{
+	{Key: "provider", Env: "PROVIDER", Type: "string", Choices: []string{"openai", "anthropic"}, Help: "provider used when none is chosen with a flag"},
+	{Key: "prompt", Env: "ALT_TEXT_PROMPT", Type: "string", Help: "prompt template sent with every image, replacing the built-in prompt"},
+	{Key: "prompt_file", Env: "ALT_TEXT_PROMPT_FILE", Type: "string", Help: "file holding the prompt template; takes precedence over prompt"},
+	{Key: "style", Env: "ALT_TEXT_STYLE", Type: "string", Default: "neutral", Choices: []string{"neutral", "marketing", "journalistic", "technical", "playful"}, Help: "tone of the alt text, as an instruction added to the prompt"},
+	{Key: "domain", Env: "ALT_TEXT_DOMAIN", Type: "string", Default: "general", Choices: []string{"general", "ecommerce", "artwork", "scientific", "news", "screenshot"}, Help: "kind of image, as an instruction added to the prompt on what to describe"},
+	{Key: "objective", Env: "ALT_TEXT_OBJECTIVE", Type: "bool", Default: "false", Help: "describe images objectively, without subjective or promotional words such as beautiful or stunning, overriding the style"},
+	{Key: "objective_words", Env: "ALT_TEXT_OBJECTIVE_WORDS", Type: "list", Help: "words objective mode leaves out besides its own list"},
+	{Key: "reading_level", Env: "ALT_TEXT_READING_LEVEL", Type: "int", Default: "0", Help: "US school grade to write alt text for, checked with the Flesch-Kincaid formula and requested again if too complex (1 to 16, or 0 for none)"},
+	{Key: "people", Env: "ALT_TEXT_PEOPLE", Type: "string", Default: "allow", Choices: []string{"allow", "neutral", "omit"}, Help: "how people may be described: allow, neutral to leave out perceived age, gender, and ethnicity and names not shown or given, or omit to leave out identity and names altogether"},
+	{Key: "platform", Env: "ALT_TEXT_PLATFORM", Type: "string", Choices: []string{"mastodon", "x", "instagram"}, Help: "social network to write alt text for, setting its length limit and conventions in place of max_length"},
+	{Key: "filters", Env: "ALT_TEXT_FILTERS", Type: "list", Help: "output filters: profanity, email, phone, license_plate, or pii for the last three"},
+	{Key: "filter_action", Env: "ALT_TEXT_FILTER_ACTION", Type: "string", Default: "redact", Choices: []string{"redact", "reprompt"}, Help: "redact filtered text, or ask the model again first"},
+	{Key: "filter_words", Env: "ALT_TEXT_FILTER_WORDS", Type: "list", Help: "words the profanity filter removes besides its own list"},
+	{Key: "grader", Env: "ALT_TEXT_GRADER", Type: "bool", Default: "false", Help: "also have the model rate each alt text, averaged into its quality score"},
+	{Key: "normalize_disable", Env: "ALT_TEXT_NORMALIZE_DISABLE", Type: "list", Help: "fixes made to every generated alt text to turn off: emoji, hashtags, redundant-prefix, spacing, quotes, sentence-case"},
+	{Key: "symbols", Env: "ALT_TEXT_SYMBOLS", Type: "string", Default: "strip", Choices: []string{"strip", "verbalize"}, Help: "remove emoji and the # of hashtags from alt text, or put them into words"},
+	{Key: "lint_disable", Env: "ALT_TEXT_LINT_DISABLE", Type: "list", Help: "alt text lint rules to turn off, such as end-punctuation"},
+	{Key: "long_description", Env: "ALT_TEXT_LONG_DESCRIPTION", Type: "bool", Default: "false", Help: "also ask for a long description of each image, returned apart from the alt text"},
+	{Key: "charts", Env: "ALT_TEXT_CHARTS", Type: "bool", Default: "false", Help: "summarise charts and graphs by their trend, with an HTML table of their data in the long description"},
+	{Key: "keywords", Env: "ALT_TEXT_KEYWORDS", Type: "bool", Default: "false", Help: "also ask for 5 to 10 searchable keywords for each image"},
+	{Key: "candidates", Env: "ALT_TEXT_CANDIDATES", Type: "int", Default: "1", Help: "how many times to ask the model for each image, offering every distinct option (1 to 5)"},
+	{Key: "structured", Env: "ALT_TEXT_STRUCTURED", Type: "bool", Default: "false", Help: "ask for a JSON result with a caption, tags, objects, and detected text besides the alt text"},
+	{Key: "temperature", Env: "ALT_TEXT_TEMPERATURE", Type: "float", Help: "sampling temperature, from 0 for the most repeatable output to 2 for the most varied (Anthropic allows up to 1; default the provider's)"},
+	{Key: "top_p", Env: "ALT_TEXT_TOP_P", Type: "float", Help: "nucleus sampling cutoff from 0 to 1 (default the provider's)"},
+	{Key: "seed", Env: "ALT_TEXT_SEED", Type: "int", Help: "sampling seed, for repeatable output where the provider supports it (OpenAI)"},
+	{Key: "translate", Env: "ALT_TEXT_TRANSLATE", Type: "list", Help: "languages to translate the existing_alt context into, checked against the image, instead of writing new alt text"},
+	{Key: "improve", Env: "ALT_TEXT_IMPROVE", Type: "bool", Default: "false", Help: "critique the existing_alt context against the image and rewrite it, returning the problems found as issues"},
+	{Key: "max_length", Env: "ALT_TEXT_MAX_LENGTH", Type: "int", Default: "125", Help: "longest alt text allowed, in characters; longer text is requested again, then truncated (0 for no limit)"},
+	{Key: "max_extra_calls", Env: "ALT_TEXT_MAX_EXTRA_CALLS", Type: "int", Default: "2", Help: "provider calls each generation may make beyond its first and its candidates, to ask again for shorter, simpler, objective, or filtered text or to grade it"},
+
+	{Key: "history.database", Env: "HISTORY_DB", Type: "string", Help: "SQLite database file, or postgres:// URL, to keep generation history in, so it survives restarts (kept in memory when empty)"},
+	{Key: "history.retention", Env: "HISTORY_RETENTION", Type: "duration", Help: "how long generations are kept before being deleted, such as 2160h for 90 days (kept forever when unset)"},
+	{Key: "history.thumbnail_retention", Env: "HISTORY_THUMBNAIL_RETENTION", Type: "duration", Help: "how long generations keep the thumbnail of their image, such as 24h (kept as long as the generation when unset)"},
+	{Key: "history.cache", Env: "RESULT_CACHE", Type: "bool", Default: "true", Help: "return the stored result for an image already generated with the same provider, model, and prompt instead of calling the provider again"},
+	{Key: "history.cache_size", Env: "RESULT_CACHE_SIZE", Type: "int", Default: "1000", Help: "results the result cache keeps in memory in front of history, when not sharing them through Redis (0 to look in history every time)"},
+	{Key: "history.cache_ttl", Env: "RESULT_CACHE_TTL", Type: "duration", Default: "168h", Help: "how long the result cache keeps a result in memory or Redis; history keeps it regardless"},
+
+	{Key: "redis.url", Env: "REDIS_URL", Type: "string", Secret: true, Help: "redis:// or rediss:// URL of a Redis server that server instances share the result cache and rate limits through"},
+
+	{Key: "storage.url", Env: "OBJECT_STORAGE_URL", Type: "string", Help: "s3://bucket/prefix or gs://bucket/prefix to keep uploaded images, results, and finished jobs in, so they outlive restarts"},
+	{Key: "storage.fetch_allowed_buckets", Env: "FETCH_ALLOWED_BUCKETS", Type: "list", Help: `s3:// and gs:// buckets API callers may send image URLs in, or "*" for any but the storage bucket (none when empty)`},
+	{Key: "storage.fetch_allow_private", Env: "FETCH_ALLOW_PRIVATE", Type: "bool", Default: "false", Help: "let API callers send image URLs on loopback, private, and link-local addresses"},
+	{Key: "storage.sse", Env: "OBJECT_STORAGE_SSE", Type: "string", Choices: []string{"AES256", "aws:kms"}, Help: "S3 server-side encryption for stored objects"},
+	{Key: "storage.kms_key", Env: "OBJECT_STORAGE_KMS_KEY", Type: "string", Help: "AWS KMS key ID, or Cloud KMS key name, to encrypt stored objects with instead of the default"},
+
+	{Key: "jobs.database", Env: "JOBS_DB", Type: "string", Help: "SQLite database file to queue asynchronous jobs in, so queued and running jobs survive restarts (kept in memory when empty)"},
+	{Key: "jobs.visibility_timeout", Env: "JOBS_VISIBILITY_TIMEOUT", Type: "duration", Default: "1m", Help: "with jobs.database, how long a worker's claim on a job lasts unless renewed before the job may run again, and how long a failed job waits to be retried"},
+	{Key: "jobs.max_attempts", Env: "JOBS_MAX_ATTEMPTS", Type: "int", Default: "3", Help: "with jobs.database, times a job is run before it is failed"},
+
+	{Key: "providers.timeout", Env: "PROVIDER_TIMEOUT", Type: "duration", Default: "2m", Help: "how long one provider call, streamed or not, may take before it is abandoned (0 for no limit)"},
+	{Key: "providers.response_header_timeout", Env: "PROVIDER_RESPONSE_HEADER_TIMEOUT", Type: "duration", Default: "90s", Help: "how long to wait for a provider's response headers, which for calls that aren't streamed come once the alt text is written (0 for no limit)"},
+	{Key: "providers.max_idle_conns", Env: "PROVIDER_MAX_IDLE_CONNS", Type: "int", Default: "32", Help: "idle connections kept open to each provider for reuse"},
+	{Key: "providers.http2", Env: "PROVIDER_HTTP2", Type: "bool", Default: "true", Help: "use HTTP/2 with providers that offer it"},
+	{Key: "providers.keepalive_interval", Env: "PROVIDER_KEEPALIVE_INTERVAL", Type: "duration", Help: "connect to providers at startup and ping them this often, such as 30s, so requests after a quiet spell skip the TLS handshake (off when unset)"},
+	{Key: "providers.race", Env: "PROVIDER_RACE", Type: "bool", Default: "false", Help: "send single-image requests from the web page, /api/v1/generate, and WebSocket to both providers at once and answer with the first, paying for both"},
+	{Key: "providers.openai.api_key", Env: "OPEN_AI_API_KEY", Type: "string", Secret: true, Help: "OpenAI API key"},
+	{Key: "providers.openai.model", Env: "OPENAI_MODEL", Type: "string", Default: "gpt-4o", Help: "OpenAI model"},
+	{Key: "providers.anthropic.api_key", Env: "ANTHROPIC_API_KEY", Type: "string", Secret: true, Help: "Anthropic API key"},
+	{Key: "providers.anthropic.model", Env: "ANTHROPIC_MODEL", Type: "string", Default: "claude-3-opus-20240229", Help: "Anthropic model"},
+
+	{Key: "server.listen", Env: "LISTEN_ADDR", Type: "string", Help: "host:port or unix:///path.sock to listen on (default :$PORT, or :8080)"},
+	{Key: "server.debug_listen", Env: "DEBUG_LISTEN_ADDR", Type: "string", Help: "host:port or unix:///path.sock to serve profiles and runtime stats on, to admin keys only (off when empty)"},
+	{Key: "server.log_format", Env: "LOG_FORMAT", Type: "string", Choices: []string{"json", "text"}, Help: "log format (default json for the server, text for commands)"},
+	{Key: "server.log_level", Env: "LOG_LEVEL", Type: "string", Choices: []string{"debug", "info", "warn", "error"}, Help: "lowest level logged (default info for the server, warn for commands)"},
+	{Key: "server.trust_proxy", Env: "TRUST_PROXY", Type: "bool", Default: "false", Help: "take client addresses from X-Forwarded-For for rate limiting"},
+	{Key: "server.audit_log", Env: "AUDIT_LOG", Type: "string", Help: "file the audit trail of generations and admin actions is appended to, so it survives restarts (kept in memory when empty)"},
+	{Key: "server.max_concurrent_generations", Env: "MAX_CONCURRENT_GENERATIONS", Type: "int", Default: "16", Help: "provider calls made at once; further requests queue for a turn (0 for no limit)"},
+	{Key: "server.generation_queue_size", Env: "GENERATION_QUEUE_SIZE", Type: "int", Default: "64", Help: "requests that may wait for a provider call before more are refused with 503"},
+	{Key: "server.generation_queue_timeout", Env: "GENERATION_QUEUE_TIMEOUT", Type: "duration", Default: "30s", Help: "how long a request waits for a provider call before being refused with 503 (0 to wait as long as the client does)"},
+	{Key: "server.upload_timeout", Env: "REQUEST_UPLOAD_TIMEOUT", Type: "duration", Help: "how long a client has to send its upload before it is refused with 408 (unset for no limit)"},
+	{Key: "server.preprocess_timeout", Env: "REQUEST_PREPROCESS_TIMEOUT", Type: "duration", Help: "how long after an upload arrives its provider call must start, including waiting for a turn, before it is refused with 504 (unset for no limit)"},
+	{Key: "server.request_timeout", Env: "REQUEST_TIMEOUT", Type: "duration", Help: "how long a generation request may take from start to finish before it is refused with 504 (unset for no limit)"},
+	{Key: "server.load_shed_memory_mb", Env: "LOAD_SHED_MEMORY_MB", Type: "int", Default: "0", Help: "memory use in MB past which uploads are refused with 503 (0 for 90% of GOMEMLIMIT when that is set, otherwise no limit)"},
+	{Key: "server.shutdown_grace_period", Env: "SHUTDOWN_GRACE_PERIOD", Type: "duration", Default: "30s", Help: "how long requests and jobs in flight get to finish after SIGINT or SIGTERM"},
+	{Key: "server.idempotency_ttl", Env: "IDEMPOTENCY_TTL", Type: "duration", Default: "24h", Help: "how long Idempotency-Key results are kept"},
+	{Key: "server.cors_allowed_origins", Env: "CORS_ALLOWED_ORIGINS", Type: "list", Help: "origins allowed to call the API from a browser"},
+	{Key: "server.cors_max_age", Env: "CORS_MAX_AGE", Type: "int", Default: "600", Help: "seconds browsers may cache preflight responses"},
+	{Key: "server.rate_limit_per_minute", Env: "RATE_LIMIT_PER_MINUTE", Type: "int", Default: "0", Help: "requests per minute per client (0 for no limit)"},
+	{Key: "server.rate_limit_burst", Env: "RATE_LIMIT_BURST", Type: "int", Help: "requests a client may make at once (default the per-minute limit)"},
+
+	{Key: "auth.api_keys", Env: "API_KEYS", Type: "list", Secret: true, Help: `API keys accepted by the JSON API, optionally labelled ("team-a:sk-123")`},
+	{Key: "auth.admin_api_keys", Env: "ADMIN_API_KEYS", Type: "list", Secret: true, Help: "keys for the admin API, which is off when none are set"},
+	{Key: "auth.oidc_issuer_url", Env: "OIDC_ISSUER_URL", Type: "string", Help: "OpenID Connect issuer whose tokens are accepted"},
+	{Key: "auth.oidc_audience", Env: "OIDC_AUDIENCE", Type: "string", Help: "audience tokens must be issued for"},
+	{Key: "auth.oidc_user_claim", Env: "OIDC_USER_CLAIM", Type: "string", Help: "claim that identifies the caller (default sub)"},
+	{Key: "auth.anonymous_uploads", Env: "ANONYMOUS_UPLOADS", Type: "bool", Default: "false", Help: "let the upload form generate without credentials while API keys or OIDC are configured"},
+	{Key: "auth.users", Env: "USER_ACCOUNTS", Type: "list", Help: `accounts grouping API key labels and token subjects, which share history and quotas ("alice=team-a auth0|123")`},
+
+	{Key: "budgets.requests_per_day", Env: "QUOTA_REQUESTS_PER_DAY", Type: "int", Default: "0", Help: "provider requests per caller per UTC day (0 for no limit)"},
+	{Key: "budgets.tokens_per_day", Env: "QUOTA_TOKENS_PER_DAY", Type: "int", Default: "0", Help: "provider tokens per caller per UTC day (0 for no limit)"},
+	{Key: "budgets.overrides", Env: "QUOTA_OVERRIDES", Type: "list", Help: `per-caller limits as name=requests/tokens ("team-a=1000/2000000")`},
+}
+
+// LookupSetting finds a setting by its key in the file
+func LookupSetting(key string) (Setting, bool) {
+	for _, s := range Settings {
+		if s.Key == key {
+			return s, true
+		}
+	}
+	return Setting{}, false
+}
+
+// ReadFile parses and validates a config file, returning the environment
+// value each key in it sets. Every problem found is reported, with its line.
+func ReadFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseTOML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	env := map[string]string{}
+	var errs []error
+	for key, value := range values {
+		setting, ok := LookupSetting(key)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: line %d: unknown setting %s", path, value.Line, key))
+			continue
+		}
+		s, err := setting.format(value.Value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: line %d: %s: %v", path, value.Line, key, err))
+			continue
+		}
+		env[setting.Env] = s
+	}
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return env, errors.Join(errs...)
+}
+
+// format checks a value from the file against the setting's type and
+// returns it as the environment variable would hold it
+func (s Setting) format(value interface{}) (string, error) {
+	var out string
+	switch s.Type {
+	case "string", "duration":
+		str, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("expected a quoted string")
+		}
+		if s.Type == "duration" {
+			if _, err := time.ParseDuration(str); err != nil {
+				return "", fmt.Errorf("expected a duration such as \"30s\"")
+			}
+		}
+		out = str
+	case "int":
+		n, ok := value.(int64)
+		if !ok {
+			return "", fmt.Errorf("expected an integer")
+		}
+		out = strconv.FormatInt(n, 10)
+	case "float":
+		switch n := value.(type) {
+		case int64:
+			out = strconv.FormatInt(n, 10)
+		case float64:
+			out = strconv.FormatFloat(n, 'f', -1, 64)
+		default:
+			return "", fmt.Errorf("expected a number")
+		}
+	case "bool":
+		b, ok := value.(bool)
+		if !ok {
+			return "", fmt.Errorf("expected true or false")
+		}
+		out = strconv.FormatBool(b)
+	case "list":
+		items, ok := value.([]interface{})
+		if !ok {
+			return "", fmt.Errorf("expected an array of strings")
+		}
+		var strs []string
+		for _, item := range items {
+			str, ok := item.(string)
+			if !ok || strings.Contains(str, ",") {
+				return "", fmt.Errorf("expected an array of strings without commas")
+			}
+			strs = append(strs, str)
+		}
+		out = strings.Join(strs, ",")
+	}
+	if len(s.Choices) > 0 && !slices.Contains(s.Choices, out) {
+		return "", fmt.Errorf("must be one of %s", strings.Join(s.Choices, ", "))
+	}
+	return out, nil
+}
+
+// LoadFile applies a config file by setting the environment variable for
+// each key it contains, except those already set, so the environment (and
+// .env) override the file
+func LoadFile(path string) error {
+	env, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for key, value := range env {
+		if os.Getenv(key) != "" {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
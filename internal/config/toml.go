@@ -0,0 +1,226 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tomlValue is a value read from a config file and the line it was on
+type tomlValue struct {
+	Value interface{} // string, int64, float64, bool, or []interface{}
+	Line  int
+}
+
+// parseTOML reads the subset of TOML config files need: [table] headers,
+// key = value pairs, strings, numbers, booleans, and arrays. It returns the
+// values keyed by dotted path, such as "server.log_level".
+func parseTOML(data string) (map[string]tomlValue, error) {
+	values := map[string]tomlValue{}
+	table := ""
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(stripComment(lines[i]))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table header %s", lineNo, line)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if !validKey(table) {
+				return nil, fmt.Errorf("line %d: invalid table name %q", lineNo, table)
+			}
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		key, raw = strings.TrimSpace(key), strings.TrimSpace(raw)
+		if !ok || !validKey(key) {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		// Arrays may continue over several lines until the closing bracket
+		for strings.HasPrefix(raw, "[") && !arrayClosed(raw) && i+1 < len(lines) {
+			i++
+			raw += " " + strings.TrimSpace(stripComment(lines[i]))
+		}
+		value, rest, err := parseTOMLValue(raw)
+		if err == nil && strings.TrimSpace(rest) != "" {
+			err = fmt.Errorf("unexpected %q after value", strings.TrimSpace(rest))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", lineNo, key, err)
+		}
+
+		if table != "" {
+			key = table + "." + key
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("line %d: %s is set twice", lineNo, key)
+		}
+		values[key] = tomlValue{value, lineNo}
+	}
+	return values, nil
+}
+
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, part := range strings.Split(key, ".") {
+		if part == "" {
+			return false
+		}
+		for _, c := range part {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// stripComment removes a # comment that isn't inside a string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// arrayClosed reports whether the brackets outside strings balance
+func arrayClosed(s string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// parseTOMLValue parses the value at the start of s and returns what follows
+func parseTOMLValue(s string) (interface{}, string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return nil, "", fmt.Errorf("missing value")
+	case strings.HasPrefix(s, `"""`) || strings.HasPrefix(s, "'''"):
+		return nil, "", fmt.Errorf("multi-line strings are not supported")
+	case s[0] == '"':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch c := s[i]; c {
+			case '"':
+				return b.String(), s[i+1:], nil
+			case '\\':
+				if i+1 >= len(s) {
+					return nil, "", fmt.Errorf("unterminated string")
+				}
+				i++
+				switch s[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'r':
+					b.WriteByte('\r')
+				case '"', '\\':
+					b.WriteByte(s[i])
+				case 'u':
+					if i+4 >= len(s) {
+						return nil, "", fmt.Errorf("invalid \\u escape")
+					}
+					r, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+					if err != nil {
+						return nil, "", fmt.Errorf("invalid \\u escape")
+					}
+					b.WriteRune(rune(r))
+					i += 4
+				default:
+					return nil, "", fmt.Errorf("invalid escape \\%c", s[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return nil, "", fmt.Errorf("unterminated string")
+	case s[0] == '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case s[0] == '[':
+		items := []interface{}{}
+		rest := strings.TrimSpace(s[1:])
+		for {
+			if strings.HasPrefix(rest, "]") {
+				return items, rest[1:], nil
+			}
+			item, after, err := parseTOMLValue(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			items = append(items, item)
+			rest = strings.TrimSpace(after)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return nil, "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+	case s[0] == '{':
+		return nil, "", fmt.Errorf("inline tables are not supported; use a [table] header")
+	}
+
+	// Bare values run to the next delimiter
+	end := strings.IndexAny(s, ",] \t")
+	if end < 0 {
+		end = len(s)
+	}
+	word, rest := s[:end], s[end:]
+	switch word {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	digits := strings.ReplaceAll(word, "_", "")
+	if n, err := strconv.ParseInt(digits, 10, 64); err == nil {
+		return n, rest, nil
+	}
+	if f, err := strconv.ParseFloat(digits, 64); err == nil {
+		return f, rest, nil
+	}
+	return nil, "", fmt.Errorf("invalid value %q (strings must be quoted)", word)
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	values, err := parseTOML(`# Alt text settings
+provider = "anthropic"   # trailing comment
+style = 'literal \n # kept'
+candidates = 3
+temperature = 0.7
+grader = true
+filters = ["email", 'phone'] # comment after an array
+escaped = "tab\there \"quoted\" é"
+big = 1_000
+
+[server]
+port = -8080
+cors_allowed_origins = [
+  "https://a.example", # first
+  "https://b.example",
+]
+empty = []
+
+[history.cache]
+size = 1e3
+`)
+	if err != nil {
+		t.Fatalf("parseTOML: %v", err)
+	}
+	want := map[string]tomlValue{
+		"provider":                    {"anthropic", 2},
+		"style":                       {`literal \n # kept`, 3},
+		"candidates":                  {int64(3), 4},
+		"temperature":                 {0.7, 5},
+		"grader":                      {true, 6},
+		"filters":                     {[]interface{}{"email", "phone"}, 7},
+		"escaped":                     {"tab\there \"quoted\" é", 8},
+		"big":                         {int64(1000), 9},
+		"server.port":                 {int64(-8080), 12},
+		"server.cors_allowed_origins": {[]interface{}{"https://a.example", "https://b.example"}, 13},
+		"server.empty":                {[]interface{}{}, 17},
+		"history.cache.size":          {1000.0, 20},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("values =\n%#v\nwant\n%#v", values, want)
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"missing equals", "provider", "line 1: expected key = value"},
+		{"bad key", "a b = 1", "line 1: expected key = value"},
+		{"empty key part", "a..b = 1", "line 1: expected key = value"},
+		{"missing value", "provider =", "line 1: provider: missing value"},
+		{"bare string", "provider = openai", `line 1: provider: invalid value "openai" (strings must be quoted)`},
+		{"unterminated string", `provider = "openai`, "line 1: provider: unterminated string"},
+		{"unterminated literal string", "provider = 'openai", "line 1: provider: unterminated string"},
+		{"bad escape", `provider = "a\qb"`, `line 1: provider: invalid escape \q`},
+		{"short unicode escape", `provider = "\u12"`, `line 1: provider: invalid \u escape`},
+		{"junk after value", `provider = "openai" "anthropic"`, `line 1: provider: unexpected "\"anthropic\"" after value`},
+		{"array without commas", `filters = ["a" "b"]`, "line 1: filters: expected , or ] in array"},
+		{"unclosed array", "filters = [\"a\",\n\"b\"", "line 1: filters: expected , or ] in array"},
+		{"multi-line string", `prompt = """text"""`, "multi-line strings are not supported"},
+		{"inline table", "server = { port = 1 }", "inline tables are not supported"},
+		{"array of tables", "[[server]]", "line 1: invalid table header [[server]]"},
+		{"unclosed table header", "[server", "line 1: invalid table header [server"},
+		{"bad table name", "[ser ver]", `line 1: invalid table name "ser ver"`},
+		{"set twice", "[server]\nport = 1\nport = 2", "line 3: server.port is set twice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTOML(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := `provider = "openai"
+candidates = 2
+temperature = 1
+filters = ["email", "phone"]
+unknown = 1
+
+[server]
+max_concurrent_generations = "16"
+request_timeout = "soon"
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env, err := ReadFile(path)
+	want := map[string]string{
+		"PROVIDER":             "openai",
+		"ALT_TEXT_CANDIDATES":  "2",
+		"ALT_TEXT_TEMPERATURE": "1",
+		"ALT_TEXT_FILTERS":     "email,phone",
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("env = %v, want %v", env, want)
+	}
+	for _, problem := range []string{"line 5: unknown setting unknown", "line 8: server.max_concurrent_generations: expected an integer", "line 9: server.request_timeout: expected a duration"} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("err = %v, want it to report %q", err, problem)
+		}
+	}
+}
+
+func TestSettingFormat(t *testing.T) {
+	tests := []struct {
+		setting Setting
+		value   interface{}
+		want    string
+		err     string
+	}{
+		{Setting{Type: "string", Choices: []string{"a", "b"}}, "b", "b", ""},
+		{Setting{Type: "string", Choices: []string{"a", "b"}}, "c", "", "must be one of a, b"},
+		{Setting{Type: "string"}, int64(1), "", "expected a quoted string"},
+		{Setting{Type: "duration"}, "90s", "90s", ""},
+		{Setting{Type: "int"}, 1.5, "", "expected an integer"},
+		{Setting{Type: "float"}, 0.25, "0.25", ""},
+		{Setting{Type: "bool"}, "yes", "", "expected true or false"},
+		{Setting{Type: "list"}, []interface{}{"a", "b"}, "a,b", ""},
+		{Setting{Type: "list"}, []interface{}{"a,b"}, "", "without commas"},
+		{Setting{Type: "list"}, "a", "", "expected an array of strings"},
+	}
+	for _, tt := range tests {
+		got, err := tt.setting.format(tt.value)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("format(%s, %#v) err = %v, want %q", tt.setting.Type, tt.value, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("format(%s, %#v) = %q, %v, want %q", tt.setting.Type, tt.value, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetString returns the environment variable or def when unset
+func GetString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// GetInt returns the environment variable parsed as an int, or def when unset or invalid
+func GetInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		slog.Warn("Ignoring invalid setting", "key", key, "value", v, "expected", "an integer")
+		return def
+	}
+	return n
+}
+
+// GetFloat returns the environment variable parsed as a float64, or def when
+// unset or invalid
+func GetFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		slog.Warn("Ignoring invalid setting", "key", key, "value", v, "expected", "a number")
+		return def
+	}
+	return f
+}
+
+// GetBool returns the environment variable parsed as a bool, or def when unset or invalid
+func GetBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		slog.Warn("Ignoring invalid setting", "key", key, "value", v, "expected", "true or false")
+		return def
+	}
+	return b
+}
+
+// GetDuration returns the environment variable parsed as a duration (e.g. "30s"),
+// or def when unset or invalid
+func GetDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil {
+		slog.Warn("Ignoring invalid setting", "key", key, "value", v, "expected", "a duration such as 30s")
+		return def
+	}
+	return d
+}
+
+// GetList returns the environment variable split on commas with blanks removed
+func GetList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
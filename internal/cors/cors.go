@@ -0,0 +1,87 @@
+package cors
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	allowedMethods = "GET, POST, OPTIONS"
+	allowedHeaders = "Authorization, Content-Type, X-API-Key, X-Request-ID, Idempotency-Key"
+	exposedHeaders = "Location, Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-Request-ID, Idempotent-Replayed, API-Version, Deprecation, Sunset, Link"
+)
+
+// Policy decides which cross-origin callers may use the server
+type Policy struct {
+	origins   map[string]bool
+	anyOrigin bool
+	maxAge    int
+}
+
+// New creates a policy for the given origins (e.g. "https://app.example.com").
+// A "*" entry allows every origin.
+func New(origins []string, maxAgeSeconds int) *Policy {
+	p := &Policy{origins: map[string]bool{}, maxAge: maxAgeSeconds}
+	for _, o := range origins {
+		if o == "*" {
+			p.anyOrigin = true
+			continue
+		}
+		p.origins[strings.TrimSuffix(o, "/")] = true
+	}
+	return p
+}
+
+// Allowed reports whether requests from origin are permitted
+func (p *Policy) Allowed(origin string) bool {
+	return p.anyOrigin || p.origins[origin]
+}
+
+// Handler adds CORS headers for allowed origins and answers preflight
+// requests before they reach routing or authentication
+func (p *Policy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if !p.Allowed(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if p.anyOrigin {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if preflight {
+			h.Set("Access-Control-Allow-Methods", allowedMethods)
+			h.Set("Access-Control-Allow-Headers", allowedHeaders)
+			if p.maxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(p.maxAge))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.Set("Access-Control-Expose-Headers", exposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,347 @@
+package crawl
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// maxPageSize is the most of any page or sitemap that is read
+const maxPageSize = 5 * 1024 * 1024
+
+// defaultClient fetches pages for crawlers not given a client of their own
+var defaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// Image is an <img> found on a crawled page
+type Image struct {
+	// Src is the image's absolute URL
+	Src    string
+	Alt    string
+	HasAlt bool
+	// Issue says what is wrong with the alt text, or is empty if nothing is
+	Issue string
+	// Disallowed is set when robots.txt forbids fetching the image
+	Disallowed bool
+}
+
+// Page is the outcome of crawling one URL
+type Page struct {
+	URL    string
+	Depth  int
+	Images []Image
+	Err    error
+}
+
+// Crawler walks a site breadth first from its start pages, following links
+// that stay on the same hosts and honoring each host's robots.txt
+type Crawler struct {
+	Client    *http.Client
+	UserAgent string
+	// MaxDepth is how many links away from a start page to go; 0 crawls
+	// only the start pages
+	MaxDepth int
+	// MaxPages stops the crawl after this many pages; 0 means no limit
+	MaxPages int
+	// Delay is the minimum time between requests, raised to a host's
+	// Crawl-delay where it asks for more
+	Delay time.Duration
+
+	mu     sync.Mutex
+	robots map[string]*robots
+	last   time.Time
+}
+
+type queued struct {
+	url   *url.URL
+	depth int
+}
+
+// Run crawls from starts, calling visit for each page in the order crawled.
+// A start URL whose path ends in .xml is read as a sitemap (or sitemap
+// index), and the pages it lists become start pages. Run stops early if ctx
+// is cancelled or visit fails.
+func (c *Crawler) Run(ctx context.Context, starts []string, visit func(Page) error) error {
+	hosts := map[string]bool{}
+	seen := map[string]bool{}
+	var queue []queued
+	enqueue := func(u *url.URL, depth int) {
+		u.Fragment = ""
+		if key := u.String(); !seen[key] {
+			seen[key] = true
+			queue = append(queue, queued{u, depth})
+		}
+	}
+
+	for _, start := range starts {
+		u, err := url.Parse(start)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("%q is not an http(s) URL", start)
+		}
+		if !strings.HasSuffix(strings.ToLower(u.Path), ".xml") {
+			hosts[u.Host] = true
+			enqueue(u, 0)
+			continue
+		}
+		pages, err := c.sitemap(ctx, u, 0)
+		if err != nil {
+			return fmt.Errorf("reading sitemap %s: %v", start, err)
+		}
+		for _, page := range pages {
+			hosts[page.Host] = true
+			enqueue(page, 0)
+		}
+	}
+
+	crawled := 0
+	for len(queue) > 0 && (c.MaxPages <= 0 || crawled < c.MaxPages) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		next := queue[0]
+		queue = queue[1:]
+		if !c.allowed(ctx, next.url) {
+			continue
+		}
+
+		page, links := c.page(ctx, next.url)
+		page.Depth = next.depth
+		crawled++
+		if next.depth < c.MaxDepth {
+			for _, link := range links {
+				if hosts[link.Host] {
+					enqueue(link, next.depth+1)
+				}
+			}
+		}
+		if err := visit(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// page fetches one page and returns its images and the links it contains
+func (c *Crawler) page(ctx context.Context, u *url.URL) (Page, []*url.URL) {
+	page := Page{URL: u.String()}
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		page.Err = err
+		return page, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		page.Err = fmt.Errorf("%s", resp.Status)
+		return page, nil
+	}
+	if mediaType := resp.Header.Get("Content-Type"); mediaType != "" && !strings.Contains(mediaType, "html") {
+		page.Err = fmt.Errorf("not an HTML page (%s)", mediaType)
+		return page, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPageSize))
+	if err != nil {
+		page.Err = err
+		return page, nil
+	}
+
+	// Relative URLs resolve against wherever redirects ended up
+	base := resp.Request.URL
+	var links []*url.URL
+	z := html.NewTokenizer(bytes.NewReader(data))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		token := z.Token()
+		attrs := map[string]string{}
+		for _, attr := range token.Attr {
+			attrs[attr.Key] = attr.Val
+		}
+		resolve := func(ref string) *url.URL {
+			target, err := base.Parse(strings.TrimSpace(ref))
+			if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+				return nil
+			}
+			return target
+		}
+
+		switch token.Data {
+		case "base":
+			if href := resolve(attrs["href"]); href != nil {
+				base = href
+			}
+		case "a":
+			if href := resolve(attrs["href"]); href != nil {
+				links = append(links, href)
+			}
+		case "img":
+			src := resolve(attrs["src"])
+			if src == nil {
+				continue
+			}
+			alt, hasAlt := attrs["alt"]
+			image := Image{Src: src.String(), Alt: alt, HasAlt: hasAlt}
+			if attrs["role"] != "presentation" && attrs["role"] != "none" && attrs["aria-hidden"] != "true" {
+				image.Issue = AltIssue(alt, hasAlt)
+			}
+			if image.Issue != "" {
+				image.Disallowed = !c.allowed(ctx, src)
+			}
+			page.Images = append(page.Images, image)
+		}
+	}
+	return page, links
+}
+
+var (
+	// fileNameAlt matches alt text that is just an image's file name
+	fileNameAlt = regexp.MustCompile(`(?i)^[\w\s.-]+\.(?:png|jpe?g|gif|bmp|tiff?|webp|svg|avif)$`)
+	// genericAlt lists alt text that says nothing about the image
+	genericAlt = map[string]bool{
+		"image": true, "img": true, "photo": true, "picture": true, "pic": true,
+		"graphic": true, "icon": true, "banner": true, "untitled": true,
+		"placeholder": true, "alt": true, "null": true, "undefined": true,
+	}
+)
+
+// AltIssue describes what is wrong with an image's alt text, or returns ""
+// if it looks fine. An empty alt marks an image as decorative and is fine.
+func AltIssue(alt string, hasAlt bool) string {
+	alt = strings.TrimSpace(alt)
+	switch {
+	case !hasAlt:
+		return "missing alt"
+	case alt == "":
+		return ""
+	case fileNameAlt.MatchString(alt):
+		return "alt is a file name"
+	case genericAlt[strings.ToLower(strings.Trim(alt, ".!"))]:
+		return "generic alt"
+	}
+	return ""
+}
+
+// sitemap returns the page URLs listed in a sitemap, following sitemap
+// index files a few levels deep
+func (c *Crawler) sitemap(ctx context.Context, u *url.URL, depth int) ([]*url.URL, error) {
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	var doc struct {
+		XMLName  xml.Name
+		URLs     []string `xml:"url>loc"`
+		Sitemaps []string `xml:"sitemap>loc"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxPageSize)).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var pages []*url.URL
+	for _, loc := range doc.URLs {
+		if page, err := u.Parse(strings.TrimSpace(loc)); err == nil {
+			pages = append(pages, page)
+		}
+	}
+	if depth < 3 {
+		for _, loc := range doc.Sitemaps {
+			child, err := u.Parse(strings.TrimSpace(loc))
+			if err != nil {
+				continue
+			}
+			more, err := c.sitemap(ctx, child, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			pages = append(pages, more...)
+		}
+	}
+	return pages, nil
+}
+
+// allowed reports whether robots.txt lets the crawler fetch u, fetching and
+// caching the host's rules on first use
+func (c *Crawler) allowed(ctx context.Context, u *url.URL) bool {
+	key := u.Scheme + "://" + u.Host
+	c.mu.Lock()
+	rules, ok := c.robots[key]
+	c.mu.Unlock()
+	if !ok {
+		rules = c.fetchRobots(ctx, u)
+		c.mu.Lock()
+		if c.robots == nil {
+			c.robots = map[string]*robots{}
+		}
+		c.robots[key] = rules
+		c.mu.Unlock()
+	}
+	return rules.allowed(u.RequestURI())
+}
+
+// fetchRobots reads a host's robots.txt. A missing file allows everything;
+// one that can't be fetched for any other reason allows nothing.
+func (c *Crawler) fetchRobots(ctx context.Context, u *url.URL) *robots {
+	resp, err := c.get(ctx, &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/robots.txt"})
+	if err != nil {
+		return disallowAll
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return parseRobots(io.LimitReader(resp.Body, 500*1024), c.UserAgent)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return allowAll
+	}
+	return disallowAll
+}
+
+// get sends a GET with the crawler's user agent, waiting first so requests
+// are at least Delay (or the host's Crawl-delay) apart
+func (c *Crawler) get(ctx context.Context, u *url.URL) (*http.Response, error) {
+	delay := c.Delay
+	c.mu.Lock()
+	if rules, ok := c.robots[u.Scheme+"://"+u.Host]; ok && rules.delay > delay {
+		delay = rules.delay
+	}
+	wait := time.Until(c.last.Add(delay))
+	c.mu.Unlock()
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	client := c.Client
+	if client == nil {
+		client = defaultClient
+	}
+	c.mu.Lock()
+	c.last = time.Now()
+	c.mu.Unlock()
+	return client.Do(req)
+}
@@ -0,0 +1,246 @@
+package crawl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// site serves a small site linking to other, a second host
+func site(t *testing.T, other string) *httptest.Server {
+	t.Helper()
+	pages := map[string]string{
+		"/robots.txt": "User-agent: *\nDisallow: /private/\n",
+		"/": `<html><body>
+			<a href="/a">A</a> <a href="b#top">B</a> <a href="/private/secret">Secret</a>
+			<a href="` + other + `/elsewhere">Elsewhere</a> <a href="mailto:me@example.com">Mail</a>
+			<img src="/img/missing.png">
+			<img src="/img/empty.png" alt="">
+			<img src="/img/hidden.png" role="presentation">
+			<img src="/img/name.png" alt="IMG_0042.jpg">
+			<img src="/img/good.png" alt="A red bicycle leaning on a wall">
+			<img src="/private/photo.png">
+		</body></html>`,
+		"/a":              `<a href="/a/deeper">Deeper</a> <a href="/">Home</a> <img src="pic.png" alt="photo">`,
+		"/b":              `<a href="/a">A</a>`,
+		"/a/deeper":       `<a href="/a/deepest">Deepest</a>`,
+		"/a/deepest":      `<p>The end</p>`,
+		"/private/secret": `<p>Hidden</p>`,
+		"/sitemap.xml":    `<urlset><url><loc>/b</loc></url><url><loc>/a/deepest</loc></url></urlset>`,
+		"/sitemaps.xml":   `<sitemapindex><sitemap><loc>/sitemap.xml</loc></sitemap></sitemapindex>`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".xml") || r.URL.Path == "/robots.txt" {
+			w.Header().Set("Content-Type", "text/plain")
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// crawl runs c from starts on base and returns each page crawled, and its
+// path and depth
+func crawl(t *testing.T, c *Crawler, base string, starts ...string) ([]string, []Page) {
+	t.Helper()
+	var visited []string
+	var pages []Page
+	for i := range starts {
+		starts[i] = base + starts[i]
+	}
+	err := c.Run(context.Background(), starts, func(p Page) error {
+		if p.Err != nil {
+			t.Errorf("%s: %v", p.URL, p.Err)
+		}
+		visited = append(visited, fmt.Sprintf("%s@%d", strings.TrimPrefix(p.URL, base), p.Depth))
+		pages = append(pages, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return visited, pages
+}
+
+func TestRunLimits(t *testing.T) {
+	var otherHits atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherHits.Add(1)
+	}))
+	defer other.Close()
+	srv := site(t, other.URL)
+
+	tests := []struct {
+		name     string
+		maxDepth int
+		maxPages int
+		starts   []string
+		want     []string
+	}{
+		{"start page only", 0, 0, []string{"/"}, []string{"/@0"}},
+		{"one link away", 1, 0, []string{"/"}, []string{"/@0", "/a@1", "/b@1"}},
+		{"two links away", 2, 0, []string{"/"}, []string{"/@0", "/a@1", "/b@1", "/a/deeper@2"}},
+		{"every page", 10, 0, []string{"/"}, []string{"/@0", "/a@1", "/b@1", "/a/deeper@2", "/a/deepest@3"}},
+		{"page limit", 10, 2, []string{"/"}, []string{"/@0", "/a@1"}},
+		{"disallowed start", 10, 0, []string{"/private/secret"}, nil},
+		{"sitemap index", 0, 0, []string{"/sitemaps.xml"}, []string{"/b@0", "/a/deepest@0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Crawler{UserAgent: "alt-text-test", MaxDepth: tt.maxDepth, MaxPages: tt.maxPages}
+			if got, _ := crawl(t, c, srv.URL, tt.starts...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("crawled %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if n := otherHits.Load(); n != 0 {
+		t.Errorf("fetched %d pages from another host", n)
+	}
+}
+
+func TestRunImages(t *testing.T) {
+	srv := site(t, "http://other.example")
+	_, pages := crawl(t, &Crawler{UserAgent: "alt-text-test"}, srv.URL, "/")
+	if len(pages) != 1 {
+		t.Fatalf("crawled %d pages, want 1", len(pages))
+	}
+	want := []Image{
+		{Src: srv.URL + "/img/missing.png", Issue: "missing alt"},
+		{Src: srv.URL + "/img/empty.png", HasAlt: true},
+		{Src: srv.URL + "/img/hidden.png"},
+		{Src: srv.URL + "/img/name.png", Alt: "IMG_0042.jpg", HasAlt: true, Issue: "alt is a file name"},
+		{Src: srv.URL + "/img/good.png", Alt: "A red bicycle leaning on a wall", HasAlt: true},
+		{Src: srv.URL + "/private/photo.png", Issue: "missing alt", Disallowed: true},
+	}
+	if got := pages[0].Images; !reflect.DeepEqual(got, want) {
+		t.Errorf("images =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	srv := site(t, "http://other.example")
+	c := &Crawler{UserAgent: "alt-text-test"}
+	var got []Page
+	err := c.Run(context.Background(), []string{srv.URL + "/missing", srv.URL + "/robots.txt"}, func(p Page) error {
+		got = append(got, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Err == nil || !strings.Contains(got[0].Err.Error(), "404") ||
+		got[1].Err == nil || !strings.Contains(got[1].Err.Error(), "not an HTML page") {
+		t.Errorf("pages = %+v, want a 404 and a non-HTML error", got)
+	}
+
+	if err := c.Run(context.Background(), []string{"ftp://example.com/"}, nil); err == nil {
+		t.Error("crawled an ftp URL")
+	}
+	stop := errors.New("stop")
+	if err := c.Run(context.Background(), []string{srv.URL + "/"}, func(Page) error { return stop }); err != stop {
+		t.Errorf("Run err = %v, want visit's error", err)
+	}
+}
+
+func TestCrawlDelay(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path == "/robots.txt" {
+			fmt.Fprint(w, "User-agent: *\nCrawl-delay: 10\n")
+			return
+		}
+		fmt.Fprint(w, `<a href="/next">Next</a>`)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	c := &Crawler{UserAgent: "alt-text-test", MaxDepth: 1}
+	var pages []Page
+	if err := c.Run(ctx, []string{srv.URL + "/"}, func(p Page) error {
+		pages = append(pages, p)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Once robots.txt asks for 10s between requests, the start page waits
+	if len(pages) != 1 || !errors.Is(pages[0].Err, context.DeadlineExceeded) || hits.Load() != 1 {
+		t.Errorf("pages = %+v after %d requests, want the start page waiting out the crawl delay", pages, hits.Load())
+	}
+}
+
+func TestAltIssue(t *testing.T) {
+	tests := []struct {
+		alt    string
+		hasAlt bool
+		want   string
+	}{
+		{"", false, "missing alt"},
+		{"", true, ""},
+		{"   ", true, ""},
+		{"hero-banner_2.JPEG", true, "alt is a file name"},
+		{"Image.", true, "generic alt"},
+		{"PHOTO", true, "generic alt"},
+		{"A photo of the harbour at dusk", true, ""},
+	}
+	for _, tt := range tests {
+		if got := AltIssue(tt.alt, tt.hasAlt); got != tt.want {
+			t.Errorf("AltIssue(%q, %v) = %q, want %q", tt.alt, tt.hasAlt, got, tt.want)
+		}
+	}
+}
+
+func TestParseRobots(t *testing.T) {
+	txt := `# comments are ignored
+User-agent: *
+Disallow: /private/
+Allow: /private/press/
+
+User-agent: other-bot
+User-agent: alt-text
+Disallow: /*.pdf$
+Disallow: /drafts
+Allow: /drafts/public
+Crawl-delay: 1.5
+`
+	tests := []struct {
+		agent string
+		path  string
+		want  bool
+	}{
+		{"Mozilla/5.0 (compatible; Alt-Text/1.0)", "/private/x", true},
+		{"Mozilla/5.0 (compatible; Alt-Text/1.0)", "/guide.pdf", false},
+		{"Mozilla/5.0 (compatible; Alt-Text/1.0)", "/guide.pdf?page=2", true},
+		{"Mozilla/5.0 (compatible; Alt-Text/1.0)", "/drafts/2026", false},
+		{"Mozilla/5.0 (compatible; Alt-Text/1.0)", "/drafts/public/1", true},
+		{"somebot", "/private/x", false},
+		{"somebot", "/private/press/release", true},
+		{"somebot", "/guide.pdf", true},
+	}
+	for _, tt := range tests {
+		if got := parseRobots(strings.NewReader(txt), tt.agent).allowed(tt.path); got != tt.want {
+			t.Errorf("%s allowed(%q) = %v, want %v", tt.agent, tt.path, got, tt.want)
+		}
+	}
+	if delay := parseRobots(strings.NewReader(txt), "alt-text").delay; delay != 1500*time.Millisecond {
+		t.Errorf("delay = %v, want 1.5s", delay)
+	}
+	if r := parseRobots(strings.NewReader("Sitemap: /sitemap.xml\n"), "alt-text"); r != allowAll {
+		t.Error("robots.txt without groups doesn't allow everything")
+	}
+}
@@ -0,0 +1,126 @@
+package crawl
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// robots holds the robots.txt rules that apply to the crawler on one host
+type robots struct {
+	rules []robotsRule
+	delay time.Duration
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// allowAll and disallowAll stand in for hosts whose robots.txt is missing
+// or can't be read
+var (
+	allowAll    = &robots{}
+	disallowAll = &robots{rules: []robotsRule{{allow: false, pattern: "/"}}}
+)
+
+// parseRobots reads the group of a robots.txt file that applies to agent,
+// falling back to the "*" group (RFC 9309)
+func parseRobots(r io.Reader, agent string) *robots {
+	agent = strings.ToLower(agent)
+	var specific, fallback *robots
+	var current []*robots
+	inAgents := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+
+		if key == "user-agent" {
+			if !inAgents {
+				current = nil
+				inAgents = true
+			}
+			name := strings.ToLower(value)
+			switch {
+			case name == "*":
+				if fallback == nil {
+					fallback = &robots{}
+				}
+				current = append(current, fallback)
+			case name != "" && strings.Contains(agent, name):
+				if specific == nil {
+					specific = &robots{}
+				}
+				current = append(current, specific)
+			}
+			continue
+		}
+		inAgents = false
+		for _, group := range current {
+			switch key {
+			case "allow", "disallow":
+				if value != "" {
+					group.rules = append(group.rules, robotsRule{allow: key == "allow", pattern: value})
+				}
+			case "crawl-delay":
+				if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+					group.delay = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		}
+	}
+
+	switch {
+	case specific != nil:
+		return specific
+	case fallback != nil:
+		return fallback
+	}
+	return allowAll
+}
+
+// allowed reports whether path (including any query) may be fetched. The
+// longest matching rule wins, and allow wins a tie.
+func (r *robots) allowed(path string) bool {
+	best, allow := -1, true
+	for _, rule := range r.rules {
+		if !matchRobots(rule.pattern, path) {
+			continue
+		}
+		if n := len(rule.pattern); n > best || (n == best && rule.allow) {
+			best, allow = n, rule.allow
+		}
+	}
+	return allow
+}
+
+// matchRobots matches a robots.txt path pattern, where * matches any run of
+// characters and a trailing $ anchors the end of the path
+func matchRobots(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			return strings.HasSuffix(rest, part)
+		}
+		index := strings.Index(rest, part)
+		if index < 0 {
+			return false
+		}
+		rest = rest[index+len(part):]
+	}
+	return !anchored || rest == ""
+}
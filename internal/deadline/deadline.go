@@ -0,0 +1,215 @@
+// Package deadline gives each stage of a generation request its own time
+// limit, on top of a budget for the request as a whole, and names the stage
+// that ran out, so a slow client can be told apart from a slow model. The
+// stages are receiving the upload, preparing it until a provider call can
+// start, which includes waiting for a worker, and the provider call itself.
+package deadline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"alt-text-generator/internal/config"
+)
+
+// Stage names a part of handling a generation request
+type Stage string
+
+const (
+	Upload     Stage = "upload"
+	Preprocess Stage = "preprocess"
+	Provider   Stage = "provider"
+	Total      Stage = "total"
+)
+
+// Stages lists every stage, in the order a request goes through them
+var Stages = []Stage{Upload, Preprocess, Provider, Total}
+
+// defaultProviderTimeout matches the provider timeout's default
+const defaultProviderTimeout = 2 * time.Minute
+
+// Error reports that a stage ran out of time. It matches
+// context.DeadlineExceeded, so it's handled as any other timeout.
+type Error struct {
+	Stage Stage
+	// Limit is the stage's time limit, or 0 when it isn't known
+	Limit time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Limit <= 0 {
+		return fmt.Sprintf("%s stage timed out", e.Stage)
+	}
+	return fmt.Sprintf("%s stage timed out after %s", e.Stage, e.Limit)
+}
+
+func (e *Error) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// Budgets are the time limits for each stage. Zero is no limit.
+type Budgets struct {
+	Upload     time.Duration
+	Preprocess time.Duration
+	Provider   time.Duration
+	Total      time.Duration
+}
+
+// FromEnv reads the budgets from REQUEST_UPLOAD_TIMEOUT,
+// REQUEST_PREPROCESS_TIMEOUT, PROVIDER_TIMEOUT, and REQUEST_TIMEOUT
+func FromEnv() Budgets {
+	return Budgets{
+		Upload:     config.GetDuration("REQUEST_UPLOAD_TIMEOUT", 0),
+		Preprocess: config.GetDuration("REQUEST_PREPROCESS_TIMEOUT", 0),
+		Provider:   config.GetDuration("PROVIDER_TIMEOUT", defaultProviderTimeout),
+		Total:      config.GetDuration("REQUEST_TIMEOUT", 0),
+	}
+}
+
+// limit is the budget for stage
+func (b Budgets) limit(stage Stage) time.Duration {
+	switch stage {
+	case Upload:
+		return b.Upload
+	case Preprocess:
+		return b.Preprocess
+	case Provider:
+		return b.Provider
+	case Total:
+		return b.Total
+	}
+	return 0
+}
+
+// request tracks a request's progress through the stages
+type request struct {
+	budgets    Budgets
+	controller *http.ResponseController
+	// expired is set once the upload deadline has passed
+	expired bool
+
+	mu       sync.Mutex
+	received time.Time
+}
+
+type contextKey struct{}
+
+// Middleware bounds each request by the total budget and gives it the
+// upload budget to send its body in, after which reading the body fails
+// with an upload Error. Handlers call Received once they have the body.
+func (b Budgets) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if b.Total > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeoutCause(ctx, b.Total, &Error{Stage: Total, Limit: b.Total})
+			defer cancel()
+		}
+		req := &request{budgets: b}
+		if b.Upload > 0 {
+			// Not every connection supports read deadlines; those requests
+			// just aren't given one
+			controller := http.NewResponseController(w)
+			if err := controller.SetReadDeadline(time.Now().Add(b.Upload)); err == nil {
+				req.controller = controller
+				r.Body = &uploadBody{ReadCloser: r.Body, req: req}
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, contextKey{}, req)))
+		// In case the handler never read the whole body
+		req.clearReadDeadline()
+	})
+}
+
+// clearReadDeadline lifts the upload deadline. Left in place, it would
+// cancel the request once it passed, since the server reads ahead to notice
+// clients hanging up. One that has already passed stays, so the server
+// doesn't wait on the rest of the body before answering.
+func (r *request) clearReadDeadline() {
+	if r.controller != nil && !r.expired {
+		r.controller.SetReadDeadline(time.Time{})
+	}
+}
+
+// uploadBody reports a read deadline passing as the upload stage timing out
+type uploadBody struct {
+	io.ReadCloser
+	req *request
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		b.req.expired = true
+		err = &Error{Stage: Upload, Limit: b.req.budgets.Upload}
+	}
+	if err == io.EOF {
+		b.req.clearReadDeadline()
+	}
+	return n, err
+}
+
+// Received marks the upload as complete, lifting its deadline and starting
+// the preprocess stage's clock
+func Received(ctx context.Context) {
+	req, _ := ctx.Value(contextKey{}).(*request)
+	if req == nil {
+		return
+	}
+	req.clearReadDeadline()
+	req.mu.Lock()
+	defer req.mu.Unlock()
+	if req.received.IsZero() {
+		req.received = time.Now()
+	}
+}
+
+// Preprocessing returns a copy of ctx that's done when the preprocess
+// stage's budget, counted from Received, runs out, for waiting until a
+// provider call can start. Without a budget it returns ctx as it is.
+func Preprocessing(ctx context.Context) (context.Context, context.CancelFunc) {
+	req, _ := ctx.Value(contextKey{}).(*request)
+	if req == nil || req.budgets.Preprocess <= 0 {
+		return ctx, func() {}
+	}
+	req.mu.Lock()
+	start := req.received
+	req.mu.Unlock()
+	if start.IsZero() {
+		start = time.Now()
+	}
+	return context.WithDeadlineCause(ctx, start.Add(req.budgets.Preprocess), &Error{Stage: Preprocess, Limit: req.budgets.Preprocess})
+}
+
+// Explain turns a timeout in stage into an Error naming the stage that ran
+// out of time: one enclosing it, such as the whole request's budget, if its
+// deadline passed, else stage itself. Other errors are returned as they are.
+func Explain(ctx context.Context, err error, stage Stage) error {
+	if err == nil || !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	var e *Error
+	if errors.As(err, &e) || errors.As(context.Cause(ctx), &e) {
+		return e
+	}
+	budgets := FromEnv()
+	if req, _ := ctx.Value(contextKey{}).(*request); req != nil {
+		budgets = req.budgets
+	}
+	return &Error{Stage: stage, Limit: budgets.limit(stage)}
+}
+
+// StageOf returns the stage that ran out of time when err is a timeout Error
+func StageOf(err error) (Stage, bool) {
+	var e *Error
+	if !errors.As(err, &e) {
+		return "", false
+	}
+	return e.Stage, true
+}
@@ -0,0 +1,221 @@
+// Package diagnostics serves profiles and runtime stats for investigating a
+// running server, such as memory growth from large uploads. It doesn't use
+// net/http/pprof, whose import alone would publish the profiles on the main
+// server's mux.
+package diagnostics
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"time"
+
+	"alt-text-generator/internal/version"
+)
+
+// maxSeconds caps how long a CPU profile or trace may record
+const maxSeconds = 120
+
+// Handler serves the profiles under /debug/pprof/, in the format go tool
+// pprof reads, and runtime stats at /debug/runtime
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/{$}", indexHandler)
+	mux.HandleFunc("GET /debug/pprof/profile", cpuHandler)
+	mux.HandleFunc("GET /debug/pprof/trace", traceHandler)
+	mux.HandleFunc("GET /debug/pprof/{name}", profileHandler)
+	mux.HandleFunc("GET /debug/runtime", RuntimeHandler)
+	mux.HandleFunc("POST /debug/gc", GCHandler)
+	return mux
+}
+
+// indexHandler lists the profiles
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<!DOCTYPE html><title>Profiles</title><ul>")
+	for _, p := range pprof.Profiles() {
+		name := html.EscapeString(p.Name())
+		fmt.Fprintf(w, "<li><a href=\"%s?debug=1\">%s</a> (%d)</li>\n", name, name, p.Count())
+	}
+	fmt.Fprintln(w, `<li><a href="profile?seconds=30">profile</a> (CPU, 30 seconds)</li>`)
+	fmt.Fprintln(w, `<li><a href="trace?seconds=5">trace</a> (5 seconds)</li>`)
+	fmt.Fprintln(w, "</ul>")
+}
+
+// profileHandler writes a named profile, such as heap or goroutine. With
+// ?debug=1 or 2 it is text; otherwise it is gzipped protobuf. With ?gc=1 a
+// garbage collection runs first, so a heap profile shows only live memory.
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	p := pprof.Lookup(r.PathValue("name"))
+	if p == nil {
+		http.Error(w, "Unknown profile", http.StatusNotFound)
+		return
+	}
+	debugLevel, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+	if r.URL.Query().Get("gc") == "1" {
+		runtime.GC()
+	}
+	if debugLevel > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+p.Name()+`"`)
+	}
+	p.WriteTo(w, debugLevel)
+}
+
+// cpuHandler records a CPU profile for ?seconds=, 30 by default
+func cpuHandler(w http.ResponseWriter, r *http.Request) {
+	d, ok := duration(w, r, 30)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		// Only one CPU profile can run at a time
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "Could not start a CPU profile: "+err.Error(), http.StatusConflict)
+		return
+	}
+	record(r, d)
+	pprof.StopCPUProfile()
+}
+
+// traceHandler records an execution trace for ?seconds=, 1 by default
+func traceHandler(w http.ResponseWriter, r *http.Request) {
+	d, ok := duration(w, r, 1)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "Could not start a trace: "+err.Error(), http.StatusConflict)
+		return
+	}
+	record(r, d)
+	trace.Stop()
+}
+
+// duration reads ?seconds=, answering 400 if it isn't between 1 and
+// maxSeconds
+func duration(w http.ResponseWriter, r *http.Request, def int) (time.Duration, bool) {
+	seconds := def
+	if v := r.URL.Query().Get("seconds"); v != "" {
+		var err error
+		if seconds, err = strconv.Atoi(v); err != nil || seconds < 1 || seconds > maxSeconds {
+			http.Error(w, fmt.Sprintf("seconds must be between 1 and %d", maxSeconds), http.StatusBadRequest)
+			return 0, false
+		}
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// record waits for d, or until the client goes away
+func record(r *http.Request, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+}
+
+// Stats is a snapshot of the Go runtime
+type Stats struct {
+	Version    string `json:"version"`
+	GoVersion  string `json:"go_version"`
+	Goroutines int    `json:"goroutines"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	CPUs       int    `json:"cpus"`
+	Memory     Memory `json:"memory"`
+	GC         GC     `json:"gc"`
+}
+
+// Memory is the runtime's memory use, in bytes
+type Memory struct {
+	// Sys is everything obtained from the OS
+	Sys          uint64 `json:"sys"`
+	HeapAlloc    uint64 `json:"heap_alloc"`
+	HeapInuse    uint64 `json:"heap_inuse"`
+	HeapIdle     uint64 `json:"heap_idle"`
+	HeapReleased uint64 `json:"heap_released"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	StackInuse   uint64 `json:"stack_inuse"`
+	// TotalAlloc counts every byte ever allocated, freed or not
+	TotalAlloc uint64 `json:"total_alloc"`
+	// Limit is GOMEMLIMIT, or 0 when it isn't set
+	Limit int64 `json:"limit,omitempty"`
+}
+
+// GC is the garbage collector's progress
+type GC struct {
+	Cycles uint32 `json:"cycles"`
+	// NextHeap is the heap size that triggers the next collection
+	NextHeap   uint64        `json:"next_heap"`
+	Last       *time.Time    `json:"last,omitempty"`
+	PauseTotal time.Duration `json:"pause_total_ns"`
+	CPUPercent float64       `json:"cpu_percent"`
+}
+
+// ReadStats takes a snapshot of the runtime. It briefly stops the world, so
+// it's for on-demand use rather than frequent polling.
+func ReadStats() Stats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats := Stats{
+		Version:    version.Version,
+		GoVersion:  runtime.Version(),
+		Goroutines: runtime.NumGoroutine(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		CPUs:       runtime.NumCPU(),
+		Memory: Memory{
+			Sys:          m.Sys,
+			HeapAlloc:    m.HeapAlloc,
+			HeapInuse:    m.HeapInuse,
+			HeapIdle:     m.HeapIdle,
+			HeapReleased: m.HeapReleased,
+			HeapObjects:  m.HeapObjects,
+			StackInuse:   m.StackInuse,
+			TotalAlloc:   m.TotalAlloc,
+		},
+		GC: GC{
+			Cycles:     m.NumGC,
+			NextHeap:   m.NextGC,
+			PauseTotal: time.Duration(m.PauseTotalNs),
+			CPUPercent: m.GCCPUFraction * 100,
+		},
+	}
+	if limit := debug.SetMemoryLimit(-1); limit < 1<<63-1 {
+		stats.Memory.Limit = limit
+	}
+	if m.LastGC > 0 {
+		last := time.Unix(0, int64(m.LastGC)).UTC()
+		stats.GC.Last = &last
+	}
+	return stats
+}
+
+// RuntimeHandler reports a snapshot of the runtime as JSON
+func RuntimeHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, ReadStats())
+}
+
+// GCHandler runs a garbage collection and returns memory to the OS, then
+// reports the runtime as RuntimeHandler does, to tell memory still in use
+// from garbage not yet collected
+func GCHandler(w http.ResponseWriter, r *http.Request) {
+	debug.FreeOSMemory()
+	writeJSON(w, ReadStats())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
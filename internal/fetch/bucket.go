@@ -0,0 +1,166 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Bucket is a prefix in an S3 or Cloud Storage bucket that objects, such as
+// uploaded images and results, are written to and read back from, with the
+// same credentials as fetching from buckets
+type Bucket struct {
+	scheme string
+	name   string
+	prefix string
+	// sse is the S3 server-side encryption, AES256 or aws:kms
+	sse string
+	// kmsKey encrypts objects: an AWS KMS key ID for S3, or a Cloud KMS key
+	// name for Cloud Storage
+	kmsKey string
+}
+
+// OpenBucket returns the bucket at an s3://bucket/prefix or
+// gs://bucket/prefix URL. For S3, sse asks for server-side encryption with
+// S3-managed keys (AES256) or KMS keys (aws:kms); Cloud Storage always
+// encrypts objects. kmsKey names the KMS key to encrypt with instead of the
+// default, and implies aws:kms on S3.
+func OpenBucket(rawURL, sse, kmsKey string) (*Bucket, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || u.Scheme != "s3" && u.Scheme != "gs" {
+		return nil, errors.New("object storage URL must look like s3://bucket/prefix or gs://bucket/prefix")
+	}
+	b := &Bucket{scheme: u.Scheme, name: u.Host, prefix: strings.TrimPrefix(u.Path, "/"), sse: sse, kmsKey: kmsKey}
+	if b.prefix != "" && !strings.HasSuffix(b.prefix, "/") {
+		b.prefix += "/"
+	}
+	if b.scheme == "gs" {
+		if sse != "" {
+			return nil, errors.New("server-side encryption modes only apply to S3; Cloud Storage always encrypts objects")
+		}
+		return b, nil
+	}
+	if kmsKey != "" && sse == "" {
+		b.sse = "aws:kms"
+	}
+	if b.sse != "" && b.sse != "AES256" && b.sse != "aws:kms" {
+		return nil, fmt.Errorf("unknown S3 server-side encryption %q: use AES256 or aws:kms", sse)
+	}
+	if kmsKey != "" && b.sse != "aws:kms" {
+		return nil, errors.New("a KMS key needs aws:kms server-side encryption")
+	}
+	return b, nil
+}
+
+// String returns the bucket's URL
+func (b *Bucket) String() string {
+	return b.scheme + "://" + b.name + "/" + b.prefix
+}
+
+// Put writes data to key, under the bucket's prefix
+func (b *Bucket) Put(ctx context.Context, key, contentType string, data []byte) error {
+	var req *http.Request
+	var err error
+	if b.scheme == "s3" {
+		header := http.Header{}
+		header.Set("Content-Type", contentType)
+		if b.sse != "" {
+			header.Set("X-Amz-Server-Side-Encryption", b.sse)
+		}
+		if b.kmsKey != "" {
+			header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", b.kmsKey)
+		}
+		req, err = s3Request(ctx, http.MethodPut, b.name, b.prefix+key, data, header)
+	} else {
+		query := url.Values{"uploadType": {"media"}, "name": {b.prefix + key}}
+		if b.kmsKey != "" {
+			query.Set("kmsKeyName", b.kmsKey)
+		}
+		rawURL := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", gcsEndpoint(), url.PathEscape(b.name), query.Encode())
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, rawURL, bytes.NewReader(data)); err == nil {
+			req.Header.Set("Content-Type", contentType)
+			req, err = authorizeGCS(ctx, req, googleWriteTokens)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to write %s%s: %v", b, key, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to write %s%s: %s", b, key, resp.Status)
+	}
+	return nil
+}
+
+// Get reads the object at key, under the bucket's prefix, and reports
+// whether there was one
+func (b *Bucket) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	var req *http.Request
+	var err error
+	if b.scheme == "s3" {
+		req, err = newS3Request(ctx, b.name, b.prefix+key)
+	} else {
+		req, err = newGCSRequest(ctx, b.name, b.prefix+key)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read %s%s: %v", b, key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("failed to read %s%s: %s", b, key, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read %s%s: %v", b, key, err)
+	}
+	return data, true, nil
+}
+
+// Delete removes the object at key, under the bucket's prefix. An object
+// that isn't there counts as deleted.
+func (b *Bucket) Delete(ctx context.Context, key string) error {
+	var req *http.Request
+	var err error
+	if b.scheme == "s3" {
+		req, err = s3Request(ctx, http.MethodDelete, b.name, b.prefix+key, nil, nil)
+	} else {
+		rawURL := fmt.Sprintf("%s/storage/v1/b/%s/o/%s", gcsEndpoint(), url.PathEscape(b.name), url.PathEscape(b.prefix+key))
+		if req, err = http.NewRequestWithContext(ctx, http.MethodDelete, rawURL, nil); err == nil {
+			req, err = authorizeGCS(ctx, req, googleWriteTokens)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s%s: %v", b, key, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("failed to delete %s%s: %s", b, key, resp.Status)
+}
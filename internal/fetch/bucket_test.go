@@ -0,0 +1,51 @@
+package fetch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBucketDelete(t *testing.T) {
+	var requests []string
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.EscapedPath())
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_ENDPOINT_URL_S3", srv.URL)
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "GOOGLE_OAUTH_ACCESS_TOKEN"} {
+		t.Setenv(name, "")
+	}
+
+	tests := []struct {
+		bucket string
+		want   string
+	}{
+		{"s3://store/alt-text", "DELETE /store/alt-text/results/1.json"},
+		{"gs://store/alt-text", "DELETE /storage/v1/b/store/o/alt-text%2Fresults%2F1.json"},
+	}
+	for _, tt := range tests {
+		b, err := OpenBucket(tt.bucket, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, status = range []int{http.StatusNoContent, http.StatusOK, http.StatusNotFound} {
+			requests = nil
+			if err := b.Delete(context.Background(), "results/1.json"); err != nil {
+				t.Errorf("%s Delete with %d: %v", tt.bucket, status, err)
+			}
+			if len(requests) != 1 || requests[0] != tt.want {
+				t.Errorf("%s requests = %q, want %q", tt.bucket, requests, tt.want)
+			}
+		}
+		status = http.StatusForbidden
+		if err := b.Delete(context.Background(), "results/1.json"); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Errorf("%s Delete with 403 err = %v", tt.bucket, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// MaxImageSize is the largest image that will be downloaded
+const MaxImageSize = 5 * 1024 * 1024
+
+// ErrTooLarge is returned for an image larger than MaxImageSize
+var ErrTooLarge = errors.New("image exceeds 5 MB maximum")
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// Image is a downloaded image and the name it should be recorded under
+type Image struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// FetchImage downloads an image, refusing anything larger than MaxImageSize.
+// rawURL is an http(s) URL (including presigned URLs), an s3://bucket/key
+// reference, or a gs://bucket/object reference; bucket references are read
+// with the cloud credentials configured in the environment. Any URL is
+// fetched, so URLs from API callers go through a Guard instead.
+func FetchImage(ctx context.Context, rawURL string) (Image, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Image{}, fmt.Errorf("invalid URL: %v", err)
+	}
+	return fetchImage(ctx, client, u)
+}
+
+// fetchImage downloads the image at u, fetching http(s) URLs with web
+func fetchImage(ctx context.Context, web *http.Client, u *url.URL) (Image, error) {
+	var req *http.Request
+	var err error
+	do := client.Do
+	switch u.Scheme {
+	case "http", "https":
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		do = web.Do
+	case "s3":
+		req, err = newS3Request(ctx, u.Host, strings.TrimPrefix(u.Path, "/"))
+	case "gs":
+		req, err = newGCSRequest(ctx, u.Host, strings.TrimPrefix(u.Path, "/"))
+	default:
+		return Image{}, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return Image{}, err
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := do(req)
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to download image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Image{}, fmt.Errorf("failed to download image: %s", resp.Status)
+	}
+	if resp.ContentLength > MaxImageSize {
+		return Image{}, ErrTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxImageSize+1))
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to read image: %v", err)
+	}
+	if len(data) > MaxImageSize {
+		return Image{}, ErrTooLarge
+	}
+
+	return Image{
+		Filename:    path.Base(u.Path),
+		ContentType: http.DetectContentType(data),
+		Data:        data,
+	}, nil
+}
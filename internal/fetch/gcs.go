@@ -0,0 +1,223 @@
+package fetch
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcsReadScope  = "https://www.googleapis.com/auth/devstorage.read_only"
+	gcsWriteScope = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// newGCSRequest builds a GET for gs://bucket/object through the JSON API,
+// authorized with a Google access token when one can be obtained.
+// STORAGE_EMULATOR_HOST points at a local emulator instead of Google.
+func newGCSRequest(ctx context.Context, bucket, object string) (*http.Request, error) {
+	if bucket == "" || object == "" {
+		return nil, fmt.Errorf("GCS URL must look like gs://bucket/object")
+	}
+	rawURL := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", gcsEndpoint(), url.PathEscape(bucket), url.PathEscape(object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return authorizeGCS(ctx, req, googleTokens)
+}
+
+// gcsEndpoint is the Cloud Storage API, or the emulator at
+// STORAGE_EMULATOR_HOST
+func gcsEndpoint() string {
+	endpoint := "https://storage.googleapis.com"
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		endpoint = strings.TrimSuffix(host, "/")
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+	}
+	return endpoint
+}
+
+// authorizeGCS adds a token from tokens to req, if one can be obtained
+func authorizeGCS(ctx context.Context, req *http.Request, tokens *googleTokenSource) (*http.Request, error) {
+	token, err := tokens.token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Google credentials: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// googleTokenSource finds and caches an OAuth access token for Cloud Storage
+// with its scope. It tries, in order: GOOGLE_OAUTH_ACCESS_TOKEN, the service
+// account key file named by GOOGLE_APPLICATION_CREDENTIALS, and the GCE/Cloud
+// Run metadata server. With none available requests go out unauthenticated,
+// which works for public objects.
+type googleTokenSource struct {
+	scope       string
+	mu          sync.Mutex
+	accessToken string
+	expires     time.Time
+	noMetadata  bool
+}
+
+var (
+	googleTokens      = &googleTokenSource{scope: gcsReadScope}
+	googleWriteTokens = &googleTokenSource{scope: gcsWriteScope}
+)
+
+func (s *googleTokenSource) token(ctx context.Context) (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accessToken != "" && time.Now().Before(s.expires.Add(-time.Minute)) {
+		return s.accessToken, nil
+	}
+
+	var token string
+	var expiresIn int
+	var err error
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		token, expiresIn, err = serviceAccountToken(ctx, path, s.scope)
+	} else if !s.noMetadata {
+		token, expiresIn, err = metadataToken(ctx, s.scope)
+		if err != nil && s.accessToken == "" {
+			// Not running on Google Cloud; don't probe again
+			s.noMetadata = true
+			return "", nil
+		}
+	}
+	if err != nil || token == "" {
+		return "", err
+	}
+
+	s.accessToken = token
+	s.expires = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	return token, nil
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// serviceAccountToken exchanges a JWT signed with the service account's key
+// for an access token with scope (RFC 7523)
+func serviceAccountToken(ctx context.Context, path, scope string) (string, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	var account struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &account); err != nil {
+		return "", 0, fmt.Errorf("invalid credentials file: %v", err)
+	}
+	if account.Type != "service_account" {
+		return "", 0, fmt.Errorf("credentials file type %q is not supported", account.Type)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return "", 0, errors.New("credentials file has no private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", 0, errors.New("private key is not RSA")
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"scope": scope,
+		"aud":   account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", 0, err
+	}
+	assertion := signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return requestToken(req)
+}
+
+// metadataToken asks the instance metadata server for the attached service
+// account's token with scope
+func metadataToken(ctx context.Context, scope string) (string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token?scopes="+url.QueryEscape(scope), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return requestToken(req)
+}
+
+func requestToken(req *http.Request) (string, int, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token request failed: %s", resp.Status)
+	}
+
+	var token tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", 0, err
+	}
+	return token.AccessToken, token.ExpiresIn, nil
+}
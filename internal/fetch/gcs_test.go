@@ -0,0 +1,216 @@
+package fetch
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// clearGoogleEnv unsets every way of finding Google credentials
+func clearGoogleEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"GOOGLE_OAUTH_ACCESS_TOKEN", "GOOGLE_APPLICATION_CREDENTIALS", "GCE_METADATA_HOST", "STORAGE_EMULATOR_HOST"} {
+		t.Setenv(name, "")
+	}
+}
+
+// tokenServer checks service account assertions signed by key and answers
+// with an access token, counting the requests
+func tokenServer(t *testing.T, key *rsa.PrivateKey, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, "bad grant", http.StatusBadRequest)
+			return
+		}
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, "bad assertion", http.StatusBadRequest)
+			return
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims struct {
+			Iss   string `json:"iss"`
+			Scope string `json:"scope"`
+			Aud   string `json:"aud"`
+			Iat   int64  `json:"iat"`
+			Exp   int64  `json:"exp"`
+		}
+		json.Unmarshal(payload, &claims)
+		if claims.Iss != "reader@project.iam.gserviceaccount.com" || claims.Aud != "http://"+r.Host+"/token" || claims.Exp-claims.Iat != 3600 {
+			http.Error(w, "bad claims", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "token-for " + claims.Scope, ExpiresIn: 3600})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// writeServiceAccount writes a credentials file for key whose tokens come
+// from tokenURI
+func writeServiceAccount(t *testing.T, key *rsa.PrivateKey, tokenURI string) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "reader@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    tokenURI,
+	})
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestServiceAccountToken(t *testing.T) {
+	clearGoogleEnv(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests atomic.Int32
+	srv := tokenServer(t, key, &requests)
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", writeServiceAccount(t, key, srv.URL+"/token"))
+
+	tokens := &googleTokenSource{scope: gcsReadScope}
+	for range 2 {
+		token, err := tokens.token(context.Background())
+		if err != nil {
+			t.Fatalf("token: %v", err)
+		}
+		if token != "token-for "+gcsReadScope {
+			t.Errorf("token = %q", token)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("token endpoint called %d times, want the token cached", n)
+	}
+
+	// A key the token endpoint doesn't know is refused
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", writeServiceAccount(t, other, srv.URL+"/token"))
+	if _, err := (&googleTokenSource{scope: gcsReadScope}).token(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("token with an unknown key err = %v, want a 401", err)
+	}
+}
+
+func TestServiceAccountTokenBadFiles(t *testing.T) {
+	clearGoogleEnv(t)
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"not JSON", "{", "invalid credentials file"},
+		{"user credentials", `{"type": "authorized_user"}`, `credentials file type "authorized_user" is not supported`},
+		{"no key", `{"type": "service_account", "private_key": "none"}`, "credentials file has no private key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, _, err := serviceAccountToken(context.Background(), path, gcsReadScope)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMetadataToken(t *testing.T) {
+	clearGoogleEnv(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "metadata " + r.URL.Query().Get("scopes"), ExpiresIn: 600})
+	}))
+	defer srv.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+
+	token, err := (&googleTokenSource{scope: gcsWriteScope}).token(context.Background())
+	if err != nil || token != "metadata "+gcsWriteScope {
+		t.Errorf("token = %q, %v", token, err)
+	}
+}
+
+func TestTokenWithoutCredentials(t *testing.T) {
+	clearGoogleEnv(t)
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+
+	tokens := &googleTokenSource{scope: gcsReadScope}
+	for range 2 {
+		if token, err := tokens.token(context.Background()); token != "" || err != nil {
+			t.Errorf("token = %q, %v, want none, to read public objects", token, err)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("metadata server asked %d times, want once", n)
+	}
+
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "from-env")
+	if token, _ := tokens.token(context.Background()); token != "from-env" {
+		t.Errorf("token = %q, want GOOGLE_OAUTH_ACCESS_TOKEN", token)
+	}
+}
+
+func TestNewGCSRequest(t *testing.T) {
+	clearGoogleEnv(t)
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "secret")
+	req, err := newGCSRequest(context.Background(), "photos", "2024/a cat.jpg")
+	if err != nil {
+		t.Fatalf("newGCSRequest: %v", err)
+	}
+	if want := "https://storage.googleapis.com/storage/v1/b/photos/o/2024%2Fa%20cat.jpg?alt=media"; req.URL.String() != want {
+		t.Errorf("URL = %s, want %s", req.URL, want)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization = %q", got)
+	}
+
+	t.Setenv("STORAGE_EMULATOR_HOST", "localhost:4443/")
+	if req, _ := newGCSRequest(context.Background(), "photos", "cat.jpg"); !strings.HasPrefix(req.URL.String(), "http://localhost:4443/storage/v1/b/photos/o/cat.jpg") {
+		t.Errorf("emulator URL = %s", req.URL)
+	}
+	if _, err := newGCSRequest(context.Background(), "photos", ""); err == nil {
+		t.Error("newGCSRequest without an object succeeded")
+	}
+}
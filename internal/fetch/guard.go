@@ -0,0 +1,143 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrNotAllowed is returned for URLs a Guard refuses to fetch
+var ErrNotAllowed = errors.New("URL not allowed")
+
+// sharedAddressSpace is the carrier-grade NAT range, which like the private
+// ranges belongs to someone's internal network
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// Guard fetches images from URLs that API callers supply. They mustn't read
+// the server's own network, such as cloud metadata endpoints, or buckets
+// other than those the operator chose to share.
+type Guard struct {
+	// buckets holds the allowed buckets as "s3://name" and "gs://name"
+	buckets   map[string]bool
+	anyBucket bool
+	// excluded is the object storage bucket, readable only when listed
+	excluded string
+	client   *http.Client
+	// public reports whether an address may be connected to
+	public func(netip.Addr) bool
+}
+
+// NewGuard returns a Guard reading only the buckets listed, as s3://name or
+// gs://name, or any bucket but exclude for "*". exclude is the bucket
+// uploads and results are kept in, which may be nil. Unless allowPrivate,
+// http(s) URLs are refused when they resolve to a loopback, private,
+// link-local, or otherwise internal address, checked on each redirect and
+// again on connecting.
+func NewGuard(buckets []string, exclude *Bucket, allowPrivate bool) (*Guard, error) {
+	g := &Guard{buckets: map[string]bool{}, public: publicAddr}
+	for _, b := range buckets {
+		if b == "*" {
+			g.anyBucket = true
+			continue
+		}
+		u, err := url.Parse(b)
+		if err != nil || u.Host == "" || u.Scheme != "s3" && u.Scheme != "gs" || strings.Trim(u.Path, "/") != "" {
+			return nil, fmt.Errorf("allowed bucket %q must look like s3://bucket or gs://bucket", b)
+		}
+		g.buckets[u.Scheme+"://"+u.Host] = true
+	}
+	if exclude != nil {
+		g.excluded = exclude.scheme + "://" + exclude.name
+	}
+	if allowPrivate {
+		g.public = func(netip.Addr) bool { return true }
+	}
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		// Control sees the address actually connected to, after DNS, so a
+		// name that resolves differently the second time is still caught
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !g.public(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s is not a public address", ErrNotAllowed, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+	g.client = &http.Client{
+		Timeout: client.Timeout,
+		// No proxy: it would make the connection, out of the dialer's sight
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return g.checkHost(req.Context(), req.URL)
+		},
+	}
+	return g, nil
+}
+
+// FetchImage downloads an image like the package's FetchImage, refusing
+// buckets that aren't allowed and http(s) URLs on internal addresses with an
+// error wrapping ErrNotAllowed
+func (g *Guard) FetchImage(ctx context.Context, rawURL string) (Image, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Image{}, fmt.Errorf("invalid URL: %v", err)
+	}
+	switch u.Scheme {
+	case "s3", "gs":
+		bucket := u.Scheme + "://" + u.Host
+		if !g.buckets[bucket] && (!g.anyBucket || bucket == g.excluded) {
+			return Image{}, fmt.Errorf("%w: bucket %s is not one images may be read from", ErrNotAllowed, bucket)
+		}
+	case "http", "https":
+		if err := g.checkHost(ctx, u); err != nil {
+			return Image{}, err
+		}
+	}
+	return fetchImage(ctx, g.client, u)
+}
+
+// checkHost resolves u's host and refuses it if any of its addresses is
+// internal, so a redirect is stopped before it is followed
+func (g *Guard) checkHost(ctx context.Context, u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: unsupported URL scheme %q", ErrNotAllowed, u.Scheme)
+	}
+	host := u.Hostname()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if !g.public(addr) {
+			return fmt.Errorf("%w: %s resolves to %s, which is not a public address", ErrNotAllowed, host, addr.Unmap())
+		}
+	}
+	return nil
+}
+
+// publicAddr reports whether addr is on the public internet
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.Is4() && addr.As4()[0] == 0 {
+		// "This network", which reaches the host itself on some systems
+		return false
+	}
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
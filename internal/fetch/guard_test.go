@@ -0,0 +1,191 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// pngData is enough of a PNG for content sniffing
+var pngData = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// imageServer serves pngData at every path, counting requests
+func imageServer(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(pngData)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGuardBuckets(t *testing.T) {
+	var requests atomic.Int32
+	srv := imageServer(t, &requests)
+	// Bucket requests go to the configured endpoints, which may be local
+	t.Setenv("AWS_ENDPOINT_URL_S3", srv.URL)
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "GOOGLE_OAUTH_ACCESS_TOKEN"} {
+		t.Setenv(name, "")
+	}
+	history, err := OpenBucket("s3://history/uploads", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		allowed []string
+		url     string
+		ok      bool
+	}{
+		{"none allowed by default", nil, "s3://photos/cat.png", false},
+		{"listed bucket", []string{"s3://photos"}, "s3://photos/cat.png", true},
+		{"listed bucket with another scheme", []string{"s3://photos"}, "gs://photos/cat.png", false},
+		{"unlisted bucket", []string{"s3://photos"}, "s3://other/cat.png", false},
+		{"any bucket", []string{"*"}, "gs://other/cat.png", true},
+		{"any bucket but the storage bucket", []string{"*"}, "s3://history/uploads/a.png", false},
+		{"storage bucket listed", []string{"*", "s3://history"}, "s3://history/uploads/a.png", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := NewGuard(tt.allowed, history, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := requests.Load()
+			image, err := g.FetchImage(context.Background(), tt.url)
+			if tt.ok {
+				if err != nil || image.ContentType != "image/png" {
+					t.Errorf("FetchImage(%s) = %q, %v", tt.url, image.ContentType, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrNotAllowed) {
+				t.Errorf("FetchImage(%s) err = %v, want ErrNotAllowed", tt.url, err)
+			}
+			if requests.Load() != before {
+				t.Errorf("FetchImage(%s) made a request", tt.url)
+			}
+		})
+	}
+}
+
+func TestNewGuardBadBuckets(t *testing.T) {
+	for _, b := range []string{"photos", "https://photos", "s3://photos/prefix", "s3://"} {
+		if _, err := NewGuard([]string{b}, nil, false); err == nil {
+			t.Errorf("NewGuard(%q) succeeded", b)
+		}
+	}
+}
+
+func TestGuardRefusesInternalAddresses(t *testing.T) {
+	var requests atomic.Int32
+	srv := imageServer(t, &requests)
+	g, err := NewGuard(nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rawURL := range []string{
+		srv.URL + "/cat.png",
+		strings.Replace(srv.URL, "127.0.0.1", "localhost", 1) + "/cat.png",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.1/cat.png",
+		"http://[::1]/cat.png",
+		"http://[fd00::1]/cat.png",
+		"file:///etc/passwd",
+	} {
+		if _, err := g.FetchImage(context.Background(), rawURL); !errors.Is(err, ErrNotAllowed) && !strings.Contains(err.Error(), "unsupported URL scheme") {
+			t.Errorf("FetchImage(%s) err = %v, want ErrNotAllowed", rawURL, err)
+		}
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("server reached %d times", n)
+	}
+
+	// Connections are checked too, for names that resolve differently
+	// when the request is made
+	if _, err := g.client.Get(srv.URL); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("dial err = %v, want ErrNotAllowed", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("server reached %d times", n)
+	}
+
+	// Unless the operator allows them
+	g, err = NewGuard(nil, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.FetchImage(context.Background(), srv.URL+"/cat.png"); err != nil {
+		t.Errorf("FetchImage with private addresses allowed: %v", err)
+	}
+}
+
+func TestGuardChecksRedirects(t *testing.T) {
+	var requests atomic.Int32
+	target := imageServer(t, &requests)
+	redirects := map[string]string{
+		"/metadata": "http://169.254.169.254/latest/meta-data/",
+		"/private":  "http://10.0.0.1/cat.png",
+		"/loopback": "http://[::1]/cat.png",
+		"/public":   target.URL + "/cat.png",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, redirects[r.URL.Path], http.StatusFound)
+	}))
+	defer srv.Close()
+
+	g, err := NewGuard(nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Treat the test servers' address as public, and nothing else internal
+	g.public = func(addr netip.Addr) bool {
+		return addr.Unmap() == netip.MustParseAddr("127.0.0.1") || publicAddr(addr)
+	}
+	for _, path := range []string{"/metadata", "/private", "/loopback"} {
+		if _, err := g.FetchImage(context.Background(), srv.URL+path); !errors.Is(err, ErrNotAllowed) {
+			t.Errorf("redirect to %s err = %v, want ErrNotAllowed", redirects[path], err)
+		}
+	}
+	if _, err := g.FetchImage(context.Background(), srv.URL+"/public"); err != nil || requests.Load() != 1 {
+		t.Errorf("redirect to a public address = %v, %d requests", err, requests.Load())
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fd00:ec2::254", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("publicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
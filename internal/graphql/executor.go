@@ -0,0 +1,392 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Schema holds the root types for queries and mutations
+type Schema struct {
+	Query    *Object
+	Mutation *Object
+}
+
+// Object is a named type whose fields are resolved by Go functions
+type Object struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+// Field describes a single field on an object. Type is nil for scalar fields;
+// otherwise the resolved value (or each element of a resolved slice) is
+// resolved against Type's fields.
+type Field struct {
+	Type    *Object
+	Resolve func(p ResolveParams) (interface{}, error)
+	// MaxPerRequest limits how many times the field is resolved in one
+	// request, however it's aliased, for fields that are costly to resolve.
+	// Zero means no limit.
+	MaxPerRequest int
+}
+
+// ResolveParams is passed to field resolvers
+type ResolveParams struct {
+	Context context.Context
+	Source  interface{}
+	Args    map[string]interface{}
+}
+
+// Request is the standard GraphQL-over-HTTP request body
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Response is the standard GraphQL-over-HTTP response body
+type Response struct {
+	Data   *OrderedMap `json:"data"`
+	Errors []Error     `json:"errors,omitempty"`
+}
+
+// Error is a GraphQL error with the path of the field that produced it
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// OrderedMap is a JSON object that preserves the order of the selection set
+type OrderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newOrderedMap() *OrderedMap {
+	return &OrderedMap{values: map[string]interface{}{}}
+}
+
+// Set adds or replaces a key, keeping its original position
+func (m *OrderedMap) Set(key string, value interface{}) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// Get returns the value stored under key
+func (m *OrderedMap) Get(key string) interface{} {
+	return m.values[key]
+}
+
+func (m *OrderedMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		val, err := json.Marshal(m.values[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type executor struct {
+	ctx       context.Context
+	fragments map[string]*Fragment
+	variables map[string]interface{}
+	errors    []Error
+	// resolved counts the resolutions of fields with MaxPerRequest
+	resolved map[*Field]int
+}
+
+// Execute parses and runs a request against the schema
+func Execute(ctx context.Context, schema *Schema, req Request) *Response {
+	doc, err := Parse(req.Query)
+	if err != nil {
+		return &Response{Errors: []Error{{Message: err.Error()}}}
+	}
+
+	op, err := selectOperation(doc, req.OperationName)
+	if err != nil {
+		return &Response{Errors: []Error{{Message: err.Error()}}}
+	}
+
+	var root *Object
+	switch op.Type {
+	case "query":
+		root = schema.Query
+	case "mutation":
+		root = schema.Mutation
+	}
+	if root == nil {
+		return &Response{Errors: []Error{{Message: fmt.Sprintf("%s operations are not supported", op.Type)}}}
+	}
+
+	variables, err := coerceVariables(op, req.Variables)
+	if err != nil {
+		return &Response{Errors: []Error{{Message: err.Error()}}}
+	}
+
+	e := &executor{ctx: ctx, fragments: doc.Fragments, variables: variables, resolved: map[*Field]int{}}
+	data := e.executeSelectionSet(root, nil, op.SelectionSet, nil)
+	return &Response{Data: data, Errors: e.errors}
+}
+
+func selectOperation(doc *Document, name string) (*Operation, error) {
+	if name == "" {
+		if len(doc.Operations) > 1 {
+			return nil, fmt.Errorf("operationName is required when the document contains multiple operations")
+		}
+		return doc.Operations[0], nil
+	}
+	for _, op := range doc.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %q", name)
+}
+
+func coerceVariables(op *Operation, provided map[string]interface{}) (map[string]interface{}, error) {
+	vars := map[string]interface{}{}
+	for _, def := range op.Variables {
+		v, ok := provided[def.Name]
+		if !ok && def.DefaultValue != nil {
+			v, ok = def.DefaultValue, true
+		}
+		if def.NonNull && (!ok || v == nil) {
+			return nil, fmt.Errorf("variable $%s is required", def.Name)
+		}
+		if ok {
+			vars[def.Name] = normalizeJSONValue(v)
+		}
+	}
+	return vars, nil
+}
+
+// normalizeJSONValue converts whole float64 values decoded from JSON into ints
+// so resolvers see the same types for literals and variables
+func normalizeJSONValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case float64:
+		if val == float64(int(val)) {
+			return int(val)
+		}
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = normalizeJSONValue(item)
+		}
+		return out
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, item := range val {
+			out[k] = normalizeJSONValue(item)
+		}
+		return out
+	}
+	return v
+}
+
+func (e *executor) executeSelectionSet(obj *Object, source interface{}, set []Selection, path []interface{}) *OrderedMap {
+	result := newOrderedMap()
+	for _, sel := range e.collectFields(set, map[string]bool{}) {
+		key := sel.ResponseKey()
+		fieldPath := append(append([]interface{}{}, path...), key)
+
+		if sel.Name == "__typename" {
+			result.Set(key, obj.Name)
+			continue
+		}
+
+		field, ok := obj.Fields[sel.Name]
+		if !ok {
+			e.addError(fieldPath, "cannot query field %q on type %q", sel.Name, obj.Name)
+			result.Set(key, nil)
+			continue
+		}
+
+		if field.MaxPerRequest > 0 {
+			if e.resolved[field] >= field.MaxPerRequest {
+				e.addError(fieldPath, "field %q is limited to %d per request", sel.Name, field.MaxPerRequest)
+				result.Set(key, nil)
+				continue
+			}
+			e.resolved[field]++
+		}
+
+		args, err := e.resolveArguments(sel.Arguments)
+		if err != nil {
+			e.addError(fieldPath, "%v", err)
+			result.Set(key, nil)
+			continue
+		}
+
+		value, err := field.Resolve(ResolveParams{Context: e.ctx, Source: source, Args: args})
+		if err != nil {
+			e.addError(fieldPath, "%v", err)
+			result.Set(key, nil)
+			continue
+		}
+
+		result.Set(key, e.completeValue(field, value, sel, fieldPath))
+	}
+	return result
+}
+
+func (e *executor) completeValue(field *Field, value interface{}, sel Selection, path []interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	if field.Type == nil {
+		if len(sel.SelectionSet) > 0 {
+			e.addError(path, "field %q is a scalar and cannot have a selection set", sel.Name)
+			return nil
+		}
+		return value
+	}
+	if len(sel.SelectionSet) == 0 {
+		e.addError(path, "field %q of type %q must have a selection set", sel.Name, field.Type.Name)
+		return nil
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil
+	}
+	if rv.Kind() == reflect.Slice {
+		list := make([]interface{}, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			itemPath := append(append([]interface{}{}, path...), i)
+			list[i] = e.executeSelectionSet(field.Type, rv.Index(i).Interface(), sel.SelectionSet, itemPath)
+		}
+		return list
+	}
+	return e.executeSelectionSet(field.Type, value, sel.SelectionSet, path)
+}
+
+// collectFields flattens fragment spreads and inline fragments and applies
+// @skip/@include directives
+func (e *executor) collectFields(set []Selection, visited map[string]bool) []Selection {
+	var fields []Selection
+	for _, sel := range set {
+		if !e.shouldInclude(sel.Directives) {
+			continue
+		}
+		switch {
+		case sel.FragmentSpread != "":
+			if visited[sel.FragmentSpread] {
+				continue
+			}
+			frag, ok := e.fragments[sel.FragmentSpread]
+			if !ok {
+				e.addError(nil, "unknown fragment %q", sel.FragmentSpread)
+				continue
+			}
+			visited[sel.FragmentSpread] = true
+			fields = append(fields, e.collectFields(frag.SelectionSet, visited)...)
+		case sel.Inline:
+			fields = append(fields, e.collectFields(sel.SelectionSet, visited)...)
+		default:
+			fields = append(fields, sel)
+		}
+	}
+	return fields
+}
+
+func (e *executor) shouldInclude(directives []Directive) bool {
+	for _, d := range directives {
+		if d.Name != "skip" && d.Name != "include" {
+			continue
+		}
+		v, err := e.resolveValue(d.Arguments["if"])
+		if err != nil {
+			continue
+		}
+		cond, _ := v.(bool)
+		if d.Name == "skip" && cond {
+			return false
+		}
+		if d.Name == "include" && !cond {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *executor) resolveArguments(args map[string]Value) (map[string]interface{}, error) {
+	resolved := map[string]interface{}{}
+	for name, v := range args {
+		val, err := e.resolveValue(v)
+		if err != nil {
+			return nil, err
+		}
+		if _, isVar := v.(Variable); isVar && val == nil {
+			if _, provided := e.variables[string(v.(Variable))]; !provided {
+				continue
+			}
+		}
+		resolved[name] = val
+	}
+	return resolved, nil
+}
+
+func (e *executor) resolveValue(v Value) (interface{}, error) {
+	switch val := v.(type) {
+	case Variable:
+		return e.variables[string(val)], nil
+	case Enum:
+		return string(val), nil
+	case []Value:
+		list := make([]interface{}, len(val))
+		for i, item := range val {
+			r, err := e.resolveValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = r
+		}
+		return list, nil
+	case map[string]Value:
+		obj := map[string]interface{}{}
+		for k, item := range val {
+			r, err := e.resolveValue(item)
+			if err != nil {
+				return nil, err
+			}
+			obj[k] = r
+		}
+		return obj, nil
+	}
+	return v, nil
+}
+
+func (e *executor) addError(path []interface{}, format string, args ...interface{}) {
+	e.errors = append(e.errors, Error{Message: fmt.Sprintf(format, args...), Path: path})
+}
+
+// String returns the named string argument, or "" when absent
+func (p ResolveParams) String(name string) string {
+	s, _ := p.Args[name].(string)
+	return s
+}
+
+// Int returns the named int argument and whether it was supplied
+func (p ResolveParams) Int(name string) (int, bool) {
+	n, ok := p.Args[name].(int)
+	return n, ok
+}
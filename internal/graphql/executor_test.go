@@ -0,0 +1,215 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type testItem struct {
+	ID   string
+	Tags []string
+}
+
+// testSchema has a list of items to query and a costly mutation limited to
+// one call per request
+func testSchema(calls *int) *Schema {
+	item := &Object{
+		Name: "Item",
+		Fields: map[string]*Field{
+			"id":   {Resolve: func(p ResolveParams) (interface{}, error) { return p.Source.(testItem).ID, nil }},
+			"tags": {Resolve: func(p ResolveParams) (interface{}, error) { return p.Source.(testItem).Tags, nil }},
+			"broken": {Resolve: func(p ResolveParams) (interface{}, error) {
+				return nil, errors.New("resolver failed")
+			}},
+		},
+	}
+	items := []testItem{{ID: "a", Tags: []string{"x"}}, {ID: "b"}, {ID: "c"}}
+	return &Schema{
+		Query: &Object{
+			Name: "Query",
+			Fields: map[string]*Field{
+				"items": {
+					Type: item,
+					Resolve: func(p ResolveParams) (interface{}, error) {
+						n, ok := p.Int("limit")
+						if !ok || n > len(items) {
+							n = len(items)
+						}
+						return items[:n], nil
+					},
+				},
+				"item": {
+					Type: item,
+					Resolve: func(p ResolveParams) (interface{}, error) {
+						for _, it := range items {
+							if it.ID == p.String("id") {
+								return it, nil
+							}
+						}
+						return nil, nil
+					},
+				},
+				"echo": {Resolve: func(p ResolveParams) (interface{}, error) { return p.Args["value"], nil }},
+			},
+		},
+		Mutation: &Object{
+			Name: "Mutation",
+			Fields: map[string]*Field{
+				"create": {
+					Type:          item,
+					MaxPerRequest: 1,
+					Resolve: func(p ResolveParams) (interface{}, error) {
+						*calls++
+						return testItem{ID: p.String("id")}, nil
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		name string
+		req  Request
+		want string
+		// calls is how many times the mutation should have run
+		calls int
+	}{
+		{
+			name: "list and aliases",
+			req:  Request{Query: `{ items(limit: 2) { id } first: item(id: "a") { key: id tags } }`},
+			want: `{"data":{"items":[{"id":"a"},{"id":"b"}],"first":{"key":"a","tags":["x"]}}}`,
+		},
+		{
+			name: "null object",
+			req:  Request{Query: `{ item(id: "z") { id } }`},
+			want: `{"data":{"item":null}}`,
+		},
+		{
+			name: "variables and defaults",
+			req: Request{
+				Query:     `query Q($limit: Int = 3, $v: String) { items(limit: $limit) { id } echo(value: $v) }`,
+				Variables: map[string]interface{}{"limit": 1.0, "v": "hi"},
+			},
+			want: `{"data":{"items":[{"id":"a"}],"echo":"hi"}}`,
+		},
+		{
+			name: "default used for a missing variable",
+			req:  Request{Query: `query Q($limit: Int = 2) { items(limit: $limit) { id } }`},
+			want: `{"data":{"items":[{"id":"a"},{"id":"b"}]}}`,
+		},
+		{
+			name: "object and list arguments",
+			req:  Request{Query: `{ echo(value: {a: [1, "b", ENUM]}) }`},
+			want: `{"data":{"echo":{"a":[1,"b","ENUM"]}}}`,
+		},
+		{
+			name: "fragments and directives",
+			req: Request{
+				Query:     `query($skip: Boolean!) { item(id: "a") { ...F __typename tags @skip(if: $skip) ... @include(if: false) { broken } } } fragment F on Item { id }`,
+				Variables: map[string]interface{}{"skip": true},
+			},
+			want: `{"data":{"item":{"id":"a","__typename":"Item"}}}`,
+		},
+		{
+			name: "named operation",
+			req:  Request{Query: `query A { items(limit: 1) { id } } query B { echo(value: "b") }`, OperationName: "B"},
+			want: `{"data":{"echo":"b"}}`,
+		},
+		{
+			name:  "mutation",
+			req:   Request{Query: `mutation { create(id: "n") { id } }`},
+			want:  `{"data":{"create":{"id":"n"}}}`,
+			calls: 1,
+		},
+		{
+			name:  "aliased mutations over the limit",
+			req:   Request{Query: `mutation { one: create(id: "1") { id } two: create(id: "2") { id } ...M } fragment M on Mutation { three: create(id: "3") { id } }`},
+			want:  `{"data":{"one":{"id":"1"},"two":null,"three":null},"errors":[{"message":"field \"create\" is limited to 1 per request","path":["two"]},{"message":"field \"create\" is limited to 1 per request","path":["three"]}]}`,
+			calls: 1,
+		},
+		{
+			name: "resolver error",
+			req:  Request{Query: `{ items(limit: 1) { id broken } }`},
+			want: `{"data":{"items":[{"id":"a","broken":null}]},"errors":[{"message":"resolver failed","path":["items",0,"broken"]}]}`,
+		},
+		{
+			name: "unknown field",
+			req:  Request{Query: `{ nope }`},
+			want: `{"data":{"nope":null},"errors":[{"message":"cannot query field \"nope\" on type \"Query\"","path":["nope"]}]}`,
+		},
+		{
+			name: "object without a selection set",
+			req:  Request{Query: `{ item(id: "a") }`},
+			want: `{"data":{"item":null},"errors":[{"message":"field \"item\" of type \"Item\" must have a selection set","path":["item"]}]}`,
+		},
+		{
+			name: "scalar with a selection set",
+			req:  Request{Query: `{ echo(value: 1) { id } }`},
+			want: `{"data":{"echo":null},"errors":[{"message":"field \"echo\" is a scalar and cannot have a selection set","path":["echo"]}]}`,
+		},
+		{
+			name: "unknown fragment",
+			req:  Request{Query: `{ ...Missing }`},
+			want: `{"data":{},"errors":[{"message":"unknown fragment \"Missing\""}]}`,
+		},
+		{
+			name: "missing required variable",
+			req:  Request{Query: `query($id: String!) { item(id: $id) { id } }`},
+			want: `{"data":null,"errors":[{"message":"variable $id is required"}]}`,
+		},
+		{
+			name: "operation name required",
+			req:  Request{Query: `query A { echo(value: 1) } query B { echo(value: 2) }`},
+			want: `{"data":null,"errors":[{"message":"operationName is required when the document contains multiple operations"}]}`,
+		},
+		{
+			name: "unknown operation",
+			req:  Request{Query: `query A { echo(value: 1) }`, OperationName: "B"},
+			want: `{"data":null,"errors":[{"message":"unknown operation \"B\""}]}`,
+		},
+		{
+			name: "unsupported operation type",
+			req:  Request{Query: `subscription { items { id } }`},
+			want: `{"data":null,"errors":[{"message":"subscription operations are not supported"}]}`,
+		},
+		{
+			name: "syntax error",
+			req:  Request{Query: `{ items {`},
+			want: `{"data":null,"errors":[{"message":"syntax error at offset 9: unterminated selection set"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			resp := Execute(context.Background(), testSchema(&calls), tt.req)
+			got, err := json.Marshal(resp)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("response =\n%s\nwant\n%s", got, tt.want)
+			}
+			if calls != tt.calls {
+				t.Errorf("mutation ran %d times, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestResolveParams(t *testing.T) {
+	p := ResolveParams{Args: map[string]interface{}{"s": "x", "n": 3, "f": 1.5}}
+	if p.String("s") != "x" || p.String("n") != "" || p.String("missing") != "" {
+		t.Errorf("String gave %q, %q, %q", p.String("s"), p.String("n"), p.String("missing"))
+	}
+	for name, want := range map[string]string{"n": "3 true", "f": "0 false", "missing": "0 false"} {
+		n, ok := p.Int(name)
+		if got := fmt.Sprint(n, ok); got != want {
+			t.Errorf("Int(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
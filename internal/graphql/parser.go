@@ -0,0 +1,636 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunct
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// Document is a parsed GraphQL request document
+type Document struct {
+	Operations []*Operation
+	Fragments  map[string]*Fragment
+}
+
+// Operation is a query or mutation definition
+type Operation struct {
+	Type         string
+	Name         string
+	Variables    []VariableDefinition
+	SelectionSet []Selection
+}
+
+// VariableDefinition declares an operation variable and its optional default
+type VariableDefinition struct {
+	Name         string
+	NonNull      bool
+	DefaultValue Value
+}
+
+// Fragment is a named, reusable selection set
+type Fragment struct {
+	Name         string
+	SelectionSet []Selection
+}
+
+// Selection is a field, fragment spread, or inline fragment
+type Selection struct {
+	Alias        string
+	Name         string
+	Arguments    map[string]Value
+	Directives   []Directive
+	SelectionSet []Selection
+	// FragmentSpread holds the fragment name for `...Name` selections
+	FragmentSpread string
+	// Inline marks `... { }` selections whose fields merge into the parent
+	Inline bool
+}
+
+// ResponseKey returns the alias if present, otherwise the field name
+func (s Selection) ResponseKey() string {
+	if s.Alias != "" {
+		return s.Alias
+	}
+	return s.Name
+}
+
+// Directive is an `@name(args)` annotation on a selection
+type Directive struct {
+	Name      string
+	Arguments map[string]Value
+}
+
+// Value is a literal or variable reference appearing in a document
+type Value interface{}
+
+// Variable references an operation variable by name
+type Variable string
+
+// Enum is a bare enum literal
+type Enum string
+
+type parser struct {
+	src string
+	pos int
+	tok token
+}
+
+// Parse parses a GraphQL request document
+func Parse(src string) (*Document, error) {
+	p := &parser{src: strings.TrimPrefix(src, "\uFEFF")}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	doc := &Document{Fragments: map[string]*Fragment{}}
+	for p.tok.kind != tokenEOF {
+		switch {
+		case p.isPunct("{"):
+			set, err := p.parseSelectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, &Operation{Type: "query", SelectionSet: set})
+		case p.tok.kind == tokenName && (p.tok.value == "query" || p.tok.value == "mutation" || p.tok.value == "subscription"):
+			op, err := p.parseOperation()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, op)
+		case p.tok.kind == tokenName && p.tok.value == "fragment":
+			frag, err := p.parseFragment()
+			if err != nil {
+				return nil, err
+			}
+			doc.Fragments[frag.Name] = frag
+		default:
+			return nil, p.errorf("unexpected %q", p.tok.value)
+		}
+	}
+
+	if len(doc.Operations) == 0 {
+		return nil, fmt.Errorf("document contains no operations")
+	}
+	return doc, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at offset %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) isPunct(v string) bool {
+	return p.tok.kind == tokenPunct && p.tok.value == v
+}
+
+func (p *parser) expectPunct(v string) error {
+	if !p.isPunct(v) {
+		return p.errorf("expected %q, found %q", v, p.tok.value)
+	}
+	return p.next()
+}
+
+func (p *parser) expectName() (string, error) {
+	if p.tok.kind != tokenName {
+		return "", p.errorf("expected name, found %q", p.tok.value)
+	}
+	name := p.tok.value
+	return name, p.next()
+}
+
+func (p *parser) parseOperation() (*Operation, error) {
+	op := &Operation{Type: p.tok.value}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind == tokenName {
+		op.Name = p.tok.value
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isPunct("(") {
+		vars, err := p.parseVariableDefinitions()
+		if err != nil {
+			return nil, err
+		}
+		op.Variables = vars
+	}
+
+	if _, err := p.parseDirectives(); err != nil {
+		return nil, err
+	}
+
+	set, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.SelectionSet = set
+	return op, nil
+}
+
+func (p *parser) parseVariableDefinitions() ([]VariableDefinition, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+
+	var defs []VariableDefinition
+	for !p.isPunct(")") {
+		if err := p.expectPunct("$"); err != nil {
+			return nil, err
+		}
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(":"); err != nil {
+			return nil, err
+		}
+		nonNull, err := p.parseTypeRef()
+		if err != nil {
+			return nil, err
+		}
+
+		def := VariableDefinition{Name: name, NonNull: nonNull}
+		if p.isPunct("=") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if def.DefaultValue, err = p.parseValue(true); err != nil {
+				return nil, err
+			}
+		}
+		defs = append(defs, def)
+	}
+	return defs, p.next()
+}
+
+// parseTypeRef consumes a type reference and reports whether it is non-null.
+// Variable types are not checked beyond nullability.
+func (p *parser) parseTypeRef() (bool, error) {
+	if p.isPunct("[") {
+		if err := p.next(); err != nil {
+			return false, err
+		}
+		if _, err := p.parseTypeRef(); err != nil {
+			return false, err
+		}
+		if err := p.expectPunct("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.expectName(); err != nil {
+		return false, err
+	}
+
+	if p.isPunct("!") {
+		return true, p.next()
+	}
+	return false, nil
+}
+
+func (p *parser) parseFragment() (*Fragment, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	name, err := p.expectName()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokenName || p.tok.value != "on" {
+		return nil, p.errorf("expected type condition for fragment %s", name)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if _, err := p.expectName(); err != nil {
+		return nil, err
+	}
+	if _, err := p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	set, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	return &Fragment{Name: name, SelectionSet: set}, nil
+}
+
+func (p *parser) parseSelectionSet() ([]Selection, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+
+	var set []Selection
+	for !p.isPunct("}") {
+		if p.tok.kind == tokenEOF {
+			return nil, p.errorf("unterminated selection set")
+		}
+		sel, err := p.parseSelection()
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, sel)
+	}
+	return set, p.next()
+}
+
+func (p *parser) parseSelection() (Selection, error) {
+	if p.isPunct("...") {
+		return p.parseFragmentSelection()
+	}
+
+	var sel Selection
+	name, err := p.expectName()
+	if err != nil {
+		return sel, err
+	}
+	if p.isPunct(":") {
+		if err := p.next(); err != nil {
+			return sel, err
+		}
+		sel.Alias = name
+		if name, err = p.expectName(); err != nil {
+			return sel, err
+		}
+	}
+	sel.Name = name
+
+	if p.isPunct("(") {
+		if sel.Arguments, err = p.parseArguments(); err != nil {
+			return sel, err
+		}
+	}
+	if sel.Directives, err = p.parseDirectives(); err != nil {
+		return sel, err
+	}
+	if p.isPunct("{") {
+		if sel.SelectionSet, err = p.parseSelectionSet(); err != nil {
+			return sel, err
+		}
+	}
+	return sel, nil
+}
+
+func (p *parser) parseFragmentSelection() (Selection, error) {
+	var sel Selection
+	if err := p.next(); err != nil {
+		return sel, err
+	}
+
+	if p.tok.kind == tokenName && p.tok.value != "on" {
+		sel.FragmentSpread = p.tok.value
+		if err := p.next(); err != nil {
+			return sel, err
+		}
+		var err error
+		sel.Directives, err = p.parseDirectives()
+		return sel, err
+	}
+
+	sel.Inline = true
+	if p.tok.kind == tokenName && p.tok.value == "on" {
+		if err := p.next(); err != nil {
+			return sel, err
+		}
+		if _, err := p.expectName(); err != nil {
+			return sel, err
+		}
+	}
+	var err error
+	if sel.Directives, err = p.parseDirectives(); err != nil {
+		return sel, err
+	}
+	sel.SelectionSet, err = p.parseSelectionSet()
+	return sel, err
+}
+
+func (p *parser) parseDirectives() ([]Directive, error) {
+	var directives []Directive
+	for p.isPunct("@") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		d := Directive{Name: name}
+		if p.isPunct("(") {
+			if d.Arguments, err = p.parseArguments(); err != nil {
+				return nil, err
+			}
+		}
+		directives = append(directives, d)
+	}
+	return directives, nil
+}
+
+func (p *parser) parseArguments() (map[string]Value, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+
+	args := map[string]Value{}
+	for !p.isPunct(")") {
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.parseValue(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, p.next()
+}
+
+func (p *parser) parseValue(constant bool) (Value, error) {
+	tok := p.tok
+	switch {
+	case p.isPunct("$"):
+		if constant {
+			return nil, p.errorf("variables are not allowed here")
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.expectName()
+		return Variable(name), err
+	case p.isPunct("["):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list := []Value{}
+		for !p.isPunct("]") {
+			v, err := p.parseValue(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.next()
+	case p.isPunct("{"):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		obj := map[string]Value{}
+		for !p.isPunct("}") {
+			name, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(":"); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.parseValue(constant); err != nil {
+				return nil, err
+			}
+		}
+		return obj, p.next()
+	case tok.kind == tokenInt:
+		n, err := strconv.ParseInt(tok.value, 10, 64)
+		if err != nil {
+			return nil, p.errorf("invalid int %q", tok.value)
+		}
+		return int(n), p.next()
+	case tok.kind == tokenFloat:
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, p.errorf("invalid float %q", tok.value)
+		}
+		return f, p.next()
+	case tok.kind == tokenString:
+		return tok.value, p.next()
+	case tok.kind == tokenName:
+		var v Value
+		switch tok.value {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = Enum(tok.value)
+		}
+		return v, p.next()
+	}
+	return nil, p.errorf("unexpected %q", tok.value)
+}
+
+// next advances to the following token, skipping whitespace, commas, and comments
+func (p *parser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+			continue
+		}
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		break
+	}
+
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = token{kind: tokenEOF, pos: start}
+		return nil
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = token{kind: tokenPunct, value: "...", pos: start}
+	case strings.IndexByte("!$()[]{}:=@|&", c) >= 0:
+		p.pos++
+		p.tok = token{kind: tokenPunct, value: string(c), pos: start}
+	case c == '_' || isLetter(c):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || isLetter(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		p.tok = token{kind: tokenName, value: p.src[start:p.pos], pos: start}
+	case c == '-' || isDigit(c):
+		return p.lexNumber()
+	case c == '"':
+		return p.lexString()
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.tok = token{pos: start}
+		return p.errorf("unexpected character %q", r)
+	}
+	return nil
+}
+
+func (p *parser) lexNumber() error {
+	start := p.pos
+	kind := tokenInt
+	if p.src[p.pos] == '-' {
+		p.pos++
+	}
+	for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+		p.pos++
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		kind = tokenFloat
+		p.pos++
+		for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+			p.pos++
+		}
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		kind = tokenFloat
+		p.pos++
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+			p.pos++
+		}
+	}
+	p.tok = token{kind: kind, value: p.src[start:p.pos], pos: start}
+	return nil
+}
+
+func (p *parser) lexString() error {
+	start := p.pos
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		end := strings.Index(p.src[p.pos+3:], `"""`)
+		if end < 0 {
+			p.tok = token{pos: start}
+			return p.errorf("unterminated block string")
+		}
+		p.tok = token{kind: tokenString, value: strings.TrimSpace(p.src[p.pos+3 : p.pos+3+end]), pos: start}
+		p.pos += end + 6
+		return nil
+	}
+
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			p.tok = token{kind: tokenString, value: b.String(), pos: start}
+			return nil
+		case '\n':
+			p.tok = token{pos: start}
+			return p.errorf("unterminated string")
+		case '\\':
+			if p.pos+1 >= len(p.src) {
+				p.tok = token{pos: start}
+				return p.errorf("unterminated string")
+			}
+			esc := p.src[p.pos+1]
+			p.pos += 2
+			switch esc {
+			case '"', '\\', '/':
+				b.WriteByte(esc)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					p.tok = token{pos: start}
+					return p.errorf("invalid unicode escape")
+				}
+				n, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					p.tok = token{pos: start}
+					return p.errorf("invalid unicode escape")
+				}
+				b.WriteRune(rune(n))
+				p.pos += 4
+			default:
+				p.tok = token{pos: start}
+				return p.errorf("invalid escape sequence \\%c", esc)
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	p.tok = token{pos: start}
+	return p.errorf("unterminated string")
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
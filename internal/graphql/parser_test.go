@@ -0,0 +1,112 @@
+package graphql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	doc, err := Parse(`
+		# Fetch recent generations
+		query Recent($limit: Int! = 10, $tags: [String]) {
+			recent: history(limit: $limit, search: "dog\n\"cat\"", since: null) @include(if: true) {
+				id
+				...Fields
+				... { score }
+			}
+		}
+		mutation { generate(image: """ raw """, context: {page_title: "Pricing", n: -1.5e2}, mode: FAST) { id } }
+		fragment Fields on Generation { altText, options }
+	`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(doc.Operations) != 2 {
+		t.Fatalf("got %d operations, want 2", len(doc.Operations))
+	}
+
+	query := doc.Operations[0]
+	if query.Type != "query" || query.Name != "Recent" {
+		t.Errorf("operation = %s %q", query.Type, query.Name)
+	}
+	wantVars := []VariableDefinition{
+		{Name: "limit", NonNull: true, DefaultValue: 10},
+		{Name: "tags"},
+	}
+	if !reflect.DeepEqual(query.Variables, wantVars) {
+		t.Errorf("variables = %#v, want %#v", query.Variables, wantVars)
+	}
+
+	history := query.SelectionSet[0]
+	if history.Name != "history" || history.ResponseKey() != "recent" {
+		t.Errorf("field = %q as %q", history.Name, history.ResponseKey())
+	}
+	wantArgs := map[string]Value{"limit": Variable("limit"), "search": "dog\n\"cat\"", "since": nil}
+	if !reflect.DeepEqual(history.Arguments, wantArgs) {
+		t.Errorf("arguments = %#v, want %#v", history.Arguments, wantArgs)
+	}
+	if len(history.Directives) != 1 || history.Directives[0].Name != "include" || history.Directives[0].Arguments["if"] != true {
+		t.Errorf("directives = %#v", history.Directives)
+	}
+	if set := history.SelectionSet; len(set) != 3 || set[0].Name != "id" || set[1].FragmentSpread != "Fields" || !set[2].Inline {
+		t.Errorf("selection set = %#v", set)
+	}
+
+	generate := doc.Operations[1].SelectionSet[0]
+	if doc.Operations[1].Type != "mutation" {
+		t.Errorf("second operation is a %s", doc.Operations[1].Type)
+	}
+	wantArgs = map[string]Value{
+		"image":   "raw",
+		"context": map[string]Value{"page_title": "Pricing", "n": -150.0},
+		"mode":    Enum("FAST"),
+	}
+	if !reflect.DeepEqual(generate.Arguments, wantArgs) {
+		t.Errorf("arguments = %#v, want %#v", generate.Arguments, wantArgs)
+	}
+
+	fields, ok := doc.Fragments["Fields"]
+	if !ok || len(fields.SelectionSet) != 2 || fields.SelectionSet[1].Name != "options" {
+		t.Errorf("fragment = %#v", fields)
+	}
+}
+
+func TestParseShorthandQuery(t *testing.T) {
+	doc, err := Parse("\uFEFF{ providers { name } }")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if op := doc.Operations[0]; op.Type != "query" || op.Name != "" || op.SelectionSet[0].Name != "providers" {
+		t.Errorf("operation = %#v", op)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{"empty", "", "no operations"},
+		{"only a fragment", "fragment F on T { id }", "no operations"},
+		{"unclosed selection set", "{ history { id }", "syntax error"},
+		{"missing argument value", "{ history(limit: ) { id } }", "syntax error"},
+		{"unknown keyword", "schema { id }", `unexpected "schema"`},
+		{"variable in default", "query($a: Int = $b) { id }", "variables are not allowed here"},
+		{"unterminated string", `{ history(search: "dog) { id } }`, "unterminated string"},
+		{"newline in string", "{ history(search: \"dog\n\") { id } }", "unterminated string"},
+		{"unterminated block string", `{ history(search: """dog) { id } }`, "unterminated block string"},
+		{"bad escape", `{ history(search: "\q") { id } }`, `invalid escape sequence \q`},
+		{"bad unicode escape", `{ history(search: "\u12") { id } }`, "invalid unicode escape"},
+		{"unexpected character", "{ history ? }", `unexpected character '?'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Parse(%q) error = %v, want %q", tt.src, err, tt.err)
+			}
+		})
+	}
+}
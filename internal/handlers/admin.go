@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/audit"
+	"alt-text-generator/internal/history"
+	"alt-text-generator/internal/jobs"
+	"alt-text-generator/internal/pool"
+	"alt-text-generator/internal/quota"
+	"alt-text-generator/internal/regenerate"
+)
+
+// Cache is a cache the admin API can inspect and flush
+type Cache interface {
+	Len() int
+	Flush() int
+}
+
+// Admin holds the runtime state the admin API reports on and controls
+type Admin struct {
+	Started       time.Time
+	Active        api.Provider
+	Store         *history.Store
+	Jobs          *jobs.Manager
+	Caches        map[string]Cache
+	Quotas        *quota.Tracker
+	Audit         *audit.Log
+	Regenerations *regenerate.Runner
+	// Generations is nil when provider calls aren't bounded
+	Generations *pool.Pool
+}
+
+type adminProvider struct {
+	Name       string `json:"name"`
+	Model      string `json:"model"`
+	Active     bool   `json:"active"`
+	Configured bool   `json:"configured"`
+	Enabled    bool   `json:"enabled"`
+}
+
+// StatsHandler reports uptime, provider state, stored generations, job
+// counts, cache sizes, and how busy the generation workers are
+func (a *Admin) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	var providers []adminProvider
+	for _, p := range api.Providers() {
+		providers = append(providers, adminProvider{
+			Name:       p.Name,
+			Model:      p.Model,
+			Active:     p.Name == a.Active.Name,
+			Configured: p.Configured(),
+			Enabled:    p.Enabled(),
+		})
+	}
+
+	caches := map[string]int{}
+	for name, c := range a.Caches {
+		caches[name] = c.Len()
+	}
+
+	stats := map[string]interface{}{
+		"uptime_seconds": int(time.Since(a.Started).Seconds()),
+		"providers":      providers,
+		"generations":    a.Store.Count(),
+		"jobs":           a.Jobs.Stats(),
+		"caches":         caches,
+	}
+	if a.Generations != nil {
+		stats["workers"] = a.Generations.Stats()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// FlushCachesHandler empties every cache, or only those named in the
+// comma-separated "cache" query parameter
+func (a *Admin) FlushCachesHandler(w http.ResponseWriter, r *http.Request) {
+	names := a.cacheNames()
+	if q := r.URL.Query().Get("cache"); q != "" {
+		names = strings.Split(q, ",")
+	}
+
+	flushed := map[string]int{}
+	for _, name := range names {
+		c, ok := a.Caches[strings.TrimSpace(name)]
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "Unknown cache "+name)
+			return
+		}
+		flushed[name] = c.Flush()
+	}
+	slog.InfoContext(r.Context(), "Flushed caches", "flushed", flushed)
+	audit.Record(r.Context(), audit.Event{Action: audit.ActionCachesFlushed, Detail: strings.Join(names, ",")})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"flushed": flushed})
+}
+
+func (a *Admin) cacheNames() []string {
+	var names []string
+	for name := range a.Caches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RotateKeyHandler replaces a provider's API key without a restart. The body
+// is {"api_key": "..."}.
+func (a *Admin) RotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := api.LookupProvider(r.PathValue("name"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Unknown provider")
+		return
+	}
+
+	var body struct {
+		APIKey string `json:"api_key"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&body); err != nil || strings.TrimSpace(body.APIKey) == "" {
+		writeJSONError(w, http.StatusBadRequest, "Request body must be a JSON object with an api_key")
+		return
+	}
+	if err := provider.SetAPIKey(strings.TrimSpace(body.APIKey)); err != nil {
+		slog.ErrorContext(r.Context(), "Error rotating API key", "provider", provider.Name, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to rotate API key")
+		return
+	}
+	slog.InfoContext(r.Context(), "Rotated provider API key", "provider", provider.Name)
+	audit.Record(r.Context(), audit.Event{Action: audit.ActionKeyRotated, Provider: provider.Name})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"provider": provider.Name, "configured": true})
+}
+
+// SetProviderEnabledHandler returns a handler that switches the named
+// provider on or off. Generation requests to a disabled provider fail fast
+// with 503 instead of reaching its API.
+func (a *Admin) SetProviderEnabledHandler(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := api.LookupProvider(r.PathValue("name"))
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "Unknown provider")
+			return
+		}
+		api.SetEnabled(provider.Name, enabled)
+		slog.InfoContext(r.Context(), "Changed provider state", "provider", provider.Name, "enabled", enabled)
+		action := audit.ActionProviderDisabled
+		if enabled {
+			action = audit.ActionProviderEnabled
+		}
+		audit.Record(r.Context(), audit.Event{Action: action, Provider: provider.Name})
+		writeJSON(w, http.StatusOK, map[string]interface{}{"provider": provider.Name, "enabled": enabled})
+	}
+}
+
+// DrainJobsHandler stops accepting jobs and waits for queued and running jobs
+// to finish, up to the "timeout" query parameter (default 30s). It responds
+// 200 once drained, or 504 with the remaining counts if the timeout passes.
+func (a *Admin) DrainJobsHandler(w http.ResponseWriter, r *http.Request) {
+	timeout := 30 * time.Second
+	if q := r.URL.Query().Get("timeout"); q != "" {
+		d, err := time.ParseDuration(q)
+		if err != nil || d <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "timeout must be a positive duration such as 30s")
+			return
+		}
+		timeout = d
+	}
+
+	audit.Record(r.Context(), audit.Event{Action: audit.ActionJobsDrained, Detail: "timeout " + timeout.String()})
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	stats, err := a.Jobs.Drain(ctx)
+	if err != nil {
+		writeJSON(w, http.StatusGatewayTimeout, map[string]interface{}{"error": "Timed out waiting for jobs to finish", "jobs": stats})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"jobs": stats})
+}
+
+// ResumeJobsHandler accepts job submissions again after a drain
+func (a *Admin) ResumeJobsHandler(w http.ResponseWriter, r *http.Request) {
+	a.Jobs.Resume()
+	slog.InfoContext(r.Context(), "Resumed job queue")
+	audit.Record(r.Context(), audit.Event{Action: audit.ActionJobsResumed})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"jobs": a.Jobs.Stats()})
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"alt-text-generator/internal/audit"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditPage is one page of GET /admin/audit
+type auditPage struct {
+	Events []audit.Event `json:"events"`
+	// NextBefore is the before parameter for the next page
+	NextBefore int `json:"next_before,omitempty"`
+}
+
+// AuditHandler lists audit log events newest first. Query parameters:
+// action, user, since/until (RFC 3339 timestamps or dates), limit (1-1000),
+// and before (next_before from the previous page).
+func (a *Admin) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := audit.Filter{Action: query.Get("action"), User: query.Get("user"), Limit: defaultAuditLimit}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		filter.Limit = n
+	}
+	if v := query.Get("before"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, "before must be an event ID")
+			return
+		}
+		filter.Before = n
+	}
+	var err error
+	if filter.Since, err = parseHistoryTime(query, "since"); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.Until, err = parseHistoryTime(query, "until"); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Fetch one extra event to learn whether another page follows
+	limit := filter.Limit
+	filter.Limit++
+	page := auditPage{Events: a.Audit.List(filter)}
+	if page.Events == nil {
+		page.Events = []audit.Event{}
+	}
+	if len(page.Events) > limit {
+		page.Events = page.Events[:limit]
+		page.NextBefore = page.Events[limit-1].ID
+	}
+	writeJSON(w, http.StatusOK, page)
+}
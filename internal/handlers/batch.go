@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/fetch"
+	"alt-text-generator/internal/history"
+)
+
+const (
+	// maxBatchItems caps how many images a single batch request may contain
+	maxBatchItems = 20
+	// batchConcurrency bounds how many provider calls a batch runs at once
+	batchConcurrency = 4
+)
+
+// batchItem is one image in a batch, either uploaded directly or referenced by URL
+type batchItem struct {
+	Filename string
+	URL      string
+	Data     []byte
+	Err      error
+}
+
+// BatchResult reports the outcome for a single item of a batch request
+type BatchResult struct {
+	Index      int             `json:"index"`
+	Filename   string          `json:"filename,omitempty"`
+	URL        string          `json:"url,omitempty"`
+	Status     string          `json:"status"`
+	Error      string          `json:"error,omitempty"`
+	Generation *history.Record `json:"generation,omitempty"`
+}
+
+// BatchHandler accepts several images in one request, either as multipart
+// files under "images" or as a JSON body of the form {"urls": [...]}, and
+// returns a result per item in request order. Prompt context, sent as
+// "context.<name>" fields or a JSON "context" object, applies to every image.
+// URLs are fetched through images.
+func BatchHandler(w http.ResponseWriter, r *http.Request, provider api.Provider, store *history.Store, images *fetch.Guard) {
+	slog.InfoContext(r.Context(), "Received batch request")
+
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !provider.Configured() {
+		writeJSONError(w, http.StatusServiceUnavailable, "API key not configured")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchItems*6*1024*1024)
+
+	var items []batchItem
+	var imageContext api.ImageContext
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		items, imageContext, err = readBatchURLs(r)
+	} else {
+		items, imageContext, err = readBatchFiles(r)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	r = r.WithContext(api.WithImageContext(r.Context(), imageContext))
+	if len(items) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "No images supplied")
+		return
+	}
+	if len(items) > maxBatchItems {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("A batch may contain at most %d images", maxBatchItems))
+		return
+	}
+
+	results := runBatch(r, provider, store, images, items)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// runBatch processes items with bounded concurrency and returns their results
+// in request order. URLs are fetched through images, which may be nil when
+// no item has one.
+func runBatch(r *http.Request, provider api.Provider, store *history.Store, images *fetch.Guard, items []batchItem) []BatchResult {
+	results := make([]BatchResult, len(items))
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, batchConcurrency)
+	for i, item := range items {
+		wg.Add(1)
+		go func(i int, item batchItem) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[i] = processBatchItem(r, provider, store, images, i, item)
+		}(i, item)
+	}
+	wg.Wait()
+
+	slog.InfoContext(r.Context(), "Completed batch", "images", len(items))
+	return results
+}
+
+func processBatchItem(r *http.Request, provider api.Provider, store *history.Store, images *fetch.Guard, index int, item batchItem) BatchResult {
+	result := BatchResult{Index: index, Filename: item.Filename, URL: item.URL}
+
+	if item.Err == nil && item.URL != "" {
+		var image fetch.Image
+		image, item.Err = images.FetchImage(r.Context(), item.URL)
+		item.Data = image.Data
+		result.Filename = image.Filename
+	}
+	if item.Err != nil {
+		result.Status = "error"
+		result.Error = item.Err.Error()
+		return result
+	}
+
+	record, err := generateAltText(r.Context(), provider, store, result.Filename, item.Data)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error generating alt text for batch item", "index", index, "err", err)
+		result.Status = "error"
+		result.Error = formatErrorMessage(err.Error())
+		return result
+	}
+
+	result.Status = "ok"
+	result.Generation = &record
+	return result
+}
+
+func readBatchURLs(r *http.Request) ([]batchItem, api.ImageContext, error) {
+	var body struct {
+		URLs    []string          `json:"urls"`
+		Context map[string]string `json:"context"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, api.ImageContext{}, fmt.Errorf("Request body must be a JSON object with a urls array")
+	}
+	imageContext, err := api.NewImageContext(body.Context)
+	if err != nil {
+		return nil, api.ImageContext{}, err
+	}
+
+	items := make([]batchItem, len(body.URLs))
+	for i, u := range body.URLs {
+		items[i] = batchItem{URL: u}
+	}
+	return items, imageContext, nil
+}
+
+func readBatchFiles(r *http.Request) ([]batchItem, api.ImageContext, error) {
+	if err := r.ParseMultipartForm(32 * 1024 * 1024); err != nil {
+		slog.ErrorContext(r.Context(), "Error parsing multipart form", "err", err)
+		return nil, api.ImageContext{}, fmt.Errorf("Failed to parse upload")
+	}
+	imageContext, err := formContext(r.MultipartForm.Value)
+	if err != nil {
+		return nil, api.ImageContext{}, err
+	}
+
+	return uploadedFiles(r.MultipartForm, "images", "image", "image[]"), imageContext, nil
+}
+
+// uploadedFiles reads every file under the given multipart fields, recording
+// per-file problems on the item rather than failing the whole request
+func uploadedFiles(form *multipart.Form, fields ...string) []batchItem {
+	var items []batchItem
+	for _, field := range fields {
+		for _, header := range form.File[field] {
+			item := batchItem{Filename: header.Filename}
+			if header.Size > 5*1024*1024 {
+				item.Err = errors.New("Image size exceeds 5MB limit. Please choose a smaller image.")
+			} else if file, err := header.Open(); err != nil {
+				item.Err = errors.New("Failed to read uploaded file. Please try again.")
+			} else {
+				item.Data, err = ioutil.ReadAll(file)
+				file.Close()
+				if err != nil {
+					item.Err = errors.New("Failed to read uploaded file. Please try again.")
+				}
+			}
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		slog.Error("Error encoding JSON response", "err", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/audit"
+	"alt-text-generator/internal/auth"
+	"alt-text-generator/internal/coalesce"
+	"alt-text-generator/internal/config"
+	"alt-text-generator/internal/history"
+	"alt-text-generator/internal/metrics"
+	"alt-text-generator/internal/pool"
+	"alt-text-generator/internal/quota"
+)
+
+// generationInputs are the inputs generating fileBytes with provider for ctx
+// would be made from, for finding or sharing a generation made from the same
+func generationInputs(ctx context.Context, provider api.Provider, fileBytes []byte) (history.Inputs, error) {
+	prompt, err := api.Prompt(ctx)
+	if err != nil {
+		return history.Inputs{}, err
+	}
+	return history.Inputs{
+		ImageHash: history.HashImage(fileBytes),
+		Provider:  provider.Name,
+		Model:     provider.Model,
+		Prompt:    prompt,
+		Settings:  api.OutputSettings(ctx),
+	}, nil
+}
+
+// optionsFingerprint identifies the options a generation for ctx is made
+// with, apart from the image, so a reused Idempotency-Key can be told from a
+// retry
+func optionsFingerprint(ctx context.Context, provider api.Provider) string {
+	inputs, err := generationInputs(ctx, provider, nil)
+	if err != nil {
+		// The provider call will fail on the same error
+		return ""
+	}
+	inputs.ImageHash = ""
+	return inputs.Key()
+}
+
+// cachedGeneration looks in history, or the cache in front of it, for an
+// earlier generation of the same image bytes with the same provider, model,
+// prompt, and settings. If there is one, its
+// result is stored again as this caller's generation, with no tokens, and
+// returned, so re-uploading an image doesn't pay for another provider call.
+// A refresh skips the lookup, so the new result replaces the stored one.
+func cachedGeneration(ctx context.Context, provider api.Provider, store *history.Store, filename string, fileBytes []byte) (history.Record, bool) {
+	if !config.GetBool("RESULT_CACHE", true) {
+		return history.Record{}, false
+	}
+	if history.RefreshWanted(ctx) {
+		metrics.CacheRefreshes.Inc()
+		return history.Record{}, false
+	}
+	inputs, err := generationInputs(ctx, provider, fileBytes)
+	if err != nil {
+		// The provider call will fail on the same error
+		return history.Record{}, false
+	}
+	var earlier history.Record
+	ok := false
+	// A race is answered by whichever racer's result is stored
+	for _, racer := range provider.Racers() {
+		inputs.Provider, inputs.Model = racer.Name, racer.Model
+		if earlier, ok = store.Lookup(inputs); ok {
+			break
+		}
+	}
+	if !ok {
+		metrics.CacheMisses.Inc()
+		return history.Record{}, false
+	}
+	metrics.CacheHits.Inc()
+
+	record := reuseGeneration(ctx, store, earlier, filename, fileBytes)
+	slog.InfoContext(ctx, "Served generation from the result cache", "generation_id", record.ID, "cached_from", earlier.ID)
+	audit.Record(ctx, audit.Event{Action: audit.ActionGenerateCached, ImageHash: record.ImageHash, Provider: record.Provider, Model: record.Model, GenerationID: record.ID, Detail: "cached from " + earlier.ID})
+	return record, true
+}
+
+// inflight holds the provider calls under way, so concurrent requests for
+// the same image share one
+var inflight coalesce.Group
+
+// coalescedGeneration calls generate, unless a request for the same image
+// bytes with the same provider, model, prompt, and settings is already
+// calling it, in
+// which case that request's result is stored again as this caller's
+// generation, as a cache hit is. If the shared call failed for reasons of the
+// request that made it, such as its client hanging up or its quota running
+// out, this caller makes the call itself.
+func coalescedGeneration(ctx context.Context, provider api.Provider, store *history.Store, filename string, fileBytes []byte, generate func() (history.Record, error)) (history.Record, error) {
+	inputs, err := generationInputs(ctx, provider, fileBytes)
+	if err != nil || !config.GetBool("RESULT_CACHE", true) {
+		return generate()
+	}
+	key := inputs.Key()
+	for {
+		value, shared, err := inflight.Do(ctx, key, func() (interface{}, error) { return generate() })
+		if !shared {
+			if err != nil {
+				return history.Record{}, err
+			}
+			return value.(history.Record), nil
+		}
+		if err != nil {
+			if ctx.Err() == nil && (errors.Is(err, context.Canceled) || errors.Is(err, quota.ErrExceeded) || errors.Is(err, pool.ErrBusy)) {
+				continue
+			}
+			return history.Record{}, err
+		}
+		metrics.Coalesced.Inc()
+		earlier := value.(history.Record)
+		record := reuseGeneration(ctx, store, earlier, filename, fileBytes)
+		slog.InfoContext(ctx, "Shared a provider call with a concurrent request", "generation_id", record.ID, "shared_with", earlier.ID)
+		audit.Record(ctx, audit.Event{Action: audit.ActionGenerateCached, ImageHash: record.ImageHash, Provider: record.Provider, Model: record.Model, GenerationID: record.ID, Detail: "shared with " + earlier.ID})
+		return record, nil
+	}
+}
+
+// reuseGeneration stores the result of an earlier generation again as this
+// caller's, with no tokens
+func reuseGeneration(ctx context.Context, store *history.Store, earlier history.Record, filename string, fileBytes []byte) history.Record {
+	record := earlier
+	record.ID, record.User, record.Filename = "", "", filename
+	if id, ok := auth.IdentityFromContext(ctx); ok {
+		record.User = id.User
+	}
+	record.Thumbnail = history.Thumbnail(fileBytes)
+	record.InputTokens, record.OutputTokens = 0, 0
+	record.Cached = true
+	record.CreatedAt = time.Time{}
+	// Feedback was on the earlier generation, not this one
+	record.Feedback = nil
+	return store.Add(record)
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"alt-text-generator/internal/audit"
+	"alt-text-generator/internal/history"
+	"alt-text-generator/internal/metrics"
+)
+
+// maxFeedbackChars bounds an edited alt text or comment
+const maxFeedbackChars = 2000
+
+// feedbackRequest is the body of POST /api/v1/history/{id}/feedback
+type feedbackRequest struct {
+	Rating        string `json:"rating"`
+	EditedAltText string `json:"edited_alt_text"`
+	Comment       string `json:"comment"`
+}
+
+// feedback checks the request and returns it as stored
+func (req feedbackRequest) feedback() (history.Feedback, error) {
+	f := history.Feedback{
+		Rating:        strings.ToLower(strings.TrimSpace(req.Rating)),
+		EditedAltText: strings.TrimSpace(req.EditedAltText),
+		Comment:       strings.TrimSpace(req.Comment),
+	}
+	switch {
+	case f.Rating != "" && f.Rating != history.RatingUp && f.Rating != history.RatingDown:
+		return f, errors.New("rating must be up or down")
+	case f.Rating == "" && f.EditedAltText == "" && f.Comment == "":
+		return f, errors.New("give a rating, an edited alt text, or a comment")
+	case utf8.RuneCountInString(f.EditedAltText) > maxFeedbackChars || utf8.RuneCountInString(f.Comment) > maxFeedbackChars:
+		return f, errors.New("edited alt text and comment must be at most 2000 characters")
+	}
+	return f, nil
+}
+
+// FeedbackHandler rates a stored generation up or down and records an
+// edited version of its alt text, replacing any earlier feedback on it.
+// Authenticated callers can only give feedback on their own generations.
+func FeedbackHandler(w http.ResponseWriter, r *http.Request, store *history.Store) {
+	var req feedbackRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	record, status, err := saveFeedback(r, store, req)
+	if err != nil {
+		writeJSONError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, generationResponse{Record: record, Options: record.Options()})
+}
+
+// HistoryFeedbackHandler takes feedback posted from the history page's
+// forms and sends the browser back to the page
+func HistoryFeedbackHandler(w http.ResponseWriter, r *http.Request, store *history.Store) {
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	req := feedbackRequest{
+		Rating:        r.PostFormValue("rating"),
+		EditedAltText: r.PostFormValue("edited_alt_text"),
+		Comment:       r.PostFormValue("comment"),
+	}
+	if _, status, err := saveFeedback(r, store, req); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	// Only return to a page of history, keeping its search
+	back := "/history"
+	if u, err := url.Parse(r.PostFormValue("return")); err == nil && u.Path == "/history" && u.Host == "" && u.Scheme == "" {
+		back = u.RequestURI()
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// saveFeedback stores req on the generation named by the id path value,
+// returning the updated generation or the status to fail with
+func saveFeedback(r *http.Request, store *history.Store, req feedbackRequest) (history.Record, int, error) {
+	f, err := req.feedback()
+	if err != nil {
+		return history.Record{}, http.StatusBadRequest, err
+	}
+	if _, ok := ownGeneration(r, store); !ok {
+		return history.Record{}, http.StatusNotFound, errors.New("Generation not found")
+	}
+	record, ok := store.SetFeedback(r.PathValue("id"), f)
+	if !ok {
+		return history.Record{}, http.StatusInternalServerError, errors.New("Failed to save feedback")
+	}
+	rating := f.Rating
+	if rating == "" {
+		rating = "none"
+	}
+	metrics.Feedback.Inc(rating, strconv.FormatBool(f.EditedAltText != ""))
+	audit.Record(r.Context(), audit.Event{Action: audit.ActionFeedback, ImageHash: record.ImageHash, Provider: record.Provider, Model: record.Model, GenerationID: record.ID, Detail: "rating " + rating})
+	return record, http.StatusOK, nil
+}
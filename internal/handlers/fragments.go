@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/history"
+)
+
+// fragments are the HTML pieces HTMX swaps into the page, and the figure
+// snippet. html/template escapes everything generated or uploaded.
+var fragments = template.Must(template.New("fragments").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).Parse(`
+{{- define "generation"}}
+            <div class="space-y-4">
+                {{- range .Options}}
+                <div class="bg-white p-3 rounded border border-green-200">
+                    <p>{{.}}</p>
+                </div>
+                {{- end}}
+            </div>
+            <p class="text-sm mt-2">Quality score: {{.Score}}/100 · Confidence: {{.Confidence}}/100</p>
+            {{- range .Lint}}
+            <p class="text-sm text-yellow-700">{{.}}</p>
+            {{- end}}
+            {{- with .Description}}
+            <h3 class="font-bold mt-4 mb-2">Long Description:</h3>
+            <div class="bg-white p-3 rounded border border-green-200 whitespace-pre-wrap">{{.}}</div>
+            {{- end}}
+            {{- range .Issues}}
+            <p class="text-sm text-yellow-700">{{.}}</p>
+            {{- end}}
+            {{- with .Keywords}}
+            <p class="mt-2"><span class="font-bold">Keywords:</span> {{join . ", "}}</p>
+            {{- end}}
+            {{- with .Caption}}
+            <p class="mt-2"><span class="font-bold">Caption:</span> {{.}}</p>
+            {{- end}}
+            {{- with .Tags}}
+            <p class="mt-2"><span class="font-bold">Tags:</span> {{join . ", "}}</p>
+            {{- end}}
+            {{- with .Objects}}
+            <p class="mt-2"><span class="font-bold">Objects:</span> {{join . ", "}}</p>
+            {{- end}}
+            {{- with .DetectedText}}
+            <p class="mt-2"><span class="font-bold">Text in the image:</span> {{.}}</p>
+            {{- end}}
+{{- end}}
+
+{{- define "success"}}
+        <div class="bg-green-50 border border-green-400 text-green-700 px-4 py-3 rounded-lg">
+            <h3 class="font-bold mb-4">Generated Alt Text Options:</h3>
+            {{- template "generation" .}}
+            <button onclick="location.reload()" class="mt-4 bg-green-100 text-green-700 px-4 py-2 rounded hover:bg-green-200">
+                Upload New Image
+            </button>
+        </div>
+{{end}}
+
+{{- define "results"}}
+        <div class="space-y-4">
+            <h3 class="font-bold">Generated Alt Text Options:</h3>
+            {{- range .}}
+            {{- if .Generation}}
+            <div class="bg-green-50 border border-green-400 text-green-700 px-4 py-3 rounded-lg">
+                <h3 class="font-bold mb-4">{{.Filename}}</h3>
+                {{- template "generation" .Generation}}
+            </div>
+            {{- else}}
+            <div class="bg-red-50 border border-red-400 text-red-700 px-4 py-3 rounded-lg">
+                <h3 class="font-bold mb-2">{{.Filename}}</h3>
+                <p>Error: {{.Error}}</p>
+            </div>
+            {{- end}}
+            {{- end}}
+            <button onclick="location.reload()" class="bg-green-100 text-green-700 px-4 py-2 rounded hover:bg-green-200">
+                Upload New Images
+            </button>
+        </div>
+{{end}}
+
+{{- define "error"}}
+		<div class="bg-red-50 border border-red-400 text-red-700 px-4 py-3 rounded-lg">
+			<p class="font-bold mb-2">Error: {{.}}</p>
+			<button
+				onclick="document.getElementById('uploadForm').reset(); this.closest('.bg-red-50').remove()"
+				class="bg-red-100 text-red-700 px-4 py-2 rounded hover:bg-red-200"
+			>
+				Try Again
+			</button>
+		</div>
+{{end}}
+
+{{- define "homeError"}}
+		<div class="bg-red-50 border border-red-400 text-red-700 px-4 py-3 rounded-lg">
+			<p class="font-bold">Error loading page: {{.}}</p>
+			<button onclick="window.location.reload()" class="mt-2 bg-red-100 text-red-700 px-4 py-2 rounded hover:bg-red-200">
+				Reload Page
+			</button>
+		</div>
+{{end}}
+
+{{- define "figure" -}}
+<figure>
+  <img src="{{.Src}}" alt="{{.Alt}}">
+  {{- with .Caption}}
+  <figcaption>{{.}}</figcaption>
+  {{- end}}
+</figure>
+{{end}}`))
+
+// renderFragment writes the named fragment as an HTML response
+func renderFragment(w http.ResponseWriter, name string, data any) {
+	w.Header().Set("Content-Type", "text/html")
+	if err := fragments.ExecuteTemplate(w, name, data); err != nil {
+		slog.Error("Error rendering fragment", "fragment", name, "err", err)
+	}
+}
+
+// Figure is an image ready to paste into a page as a figure
+type Figure struct {
+	// Src is the image's URL or path
+	Src string
+	Alt string
+	// Caption is the visible caption, left out when empty
+	Caption string
+}
+
+// NewFigure makes a figure of the image at src from record's first option
+// and caption
+func NewFigure(src string, record history.Record) Figure {
+	return Figure{Src: src, Alt: api.FirstOption(record.AltText), Caption: record.Caption}
+}
+
+// WriteFigure writes f as a <figure> snippet, with every value escaped
+func WriteFigure(w io.Writer, f Figure) error {
+	return fragments.ExecuteTemplate(w, "figure", f)
+}
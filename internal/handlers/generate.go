@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/audit"
+	"alt-text-generator/internal/auth"
+	"alt-text-generator/internal/deadline"
+	"alt-text-generator/internal/history"
+	"alt-text-generator/internal/idempotency"
+	"alt-text-generator/internal/logging"
+	"alt-text-generator/internal/metrics"
+	"alt-text-generator/internal/pool"
+	"alt-text-generator/internal/quota"
+)
+
+// generateAltText calls the provider for the raw image bytes and stores the
+// result in the history store. Each call counts against the caller's daily
+// quota and waits its turn for one of the server's generation workers.
+// Retries carrying the same Idempotency-Key and image get the original
+// result without another provider call, as does an image already generated
+// with the same provider, model, and prompt, or being generated for another
+// request at the same time.
+func generateAltText(ctx context.Context, provider api.Provider, store *history.Store, filename string, fileBytes []byte) (history.Record, error) {
+	ctx = api.WithFilename(ctx, filename)
+	if !provider.Enabled() {
+		return history.Record{}, api.ErrProviderDisabled
+	}
+
+	value, _, err := idempotency.Do(ctx, history.HashImage(fileBytes), optionsFingerprint(ctx, provider), func() (interface{}, error) {
+		if record, ok := cachedGeneration(ctx, provider, store, filename, fileBytes); ok {
+			return record, nil
+		}
+		return coalescedGeneration(ctx, provider, store, filename, fileBytes, func() (history.Record, error) {
+			if err := quota.Reserve(ctx); err != nil {
+				return history.Record{}, err
+			}
+			release, err := acquireWorker(ctx)
+			if err != nil {
+				quota.Record(ctx, 0, err)
+				return history.Record{}, err
+			}
+			logging.SetProvider(ctx, provider.Name)
+
+			start := time.Now()
+			result, err := provider.Generate(ctx, fileBytes)
+			err = deadline.Explain(ctx, err, deadline.Provider)
+			release()
+			quota.Record(ctx, result.Tokens(), err)
+			observeProvider(ctx, provider, start, result, err)
+			if err != nil {
+				return history.Record{}, err
+			}
+			return recordGeneration(ctx, provider, store, filename, fileBytes, result), nil
+		})
+	})
+	if err != nil {
+		return history.Record{}, err
+	}
+	return value.(history.Record), nil
+}
+
+// streamAltText behaves like generateAltText but passes each text fragment to
+// onDelta as the provider streams it
+func streamAltText(ctx context.Context, provider api.Provider, store *history.Store, filename string, fileBytes []byte, onDelta func(string)) (history.Record, error) {
+	ctx = api.WithFilename(ctx, filename)
+	if !provider.Enabled() {
+		return history.Record{}, api.ErrProviderDisabled
+	}
+
+	value, replayed, err := idempotency.Do(ctx, history.HashImage(fileBytes), optionsFingerprint(ctx, provider), func() (interface{}, error) {
+		if record, ok := cachedGeneration(ctx, provider, store, filename, fileBytes); ok {
+			return record, nil
+		}
+		return coalescedGeneration(ctx, provider, store, filename, fileBytes, func() (history.Record, error) {
+			if err := quota.Reserve(ctx); err != nil {
+				return history.Record{}, err
+			}
+			release, err := acquireWorker(ctx)
+			if err != nil {
+				quota.Record(ctx, 0, err)
+				return history.Record{}, err
+			}
+			logging.SetProvider(ctx, provider.Name)
+
+			start := time.Now()
+			result, err := provider.Stream(ctx, fileBytes, onDelta)
+			err = deadline.Explain(ctx, err, deadline.Provider)
+			release()
+			quota.Record(ctx, result.Tokens(), err)
+			observeProvider(ctx, provider, start, result, err)
+			if err != nil {
+				return history.Record{}, err
+			}
+			return recordGeneration(ctx, provider, store, filename, fileBytes, result), nil
+		})
+	})
+	if err != nil {
+		return history.Record{}, err
+	}
+	record := value.(history.Record)
+	if replayed || record.Cached {
+		// Nothing was streamed for a replay or a cached result, so deliver
+		// the whole text at once
+		onDelta(record.AltText)
+	}
+	return record, nil
+}
+
+// formContext reads the prompt context sent as "context.<name>" form fields,
+// such as context.page_title or context.surrounding_text
+func formContext(form url.Values) (api.ImageContext, error) {
+	values := map[string]string{}
+	for field, v := range form {
+		if name, ok := strings.CutPrefix(field, "context."); ok && len(v) > 0 {
+			values[name] = v[0]
+		}
+	}
+	return api.NewImageContext(values)
+}
+
+// acquireWorker waits for a generation worker within the preprocess stage's
+// budget
+func acquireWorker(ctx context.Context) (func(), error) {
+	waitCtx, cancel := deadline.Preprocessing(ctx)
+	defer cancel()
+	release, err := pool.Acquire(waitCtx)
+	return release, deadline.Explain(waitCtx, err, deadline.Preprocess)
+}
+
+// observeProvider records metrics and a structured log line for a provider
+// call, under the racer that answered when provider is a race. The calls to
+// racers that lost are recorded under their own names.
+func observeProvider(ctx context.Context, provider api.Provider, start time.Time, result api.Result, err error) {
+	for _, l := range result.Losers {
+		metrics.ObserveProvider(l.Provider, start, l.InputTokens, l.OutputTokens, l.Err)
+		slog.InfoContext(ctx, "Provider lost the race", "provider", l.Provider, "input_tokens", l.InputTokens, "output_tokens", l.OutputTokens, "err", l.Err)
+	}
+	provider = provider.Responder(result)
+	// A race nobody won has had each of its calls recorded as a loser
+	if result.Provider != "" || len(result.Losers) == 0 {
+		metrics.ObserveProvider(provider.Name, start, result.InputTokens, result.OutputTokens, err)
+	}
+
+	attrs := []any{
+		"provider", provider.Name,
+		"model", provider.Model,
+		"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if errors.Is(err, context.Canceled) {
+		// The caller hung up, and the provider call was abandoned with it
+		slog.InfoContext(ctx, "Provider call cancelled", attrs...)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Provider call failed", append(attrs, "err", err)...)
+		return
+	}
+	slog.InfoContext(ctx, "Provider call completed", append(attrs, "input_tokens", result.InputTokens, "output_tokens", result.OutputTokens)...)
+}
+
+// recordGeneration stores the result, attributing it to the authenticated
+// caller if any, and to the racer that answered when provider is a race
+func recordGeneration(ctx context.Context, provider api.Provider, store *history.Store, filename string, fileBytes []byte, result api.Result) history.Record {
+	var user string
+	if id, ok := auth.IdentityFromContext(ctx); ok {
+		user = id.User
+	}
+	prompt, err := api.Prompt(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Error rendering the prompt for history", "err", err)
+	}
+
+	provider = provider.Responder(result)
+	record := store.Add(history.Record{
+		User:         user,
+		Provider:     provider.Name,
+		Model:        provider.Model,
+		Filename:     filename,
+		ImageHash:    history.HashImage(fileBytes),
+		Thumbnail:    history.Thumbnail(fileBytes),
+		Prompt:       prompt,
+		Settings:     api.OutputSettings(ctx),
+		AltText:      result.Text,
+		Description:  result.Description,
+		Score:        result.Score,
+		Confidence:   result.Confidence,
+		Lint:         result.Lint,
+		Caption:      result.Caption,
+		Tags:         result.Tags,
+		Objects:      result.Objects,
+		DetectedText: result.DetectedText,
+		Keywords:     result.Keywords,
+		Issues:       result.Issues,
+		MaxChars:     result.MaxChars,
+		InputTokens:  result.InputTokens,
+		OutputTokens: result.OutputTokens,
+	})
+	slog.InfoContext(ctx, "Stored generation in history", "generation_id", record.ID)
+	audit.Record(ctx, audit.Event{Action: audit.ActionGenerate, ImageHash: record.ImageHash, Provider: record.Provider, Model: record.Model, GenerationID: record.ID})
+	store.SaveImage(ctx, record.ImageHash, http.DetectContentType(fileBytes), fileBytes)
+	return record
+}
+
+// supportedMediaTypes lists the image formats both providers accept
+var supportedMediaTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// decodeBase64Image decodes an image supplied either as raw base64 or as a
+// data URI ("data:image/png;base64,..."), enforcing the same 5MB limit as
+// uploads. It returns the sniffed media type alongside the bytes. Returned
+// errors are suitable for showing to callers.
+func decodeBase64Image(encoded string) ([]byte, string, error) {
+	encoded = strings.TrimSpace(encoded)
+	if strings.HasPrefix(encoded, "data:") {
+		meta, payload, ok := strings.Cut(encoded, ",")
+		if !ok || !strings.HasSuffix(meta, ";base64") {
+			return nil, "", errors.New("data URI must be base64 encoded")
+		}
+		encoded = payload
+	}
+
+	fileBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		// Accept unpadded and URL-safe variants produced by some encoders
+		if fileBytes, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "=")); err != nil {
+			fileBytes, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		}
+	}
+	if err != nil || len(fileBytes) == 0 {
+		return nil, "", errors.New("image must be a non-empty base64 string or data URI")
+	}
+	if len(fileBytes) > 5*1024*1024 {
+		return nil, "", errors.New("Image size exceeds 5MB limit. Please choose a smaller image.")
+	}
+
+	mediaType := http.DetectContentType(fileBytes)
+	if !supportedMediaTypes[mediaType] {
+		return nil, "", fmt.Errorf("Unsupported image format %q. Supported formats: JPG, PNG, GIF, WebP", mediaType)
+	}
+	return fileBytes, mediaType, nil
+}
@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/auth"
+	"alt-text-generator/internal/deadline"
+	"alt-text-generator/internal/graphql"
+	"alt-text-generator/internal/history"
+)
+
+// NewGraphQLSchema builds the schema exposing providers, generation, and history.
+// The active provider is used for generation unless the caller picks another
+// configured one.
+func NewGraphQLSchema(active api.Provider, store *history.Store) *graphql.Schema {
+	providerType := &graphql.Object{
+		Name: "Provider",
+		Fields: map[string]*graphql.Field{
+			"name":       {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(api.Provider).Name, nil }},
+			"label":      {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(api.Provider).Label, nil }},
+			"model":      {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(api.Provider).Model, nil }},
+			"configured": {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(api.Provider).Configured(), nil }},
+			"active": {Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(api.Provider).Name == active.Name, nil
+			}},
+		},
+	}
+
+	generationType := &graphql.Object{
+		Name: "Generation",
+		Fields: map[string]*graphql.Field{
+			"id":        {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(history.Record).ID, nil }},
+			"user":      {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(history.Record).User, nil }},
+			"provider":  {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(history.Record).Provider, nil }},
+			"model":     {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(history.Record).Model, nil }},
+			"filename":  {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(history.Record).Filename, nil }},
+			"imageHash": {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(history.Record).ImageHash, nil }},
+			"altText":   {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(history.Record).AltText, nil }},
+			"options":   {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(history.Record).Options(), nil }},
+			"description": {Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(history.Record).Description, nil
+			}},
+			"score": {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(history.Record).Score, nil }},
+			"confidence": {Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(history.Record).Confidence, nil
+			}},
+			"lint":    {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(history.Record).Lint, nil }},
+			"caption": {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(history.Record).Caption, nil }},
+			"tags":    {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(history.Record).Tags, nil }},
+			"objects": {Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(history.Record).Objects, nil }},
+			"keywords": {Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(history.Record).Keywords, nil
+			}},
+			"issues": {Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(history.Record).Issues, nil
+			}},
+			"detectedText": {Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(history.Record).DetectedText, nil
+			}},
+			"maxChars": {Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(history.Record).MaxChars, nil
+			}},
+			"cached": {Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(history.Record).Cached, nil
+			}},
+			"createdAt": {Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(history.Record).CreatedAt.Format(time.RFC3339), nil
+			}},
+		},
+	}
+
+	query := &graphql.Object{
+		Name: "Query",
+		Fields: map[string]*graphql.Field{
+			"providers": {
+				Type: providerType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return api.Providers(), nil
+				},
+			},
+			"provider": {
+				Type: providerType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if provider, ok := api.LookupProvider(p.String("name")); ok {
+						return provider, nil
+					}
+					return nil, nil
+				},
+			},
+			"generation": {
+				Type: generationType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					record, ok := store.Get(p.String("id"))
+					if id, authenticated := auth.IdentityFromContext(p.Context); ok && authenticated && record.User != id.User {
+						ok = false
+					}
+					if ok {
+						return record, nil
+					}
+					return nil, nil
+				},
+			},
+			"history": {
+				Type: generationType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					filter, err := historyFilterFromArgs(p)
+					if err != nil {
+						return nil, err
+					}
+					return store.List(filter), nil
+				},
+			},
+		},
+	}
+
+	mutation := &graphql.Object{
+		Name: "Mutation",
+		Fields: map[string]*graphql.Field{
+			// Each generate is a provider call, so a request can't fan out
+			// into many of them under one rate limit charge
+			"generate": {
+				Type:          generationType,
+				MaxPerRequest: 1,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					provider := active
+					if name := p.String("provider"); name != "" {
+						var ok bool
+						if provider, ok = api.LookupProvider(name); !ok {
+							return nil, fmt.Errorf("unknown provider %q", name)
+						}
+					}
+					if !provider.Configured() {
+						return nil, fmt.Errorf("API key not configured for %s", provider.Name)
+					}
+
+					fileBytes, _, err := decodeBase64Image(p.String("image"))
+					if err != nil {
+						return nil, err
+					}
+
+					imageContext, err := contextArg(p)
+					if err != nil {
+						return nil, err
+					}
+
+					ctx := api.WithImageContext(p.Context, imageContext)
+					if refresh, ok := p.Args["refresh"].(bool); ok {
+						ctx = history.WithRefresh(ctx, refresh)
+					}
+					record, err := generateAltText(ctx, provider, store, p.String("filename"), fileBytes)
+					if err != nil {
+						slog.ErrorContext(p.Context, "Error generating alt text", "err", err)
+						return nil, fmt.Errorf("%s", formatErrorMessage(err.Error()))
+					}
+					return record, nil
+				},
+			},
+		},
+	}
+
+	return &graphql.Schema{Query: query, Mutation: mutation}
+}
+
+// contextArg reads the generate mutation's context argument, an object of
+// prompt values such as {page_title: "Pricing"}
+func contextArg(p graphql.ResolveParams) (api.ImageContext, error) {
+	arg, _ := p.Args["context"].(map[string]interface{})
+	values := map[string]string{}
+	for name, v := range arg {
+		s, ok := v.(string)
+		if !ok && v != nil {
+			return api.ImageContext{}, fmt.Errorf("context.%s must be a string", name)
+		}
+		values[name] = s
+	}
+	return api.NewImageContext(values)
+}
+
+// historyFilterFromArgs reads the history query's arguments. Authenticated
+// callers only see their own generations, whatever user they ask for. The
+// limit defaults to and is capped like the REST API's.
+func historyFilterFromArgs(p graphql.ResolveParams) (history.Filter, error) {
+	filter := history.Filter{
+		User:     p.String("user"),
+		Provider: p.String("provider"),
+		Filename: p.String("filename"),
+		Search:   p.String("search"),
+		Limit:    defaultHistoryLimit,
+	}
+	if id, ok := auth.IdentityFromContext(p.Context); ok {
+		filter.User = id.User
+	}
+	if _, given := p.Args["limit"]; given {
+		n, ok := p.Int("limit")
+		if !ok || n < 1 || n > maxHistoryLimit {
+			return filter, fmt.Errorf("limit must be between 1 and 100")
+		}
+		filter.Limit = n
+	}
+	if _, given := p.Args["offset"]; given {
+		n, ok := p.Int("offset")
+		if !ok || n < 0 {
+			return filter, fmt.Errorf("offset must not be negative")
+		}
+		filter.Offset = n
+	}
+
+	var err error
+	if since := p.String("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return filter, fmt.Errorf("since must be an RFC 3339 timestamp")
+		}
+	}
+	if until := p.String("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return filter, fmt.Errorf("until must be an RFC 3339 timestamp")
+		}
+	}
+	return filter, nil
+}
+
+func GraphQLHandler(w http.ResponseWriter, r *http.Request, schema *graphql.Schema) {
+	slog.InfoContext(r.Context(), "Received GraphQL request")
+
+	var req graphql.Request
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if vars := r.URL.Query().Get("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				writeGraphQLError(w, http.StatusBadRequest, "variables must be a JSON object")
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8*1024*1024)).Decode(&req); err != nil {
+			if _, timedOut := deadline.StageOf(err); timedOut {
+				writeGraphQLError(w, http.StatusRequestTimeout, err.Error())
+				return
+			}
+			writeGraphQLError(w, http.StatusBadRequest, "request body must be a JSON object with a query")
+			return
+		}
+		deadline.Received(r.Context())
+	default:
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if req.Query == "" {
+		writeGraphQLError(w, http.StatusBadRequest, "query is required")
+		return
+	}
+
+	if r.Method == http.MethodGet && isMutation(req) {
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "mutations must use POST")
+		return
+	}
+
+	resp := graphql.Execute(r.Context(), schema, req)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding GraphQL response", "err", err)
+	}
+}
+
+func isMutation(req graphql.Request) bool {
+	doc, err := graphql.Parse(req.Query)
+	if err != nil {
+		return false
+	}
+	for _, op := range doc.Operations {
+		if op.Type == "mutation" && (req.OperationName == "" || op.Name == req.OperationName) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeGraphQLError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(graphql.Response{Errors: []graphql.Error{{Message: message}}})
+}
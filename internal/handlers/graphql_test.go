@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"alt-text-generator/internal/graphql"
+)
+
+func TestHistoryFilterLimit(t *testing.T) {
+	tests := []struct {
+		args  map[string]interface{}
+		limit int
+		err   bool
+	}{
+		{args: map[string]interface{}{}, limit: defaultHistoryLimit},
+		{args: map[string]interface{}{"limit": 1}, limit: 1},
+		{args: map[string]interface{}{"limit": 100}, limit: 100},
+		{args: map[string]interface{}{"limit": 101}, err: true},
+		{args: map[string]interface{}{"limit": 0}, err: true},
+		{args: map[string]interface{}{"limit": "10"}, err: true},
+		{args: map[string]interface{}{"offset": -1}, err: true},
+	}
+	for _, tt := range tests {
+		filter, err := historyFilterFromArgs(graphql.ResolveParams{Context: context.Background(), Args: tt.args})
+		if tt.err {
+			if err == nil {
+				t.Errorf("%v: no error", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.args, err)
+		} else if filter.Limit != tt.limit {
+			t.Errorf("%v: limit = %d, want %d", tt.args, filter.Limit, tt.limit)
+		}
+	}
+}
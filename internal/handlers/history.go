@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"alt-text-generator/internal/auth"
+	"alt-text-generator/internal/history"
+)
+
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+// historyPage is one page of GET /api/v1/history
+type historyPage struct {
+	Items      []generationResponse `json:"items"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+}
+
+// HistoryHandler lists stored generations newest first. Query parameters:
+// provider, filename (substring), q (words that must all appear in the alt
+// text), rating (up or down feedback), since/until (RFC 3339 timestamps or dates), limit (1-100), and
+// cursor (next_cursor from the previous page). Authenticated callers only
+// see their own generations.
+func HistoryHandler(w http.ResponseWriter, r *http.Request, store *history.Store) {
+	filter, err := historyFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	records, cursor, next := listHistory(r, store, filter)
+	page := historyPage{Items: []generationResponse{}, NextCursor: cursor}
+	if next != "" {
+		w.Header().Set("Link", "<"+next+`>; rel="next"`)
+	}
+	for _, record := range records {
+		page.Items = append(page.Items, generationResponse{Record: record, Options: record.Options()})
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// ExportHistoryHandler downloads every stored generation matching the
+// history query parameters, as a JSON array or, with format=csv, as CSV.
+// Authenticated callers only export their own generations.
+func ExportHistoryHandler(w http.ResponseWriter, r *http.Request, store *history.Store) {
+	filter, err := historyFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if !slices.Contains(history.ExportFormats, format) {
+		writeJSONError(w, http.StatusBadRequest, "format must be csv or json")
+		return
+	}
+
+	contentType := "application/json"
+	if format == "csv" {
+		contentType = "text/csv; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="history-%s.%s"`, time.Now().UTC().Format(time.DateOnly), format))
+	n, err := store.Export(w, filter, format)
+	if err != nil {
+		// The response has started, so the download is left cut short
+		slog.ErrorContext(r.Context(), "Error exporting history", "exported", n, "err", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Exported history", "format", format, "generations", n)
+}
+
+// GetHistoryHandler returns a single stored generation
+func GetHistoryHandler(w http.ResponseWriter, r *http.Request, store *history.Store) {
+	record, ok := ownGeneration(r, store)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Generation not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, generationResponse{Record: record, Options: record.Options()})
+}
+
+// HistoryImageHandler returns the original image of a stored generation,
+// when images are kept in object storage
+func HistoryImageHandler(w http.ResponseWriter, r *http.Request, store *history.Store) {
+	record, ok := ownGeneration(r, store)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Generation not found")
+		return
+	}
+	data, ok := store.Image(r.Context(), record)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Image not found")
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(data)
+}
+
+// ownGeneration returns the generation named by the id path value, unless
+// it belongs to someone other than an authenticated caller
+func ownGeneration(r *http.Request, store *history.Store) (history.Record, bool) {
+	record, ok := store.Get(r.PathValue("id"))
+	if id, authenticated := auth.IdentityFromContext(r.Context()); ok && authenticated && record.User != id.User {
+		return history.Record{}, false
+	}
+	return record, ok
+}
+
+// listHistory returns a page of the records matching filter, with the
+// cursor and URL of the next page if there is one
+func listHistory(r *http.Request, store *history.Store, filter history.Filter) ([]history.Record, string, string) {
+	// Fetch one extra record to learn whether another page follows
+	limit := filter.Limit
+	filter.Limit++
+	records := store.List(filter)
+	if len(records) <= limit {
+		return records, "", ""
+	}
+	records = records[:limit]
+	cursor := history.CursorFor(records[limit-1]).Encode()
+
+	next := *r.URL
+	q := next.Query()
+	q.Set("cursor", cursor)
+	next.RawQuery = q.Encode()
+	return records, cursor, next.RequestURI()
+}
+
+// historyFilter reads the history query parameters shared by the API and
+// the history page. Authenticated callers only see their own generations.
+func historyFilter(r *http.Request) (history.Filter, error) {
+	query := r.URL.Query()
+	filter := history.Filter{
+		Provider: query.Get("provider"),
+		Filename: query.Get("filename"),
+		Search:   query.Get("q"),
+		Rating:   query.Get("rating"),
+		Limit:    defaultHistoryLimit,
+	}
+	if id, ok := auth.IdentityFromContext(r.Context()); ok {
+		filter.User = id.User
+	}
+
+	if filter.Rating != "" && filter.Rating != history.RatingUp && filter.Rating != history.RatingDown {
+		return filter, errors.New("rating must be up or down")
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			return filter, errors.New("limit must be between 1 and 100")
+		}
+		filter.Limit = n
+	}
+	var err error
+	if filter.Since, err = parseHistoryTime(query, "since"); err != nil {
+		return filter, err
+	}
+	if filter.Until, err = parseHistoryTime(query, "until"); err != nil {
+		return filter, err
+	}
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := history.DecodeCursor(v)
+		if err != nil {
+			return filter, errors.New("cursor is invalid")
+		}
+		filter.After = &cursor
+	}
+	return filter, nil
+}
+
+// parseHistoryTime reads an RFC 3339 timestamp or a bare date from the query
+func parseHistoryTime(query url.Values, key string) (time.Time, error) {
+	v := query.Get(key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s must be an RFC 3339 timestamp or a date such as 2024-05-01", key)
+}
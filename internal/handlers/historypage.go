@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"alt-text-generator/internal/history"
+)
+
+// historyPageData is what web/history.html is rendered with
+type historyPageData struct {
+	Search, Since, Until string
+	Generations          []historyItem
+	Next                 string
+	// Return is where feedback forms send the browser back to
+	Return string
+	Error  string
+}
+
+// historyItem is a generation as the history page shows it
+type historyItem struct {
+	ID                        string
+	Filename, Provider, Model string
+	Options                   []string
+	// Thumbnail is trusted as a URL, since the store only holds data URIs
+	// it made itself, and the image route is built here
+	Thumbnail          template.URL
+	Timestamp, Created string
+	Cached             bool
+	// Superseded and Regenerated mark generations replaced by, or made by,
+	// a regeneration with a newer model
+	Superseded, Regenerated bool
+	// Rating, EditedAltText, and Comment are the feedback given so far
+	Rating, EditedAltText, Comment string
+}
+
+// HistoryPageHandler serves the history page, listing past generations
+// newest first with their thumbnails, searchable by alt text and date, with
+// forms to rate or correct each one. It takes the same query parameters as
+// the history API.
+func HistoryPageHandler(w http.ResponseWriter, r *http.Request, store *history.Store) {
+	query := r.URL.Query()
+	data := historyPageData{Search: query.Get("q"), Since: query.Get("since"), Until: query.Get("until"), Return: r.URL.RequestURI()}
+
+	status := http.StatusOK
+	filter, err := historyFilter(r)
+	if err != nil {
+		status, data.Error = http.StatusBadRequest, err.Error()
+	} else {
+		var records []history.Record
+		records, _, data.Next = listHistory(r, store, filter)
+		for _, record := range records {
+			item := historyItem{
+				ID:        record.ID,
+				Filename:  record.Filename,
+				Provider:  record.Provider,
+				Model:     record.Model,
+				Options:   record.Options(),
+				Timestamp: record.CreatedAt.Format(time.RFC3339),
+				Created:   record.CreatedAt.Format("2 Jan 2006 15:04 MST"),
+				Cached:    record.Cached,
+			}
+			item.Superseded, item.Regenerated = record.SupersededBy != "", record.Supersedes != ""
+			if f := record.Feedback; f != nil {
+				item.Rating, item.EditedAltText, item.Comment = f.Rating, f.EditedAltText, f.Comment
+			}
+			if strings.HasPrefix(record.Thumbnail, "data:image/jpeg;base64,") {
+				item.Thumbnail = template.URL(record.Thumbnail)
+			} else if store.KeepsImages() {
+				// Without a thumbnail, such as for a WebP image, show the
+				// original from object storage
+				item.Thumbnail = template.URL("/history/" + url.PathEscape(record.ID) + "/image")
+			}
+			data.Generations = append(data.Generations, item)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := historyTmpl.Execute(w, data); err != nil {
+		slog.ErrorContext(r.Context(), "Error rendering history page", "err", err)
+	}
+}
@@ -1,8 +1,10 @@
 package handlers
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"errors"
+	htmltemplate "html/template"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -11,10 +13,40 @@ import (
 	"alt-text-generator/internal/types"
 )
 
-var tmpl = template.Must(template.ParseFiles(filepath.Join("web", "template.html")))
+var tmpl *template.Template
 
-func HomeHandler(w http.ResponseWriter, r *http.Request, mode string) {
-	log.Println("Serving home page")
+// historyTmpl is the history page, which shows uploaded filenames and
+// generated text, so html/template escapes it
+var historyTmpl *htmltemplate.Template
+
+// LoadTemplate parses the page templates from the web directory. They are
+// loaded by the server rather than at init so command line use works from
+// any directory.
+func LoadTemplate() error {
+	t, err := template.ParseFiles(filepath.Join("web", "template.html"))
+	if err != nil {
+		return err
+	}
+	h, err := htmltemplate.ParseFiles(filepath.Join("web", "history.html"))
+	if err != nil {
+		return err
+	}
+	tmpl, historyTmpl = t, h
+	return nil
+}
+
+// CheckTemplate reports whether the page templates parsed and are renderable
+func CheckTemplate(ctx context.Context) error {
+	if tmpl == nil || tmpl.Lookup("template.html") == nil || historyTmpl == nil {
+		return errors.New("page template not loaded")
+	}
+	return nil
+}
+
+// HomeHandler serves the upload form. With authRequired, the form asks for
+// an API key or token to send with its uploads.
+func HomeHandler(w http.ResponseWriter, r *http.Request, mode string, authRequired bool) {
+	slog.InfoContext(r.Context(), "Serving home page")
 
 	// Check if API key exists
 	var apiKey string
@@ -27,10 +59,11 @@ func HomeHandler(w http.ResponseWriter, r *http.Request, mode string) {
 	data := types.TemplateData{
 		Mode:          mode,
 		APIKeyMissing: apiKey == "",
+		AuthRequired:  authRequired,
 	}
 
 	if err := tmpl.Execute(w, data); err != nil {
-		log.Printf("Error rendering template: %v", err)
+		slog.ErrorContext(r.Context(), "Error rendering template", "err", err)
 		renderHomeError(w, err.Error())
 		return
 	}
@@ -39,12 +72,7 @@ func HomeHandler(w http.ResponseWriter, r *http.Request, mode string) {
 func renderHomeError(w http.ResponseWriter, message string) {
 	w.Header().Set("Content-Type", "text/html")
 	w.WriteHeader(http.StatusInternalServerError)
-	fmt.Fprintf(w, `
-		<div class="bg-red-50 border border-red-400 text-red-700 px-4 py-3 rounded-lg">
-			<p class="font-bold">Error loading page: %s</p>
-			<button onclick="window.location.reload()" class="mt-2 bg-red-100 text-red-700 px-4 py-2 rounded hover:bg-red-200">
-				Reload Page
-			</button>
-		</div>
-	`, message)
+	if err := fragments.ExecuteTemplate(w, "homeError", message); err != nil {
+		slog.Error("Error rendering fragment", "fragment", "homeError", "err", err)
+	}
 }
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/audit"
+	"alt-text-generator/internal/auth"
+	"alt-text-generator/internal/fetch"
+	"alt-text-generator/internal/history"
+	"alt-text-generator/internal/idempotency"
+	"alt-text-generator/internal/jobs"
+	"alt-text-generator/internal/quota"
+)
+
+// NewJobProcessor returns the function job workers use to generate alt text,
+// charging each job to its submitter's quota in quotas and recording it in
+// trail
+func NewJobProcessor(provider api.Provider, store *history.Store, quotas *quota.Tracker, trail *audit.Log) jobs.ProcessFunc {
+	return func(ctx context.Context, filename string, data []byte) (history.Record, error) {
+		ctx = quota.NewContext(ctx, quotas)
+		ctx = audit.NewContext(ctx, trail)
+		record, err := generateAltText(ctx, provider, store, filename, data)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error generating alt text", "err", err)
+			jobErr := error(&jobError{message: formatErrorMessage(err.Error()), err: err})
+			if permanentFailure(err) {
+				jobErr = jobs.Permanent(jobErr)
+			}
+			return history.Record{}, jobErr
+		}
+		return record, nil
+	}
+}
+
+// jobError is a job's failure as its submitter is shown it, keeping the
+// error it came from for deciding whether to retry
+type jobError struct {
+	message string
+	err     error
+}
+
+func (e *jobError) Error() string {
+	return e.message
+}
+
+func (e *jobError) Unwrap() error {
+	return e.err
+}
+
+// permanentFailure reports whether a generation failed in a way retrying
+// won't fix soon: a used-up quota, a disabled provider, or an image or
+// request the provider rejected
+func permanentFailure(err error) bool {
+	return errors.Is(err, quota.ErrExceeded) || errors.Is(err, api.ErrProviderDisabled) ||
+		errors.Is(err, api.ErrInvalidRequest) || errors.Is(err, fetch.ErrTooLarge)
+}
+
+// CreateJobHandler queues an image for asynchronous processing. The image is
+// either a multipart "image" file or a JSON body of the form {"url": "..."},
+// with optional prompt context as "context.<name>" fields or a JSON "context"
+// object.
+// URLs are fetched through images. It responds 202 with the job and a
+// Location header to poll.
+func CreateJobHandler(w http.ResponseWriter, r *http.Request, provider api.Provider, manager *jobs.Manager, images *fetch.Guard) {
+	slog.InfoContext(r.Context(), "Received job submission")
+
+	if !provider.Configured() {
+		writeJSONError(w, http.StatusServiceUnavailable, "API key not configured")
+		return
+	}
+	// Refuse work up front rather than queueing a job that is bound to fail
+	if err := quota.Check(r.Context()); err != nil {
+		setRetryAfter(w, err)
+		writeJSONError(w, http.StatusTooManyRequests, formatErrorMessage(err.Error()))
+		return
+	}
+
+	var filename string
+	var fileBytes []byte
+	var imageContext api.ImageContext
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			URL     string            `json:"url"`
+			Context map[string]string `json:"context"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&body); err != nil || body.URL == "" {
+			writeJSONError(w, http.StatusBadRequest, "Request body must be a JSON object with a url")
+			return
+		}
+		var err error
+		if imageContext, err = api.NewImageContext(body.Context); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		image, err := images.FetchImage(r.Context(), body.URL)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		filename, fileBytes = image.Filename, image.Data
+	} else {
+		var err error
+		if filename, fileBytes, err = readUploadedImage(r); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if imageContext, err = formContext(r.MultipartForm.Value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	ctx := api.WithImageContext(r.Context(), imageContext)
+
+	// A retried submission returns the job created by the first attempt
+	value, replayed, err := idempotency.Do(ctx, "job:"+history.HashImage(fileBytes), optionsFingerprint(ctx, provider), func() (interface{}, error) {
+		job, err := manager.Submit(ctx, filename, fileBytes)
+		return job.ID, err
+	})
+	var job jobs.Job
+	if err == nil {
+		var ok bool
+		if job, ok = manager.Get(value.(string)); !ok && replayed {
+			// The original job aged out of retention; start a fresh one
+			job, err = manager.Submit(ctx, filename, fileBytes)
+		}
+	}
+	if errors.Is(err, idempotency.ErrMismatch) {
+		writeJSONError(w, http.StatusUnprocessableEntity, formatErrorMessage(err.Error()))
+		return
+	}
+	if err != nil {
+		w.Header().Set("Retry-After", "30")
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// GetJobHandler reports the status of a job, including its result once
+// finished. Authenticated callers only see their own jobs.
+func GetJobHandler(w http.ResponseWriter, r *http.Request, manager *jobs.Manager) {
+	job, ok := manager.Get(r.PathValue("id"))
+	if id, authenticated := auth.IdentityFromContext(r.Context()); ok && authenticated && job.User != id.User {
+		ok = false
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
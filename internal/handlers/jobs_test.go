@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/fetch"
+	"alt-text-generator/internal/quota"
+)
+
+func TestPermanentFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("%w: 100 requests per day", quota.ErrExceeded), true},
+		{api.ErrProviderDisabled, true},
+		{&api.Error{Message: "Invalid image", Type: "invalid_request_error"}, true},
+		{fmt.Errorf("generating alt text: %w", &api.Error{Message: "Invalid image", Type: "invalid_request_error"}), true},
+		{fetch.ErrTooLarge, true},
+		{fmt.Errorf("fetching image: %w", fetch.ErrTooLarge), true},
+		{context.DeadlineExceeded, false},
+		{&api.Error{Message: "Overloaded", Type: "overloaded_error"}, false},
+		{&api.Error{Message: "Internal server error"}, false},
+		// Only the error itself counts, not text that happens to match it
+		{errors.New("API error: Invalid image (invalid_request_error)"), false},
+		{errors.New("image exceeds 5 MB maximum"), false},
+		{errors.New("dial tcp: lookup api.openai.com: no such host"), false},
+	}
+	for _, tt := range tests {
+		if got := permanentFailure(tt.err); got != tt.want {
+			t.Errorf("permanentFailure(%q) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+
+	// The message shown keeps the error it came from
+	err := error(&jobError{message: "Daily usage quota exceeded.", err: fmt.Errorf("reserving quota: %w", quota.ErrExceeded)})
+	if !errors.Is(err, quota.ErrExceeded) || err.Error() != "Daily usage quota exceeded." {
+		t.Errorf("jobError = %q, unwraps to quota.ErrExceeded: %v", err, errors.Is(err, quota.ErrExceeded))
+	}
+}
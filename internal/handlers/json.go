@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/deadline"
+	"alt-text-generator/internal/history"
+)
+
+// generateRequest is the JSON body accepted by GenerateJSONHandler
+type generateRequest struct {
+	ImageBase64 string `json:"image_base64"`
+	MediaType   string `json:"media_type"`
+	Filename    string `json:"filename"`
+	// Context holds values for the prompt, such as page_title
+	Context map[string]string `json:"context"`
+}
+
+// generationResponse is a stored generation plus its alt text split into options
+type generationResponse struct {
+	history.Record
+	Options []string `json:"options"`
+}
+
+// GenerateJSONHandler generates alt text for an image sent as base64 or a data
+// URI in a JSON body, for clients that already hold encoded images
+func GenerateJSONHandler(w http.ResponseWriter, r *http.Request, provider api.Provider, store *history.Store) {
+	slog.InfoContext(r.Context(), "Received JSON generate request")
+
+	if !provider.Configured() {
+		writeJSONError(w, http.StatusServiceUnavailable, "API key not configured")
+		return
+	}
+
+	var req generateRequest
+	// Base64 inflates by a third, so allow comfortably more than the 5MB image limit
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8*1024*1024)).Decode(&req); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			setTimeoutStage(w, err)
+			writeJSONError(w, generationErrorStatus(err), formatErrorMessage(err.Error()))
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "Request body must be a JSON object with image_base64")
+		return
+	}
+	deadline.Received(r.Context())
+
+	fileBytes, detected, err := decodeBase64Image(req.ImageBase64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.MediaType != "" && req.MediaType != detected {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("media_type %q does not match image content (%s)", req.MediaType, detected))
+		return
+	}
+
+	imageContext, err := api.NewImageContext(req.Context)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	record, err := generateAltText(api.WithImageContext(r.Context(), imageContext), provider, store, req.Filename, fileBytes)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error generating alt text", "err", err)
+		setRetryAfter(w, err)
+		setTimeoutStage(w, err)
+		writeJSONError(w, generationErrorStatus(err), formatErrorMessage(err.Error()))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, generationResponse{Record: record, Options: record.Options()})
+}
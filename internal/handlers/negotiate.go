@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Response formats supported by content negotiation
+const (
+	formatHTML = "html"
+	formatJSON = "json"
+	formatText = "text"
+	// formatFigure is a <figure> snippet to paste into a page, only given
+	// when asked for by name
+	formatFigure = "figure"
+)
+
+var formatsByMediaType = map[string]string{
+	"text/html":        formatHTML,
+	"application/json": formatJSON,
+	"text/plain":       formatText,
+}
+
+// negotiateFormat picks the response format from the "format" query or form
+// parameter, falling back to the Accept header. HTML is the default so HTMX
+// and browsers keep getting fragments.
+func negotiateFormat(r *http.Request) string {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "json":
+		return formatJSON
+	case "text", "plain", "txt":
+		return formatText
+	case "html":
+		return formatHTML
+	case "figure":
+		return formatFigure
+	}
+
+	type candidate struct {
+		format string
+		q      float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		format, ok := formatsByMediaType[strings.ToLower(strings.TrimSpace(mediaType))]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && name == "q" {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{format, q})
+		}
+	}
+	if len(candidates) == 0 {
+		return formatHTML
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+	return candidates[0].format
+}
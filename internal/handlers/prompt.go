@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/history"
+)
+
+// PromptMiddleware applies per-request prompt options given as query
+// parameters to the generations a request makes: "style" and "domain" pick
+// presets, as in /upload?style=marketing&domain=ecommerce, "platform" a
+// social network to write for, "limit" a length limit by preset name or as
+// custom:N, "people" sets how people may be described, "describe" asks for
+// a long description too, "keywords" for keywords, "charts" for chart mode,
+// "objective" for objective mode, "reading_level" for a grade to write for,
+// "structured" for a structured result, "candidates" for how many times to
+// ask the model, as in /upload?candidates=3, "temperature", "top_p", and
+// "seed" set the sampling parameters, "translate" lists languages to
+// translate the existing_alt context into, "improve" critiques and
+// rewrites it, and "refresh" skips the result cache, replacing the stored
+// result. Requests without them use the configured defaults.
+func PromptMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		ctx := r.Context()
+		if name := query.Get("style"); name != "" {
+			if err := api.CheckStyle(name); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			ctx = api.WithStyle(ctx, name)
+		}
+		if name := query.Get("domain"); name != "" {
+			if err := api.CheckDomain(name); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			ctx = api.WithDomain(ctx, name)
+		}
+		if name := query.Get("platform"); name != "" {
+			if err := api.CheckPlatform(name); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			ctx = api.WithPlatform(ctx, name)
+		}
+		if value := query.Get("limit"); value != "" {
+			limit, err := api.ParseLimit(value)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			ctx = api.WithMaxChars(ctx, limit)
+		}
+		if name := query.Get("people"); name != "" {
+			if err := api.CheckPeoplePolicy(name); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			ctx = api.WithPeoplePolicy(ctx, name)
+		}
+		if value := query.Get("describe"); value != "" {
+			describe, err := strconv.ParseBool(value)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "describe must be true or false")
+				return
+			}
+			ctx = api.WithDescription(ctx, describe)
+		}
+		if value := query.Get("keywords"); value != "" {
+			keywords, err := strconv.ParseBool(value)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "keywords must be true or false")
+				return
+			}
+			ctx = api.WithKeywords(ctx, keywords)
+		}
+		if value := query.Get("charts"); value != "" {
+			charts, err := strconv.ParseBool(value)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "charts must be true or false")
+				return
+			}
+			ctx = api.WithCharts(ctx, charts)
+		}
+		if value := query.Get("objective"); value != "" {
+			objective, err := strconv.ParseBool(value)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "objective must be true or false")
+				return
+			}
+			ctx = api.WithObjective(ctx, objective)
+		}
+		if value := query.Get("reading_level"); value != "" {
+			grade, err := strconv.Atoi(value)
+			if err == nil {
+				err = api.CheckReadingLevel(grade)
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("reading_level must be a grade from 1 to %d, or 0 for none", api.MaxReadingLevel))
+				return
+			}
+			ctx = api.WithReadingLevel(ctx, grade)
+		}
+		if value := query.Get("candidates"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err == nil {
+				err = api.CheckCandidates(n)
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("candidates must be a number from 1 to %d", api.MaxCandidates))
+				return
+			}
+			ctx = api.WithCandidates(ctx, n)
+		}
+		sampling, err := querySampling(query)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if sampling != (api.Sampling{}) {
+			ctx = api.WithSampling(ctx, sampling)
+		}
+		if value := query.Get("translate"); value != "" {
+			languages, err := api.ParseLanguages(value)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			ctx = api.WithTranslation(ctx, languages)
+		}
+		if value := query.Get("improve"); value != "" {
+			improve, err := strconv.ParseBool(value)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "improve must be true or false")
+				return
+			}
+			ctx = api.WithImprove(ctx, improve)
+		}
+		if value := query.Get("refresh"); value != "" {
+			refresh, err := strconv.ParseBool(value)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "refresh must be true or false")
+				return
+			}
+			ctx = history.WithRefresh(ctx, refresh)
+		}
+		if value := query.Get("structured"); value != "" {
+			structured, err := strconv.ParseBool(value)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "structured must be true or false")
+				return
+			}
+			ctx = api.WithStructured(ctx, structured)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// querySampling reads the sampling parameters in query, leaving those not
+// given nil
+func querySampling(query url.Values) (api.Sampling, error) {
+	var s api.Sampling
+	if value := query.Get("temperature"); value != "" {
+		t, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return s, errors.New("temperature must be a number")
+		}
+		s.Temperature = &t
+	}
+	if value := query.Get("top_p"); value != "" {
+		p, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return s, errors.New("top_p must be a number")
+		}
+		s.TopP = &p
+	}
+	if value := query.Get("seed"); value != "" {
+		seed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return s, errors.New("seed must be a whole number")
+		}
+		s.Seed = &seed
+	}
+	return s, s.Check()
+}
+
+// formOptions applies the web form's "describe", "keywords", "charts", and
+// "objective" checkboxes, when ticked, and its "candidates" count
+func formOptions(r *http.Request) *http.Request {
+	if r.MultipartForm == nil {
+		return r
+	}
+	ctx := r.Context()
+	if r.MultipartForm.Value["describe"] != nil {
+		ctx = api.WithDescription(ctx, true)
+	}
+	if r.MultipartForm.Value["keywords"] != nil {
+		ctx = api.WithKeywords(ctx, true)
+	}
+	if r.MultipartForm.Value["charts"] != nil {
+		ctx = api.WithCharts(ctx, true)
+	}
+	if r.MultipartForm.Value["objective"] != nil {
+		ctx = api.WithObjective(ctx, true)
+	}
+	if values := r.MultipartForm.Value["candidates"]; values != nil {
+		if n, err := strconv.Atoi(values[0]); err == nil && api.CheckCandidates(n) == nil {
+			ctx = api.WithCandidates(ctx, n)
+		}
+	}
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"alt-text-generator/internal/audit"
+	"alt-text-generator/internal/regenerate"
+)
+
+// regenerateRequest is the body of POST /admin/regenerate
+type regenerateRequest struct {
+	OldModels bool    `json:"old_models"`
+	Below     int     `json:"below"`
+	RatedDown bool    `json:"rated_down"`
+	Since     string  `json:"since"`
+	Until     string  `json:"until"`
+	Budget    float64 `json:"budget"`
+	Limit     int     `json:"limit"`
+	DryRun    bool    `json:"dry_run"`
+}
+
+// StartRegenerationHandler starts captioning stored generations again with
+// the active provider in the background, and responds 202 with the run's
+// status. Only one run goes at a time.
+func (a *Admin) StartRegenerationHandler(w http.ResponseWriter, r *http.Request) {
+	var body regenerateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	opts := regenerate.Options{OldModels: body.OldModels, Below: body.Below, RatedDown: body.RatedDown, Budget: body.Budget, Limit: body.Limit, DryRun: body.DryRun}
+	// The times are read as the history API reads them
+	times := url.Values{"since": {body.Since}, "until": {body.Until}}
+	var err error
+	if opts.Since, err = parseHistoryTime(times, "since"); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if opts.Until, err = parseHistoryTime(times, "until"); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := opts.Check(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !a.Store.KeepsImages() {
+		writeJSONError(w, http.StatusConflict, "Regenerating needs the original images, which are only kept with object storage")
+		return
+	}
+
+	err = a.Regenerations.Start(r.Context(), a.Store, a.Active, opts)
+	if errors.Is(err, regenerate.ErrRunning) {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"error": "A regeneration is already running", "regeneration": a.Regenerations.Status()})
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	slog.InfoContext(r.Context(), "Started regeneration", "model", a.Active.Model, "budget", opts.Budget, "dry_run", opts.DryRun)
+	audit.Record(r.Context(), audit.Event{Action: audit.ActionRegenerationStarted, Provider: a.Active.Name, Model: a.Active.Model, Detail: fmt.Sprintf("budget $%.2f", opts.Budget)})
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"regeneration": a.Regenerations.Status()})
+}
+
+// RegenerationHandler reports the latest regeneration's progress and summary
+func (a *Admin) RegenerationHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"regeneration": a.Regenerations.Status()})
+}
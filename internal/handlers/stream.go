@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/deadline"
+	"alt-text-generator/internal/history"
+	"alt-text-generator/internal/metrics"
+)
+
+// StreamHandler accepts the same multipart upload as UploadHandler but responds
+// with server-sent events: a "delta" event per text fragment, then a single
+// "done" or "error" event.
+func StreamHandler(w http.ResponseWriter, r *http.Request, provider api.Provider, store *history.Store) {
+	slog.InfoContext(r.Context(), "Received streaming upload request")
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	if !provider.Configured() {
+		http.Error(w, "API key not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	filename, fileBytes, err := readUploadedImage(r)
+	if errors.Is(err, context.DeadlineExceeded) {
+		setTimeoutStage(w, err)
+		http.Error(w, formatErrorMessage(err.Error()), generationErrorStatus(err))
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	imageContext, err := formContext(r.MultipartForm.Value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r = formOptions(r.WithContext(api.WithImageContext(r.Context(), imageContext)))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	record, err := streamAltText(r.Context(), provider, store, filename, fileBytes, func(delta string) {
+		writeEvent(w, "delta", map[string]string{"text": delta})
+		flusher.Flush()
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error streaming alt text", "err", err)
+		event := map[string]string{"message": formatErrorMessage(err.Error())}
+		if stage, ok := deadline.StageOf(err); ok {
+			metrics.Timeouts.Inc(string(stage))
+			event["stage"] = string(stage)
+		}
+		writeEvent(w, "error", event)
+		flusher.Flush()
+		return
+	}
+
+	slog.DebugContext(r.Context(), "Streamed alt text", "generation_id", record.ID, "alt_text", record.AltText)
+	writeEvent(w, "done", map[string]interface{}{
+		"id":            record.ID,
+		"alt_text":      record.AltText,
+		"options":       record.Options(),
+		"description":   record.Description,
+		"score":         record.Score,
+		"confidence":    record.Confidence,
+		"lint":          record.Lint,
+		"caption":       record.Caption,
+		"tags":          record.Tags,
+		"objects":       record.Objects,
+		"detected_text": record.DetectedText,
+		"keywords":      record.Keywords,
+		"issues":        record.Issues,
+		"max_chars":     record.MaxChars,
+		"cached":        record.Cached,
+	})
+	flusher.Flush()
+}
+
+func writeEvent(w http.ResponseWriter, event string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Error encoding event", "event", event, "err", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
@@ -1,149 +1,289 @@
 package handlers
 
 import (
-	"encoding/base64"
+	"context"
+	"errors"
 	"fmt"
-	"html"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 	"strings"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/deadline"
+	"alt-text-generator/internal/fetch"
+	"alt-text-generator/internal/history"
+	"alt-text-generator/internal/idempotency"
+	"alt-text-generator/internal/metrics"
+	"alt-text-generator/internal/pool"
+	"alt-text-generator/internal/quota"
 )
 
-func UploadHandler(w http.ResponseWriter, r *http.Request, generateAltTextFunc func(string) (string, error), mode string) {
-	log.Println("Received upload request")
+func UploadHandler(w http.ResponseWriter, r *http.Request, provider api.Provider, store *history.Store) {
+	slog.InfoContext(r.Context(), "Received upload request")
+
+	slog.DebugContext(r.Context(), "Upload request details", "method", r.Method, "content_type", r.Header.Get("Content-Type"))
 
-	// Add debug logging
-	log.Printf("Request Method: %s", r.Method)
-	log.Printf("Content Type: %s", r.Header.Get("Content-Type"))
+	format := negotiateFormat(r)
 
 	if r.Method != http.MethodPost {
-		log.Println("Invalid request method. Expected POST.")
-		renderUploadError(w, "Invalid request method")
+		slog.InfoContext(r.Context(), "Invalid request method. Expected POST.")
+		writeUploadError(w, format, http.StatusMethodNotAllowed, "Invalid request method")
 		return
 	}
 
 	// Verify API key exists before processing upload
-	var apiKey string
-	if mode == "openai" {
-		apiKey = os.Getenv("OPEN_AI_API_KEY")
-	} else {
-		apiKey = os.Getenv("ANTHROPIC_API_KEY")
-	}
-
-	if apiKey == "" {
-		renderUploadError(w, "API key not configured")
+	if !provider.Configured() {
+		writeUploadError(w, format, http.StatusServiceUnavailable, "API key not configured")
 		return
 	}
 
-	// Try to parse the multipart form with a 6MB limit (slightly higher than our 5MB limit to account for form overhead)
+	// Several files may be sent under "image" or "image[]"; they are captioned
+	// concurrently and reported per file
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchItems*6*1024*1024)
 	if err := r.ParseMultipartForm(6 * 1024 * 1024); err != nil {
-		log.Printf("Error parsing multipart form: %v", err)
-		renderUploadError(w, "Failed to parse upload. Please ensure the file is under 5MB.")
+		slog.ErrorContext(r.Context(), "Error parsing multipart form", "err", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			setTimeoutStage(w, err)
+			writeUploadError(w, format, generationErrorStatus(err), formatErrorMessage(err.Error()))
+			return
+		}
+		writeUploadError(w, format, http.StatusBadRequest, "Failed to parse upload. Please ensure the file is under 5MB.")
 		return
 	}
-
-	file, header, err := r.FormFile("image")
+	deadline.Received(r.Context())
+	imageContext, err := formContext(r.MultipartForm.Value)
 	if err != nil {
-		log.Printf("Error reading form file: %v", err)
-		renderUploadError(w, "Failed to read uploaded file. Please try again.")
+		writeUploadError(w, format, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer file.Close()
-
-	log.Printf("Uploaded file details - Filename: %s, Size: %d bytes, Header: %v", header.Filename, header.Size, header.Header)
-
-	// Check file size before processing
-	if header.Size > 5*1024*1024 { // 5MB limit
-		renderUploadError(w, "Image size exceeds 5MB limit. Please choose a smaller image.")
+	ctx := api.WithImageContext(r.Context(), imageContext)
+	if format == formatFigure && r.URL.Query().Get("structured") == "" {
+		// A structured result has the caption for the figcaption
+		ctx = api.WithStructured(ctx, true)
+	}
+	r = formOptions(r.WithContext(ctx))
+	items := uploadedFiles(r.MultipartForm, "image", "image[]")
+	switch {
+	case len(items) == 0:
+		writeUploadError(w, format, http.StatusBadRequest, "Failed to read uploaded file. Please try again.")
+		return
+	case len(items) > maxBatchItems:
+		writeUploadError(w, format, http.StatusBadRequest, fmt.Sprintf("Please upload at most %d images at a time.", maxBatchItems))
+		return
+	case len(items) > 1:
+		writeUploadResults(w, format, runBatch(r, provider, store, nil, items))
 		return
 	}
 
-	// Read the uploaded file content
-	fileBytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		log.Printf("Error reading image content: %v", err)
-		renderUploadError(w, "Failed to process image")
+	item := items[0]
+	if item.Err != nil {
+		writeUploadError(w, format, http.StatusBadRequest, item.Err.Error())
 		return
 	}
-
-	log.Println("Successfully read uploaded image content")
-
-	// Encode the image content to base64
-	encodedImage := base64.StdEncoding.EncodeToString(fileBytes)
-	log.Println("Successfully encoded image to base64")
+	slog.InfoContext(r.Context(), "Received uploaded file", "filename", item.Filename, "size", len(item.Data))
 
 	// Call appropriate API to generate alt text
-	altText, err := generateAltTextFunc(encodedImage)
+	record, err := generateAltText(r.Context(), provider, store, item.Filename, item.Data)
 	if err != nil {
-		log.Printf("Error generating alt text: %v", err)
-		renderUploadError(w, formatErrorMessage(err.Error()))
+		slog.ErrorContext(r.Context(), "Error generating alt text", "err", err)
+		setRetryAfter(w, err)
+		setTimeoutStage(w, err)
+		writeUploadError(w, format, generationErrorStatus(err), formatErrorMessage(err.Error()))
 		return
 	}
 
-	log.Printf("Generated alt text: %s", altText)
+	slog.DebugContext(r.Context(), "Generated alt text", "generation_id", record.ID, "alt_text", record.AltText)
 
-	// Return success response
-	renderSuccess(w, altText)
+	// Return success response in the negotiated format
+	switch format {
+	case formatJSON:
+		writeJSON(w, http.StatusOK, generationResponse{Record: record, Options: record.Options()})
+	case formatText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, strings.Join(record.Options(), "\n"))
+	case formatFigure:
+		// The image's URL on the page, if given, else its file name
+		src := r.URL.Query().Get("src")
+		if src == "" {
+			src = item.Filename
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		WriteFigure(w, NewFigure(src, record))
+	default:
+		renderSuccess(w, record)
+	}
 }
 
-func renderSuccess(w http.ResponseWriter, altText string) {
-	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprintf(w, `
-        <div class="bg-green-50 border border-green-400 text-green-700 px-4 py-3 rounded-lg">
-            <h3 class="font-bold mb-4">Generated Alt Text Options:</h3>
-            <div class="space-y-4">%s</div>
-            <button onclick="location.reload()" class="mt-4 bg-green-100 text-green-700 px-4 py-2 rounded hover:bg-green-200">
-                Upload New Image
-            </button>
-        </div>
-    `, formatAltTextOptions(altText))
+// writeUploadResults reports the outcome of a multi-file upload in the
+// negotiated format
+func writeUploadResults(w http.ResponseWriter, format string, results []BatchResult) {
+	switch format {
+	case formatJSON:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+	case formatText:
+		// One block per file: the filename, then its options or error
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for i, result := range results {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%s:\n", result.Filename)
+			if result.Generation == nil {
+				fmt.Fprintf(w, "error: %s\n", result.Error)
+				continue
+			}
+			fmt.Fprintln(w, strings.Join(result.Generation.Options(), "\n"))
+		}
+	case formatFigure:
+		// One figure per file; failures are left out, as there is no
+		// image to show
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		for _, result := range results {
+			if result.Generation != nil {
+				WriteFigure(w, NewFigure(result.Filename, *result.Generation))
+			}
+		}
+	default:
+		renderResults(w, results)
+	}
 }
 
-func formatAltTextOptions(altText string) string {
-	options := strings.Split(altText, "\n")
-	var formatted strings.Builder
-
-	for _, option := range options {
-		option = strings.TrimSpace(option)
-		if option != "" {
-			formatted.WriteString(fmt.Sprintf(`
-                <div class="bg-white p-3 rounded border border-green-200">
-                    <p>%s</p>
-                </div>
-            `, html.EscapeString(option)))
+// writeUploadError reports an upload failure in the negotiated format. HTML
+// errors keep a 200 status because HTMX does not swap in error responses.
+func writeUploadError(w http.ResponseWriter, format string, status int, message string) {
+	switch format {
+	case formatJSON:
+		writeJSONError(w, status, message)
+	case formatText, formatFigure:
+		http.Error(w, message, status)
+	default:
+		renderUploadError(w, message)
+	}
+}
+
+// readUploadedImage reads the "image" file from a multipart upload. Returned
+// errors carry a message suitable for showing to the user, except for the
+// upload running out of time, which is returned as it is.
+func readUploadedImage(r *http.Request) (string, []byte, error) {
+	// Try to parse the multipart form with a 6MB limit (slightly higher than our 5MB limit to account for form overhead)
+	if err := r.ParseMultipartForm(6 * 1024 * 1024); err != nil {
+		slog.ErrorContext(r.Context(), "Error parsing multipart form", "err", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "", nil, err
 		}
+		return "", nil, errors.New("Failed to parse upload. Please ensure the file is under 5MB.")
 	}
+	deadline.Received(r.Context())
 
-	return formatted.String()
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading form file", "err", err)
+		return "", nil, errors.New("Failed to read uploaded file. Please try again.")
+	}
+	defer file.Close()
+
+	slog.InfoContext(r.Context(), "Received uploaded file", "filename", header.Filename, "size", header.Size)
+
+	// Check file size before processing
+	if header.Size > 5*1024*1024 { // 5MB limit
+		return "", nil, errors.New("Image size exceeds 5MB limit. Please choose a smaller image.")
+	}
+
+	// Read the uploaded file content
+	fileBytes, err := ioutil.ReadAll(file)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading image content", "err", err)
+		return "", nil, errors.New("Failed to process image")
+	}
+
+	slog.InfoContext(r.Context(), "Successfully read uploaded image content")
+	return header.Filename, fileBytes, nil
+}
+
+func renderSuccess(w http.ResponseWriter, record history.Record) {
+	renderFragment(w, "success", record)
+}
+
+// renderResults renders a card per file with its options or error
+func renderResults(w http.ResponseWriter, results []BatchResult) {
+	renderFragment(w, "results", results)
 }
 
 func renderUploadError(w http.ResponseWriter, message string) {
-	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprintf(w, `
-		<div class="bg-red-50 border border-red-400 text-red-700 px-4 py-3 rounded-lg">
-			<p class="font-bold mb-2">Error: %s</p>
-			<button 
-				onclick="document.getElementById('uploadForm').reset(); this.closest('.bg-red-50').remove()"
-				class="bg-red-100 text-red-700 px-4 py-2 rounded hover:bg-red-200"
-			>
-				Try Again
-			</button>
-		</div>
-	`, message)
+	renderFragment(w, "error", message)
 }
 
 func formatErrorMessage(errMsg string) string {
-	if strings.Contains(errMsg, "image exceeds 5 MB maximum") {
+	if strings.Contains(errMsg, api.ErrProviderDisabled.Error()) {
+		return "Alt text generation is temporarily disabled. Please try again later."
+	}
+	if strings.Contains(errMsg, quota.ErrExceeded.Error()) {
+		return "Daily usage quota exceeded. Quotas reset at midnight UTC."
+	}
+	if strings.Contains(errMsg, pool.ErrBusy.Error()) {
+		return "The server is busy. Please try again in a few seconds."
+	}
+	if strings.Contains(errMsg, idempotency.ErrMismatch.Error()) {
+		return "This Idempotency-Key was already used with different options. Please use a new key."
+	}
+	for _, stage := range deadline.Stages {
+		if strings.Contains(errMsg, (&deadline.Error{Stage: stage}).Error()) {
+			return timeoutMessages[stage]
+		}
+	}
+	if strings.Contains(errMsg, context.DeadlineExceeded.Error()) {
+		return timeoutMessages[deadline.Provider]
+	}
+	if strings.Contains(errMsg, fetch.ErrTooLarge.Error()) {
 		return "Image size exceeds the 5MB limit. Please choose a smaller image."
 	}
-	if strings.Contains(errMsg, "invalid_request_error") {
+	if strings.Contains(errMsg, api.ErrInvalidRequest.Error()) {
 		return "Invalid request. Please check your image and try again."
 	}
 	return "Failed to generate alt text. Please try again."
 }
 
+// timeoutMessages tells the user which stage of their request ran out of time
+var timeoutMessages = map[deadline.Stage]string{
+	deadline.Upload:     "The upload took too long to arrive. Please try again.",
+	deadline.Preprocess: "The server took too long to start on the image. Please try again in a few seconds.",
+	deadline.Provider:   "The provider took too long to respond. Please try again.",
+	deadline.Total:      "The request took too long to complete. Please try again.",
+}
+
+// generationErrorStatus maps a generation failure to an HTTP status: 503 when
+// the provider has been disabled or no worker is free, 429 when the caller's
+// quota is used up, 408 when the upload was too slow to arrive, 504 when any
+// other stage ran out of time, 502 for provider errors
+func generationErrorStatus(err error) int {
+	if errors.Is(err, api.ErrProviderDisabled) || errors.Is(err, pool.ErrBusy) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, quota.ErrExceeded) {
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, idempotency.ErrMismatch) {
+		return http.StatusUnprocessableEntity
+	}
+	if stage, ok := deadline.StageOf(err); ok && stage == deadline.Upload {
+		return http.StatusRequestTimeout
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// setTimeoutStage names the stage that ran out of time, if one did, in a
+// Timeout-Stage header, and counts the timeout
+func setTimeoutStage(w http.ResponseWriter, err error) {
+	if stage, ok := deadline.StageOf(err); ok {
+		w.Header().Set("Timeout-Stage", string(stage))
+		metrics.Timeouts.Inc(string(stage))
+	}
+}
+
 func hasMultipartPrefix(contentType string) bool {
 	return len(contentType) >= 19 && contentType[:19] == "multipart/form-data"
 }
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"alt-text-generator/internal/auth"
+	"alt-text-generator/internal/pool"
+	"alt-text-generator/internal/quota"
+)
+
+// UsageHandler reports the authenticated caller's usage and limits for today
+func UsageHandler(w http.ResponseWriter, r *http.Request, quotas *quota.Tracker) {
+	id, ok := auth.IdentityFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "Usage is tracked per API key; authentication is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, quotas.Usage(id.User))
+}
+
+// UsageHandler reports today's usage for every caller that has made requests
+func (a *Admin) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"usage": a.Quotas.All()})
+}
+
+// setRetryAfter tells clients refused for quota or because the server is
+// busy when to try again
+func setRetryAfter(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, quota.ErrExceeded):
+		now := time.Now()
+		w.Header().Set("Retry-After", strconv.Itoa(int(quota.ResetsAt(now).Sub(now).Seconds())+1))
+	case errors.Is(err, pool.ErrBusy):
+		w.Header().Set("Retry-After", strconv.Itoa(int(pool.RetryAfter.Seconds())))
+	}
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/auth"
+	"alt-text-generator/internal/quota"
+)
+
+func TestQuotaExceededResponse(t *testing.T) {
+	t.Setenv("QUOTA_TEST_API_KEY", "secret")
+	provider := api.Provider{Name: "test", EnvKey: "QUOTA_TEST_API_KEY"}
+	tracker := quota.New(quota.Limits{RequestsPerDay: 1}, nil)
+	if err := tracker.Reserve("team"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/jobs", nil)
+	ctx := auth.WithIdentity(quota.NewContext(req.Context(), tracker), auth.Identity{User: "team"})
+	rec := httptest.NewRecorder()
+	CreateJobHandler(rec, req.WithContext(ctx), provider, nil, nil)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Daily usage quota exceeded. Quotas reset at midnight UTC."; body["error"] != want {
+		t.Errorf("error = %q, want %q", body["error"], want)
+	}
+	retry, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	now := time.Now()
+	if err != nil || retry < 1 || retry > int(quota.ResetsAt(now).Sub(now).Seconds())+1 {
+		t.Errorf("Retry-After = %q, want the seconds until midnight UTC", rec.Header().Get("Retry-After"))
+	}
+
+	// A generation refused for quota gets the same status and message
+	refused := fmt.Errorf("reserving: %w", tracker.Reserve("team"))
+	if status := generationErrorStatus(refused); status != http.StatusTooManyRequests {
+		t.Errorf("generationErrorStatus = %d, want %d", status, http.StatusTooManyRequests)
+	}
+	if message := formatErrorMessage(refused.Error()); message != body["error"] {
+		t.Errorf("formatErrorMessage = %q, want %q", message, body["error"])
+	}
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/config"
+	"alt-text-generator/internal/cors"
+	"alt-text-generator/internal/history"
+	"alt-text-generator/internal/websocket"
+)
+
+// maxConcurrentSocketJobs bounds how many images a single connection can
+// have in flight. The connection isn't read from while they're all busy, so
+// a client sending faster than its images are processed is held back rather
+// than queued in memory.
+const maxConcurrentSocketJobs = 4
+
+var upgrader = websocket.Upgrader{MaxMessageSize: 8 * 1024 * 1024, CheckOrigin: socketOriginAllowed}
+
+// socketOriginAllowed accepts handshakes from the server's own pages, from
+// the origins in CORS_ALLOWED_ORIGINS, and from non-browser clients, which
+// send no Origin. Browsers don't apply CORS to WebSockets, so without this
+// any site could open a connection with a visitor's credentials.
+func socketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return cors.New(config.GetList("CORS_ALLOWED_ORIGINS"), 0).Allowed(origin)
+}
+
+// socketRequest is a client message asking for alt text for one image
+type socketRequest struct {
+	ID       string `json:"id"`
+	Image    string `json:"image"`
+	Filename string `json:"filename"`
+	Stream   bool   `json:"stream"`
+	// Context holds values for the prompt, such as page_title
+	Context map[string]string `json:"context"`
+}
+
+// socketEvent is a server message about the request with the matching ID
+type socketEvent struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Stage      string          `json:"stage,omitempty"`
+	Text       string          `json:"text,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	Generation *history.Record `json:"generation,omitempty"`
+}
+
+// WebSocketHandler lets a client push any number of images over one
+// connection. Each image is processed concurrently and reported through
+// "accepted", "progress", optional "delta", and finally "result" or "error" events.
+func WebSocketHandler(w http.ResponseWriter, r *http.Request, provider api.Provider, store *history.Store) {
+	conn, err := upgrader.Upgrade(w, r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error upgrading WebSocket connection", "err", err)
+		return
+	}
+	defer conn.Close()
+	slog.InfoContext(r.Context(), "WebSocket client connected", "remote_addr", r.RemoteAddr)
+
+	send := func(event socketEvent) {
+		data, err := json.Marshal(event)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error encoding WebSocket event", "err", err)
+			return
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			slog.ErrorContext(r.Context(), "Error writing WebSocket event", "err", err)
+		}
+	}
+
+	// A hijacked connection's request context isn't cancelled when the client
+	// goes away, so generations still running are cancelled here instead
+	ctx, cancel := context.WithCancel(r.Context())
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxConcurrentSocketJobs)
+	defer wg.Wait()
+	defer cancel()
+
+	for {
+		// Wait for a free slot before reading the next message, so at most
+		// maxConcurrentSocketJobs images are held at once
+		slots <- struct{}{}
+		release := func() { <-slots }
+
+		opcode, data, err := conn.ReadMessage()
+		if err != nil {
+			release()
+			if err != websocket.ErrClosed {
+				slog.InfoContext(r.Context(), "WebSocket read ended", "err", err)
+			}
+			slog.InfoContext(r.Context(), "WebSocket client disconnected", "remote_addr", r.RemoteAddr)
+			return
+		}
+		if opcode != websocket.TextMessage {
+			send(socketEvent{Type: "error", Message: "messages must be JSON text frames"})
+			release()
+			continue
+		}
+
+		var req socketRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			send(socketEvent{Type: "error", Message: "invalid JSON message"})
+			release()
+			continue
+		}
+		if !provider.Configured() {
+			send(socketEvent{ID: req.ID, Type: "error", Message: "API key not configured"})
+			release()
+			continue
+		}
+		fileBytes, _, err := decodeBase64Image(req.Image)
+		if err != nil {
+			send(socketEvent{ID: req.ID, Type: "error", Message: err.Error()})
+			release()
+			continue
+		}
+		imageContext, err := api.NewImageContext(req.Context)
+		if err != nil {
+			send(socketEvent{ID: req.ID, Type: "error", Message: err.Error()})
+			release()
+			continue
+		}
+
+		send(socketEvent{ID: req.ID, Type: "accepted"})
+
+		wg.Add(1)
+		go func(req socketRequest, fileBytes []byte) {
+			defer wg.Done()
+			defer release()
+			ctx := api.WithImageContext(ctx, imageContext)
+
+			send(socketEvent{ID: req.ID, Type: "progress", Stage: "generating"})
+
+			var record history.Record
+			var err error
+			if req.Stream {
+				record, err = streamAltText(ctx, provider, store, req.Filename, fileBytes, func(delta string) {
+					send(socketEvent{ID: req.ID, Type: "delta", Text: delta})
+				})
+			} else {
+				record, err = generateAltText(ctx, provider, store, req.Filename, fileBytes)
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error generating alt text", "err", err)
+				send(socketEvent{ID: req.ID, Type: "error", Message: formatErrorMessage(err.Error())})
+				return
+			}
+			send(socketEvent{ID: req.ID, Type: "result", Generation: &record})
+		}(req, fileBytes)
+	}
+}
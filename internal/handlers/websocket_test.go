@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSocketOriginAllowed(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example, https://admin.example/")
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://alt.example:8080", true},
+		{"https://app.example", true},
+		{"https://admin.example", true},
+		{"https://evil.example", false},
+		{"http://alt.example.evil.example", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://alt.example:8080/api/v1/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := socketOriginAllowed(r); got != tt.want {
+			t.Errorf("socketOriginAllowed(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+
+	t.Setenv("CORS_ALLOWED_ORIGINS", "")
+	r := httptest.NewRequest("GET", "http://alt.example:8080/api/v1/ws", nil)
+	r.Header.Set("Origin", "https://app.example")
+	if socketOriginAllowed(r) {
+		t.Error("cross-origin handshake allowed without CORS_ALLOWED_ORIGINS")
+	}
+}
@@ -0,0 +1,130 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Check returns an error when a dependency is unhealthy
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// CheckResult is the outcome of a single readiness check
+type CheckResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Report is the body returned by the readiness endpoint
+type Report struct {
+	Status    string                 `json:"status"`
+	Checks    map[string]CheckResult `json:"checks"`
+	CheckedAt time.Time              `json:"checked_at"`
+}
+
+// Checker serves liveness, readiness, and startup probes. Readiness results
+// are cached for the TTL so frequent probes don't hammer provider APIs.
+type Checker struct {
+	ttl     time.Duration
+	timeout time.Duration
+	started atomic.Bool
+
+	mu     sync.Mutex
+	checks []namedCheck
+	last   *Report
+}
+
+func New(ttl, timeout time.Duration) *Checker {
+	return &Checker{ttl: ttl, timeout: timeout}
+}
+
+// Add registers a readiness check
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name, check})
+}
+
+// MarkStarted flips the startup probe to healthy
+func (c *Checker) MarkStarted() {
+	c.started.Store(true)
+}
+
+// Ready runs the readiness checks, or returns the cached report if it is fresh
+func (c *Checker) Ready(ctx context.Context) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.last != nil && time.Since(c.last.CheckedAt) < c.ttl {
+		return *c.last
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	results := make(map[string]CheckResult, len(c.checks))
+	var wg sync.WaitGroup
+	var resultsMu sync.Mutex
+	for _, nc := range c.checks {
+		wg.Add(1)
+		go func(nc namedCheck) {
+			defer wg.Done()
+			result := CheckResult{OK: true}
+			if err := nc.check(ctx); err != nil {
+				result = CheckResult{Error: err.Error()}
+			}
+			resultsMu.Lock()
+			results[nc.name] = result
+			resultsMu.Unlock()
+		}(nc)
+	}
+	wg.Wait()
+
+	report := Report{Status: "ok", Checks: results, CheckedAt: time.Now().UTC()}
+	for _, result := range results {
+		if !result.OK {
+			report.Status = "unavailable"
+		}
+	}
+	c.last = &report
+	return report
+}
+
+// LivenessHandler reports that the process is up and serving requests
+func (c *Checker) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadinessHandler reports 200 when every check passes and 503 otherwise
+func (c *Checker) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	report := c.Ready(r.Context())
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeStatus(w, status, report)
+}
+
+// StartupHandler reports 503 until MarkStarted has been called
+func (c *Checker) StartupHandler(w http.ResponseWriter, r *http.Request) {
+	if !c.started.Load() {
+		writeStatus(w, http.StatusServiceUnavailable, map[string]string{"status": "starting"})
+		return
+	}
+	writeStatus(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func writeStatus(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,94 @@
+package history
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// Cache is a fast tier in front of the store for Lookup, such as Redis
+// shared by several server instances. Values are records as JSON, without
+// their thumbnails, so images aren't kept beyond the store's retention.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+}
+
+type refreshKey struct{}
+
+// WithRefresh returns a copy of ctx whose generations do or don't skip the
+// result cache
+func WithRefresh(ctx context.Context, on bool) context.Context {
+	return context.WithValue(ctx, refreshKey{}, on)
+}
+
+// RefreshWanted reports whether generations for ctx skip the result cache
+// and call the provider again. Their result then takes the place of the
+// stored one for later lookups, as the newest generation.
+func RefreshWanted(ctx context.Context) bool {
+	on, _ := ctx.Value(refreshKey{}).(bool)
+	return on
+}
+
+// UseCache puts c in front of the store for Lookup, and fills it as
+// generations are added
+func (s *Store) UseCache(c Cache) {
+	s.cache = c
+}
+
+// Inputs are everything that decides what generating an image returns.
+// Generations with the same inputs can stand in for each other.
+type Inputs struct {
+	ImageHash string
+	Provider  string
+	Model     string
+	Prompt    string
+	Settings  string
+}
+
+// Key identifies the inputs, for caching or sharing a generation made from
+// them
+func (in Inputs) Key() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{in.ImageHash, in.Provider, in.Model, in.Prompt, in.Settings}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// inputs are the inputs r was generated from
+func (r Record) inputs() Inputs {
+	return Inputs{ImageHash: r.ImageHash, Provider: r.Provider, Model: r.Model, Prompt: r.Prompt, Settings: r.Settings}
+}
+
+// Lookup returns the newest generation made from the same inputs, so its
+// result can be reused
+func (s *Store) Lookup(in Inputs) (Record, bool) {
+	if in.ImageHash == "" || in.Prompt == "" || in.Settings == "" {
+		return Record{}, false
+	}
+	if s.cache != nil {
+		if data, ok := s.cache.Get(in.Key()); ok {
+			var r Record
+			if err := json.Unmarshal(data, &r); err == nil {
+				return r, true
+			}
+		}
+	}
+	earlier := s.List(Filter{ImageHash: in.ImageHash, Provider: in.Provider, Model: in.Model, Prompt: in.Prompt, Settings: in.Settings, Limit: 1})
+	if len(earlier) == 0 {
+		return Record{}, false
+	}
+	s.remember(earlier[0])
+	return earlier[0], true
+}
+
+// remember puts r in the cache, if the store has one, for Lookup to find
+func (s *Store) remember(r Record) {
+	if s.cache == nil || r.ImageHash == "" || r.Prompt == "" || r.Settings == "" {
+		return
+	}
+	r.Thumbnail = ""
+	if data, err := json.Marshal(r); err == nil {
+		s.cache.Set(r.inputs().Key(), data)
+	}
+}
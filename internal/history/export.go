@@ -0,0 +1,114 @@
+package history
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportFormats lists the formats Export writes
+var ExportFormats = []string{"csv", "json"}
+
+// exportBatch is how many records Export reads at a time, so a large
+// history isn't held in memory at once
+const exportBatch = 500
+
+var exportHeader = []string{"id", "created_at", "user", "provider", "model", "filename", "image_hash", "alt_text", "description", "score", "confidence", "lint", "caption", "tags", "objects", "detected_text", "keywords", "issues", "max_chars", "cached", "input_tokens", "output_tokens", "prompt", "rating", "edited_alt_text", "feedback_comment"}
+
+// Export writes every record matching f, newest first, as CSV or a JSON
+// array, for compliance records or importing into a CMS. f's Limit, Offset,
+// and After are ignored, and thumbnails are left out. It returns how many
+// records were written.
+func (s *Store) Export(w io.Writer, f Filter, format string) (int, error) {
+	var write func(r Record) error
+	var finish func() error
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(exportHeader); err != nil {
+			return 0, err
+		}
+		write = func(r Record) error {
+			var feedback Feedback
+			if r.Feedback != nil {
+				feedback = *r.Feedback
+			}
+			return cw.Write([]string{
+				r.ID,
+				r.CreatedAt.Format(time.RFC3339),
+				r.User,
+				r.Provider,
+				r.Model,
+				r.Filename,
+				r.ImageHash,
+				r.AltText,
+				r.Description,
+				strconv.Itoa(r.Score),
+				strconv.Itoa(r.Confidence),
+				strings.Join(r.Lint, "; "),
+				r.Caption,
+				strings.Join(r.Tags, ", "),
+				strings.Join(r.Objects, ", "),
+				r.DetectedText,
+				strings.Join(r.Keywords, ", "),
+				strings.Join(r.Issues, "; "),
+				strconv.Itoa(r.MaxChars),
+				strconv.FormatBool(r.Cached),
+				strconv.Itoa(r.InputTokens),
+				strconv.Itoa(r.OutputTokens),
+				r.Prompt,
+				feedback.Rating,
+				feedback.EditedAltText,
+				feedback.Comment,
+			})
+		}
+		finish = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case "json":
+		// Records are written one to a line inside the array as they are read
+		sep := "[\n"
+		write = func(r Record) error {
+			r.Thumbnail = ""
+			data, err := json.Marshal(r)
+			if err == nil {
+				_, err = fmt.Fprintf(w, "%s%s", sep, data)
+			}
+			sep = ",\n"
+			return err
+		}
+		finish = func() error {
+			if sep == "[\n" {
+				_, err := io.WriteString(w, "[]\n")
+				return err
+			}
+			_, err := io.WriteString(w, "\n]\n")
+			return err
+		}
+	default:
+		return 0, fmt.Errorf("unknown export format %q (expected %s)", format, strings.Join(ExportFormats, " or "))
+	}
+
+	f.Limit, f.Offset, f.After = exportBatch, 0, nil
+	n := 0
+	for {
+		records := s.List(f)
+		for _, r := range records {
+			if err := write(r); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if len(records) < exportBatch {
+			break
+		}
+		cursor := CursorFor(records[len(records)-1])
+		f.After = &cursor
+	}
+	return n, finish()
+}
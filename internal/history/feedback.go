@@ -0,0 +1,35 @@
+package history
+
+import "time"
+
+// Ratings a generation can be given
+const (
+	RatingUp   = "up"
+	RatingDown = "down"
+)
+
+// Feedback is what a person thought of a generation's alt text, kept with
+// the original so the two can be compared to measure and improve quality
+type Feedback struct {
+	// Rating is up or down, or empty when only an edit was given
+	Rating string `json:"rating,omitempty"`
+	// EditedAltText is the alt text as the person corrected it
+	EditedAltText string    `json:"edited_alt_text,omitempty"`
+	Comment       string    `json:"comment,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// SetFeedback replaces the feedback on the record with the given ID and
+// returns the updated record, and whether there was one
+func (s *Store) SetFeedback(id string, f Feedback) (Record, bool) {
+	f.UpdatedAt = time.Now().UTC()
+	return s.update(id, func(r *Record) { r.Feedback = &f })
+}
+
+// rating returns the feedback rating given r, or "" for none
+func (r Record) rating() string {
+	if r.Feedback == nil {
+		return ""
+	}
+	return r.Feedback.Rating
+}
@@ -0,0 +1,346 @@
+package history
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record represents a single stored alt text generation
+type Record struct {
+	ID        string `json:"id"`
+	User      string `json:"user,omitempty"`
+	Provider  string `json:"provider"`
+	Model     string `json:"model"`
+	Filename  string `json:"filename"`
+	ImageHash string `json:"image_hash"`
+	// Thumbnail is a small JPEG of the image as a data URI, when its format
+	// could be decoded
+	Thumbnail string `json:"thumbnail,omitempty"`
+	// Prompt is the prompt the image was sent with
+	Prompt string `json:"prompt,omitempty"`
+	// Settings are those the image was generated with that aren't in the
+	// prompt, as api.OutputSettings describes them
+	Settings string `json:"settings,omitempty"`
+	AltText  string `json:"alt_text"`
+	// Description is the long description, when one was asked for
+	Description string `json:"description,omitempty"`
+	// Score rates the first option from 0 to 100
+	Score int `json:"score"`
+	// Confidence estimates from 0 to 100 how likely the first option is to
+	// be accurate
+	Confidence int `json:"confidence"`
+	// Lint lists the lint rules the first option breaks
+	Lint []string `json:"lint,omitempty"`
+	// Caption, Tags, Objects, and DetectedText come from a structured
+	// result, when one was asked for
+	Caption      string   `json:"caption,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Objects      []string `json:"objects,omitempty"`
+	DetectedText string   `json:"detected_text,omitempty"`
+	// Keywords are searchable keywords for the image, when asked for
+	Keywords []string `json:"keywords,omitempty"`
+	// Issues lists what checking a translation, or the alt text improved,
+	// against the image found
+	Issues []string `json:"issues,omitempty"`
+	// MaxChars is the length limit the options were held to, or 0 for none
+	MaxChars int `json:"max_chars,omitempty"`
+	// Cached is set when the result was reused from an earlier generation
+	// of the same image and prompt instead of calling the provider
+	Cached    bool      `json:"cached,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Feedback is the owner's rating of the alt text or edit of it, if any
+	Feedback *Feedback `json:"feedback,omitempty"`
+	// Supersedes is the ID of the generation this one regenerated, and
+	// SupersededBy that of the generation that regenerated this one
+	Supersedes   string `json:"supersedes,omitempty"`
+	SupersededBy string `json:"superseded_by,omitempty"`
+
+	InputTokens  int `json:"input_tokens,omitempty"`
+	OutputTokens int `json:"output_tokens,omitempty"`
+}
+
+// Options splits the generated alt text into its individual non-empty lines
+func (r Record) Options() []string {
+	var options []string
+	for _, line := range strings.Split(r.AltText, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			options = append(options, line)
+		}
+	}
+	return options
+}
+
+// Filter narrows a history query. Zero values match everything.
+type Filter struct {
+	User     string
+	Provider string
+	Filename string
+	Search   string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+	Offset   int
+
+	// ImageHash, Model, Prompt, and Settings match exactly, to find
+	// earlier generations of the same image
+	ImageHash string
+	Model     string
+	Prompt    string
+	Settings  string
+
+	// Rating matches records given that rating as feedback
+	Rating string
+
+	// After continues a listing from a cursor returned by a previous page
+	After *Cursor
+}
+
+// Cursor marks a position in the newest-first listing so pages stay stable
+// while new generations are added
+type Cursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// CursorFor returns the cursor positioned at r
+func CursorFor(r Record) Cursor {
+	return Cursor{CreatedAt: r.CreatedAt, ID: r.ID}
+}
+
+// Encode returns the cursor as an opaque URL-safe token
+func (c Cursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + c.ID))
+}
+
+// DecodeCursor parses a token produced by Cursor.Encode
+func DecodeCursor(token string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return Cursor{}, errors.New("invalid cursor")
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if !ok || err != nil || id == "" {
+		return Cursor{}, errors.New("invalid cursor")
+	}
+	return Cursor{CreatedAt: time.Unix(0, n).UTC(), ID: id}, nil
+}
+
+// newer reports whether a sorts before b in the newest-first listing. Records
+// created at the same instant fall back to ID order, shorter IDs first so
+// numeric IDs compare numerically.
+func newer(a, b Cursor) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	if len(a.ID) != len(b.ID) {
+		return len(a.ID) > len(b.ID)
+	}
+	return a.ID > b.ID
+}
+
+func (f Filter) matches(r Record) bool {
+	if f.User != "" && r.User != f.User {
+		return false
+	}
+	if f.Provider != "" && r.Provider != f.Provider {
+		return false
+	}
+	if f.ImageHash != "" && r.ImageHash != f.ImageHash {
+		return false
+	}
+	if f.Model != "" && r.Model != f.Model {
+		return false
+	}
+	if f.Prompt != "" && r.Prompt != f.Prompt {
+		return false
+	}
+	if f.Settings != "" && r.Settings != f.Settings {
+		return false
+	}
+	if f.Rating != "" && r.rating() != f.Rating {
+		return false
+	}
+	if f.Filename != "" && !strings.Contains(strings.ToLower(r.Filename), strings.ToLower(f.Filename)) {
+		return false
+	}
+	if f.Search != "" && !matchesSearch(r.AltText, f.Search) {
+		return false
+	}
+	if !f.Since.IsZero() && r.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !r.CreatedAt.Before(f.Until) {
+		return false
+	}
+	if f.After != nil && !newer(*f.After, CursorFor(r)) {
+		return false
+	}
+	return true
+}
+
+// matchesSearch reports whether text contains every word of the query,
+// ignoring case and order
+func matchesSearch(text, query string) bool {
+	text = strings.ToLower(text)
+	for _, term := range strings.Fields(strings.ToLower(query)) {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// backend is where a Store keeps its records
+type backend interface {
+	// Add stores r, assigning its ID when unset. The record is returned
+	// with its ID even when storing it fails.
+	Add(r Record) (Record, error)
+	Get(id string) (Record, bool, error)
+	Count() (int, error)
+	// List returns the records matching f, newest first
+	List(f Filter) ([]Record, error)
+	// Purge deletes the records created before cutoff, returning them with
+	// at least their IDs and image hashes, for removing what they left in
+	// object storage
+	Purge(cutoff time.Time) ([]Record, error)
+	// DropThumbnails removes the thumbnails of records created before cutoff
+	DropThumbnails(cutoff time.Time) (int, error)
+	// Update applies change to the record with the given ID, returning the
+	// updated record and whether there was one
+	Update(id string, change func(*Record)) (Record, bool, error)
+	Close() error
+}
+
+// Store keeps generations in memory, or in a database when opened with Open
+type Store struct {
+	backend   backend
+	name      string
+	cache     Cache
+	objects   Objects
+	retention Retention
+	// imagesSwept is the cutoff object storage was last swept of images to
+	imagesSwept time.Time
+}
+
+// NewStore returns a store that keeps generations in memory until the
+// process exits
+func NewStore() *Store {
+	return &Store{backend: &memoryBackend{}, name: "memory"}
+}
+
+// Open returns a store that keeps generations in a database, so history
+// survives restarts. A postgres:// or postgresql:// URL opens PostgreSQL,
+// which several server instances can share; anything else is the path of an
+// SQLite database file, created if needed.
+func Open(dsn string) (*Store, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		b, err := openPostgres(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return &Store{backend: b, name: "postgres"}, nil
+	}
+	b, err := openSQLite(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{backend: b, name: "sqlite"}, nil
+}
+
+// Backend names where the store keeps generations: memory, sqlite, or
+// postgres
+func (s *Store) Backend() string {
+	return s.name
+}
+
+// Close closes the store's database, if it has one
+func (s *Store) Close() error {
+	return s.backend.Close()
+}
+
+// Add stores a record, assigning its ID and timestamp when unset. A record
+// that can't be stored is logged rather than failing the generation it came
+// from.
+func (s *Store) Add(r Record) Record {
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now().UTC()
+	}
+	stored, err := s.backend.Add(r)
+	if err != nil {
+		slog.Error("Error storing generation in history", "backend", s.name, "generation_id", stored.ID, "err", err)
+		return stored
+	}
+	s.remember(stored)
+	s.archive(stored)
+	return stored
+}
+
+// Get returns the record with the given ID, from object storage if the
+// store no longer has it
+func (s *Store) Get(id string) (Record, bool) {
+	r, ok, err := s.backend.Get(id)
+	if err != nil {
+		slog.Error("Error reading history", "backend", s.name, "err", err)
+	}
+	if !ok && err == nil {
+		return s.archived(id)
+	}
+	return r, ok
+}
+
+// Count returns the number of stored records
+func (s *Store) Count() int {
+	n, err := s.backend.Count()
+	if err != nil {
+		slog.Error("Error counting history", "backend", s.name, "err", err)
+	}
+	return n
+}
+
+// List returns the records matching the filter, newest first
+func (s *Store) List(f Filter) []Record {
+	records, err := s.backend.List(f)
+	if err != nil {
+		slog.Error("Error reading history", "backend", s.name, "err", err)
+	}
+	return records
+}
+
+// update applies change to the record with the given ID and returns the
+// updated record, and whether there was one. A generation only in object
+// storage is updated there.
+func (s *Store) update(id string, change func(*Record)) (Record, bool) {
+	r, ok, err := s.backend.Update(id, change)
+	if err != nil {
+		slog.Error("Error updating history", "backend", s.name, "generation_id", id, "err", err)
+		return Record{}, false
+	}
+	if !ok {
+		if r, ok = s.archived(id); !ok {
+			return Record{}, false
+		}
+		change(&r)
+	}
+	s.archive(r)
+	return r, true
+}
+
+// Supersede marks the record with the given ID as replaced by the
+// generation with ID by, and reports whether there was one
+func (s *Store) Supersede(id, by string) bool {
+	_, ok := s.update(id, func(r *Record) { r.SupersededBy = by })
+	return ok
+}
+
+// HashImage returns the hex-encoded SHA-256 of the raw image bytes
+func HashImage(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
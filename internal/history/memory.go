@@ -0,0 +1,120 @@
+package history
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryBackend keeps records in memory until the process exits
+type memoryBackend struct {
+	mu      sync.RWMutex
+	records []Record
+	nextID  int
+}
+
+func (m *memoryBackend) Add(r Record) (Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	if r.ID == "" {
+		r.ID = fmt.Sprintf("%d", m.nextID)
+	}
+	m.records = append(m.records, r)
+	return r, nil
+}
+
+func (m *memoryBackend) Get(id string) (Record, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, r := range m.records {
+		if r.ID == id {
+			return r, true, nil
+		}
+	}
+	return Record{}, false, nil
+}
+
+func (m *memoryBackend) Count() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.records), nil
+}
+
+func (m *memoryBackend) List(f Filter) ([]Record, error) {
+	m.mu.RLock()
+	var matched []Record
+	for _, r := range m.records {
+		if f.matches(r) {
+			matched = append(matched, r)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return newer(CursorFor(matched[i]), CursorFor(matched[j]))
+	})
+
+	if f.Offset > 0 {
+		if f.Offset >= len(matched) {
+			return nil, nil
+		}
+		matched = matched[f.Offset:]
+	}
+	if f.Limit > 0 && f.Limit < len(matched) {
+		matched = matched[:f.Limit]
+	}
+	return matched, nil
+}
+
+func (m *memoryBackend) Purge(cutoff time.Time) ([]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged []Record
+	kept := m.records[:0]
+	for _, r := range m.records {
+		if r.CreatedAt.Before(cutoff) {
+			purged = append(purged, r)
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	clear(m.records[len(kept):])
+	m.records = kept
+	return purged, nil
+}
+
+func (m *memoryBackend) DropThumbnails(cutoff time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for i, r := range m.records {
+		if r.Thumbnail != "" && r.CreatedAt.Before(cutoff) {
+			m.records[i].Thumbnail = ""
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryBackend) Update(id string, change func(*Record)) (Record, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, r := range m.records {
+		if r.ID == id {
+			change(&m.records[i])
+			return m.records[i], true, nil
+		}
+	}
+	return Record{}, false, nil
+}
+
+func (m *memoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,123 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds each dialect's schema migrations, named
+// NNNN_description.sql and applied in order of their numbers. Applied
+// migrations must never change; add a new one instead.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migrationsSchema creates the table recording which migrations a database
+// has had
+const migrationsSchema = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	name       TEXT NOT NULL,
+	applied_at BIGINT NOT NULL
+)`
+
+// migration is one versioned change to the history schema
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations returns the migrations in dir, in version order
+func loadMigrations(dir string) ([]migration, error) {
+	entries, err := migrationFiles.ReadDir(path.Join("migrations", dir))
+	if err != nil {
+		return nil, err
+	}
+	var migrations []migration
+	for _, entry := range entries {
+		number, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil || version < 1 || !strings.HasSuffix(entry.Name(), ".sql") {
+			return nil, fmt.Errorf("migration %s must be named NNNN_description.sql", entry.Name())
+		}
+		data, err := migrationFiles.ReadFile(path.Join("migrations", dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("two migrations are numbered %d", migrations[i].version)
+		}
+	}
+	return migrations, nil
+}
+
+// migrate brings the database's schema up to date, applying each migration
+// it hasn't had yet in a transaction of its own, so a failed one leaves the
+// schema as the one before left it. A database migrated by a newer build is
+// refused rather than used with a schema this build doesn't know.
+func migrate(db *sql.DB, d dialect) error {
+	migrations, err := loadMigrations(d.migrations)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if d.lock != "" {
+		// Instances starting together take turns, so each migration is
+		// applied once
+		if _, err := conn.ExecContext(ctx, d.lock); err != nil {
+			return fmt.Errorf("locking for migrations: %v", err)
+		}
+		defer conn.ExecContext(ctx, d.unlock)
+	}
+	if _, err := conn.ExecContext(ctx, migrationsSchema); err != nil {
+		return err
+	}
+	var current int
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	if latest := migrations[len(migrations)-1].version; current > latest {
+		return fmt.Errorf("database schema is at version %d, newer than this build's %d; upgrade alt-text-generator to use it", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+		if _, err := tx.ExecContext(ctx, d.bind(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`), m.version, m.name, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+		slog.Info("Applied history migration", "version", m.version, "name", m.name)
+	}
+	return nil
+}
@@ -0,0 +1,4 @@
+-- Feedback ratings get a column, so listing rated generations uses an index
+ALTER TABLE generations ADD COLUMN rating TEXT NOT NULL DEFAULT '';
+UPDATE generations SET rating = COALESCE(record->'feedback'->>'rating', '');
+CREATE INDEX generations_rating ON generations (rating);
@@ -0,0 +1,19 @@
+-- The generations table as it was before migrations, so databases created
+-- then are taken over as they are
+CREATE TABLE IF NOT EXISTS generations (
+	id            TEXT PRIMARY KEY,
+	user_id       TEXT NOT NULL DEFAULT '',
+	provider      TEXT NOT NULL,
+	model         TEXT NOT NULL,
+	filename      TEXT NOT NULL,
+	image_hash    TEXT NOT NULL,
+	prompt        TEXT NOT NULL DEFAULT '',
+	alt_text      TEXT NOT NULL,
+	input_tokens  INTEGER NOT NULL DEFAULT 0,
+	output_tokens INTEGER NOT NULL DEFAULT 0,
+	created_at    INTEGER NOT NULL,
+	record        TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS generations_created_at ON generations (created_at);
+CREATE INDEX IF NOT EXISTS generations_image_hash ON generations (image_hash);
+CREATE INDEX IF NOT EXISTS generations_user_id ON generations (user_id);
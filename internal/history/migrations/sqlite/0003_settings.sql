@@ -0,0 +1,4 @@
+-- The settings a generation was made with beyond its prompt get a column,
+-- so the result cache only reuses results made with the same ones
+ALTER TABLE generations ADD COLUMN settings TEXT NOT NULL DEFAULT '';
+UPDATE generations SET settings = COALESCE(json_extract(record, '$.settings'), '');
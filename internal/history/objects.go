@@ -0,0 +1,116 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// objectTimeout bounds each read or write to object storage
+const objectTimeout = 30 * time.Second
+
+// Objects is object storage, such as an S3 or Cloud Storage bucket, that
+// keeps each generation's result and original image beyond the store
+type Objects interface {
+	Put(ctx context.Context, key, contentType string, data []byte) error
+	// Get returns the object at key, and whether there was one
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Delete removes the object at key, succeeding if there was none
+	Delete(ctx context.Context, key string) error
+}
+
+// UseObjects keeps the result of every generation added from now on in o,
+// as results/<id>.json, and the images passed to SaveImage as
+// images/<hash>. Get falls back to o for generations the store no longer
+// has, such as those kept in memory before a restart.
+func (s *Store) UseObjects(o Objects) {
+	s.objects = o
+	if m, ok := s.backend.(*memoryBackend); ok {
+		// IDs must not repeat those archived before a restart, which can't
+		// be counted, so they carry on from the clock instead of 1
+		m.mu.Lock()
+		m.nextID = max(m.nextID, int(time.Now().UnixMilli()))
+		m.mu.Unlock()
+	}
+}
+
+// KeepsImages reports whether the store has object storage for images
+func (s *Store) KeepsImages() bool {
+	return s.objects != nil
+}
+
+// SaveImage keeps the original image with the given hash in object storage,
+// if the store has it. Failures are logged rather than failing the
+// generation.
+func (s *Store) SaveImage(ctx context.Context, hash, contentType string, data []byte) {
+	if s.objects == nil || hash == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, objectTimeout)
+	defer cancel()
+	if err := s.objects.Put(ctx, "images/"+hash, contentType, data); err != nil {
+		slog.ErrorContext(ctx, "Error saving image to object storage", "image_hash", hash, "err", err)
+	}
+}
+
+// Image returns the original image of r from object storage, and whether
+// it was found. Images are kept no longer than thumbnails.
+func (s *Store) Image(ctx context.Context, r Record) ([]byte, bool) {
+	if s.objects == nil || r.ImageHash == "" {
+		return nil, false
+	}
+	if s.retention.Thumbnails > 0 && time.Since(r.CreatedAt) > s.retention.Thumbnails {
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, objectTimeout)
+	defer cancel()
+	data, ok, err := s.objects.Get(ctx, "images/"+r.ImageHash)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading image from object storage", "image_hash", r.ImageHash, "err", err)
+	}
+	return data, ok
+}
+
+// archive keeps r in object storage, if the store has it
+func (s *Store) archive(r Record) {
+	if s.objects == nil {
+		return
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), objectTimeout)
+	defer cancel()
+	if err := s.objects.Put(ctx, "results/"+r.ID+".json", "application/json", data); err != nil {
+		slog.Error("Error saving generation to object storage", "generation_id", r.ID, "err", err)
+	}
+}
+
+// archived returns the record with the given ID from object storage
+func (s *Store) archived(id string) (Record, bool) {
+	if s.objects == nil || id == "" {
+		return Record{}, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), objectTimeout)
+	defer cancel()
+	data, ok, err := s.objects.Get(ctx, "results/"+id+".json")
+	if err != nil {
+		slog.Error("Error reading generation from object storage", "generation_id", id, "err", err)
+	}
+	var r Record
+	if !ok || json.Unmarshal(data, &r) != nil {
+		return Record{}, false
+	}
+	// The sweep deletes it once past its retention, but may not have run
+	// yet, or may not know of it after a restart without a database
+	age := time.Since(r.CreatedAt)
+	if s.retention.Records > 0 && age > s.retention.Records {
+		return Record{}, false
+	}
+	if s.retention.Thumbnails > 0 && age > s.retention.Thumbnails {
+		r.Thumbnail = ""
+	}
+	return r, true
+}
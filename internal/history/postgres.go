@@ -0,0 +1,46 @@
+package history
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	// Registers the "postgres" driver
+	_ "github.com/lib/pq"
+)
+
+var postgresDialect = dialect{
+	instr:          "strpos",
+	numbered:       true,
+	dropThumbnails: `UPDATE generations SET record = record - 'thumbnail' WHERE created_at < ? AND record->>'thumbnail' IS NOT NULL`,
+	migrations:     "postgres",
+	// Any fixed key will do, as long as nothing else sharing the database
+	// locks with it
+	lock:   `SELECT pg_advisory_lock(7316282011)`,
+	unlock: `SELECT pg_advisory_unlock(7316282011)`,
+}
+
+// openPostgres connects to the PostgreSQL database at url, migrating the
+// history tables to the latest schema
+func openPostgres(url string) (*sqlBackend, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to history database: %v", err)
+	}
+	if err := migrate(db, postgresDialect); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating history database: %v", err)
+	}
+	newID := func() (string, error) {
+		var id int64
+		if err := db.QueryRow(`SELECT nextval('generation_ids')`).Scan(&id); err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(id, 10), nil
+	}
+	return &sqlBackend{db: db, dialect: postgresDialect, newID: newID}, nil
+}
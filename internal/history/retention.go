@@ -0,0 +1,126 @@
+package history
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// sweepInterval is how often the retention sweeper runs
+const sweepInterval = 10 * time.Minute
+
+// Retention is how long a store keeps generations. Zero keeps them forever.
+type Retention struct {
+	// Records is how long a generation is kept before it is deleted
+	Records time.Duration
+	// Thumbnails is how long a generation keeps the thumbnail of its image,
+	// usually much shorter than the text
+	Thumbnails time.Duration
+}
+
+// Retain starts a background sweeper that deletes generations, and removes
+// thumbnails, once they are older than r allows. It sweeps straight away,
+// then every ten minutes.
+func (s *Store) Retain(r Retention) {
+	s.retention = r
+	if r.Records <= 0 && r.Thumbnails <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			s.sweep(r, time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+// sweep applies r as of now, deleting what purged generations and expired
+// images left in object storage too
+func (s *Store) sweep(r Retention, now time.Time) {
+	var purged []Record
+	if r.Records > 0 {
+		var err error
+		purged, err = s.backend.Purge(now.Add(-r.Records))
+		if err != nil {
+			slog.Error("Error purging old generations from history", "backend", s.name, "err", err)
+		} else if len(purged) > 0 {
+			slog.Info("Purged generations past their retention", "purged", len(purged), "retention", r.Records.String())
+		}
+	}
+	if r.Thumbnails > 0 {
+		n, err := s.backend.DropThumbnails(now.Add(-r.Thumbnails))
+		if err != nil {
+			slog.Error("Error removing old thumbnails from history", "backend", s.name, "err", err)
+		} else if n > 0 {
+			slog.Info("Removed thumbnails past their retention", "removed", n, "retention", r.Thumbnails.String())
+		}
+	}
+	if s.objects != nil {
+		s.sweepObjects(r, now, purged)
+	}
+}
+
+// sweepObjects deletes the results of purged generations from object
+// storage, and the images no generation may show any more. Images are kept
+// as long as thumbnails, or as generations when thumbnails aren't limited,
+// and are shared by generations of the same image, so one goes once the
+// newest generation of it is past that age.
+func (s *Store) sweepObjects(r Retention, now time.Time, purged []Record) {
+	ctx, cancel := context.WithTimeout(context.Background(), sweepInterval)
+	defer cancel()
+
+	deleted := 0
+	for _, record := range purged {
+		if err := s.objects.Delete(ctx, "results/"+record.ID+".json"); err != nil {
+			slog.Error("Error deleting generation from object storage", "generation_id", record.ID, "err", err)
+			continue
+		}
+		deleted++
+	}
+
+	imageAge := r.Thumbnails
+	if imageAge <= 0 {
+		imageAge = r.Records
+	}
+	cutoff := now.Add(-imageAge)
+	hashes := map[string]bool{}
+	for _, record := range purged {
+		hashes[record.ImageHash] = true
+	}
+	if r.Thumbnails > 0 {
+		// Generations still kept whose images passed the cutoff since the
+		// last sweep; after a restart, every one past it is checked again
+		aged, err := s.backend.List(Filter{Since: s.imagesSwept, Until: cutoff})
+		if err != nil {
+			slog.Error("Error listing generations with expired images", "backend", s.name, "err", err)
+			return
+		}
+		for _, record := range aged {
+			hashes[record.ImageHash] = true
+		}
+	}
+	for hash := range hashes {
+		if hash == "" {
+			continue
+		}
+		newer, err := s.backend.List(Filter{ImageHash: hash, Since: cutoff, Limit: 1})
+		if err != nil {
+			slog.Error("Error checking for newer generations of an image", "image_hash", hash, "err", err)
+			continue
+		}
+		if len(newer) > 0 {
+			continue
+		}
+		if err := s.objects.Delete(ctx, "images/"+hash); err != nil {
+			slog.Error("Error deleting image from object storage", "image_hash", hash, "err", err)
+			continue
+		}
+		deleted++
+	}
+	s.imagesSwept = cutoff
+	if deleted > 0 {
+		slog.Info("Deleted expired objects from object storage", "deleted", deleted)
+	}
+}
@@ -0,0 +1,121 @@
+package history
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryObjects is object storage kept in a map
+type memoryObjects struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	deletes int
+}
+
+func newMemoryObjects() *memoryObjects {
+	return &memoryObjects{objects: map[string][]byte{}}
+}
+
+func (o *memoryObjects) Put(ctx context.Context, key, contentType string, data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.objects[key] = data
+	return nil
+}
+
+func (o *memoryObjects) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	data, ok := o.objects[key]
+	return data, ok, nil
+}
+
+func (o *memoryObjects) Delete(ctx context.Context, key string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.objects, key)
+	o.deletes++
+	return nil
+}
+
+func (o *memoryObjects) keys() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var keys []string
+	for key := range o.objects {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestSweepDeletesObjects(t *testing.T) {
+	now := time.Now()
+	days := func(n int) time.Time { return now.Add(-time.Duration(n) * 24 * time.Hour) }
+	objects := newMemoryObjects()
+	store := NewStore()
+	store.UseObjects(objects)
+
+	add := func(id, hash string, created time.Time) {
+		store.Add(Record{ID: id, ImageHash: hash, CreatedAt: created, Thumbnail: "data:image/jpeg;base64,"})
+		store.SaveImage(context.Background(), hash, "image/png", []byte(hash))
+	}
+	// Past the record retention: deleted with its image
+	add("old", "a", days(40))
+	// Kept, but past the image retention
+	add("aged", "b", days(5))
+	// An image shared with a recent generation stays for it
+	add("old-shared", "c", days(40))
+	add("aged-shared", "c", days(5))
+	add("recent", "c", now.Add(-time.Hour))
+
+	r := Retention{Records: 30 * 24 * time.Hour, Thumbnails: 24 * time.Hour}
+	store.retention = r
+	store.sweep(r, now)
+
+	want := []string{"images/c", "results/aged-shared.json", "results/aged.json", "results/recent.json"}
+	if got := objects.keys(); !slices.Equal(got, want) {
+		t.Errorf("objects after sweep = %q, want %q", got, want)
+	}
+	if _, ok := store.Get("old"); ok {
+		t.Error("purged generation still found")
+	}
+	if r, ok := store.Get("aged"); !ok || r.Thumbnail != "" {
+		t.Errorf("aged generation = %+v, %v, want it kept without its thumbnail", r, ok)
+	}
+
+	// Images already swept aren't deleted again
+	deletes := objects.deletes
+	store.sweep(r, now.Add(time.Minute))
+	if objects.deletes != deletes {
+		t.Errorf("second sweep made %d deletes", objects.deletes-deletes)
+	}
+
+	// Once the last generation of an image ages, the image goes too
+	store.sweep(r, now.Add(2*24*time.Hour))
+	if _, ok, _ := objects.Get(context.Background(), "images/c"); ok {
+		t.Error("image kept after its last generation aged past the retention")
+	}
+}
+
+func TestSweepWithoutThumbnailRetention(t *testing.T) {
+	now := time.Now()
+	objects := newMemoryObjects()
+	store := NewStore()
+	store.UseObjects(objects)
+	store.Add(Record{ID: "old", ImageHash: "a", CreatedAt: now.Add(-48 * time.Hour)})
+	store.Add(Record{ID: "new", ImageHash: "b", CreatedAt: now})
+	store.SaveImage(context.Background(), "a", "image/png", []byte("a"))
+	store.SaveImage(context.Background(), "b", "image/png", []byte("b"))
+
+	// Images are kept as long as their generations
+	r := Retention{Records: 24 * time.Hour}
+	store.sweep(r, now)
+	want := []string{"images/b", "results/new.json"}
+	if got := objects.keys(); !slices.Equal(got, want) {
+		t.Errorf("objects after sweep = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,237 @@
+package history
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialect is what differs between the SQL databases history can be kept in
+type dialect struct {
+	// instr names the function returning where a substring starts in a
+	// string, or 0 when it doesn't
+	instr string
+	// numbered is set when placeholders are $1, $2, ... rather than ?
+	numbered bool
+	// dropThumbnails removes the thumbnails from records created before a
+	// cutoff, as the JSON functions differ
+	dropThumbnails string
+	// migrations names the directory of the dialect's schema migrations
+	migrations string
+	// lock and unlock take and release a lock held while migrating, for
+	// databases shared by several instances
+	lock, unlock string
+}
+
+// sqlBackend keeps records in an SQL database's generations table. Each
+// record is kept whole as JSON, with the fields history is filtered and
+// sorted on copied into columns beside it, so new record fields need no new
+// columns.
+type sqlBackend struct {
+	db      *sql.DB
+	dialect dialect
+	// newID returns the ID for a record added without one
+	newID func() (string, error)
+}
+
+func (b *sqlBackend) Add(r Record) (Record, error) {
+	if r.ID == "" {
+		id, err := b.newID()
+		if err != nil {
+			return r, err
+		}
+		r.ID = id
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return r, err
+	}
+	_, err = b.db.Exec(b.dialect.bind(`INSERT INTO generations (id, user_id, provider, model, filename, image_hash, prompt, settings, alt_text, input_tokens, output_tokens, created_at, rating, record)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		r.ID, r.User, r.Provider, r.Model, r.Filename, r.ImageHash, r.Prompt, r.Settings, r.AltText, r.InputTokens, r.OutputTokens, r.CreatedAt.UnixNano(), r.rating(), string(data))
+	return r, err
+}
+
+func (b *sqlBackend) Get(id string) (Record, bool, error) {
+	records, err := b.query("WHERE id = ?", id)
+	if len(records) == 0 {
+		return Record{}, false, err
+	}
+	return records[0], true, err
+}
+
+func (b *sqlBackend) Count() (int, error) {
+	var n int
+	err := b.db.QueryRow(`SELECT COUNT(*) FROM generations`).Scan(&n)
+	return n, err
+}
+
+func (b *sqlBackend) List(f Filter) ([]Record, error) {
+	clauses, args := f.where(b.dialect)
+	return b.query(clauses, args...)
+}
+
+func (b *sqlBackend) Purge(cutoff time.Time) ([]Record, error) {
+	rows, err := b.db.Query(b.dialect.bind(`DELETE FROM generations WHERE created_at < ? RETURNING id, image_hash`), cutoff.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var purged []Record
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.ID, &r.ImageHash); err != nil {
+			return purged, err
+		}
+		purged = append(purged, r)
+	}
+	return purged, rows.Err()
+}
+
+func (b *sqlBackend) DropThumbnails(cutoff time.Time) (int, error) {
+	return b.exec(b.dialect.dropThumbnails, cutoff.UnixNano())
+}
+
+func (b *sqlBackend) Update(id string, change func(*Record)) (Record, bool, error) {
+	r, ok, err := b.Get(id)
+	if !ok || err != nil {
+		return r, ok, err
+	}
+	change(&r)
+	data, err := json.Marshal(r)
+	if err != nil {
+		return r, false, err
+	}
+	_, err = b.exec(`UPDATE generations SET record = ?, rating = ? WHERE id = ?`, string(data), r.rating(), id)
+	return r, err == nil, err
+}
+
+// exec runs a statement and returns how many rows it changed
+func (b *sqlBackend) exec(query string, args ...any) (int, error) {
+	result, err := b.db.Exec(b.dialect.bind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+func (b *sqlBackend) Close() error {
+	return b.db.Close()
+}
+
+// query returns the records the SQL after "SELECT record FROM generations"
+// selects, with what was read before any error
+func (b *sqlBackend) query(clauses string, args ...any) ([]Record, error) {
+	rows, err := b.db.Query(b.dialect.bind(`SELECT record FROM generations `+clauses), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []Record
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return records, err
+		}
+		var r Record
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return records, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// bind numbers the ? placeholders in query if the dialect needs it
+func (d dialect) bind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var out strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			out.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		out.WriteRune(c)
+	}
+	return out.String()
+}
+
+// where turns f into a WHERE clause and its arguments, matching as
+// f.matches does, and orders the results newest first
+func (f Filter) where(d dialect) (string, []any) {
+	var conds []string
+	var args []any
+	if f.User != "" {
+		conds = append(conds, "user_id = ?")
+		args = append(args, f.User)
+	}
+	if f.Provider != "" {
+		conds = append(conds, "provider = ?")
+		args = append(args, f.Provider)
+	}
+	if f.ImageHash != "" {
+		conds = append(conds, "image_hash = ?")
+		args = append(args, f.ImageHash)
+	}
+	if f.Model != "" {
+		conds = append(conds, "model = ?")
+		args = append(args, f.Model)
+	}
+	if f.Prompt != "" {
+		conds = append(conds, "prompt = ?")
+		args = append(args, f.Prompt)
+	}
+	if f.Settings != "" {
+		conds = append(conds, "settings = ?")
+		args = append(args, f.Settings)
+	}
+	if f.Rating != "" {
+		conds = append(conds, "rating = ?")
+		args = append(args, f.Rating)
+	}
+	if f.Filename != "" {
+		conds = append(conds, d.instr+"(lower(filename), ?) > 0")
+		args = append(args, strings.ToLower(f.Filename))
+	}
+	for _, term := range strings.Fields(strings.ToLower(f.Search)) {
+		conds = append(conds, d.instr+"(lower(alt_text), ?) > 0")
+		args = append(args, term)
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, f.Since.UnixNano())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, f.Until.UnixNano())
+	}
+	if f.After != nil {
+		// Older than the cursor, in the order newer sorts by
+		conds = append(conds, "(created_at < ? OR created_at = ? AND (length(id) < ? OR length(id) = ? AND id < ?))")
+		nanos, n := f.After.CreatedAt.UnixNano(), len(f.After.ID)
+		args = append(args, nanos, nanos, n, n, f.After.ID)
+	}
+	clauses := ""
+	if len(conds) > 0 {
+		clauses = "WHERE " + strings.Join(conds, " AND ")
+	}
+	clauses += " ORDER BY created_at DESC, length(id) DESC, id DESC"
+	if f.Limit > 0 || f.Offset > 0 {
+		// Not every dialect has a way to write no limit but a huge one
+		limit := int64(f.Limit)
+		if limit <= 0 {
+			limit = math.MaxInt64
+		}
+		clauses += " LIMIT ? OFFSET ?"
+		args = append(args, limit, max(f.Offset, 0))
+	}
+	return clauses, args
+}
@@ -0,0 +1,240 @@
+package history
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appliedMigrations returns the versions recorded in schema_migrations and
+// when each was applied
+func appliedMigrations(t *testing.T, db *sql.DB) map[int]int64 {
+	t.Helper()
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	applied := map[int]int64{}
+	for rows.Next() {
+		var version int
+		var at int64
+		if err := rows.Scan(&version, &at); err != nil {
+			t.Fatal(err)
+		}
+		applied[version] = at
+	}
+	return applied
+}
+
+// columns returns the names of the generations table's columns
+func columns(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('generations') ORDER BY cid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	migrations, err := loadMigrations("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "history.db")
+
+	b, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := appliedMigrations(t, b.db)
+	if len(applied) != len(migrations) {
+		t.Errorf("applied %v, want all %d migrations", applied, len(migrations))
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; !ok {
+			t.Errorf("migration %d (%s) not applied", m.version, m.name)
+		}
+	}
+	want := []string{"id", "user_id", "provider", "model", "filename", "image_hash", "prompt", "alt_text",
+		"input_tokens", "output_tokens", "created_at", "record", "rating", "settings"}
+	if got := columns(t, b.db); !reflect.DeepEqual(got, want) {
+		t.Errorf("columns = %q, want %q", got, want)
+	}
+
+	// Migrating again, directly or by reopening, changes nothing
+	if err := migrate(b.db, sqliteDialect); err != nil {
+		t.Fatalf("second migrate: %v", err)
+	}
+	b.Close()
+	b, err = openSQLite(path)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	if again := appliedMigrations(t, b.db); !reflect.DeepEqual(again, applied) {
+		t.Errorf("after reopening applied = %v, want %v", again, applied)
+	}
+
+	// A database migrated by a newer build is refused
+	if _, err := b.db.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (9999, 'future', 0)`); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if _, err := openSQLite(path); err == nil || !strings.Contains(err.Error(), "newer than this build's") {
+		t.Errorf("opening a newer schema err = %v", err)
+	}
+}
+
+func TestSQLiteMigratesLegacyDatabase(t *testing.T) {
+	// A database from before migrations has the original table and no
+	// schema_migrations
+	path := filepath.Join(t.TempDir(), "history.db")
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := migrationFiles.ReadFile("migrations/sqlite/0001_create_generations.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(legacy)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO generations (id, provider, model, filename, image_hash, alt_text, created_at, record) VALUES ('7', 'anthropic', 'm', 'a.png', 'h', 'A cat', 1, ?)`,
+		`{"id":"7","provider":"anthropic","alt_text":"A cat","settings":"length=short","feedback":{"rating":"up"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	// The new columns are filled in from the records
+	if got := store.List(Filter{Rating: RatingUp, Settings: "length=short"}); len(got) != 1 || got[0].ID != "7" {
+		t.Errorf("List by backfilled columns = %+v", got)
+	}
+	// New IDs carry on from the highest stored
+	if r := store.Add(Record{Provider: "anthropic", AltText: "A dog"}); r.ID != "8" {
+		t.Errorf("new ID = %q, want 8", r.ID)
+	}
+}
+
+func TestSQLiteRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Backend() != "sqlite" {
+		t.Errorf("Backend = %q, want sqlite", store.Backend())
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	old := store.Add(Record{
+		User: "team", Provider: "anthropic", Model: "claude", Filename: "Old-Harbour.png", ImageHash: "hash-old",
+		AltText: "1. A harbour at dusk\n2. Boats in a harbour", Score: 80, Lint: []string{"starts-with-image-of"},
+		Tags: []string{"harbour", "boats"}, Settings: "length=short", InputTokens: 100, OutputTokens: 20,
+		CreatedAt: now.Add(-48 * time.Hour),
+	})
+	kept := store.Add(Record{
+		User: "team", Provider: "openai", Model: "gpt", Filename: "cat.jpg", ImageHash: "hash-cat",
+		AltText: "A cat asleep on a windowsill", CreatedAt: now,
+	})
+	other := store.Add(Record{User: "someone", Provider: "openai", Model: "gpt", Filename: "dog.jpg", ImageHash: "hash-dog", AltText: "A dog", CreatedAt: now})
+	if old.ID != "1" || kept.ID != "2" || other.ID != "3" {
+		t.Fatalf("IDs = %s, %s, %s, want 1, 2, 3", old.ID, kept.ID, other.ID)
+	}
+
+	got, ok := store.Get(old.ID)
+	if !ok || !reflect.DeepEqual(got, old) {
+		t.Errorf("Get = %+v, %v, want %+v", got, ok, old)
+	}
+	if _, ok := store.Get("404"); ok {
+		t.Error("Get found a record that was never added")
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"everything, newest first", Filter{}, []string{"3", "2", "1"}},
+		{"user", Filter{User: "team"}, []string{"2", "1"}},
+		{"filename", Filter{Filename: "harbour"}, []string{"1"}},
+		{"search", Filter{Search: "BOATS harbour"}, []string{"1"}},
+		{"image", Filter{ImageHash: "hash-cat", Model: "gpt"}, []string{"2"}},
+		{"settings", Filter{Settings: "length=short"}, []string{"1"}},
+		{"since", Filter{Since: now.Add(-time.Hour)}, []string{"3", "2"}},
+		{"page", Filter{Limit: 1, Offset: 1}, []string{"2"}},
+		{"after a cursor", Filter{After: &Cursor{CreatedAt: now, ID: "3"}}, []string{"2", "1"}},
+	}
+	for _, tt := range tests {
+		var ids []string
+		for _, r := range store.List(tt.filter) {
+			ids = append(ids, r.ID)
+		}
+		if !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("%s: List = %v, want %v", tt.name, ids, tt.want)
+		}
+	}
+
+	if _, ok := store.SetFeedback(kept.ID, Feedback{Rating: RatingDown, Comment: "It's a kitten"}); !ok {
+		t.Fatal("SetFeedback found nothing")
+	}
+	if rated := store.List(Filter{Rating: RatingDown}); len(rated) != 1 || rated[0].Feedback.Comment != "It's a kitten" {
+		t.Errorf("List by rating = %+v", rated)
+	}
+
+	purged, err := store.backend.Purge(now.Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Record{{ID: old.ID, ImageHash: "hash-old"}}; !reflect.DeepEqual(purged, want) {
+		t.Errorf("Purge = %+v, want %+v", purged, want)
+	}
+	if store.Count() != 2 {
+		t.Errorf("Count after purge = %d, want 2", store.Count())
+	}
+	if purged, err := store.backend.Purge(now.Add(-24 * time.Hour)); err != nil || len(purged) != 0 {
+		t.Errorf("second Purge = %+v, %v, want nothing", purged, err)
+	}
+
+	// Records and IDs survive reopening
+	store.Close()
+	if store, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got, ok := store.Get(kept.ID); !ok || got.Feedback == nil || got.Feedback.Rating != RatingDown {
+		t.Errorf("after reopening Get = %+v, %v", got, ok)
+	}
+	if r := store.Add(Record{Provider: "openai", AltText: "A bird"}); r.ID != "4" {
+		t.Errorf("ID after reopening = %q, want 4", r.ID)
+	}
+}
+
+func TestBind(t *testing.T) {
+	query := `SELECT record FROM generations WHERE id = ? AND user_id = ?`
+	if got := sqliteDialect.bind(query); got != query {
+		t.Errorf("sqlite bind = %q", got)
+	}
+	if got, want := (dialect{numbered: true}).bind(query), `SELECT record FROM generations WHERE id = $1 AND user_id = $2`; got != want {
+		t.Errorf("numbered bind = %q, want %q", got, want)
+	}
+}
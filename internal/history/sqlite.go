@@ -0,0 +1,46 @@
+package history
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+
+	// Registers the pure Go "sqlite" driver, so no C toolchain is needed
+	_ "modernc.org/sqlite"
+)
+
+var sqliteDialect = dialect{
+	instr:          "instr",
+	dropThumbnails: `UPDATE generations SET record = json_remove(record, '$.thumbnail') WHERE created_at < ? AND json_extract(record, '$.thumbnail') IS NOT NULL`,
+	migrations:     "sqlite",
+}
+
+// openSQLite opens the SQLite database file at path, creating it if needed
+func openSQLite(path string) (*sqlBackend, error) {
+	// WAL lets history be read while a generation is being written, and the
+	// busy timeout waits out a concurrent write instead of failing
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db, sqliteDialect); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating history database %s: %v", path, err)
+	}
+	// IDs carry on from the highest already stored. Only one process uses
+	// the file, so they can be counted here.
+	var next int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(CAST(id AS INTEGER)), 0) FROM generations`).Scan(&next); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("reading history from %s: %v", path, err)
+	}
+	var mu sync.Mutex
+	newID := func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		next++
+		return strconv.Itoa(next), nil
+	}
+	return &sqlBackend{db: db, dialect: sqliteDialect, newID: newID}, nil
+}
@@ -0,0 +1,65 @@
+package history
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	_ "image/gif" // Registers GIF decoding
+	"image/jpeg"
+	_ "image/png" // Registers PNG decoding
+)
+
+// thumbnailSize is the longest side of a thumbnail, in pixels
+const thumbnailSize = 96
+
+// Thumbnail returns a small JPEG of the image as a data URI, for showing a
+// generation beside its alt text, or "" for a format that can't be decoded,
+// such as WebP
+func Thumbnail(data []byte) string {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+	tw, th := w, h
+	if w > thumbnailSize || h > thumbnailSize {
+		if w >= h {
+			tw, th = thumbnailSize, max(1, h*thumbnailSize/w)
+		} else {
+			tw, th = max(1, w*thumbnailSize/h), thumbnailSize
+		}
+	}
+
+	// Each thumbnail pixel averages a grid of samples from the area it
+	// covers, which is much faster than every pixel of a large photo
+	const samples = 4
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		for x := 0; x < tw; x++ {
+			var r, g, bl, a uint32
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					px := b.Min.X + (x*samples+sx)*w/(tw*samples)
+					py := b.Min.Y + (y*samples+sy)*h/(th*samples)
+					cr, cg, cb, ca := src.At(px, py).RGBA()
+					r, g, bl, a = r+cr, g+cg, bl+cb, a+ca
+				}
+			}
+			n := uint32(samples * samples * 257)
+			i := dst.PixOffset(x, y)
+			// JPEG has no transparency, so transparent areas come out white
+			white := 255 - a/n
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n+white), uint8(g/n+white), uint8(bl/n+white), 255
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 75}); err != nil {
+		return ""
+	}
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
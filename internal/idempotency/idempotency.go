@@ -0,0 +1,191 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"alt-text-generator/internal/auth"
+	"alt-text-generator/internal/ratelimit"
+)
+
+// Header is the request header clients use to mark retries of the same call
+const Header = "Idempotency-Key"
+
+// ReplayedHeader is set on responses served from a previous call's result
+const ReplayedHeader = "Idempotent-Replayed"
+
+// maxKeyLength bounds client keys; UUIDs and similar tokens fit comfortably
+const maxKeyLength = 255
+
+// ErrMismatch is returned by Do when an idempotency key is reused for a
+// call made with different options than the first
+var ErrMismatch = errors.New("idempotency key was already used with different options")
+
+type contextKey struct{}
+
+// request is what the middleware stores in the context for Do to use
+type request struct {
+	cache *Cache
+	key   string
+	// client is the caller's IP address, which keys are scoped to when the
+	// caller isn't authenticated
+	client string
+
+	mu     sync.Mutex // guards header; batch items call Do concurrently
+	header http.Header
+}
+
+// Cache remembers the results of recent calls made under an idempotency key
+// so a retried request gets the original result instead of a second paid
+// provider call
+type Cache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	trustProxy bool
+	entries    map[string]*entry
+}
+
+type entry struct {
+	// fingerprint describes the options the call was made with
+	fingerprint string
+	done        chan struct{}
+	value       interface{}
+	err         error
+	expires     time.Time
+}
+
+// New returns a cache that keeps successful results for ttl. Unauthenticated
+// callers are told apart by IP address, taken from X-Forwarded-For when
+// trustProxy is set.
+func New(ttl time.Duration, trustProxy bool) *Cache {
+	c := &Cache{ttl: ttl, trustProxy: trustProxy, entries: map[string]*entry{}}
+	go c.sweep()
+	return c
+}
+
+// Middleware makes the request's Idempotency-Key available to Do. Requests
+// without the header pass through untouched.
+func (c *Cache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"Idempotency-Key must be at most 255 characters"}` + "\n"))
+			return
+		}
+		ctx := context.WithValue(r.Context(), contextKey{}, &request{cache: c, key: key, client: ratelimit.ClientIP(r, c.trustProxy), header: w.Header()})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Do runs fn once per idempotency key, caller, and scope. scope distinguishes
+// the calls a single request makes (e.g. the hash of each image in a batch),
+// and fingerprint describes the options fn is called with. A retry while the
+// first call is still running waits for it; a retry after it succeeded gets
+// its value with replayed set. A retry with a different fingerprint fails
+// with ErrMismatch rather than getting a result made with other options.
+// Failures are not remembered, so a retry after an error calls fn again.
+// Without an Idempotency-Key in ctx, Do simply calls fn.
+func Do(ctx context.Context, scope, fingerprint string, fn func() (interface{}, error)) (value interface{}, replayed bool, err error) {
+	req, ok := ctx.Value(contextKey{}).(*request)
+	if !ok {
+		value, err = fn()
+		return value, false, err
+	}
+
+	// Keys are namespaced by caller so one client can't read another's results
+	caller := "ip:" + req.client
+	if id, ok := auth.IdentityFromContext(ctx); ok {
+		caller = id.Method + ":" + id.Subject
+	}
+	key := caller + "\x00" + req.key + "\x00" + scope
+	c := req.cache
+
+	c.mu.Lock()
+	e, found := c.entries[key]
+	if found && (e.expires.IsZero() || time.Now().Before(e.expires)) {
+		c.mu.Unlock()
+		if e.fingerprint != fingerprint {
+			slog.WarnContext(ctx, "Idempotency key reused with different options", "idempotency_key", req.key)
+			return nil, false, ErrMismatch
+		}
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if e.err != nil {
+			return nil, false, e.err
+		}
+		slog.InfoContext(ctx, "Replaying idempotent result", "idempotency_key", req.key)
+		req.mu.Lock()
+		req.header.Set(ReplayedHeader, "true")
+		req.mu.Unlock()
+		return e.value, true, nil
+	}
+	e = &entry{fingerprint: fingerprint, done: make(chan struct{})}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	value, err = fn()
+
+	c.mu.Lock()
+	e.value, e.err = value, err
+	if err != nil {
+		delete(c.entries, key)
+	} else {
+		e.expires = time.Now().Add(c.ttl)
+	}
+	c.mu.Unlock()
+	close(e.done)
+	return value, false, err
+}
+
+// Len returns the number of remembered calls
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Flush forgets every completed call and returns how many were dropped.
+// Calls still in flight are kept so their waiters are not orphaned.
+func (c *Cache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for key, e := range c.entries {
+		if !e.expires.IsZero() {
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// sweep drops expired results
+func (c *Cache) sweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		c.mu.Lock()
+		for key, e := range c.entries {
+			if !e.expires.IsZero() && now.After(e.expires) {
+				delete(c.entries, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,136 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"alt-text-generator/internal/auth"
+)
+
+// call sends a request through c's middleware from remoteAddr, optionally as
+// an authenticated caller, and runs Do inside it
+func call(c *Cache, key, remoteAddr string, id *auth.Identity, scope, fingerprint string, fn func() (interface{}, error)) (value interface{}, replayed bool, err error) {
+	r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	r.RemoteAddr = remoteAddr
+	if key != "" {
+		r.Header.Set(Header, key)
+	}
+	c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if id != nil {
+			ctx = auth.WithIdentity(ctx, *id)
+		}
+		value, replayed, err = Do(ctx, scope, fingerprint, fn)
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	return value, replayed, err
+}
+
+func TestDo(t *testing.T) {
+	c := New(time.Hour, false)
+	var calls int
+	generate := func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+	alice := &auth.Identity{Subject: "alice", Method: "api_key"}
+	bob := &auth.Identity{Subject: "bob", Method: "api_key"}
+
+	steps := []struct {
+		name        string
+		key         string
+		remoteAddr  string
+		id          *auth.Identity
+		scope       string
+		fingerprint string
+		value       interface{}
+		replayed    bool
+		err         error
+	}{
+		{"first call", "k1", "192.0.2.1:1000", alice, "img", "opts", 1, false, nil},
+		{"retry replays", "k1", "192.0.2.9:2000", alice, "img", "opts", 1, true, nil},
+		{"different options", "k1", "192.0.2.1:1000", alice, "img", "other", nil, false, ErrMismatch},
+		{"different image", "k1", "192.0.2.1:1000", alice, "img2", "other", 2, false, nil},
+		{"other caller", "k1", "192.0.2.1:1000", bob, "img", "other", 3, false, nil},
+		{"anonymous caller", "k1", "192.0.2.1:1000", nil, "img", "opts", 4, false, nil},
+		{"same anonymous caller on another port", "k1", "192.0.2.1:3000", nil, "img", "opts", 4, true, nil},
+		{"other anonymous caller", "k1", "192.0.2.2:1000", nil, "img", "opts", 5, false, nil},
+		{"no key", "", "192.0.2.1:1000", alice, "img", "opts", 6, false, nil},
+	}
+	for _, s := range steps {
+		value, replayed, err := call(c, s.key, s.remoteAddr, s.id, s.scope, s.fingerprint, generate)
+		if !errors.Is(err, s.err) || value != s.value || replayed != s.replayed {
+			t.Errorf("%s: got (%v, %v, %v), want (%v, %v, %v)", s.name, value, replayed, err, s.value, s.replayed, s.err)
+		}
+	}
+}
+
+func TestDoForgetsFailures(t *testing.T) {
+	c := New(time.Hour, false)
+	errFailed := errors.New("provider failed")
+	if _, _, err := call(c, "k", "192.0.2.1:1000", nil, "img", "opts", func() (interface{}, error) {
+		return nil, errFailed
+	}); !errors.Is(err, errFailed) {
+		t.Fatalf("err = %v, want %v", err, errFailed)
+	}
+	// A retry with other options isn't refused, since nothing was kept
+	value, replayed, err := call(c, "k", "192.0.2.1:1000", nil, "img", "other", func() (interface{}, error) {
+		return "ok", nil
+	})
+	if err != nil || value != "ok" || replayed {
+		t.Errorf("retry = (%v, %v, %v), want a fresh call", value, replayed, err)
+	}
+}
+
+func TestDoWaitsForRunningCall(t *testing.T) {
+	c := New(time.Hour, false)
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	first := make(chan interface{})
+	go func() {
+		value, _, _ := call(c, "k", "192.0.2.1:1000", nil, "img", "opts", func() (interface{}, error) {
+			close(started)
+			<-finish
+			return "first", nil
+		})
+		first <- value
+	}()
+	<-started
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(finish)
+	}()
+	value, replayed, err := call(c, "k", "192.0.2.1:1000", nil, "img", "opts", func() (interface{}, error) {
+		return "second", nil
+	})
+	if err != nil || value != "first" || !replayed {
+		t.Errorf("retry = (%v, %v, %v), want the first call's value", value, replayed, err)
+	}
+	if v := <-first; v != "first" {
+		t.Errorf("first call = %v", v)
+	}
+}
+
+func TestMiddlewareRejectsLongKeys(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	r.Header.Set(Header, string(make([]byte, maxKeyLength+1)))
+	w := httptest.NewRecorder()
+	New(time.Hour, false).Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Error("handler called")
+	})).ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
+
+func TestDoWithoutMiddleware(t *testing.T) {
+	value, replayed, err := Do(context.Background(), "img", "opts", func() (interface{}, error) {
+		return "direct", nil
+	})
+	if err != nil || value != "direct" || replayed {
+		t.Errorf("Do = (%v, %v, %v)", value, replayed, err)
+	}
+}
@@ -0,0 +1,154 @@
+package jobs
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"alt-text-generator/internal/history"
+)
+
+// gaveUpMessage is the error of a durable job that used up its attempts
+// without any of them returning, such as by the server stopping each time
+const gaveUpMessage = "The job could not be finished. Please submit it again."
+
+// pollInterval is how often idle durable workers look for jobs that have
+// become ready, such as ones due a retry
+const pollInterval = time.Second
+
+// submitDurable adds job to the durable queue
+func (m *Manager) submitDurable(ctx context.Context, job *Job) (Job, error) {
+	m.mu.RLock()
+	draining := m.draining
+	m.mu.RUnlock()
+	if draining {
+		return Job{}, ErrDraining
+	}
+	if err := m.durable.push(ctx, job, m.queueSize); err != nil {
+		if err != ErrQueueFull {
+			slog.ErrorContext(ctx, "Error queueing job", "err", err)
+		}
+		return Job{}, err
+	}
+	m.signal()
+	slog.InfoContext(ctx, "Queued job", "job_id", job.ID)
+	return *job, nil
+}
+
+// signal wakes an idle durable worker, if there is one
+func (m *Manager) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// durableWorker runs jobs from the durable queue until Abandon stops it
+func (m *Manager) durableWorker() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for m.ctx.Err() == nil {
+		job, err := m.durable.claim(m.ctx)
+		if err != nil && m.ctx.Err() == nil {
+			slog.Error("Error claiming job from the queue", "err", err)
+		}
+		if job == nil {
+			select {
+			case <-m.ctx.Done():
+			case <-m.wake:
+			case <-ticker.C:
+			}
+			continue
+		}
+		// More jobs may be ready, for another idle worker
+		m.signal()
+		m.runDurable(job)
+	}
+}
+
+// runDurable runs a job claimed from the durable queue, then records how it
+// ended or, when it failed with attempts to spare and the failure isn't
+// Permanent, puts it back for a retry
+func (m *Manager) runDurable(job *Job) {
+	ctx := job.options.context(m.ctx)
+	if job.Attempts > m.durable.maxAttempts {
+		slog.ErrorContext(ctx, "Job used up its attempts", "job_id", job.ID, "attempts", job.Attempts-1)
+		m.finishDurable(ctx, job, history.Record{}, gaveUpMessage)
+		return
+	}
+
+	m.mu.Lock()
+	m.jobs[job.ID] = job
+	m.mu.Unlock()
+
+	release := m.durable.hold(job.ID)
+	slog.InfoContext(ctx, "Running job", "job_id", job.ID, "attempt", job.Attempts)
+	record, err := m.process(ctx, job.Filename, job.data)
+	release()
+
+	m.mu.Lock()
+	abandoned := job.Status != StatusRunning
+	delete(m.jobs, job.ID)
+	m.mu.Unlock()
+	if abandoned {
+		// Returned to the queue by Abandon
+		return
+	}
+
+	if err == nil {
+		slog.InfoContext(ctx, "Job succeeded", "job_id", job.ID)
+		m.finishDurable(ctx, job, record, "")
+		return
+	}
+	if job.Attempts < m.durable.maxAttempts && !isPermanent(err) {
+		slog.WarnContext(ctx, "Job failed, will retry", "job_id", job.ID, "attempt", job.Attempts, "err", err)
+		if err := m.durable.retry(context.Background(), job.ID); err != nil {
+			slog.ErrorContext(ctx, "Error returning job to the queue", "job_id", job.ID, "err", err)
+		}
+		return
+	}
+	slog.ErrorContext(ctx, "Job failed", "job_id", job.ID, "attempts", job.Attempts, "permanent", isPermanent(err), "err", err)
+	m.finishDurable(ctx, job, history.Record{}, err.Error())
+}
+
+// finishDurable records a durable job as succeeded with record, or failed
+// with message when there is one
+func (m *Manager) finishDurable(ctx context.Context, job *Job, record history.Record, message string) {
+	done := time.Now().UTC()
+	job.CompletedAt = &done
+	job.data = nil
+	if message != "" {
+		job.Status = StatusFailed
+		job.Error = message
+	} else {
+		job.Status = StatusSucceeded
+		job.Result = &record
+	}
+	if err := m.durable.finish(context.Background(), *job); err != nil {
+		slog.ErrorContext(ctx, "Error saving finished job to the queue", "job_id", job.ID, "err", err)
+	}
+	m.archive(ctx, *job)
+}
+
+// release stops the jobs running and returns them to the durable queue, for
+// Abandon
+func (m *Manager) release(ctx context.Context) int {
+	m.mu.Lock()
+	m.draining = true
+	m.cancel()
+	var released []string
+	for id, job := range m.jobs {
+		job.Status = StatusQueued
+		released = append(released, id)
+	}
+	m.mu.Unlock()
+
+	for _, id := range released {
+		if err := m.durable.release(ctx, id); err != nil {
+			slog.ErrorContext(ctx, "Error returning job to the queue", "job_id", id, "err", err)
+			continue
+		}
+		slog.WarnContext(ctx, "Returned job to the queue at shutdown", "job_id", id)
+	}
+	return len(released)
+}
@@ -0,0 +1,103 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"alt-text-generator/internal/history"
+)
+
+// waitFinished polls until the job has succeeded or failed
+func waitFinished(t *testing.T, m *Manager, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		job, ok := m.Get(id)
+		if ok && (job.Status == StatusSucceeded || job.Status == StatusFailed) {
+			return job
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("job %s didn't finish", id)
+	return Job{}
+}
+
+func TestDurableRetries(t *testing.T) {
+	transient := errors.New("provider timed out")
+	tests := []struct {
+		name     string
+		fail     func(run int32) error
+		status   string
+		attempts int
+		message  string
+	}{
+		{
+			name:     "succeeds first time",
+			fail:     func(int32) error { return nil },
+			status:   StatusSucceeded,
+			attempts: 1,
+		},
+		{
+			name: "succeeds on retry",
+			fail: func(run int32) error {
+				if run == 1 {
+					return transient
+				}
+				return nil
+			},
+			status:   StatusSucceeded,
+			attempts: 2,
+		},
+		{
+			name:     "transient failures use up the attempts",
+			fail:     func(int32) error { return transient },
+			status:   StatusFailed,
+			attempts: 3,
+			message:  transient.Error(),
+		},
+		{
+			name:     "permanent failure isn't retried",
+			fail:     func(int32) error { return Permanent(fmt.Errorf("quota: %w", errors.New("daily quota exceeded"))) },
+			status:   StatusFailed,
+			attempts: 1,
+			message:  "quota: daily quota exceeded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := OpenQueue(filepath.Join(t.TempDir(), "jobs.db"), 10*time.Millisecond, 3)
+			if err != nil {
+				t.Fatalf("OpenQueue: %v", err)
+			}
+			var runs atomic.Int32
+			m := NewDurableManager(q, 1, 10, time.Hour, func(ctx context.Context, filename string, data []byte) (history.Record, error) {
+				if err := tt.fail(runs.Add(1)); err != nil {
+					return history.Record{}, err
+				}
+				return history.Record{Filename: filename, AltText: "A dog"}, nil
+			})
+			defer m.Close()
+
+			job, err := m.Submit(context.Background(), "dog.png", []byte("image"))
+			if err != nil {
+				t.Fatalf("Submit: %v", err)
+			}
+			job = waitFinished(t, m, job.ID)
+			if job.Status != tt.status || job.Attempts != tt.attempts || job.Error != tt.message {
+				t.Errorf("job = %s after %d attempts with error %q, want %s after %d with %q",
+					job.Status, job.Attempts, job.Error, tt.status, tt.attempts, tt.message)
+			}
+			if got := int(runs.Load()); got != tt.attempts {
+				t.Errorf("ran %d times, want %d", got, tt.attempts)
+			}
+			if tt.status == StatusSucceeded && (job.Result == nil || job.Result.AltText != "A dog") {
+				t.Errorf("result = %+v", job.Result)
+			}
+		})
+	}
+}
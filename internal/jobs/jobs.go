@@ -0,0 +1,515 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/auth"
+	"alt-text-generator/internal/history"
+	"alt-text-generator/internal/logging"
+)
+
+// Job statuses
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// ErrQueueFull is returned by Submit when no more jobs can be accepted
+var ErrQueueFull = errors.New("job queue is full")
+
+// ErrDraining is returned by Submit while the queue is being drained
+var ErrDraining = errors.New("job queue is draining")
+
+// Permanent marks err as a failure that running the job again won't fix,
+// such as an image the provider rejects, so a durable job fails at once
+// instead of being retried
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+type permanentError struct{ error }
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// isPermanent reports whether err was marked with Permanent
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// abandonedMessage is the error of jobs the server shut down before finishing
+const abandonedMessage = "The server shut down before the job finished. Please submit it again."
+
+// ProcessFunc generates alt text for a job's image. The context carries the
+// identity of whoever submitted the job, the ID of the submitting request, and
+// any image context and presets submitted with it.
+type ProcessFunc func(ctx context.Context, filename string, data []byte) (history.Record, error)
+
+// Job represents an asynchronous generation request
+type Job struct {
+	ID          string          `json:"id"`
+	Status      string          `json:"status"`
+	User        string          `json:"user,omitempty"`
+	Filename    string          `json:"filename,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Result      *history.Record `json:"result,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+	// Attempts counts the times a job from the durable queue has been run
+	Attempts int `json:"attempts,omitempty"`
+
+	data    []byte
+	options options
+}
+
+// options are how a job is to be captioned: who submitted it, and the image
+// context and presets they sent. They're kept with a job in the durable
+// queue, so they have JSON names.
+type options struct {
+	Owner        auth.Identity    `json:"owner"`
+	RequestID    string           `json:"request_id,omitempty"`
+	ImageContext api.ImageContext `json:"image_context"`
+	Style        string           `json:"style,omitempty"`
+	Domain       string           `json:"domain,omitempty"`
+	Platform     string           `json:"platform,omitempty"`
+	MaxChars     int              `json:"max_chars,omitempty"`
+	People       string           `json:"people,omitempty"`
+	Describe     bool             `json:"describe,omitempty"`
+	Structured   bool             `json:"structured,omitempty"`
+	Keywords     bool             `json:"keywords,omitempty"`
+	Charts       bool             `json:"charts,omitempty"`
+	Objective    bool             `json:"objective,omitempty"`
+	ReadingLevel int              `json:"reading_level,omitempty"`
+	Candidates   int              `json:"candidates,omitempty"`
+	Sampling     api.Sampling     `json:"sampling"`
+	Translate    []string         `json:"translate,omitempty"`
+	Improve      bool             `json:"improve,omitempty"`
+	Refresh      bool             `json:"refresh,omitempty"`
+}
+
+// optionsFrom takes a job's options from the context it was submitted with
+func optionsFrom(ctx context.Context) options {
+	owner, _ := auth.IdentityFromContext(ctx)
+	platform, _ := api.PlatformFrom(ctx)
+	return options{
+		Owner:        owner,
+		RequestID:    logging.RequestID(ctx),
+		ImageContext: api.ImageContextFrom(ctx),
+		Style:        api.StyleFrom(ctx),
+		Domain:       api.DomainFrom(ctx),
+		Platform:     platform.Name,
+		MaxChars:     api.MaxChars(ctx),
+		People:       api.PeoplePolicy(ctx),
+		Describe:     api.DescriptionWanted(ctx),
+		Structured:   api.StructuredWanted(ctx),
+		Keywords:     api.KeywordsWanted(ctx),
+		Charts:       api.ChartsWanted(ctx),
+		Objective:    api.ObjectiveWanted(ctx),
+		ReadingLevel: api.ReadingLevel(ctx),
+		Candidates:   api.Candidates(ctx),
+		Sampling:     api.SamplingFrom(ctx),
+		Translate:    api.TranslationLanguages(ctx),
+		Improve:      api.ImproveWanted(ctx),
+		Refresh:      history.RefreshWanted(ctx),
+	}
+}
+
+// context returns ctx carrying the options, for running the job
+func (o options) context(ctx context.Context) context.Context {
+	if o.Owner.Subject != "" {
+		ctx = auth.WithIdentity(ctx, o.Owner)
+	}
+	if o.RequestID != "" {
+		ctx = logging.WithRequestID(ctx, o.RequestID)
+	}
+	ctx = api.WithImageContext(ctx, o.ImageContext)
+	ctx = api.WithStyle(ctx, o.Style)
+	ctx = api.WithDomain(ctx, o.Domain)
+	ctx = api.WithPlatform(ctx, o.Platform)
+	ctx = api.WithMaxChars(ctx, o.MaxChars)
+	ctx = api.WithPeoplePolicy(ctx, o.People)
+	ctx = api.WithDescription(ctx, o.Describe)
+	ctx = api.WithStructured(ctx, o.Structured)
+	ctx = api.WithKeywords(ctx, o.Keywords)
+	ctx = api.WithCharts(ctx, o.Charts)
+	ctx = api.WithObjective(ctx, o.Objective)
+	ctx = api.WithReadingLevel(ctx, o.ReadingLevel)
+	ctx = api.WithCandidates(ctx, o.Candidates)
+	ctx = api.WithSampling(ctx, o.Sampling)
+	ctx = api.WithTranslation(ctx, o.Translate)
+	ctx = api.WithImprove(ctx, o.Improve)
+	return history.WithRefresh(ctx, o.Refresh)
+}
+
+// Manager runs jobs on a fixed pool of workers and keeps finished jobs
+// around for the retention period so clients can poll for them
+type Manager struct {
+	mu        sync.RWMutex
+	jobs      map[string]*Job
+	queue     chan *Job
+	process   ProcessFunc
+	retention time.Duration
+	draining  bool
+	objects   history.Objects
+
+	// durable keeps the jobs, in place of queue and all but the running
+	// ones in jobs, for a manager made by NewDurableManager
+	durable   *Queue
+	queueSize int
+	// wake tells an idle durable worker a job may be ready
+	wake chan struct{}
+
+	// ctx is cancelled by Abandon, stopping the jobs running
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Stats counts the jobs the manager currently knows about by status
+type Stats struct {
+	Queued    int  `json:"queued"`
+	Running   int  `json:"running"`
+	Succeeded int  `json:"succeeded"`
+	Failed    int  `json:"failed"`
+	Draining  bool `json:"draining"`
+}
+
+// NewManager starts workers goroutines consuming a queue of queueSize jobs
+func NewManager(workers, queueSize int, retention time.Duration, process ProcessFunc) *Manager {
+	m := &Manager{
+		jobs:      map[string]*Job{},
+		queue:     make(chan *Job, queueSize),
+		process:   process,
+		retention: retention,
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	for i := 0; i < workers; i++ {
+		go m.worker()
+	}
+	go m.sweep()
+	return m
+}
+
+// NewDurableManager starts workers goroutines running the jobs in q, which
+// may hold queueSize jobs waiting at once. Jobs left queued or running by
+// an earlier run of the server are picked up as well.
+func NewDurableManager(q *Queue, workers, queueSize int, retention time.Duration, process ProcessFunc) *Manager {
+	m := &Manager{
+		jobs:      map[string]*Job{},
+		process:   process,
+		retention: retention,
+		durable:   q,
+		queueSize: queueSize,
+		wake:      make(chan struct{}, 1),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	for i := 0; i < workers; i++ {
+		go m.durableWorker()
+	}
+	go m.sweep()
+	return m
+}
+
+// Submit queues an image for processing and returns a snapshot of the new job.
+// The job is attributed to the identity in ctx, if any, and captioned with
+// the image context and presets in ctx.
+func (m *Manager) Submit(ctx context.Context, filename string, data []byte) (Job, error) {
+	opts := optionsFrom(ctx)
+	job := &Job{
+		User:      opts.Owner.User,
+		ID:        newID(),
+		Status:    StatusQueued,
+		Filename:  filename,
+		CreatedAt: time.Now().UTC(),
+		data:      data,
+		options:   opts,
+	}
+	if m.durable != nil {
+		return m.submitDurable(ctx, job)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.draining {
+		return Job{}, ErrDraining
+	}
+	select {
+	case m.queue <- job:
+	default:
+		return Job{}, ErrQueueFull
+	}
+	m.jobs[job.ID] = job
+	slog.InfoContext(ctx, "Queued job", "job_id", job.ID)
+	return *job, nil
+}
+
+// UseObjects keeps every job from now on in o once it finishes, as
+// jobs/<id>.json, so Get can still find it after a restart
+func (m *Manager) UseObjects(o history.Objects) {
+	m.objects = o
+}
+
+// Get returns a snapshot of the job with the given ID
+func (m *Manager) Get(id string) (Job, bool) {
+	if m.durable != nil {
+		job, ok, err := m.durable.get(context.Background(), id)
+		if err != nil {
+			slog.Error("Error reading job from the queue", "job_id", id, "err", err)
+		}
+		if ok {
+			return job, true
+		}
+		return m.archived(id)
+	}
+	m.mu.RLock()
+	job, ok := m.jobs[id]
+	m.mu.RUnlock()
+	if !ok {
+		return m.archived(id)
+	}
+	return *job, true
+}
+
+// Stats returns a snapshot of job counts
+func (m *Manager) Stats() Stats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := Stats{Draining: m.draining}
+	if m.durable != nil {
+		if err := m.durable.count(context.Background(), &stats); err != nil {
+			slog.Error("Error counting jobs in the queue", "err", err)
+		}
+		return stats
+	}
+	for _, job := range m.jobs {
+		switch job.Status {
+		case StatusQueued:
+			stats.Queued++
+		case StatusRunning:
+			stats.Running++
+		case StatusSucceeded:
+			stats.Succeeded++
+		case StatusFailed:
+			stats.Failed++
+		}
+	}
+	return stats
+}
+
+// Drain stops accepting new jobs and waits until every queued and running job
+// has finished or ctx ends. The manager keeps rejecting submissions until
+// Resume is called, so a drain before shutdown can't be undone by new work.
+func (m *Manager) Drain(ctx context.Context) (Stats, error) {
+	m.mu.Lock()
+	m.draining = true
+	m.mu.Unlock()
+	slog.InfoContext(ctx, "Draining job queue")
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		stats := m.Stats()
+		if stats.Queued+stats.Running == 0 {
+			slog.InfoContext(ctx, "Job queue drained")
+			return stats, nil
+		}
+		select {
+		case <-ctx.Done():
+			return stats, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Resume accepts new jobs again after a drain
+func (m *Manager) Resume() {
+	m.mu.Lock()
+	m.draining = false
+	m.mu.Unlock()
+}
+
+// Abandon stops the jobs running and fails them and every queued job, so
+// clients polling for them learn they won't finish, from object storage after
+// a restart. A durable manager instead returns the jobs running to its
+// queue, to run again after the restart along with those still queued. It's
+// for shutting down once a drain has run out of time, and returns how many
+// jobs were failed or returned.
+func (m *Manager) Abandon(ctx context.Context) int {
+	if m.durable != nil {
+		return m.release(ctx)
+	}
+	m.mu.Lock()
+	m.draining = true
+	m.cancel()
+	now := time.Now().UTC()
+	var abandoned []Job
+	for _, job := range m.jobs {
+		if job.Status != StatusQueued && job.Status != StatusRunning {
+			continue
+		}
+		job.Status = StatusFailed
+		job.Error = abandonedMessage
+		job.CompletedAt = &now
+		job.data = nil
+		abandoned = append(abandoned, *job)
+	}
+	m.mu.Unlock()
+
+	for _, job := range abandoned {
+		slog.WarnContext(ctx, "Abandoned job at shutdown", "job_id", job.ID)
+		m.archive(ctx, job)
+	}
+	return len(abandoned)
+}
+
+// Close stops a durable manager's workers and closes its queue. It's for
+// after Drain or Abandon.
+func (m *Manager) Close() error {
+	m.cancel()
+	if m.durable == nil {
+		return nil
+	}
+	return m.durable.Close()
+}
+
+func (m *Manager) worker() {
+	for job := range m.queue {
+		m.mu.Lock()
+		if job.Status != StatusQueued {
+			// Abandoned while it waited
+			m.mu.Unlock()
+			continue
+		}
+		now := time.Now().UTC()
+		job.Status = StatusRunning
+		job.StartedAt = &now
+		data := job.data
+		m.mu.Unlock()
+
+		ctx := job.options.context(m.ctx)
+		slog.InfoContext(ctx, "Running job", "job_id", job.ID)
+		record, err := m.process(ctx, job.Filename, data)
+
+		m.mu.Lock()
+		if job.Status != StatusRunning {
+			// Abandoned while it ran
+			m.mu.Unlock()
+			continue
+		}
+		done := time.Now().UTC()
+		job.CompletedAt = &done
+		job.data = nil
+		if err != nil {
+			job.Status = StatusFailed
+			job.Error = err.Error()
+			slog.ErrorContext(ctx, "Job failed", "job_id", job.ID, "err", err)
+		} else {
+			job.Status = StatusSucceeded
+			job.Result = &record
+			slog.InfoContext(ctx, "Job succeeded", "job_id", job.ID)
+		}
+		finished := *job
+		m.mu.Unlock()
+		m.archive(ctx, finished)
+	}
+}
+
+// archive keeps a finished job in object storage, if the manager has it
+func (m *Manager) archive(ctx context.Context, job Job) {
+	if m.objects == nil {
+		return
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := m.objects.Put(ctx, "jobs/"+job.ID+".json", "application/json", data); err != nil {
+		slog.ErrorContext(ctx, "Error saving job to object storage", "job_id", job.ID, "err", err)
+	}
+}
+
+// archived returns a finished job from object storage, unless it finished
+// more than the retention period ago
+func (m *Manager) archived(id string) (Job, bool) {
+	if m.objects == nil || id == "" {
+		return Job{}, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	data, ok, err := m.objects.Get(ctx, "jobs/"+id+".json")
+	if err != nil {
+		slog.Error("Error reading job from object storage", "job_id", id, "err", err)
+	}
+	var job Job
+	if !ok || json.Unmarshal(data, &job) != nil || job.CompletedAt == nil {
+		return Job{}, false
+	}
+	if time.Since(*job.CompletedAt) > m.retention {
+		return Job{}, false
+	}
+	return job, true
+}
+
+// sweep removes jobs that finished more than the retention period ago
+func (m *Manager) sweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.sweepBefore(time.Now().Add(-m.retention))
+	}
+}
+
+// sweepBefore removes jobs that finished before cutoff, from object storage
+// too
+func (m *Manager) sweepBefore(cutoff time.Time) {
+	var expired []string
+	if m.durable != nil {
+		var err error
+		if expired, err = m.durable.sweep(context.Background(), cutoff); err != nil {
+			slog.Error("Error removing finished jobs from the queue", "err", err)
+		}
+	} else {
+		m.mu.Lock()
+		for id, job := range m.jobs {
+			if job.CompletedAt != nil && job.CompletedAt.Before(cutoff) {
+				delete(m.jobs, id)
+				expired = append(expired, id)
+			}
+		}
+		m.mu.Unlock()
+	}
+	if m.objects == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, id := range expired {
+		if err := m.objects.Delete(ctx, "jobs/"+id+".json"); err != nil {
+			slog.Error("Error deleting job from object storage", "job_id", id, "err", err)
+		}
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,100 @@
+package jobs
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"alt-text-generator/internal/history"
+)
+
+// memoryObjects is object storage kept in a map
+type memoryObjects struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (o *memoryObjects) Put(ctx context.Context, key, contentType string, data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.objects[key] = data
+	return nil
+}
+
+func (o *memoryObjects) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	data, ok := o.objects[key]
+	return data, ok, nil
+}
+
+func (o *memoryObjects) Delete(ctx context.Context, key string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.objects, key)
+	return nil
+}
+
+// waitObject polls until key is in o, as jobs are archived just after
+// they finish
+func waitObject(t *testing.T, o *memoryObjects, key string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok, _ := o.Get(context.Background(), key); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s wasn't written", key)
+}
+
+func TestSweepDeletesArchivedJobs(t *testing.T) {
+	process := func(ctx context.Context, filename string, data []byte) (history.Record, error) {
+		return history.Record{Filename: filename, AltText: "A dog"}, nil
+	}
+	managers := map[string]func(t *testing.T) *Manager{
+		"memory": func(t *testing.T) *Manager {
+			return NewManager(1, 10, time.Hour, process)
+		},
+		"durable": func(t *testing.T) *Manager {
+			q, err := OpenQueue(filepath.Join(t.TempDir(), "jobs.db"), time.Minute, 3)
+			if err != nil {
+				t.Fatalf("OpenQueue: %v", err)
+			}
+			return NewDurableManager(q, 1, 10, time.Hour, process)
+		},
+	}
+	for name, newManager := range managers {
+		t.Run(name, func(t *testing.T) {
+			objects := &memoryObjects{objects: map[string][]byte{}}
+			m := newManager(t)
+			defer m.Close()
+			m.UseObjects(objects)
+
+			job, err := m.Submit(context.Background(), "dog.png", []byte("image"))
+			if err != nil {
+				t.Fatalf("Submit: %v", err)
+			}
+			waitFinished(t, m, job.ID)
+			key := "jobs/" + job.ID + ".json"
+			waitObject(t, objects, key)
+
+			// A job still within the retention is kept
+			m.sweepBefore(time.Now().Add(-time.Hour))
+			if _, ok, _ := objects.Get(context.Background(), key); !ok {
+				t.Fatal("job deleted from object storage before its retention ended")
+			}
+
+			m.sweepBefore(time.Now().Add(time.Minute))
+			if _, ok, _ := objects.Get(context.Background(), key); ok {
+				t.Error("expired job left in object storage")
+			}
+			if _, ok := m.Get(job.ID); ok {
+				t.Error("expired job still found")
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	// Registers the pure Go "sqlite" driver, so no C toolchain is needed
+	_ "modernc.org/sqlite"
+)
+
+// queueSchema creates the table the durable queue keeps its jobs in. Times
+// are Unix milliseconds. visible_at is when a queued job may next be run, or
+// when a running job's claim lapses.
+const queueSchema = `CREATE TABLE IF NOT EXISTS jobs (
+	id           TEXT PRIMARY KEY,
+	status       TEXT NOT NULL,
+	attempts     INTEGER NOT NULL DEFAULT 0,
+	visible_at   INTEGER NOT NULL,
+	created_at   INTEGER NOT NULL,
+	started_at   INTEGER,
+	completed_at INTEGER,
+	job          TEXT NOT NULL,
+	options      TEXT NOT NULL,
+	data         BLOB
+);
+CREATE INDEX IF NOT EXISTS jobs_ready ON jobs (status, visible_at);
+CREATE INDEX IF NOT EXISTS jobs_completed_at ON jobs (completed_at)`
+
+// Queue keeps jobs in a SQLite database, so those queued or running when
+// the server stops are run once it's back. A worker claims a job for the
+// visibility timeout and renews the claim while the job runs; if the server
+// goes away first, the claim lapses and the job runs again. A failed job is
+// run again after the visibility timeout, up to maxAttempts runs in all.
+type Queue struct {
+	db          *sql.DB
+	visibility  time.Duration
+	maxAttempts int
+}
+
+// OpenQueue opens the SQLite database file at path as a job queue, creating
+// it if needed
+func OpenQueue(path string, visibility time.Duration, maxAttempts int) (*Queue, error) {
+	if visibility <= 0 {
+		return nil, errors.New("job visibility timeout must be positive")
+	}
+	if maxAttempts < 1 {
+		return nil, errors.New("jobs must be allowed at least one attempt")
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(queueSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating job queue in %s: %v", path, err)
+	}
+	return &Queue{db: db, visibility: visibility, maxAttempts: maxAttempts}, nil
+}
+
+// Close closes the database
+func (q *Queue) Close() error {
+	return q.db.Close()
+}
+
+// push adds job to the queue, unless limit jobs are already waiting
+func (q *Queue) push(ctx context.Context, job *Job, limit int) error {
+	snapshot, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	opts, err := json.Marshal(job.options)
+	if err != nil {
+		return err
+	}
+	created := job.CreatedAt.UnixMilli()
+	result, err := q.db.ExecContext(ctx, `INSERT INTO jobs (id, status, visible_at, created_at, job, options, data)
+		SELECT ?, ?, ?, ?, ?, ?, ?
+		WHERE (SELECT COUNT(*) FROM jobs WHERE status = ?) < ?`,
+		job.ID, StatusQueued, created, created, string(snapshot), string(opts), job.data, StatusQueued, limit)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// claim takes the longest-waiting job that's ready to run, or one whose
+// claim has lapsed, marking it running under a claim for the visibility
+// timeout. It returns nil when no job is ready.
+func (q *Queue) claim(ctx context.Context) (*Job, error) {
+	now := time.Now()
+	row := q.db.QueryRowContext(ctx, `UPDATE jobs SET status = ?, attempts = attempts + 1, visible_at = ?, started_at = ?
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE status IN (?, ?) AND visible_at <= ?
+			ORDER BY created_at LIMIT 1
+		)
+		RETURNING attempts, job, options, data`,
+		StatusRunning, now.Add(q.visibility).UnixMilli(), now.UnixMilli(),
+		StatusQueued, StatusRunning, now.UnixMilli())
+	var snapshot, opts string
+	job := &Job{}
+	err := row.Scan(&job.Attempts, &snapshot, &opts, &job.data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	attempts := job.Attempts
+	if err := json.Unmarshal([]byte(snapshot), job); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(opts), &job.options); err != nil {
+		return nil, err
+	}
+	started := now.UTC()
+	job.Status = StatusRunning
+	job.StartedAt = &started
+	job.Attempts = attempts
+	return job, nil
+}
+
+// hold renews the claim on the running job id every third of the
+// visibility timeout until the returned func is called
+func (q *Queue) hold(id string) (release func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(q.visibility / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := q.db.Exec(`UPDATE jobs SET visible_at = ? WHERE id = ? AND status = ?`,
+					time.Now().Add(q.visibility).UnixMilli(), id, StatusRunning)
+				if err != nil {
+					slog.Error("Error renewing claim on job", "job_id", id, "err", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// retry puts the running job id back in the queue, to be run again once
+// the visibility timeout has passed
+func (q *Queue) retry(ctx context.Context, id string) error {
+	_, err := q.db.ExecContext(ctx, `UPDATE jobs SET status = ?, visible_at = ? WHERE id = ? AND status = ?`,
+		StatusQueued, time.Now().Add(q.visibility).UnixMilli(), id, StatusRunning)
+	return err
+}
+
+// release puts the running job id back in the queue to be run straight
+// away, without counting the run it was interrupted in
+func (q *Queue) release(ctx context.Context, id string) error {
+	_, err := q.db.ExecContext(ctx, `UPDATE jobs SET status = ?, visible_at = ?, attempts = attempts - 1 WHERE id = ? AND status = ?`,
+		StatusQueued, time.Now().UnixMilli(), id, StatusRunning)
+	return err
+}
+
+// finish records how job ended and drops its image
+func (q *Queue) finish(ctx context.Context, job Job) error {
+	snapshot, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = q.db.ExecContext(ctx, `UPDATE jobs SET status = ?, completed_at = ?, job = ?, data = NULL WHERE id = ?`,
+		job.Status, job.CompletedAt.UnixMilli(), string(snapshot), job.ID)
+	return err
+}
+
+// get returns the job with the given ID
+func (q *Queue) get(ctx context.Context, id string) (Job, bool, error) {
+	var job Job
+	var status, snapshot string
+	var attempts int
+	var started sql.NullInt64
+	err := q.db.QueryRowContext(ctx, `SELECT status, attempts, started_at, job FROM jobs WHERE id = ?`, id).
+		Scan(&status, &attempts, &started, &snapshot)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, err
+	}
+	if err := json.Unmarshal([]byte(snapshot), &job); err != nil {
+		return Job{}, false, err
+	}
+	job.Status = status
+	job.Attempts = attempts
+	if started.Valid && job.StartedAt == nil {
+		t := time.UnixMilli(started.Int64).UTC()
+		job.StartedAt = &t
+	}
+	return job, true, nil
+}
+
+// count adds up the jobs in the queue by status into stats
+func (q *Queue) count(ctx context.Context, stats *Stats) error {
+	rows, err := q.db.QueryContext(ctx, `SELECT status, COUNT(*) FROM jobs GROUP BY status`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return err
+		}
+		switch status {
+		case StatusQueued:
+			stats.Queued = n
+		case StatusRunning:
+			stats.Running = n
+		case StatusSucceeded:
+			stats.Succeeded = n
+		case StatusFailed:
+			stats.Failed = n
+		}
+	}
+	return rows.Err()
+}
+
+// sweep deletes jobs that finished before cutoff, returning their IDs
+func (q *Queue) sweep(ctx context.Context, cutoff time.Time) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, `DELETE FROM jobs WHERE completed_at < ? RETURNING id`, cutoff.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
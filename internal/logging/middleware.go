@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RequestIDHeader carries the request ID on requests and responses
+const RequestIDHeader = "X-Request-ID"
+
+// accessEntry collects details handlers contribute to the access log line
+type accessEntry struct {
+	mu       sync.Mutex
+	provider string
+}
+
+func (e *accessEntry) setProvider(provider string) {
+	e.mu.Lock()
+	e.provider = provider
+	e.mu.Unlock()
+}
+
+// Middleware assigns each request an ID, echoing a well-formed X-Request-ID
+// from the client (so IDs can be correlated across services) and generating
+// one otherwise, and writes a structured access log line once it completes
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		entry := &accessEntry{}
+		ctx := WithRequestID(r.Context(), id)
+		ctx = context.WithValue(ctx, accessKey, entry)
+		r = r.WithContext(ctx)
+
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		entry.mu.Lock()
+		provider := entry.provider
+		entry.mu.Unlock()
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int64("bytes", rec.bytes),
+			slog.String("remote_addr", r.RemoteAddr),
+		}
+		if provider != "" {
+			attrs = append(attrs, slog.String("provider", provider))
+		}
+		slog.LogAttrs(ctx, slog.LevelInfo, "Request completed", attrs...)
+	})
+}
+
+// validRequestID accepts client IDs of reasonable length made of printable
+// ASCII so they can't inject into logs or headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// responseRecorder captures the status and body size while passing through
+// the optional interfaces streaming and WebSocket handlers rely on
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Application metrics shared across packages
+var (
+	HTTPRequests = NewCounter("alttext_http_requests_total",
+		"HTTP requests handled, by method, route pattern, and status code.",
+		"method", "route", "status")
+	HTTPDuration = NewHistogram("alttext_http_request_duration_seconds",
+		"HTTP request latency, by method and route pattern.",
+		nil, "method", "route")
+	HTTPInFlight = NewGauge("alttext_http_requests_in_flight",
+		"HTTP requests currently being served.")
+
+	ProviderRequests = NewCounter("alttext_provider_requests_total",
+		"Calls to the alt text provider, by provider and outcome (success, error, or cancelled).",
+		"provider", "outcome")
+	ProviderDuration = NewHistogram("alttext_provider_request_duration_seconds",
+		"Provider call latency, by provider.",
+		nil, "provider")
+	ProviderTokens = NewCounter("alttext_provider_tokens_total",
+		"Tokens reported by the provider, by provider and type (input or output).",
+		"provider", "type")
+	RaceWins = NewCounter("alttext_provider_race_wins_total",
+		"Requests raced between providers, by the provider that answered first.",
+		"provider")
+	ProviderConnections = NewCounter("alttext_provider_connections_total",
+		"Connections used for provider requests, by host and whether they were reused from an earlier request.",
+		"host", "reused")
+
+	GenerationsInFlight = NewGauge("alttext_generations_in_flight",
+		"Provider calls holding one of the server's generation workers.")
+	GenerationsQueued = NewGauge("alttext_generations_queued",
+		"Requests waiting for a generation worker.")
+	GenerationsRejected = NewCounter("alttext_generations_rejected_total",
+		"Requests refused a generation worker, by reason (queue_full or timeout).",
+		"reason")
+	Timeouts = NewCounter("alttext_timeouts_total",
+		"Requests that ran out of time, by the stage that did (upload, preprocess, provider, or total).",
+		"stage")
+	Shed = NewCounter("alttext_shed_requests_total",
+		"Requests refused before being read because the server was overloaded, by reason (queue_full or memory).",
+		"reason")
+
+	CacheHits = NewCounter("alttext_cache_hits_total",
+		"Generations served from the result cache.")
+	CacheMisses = NewCounter("alttext_cache_misses_total",
+		"Generations that missed the result cache.")
+	Coalesced = NewCounter("alttext_coalesced_requests_total",
+		"Generations that shared a concurrent request's provider call for the same image.")
+	CacheRefreshes = NewCounter("alttext_cache_refreshes_total",
+		"Generations that skipped the result cache to replace the stored result.")
+	Feedback = NewCounter("alttext_feedback_total",
+		"Feedback given on generations, by rating (up, down, or none) and whether the alt text was edited.",
+		"rating", "edited")
+	Regenerations = NewCounter("alttext_regenerations_total",
+		"Stored generations captioned again, by outcome (regenerated, reused, missing, or failed).",
+		"outcome")
+	CacheTierHits = NewCounter("alttext_cache_tier_hits_total",
+		"Result cache lookups found in the cache in front of history, by tier (memory or redis).",
+		"tier")
+	CacheTierMisses = NewCounter("alttext_cache_tier_misses_total",
+		"Result cache lookups not found in the cache in front of history, by tier (memory or redis).",
+		"tier")
+)
+
+// ObserveProvider records the outcome, latency, and token usage of a provider call
+func ObserveProvider(provider string, start time.Time, inputTokens, outputTokens int, err error) {
+	outcome := "success"
+	if errors.Is(err, context.Canceled) {
+		outcome = "cancelled"
+	} else if err != nil {
+		outcome = "error"
+	}
+	ProviderRequests.Inc(provider, outcome)
+	ProviderDuration.Observe(time.Since(start).Seconds(), provider)
+	if inputTokens > 0 {
+		ProviderTokens.Add(float64(inputTokens), provider, "input")
+	}
+	if outputTokens > 0 {
+		ProviderTokens.Add(float64(outputTokens), provider, "output")
+	}
+}
+
+// Middleware records request counts, latency, and in-flight requests. Routes
+// are labelled with the mux pattern that matched rather than the raw path so
+// IDs in URLs don't create unbounded series.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HTTPInFlight.Inc()
+		defer HTTPInFlight.Dec()
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		HTTPRequests.Inc(r.Method, route, strconv.Itoa(rec.status))
+		HTTPDuration.Observe(time.Since(start).Seconds(), r.Method, route)
+	})
+}
+
+// statusRecorder captures the response status while passing through the
+// optional interfaces streaming and WebSocket handlers rely on
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
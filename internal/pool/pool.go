@@ -0,0 +1,149 @@
+// Package pool bounds how many provider calls the server makes at once.
+// Requests beyond the bound wait in a queue of limited length for a turn and
+// are refused once it's full or they've waited too long, so a burst of
+// traffic is pushed back to clients instead of piling up provider calls.
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"alt-text-generator/internal/metrics"
+)
+
+// ErrBusy is returned when a request can't be given a worker
+var ErrBusy = errors.New("server is busy")
+
+// RetryAfter is how long refused callers are told to wait before trying again
+const RetryAfter = 5 * time.Second
+
+// Pool hands out a fixed number of workers, queueing requests for one
+type Pool struct {
+	slots     chan struct{}
+	queueSize int
+	wait      time.Duration
+
+	mu     sync.Mutex
+	queued int
+}
+
+// Stats reports how busy the pool is
+type Stats struct {
+	Workers   int `json:"workers"`
+	Busy      int `json:"busy"`
+	Queued    int `json:"queued"`
+	QueueSize int `json:"queue_size"`
+}
+
+// New returns a pool of workers. Up to queueSize requests wait for one, each
+// for at most wait, or for as long as its context allows when wait is 0.
+func New(workers, queueSize int, wait time.Duration) *Pool {
+	return &Pool{slots: make(chan struct{}, max(workers, 1)), queueSize: queueSize, wait: wait}
+}
+
+// Acquire waits for a worker and returns the function that gives it back.
+// It fails with ErrBusy when the queue is full or the wait runs out, and with
+// ctx's error if ctx is done first.
+func (p *Pool) Acquire(ctx context.Context) (func(), error) {
+	select {
+	case p.slots <- struct{}{}:
+		return p.started(), nil
+	default:
+	}
+
+	if !p.enqueue() {
+		metrics.GenerationsRejected.Inc("queue_full")
+		return nil, fmt.Errorf("%w: %d requests are already waiting", ErrBusy, p.queueSize)
+	}
+	defer p.dequeue()
+
+	var timeout <-chan time.Time
+	if p.wait > 0 {
+		timer := time.NewTimer(p.wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return p.started(), nil
+	case <-timeout:
+		metrics.GenerationsRejected.Inc("timeout")
+		return nil, fmt.Errorf("%w: no worker was free within %s", ErrBusy, p.wait)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// started counts a worker taken and returns the function that gives it back
+func (p *Pool) started() func() {
+	metrics.GenerationsInFlight.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			metrics.GenerationsInFlight.Dec()
+			<-p.slots
+		})
+	}
+}
+
+// enqueue takes a place in the queue, if there is one
+func (p *Pool) enqueue() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queued >= p.queueSize {
+		return false
+	}
+	p.queued++
+	metrics.GenerationsQueued.Inc()
+	return true
+}
+
+func (p *Pool) dequeue() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queued--
+	metrics.GenerationsQueued.Dec()
+}
+
+// Full reports whether every worker is busy and the queue has no room, so a
+// request arriving now would be refused
+func (p *Pool) Full() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.slots) == cap(p.slots) && p.queued >= p.queueSize
+}
+
+// Stats reports the workers busy and the requests waiting for one
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Stats{Workers: cap(p.slots), Busy: len(p.slots), Queued: p.queued, QueueSize: p.queueSize}
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx through which Acquire reaches p
+func NewContext(ctx context.Context, p *Pool) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// Middleware makes the pool available to handlers further down the chain
+func (p *Pool) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+	})
+}
+
+// Acquire waits for a worker from the pool in ctx. Without one, calls aren't
+// bounded and it returns at once.
+func Acquire(ctx context.Context) (func(), error) {
+	p, _ := ctx.Value(contextKey{}).(*Pool)
+	if p == nil {
+		return func() {}, nil
+	}
+	return p.Acquire(ctx)
+}
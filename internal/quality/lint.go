@@ -0,0 +1,160 @@
+package quality
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rule is a piece of common alt text guidance, such as WCAG's advice not to
+// announce that an image is an image
+type Rule struct {
+	Name        string
+	Description string
+	// check returns a description of how alt breaks the rule, or "" if it
+	// doesn't
+	check func(alt string, in LintInput) string
+}
+
+// LintInput is what rules know besides the alt text itself
+type LintInput struct {
+	// Nearby is text shown near the image, such as its caption, which alt
+	// text shouldn't repeat
+	Nearby []string
+	// MaxLength is the longest alt text allowed, or 0 for no limit
+	MaxLength int
+}
+
+// Rules lists every lint rule
+var Rules = []Rule{
+	{Name: "empty", Description: "is empty", check: func(alt string, _ LintInput) string {
+		if alt == "" {
+			return "alt text is empty"
+		}
+		return ""
+	}},
+	{Name: "redundant-prefix", Description: `starts with "image of" or similar, which screen readers already announce`, check: func(alt string, _ LintInput) string {
+		if prefix := redundantPrefix.FindString(alt); prefix != "" {
+			return fmt.Sprintf("starts with %q", prefix)
+		}
+		return ""
+	}},
+	{Name: "placeholder", Description: `is a placeholder such as "image" or "untitled"`, check: func(alt string, _ LintInput) string {
+		if placeholder.MatchString(strings.Trim(alt, ".")) {
+			return fmt.Sprintf("%q is a placeholder", alt)
+		}
+		return ""
+	}},
+	{Name: "file-name", Description: "contains a file name", check: func(alt string, _ LintInput) string {
+		if name := fileName.FindString(alt); name != "" {
+			return fmt.Sprintf("contains file name %q", name)
+		}
+		return ""
+	}},
+	{Name: "too-long", Description: "is longer than the length limit", check: func(alt string, in LintInput) string {
+		if length := len([]rune(alt)); in.MaxLength > 0 && length > in.MaxLength {
+			return fmt.Sprintf("%d characters, over the limit of %d", length, in.MaxLength)
+		}
+		return ""
+	}},
+	{Name: "all-caps", Description: "is written in capitals, which some screen readers spell out", check: func(alt string, _ LintInput) string {
+		if alt == strings.ToUpper(alt) && strings.ToLower(alt) != alt && len(strings.Fields(alt)) > 1 {
+			return "written in capitals"
+		}
+		return ""
+	}},
+	{Name: "end-punctuation", Description: "is a sentence without closing punctuation, so screen readers run on into what follows", check: func(alt string, _ LintInput) string {
+		first, _ := utf8.DecodeRuneInString(alt)
+		last, _ := utf8.DecodeLastRuneInString(strings.TrimRight(alt, `"')”’`))
+		if len(strings.Fields(alt)) >= 3 && unicode.IsUpper(first) && !strings.ContainsRune(".!?", last) {
+			return "sentence has no closing punctuation"
+		}
+		return ""
+	}},
+	{Name: "caption-repeat", Description: "repeats the caption or text beside the image", check: func(alt string, in LintInput) string {
+		text := normalizeText(alt)
+		if len(text) < 10 {
+			return ""
+		}
+		for _, nearby := range in.Nearby {
+			if nearby = normalizeText(nearby); nearby != "" && (strings.Contains(nearby, text) || strings.Contains(text, nearby)) {
+				return "repeats the text beside the image"
+			}
+		}
+		return ""
+	}},
+	{Name: "repeated-words", Description: "repeats a keyword, as if stuffed for search", check: func(alt string, _ LintInput) string {
+		if word := stuffedWord(strings.Fields(alt)); word != "" {
+			return fmt.Sprintf("repeats %q", word)
+		}
+		return ""
+	}},
+}
+
+// RuleNames lists the lint rules
+func RuleNames() []string {
+	names := make([]string, len(Rules))
+	for i, r := range Rules {
+		names[i] = r.Name
+	}
+	return names
+}
+
+// CheckRules returns an error naming the choices if any of names isn't a
+// lint rule
+func CheckRules(names []string) error {
+	for _, name := range names {
+		if !slices.Contains(RuleNames(), name) {
+			return fmt.Errorf("unknown lint rule %q (expected %s)", name, strings.Join(RuleNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// Lint checks alt against every rule not named in disabled, returning a
+// "rule: problem" line for each it breaks, or nil if it breaks none
+func Lint(alt string, in LintInput, disabled []string) []string {
+	alt = strings.TrimSpace(alt)
+	var problems []string
+	for _, r := range Rules {
+		if slices.Contains(disabled, r.Name) {
+			continue
+		}
+		if problem := r.check(alt, in); problem != "" {
+			problems = append(problems, r.Name+": "+problem)
+		}
+		if alt == "" {
+			// The other rules have nothing to say about empty text
+			break
+		}
+	}
+	return problems
+}
+
+// stuffedWord returns a word making up much of a longer text, or ""
+func stuffedWord(words []string) string {
+	counts := map[string]int{}
+	for _, word := range words {
+		word = strings.ToLower(strings.TrimFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsNumber(r) }))
+		if len(word) > 3 {
+			counts[word]++
+		}
+	}
+	for word, n := range counts {
+		if n >= 3 && n*5 >= len(words) {
+			return word
+		}
+	}
+	return ""
+}
+
+var nonWord = regexp.MustCompile(`[^\pL\pN]+`)
+
+// normalizeText lowercases text and collapses punctuation and spacing, so
+// texts can be compared for repetition
+func normalizeText(text string) string {
+	return strings.TrimSpace(nonWord.ReplaceAllString(strings.ToLower(text), " "))
+}
@@ -0,0 +1,186 @@
+package quality
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Fix is a correction made to alt text whatever the model wrote, such as
+// removing an "Image of" a screen reader would announce anyway
+type Fix struct {
+	Name        string
+	Description string
+	apply       func(alt string, opts NormalizeOptions) string
+}
+
+// NormalizeOptions configures Normalize
+type NormalizeOptions struct {
+	// Disabled names fixes not to make
+	Disabled []string
+	// Verbalize puts emoji and hashtags into words, as in "red heart" or
+	// "hashtag summer sale", instead of removing the emoji and the #
+	Verbalize bool
+}
+
+var (
+	// leadingPhrase matches an opening that announces the image as an image
+	leadingPhrase = regexp.MustCompile(`(?i)^(((an?|the|this) )?(image|photo|photograph|picture|graphic|illustration) (of|showing|depicting|shows|depicts)|(image|photo|picture):)[\s,:]*`)
+	// spaceRun matches spacing to collapse to one space
+	spaceRun = regexp.MustCompile(`[ \t\p{Zs}]{2,}`)
+	// spaceBeforePunct matches spacing before punctuation that follows a word
+	spaceBeforePunct = regexp.MustCompile(`[ \t\p{Zs}]+([,.;:!?])`)
+	// hashtag matches a hashtag starting a word; group 2 is the tag
+	hashtag = regexp.MustCompile(`(^|\s)#(\pL[\pL\pN_]*)`)
+	// wordBreak matches where a camel-cased tag such as SummerSale2024 joins
+	// two words
+	wordBreak = regexp.MustCompile(`(\p{Ll})(\p{Lu})|(\pL)(\pN)|(\pN)(\pL)`)
+)
+
+// emojiNames are the spoken names of common emoji, used when verbalizing;
+// other emoji are removed
+var emojiNames = map[string]string{
+	"😀": "grinning face", "😂": "face with tears of joy", "😊": "smiling face", "😍": "smiling face with heart eyes",
+	"😢": "crying face", "😮": "surprised face", "😎": "smiling face with sunglasses", "🙂": "slightly smiling face",
+	"❤": "red heart", "💔": "broken heart", "👍": "thumbs up", "👎": "thumbs down", "👏": "clapping hands",
+	"🙏": "folded hands", "👋": "waving hand", "💪": "flexed biceps", "🔥": "fire", "⭐": "star", "✨": "sparkles",
+	"🎉": "party popper", "🎂": "birthday cake", "🎁": "wrapped gift", "☀": "sun", "🌧": "cloud with rain",
+	"❄": "snowflake", "🌈": "rainbow", "🌊": "water wave", "🌲": "evergreen tree", "🌸": "cherry blossom",
+	"🐶": "dog face", "🐱": "cat face", "✅": "check mark", "✔": "check mark", "❌": "cross mark", "⚠": "warning",
+	"📷": "camera", "📍": "round pushpin", "🏆": "trophy", "💯": "hundred points", "🚀": "rocket",
+}
+
+// straightQuotes replaces typographic quotes and primes with plain ones
+var straightQuotes = strings.NewReplacer(
+	"“", `"`, "”", `"`, "„", `"`, "‟", `"`, "″", `"`,
+	"‘", "'", "’", "'", "‚", "'", "‛", "'", "′", "'",
+)
+
+// Fixes lists every normalizer fix, in the order they are made
+var Fixes = []Fix{
+	{Name: "emoji", Description: "removes emoji and decorative symbols such as ★ and •, which screen readers read out by name, or puts common emoji into words", apply: func(alt string, opts NormalizeOptions) string {
+		return strings.TrimSpace(replaceSymbols(alt, opts.Verbalize))
+	}},
+	{Name: "hashtags", Description: `turns hashtags such as #SummerSale into words, "Summer Sale", or "hashtag Summer Sale" when verbalizing`, apply: func(alt string, opts NormalizeOptions) string {
+		return hashtag.ReplaceAllStringFunc(alt, func(match string) string {
+			m := hashtag.FindStringSubmatch(match)
+			words := strings.ReplaceAll(wordBreak.ReplaceAllString(m[2], "$1$3$5 $2$4$6"), "_", " ")
+			if opts.Verbalize {
+				words = "hashtag " + words
+			}
+			return m[1] + words
+		})
+	}},
+	{Name: "redundant-prefix", Description: `removes an opening "An image of", "A picture showing", or similar, which screen readers already announce`, apply: func(alt string, _ NormalizeOptions) string {
+		if rest := leadingPhrase.ReplaceAllString(alt, ""); strings.TrimSpace(rest) != "" {
+			return rest
+		}
+		return alt
+	}},
+	{Name: "spacing", Description: "collapses repeated spaces and removes spaces before punctuation", apply: func(alt string, _ NormalizeOptions) string {
+		alt = spaceRun.ReplaceAllString(alt, " ")
+		return strings.TrimSpace(spaceBeforePunct.ReplaceAllString(alt, "$1"))
+	}},
+	{Name: "quotes", Description: "replaces curly quotes with straight ones, which every screen reader reads the same way", apply: func(alt string, _ NormalizeOptions) string {
+		return straightQuotes.Replace(alt)
+	}},
+	{Name: "sentence-case", Description: "starts the alt text with a capital, and lowercases text written in capitals, which some screen readers spell out", apply: func(alt string, _ NormalizeOptions) string {
+		if alt == strings.ToUpper(alt) && len(strings.Fields(alt)) > 1 {
+			alt = strings.ToLower(alt)
+		}
+		r, size := utf8.DecodeRuneInString(alt)
+		// A name styled with a lower-case start, such as iPhone, stays as it is
+		if first := strings.Fields(alt)[0]; strings.IndexFunc(first[size:], unicode.IsUpper) >= 0 {
+			return alt
+		}
+		return string(unicode.ToUpper(r)) + alt[size:]
+	}},
+}
+
+// FixNames lists the normalizer fixes
+func FixNames() []string {
+	names := make([]string, len(Fixes))
+	for i, f := range Fixes {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// CheckFixes returns an error naming the choices if any of names isn't a
+// normalizer fix
+func CheckFixes(names []string) error {
+	for _, name := range names {
+		if !slices.Contains(FixNames(), name) {
+			return fmt.Errorf("unknown normalizer fix %q (expected %s)", name, strings.Join(FixNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// Normalize makes every fix not disabled in opts to alt
+func Normalize(alt string, opts NormalizeOptions) string {
+	for _, f := range Fixes {
+		if alt = strings.TrimSpace(alt); alt == "" {
+			break
+		}
+		if !slices.Contains(opts.Disabled, f.Name) {
+			alt = f.apply(alt, opts)
+		}
+	}
+	return alt
+}
+
+// replaceSymbols removes each emoji or decorative symbol in alt, with the
+// modifiers and joiners that make it up, or with verbalize, replaces a
+// common emoji with its name
+func replaceSymbols(alt string, verbalize bool) string {
+	var b strings.Builder
+	var symbol strings.Builder
+	flush := func() {
+		if symbol.Len() == 0 {
+			return
+		}
+		if name, ok := emojiNames[symbol.String()]; ok && verbalize {
+			b.WriteString(" " + name + " ")
+		} else {
+			b.WriteByte(' ')
+		}
+		symbol.Reset()
+	}
+	for _, r := range alt {
+		switch {
+		case isDecorative(r):
+			if symbol.Len() > 0 && !strings.HasSuffix(symbol.String(), "\u200d") {
+				// Two symbols in a row, not joined into one
+				flush()
+			}
+			symbol.WriteRune(r)
+		case isEmojiModifier(r):
+			// Variation selectors, skin tones, and keycaps aren't part of
+			// the name, and a joiner only matters within a symbol
+			if r == '\u200d' && symbol.Len() > 0 {
+				symbol.WriteRune(r)
+			}
+		default:
+			flush()
+			b.WriteRune(r)
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// isDecorative reports whether r is an emoji or a decorative symbol, such as
+// an arrow, dingbat, or geometric shape, rather than one that carries
+// meaning in text such as ° or ©
+func isDecorative(r rune) bool {
+	return r == '•' || r >= 0x2190 && unicode.Is(unicode.So, r)
+}
+
+// isEmojiModifier reports whether r modifies or joins the emoji before it
+func isEmojiModifier(r rune) bool {
+	return r == '\u200d' || r == '\ufe0f' || r == '\ufe0e' || r == '\u20e3' || r >= 0x1f3fb && r <= 0x1f3ff || r >= 0xe0020 && r <= 0xe007f
+}
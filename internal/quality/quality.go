@@ -0,0 +1,123 @@
+// Package quality judges generated alt text against configurable standards,
+// so output below them can be held back instead of published.
+package quality
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Thresholds are the standards alt text must meet. Zero values are not
+// enforced.
+type Thresholds struct {
+	MinLength int // characters
+	MaxLength int // characters
+	// Banned phrases are matched case-insensitively anywhere in the text
+	Banned   []string
+	MinScore int // 0-100, as computed by Score or a grader
+	// Lint fails alt text that breaks an enabled lint rule
+	Lint bool
+}
+
+// Enabled reports whether any threshold is set
+func (t Thresholds) Enabled() bool {
+	return t.MinLength > 0 || t.MaxLength > 0 || len(t.Banned) > 0 || t.MinScore > 0 || t.Lint
+}
+
+// Check returns a description of each threshold alt fails, or nil if it
+// meets them all. score is alt's quality score, and lint the lint rules it
+// breaks.
+func (t Thresholds) Check(alt string, score int, lint []string) []string {
+	var violations []string
+	length := len([]rune(strings.TrimSpace(alt)))
+	if t.MinLength > 0 && length < t.MinLength {
+		violations = append(violations, fmt.Sprintf("%d characters, under the minimum of %d", length, t.MinLength))
+	}
+	if t.MaxLength > 0 && length > t.MaxLength {
+		violations = append(violations, fmt.Sprintf("%d characters, over the maximum of %d", length, t.MaxLength))
+	}
+	lower := strings.ToLower(alt)
+	for _, phrase := range t.Banned {
+		if phrase != "" && strings.Contains(lower, strings.ToLower(phrase)) {
+			violations = append(violations, fmt.Sprintf("contains banned phrase %q", phrase))
+		}
+	}
+	if t.MinScore > 0 && score < t.MinScore {
+		violations = append(violations, fmt.Sprintf("quality score %d, under the minimum of %d", score, t.MinScore))
+	}
+	if t.Lint {
+		violations = append(violations, lint...)
+	}
+	return violations
+}
+
+var (
+	redundantPrefix = regexp.MustCompile(`(?i)^(an? )?(image|photo|photograph|picture|graphic|illustration) (of|showing)\b`)
+	fileName        = regexp.MustCompile(`(?i)\.(jpe?g|png|gif|webp|svg)\b|\b(IMG|DSC|DSCN|PXL)[_-]?\d+`)
+	placeholder     = regexp.MustCompile(`(?i)^(image|photo|picture|graphic|img|alt|alt text|untitled|placeholder|banner|logo|icon|spacer)\d*$`)
+	redundantPhrase = regexp.MustCompile(`(?i)\b(in|of) (this|the) (image|photo|photograph|picture)\b|\b(this|the) (image|photo|photograph|picture) (shows|depicts|contains)\b|\balt(ernative)? text\b`)
+	vague           = regexp.MustCompile(`(?i)\b(something|stuff|things?|various|some kind of|some sort of)\b`)
+)
+
+// Score rates alt text from 0 to 100 using heuristics drawn from common
+// guidance: text that is empty, a placeholder, a file name, very short or
+// long, redundant about being an image, vague, or stuffed with repeated
+// words scores lower
+func Score(alt string) int {
+	alt = strings.TrimSpace(alt)
+	if alt == "" {
+		return 0
+	}
+	score := 100
+	if placeholder.MatchString(strings.Trim(alt, ".")) {
+		score -= 60
+	}
+	if fileName.MatchString(alt) {
+		score -= 40
+	}
+	if redundantPrefix.MatchString(alt) {
+		score -= 20
+	} else if redundantPhrase.MatchString(alt) {
+		score -= 10
+	}
+	if vague.MatchString(alt) {
+		score -= 15
+	}
+
+	length := len([]rune(alt))
+	words := strings.Fields(alt)
+	switch {
+	case len(words) < 3:
+		score -= 35
+	case length < 20:
+		score -= 15
+	}
+	if length > 150 {
+		score -= 15
+	}
+
+	// Keyword stuffing: one word making up much of a longer text
+	if stuffedWord(words) != "" {
+		score -= 30
+	}
+
+	if alt == strings.ToUpper(alt) && strings.ToLower(alt) != alt {
+		score -= 10
+	}
+	return max(score, 0)
+}
+
+// hedge matches wording that shows the writer was unsure what the image shows
+var hedge = regexp.MustCompile(`(?i)\b(appears? to|seems? to|seemingly|possibly|probably|perhaps|maybe|might|may be|likely|unclear|uncertain|(hard|difficult) to (tell|see|make out)|what (looks|appears) like|some kind of|some sort of|illegible|indistinct)\b`)
+
+// Confidence estimates from 0 to 100 how sure the writer of alt was of what
+// the image shows, from its hedging: each phrase such as "appears to" or
+// "possibly" lowers it
+func Confidence(alt string) int {
+	alt = strings.TrimSpace(alt)
+	if alt == "" {
+		return 0
+	}
+	return max(100-20*len(hedge.FindAllString(alt, -1)), 0)
+}
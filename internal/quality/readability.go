@@ -0,0 +1,56 @@
+package quality
+
+import (
+	"strings"
+	"unicode"
+)
+
+// GradeLevel returns the Flesch-Kincaid grade level of English text: roughly
+// the US school grade a reader needs to follow it. Each line counts as at
+// least one sentence, so a list of alt text options is judged as a whole.
+// Text without words is grade 0.
+func GradeLevel(text string) float64 {
+	words, syllables, sentences := 0, 0, 0
+	for _, line := range strings.Split(text, "\n") {
+		inSentence := false
+		for _, word := range strings.Fields(line) {
+			letters := strings.TrimFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsNumber(r) })
+			if letters == "" {
+				continue
+			}
+			words++
+			syllables += countSyllables(letters)
+			inSentence = true
+			if strings.ContainsAny(word[len(word)-1:], ".!?") {
+				sentences++
+				inSentence = false
+			}
+		}
+		if inSentence {
+			sentences++
+		}
+	}
+	if words == 0 {
+		return 0
+	}
+	grade := 0.39*float64(words)/float64(sentences) + 11.8*float64(syllables)/float64(words) - 15.59
+	return max(grade, 0)
+}
+
+// countSyllables estimates the syllables in a word from its groups of
+// vowels, not counting a silent final e
+func countSyllables(word string) int {
+	word = strings.ToLower(word)
+	count, inVowels := 0, false
+	for _, r := range word {
+		vowel := strings.ContainsRune("aeiouy", r)
+		if vowel && !inVowels {
+			count++
+		}
+		inVowels = vowel
+	}
+	if strings.HasSuffix(word, "e") && !strings.HasSuffix(word, "le") && count > 1 {
+		count--
+	}
+	return max(count, 1)
+}
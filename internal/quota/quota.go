@@ -0,0 +1,253 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"alt-text-generator/internal/auth"
+)
+
+// ErrExceeded is returned when a caller has used up a daily allowance
+var ErrExceeded = errors.New("daily quota exceeded")
+
+// Limits caps a caller's usage per UTC day. Zero means unlimited.
+type Limits struct {
+	RequestsPerDay int `json:"requests_per_day"`
+	TokensPerDay   int `json:"tokens_per_day"`
+}
+
+// ParseLimits parses per-caller overrides of the form
+// "team-a=1000/2000000,team-b=50/0", where each value is requests/tokens
+func ParseLimits(s string) (map[string]Limits, error) {
+	limits := map[string]Limits{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		requests, tokens, ok2 := strings.Cut(value, "/")
+		if !ok || !ok2 || name == "" {
+			return nil, fmt.Errorf("quota %q must look like name=requests/tokens", entry)
+		}
+		var l Limits
+		var err error
+		if l.RequestsPerDay, err = strconv.Atoi(requests); err != nil || l.RequestsPerDay < 0 {
+			return nil, fmt.Errorf("quota %q has an invalid request limit", entry)
+		}
+		if l.TokensPerDay, err = strconv.Atoi(tokens); err != nil || l.TokensPerDay < 0 {
+			return nil, fmt.Errorf("quota %q has an invalid token limit", entry)
+		}
+		limits[name] = l
+	}
+	return limits, nil
+}
+
+// Meter is usage of one resource against its limit
+type Meter struct {
+	Used      int  `json:"used"`
+	Limit     int  `json:"limit,omitempty"`
+	Remaining *int `json:"remaining,omitempty"`
+}
+
+// Usage is a caller's consumption for the current UTC day
+type Usage struct {
+	Key      string    `json:"key"`
+	Day      string    `json:"day"`
+	Requests Meter     `json:"requests"`
+	Tokens   Meter     `json:"tokens"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+type counter struct {
+	day      string
+	requests int
+	tokens   int
+}
+
+// Tracker counts provider requests and tokens per authenticated caller and
+// enforces daily limits. Counts are kept in memory and reset at midnight UTC.
+type Tracker struct {
+	defaults  Limits
+	overrides map[string]Limits
+
+	mu       sync.Mutex
+	counters map[string]*counter
+}
+
+// New returns a tracker applying defaults to every caller except those named
+// in overrides
+func New(defaults Limits, overrides map[string]Limits) *Tracker {
+	return &Tracker{defaults: defaults, overrides: overrides, counters: map[string]*counter{}}
+}
+
+// Limits returns the limits that apply to key
+func (t *Tracker) Limits(key string) Limits {
+	if l, ok := t.overrides[key]; ok {
+		return l
+	}
+	return t.defaults
+}
+
+// counter returns key's counter for today; t.mu must be held
+func (t *Tracker) counter(key string, now time.Time) *counter {
+	day := now.UTC().Format(time.DateOnly)
+	c, ok := t.counters[key]
+	if !ok || c.day != day {
+		c = &counter{day: day}
+		t.counters[key] = c
+	}
+	return c
+}
+
+// exceeded reports which limit, if any, c has reached; t.mu must be held
+func (t *Tracker) exceeded(key string, c *counter) error {
+	limits := t.Limits(key)
+	if limits.RequestsPerDay > 0 && c.requests >= limits.RequestsPerDay {
+		return fmt.Errorf("%w: %d requests per day", ErrExceeded, limits.RequestsPerDay)
+	}
+	if limits.TokensPerDay > 0 && c.tokens >= limits.TokensPerDay {
+		return fmt.Errorf("%w: %d tokens per day", ErrExceeded, limits.TokensPerDay)
+	}
+	return nil
+}
+
+// Check returns an error wrapping ErrExceeded if key has used up either limit
+func (t *Tracker) Check(key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.exceeded(key, t.counter(key, time.Now()))
+}
+
+// Reserve counts a request against key, failing if either limit is used up.
+// Tokens are only known afterwards, so a request may take a caller past its
+// token limit; the following one is refused.
+func (t *Tracker) Reserve(key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.counter(key, time.Now())
+	if err := t.exceeded(key, c); err != nil {
+		return err
+	}
+	c.requests++
+	return nil
+}
+
+// Record adds the tokens a reserved request used. A failed request is
+// refunded rather than counted.
+func (t *Tracker) Record(key string, tokens int, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.counter(key, time.Now())
+	if failed {
+		if c.requests > 0 {
+			c.requests--
+		}
+		return
+	}
+	c.tokens += tokens
+}
+
+// Usage reports key's usage for today
+func (t *Tracker) Usage(key string) Usage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	return t.usage(key, t.counter(key, now), now)
+}
+
+// All reports today's usage for every caller seen today, sorted by key
+func (t *Tracker) All() []Usage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	usages := []Usage{}
+	for key := range t.counters {
+		if c := t.counter(key, now); c.requests > 0 || c.tokens > 0 {
+			usages = append(usages, t.usage(key, c, now))
+		}
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].Key < usages[j].Key })
+	return usages
+}
+
+func (t *Tracker) usage(key string, c *counter, now time.Time) Usage {
+	limits := t.Limits(key)
+	return Usage{
+		Key:      key,
+		Day:      c.day,
+		Requests: meter(c.requests, limits.RequestsPerDay),
+		Tokens:   meter(c.tokens, limits.TokensPerDay),
+		ResetsAt: ResetsAt(now),
+	}
+}
+
+func meter(used, limit int) Meter {
+	m := Meter{Used: used, Limit: limit}
+	if limit > 0 {
+		remaining := max(limit-used, 0)
+		m.Remaining = &remaining
+	}
+	return m
+}
+
+// ResetsAt returns when the current day's usage is cleared
+func ResetsAt(now time.Time) time.Time {
+	year, month, day := now.UTC().Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx through which Reserve and Record reach t
+func NewContext(ctx context.Context, t *Tracker) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// Middleware makes the tracker available to handlers further down the chain
+func (t *Tracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), t)))
+	})
+}
+
+// caller returns the tracker and quota key for ctx. Only authenticated
+// callers have quotas.
+func caller(ctx context.Context) (*Tracker, string, bool) {
+	t, _ := ctx.Value(contextKey{}).(*Tracker)
+	id, ok := auth.IdentityFromContext(ctx)
+	if t == nil || !ok {
+		return nil, "", false
+	}
+	return t, id.User, true
+}
+
+// Check fails with ErrExceeded if the caller in ctx has no quota left
+func Check(ctx context.Context) error {
+	if t, key, ok := caller(ctx); ok {
+		return t.Check(key)
+	}
+	return nil
+}
+
+// Reserve counts a provider request against the caller in ctx
+func Reserve(ctx context.Context) error {
+	if t, key, ok := caller(ctx); ok {
+		return t.Reserve(key)
+	}
+	return nil
+}
+
+// Record settles a request reserved with Reserve
+func Record(ctx context.Context, tokens int, err error) {
+	if t, key, ok := caller(ctx); ok {
+		t.Record(key, tokens, err != nil)
+	}
+}
@@ -0,0 +1,181 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"alt-text-generator/internal/auth"
+)
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits(" team-a=1000/2000000, team-b=50/0,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Limits{"team-a": {1000, 2000000}, "team-b": {50, 0}}
+	if !reflect.DeepEqual(limits, want) {
+		t.Errorf("ParseLimits = %v, want %v", limits, want)
+	}
+	for _, s := range []string{"team-a", "team-a=10", "=10/10", "team-a=x/10", "team-a=10/-1"} {
+		if _, err := ParseLimits(s); err == nil {
+			t.Errorf("ParseLimits(%q) succeeded", s)
+		}
+	}
+}
+
+func TestReserveAndRecord(t *testing.T) {
+	tracker := New(Limits{RequestsPerDay: 2, TokensPerDay: 100}, map[string]Limits{"big": {}})
+
+	if err := tracker.Reserve("team"); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Record("team", 40, false)
+	// A failed request is refunded, so it doesn't use up the allowance
+	if err := tracker.Reserve("team"); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Record("team", 0, true)
+	if usage := tracker.Usage("team"); usage.Requests.Used != 1 || usage.Tokens.Used != 40 {
+		t.Errorf("usage after refund = %d requests, %d tokens, want 1, 40", usage.Requests.Used, usage.Tokens.Used)
+	}
+
+	if err := tracker.Reserve("team"); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Record("team", 10, false)
+	err := tracker.Reserve("team")
+	if !errors.Is(err, ErrExceeded) || err.Error() != "daily quota exceeded: 2 requests per day" {
+		t.Errorf("Reserve past the request limit = %v", err)
+	}
+	if err := tracker.Check("team"); !errors.Is(err, ErrExceeded) {
+		t.Errorf("Check past the request limit = %v", err)
+	}
+	usage := tracker.Usage("team")
+	if usage.Requests.Used != 2 || *usage.Requests.Remaining != 0 || *usage.Tokens.Remaining != 50 {
+		t.Errorf("usage = %+v", usage)
+	}
+
+	// Overrides replace the defaults; zero is unlimited
+	for range 5 {
+		if err := tracker.Reserve("big"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if usage := tracker.Usage("big"); usage.Requests.Remaining != nil || usage.Requests.Limit != 0 {
+		t.Errorf("unlimited usage = %+v", usage.Requests)
+	}
+	all := tracker.All()
+	if len(all) != 2 || all[0].Key != "big" || all[1].Key != "team" {
+		t.Errorf("All = %+v", all)
+	}
+}
+
+func TestTokenLimit(t *testing.T) {
+	tracker := New(Limits{TokensPerDay: 100}, nil)
+	// Tokens are known only afterwards, so one request may overshoot
+	if err := tracker.Reserve("team"); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Record("team", 150, false)
+	err := tracker.Reserve("team")
+	if !errors.Is(err, ErrExceeded) || err.Error() != "daily quota exceeded: 100 tokens per day" {
+		t.Errorf("Reserve past the token limit = %v", err)
+	}
+	if remaining := *tracker.Usage("team").Tokens.Remaining; remaining != 0 {
+		t.Errorf("remaining tokens = %d, want 0", remaining)
+	}
+}
+
+func TestDayRollover(t *testing.T) {
+	tracker := New(Limits{RequestsPerDay: 1}, nil)
+	// 23:30 in New York on the 1st is already the 2nd in UTC
+	newYork := time.FixedZone("EST", -5*60*60)
+	late := time.Date(2026, 3, 1, 23, 30, 0, 0, newYork)
+
+	c := tracker.counter("team", late)
+	if c.day != "2026-03-02" {
+		t.Errorf("day = %s, want the UTC date 2026-03-02", c.day)
+	}
+	c.requests = 1
+	if tracker.counter("team", late.Add(time.Hour)) != c {
+		t.Error("counter reset before midnight UTC")
+	}
+	if err := tracker.exceeded("team", c); !errors.Is(err, ErrExceeded) {
+		t.Errorf("exceeded = %v", err)
+	}
+
+	next := tracker.counter("team", time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC))
+	if next.day != "2026-03-03" || next.requests != 0 {
+		t.Errorf("counter after midnight UTC = %+v, want a fresh one", next)
+	}
+
+	// A caller last seen yesterday starts today with nothing used
+	tracker.counters["team"] = &counter{day: "2000-01-01", requests: 1, tokens: 5}
+	if err := tracker.Reserve("team"); err != nil {
+		t.Errorf("Reserve on a new day = %v", err)
+	}
+	if all := tracker.All(); len(all) != 1 || all[0].Requests.Used != 1 || all[0].Tokens.Used != 0 {
+		t.Errorf("All on a new day = %+v", all)
+	}
+
+	if got, want := ResetsAt(late), time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("ResetsAt = %v, want %v", got, want)
+	}
+}
+
+func TestContextCaller(t *testing.T) {
+	tracker := New(Limits{RequestsPerDay: 1}, nil)
+	identified := auth.WithIdentity(context.Background(), auth.Identity{User: "team"})
+	tests := []struct {
+		name string
+		ctx  context.Context
+		ok   bool
+	}{
+		{"no tracker or identity", context.Background(), false},
+		{"tracker without identity", NewContext(context.Background(), tracker), false},
+		{"identity without tracker", identified, false},
+		{"tracker and identity", NewContext(identified, tracker), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, key, ok := caller(tt.ctx)
+			if ok != tt.ok || ok && (got != tracker || key != "team") || !ok && (got != nil || key != "") {
+				t.Errorf("caller = %p, %q, %v, want ok %v", got, key, ok, tt.ok)
+			}
+		})
+	}
+
+	// Callers without a quota are never counted or refused
+	anonymous := NewContext(context.Background(), tracker)
+	for range 3 {
+		if err := Reserve(anonymous); err != nil {
+			t.Fatal(err)
+		}
+		Record(anonymous, 10, nil)
+	}
+	if err := Check(anonymous); err != nil {
+		t.Fatal(err)
+	}
+	if all := tracker.All(); len(all) != 0 {
+		t.Errorf("anonymous usage = %+v, want none", all)
+	}
+
+	ctx := NewContext(identified, tracker)
+	if err := Reserve(ctx); err != nil {
+		t.Fatal(err)
+	}
+	Record(ctx, 10, errors.New("provider failed"))
+	if err := Reserve(ctx); err != nil {
+		t.Fatalf("Reserve after a refund = %v", err)
+	}
+	Record(ctx, 10, nil)
+	if err := Check(ctx); !errors.Is(err, ErrExceeded) {
+		t.Errorf("Check = %v, want ErrExceeded", err)
+	}
+	if err := Reserve(ctx); !errors.Is(err, ErrExceeded) {
+		t.Errorf("Reserve = %v, want ErrExceeded", err)
+	}
+}
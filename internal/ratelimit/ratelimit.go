@@ -0,0 +1,206 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"alt-text-generator/internal/auth"
+	"alt-text-generator/internal/redis"
+)
+
+// idleTimeout is how long an unused bucket is kept before being discarded
+const idleTimeout = 10 * time.Minute
+
+// takeScript takes a token from the bucket at KEYS[1], refilled at ARGV[1]
+// tokens a second up to ARGV[2], by the Redis server's clock so instances
+// with skewed clocks agree. It returns 1 or 0 for whether a token was taken,
+// and the tokens left as a string, since Lua numbers are truncated in
+// replies.
+const takeScript = `
+local now = redis.call('TIME')
+now = tonumber(now[1]) + tonumber(now[2]) / 1000000
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+local taken = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	taken = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return {taken, tostring(tokens)}`
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a per-client token bucket rate limiter
+type Limiter struct {
+	rate       float64 // tokens per second
+	burst      float64
+	trustProxy bool
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+
+	// redis, when set, holds the buckets instead, shared by every instance
+	redis *redis.Client
+}
+
+// New creates a limiter allowing perMinute requests per client with bursts of
+// up to burst requests. When trustProxy is set the client IP is taken from
+// X-Forwarded-For, which is only safe behind a proxy that sets it.
+func New(perMinute, burst int, trustProxy bool) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &Limiter{
+		rate:       float64(perMinute) / 60,
+		burst:      float64(burst),
+		trustProxy: trustProxy,
+		buckets:    map[string]*bucket{},
+	}
+	go l.cleanup()
+	return l
+}
+
+// UseRedis keeps the buckets in Redis, so server instances behind a load
+// balancer enforce one limit between them. If Redis can't be reached, each
+// instance falls back to its own buckets.
+func (l *Limiter) UseRedis(client *redis.Client) {
+	l.redis = client
+}
+
+// Allow takes a token from the client's bucket. When none is available it
+// returns false and how long until one will be.
+func (l *Limiter) Allow(key string) (bool, int, time.Duration) {
+	if l.redis != nil {
+		allowed, tokens, err := l.takeShared(key)
+		if err == nil {
+			return l.result(allowed, tokens)
+		}
+		slog.Warn("Error taking a rate limit token from Redis", "err", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return l.result(allowed, b.tokens)
+}
+
+// result is what Allow returns for a bucket left with tokens
+func (l *Limiter) result(allowed bool, tokens float64) (bool, int, time.Duration) {
+	if allowed {
+		return true, int(tokens), 0
+	}
+	wait := time.Duration((1 - tokens) / l.rate * float64(time.Second))
+	return false, 0, wait
+}
+
+// takeShared takes a token from the client's bucket in Redis
+func (l *Limiter) takeShared(key string) (bool, float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := l.redis.Eval(ctx, takeScript, []string{"alttext:ratelimit:" + key},
+		strconv.FormatFloat(l.rate, 'f', -1, 64), strconv.FormatFloat(l.burst, 'f', -1, 64), strconv.Itoa(int(idleTimeout.Seconds())))
+	if err != nil {
+		return false, 0, err
+	}
+	parts, _ := reply.([]any)
+	if len(parts) != 2 {
+		return false, 0, fmt.Errorf("unexpected reply %v", reply)
+	}
+	taken, _ := parts[0].(int64)
+	text, _ := parts[1].(string)
+	tokens, err := strconv.ParseFloat(text, 64)
+	return taken == 1, tokens, err
+}
+
+// Middleware rejects requests over the limit with 429 and a Retry-After header.
+// Authenticated callers are limited per identity, everyone else per IP.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, remaining, wait := l.Allow(l.clientKey(r))
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(l.rate*60)))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		if !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":       "Rate limit exceeded",
+				"retry_after": retryAfter,
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *Limiter) clientKey(r *http.Request) string {
+	if id, ok := auth.IdentityFromContext(r.Context()); ok {
+		return id.Method + ":" + id.Subject
+	}
+	return "ip:" + ClientIP(r, l.trustProxy)
+}
+
+// ClientIP returns the caller's IP address, preferring the first
+// X-Forwarded-For hop when trustProxy is set
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (l *Limiter) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-idleTimeout)
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if b.last.Before(cutoff) {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
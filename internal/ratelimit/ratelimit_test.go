@@ -0,0 +1,372 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"alt-text-generator/internal/auth"
+	"alt-text-generator/internal/redis"
+)
+
+// fakeRedis is an in-memory Redis speaking enough RESP for the limiter. It
+// runs takeScript's token bucket in Go, by its own clock.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	commands []string
+	// reply, when set, is sent instead of running the script
+	reply string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{ln: ln, buckets: map[string]*bucket{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(nc)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) client(t *testing.T) *redis.Client {
+	t.Helper()
+	c, err := redis.Open("redis://" + s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (s *fakeRedis) serve(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if args[0] == "EVAL" {
+			// The script is long; log only what it was given
+			s.commands = append(s.commands, "EVAL "+strings.Join(args[2:], " "))
+		} else {
+			s.commands = append(s.commands, strings.Join(args, " "))
+		}
+		reply := s.reply
+		s.mu.Unlock()
+
+		switch {
+		case reply != "":
+			io.WriteString(nc, reply)
+		case args[0] == "EVAL" && args[1] == takeScript && len(args) == 7:
+			rate, _ := strconv.ParseFloat(args[4], 64)
+			burst, _ := strconv.ParseFloat(args[5], 64)
+			taken, tokens := s.take(args[3], rate, burst)
+			text := strconv.FormatFloat(tokens, 'f', -1, 64)
+			fmt.Fprintf(nc, "*2\r\n:%d\r\n$%d\r\n%s\r\n", taken, len(text), text)
+		default:
+			fmt.Fprintf(nc, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+// take does what takeScript does
+func (s *fakeRedis) take(key string, rate, burst float64) (int, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return 0, b.tokens
+	}
+	b.tokens--
+	return 1, b.tokens
+}
+
+func (s *fakeRedis) log() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// drain takes tokens from key until refused, returning the remaining counts
+// reported while allowed and the wait when refused
+func drain(t *testing.T, l *Limiter, key string) ([]int, time.Duration) {
+	t.Helper()
+	var remaining []int
+	for range 10 {
+		allowed, left, wait := l.Allow(key)
+		if !allowed {
+			return remaining, wait
+		}
+		if wait != 0 {
+			t.Errorf("Allow = true with a wait of %v", wait)
+		}
+		remaining = append(remaining, left)
+	}
+	t.Fatal("bucket never ran out")
+	return nil, 0
+}
+
+func TestAllowBurst(t *testing.T) {
+	l := New(60, 3, false)
+	remaining, wait := drain(t, l, "ip:192.0.2.1")
+	if fmt.Sprint(remaining) != "[2 1 0]" {
+		t.Errorf("remaining = %v, want [2 1 0]", remaining)
+	}
+	// One token a second, and the bucket is just about empty
+	if wait <= 900*time.Millisecond || wait > time.Second {
+		t.Errorf("wait = %v, want just under 1s", wait)
+	}
+	// Buckets are per client
+	if allowed, _, _ := l.Allow("ip:192.0.2.2"); !allowed {
+		t.Error("another client was refused")
+	}
+	// A bucket refills at the rate, up to the burst
+	l.buckets["ip:192.0.2.1"].last = time.Now().Add(-time.Hour)
+	if remaining, _ := drain(t, l, "ip:192.0.2.1"); len(remaining) != 3 {
+		t.Errorf("after an hour allowed %d, want the burst of 3", len(remaining))
+	}
+
+	if l := New(60, 0, false); l.burst != 1 {
+		t.Errorf("burst = %v, want at least 1", l.burst)
+	}
+}
+
+func TestResult(t *testing.T) {
+	tests := []struct {
+		perMinute int
+		allowed   bool
+		tokens    float64
+		remaining int
+		wait      time.Duration
+	}{
+		{60, true, 2.7, 2, 0},
+		{60, false, 0, 0, time.Second},
+		{60, false, 0.25, 0, 750 * time.Millisecond},
+		{30, false, 0, 0, 2 * time.Second},
+		{6, false, 0.5, 0, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		l := &Limiter{rate: float64(tt.perMinute) / 60}
+		allowed, remaining, wait := l.result(tt.allowed, tt.tokens)
+		if allowed != tt.allowed || remaining != tt.remaining || wait != tt.wait {
+			t.Errorf("%d/min result(%v, %v) = %v, %d, %v, want %v, %d, %v",
+				tt.perMinute, tt.allowed, tt.tokens, allowed, remaining, wait, tt.allowed, tt.remaining, tt.wait)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	l := New(30, 1, false)
+	handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/generate", nil))
+		return rec
+	}
+
+	rec := serve()
+	if rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "30" || rec.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("first request = %d, headers %v", rec.Code, rec.Header())
+	}
+	rec = serve()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	// Just under 2s to wait is rounded up
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	var body struct {
+		Error      string `json:"error"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != "Rate limit exceeded" || body.RetryAfter != 2 {
+		t.Errorf("body = %s, %v", rec.Body, err)
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	identified := auth.WithIdentity(context.Background(), auth.Identity{Subject: "ci", User: "team", Method: "api_key"})
+	tests := []struct {
+		name       string
+		remote     string
+		forwarded  string
+		trustProxy bool
+		identity   bool
+		want       string
+	}{
+		{"identity", "192.0.2.1:5000", "203.0.113.9", true, true, "api_key:ci"},
+		{"ip", "192.0.2.1:5000", "", false, false, "ip:192.0.2.1"},
+		{"ipv6", "[2001:db8::1]:5000", "", false, false, "ip:2001:db8::1"},
+		{"no port", "192.0.2.1", "", false, false, "ip:192.0.2.1"},
+		{"forwarded, untrusted", "192.0.2.1:5000", "203.0.113.9", false, false, "ip:192.0.2.1"},
+		{"forwarded, trusted", "192.0.2.1:5000", " 203.0.113.9 , 198.51.100.7", true, false, "ip:203.0.113.9"},
+		{"trusted without header", "192.0.2.1:5000", "", true, false, "ip:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.identity {
+				r = r.WithContext(identified)
+			}
+			l := &Limiter{trustProxy: tt.trustProxy}
+			if got := l.clientKey(r); got != tt.want {
+				t.Errorf("clientKey = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSharedBuckets(t *testing.T) {
+	s := newFakeRedis(t)
+	// Two instances behind a load balancer share each client's bucket
+	a, b := New(60, 2, false), New(60, 2, false)
+	a.UseRedis(s.client(t))
+	b.UseRedis(s.client(t))
+
+	if allowed, remaining, _ := a.Allow("ip:192.0.2.1"); !allowed || remaining != 1 {
+		t.Errorf("first Allow = %v, %d remaining, want true, 1", allowed, remaining)
+	}
+	if allowed, remaining, _ := b.Allow("ip:192.0.2.1"); !allowed || remaining != 0 {
+		t.Errorf("second Allow = %v, %d remaining, want true, 0", allowed, remaining)
+	}
+	allowed, _, wait := a.Allow("ip:192.0.2.1")
+	if allowed || wait <= 900*time.Millisecond || wait > time.Second {
+		t.Errorf("third Allow = %v, wait %v, want refused for just under 1s", allowed, wait)
+	}
+	if len(a.buckets) != 0 || len(b.buckets) != 0 {
+		t.Error("local buckets used while Redis was up")
+	}
+
+	commands := s.log()
+	if want := "EVAL 1 alttext:ratelimit:ip:192.0.2.1 1 2 600"; len(commands) != 3 || commands[0] != want {
+		t.Errorf("commands = %q, want three of %q", commands, want)
+	}
+}
+
+func TestTakeSharedReplies(t *testing.T) {
+	s := newFakeRedis(t)
+	l := New(60, 2, false)
+	l.UseRedis(s.client(t))
+	tests := []struct {
+		reply  string
+		taken  bool
+		tokens float64
+		err    string
+	}{
+		{"*2\r\n:1\r\n$3\r\n1.5\r\n", true, 1.5, ""},
+		{"*2\r\n:0\r\n$4\r\n0.25\r\n", false, 0.25, ""},
+		{"-ERR script failed\r\n", false, 0, "script failed"},
+		{":1\r\n", false, 0, "unexpected reply"},
+		{"*2\r\n:1\r\n$1\r\nx\r\n", true, 0, "invalid syntax"},
+	}
+	for _, tt := range tests {
+		s.mu.Lock()
+		s.reply = tt.reply
+		s.mu.Unlock()
+		taken, tokens, err := l.takeShared("ip:192.0.2.1")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("takeShared with %q err = %v, want %q", tt.reply, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || taken != tt.taken || tokens != tt.tokens {
+			t.Errorf("takeShared with %q = %v, %v, %v, want %v, %v", tt.reply, taken, tokens, err, tt.taken, tt.tokens)
+		}
+	}
+}
+
+func TestRedisFallback(t *testing.T) {
+	s := newFakeRedis(t)
+	s.reply = "-ERR out of memory\r\n"
+	failing := New(60, 2, false)
+	failing.UseRedis(s.client(t))
+
+	// Nothing listens on a closed port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	down, err := redis.Open("redis://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := New(60, 2, false)
+	unreachable.UseRedis(down)
+
+	for name, l := range map[string]*Limiter{"error reply": failing, "unreachable": unreachable} {
+		remaining, wait := drain(t, l, "ip:192.0.2.1")
+		if len(remaining) != 2 || wait <= 0 {
+			t.Errorf("%s: allowed %d then waited %v, want the burst of 2 from a local bucket", name, len(remaining), wait)
+		}
+		if _, ok := l.buckets["ip:192.0.2.1"]; !ok {
+			t.Errorf("%s: no local bucket", name)
+		}
+	}
+}
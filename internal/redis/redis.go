@@ -0,0 +1,258 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeout bounds a command when its context has no deadline of its own
+const timeout = 5 * time.Second
+
+// Error is an error reply from the server
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// Client is a small Redis client speaking RESP2 over a pool of connections.
+// Replies are strings, int64s, []any, or nil for a missing value; error
+// replies are returned as Error.
+type Client struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      *tls.Config
+	pool     chan *conn
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Open returns a client for the server at a redis:// or rediss:// (TLS) URL,
+// such as redis://:password@localhost:6379/0. Connections are made as
+// commands need them.
+func Open(rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, errors.New("Redis URL must look like redis://[:password@]host[:port][/db]")
+	}
+	c := &Client{addr: u.Host, pool: make(chan *conn, 10)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("Redis database %q is not a number", db)
+		}
+	}
+	if u.Scheme == "rediss" {
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	}
+	return c, nil
+}
+
+// Ping checks the server can be reached
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.Do(ctx, "PING")
+	return err
+}
+
+// Get returns the string at key, and whether there was one
+func (c *Client) Get(ctx context.Context, key string) (string, bool, error) {
+	reply, err := c.Do(ctx, "GET", key)
+	s, ok := reply.(string)
+	return s, ok, err
+}
+
+// Set stores value at key, expiring after ttl if it is positive
+func (c *Client) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	args := []string{"SET", key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := c.Do(ctx, args...)
+	return err
+}
+
+// Eval runs a Lua script atomically on the server
+func (c *Client) Eval(ctx context.Context, script string, keys []string, args ...string) (any, error) {
+	cmd := append([]string{"EVAL", script, strconv.Itoa(len(keys))}, keys...)
+	return c.Do(ctx, append(cmd, args...)...)
+}
+
+// Scan returns every key matching pattern, using SCAN so the server isn't
+// blocked
+func (c *Client) Scan(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := c.Do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return keys, err
+		}
+		parts, ok := reply.([]any)
+		if !ok || len(parts) != 2 {
+			return keys, errors.New("redis: unexpected SCAN reply")
+		}
+		cursor, _ = parts[0].(string)
+		batch, _ := parts[1].([]any)
+		for _, k := range batch {
+			if s, ok := k.(string); ok {
+				keys = append(keys, s)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// Do sends a command and returns its reply
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := cn.do(ctx, args)
+	var serverErr Error
+	if err != nil && !errors.As(err, &serverErr) {
+		// The connection may be mid-reply, so it can't be reused
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return reply, err
+}
+
+// get takes an idle connection from the pool, or dials a new one
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-c.pool:
+		return cn, nil
+	default:
+	}
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to Redis: %w", err)
+	}
+	if c.tls != nil {
+		tc := tls.Client(nc, c.tls)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("connecting to Redis: %w", err)
+		}
+		nc = tc
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	if c.password != "" {
+		auth := []string{"AUTH", c.password}
+		if c.username != "" {
+			auth = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := cn.do(ctx, auth); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := cn.do(ctx, []string{"SELECT", strconv.Itoa(c.db)}); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// put returns a connection to the pool, closing it if the pool is full
+func (c *Client) put(cn *conn) {
+	select {
+	case c.pool <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+func (cn *conn) do(ctx context.Context, args []string) (any, error) {
+	deadline, _ := ctx.Deadline()
+	cn.SetDeadline(deadline)
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(cn, b.String()); err != nil {
+		return nil, err
+	}
+	return cn.read()
+}
+
+// read parses one reply
+func (cn *conn) read() (any, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch kind, rest := line[0], line[1:]; kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, Error(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			// An error inside an array, as from EXEC, is kept as its value
+			if items[i], err = cn.read(); err != nil {
+				var serverErr Error
+				if !errors.As(err, &serverErr) {
+					return nil, err
+				}
+				items[i] = serverErr
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
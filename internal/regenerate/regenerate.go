@@ -0,0 +1,300 @@
+// Package regenerate captions stored generations again with a newer or
+// better model, so a site's alt text improves over time without the images
+// being uploaded again
+package regenerate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/audit"
+	"alt-text-generator/internal/history"
+	"alt-text-generator/internal/metrics"
+)
+
+// ErrRunning is returned when a run is started while another is going
+var ErrRunning = errors.New("a regeneration is already running")
+
+// pageSize is how many generations are read from history at a time
+const pageSize = 200
+
+// Options picks which stored generations are captioned again and caps what
+// doing so may spend. A generation matching any of OldModels, Below, and
+// RatedDown is picked.
+type Options struct {
+	// OldModels picks generations not made by the model captioning them again
+	OldModels bool `json:"old_models,omitempty"`
+	// Below picks generations whose quality score is under it
+	Below int `json:"below,omitempty"`
+	// RatedDown picks generations given a thumbs-down as feedback
+	RatedDown bool `json:"rated_down,omitempty"`
+	// Since and Until only pick generations made in that time
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+
+	// Budget is the most to spend, in USD at the model's list prices. The
+	// run stops once it has been spent.
+	Budget float64 `json:"budget"`
+	// Limit is the most provider calls to make, or 0 for no limit
+	Limit int `json:"limit,omitempty"`
+	// DryRun lists the generations that would be picked without calling
+	// the provider
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// Check reports whether the options pick anything and cap the spend
+func (o Options) Check() error {
+	switch {
+	case !o.OldModels && o.Below <= 0 && !o.RatedDown:
+		return errors.New("pick generations to regenerate by old model, score, or thumbs-down rating")
+	case o.Below > 100:
+		return errors.New("score threshold must be between 1 and 100")
+	case o.Budget <= 0 && !o.DryRun:
+		return errors.New("budget must be a positive amount in USD")
+	case o.Limit < 0:
+		return errors.New("limit must not be negative")
+	}
+	return nil
+}
+
+// picks reports whether r should be captioned again by provider
+func (o Options) picks(r history.Record, provider api.Provider) bool {
+	// Superseded generations were already regenerated, and translations
+	// and improvements need the alt text they started from
+	if r.SupersededBy != "" || r.ImageHash == "" || len(r.Issues) > 0 {
+		return false
+	}
+	switch {
+	case o.OldModels && (r.Provider != provider.Name || r.Model != provider.Model):
+		return true
+	case o.Below > 0 && r.Score < o.Below:
+		return true
+	case o.RatedDown && r.Feedback != nil && r.Feedback.Rating == history.RatingDown:
+		return true
+	}
+	return false
+}
+
+// Summary reports what a run did
+type Summary struct {
+	// Candidates counts the generations picked
+	Candidates  int `json:"candidates"`
+	Regenerated int `json:"regenerated"`
+	// Reused counts candidates given the new result of the same image and
+	// prompt regenerated earlier in the run
+	Reused int `json:"reused"`
+	// Missing counts candidates whose image isn't in object storage
+	Missing int     `json:"missing"`
+	Failed  int     `json:"failed"`
+	Cost    float64 `json:"cost"`
+	// Stopped is "budget" or "limit" when the run ended there with
+	// candidates left
+	Stopped string `json:"stopped,omitempty"`
+}
+
+// Run captions the stored generations opts picks again with provider,
+// newest first, using the original images kept in the store's object
+// storage and the prompts they were first sent. Each new generation is
+// stored with the old one's owner and filename and supersedes it. report,
+// if not nil, is told about each candidate: with the new generation, or an
+// error, or neither in a dry run.
+func Run(ctx context.Context, store *history.Store, provider api.Provider, opts Options, report func(old, new history.Record, err error)) (Summary, error) {
+	var summary Summary
+	if err := opts.Check(); err != nil {
+		return summary, err
+	}
+	if !store.KeepsImages() {
+		return summary, errors.New("regenerating needs the original images, which are only kept with object storage")
+	}
+	if report == nil {
+		report = func(old, new history.Record, err error) {}
+	}
+
+	// Copies of an image under the same prompt, such as cached ones, share
+	// one provider call
+	fresh := map[string]history.Record{}
+	filter := history.Filter{Since: opts.Since, Until: opts.Until, Limit: pageSize}
+	for {
+		records := store.List(filter)
+		for _, r := range records {
+			if err := ctx.Err(); err != nil {
+				return summary, err
+			}
+			if !opts.picks(r, provider) {
+				continue
+			}
+			summary.Candidates++
+			if opts.DryRun {
+				report(r, history.Record{}, nil)
+				continue
+			}
+
+			key := r.ImageHash + "\x00" + r.Prompt
+			if earlier, ok := fresh[key]; ok {
+				copied := earlier
+				copied.ID, copied.User, copied.Filename = "", r.User, r.Filename
+				copied.InputTokens, copied.OutputTokens = 0, 0
+				copied.Cached, copied.CreatedAt, copied.Feedback = true, time.Time{}, nil
+				report(r, supersede(ctx, store, r, copied), nil)
+				summary.Reused++
+				metrics.Regenerations.Inc("reused")
+				continue
+			}
+			if opts.Limit > 0 && summary.Regenerated+summary.Failed >= opts.Limit {
+				summary.Stopped = "limit"
+				return summary, nil
+			}
+			if summary.Cost >= opts.Budget {
+				summary.Stopped = "budget"
+				return summary, nil
+			}
+
+			data, ok := store.Image(ctx, r)
+			if !ok {
+				report(r, history.Record{}, errors.New("image not in object storage"))
+				summary.Missing++
+				metrics.Regenerations.Inc("missing")
+				continue
+			}
+			record, cost, err := caption(ctx, provider, r, data)
+			summary.Cost += cost
+			if err != nil {
+				slog.WarnContext(ctx, "Error regenerating alt text", "generation_id", r.ID, "err", err)
+				report(r, history.Record{}, err)
+				summary.Failed++
+				metrics.Regenerations.Inc("failed")
+				continue
+			}
+			record = supersede(ctx, store, r, record)
+			fresh[key] = record
+			report(r, record, nil)
+			summary.Regenerated++
+			metrics.Regenerations.Inc("regenerated")
+		}
+		if len(records) < pageSize {
+			return summary, nil
+		}
+		cursor := history.CursorFor(records[len(records)-1])
+		filter.After = &cursor
+	}
+}
+
+// caption asks provider for alt text for the image of r, with the prompt
+// and options r was made with, and returns it as a generation to store and
+// what it cost
+func caption(ctx context.Context, provider api.Provider, r history.Record, data []byte) (history.Record, float64, error) {
+	// The record doesn't say which options were on, but what they added to
+	// the result does
+	ctx = api.WithFilename(ctx, r.Filename)
+	ctx = api.WithStoredPrompt(ctx, r.Prompt)
+	ctx = api.WithDescription(ctx, r.Description != "")
+	ctx = api.WithKeywords(ctx, len(r.Keywords) > 0)
+	ctx = api.WithStructured(ctx, r.Caption != "" || len(r.Tags) > 0 || len(r.Objects) > 0)
+	ctx = api.WithCharts(ctx, strings.Contains(r.Description, "<table"))
+	if r.MaxChars > 0 {
+		ctx = api.WithMaxChars(ctx, r.MaxChars)
+	}
+
+	start := time.Now()
+	result, err := provider.Generate(ctx, data)
+	metrics.ObserveProvider(provider.Name, start, result.InputTokens, result.OutputTokens, err)
+	cost := provider.Cost(result)
+	if err != nil {
+		return history.Record{}, cost, err
+	}
+	prompt, _ := api.Prompt(ctx)
+	return history.Record{
+		User:         r.User,
+		Provider:     provider.Name,
+		Model:        provider.Model,
+		Filename:     r.Filename,
+		ImageHash:    r.ImageHash,
+		Thumbnail:    history.Thumbnail(data),
+		Prompt:       prompt,
+		Settings:     api.OutputSettings(ctx),
+		AltText:      result.Text,
+		Description:  result.Description,
+		Score:        result.Score,
+		Confidence:   result.Confidence,
+		Lint:         result.Lint,
+		Caption:      result.Caption,
+		Tags:         result.Tags,
+		Objects:      result.Objects,
+		DetectedText: result.DetectedText,
+		Keywords:     result.Keywords,
+		Issues:       result.Issues,
+		MaxChars:     result.MaxChars,
+		InputTokens:  result.InputTokens,
+		OutputTokens: result.OutputTokens,
+	}, cost, nil
+}
+
+// supersede stores record as the regeneration of old and marks old as
+// superseded by it
+func supersede(ctx context.Context, store *history.Store, old, record history.Record) history.Record {
+	record.Supersedes = old.ID
+	record = store.Add(record)
+	store.Supersede(old.ID, record.ID)
+	slog.InfoContext(ctx, "Regenerated alt text", "generation_id", record.ID, "supersedes", old.ID, "model", record.Model)
+	audit.Record(ctx, audit.Event{Action: audit.ActionGenerate, ImageHash: record.ImageHash, Provider: record.Provider, Model: record.Model, GenerationID: record.ID, Detail: "regenerated " + old.ID})
+	return record
+}
+
+// Status is the state of the latest run started through a Runner
+type Status struct {
+	Running bool      `json:"running"`
+	Started time.Time `json:"started"`
+	// Finished is unset while the run is going
+	Finished *time.Time `json:"finished,omitempty"`
+	Options  Options    `json:"options"`
+	Summary  Summary    `json:"summary"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// Runner runs regenerations in the background, one at a time
+type Runner struct {
+	mu     sync.Mutex
+	status Status
+}
+
+// Start begins a run in the background, or fails with ErrRunning if one is
+// going. ctx carries what the run logs and audits with; cancelling it
+// doesn't stop the run.
+func (rn *Runner) Start(ctx context.Context, store *history.Store, provider api.Provider, opts Options) error {
+	if err := opts.Check(); err != nil {
+		return err
+	}
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	if rn.status.Running {
+		return ErrRunning
+	}
+	rn.status = Status{Running: true, Started: time.Now().UTC(), Options: opts}
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		summary, err := Run(ctx, store, provider, opts, nil)
+		rn.mu.Lock()
+		defer rn.mu.Unlock()
+		finished := time.Now().UTC()
+		rn.status.Running, rn.status.Finished, rn.status.Summary = false, &finished, summary
+		if err != nil {
+			rn.status.Error = err.Error()
+		}
+		slog.InfoContext(ctx, "Finished regeneration", "regenerated", summary.Regenerated, "reused", summary.Reused, "failed", summary.Failed, "cost", fmt.Sprintf("%.4f", summary.Cost), "stopped", summary.Stopped)
+	}()
+	return nil
+}
+
+// Status returns the state of the latest run
+func (rn *Runner) Status() Status {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	return rn.status
+}
@@ -0,0 +1,652 @@
+package server
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/audit"
+	"alt-text-generator/internal/auth"
+	"alt-text-generator/internal/cache"
+	"alt-text-generator/internal/config"
+	"alt-text-generator/internal/cors"
+	"alt-text-generator/internal/deadline"
+	"alt-text-generator/internal/diagnostics"
+	"alt-text-generator/internal/fetch"
+	"alt-text-generator/internal/handlers"
+	"alt-text-generator/internal/health"
+	"alt-text-generator/internal/history"
+	"alt-text-generator/internal/idempotency"
+	"alt-text-generator/internal/jobs"
+	"alt-text-generator/internal/logging"
+	"alt-text-generator/internal/metrics"
+	"alt-text-generator/internal/pool"
+	"alt-text-generator/internal/quota"
+	"alt-text-generator/internal/ratelimit"
+	"alt-text-generator/internal/redis"
+	"alt-text-generator/internal/regenerate"
+	"alt-text-generator/internal/shed"
+	"alt-text-generator/internal/version"
+	"alt-text-generator/internal/versioning"
+)
+
+// legacyDeprecation is when the unversioned /batch and /ws routes moved under /api/v1
+var legacyDeprecation = time.Date(2026, time.October, 17, 0, 0, 0, 0, time.UTC)
+
+// Serve implements "alt-text-generator serve": it starts the web server and
+// JSON API and runs until the process is stopped
+func Serve(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	// Define flags for selecting which API to use
+	useOpenAI := flags.Bool("openai", false, "Use OpenAI API")
+	useAnthropic := flags.Bool("anthropic", false, "Use Anthropic API")
+	configPath := flags.String("config", config.FilePath(), "Config file; settings in the environment or .env take precedence")
+	promptFile := flags.String("prompt-file", "", "File holding a Go text/template prompt to use instead of the built-in one")
+	style := flags.String("style", "", "Default tone of the alt text: "+strings.Join(api.StyleNames(), ", ")+" (defaults to the style setting, then neutral)")
+	maxChars := flags.Int("max-chars", -1, "Longest alt text allowed; longer text is requested again, then truncated (0 for no limit; defaults to the max_length setting, then 125)")
+	lengthLimit := flags.String("limit", "", "Default length limit by name: "+strings.Join(api.LimitPresets(), ", ")+", or custom:N, in place of -max-chars")
+	domain := flags.String("domain", "", "Default kind of image: "+strings.Join(api.DomainNames(), ", ")+" (defaults to the domain setting, then general)")
+	platform := flags.String("platform", "", "Default social network to write for: "+strings.Join(api.PlatformNames(), ", ")+", setting its length limit in place of -max-chars (defaults to the platform setting)")
+	describe := flags.Bool("describe", false, "Also ask for a long description of each image by default (defaults to the long_description setting)")
+	charts := flags.Bool("charts", false, "Summarise charts by their trend, with a table of their data, by default (defaults to the charts setting)")
+	objective := flags.Bool("objective", false, "Describe images objectively, without subjective or promotional words, by default (defaults to the objective setting)")
+	readingLevel := flags.Int("reading-level", -1, "Default US school grade to write plain-language alt text for (1 to 16, 0 for none; defaults to the reading_level setting)")
+	keywords := flags.Bool("keywords", false, "Also ask for searchable keywords for each image by default (defaults to the keywords setting)")
+	structured := flags.Bool("structured", false, "Ask for a caption, tags, objects, and detected text besides the alt text by default (defaults to the structured setting)")
+	candidates := flags.Int("candidates", 0, "Ask the model this many times for each image by default, offering every distinct option (1 to 5; defaults to the candidates setting, then 1)")
+	people := flags.String("people", "", "Default policy for describing people: "+strings.Join(api.PeoplePolicies, ", ")+" (defaults to the people setting, then allow)")
+	filters := flags.String("filter", "", "Comma-separated output filters: "+strings.Join(api.FilterNames(), ", ")+" (defaults to the filters setting)")
+	temperature := flags.String("temperature", "", "Default sampling temperature, from 0 to 2 (defaults to the temperature setting, then the provider's)")
+	topP := flags.String("top-p", "", "Default nucleus sampling cutoff, from 0 to 1 (defaults to the top_p setting, then the provider's)")
+	seed := flags.String("seed", "", "Default sampling seed, for repeatable output with OpenAI (defaults to the seed setting)")
+	improve := flags.Bool("improve", false, "Critique and rewrite the existing_alt context by default, returning the problems found as issues (defaults to the improve setting)")
+	translate := flags.String("translate", "", "Comma-separated languages to translate the existing_alt context into by default, instead of writing new alt text (defaults to the translate setting)")
+	grade := flags.Bool("grade", false, "Also have the model rate each alt text for its quality score, at the cost of one extra request (defaults to the grader setting)")
+	listenAddr := flags.String("listen", "", "Address to listen on: host:port or unix:///path.sock (defaults to LISTEN_ADDR, then :$PORT, then :8080)")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: alt-text-generator serve [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(stderr, "Error: unexpected argument %q\n", flags.Arg(0))
+		flags.Usage()
+		return 2
+	}
+
+	// Load environment variables from .env file
+	log.Println("Loading environment variables from .env file")
+	err := config.LoadEnvFile(".env")
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+	log.Println("Successfully loaded .env file")
+
+	if err := config.LoadFile(*configPath); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Error loading config file: %v", err)
+	}
+
+	if *promptFile != "" {
+		os.Setenv("ALT_TEXT_PROMPT_FILE", *promptFile)
+	}
+	if *style != "" {
+		os.Setenv("ALT_TEXT_STYLE", *style)
+	}
+	if *domain != "" {
+		os.Setenv("ALT_TEXT_DOMAIN", *domain)
+	}
+	if *platform != "" {
+		os.Setenv("ALT_TEXT_PLATFORM", *platform)
+	}
+	if *describe {
+		os.Setenv("ALT_TEXT_LONG_DESCRIPTION", "true")
+	}
+	if *charts {
+		os.Setenv("ALT_TEXT_CHARTS", "true")
+	}
+	if *objective {
+		os.Setenv("ALT_TEXT_OBJECTIVE", "true")
+	}
+	if *readingLevel >= 0 {
+		os.Setenv("ALT_TEXT_READING_LEVEL", strconv.Itoa(*readingLevel))
+	}
+	if *keywords {
+		os.Setenv("ALT_TEXT_KEYWORDS", "true")
+	}
+	if *structured {
+		os.Setenv("ALT_TEXT_STRUCTURED", "true")
+	}
+	if *candidates != 0 {
+		if err := api.CheckCandidates(*candidates); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		os.Setenv("ALT_TEXT_CANDIDATES", strconv.Itoa(*candidates))
+	}
+	if *people != "" {
+		os.Setenv("ALT_TEXT_PEOPLE", *people)
+	}
+	if *filters != "" {
+		os.Setenv("ALT_TEXT_FILTERS", *filters)
+	}
+	if *grade {
+		os.Setenv("ALT_TEXT_GRADER", "true")
+	}
+	if *temperature != "" {
+		os.Setenv("ALT_TEXT_TEMPERATURE", *temperature)
+	}
+	if *topP != "" {
+		os.Setenv("ALT_TEXT_TOP_P", *topP)
+	}
+	if *seed != "" {
+		os.Setenv("ALT_TEXT_SEED", *seed)
+	}
+	if *translate != "" {
+		os.Setenv("ALT_TEXT_TRANSLATE", *translate)
+	}
+	if *improve {
+		os.Setenv("ALT_TEXT_IMPROVE", "true")
+	}
+	if *maxChars >= 0 {
+		os.Setenv("ALT_TEXT_MAX_LENGTH", strconv.Itoa(*maxChars))
+	}
+	if *lengthLimit != "" {
+		n, err := api.ParseLimit(*lengthLimit)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		os.Setenv("ALT_TEXT_MAX_LENGTH", strconv.Itoa(n))
+	}
+	if err := api.CheckPrompt(); err != nil {
+		log.Fatalf("Error loading prompt: %v", err)
+	}
+	if err := api.CheckLint(); err != nil {
+		log.Fatalf("Error in lint settings: %v", err)
+	}
+	if err := api.CheckNormalize(); err != nil {
+		log.Fatalf("Error in normalize settings: %v", err)
+	}
+	if err := api.CheckFilters(); err != nil {
+		log.Fatalf("Error in filter settings: %v", err)
+	}
+	if err := api.CheckPeople(); err != nil {
+		log.Fatalf("Error in people setting: %v", err)
+	}
+	if err := api.CheckSampling(); err != nil {
+		log.Fatalf("Error in sampling settings: %v", err)
+	}
+	if err := api.CheckTranslation(); err != nil {
+		log.Fatalf("Error in translate setting: %v", err)
+	}
+	if err := api.CheckReadability(); err != nil {
+		log.Fatalf("Error in reading_level setting: %v", err)
+	}
+	if err := api.CheckPlatformSetting(); err != nil {
+		log.Fatalf("Error in platform setting: %v", err)
+	}
+
+	// Structured logs go to stderr; LOG_FORMAT=text gives human-readable output
+	logging.Setup(os.Stderr, config.GetString("LOG_FORMAT", "json"), config.GetString("LOG_LEVEL", "info"))
+
+	// Set the appropriate API provider and mode
+	var mode string
+	if *useOpenAI {
+		mode = "openai"
+	} else if *useAnthropic {
+		mode = "anthropic"
+	} else if mode = config.GetString("PROVIDER", ""); mode != "openai" && mode != "anthropic" {
+		log.Fatalf("You must specify either -openai or -anthropic flag, or set provider in the config file.")
+	}
+	provider, _ := api.LookupProvider(mode)
+	// Single-image requests that someone is waiting on can race both
+	// providers, answering with whichever is first; batches and jobs don't
+	interactive := provider
+	if config.GetBool("PROVIDER_RACE", false) {
+		racers := []api.Provider{provider}
+		for _, p := range api.Providers() {
+			if p.Name != provider.Name {
+				racers = append(racers, p)
+			}
+		}
+		interactive = api.Race(racers...)
+		slog.Info("Racing providers for interactive requests", "providers", interactive.Name)
+	}
+	// Warm connections spare the first request after a quiet spell the TLS
+	// handshake
+	if interval := config.GetDuration("PROVIDER_KEEPALIVE_INTERVAL", 0); interval > 0 {
+		api.KeepWarm(interval)
+		slog.Info("Keeping provider connections warm", "interval", interval.String())
+	}
+
+	if err := handlers.LoadTemplate(); err != nil {
+		log.Fatalf("Error loading page template: %v", err)
+	}
+
+	started := time.Now()
+	store := history.NewStore()
+	if dsn := config.GetString("HISTORY_DB", ""); dsn != "" {
+		if store, err = history.Open(dsn); err != nil {
+			log.Fatalf("Error opening history database: %v", err)
+		}
+		// The DSN isn't logged, as a database URL can carry a password
+		slog.Info("Keeping history in a database", "backend", store.Backend(), "generations", store.Count())
+	}
+	retention := history.Retention{
+		Records:    config.GetDuration("HISTORY_RETENTION", 0),
+		Thumbnails: config.GetDuration("HISTORY_THUMBNAIL_RETENTION", 0),
+	}
+	store.Retain(retention)
+	if retention.Records > 0 || retention.Thumbnails > 0 {
+		slog.Info("History retention enabled", "records", retention.Records.String(), "thumbnails", retention.Thumbnails.String())
+	}
+	// Cached results are never kept longer than history keeps them
+	resultTTL := config.GetDuration("RESULT_CACHE_TTL", 7*24*time.Hour)
+	if retention.Records > 0 {
+		resultTTL = min(resultTTL, retention.Records)
+	}
+	idempotencyCache := idempotency.New(config.GetDuration("IDEMPOTENCY_TTL", 24*time.Hour), config.GetBool("TRUST_PROXY", false))
+	caches := map[string]handlers.Cache{"idempotency": idempotencyCache}
+
+	// Redis lets instances behind a load balancer share the result cache and rate limits
+	var redisClient *redis.Client
+	if redisURL := config.GetString("REDIS_URL", ""); redisURL != "" {
+		if redisClient, err = redis.Open(redisURL); err != nil {
+			log.Fatalf("Error configuring Redis: %v", err)
+		}
+		if err := redisClient.Ping(context.Background()); err != nil {
+			log.Fatalf("Error connecting to Redis: %v", err)
+		}
+		results := cache.NewRedis(redisClient, "alttext:result:", resultTTL)
+		store.UseCache(results)
+		caches["results"] = results
+		slog.Info("Sharing the result cache and rate limits through Redis")
+	} else if size := config.GetInt("RESULT_CACHE_SIZE", 1000); size > 0 {
+		results := cache.NewLRU(size, resultTTL)
+		store.UseCache(results)
+		caches["results"] = results
+	}
+	// Object storage keeps uploads and results in a bucket beyond the process
+	var bucket *fetch.Bucket
+	if storageURL := config.GetString("OBJECT_STORAGE_URL", ""); storageURL != "" {
+		if bucket, err = fetch.OpenBucket(storageURL, config.GetString("OBJECT_STORAGE_SSE", ""), config.GetString("OBJECT_STORAGE_KMS_KEY", "")); err != nil {
+			log.Fatalf("Error configuring object storage: %v", err)
+		}
+		store.UseObjects(bucket)
+		slog.Info("Keeping uploads and results in object storage", "bucket", bucket.String())
+	}
+	schema := handlers.NewGraphQLSchema(provider, store)
+	// Image URLs from API callers may only reach the public internet and the
+	// buckets listed, never the object storage bucket unless it is named
+	images, err := fetch.NewGuard(config.GetList("FETCH_ALLOWED_BUCKETS"), bucket, config.GetBool("FETCH_ALLOW_PRIVATE", false))
+	if err != nil {
+		log.Fatalf("Error parsing FETCH_ALLOWED_BUCKETS: %v", err)
+	}
+
+	// Daily quotas per user; zero limits track usage without enforcing it
+	quotaOverrides, err := quota.ParseLimits(os.Getenv("QUOTA_OVERRIDES"))
+	if err != nil {
+		log.Fatalf("Error parsing QUOTA_OVERRIDES: %v", err)
+	}
+	quotas := quota.New(quota.Limits{
+		RequestsPerDay: config.GetInt("QUOTA_REQUESTS_PER_DAY", 0),
+		TokensPerDay:   config.GetInt("QUOTA_TOKENS_PER_DAY", 0),
+	}, quotaOverrides)
+
+	// The audit trail records generations and admin actions for the admin API
+	trail := audit.New()
+	if path := config.GetString("AUDIT_LOG", ""); path != "" {
+		if trail, err = audit.Open(path); err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		slog.Info("Appending the audit trail to a file", "path", path)
+	}
+	// Jobs are queued in memory unless JOBS_DB names a database to keep them
+	// in, so they survive restarts
+	processJob := handlers.NewJobProcessor(provider, store, quotas, trail)
+	var jobManager *jobs.Manager
+	if path := config.GetString("JOBS_DB", ""); path != "" {
+		queue, err := jobs.OpenQueue(path, config.GetDuration("JOBS_VISIBILITY_TIMEOUT", time.Minute), config.GetInt("JOBS_MAX_ATTEMPTS", 3))
+		if err != nil {
+			log.Fatalf("Error opening job queue: %v", err)
+		}
+		jobManager = jobs.NewDurableManager(queue, 2, 100, time.Hour, processJob)
+		slog.Info("Keeping queued jobs in a database", "path", path)
+	} else {
+		jobManager = jobs.NewManager(2, 100, time.Hour, processJob)
+	}
+	if bucket != nil {
+		jobManager.UseObjects(bucket)
+	}
+
+	// Provider calls made for requests share a bounded set of workers, so
+	// bursts queue and then get 503 rather than all reaching the provider
+	var generations *pool.Pool
+	if workers := config.GetInt("MAX_CONCURRENT_GENERATIONS", 16); workers > 0 {
+		queueSize := config.GetInt("GENERATION_QUEUE_SIZE", 64)
+		generations = pool.New(workers, queueSize, config.GetDuration("GENERATION_QUEUE_TIMEOUT", 30*time.Second))
+		slog.Info("Generation workers bounded", "workers", workers, "queue", queueSize)
+	}
+
+	// API routes require credentials when API_KEYS or OIDC_ISSUER_URL is set; the web UI stays open
+	authenticator := &auth.Authenticator{Keys: auth.ParseKeys(os.Getenv("API_KEYS"))}
+	if len(authenticator.Keys) > 0 {
+		slog.Info("API key authentication enabled", "keys", len(authenticator.Keys))
+	}
+	if issuer := os.Getenv("OIDC_ISSUER_URL"); issuer != "" {
+		verifier, err := auth.NewOIDCVerifier(context.Background(), issuer, os.Getenv("OIDC_AUDIENCE"), os.Getenv("OIDC_USER_CLAIM"))
+		if err != nil {
+			log.Fatalf("Error configuring OIDC authentication: %v", err)
+		}
+		authenticator.Verifier = verifier
+		slog.Info("OIDC authentication enabled", "issuer", issuer)
+	}
+	if authenticator.Users, err = auth.ParseUsers(os.Getenv("USER_ACCOUNTS")); err != nil {
+		log.Fatalf("Error parsing USER_ACCOUNTS: %v", err)
+	}
+
+	// Rate limiting applies to every route that can call a provider
+	limit := func(h http.Handler) http.Handler { return h }
+	if perMinute := config.GetInt("RATE_LIMIT_PER_MINUTE", 0); perMinute > 0 {
+		limiter := ratelimit.New(perMinute, config.GetInt("RATE_LIMIT_BURST", perMinute), config.GetBool("TRUST_PROXY", false))
+		if redisClient != nil {
+			limiter.UseRedis(redisClient)
+		}
+		limit = limiter.Middleware
+		slog.Info("Rate limiting enabled", "per_minute", perMinute)
+	}
+	protect := func(h http.HandlerFunc) http.Handler {
+		return authenticator.Require(limit(h))
+	}
+	// Routes that generate are refused early while the server is overloaded,
+	// before their uploads are read
+	shedder := shed.New(generations, uint64(config.GetInt("LOAD_SHED_MEMORY_MB", 0))<<20)
+	if memory := shedder.MemoryLimit(); memory > 0 {
+		slog.Info("Shedding load over a memory limit", "limit_mb", memory>>20)
+	}
+	generating := shedder.Middleware
+	// Single-image generation routes get a time budget per stage
+	budgets := deadline.FromEnv()
+	if budgets.Total > 0 || budgets.Upload > 0 || budgets.Preprocess > 0 {
+		slog.Info("Request stage budgets", "upload", budgets.Upload.String(), "preprocess", budgets.Preprocess.String(), "provider", budgets.Provider.String(), "total", budgets.Total.String())
+	}
+
+	// Health probes: readiness checks config, template, and provider reachability
+	checker := health.New(30*time.Second, 5*time.Second)
+	checker.Add("config", func(ctx context.Context) error {
+		if !provider.Configured() {
+			return fmt.Errorf("%s is not set", provider.EnvKey)
+		}
+		return nil
+	})
+	checker.Add("template", handlers.CheckTemplate)
+	checker.Add("provider", provider.Ping)
+	if redisClient != nil {
+		checker.Add("redis", redisClient.Ping)
+	}
+
+	// Set up routes
+	http.HandleFunc("GET /healthz", checker.LivenessHandler)
+	http.HandleFunc("GET /readyz", checker.ReadinessHandler)
+	http.HandleFunc("GET /startupz", checker.StartupHandler)
+	http.HandleFunc("GET /metrics", metrics.Handler)
+	http.HandleFunc("GET /version", version.Handler)
+	// Uploads generate like the API does, so they need the same credentials
+	// unless ANONYMOUS_UPLOADS opens them to everyone
+	anonymousUploads := config.GetBool("ANONYMOUS_UPLOADS", false)
+	if anonymousUploads && authenticator.Enabled() {
+		slog.Warn("Uploads are open to anonymous callers while the API requires credentials")
+	}
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		handlers.HomeHandler(w, r, mode, authenticator.Enabled() && !anonymousUploads)
+	})
+	uploadRoutes(http.DefaultServeMux, interactive, store, authenticator, anonymousUploads, func(h http.Handler) http.Handler {
+		return generating(budgets.Middleware(h))
+	}, limit)
+	// Versioned JSON API. A future v2 registers its routes on the same mux
+	// alongside v1; set API_V1_DEPRECATION/API_V1_SUNSET to announce v1's retirement.
+	v1 := versioning.FromEnv("v1")
+	batch := generating(protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.BatchHandler(w, r, provider, store, images)
+	}))
+	ws := generating(protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.WebSocketHandler(w, r, interactive, store)
+	}))
+	v1.Handle(http.DefaultServeMux, "POST /generate", generating(budgets.Middleware(protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.GenerateJSONHandler(w, r, interactive, store)
+	}))))
+	v1.Handle(http.DefaultServeMux, "POST /batch", batch)
+	v1.Handle(http.DefaultServeMux, "GET /ws", ws)
+	v1.Handle(http.DefaultServeMux, "POST /jobs", generating(protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.CreateJobHandler(w, r, provider, jobManager, images)
+	})))
+	v1.Handle(http.DefaultServeMux, "GET /jobs/{id}", protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.GetJobHandler(w, r, jobManager)
+	}))
+	// The history page needs credentials like the API when authentication is
+	// enabled, and then shows only the caller's generations
+	http.Handle("GET /history", authenticator.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.HistoryPageHandler(w, r, store)
+	})))
+	http.Handle("GET /history/{id}/image", authenticator.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.HistoryImageHandler(w, r, store)
+	})))
+	http.Handle("POST /history/{id}/feedback", authenticator.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.HistoryFeedbackHandler(w, r, store)
+	})))
+	v1.Handle(http.DefaultServeMux, "GET /history", protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.HistoryHandler(w, r, store)
+	}))
+	v1.Handle(http.DefaultServeMux, "GET /history/export", protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.ExportHistoryHandler(w, r, store)
+	}))
+	v1.Handle(http.DefaultServeMux, "GET /history/{id}", protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.GetHistoryHandler(w, r, store)
+	}))
+	v1.Handle(http.DefaultServeMux, "GET /history/{id}/image", protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.HistoryImageHandler(w, r, store)
+	}))
+	v1.Handle(http.DefaultServeMux, "POST /history/{id}/feedback", protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.FeedbackHandler(w, r, store)
+	}))
+	v1.Handle(http.DefaultServeMux, "GET /usage", protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.UsageHandler(w, r, quotas)
+	}))
+
+	// Unversioned paths predating /api/v1 keep working but point to their successors
+	http.Handle("/batch", versioning.Legacy(batch, legacyDeprecation, "/api/v1/batch"))
+	http.Handle("/ws", versioning.Legacy(ws, legacyDeprecation, "/api/v1/ws"))
+	// Admin routes are only served when ADMIN_API_KEYS is set; regular API keys can't reach them
+	if adminKeys := auth.ParseKeys(os.Getenv("ADMIN_API_KEYS")); len(adminKeys) > 0 {
+		adminAuth := &auth.Authenticator{Keys: adminKeys}
+		admin := &handlers.Admin{
+			Started: started,
+			Active:  provider,
+			Store:   store,
+			Jobs:    jobManager,
+			Caches:  caches,
+			Quotas:  quotas,
+			Audit:   trail,
+			// Regenerations started through the admin API run one at a time
+			Regenerations: &regenerate.Runner{},
+			Generations:   generations,
+		}
+		http.Handle("GET /admin/stats", adminAuth.Require(http.HandlerFunc(admin.StatsHandler)))
+		http.Handle("POST /admin/caches/flush", adminAuth.Require(http.HandlerFunc(admin.FlushCachesHandler)))
+		http.Handle("POST /admin/providers/{name}/key", adminAuth.Require(http.HandlerFunc(admin.RotateKeyHandler)))
+		http.Handle("POST /admin/providers/{name}/enable", adminAuth.Require(admin.SetProviderEnabledHandler(true)))
+		http.Handle("POST /admin/providers/{name}/disable", adminAuth.Require(admin.SetProviderEnabledHandler(false)))
+		http.Handle("POST /admin/jobs/drain", adminAuth.Require(http.HandlerFunc(admin.DrainJobsHandler)))
+		http.Handle("POST /admin/jobs/resume", adminAuth.Require(http.HandlerFunc(admin.ResumeJobsHandler)))
+		http.Handle("GET /admin/usage", adminAuth.Require(http.HandlerFunc(admin.UsageHandler)))
+		http.Handle("GET /admin/audit", adminAuth.Require(http.HandlerFunc(admin.AuditHandler)))
+		http.Handle("POST /admin/regenerate", adminAuth.Require(http.HandlerFunc(admin.StartRegenerationHandler)))
+		http.Handle("GET /admin/regenerate", adminAuth.Require(http.HandlerFunc(admin.RegenerationHandler)))
+		slog.Info("Admin API enabled", "keys", len(adminKeys))
+	}
+	// Profiles and runtime stats are kept off the public port
+	if addr := config.GetString("DEBUG_LISTEN_ADDR", ""); addr != "" {
+		serveDebug(addr)
+	}
+
+	graphQL := protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.GraphQLHandler(w, r, schema)
+	})
+	http.Handle("/graphql", graphQL)
+	// Only POST requests can carry the generate mutation
+	http.Handle("POST /graphql", generating(budgets.Middleware(graphQL)))
+
+	// Retries carrying an Idempotency-Key reuse the original result instead of
+	// calling the provider again
+	var handler http.Handler = http.DefaultServeMux
+	// ?style= and ?describe= set prompt options for one request
+	handler = handlers.PromptMiddleware(handler)
+	handler = idempotencyCache.Middleware(handler)
+	handler = quotas.Middleware(handler)
+	handler = trail.Middleware(handler)
+	if generations != nil {
+		handler = generations.Middleware(handler)
+	}
+
+	// Cross-origin access wraps the whole mux so preflight requests are answered
+	// before method routing and authentication
+	if origins := config.GetList("CORS_ALLOWED_ORIGINS"); len(origins) > 0 {
+		handler = cors.New(origins, config.GetInt("CORS_MAX_AGE", 600)).Handler(handler)
+		slog.Info("CORS enabled", "origins", origins)
+	}
+	handler = logging.Middleware(metrics.Middleware(handler))
+
+	// Start server
+	addr := *listenAddr
+	if addr == "" {
+		addr = config.GetString("LISTEN_ADDR", ":"+config.GetString("PORT", "8080"))
+	}
+	slog.Info("Starting server", "addr", addr, "version", version.Version)
+	listener, err := listen(addr)
+	if err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+
+	// SIGINT or SIGTERM stops new requests and lets the ones running finish,
+	// rather than killing them in the middle of a provider call
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	checker.MarkStarted()
+	select {
+	case err := <-served:
+		log.Fatalf("Failed to start server: %v", err)
+	case <-ctx.Done():
+	}
+	// A second signal ends the process at once
+	stop()
+	shutdown(server, jobManager, config.GetDuration("SHUTDOWN_GRACE_PERIOD", 30*time.Second))
+	if err := store.Close(); err != nil {
+		slog.Error("Error closing history", "err", err)
+	}
+	if err := jobManager.Close(); err != nil {
+		slog.Error("Error closing the job queue", "err", err)
+	}
+	if err := trail.Close(); err != nil {
+		slog.Error("Error closing the audit trail", "err", err)
+	}
+	slog.Info("Server stopped")
+	return 0
+}
+
+// shutdown stops accepting connections and waits up to grace for requests in
+// flight and queued jobs to finish. Jobs still unfinished then are failed, so
+// clients polling for them aren't left waiting.
+// uploadRoutes registers /upload and /upload/stream on mux. Unless anonymous
+// is set, they need credentials whenever authenticator is enabled, checked
+// before the rate limit so callers are limited and billed by identity.
+// wrap adds the middleware that runs before authentication.
+func uploadRoutes(mux *http.ServeMux, provider api.Provider, store *history.Store, authenticator *auth.Authenticator, anonymous bool, wrap, limit func(http.Handler) http.Handler) {
+	protect := func(h http.HandlerFunc) http.Handler {
+		if anonymous {
+			return wrap(limit(h))
+		}
+		return wrap(authenticator.Require(limit(h)))
+	}
+	mux.Handle("/upload", protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.UploadHandler(w, r, provider, store)
+	}))
+	mux.Handle("/upload/stream", protect(func(w http.ResponseWriter, r *http.Request) {
+		handlers.StreamHandler(w, r, provider, store)
+	}))
+}
+
+func shutdown(server *http.Server, jobManager *jobs.Manager, grace time.Duration) {
+	slog.Info("Shutting down", "grace_period", grace.String())
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	drained := make(chan error, 1)
+	go func() {
+		_, err := jobManager.Drain(ctx)
+		drained <- err
+	}()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Grace period ended with requests still running", "err", err)
+	}
+	if err := <-drained; err != nil {
+		abandoned := jobManager.Abandon(context.Background())
+		slog.Warn("Grace period ended with jobs unfinished", "abandoned", abandoned)
+	}
+}
+
+// serveDebug serves profiles and runtime stats on addr in the background, to
+// callers with an admin key
+func serveDebug(addr string) {
+	keys := auth.ParseKeys(os.Getenv("ADMIN_API_KEYS"))
+	if len(keys) == 0 {
+		log.Fatalf("DEBUG_LISTEN_ADDR is set without ADMIN_API_KEYS to protect it")
+	}
+	listener, err := listen(addr)
+	if err != nil {
+		log.Fatalf("Failed to start debug listener: %v", err)
+	}
+	debugAuth := &auth.Authenticator{Keys: keys}
+	// No write timeout, since CPU profiles and traces take a while to record
+	server := &http.Server{Handler: logging.Middleware(debugAuth.Require(diagnostics.Handler())), ReadHeaderTimeout: 10 * time.Second}
+	slog.Info("Debug listener started", "addr", addr)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			slog.Error("Debug listener stopped", "err", err)
+		}
+	}()
+}
+
+// listen opens addr, which is host:port or unix:///path.sock. A socket file
+// left behind by an earlier run is removed first.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("unix socket address %q has no path", addr)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"alt-text-generator/internal/api"
+	"alt-text-generator/internal/auth"
+)
+
+func TestUploadRoutesNeedCredentials(t *testing.T) {
+	// A provider without an API key answers 503 once a request gets past
+	// authentication
+	t.Setenv("UPLOAD_TEST_API_KEY", "")
+	provider := api.Provider{Name: "test", EnvKey: "UPLOAD_TEST_API_KEY"}
+	authenticator := &auth.Authenticator{Keys: auth.ParseKeys("team-a:sk-test")}
+	none := func(h http.Handler) http.Handler { return h }
+
+	tests := []struct {
+		name      string
+		anonymous bool
+		key       string
+		want      int
+	}{
+		{"no credentials", false, "", http.StatusUnauthorized},
+		{"wrong key", false, "sk-wrong", http.StatusUnauthorized},
+		{"API key", false, "sk-test", http.StatusServiceUnavailable},
+		{"anonymous uploads allowed", true, "", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			var limited string
+			limit := func(h http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					id, _ := auth.IdentityFromContext(r.Context())
+					limited = id.User
+					h.ServeHTTP(w, r)
+				})
+			}
+			uploadRoutes(mux, provider, nil, authenticator, tt.anonymous, none, limit)
+			for _, path := range []string{"/upload", "/upload/stream"} {
+				req := httptest.NewRequest(http.MethodPost, path, nil)
+				req.Header.Set("Accept", "application/json")
+				if tt.key != "" {
+					req.Header.Set("X-API-Key", tt.key)
+				}
+				rec := httptest.NewRecorder()
+				mux.ServeHTTP(rec, req)
+				if rec.Code != tt.want {
+					t.Errorf("POST %s = %d, want %d", path, rec.Code, tt.want)
+				}
+				if tt.key == "sk-test" && limited != "team-a" {
+					t.Errorf("POST %s limited as %q, want the key's user", path, limited)
+				}
+			}
+		})
+	}
+}
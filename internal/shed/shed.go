@@ -0,0 +1,88 @@
+// Package shed refuses requests that would generate alt text while the
+// server is saturated, before their uploads are read, rather than accepting
+// work that would only time out
+package shed
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+
+	appmetrics "alt-text-generator/internal/metrics"
+	"alt-text-generator/internal/pool"
+)
+
+// Shedder decides when to refuse requests
+type Shedder struct {
+	// generations is nil when provider calls aren't bounded
+	generations *pool.Pool
+	// memoryLimit is the memory use, in bytes, past which requests are
+	// refused, or 0 for no limit
+	memoryLimit uint64
+}
+
+// New returns a shedder refusing requests while generations has no room for
+// more, or memory use is over memoryLimit bytes. A memoryLimit of 0 uses 90%
+// of GOMEMLIMIT when that is set, and otherwise doesn't watch memory.
+func New(generations *pool.Pool, memoryLimit uint64) *Shedder {
+	if memoryLimit == 0 {
+		if limit := debug.SetMemoryLimit(-1); limit < math.MaxInt64 {
+			memoryLimit = uint64(limit) / 10 * 9
+		}
+	}
+	return &Shedder{generations: generations, memoryLimit: memoryLimit}
+}
+
+// MemoryLimit returns the memory use, in bytes, past which requests are
+// refused, or 0 when memory isn't watched
+func (s *Shedder) MemoryLimit() uint64 {
+	return s.memoryLimit
+}
+
+// overloaded returns why the server can't take more work now, or "" if it can
+func (s *Shedder) overloaded() string {
+	if s.generations != nil && s.generations.Full() {
+		return "queue_full"
+	}
+	if s.memoryLimit > 0 && memoryInUse() > s.memoryLimit {
+		return "memory"
+	}
+	return ""
+}
+
+// memoryInUse returns the memory the runtime holds from the OS, as
+// GOMEMLIMIT counts it
+func memoryInUse() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
+
+// Middleware answers requests with 503, a Retry-After header, and a JSON
+// error while the server is overloaded
+func (s *Shedder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason := s.overloaded()
+		if reason == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		appmetrics.Shed.Inc(reason)
+		slog.WarnContext(r.Context(), "Shedding request", "reason", reason)
+		retryAfter := int(pool.RetryAfter.Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":       "The server is busy. Please try again in a few seconds.",
+			"retry_after": retryAfter,
+		})
+	})
+}
@@ -4,12 +4,16 @@ package types
 type TemplateData struct {
 	Mode          string
 	APIKeyMissing bool
+	// AuthRequired asks for an API key or token to send with uploads
+	AuthRequired bool
 }
 
 // ChatGPTResponse represents the response from OpenAI API
 type ChatGPTResponse struct {
 	Choices []struct {
-		Text string `json:"text"`
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
 	} `json:"choices"`
 }
 
@@ -0,0 +1,81 @@
+// Package version reports which build of the binary is running. The values
+// are set at build time with -ldflags, as build.sh does:
+//
+//	go build -ldflags "-X alt-text-generator/internal/version.Version=v1.2.0" ./cmd/server
+package version
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set with -ldflags "-X alt-text-generator/internal/version.<Name>=<value>"
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+// Info describes the running build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// Get returns the build info. Commit and date not set with -ldflags are
+// taken from the VCS stamp go build embeds, when there is one.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		modified := false
+		for _, s := range build.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = s.Value
+				}
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if modified && Commit == "" && info.Commit != "" {
+			info.Commit += "-dirty"
+		}
+	}
+	return info
+}
+
+// String formats the info on one line, as the version command prints it
+func (i Info) String() string {
+	s := "alt-text-generator " + i.Version
+	if i.Commit != "" {
+		s += " (commit " + i.Commit
+		if i.Date != "" {
+			s += ", built " + i.Date
+		}
+		s += ")"
+	}
+	return s + fmt.Sprintf(" %s %s", i.GoVersion, i.Platform)
+}
+
+// Handler serves the build info as JSON
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Get())
+}
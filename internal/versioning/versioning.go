@@ -0,0 +1,101 @@
+package versioning
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Version is a major version of the JSON API, served under /api/<Name>.
+// Versions live side by side on one mux so a new version can change the
+// response schema while integrations on the old one keep working until its
+// sunset date.
+type Version struct {
+	Name string
+
+	// Deprecation, when set, is announced on every response with the
+	// Deprecation header (RFC 9745); Sunset is the date the version will stop
+	// being served (RFC 8594). Link points to migration notes or the
+	// successor version.
+	Deprecation time.Time
+	Sunset      time.Time
+	Link        string
+}
+
+// FromEnv returns the named version with its deprecation schedule read from
+// API_<NAME>_DEPRECATION, API_<NAME>_SUNSET (RFC 3339 dates or timestamps),
+// and API_<NAME>_DEPRECATION_LINK, so a deprecation can be announced without
+// a code change
+func FromEnv(name string) *Version {
+	prefix := "API_" + strings.ToUpper(name) + "_"
+	return &Version{
+		Name:        name,
+		Deprecation: envTime(prefix + "DEPRECATION"),
+		Sunset:      envTime(prefix + "SUNSET"),
+		Link:        os.Getenv(prefix + "DEPRECATION_LINK"),
+	}
+}
+
+func envTime(key string) time.Time {
+	v := os.Getenv(key)
+	if v == "" {
+		return time.Time{}
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t
+		}
+	}
+	slog.Warn("Ignoring invalid setting", "key", key, "value", v, "expected", "a date such as 2025-06-30")
+	return time.Time{}
+}
+
+// Prefix is the path prefix the version's routes are served under
+func (v *Version) Prefix() string {
+	return "/api/" + v.Name
+}
+
+// Handle registers h on mux under the version's prefix. pattern uses the
+// ServeMux syntax relative to the prefix, e.g. "POST /generate".
+func (v *Version) Handle(mux *http.ServeMux, pattern string, h http.Handler) {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		method, path = "", pattern
+	} else {
+		method += " "
+	}
+	mux.Handle(method+v.Prefix()+path, v.Middleware(h))
+}
+
+// Middleware labels responses with the version and its deprecation schedule
+func (v *Version) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-Version", v.Name)
+		setDeprecationHeaders(w.Header(), v.Deprecation, v.Sunset, v.Link, "deprecation")
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Legacy marks a route kept for compatibility after moving under a versioned
+// prefix. Responses point clients at the successor path.
+func Legacy(h http.Handler, since time.Time, successor string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setDeprecationHeaders(w.Header(), since, time.Time{}, successor, "successor-version")
+		h.ServeHTTP(w, r)
+	})
+}
+
+func setDeprecationHeaders(h http.Header, deprecation, sunset time.Time, link, rel string) {
+	if !deprecation.IsZero() {
+		h.Set("Deprecation", fmt.Sprintf("@%d", deprecation.Unix()))
+	}
+	if !sunset.IsZero() {
+		h.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+	if link != "" && (!deprecation.IsZero() || !sunset.IsZero()) {
+		h.Add("Link", fmt.Sprintf("<%s>; rel=%q", link, rel))
+	}
+}
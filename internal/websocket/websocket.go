@@ -0,0 +1,285 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455) with just enough surface for JSON message exchange.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message opcodes
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+)
+
+// Close status codes
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+	closeNoStatusPresent = 1005
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrClosed is returned by reads after the peer has closed the connection
+var ErrClosed = errors.New("websocket: connection closed")
+
+// Upgrader performs the opening handshake
+type Upgrader struct {
+	// MaxMessageSize limits the size of a reassembled message. Zero means 1MB.
+	MaxMessageSize int64
+	// CheckOrigin rejects the handshake when it returns false. Nil allows all origins.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Conn is an established WebSocket connection. Writes are safe for concurrent
+// use; reads must happen from a single goroutine.
+type Conn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	maxSize int64
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// Upgrade completes the handshake and takes over the underlying connection
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: method must be GET")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected WebSocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing key")
+	}
+	if u.CheckOrigin != nil && !u.CheckOrigin(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return nil, errors.New("websocket: origin not allowed")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket unsupported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response does not support hijacking")
+	}
+	netConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	handshake := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	netConn.SetDeadline(time.Time{})
+	if _, err := netConn.Write([]byte(handshake)); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	maxSize := u.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = 1 << 20
+	}
+	return &Conn{conn: netConn, br: rw.Reader, maxSize: maxSize}, nil
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message, answering pings and
+// close frames along the way
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var opcode int
+	var message []byte
+
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case PingMessage:
+			if err := c.WriteMessage(PongMessage, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			code := closeNoStatusPresent
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			if code == closeNoStatusPresent {
+				c.WriteClose(CloseNormal, "")
+			} else {
+				c.WriteClose(code, "")
+			}
+			c.conn.Close()
+			return 0, nil, ErrClosed
+		case 0:
+			if opcode == 0 {
+				c.WriteClose(CloseProtocolError, "unexpected continuation frame")
+				return 0, nil, errors.New("websocket: unexpected continuation frame")
+			}
+		case TextMessage, BinaryMessage:
+			if opcode != 0 {
+				c.WriteClose(CloseProtocolError, "expected continuation frame")
+				return 0, nil, errors.New("websocket: expected continuation frame")
+			}
+			opcode = op
+		default:
+			c.WriteClose(CloseProtocolError, "unknown opcode")
+			return 0, nil, fmt.Errorf("websocket: unknown opcode %d", op)
+		}
+
+		if int64(len(message)+len(payload)) > c.maxSize {
+			c.WriteClose(CloseMessageTooBig, "message too big")
+			return 0, nil, errors.New("websocket: message too big")
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	if header[0]&0x70 != 0 {
+		c.WriteClose(CloseProtocolError, "reserved bits set")
+		return false, 0, nil, errors.New("websocket: reserved bits set")
+	}
+	opcode := int(header[0] & 0x0f)
+	masked := header[1]&0x80 != 0
+	if !masked {
+		c.WriteClose(CloseProtocolError, "client frames must be masked")
+		return false, 0, nil, errors.New("websocket: unmasked client frame")
+	}
+
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if opcode >= CloseMessage && (length > 125 || !fin) {
+		c.WriteClose(CloseProtocolError, "invalid control frame")
+		return false, 0, nil, errors.New("websocket: invalid control frame")
+	}
+	if length < 0 || length > c.maxSize {
+		c.WriteClose(CloseMessageTooBig, "message too big")
+		return false, 0, nil, errors.New("websocket: frame too big")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends a single unfragmented frame
+func (c *Conn) WriteMessage(opcode int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	frame := make([]byte, 0, len(data)+10)
+	frame = append(frame, 0x80|byte(opcode))
+	switch {
+	case len(data) < 126:
+		frame = append(frame, byte(len(data)))
+	case len(data) <= 0xffff:
+		frame = append(frame, 126, byte(len(data)>>8), byte(len(data)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(data)))
+	}
+	frame = append(frame, data...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(frame)
+	if opcode == CloseMessage {
+		c.closed = true
+	}
+	return err
+}
+
+// WriteClose sends a close frame with the given status code and reason
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	return c.WriteMessage(CloseMessage, append(payload, reason...))
+}
+
+// Close sends a normal close frame and closes the underlying connection
+func (c *Conn) Close() error {
+	c.WriteClose(CloseNormal, "")
+	return c.conn.Close()
+}
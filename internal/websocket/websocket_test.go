@@ -0,0 +1,323 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// clientFrame builds a frame as a client sends it, masked unless told not to
+func clientFrame(fin bool, opcode int, payload []byte, masked bool) []byte {
+	var frame []byte
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+	frame = append(frame, first)
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// serverFrame is a frame the server sent
+type serverFrame struct {
+	opcode  int
+	payload []byte
+}
+
+// readServerFrames parses the unmasked frames the server wrote
+func readServerFrames(t *testing.T, data []byte) []serverFrame {
+	t.Helper()
+	var frames []serverFrame
+	for len(data) > 0 {
+		if len(data) < 2 {
+			t.Fatalf("truncated frame header: %x", data)
+		}
+		opcode := int(data[0] & 0x0f)
+		length := int(data[1] & 0x7f)
+		data = data[2:]
+		switch length {
+		case 126:
+			length = int(binary.BigEndian.Uint16(data))
+			data = data[2:]
+		case 127:
+			length = int(binary.BigEndian.Uint64(data))
+			data = data[8:]
+		}
+		frames = append(frames, serverFrame{opcode: opcode, payload: data[:length]})
+		data = data[length:]
+	}
+	return frames
+}
+
+// pipeConn returns a Conn reading input as the client's bytes, and a func
+// that closes it and returns what the server wrote back
+func pipeConn(input []byte, maxSize int64) (*Conn, func() []byte) {
+	server, client := net.Pipe()
+	written := make(chan []byte, 1)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, client)
+		written <- buf.Bytes()
+	}()
+	go func() {
+		client.Write(input)
+	}()
+	conn := &Conn{conn: server, br: bufio.NewReader(server), maxSize: maxSize}
+	return conn, func() []byte {
+		server.Close()
+		return <-written
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	long := bytes.Repeat([]byte("a"), 300)
+	tests := []struct {
+		name     string
+		frames   [][]byte
+		maxSize  int64
+		opcode   int
+		message  string
+		err      string
+		response []serverFrame
+	}{
+		{
+			name:    "text",
+			frames:  [][]byte{clientFrame(true, TextMessage, []byte(`{"id":"1"}`), true)},
+			opcode:  TextMessage,
+			message: `{"id":"1"}`,
+		},
+		{
+			name:    "extended length",
+			frames:  [][]byte{clientFrame(true, BinaryMessage, long, true)},
+			opcode:  BinaryMessage,
+			message: string(long),
+		},
+		{
+			name: "fragmented with a ping between",
+			frames: [][]byte{
+				clientFrame(false, TextMessage, []byte("hel"), true),
+				clientFrame(true, PingMessage, []byte("p"), true),
+				clientFrame(true, 0, []byte("lo"), true),
+			},
+			opcode:   TextMessage,
+			message:  "hello",
+			response: []serverFrame{{opcode: PongMessage, payload: []byte("p")}},
+		},
+		{
+			name:     "unmasked",
+			frames:   [][]byte{clientFrame(true, TextMessage, []byte("x"), false)},
+			err:      "unmasked client frame",
+			response: []serverFrame{{opcode: CloseMessage, payload: closePayload(CloseProtocolError, "client frames must be masked")}},
+		},
+		{
+			name:     "frame too big",
+			frames:   [][]byte{clientFrame(true, TextMessage, long, true)},
+			maxSize:  100,
+			err:      "frame too big",
+			response: []serverFrame{{opcode: CloseMessage, payload: closePayload(CloseMessageTooBig, "message too big")}},
+		},
+		{
+			name: "message too big",
+			frames: [][]byte{
+				clientFrame(false, TextMessage, long[:80], true),
+				clientFrame(true, 0, long[:80], true),
+			},
+			maxSize:  100,
+			err:      "message too big",
+			response: []serverFrame{{opcode: CloseMessage, payload: closePayload(CloseMessageTooBig, "message too big")}},
+		},
+		{
+			name:     "continuation first",
+			frames:   [][]byte{clientFrame(true, 0, []byte("x"), true)},
+			err:      "unexpected continuation frame",
+			response: []serverFrame{{opcode: CloseMessage, payload: closePayload(CloseProtocolError, "unexpected continuation frame")}},
+		},
+		{
+			name:     "fragmented control frame",
+			frames:   [][]byte{clientFrame(false, PingMessage, []byte("x"), true)},
+			err:      "invalid control frame",
+			response: []serverFrame{{opcode: CloseMessage, payload: closePayload(CloseProtocolError, "invalid control frame")}},
+		},
+		{
+			name:     "close",
+			frames:   [][]byte{clientFrame(true, CloseMessage, closePayload(CloseGoingAway, "bye"), true)},
+			err:      ErrClosed.Error(),
+			response: []serverFrame{{opcode: CloseMessage, payload: closePayload(CloseGoingAway, "")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxSize := tt.maxSize
+			if maxSize == 0 {
+				maxSize = 1 << 20
+			}
+			conn, finish := pipeConn(bytes.Join(tt.frames, nil), maxSize)
+			opcode, message, err := conn.ReadMessage()
+			response := readServerFrames(t, finish())
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("ReadMessage: %v", err)
+				}
+				if opcode != tt.opcode || string(message) != tt.message {
+					t.Errorf("got (%d, %q), want (%d, %q)", opcode, message, tt.opcode, tt.message)
+				}
+			}
+			if len(response) != len(tt.response) {
+				t.Fatalf("server sent %d frames, want %d", len(response), len(tt.response))
+			}
+			for i, f := range response {
+				if f.opcode != tt.response[i].opcode || !bytes.Equal(f.payload, tt.response[i].payload) {
+					t.Errorf("frame %d = (%d, %q), want (%d, %q)", i, f.opcode, f.payload, tt.response[i].opcode, tt.response[i].payload)
+				}
+			}
+		})
+	}
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+func TestWriteMessageLengths(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		server, client := net.Pipe()
+		written := make(chan []byte, 1)
+		go func() {
+			data, _ := io.ReadAll(client)
+			written <- data
+		}()
+		conn := &Conn{conn: server, br: bufio.NewReader(server), maxSize: 1 << 20}
+		payload := bytes.Repeat([]byte("b"), n)
+		if err := conn.WriteMessage(BinaryMessage, payload); err != nil {
+			t.Fatalf("WriteMessage(%d bytes): %v", n, err)
+		}
+		server.Close()
+		frames := readServerFrames(t, <-written)
+		if len(frames) != 1 || frames[0].opcode != BinaryMessage || !bytes.Equal(frames[0].payload, payload) {
+			t.Errorf("%d bytes: got %d frames", n, len(frames))
+		}
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	conn, finish := pipeConn(nil, 1<<20)
+	if err := conn.WriteClose(CloseNormal, ""); err != nil {
+		t.Fatalf("WriteClose: %v", err)
+	}
+	if err := conn.WriteMessage(TextMessage, []byte("late")); err != ErrClosed {
+		t.Errorf("WriteMessage after close = %v, want ErrClosed", err)
+	}
+	finish()
+}
+
+func TestUpgrade(t *testing.T) {
+	upgrader := &Upgrader{CheckOrigin: func(r *http.Request) bool {
+		return r.Header.Get("Origin") != "https://evil.example"
+	}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		opcode, message, err := conn.ReadMessage()
+		if err == nil {
+			conn.WriteMessage(opcode, message)
+		}
+	}))
+	defer srv.Close()
+
+	handshake := func(t *testing.T, headers string) (*http.Response, net.Conn, *bufio.Reader) {
+		t.Helper()
+		c, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		_, err = io.WriteString(c, "GET / HTTP/1.1\r\nHost: "+srv.Listener.Addr().String()+"\r\n"+headers+"\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, c, br
+	}
+	const upgrade = "Connection: keep-alive, Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n"
+
+	t.Run("echo", func(t *testing.T) {
+		resp, c, br := handshake(t, upgrade+"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n")
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("status = %d, want 101", resp.StatusCode)
+		}
+		// The example from RFC 6455 section 1.3
+		if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			t.Errorf("Sec-WebSocket-Accept = %q", got)
+		}
+		c.Write(clientFrame(true, TextMessage, []byte("ping?"), true))
+		var header [2]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			t.Fatal(err)
+		}
+		payload := make([]byte, header[1]&0x7f)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			t.Fatal(err)
+		}
+		if header[0] != 0x80|TextMessage || string(payload) != "ping?" {
+			t.Errorf("echo = (%#x, %q)", header[0], payload)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		headers string
+		status  int
+	}{
+		{"missing key", upgrade, http.StatusBadRequest},
+		{"not an upgrade", "Sec-WebSocket-Key: x\r\n", http.StatusBadRequest},
+		{"old version", "Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 8\r\nSec-WebSocket-Key: x\r\n", http.StatusUpgradeRequired},
+		{"origin refused", upgrade + "Sec-WebSocket-Key: x\r\nOrigin: https://evil.example\r\n", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _, _ := handshake(t, tt.headers)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}